@@ -0,0 +1,31 @@
+// Package adminui embeds a small admin web UI for listing, searching and
+// viewing customers, reviewing duplicates and downloading exports, so that
+// small deployments need no separate admin frontend. The UI calls the
+// service's own API, with the credentials the browser signed in with.
+package adminui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Prefix is the path the UI is served under.
+const Prefix = "/admin/ui/"
+
+// Handler serves the UI under Prefix.
+func Handler() http.Handler {
+	files, _ := fs.Sub(static, "static")
+	fileServer := http.StripPrefix(Prefix, http.FileServerFS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Pages show customer data, so they are not cached by proxies, and
+		// may not be framed.
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,31 @@
+package adminui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	for path, contains := range map[string]string{
+		Prefix:             "<title>User service admin</title>",
+		Prefix + "app.js":  "/customers/search?",
+		Prefix + "app.css": "body",
+		Prefix + "missing": "404",
+	} {
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if !strings.Contains(w.Body.String(), contains) {
+			t.Errorf("Expected %v to contain %q, received %v %v", path, contains, w.Code, w.Body)
+		}
+		if w.Code == http.StatusOK && w.Header().Get("Cache-Control") != "private, no-cache" {
+			t.Errorf("Expected %v not cached by proxies, received %v", path, w.Header())
+		}
+	}
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", Prefix+"index.html", nil))
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected index.html redirected to the directory, received %v", w.Code)
+	}
+}
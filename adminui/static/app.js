@@ -0,0 +1,142 @@
+// The admin UI renders the service's own API. Requests are same origin, so
+// the browser sends the credentials it signed in to /admin/ui with.
+"use strict";
+
+const api = "../..";
+const pageSize = 20;
+let page = 1;
+let query = "";
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function text(tag, value) {
+  const el = document.createElement(tag);
+  el.textContent = value == null ? "" : value;
+  return el;
+}
+
+async function get(path) {
+  const res = await fetch(api + path, { headers: { Accept: "application/json" } });
+  const body = await res.json();
+  if (!res.ok) {
+    throw new Error(body.error || res.statusText);
+  }
+  return body;
+}
+
+function embedded(body, name) {
+  return (body._embedded && body._embedded[name]) || [];
+}
+
+function show(view) {
+  for (const v of ["customers-view", "customer-view", "duplicates-view"]) {
+    $(v).hidden = v !== view;
+  }
+  $("error").hidden = true;
+}
+
+function fail(err) {
+  $("error").textContent = err.message;
+  $("error").hidden = false;
+}
+
+async function listCustomers() {
+  show("customers-view");
+  const path = query
+    ? "/customers/search?" + query
+    : "/customers?sort=createdAt&order=desc&page=" + page + "&size=" + pageSize;
+  const customers = embedded(await get(path), "customer");
+  const rows = customers.map((c) => {
+    const tr = document.createElement("tr");
+    const link = text("a", c.username);
+    link.href = "#customer/" + encodeURIComponent(c.id);
+    const td = document.createElement("td");
+    td.append(link);
+    tr.append(td, text("td", c.firstName + " " + c.lastName), text("td", c.email), text("td", c.createdAt));
+    return tr;
+  });
+  $("customers").replaceChildren(...rows);
+  $("page").textContent = query ? customers.length + " found" : "Page " + page;
+  $("previous").disabled = query !== "" || page === 1;
+  $("next").disabled = query !== "" || customers.length < pageSize;
+}
+
+async function viewCustomer(id) {
+  show("customer-view");
+  const path = "/customers/" + encodeURIComponent(id);
+  const [c, addresses, cards] = await Promise.all([
+    get(path),
+    get(path + "/addresses"),
+    get(path + "/cards"),
+  ]);
+  $("customer-name").textContent = c.firstName + " " + c.lastName;
+  const fields = ["id", "username", "email", "tags", "createdAt", "lastLoginAt"];
+  $("customer").replaceChildren(...fields.flatMap((f) => [text("dt", f), text("dd", c[f])]));
+  $("addresses").replaceChildren(
+    ...embedded(addresses, "address").map((a) => text("li", [a.number, a.street, a.city, a.postcode, a.country].join(" ")))
+  );
+  $("cards").replaceChildren(
+    ...embedded(cards, "card").map((k) => text("li", k.longNum + " expires " + k.expires + (k.status ? " (" + k.status + ")" : "")))
+  );
+  $("backup").href = api + "/admin" + path + "/backup";
+}
+
+async function listDuplicates() {
+  show("duplicates-view");
+  const duplicates = embedded(await get("/admin/duplicates"), "duplicate");
+  $("duplicates").replaceChildren(
+    ...duplicates.map((d) => {
+      const tr = document.createElement("tr");
+      const td = document.createElement("td");
+      for (const id of d.userIDs) {
+        const link = text("a", id);
+        link.href = "#customer/" + encodeURIComponent(id);
+        td.append(link, " ");
+      }
+      tr.append(text("td", d.reason), text("td", d.key), td);
+      return tr;
+    })
+  );
+}
+
+function route() {
+  const hash = location.hash.slice(1);
+  let view;
+  if (hash.startsWith("customer/")) {
+    view = viewCustomer(decodeURIComponent(hash.slice("customer/".length)));
+  } else if (hash === "duplicates") {
+    view = listDuplicates();
+  } else {
+    view = listCustomers();
+  }
+  view.catch(fail);
+}
+
+$("search").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const params = new URLSearchParams();
+  for (const [k, v] of new FormData(e.target)) {
+    if (v) {
+      params.set(k, v);
+    }
+  }
+  query = params.toString();
+  listCustomers().catch(fail);
+});
+$("search").addEventListener("reset", () => {
+  query = "";
+  page = 1;
+  setTimeout(() => listCustomers().catch(fail));
+});
+$("previous").addEventListener("click", () => {
+  page--;
+  listCustomers().catch(fail);
+});
+$("next").addEventListener("click", () => {
+  page++;
+  listCustomers().catch(fail);
+});
+window.addEventListener("hashchange", route);
+route();
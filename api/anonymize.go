@@ -0,0 +1,287 @@
+package api
+
+// anonymize.go contains the anonymize-on-read mode, which masks personal
+// data in every read response so that production data can be served to
+// non-production environments.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+var (
+	pseudoFirstNames = []string{"Alex", "Sam", "Jordan", "Taylor", "Morgan", "Casey", "Robin", "Jamie", "Avery", "Riley"}
+	pseudoLastNames  = []string{"Smith", "Jones", "Brown", "Garcia", "Miller", "Davis", "Wilson", "Moore", "Clark", "Lewis"}
+)
+
+// Anonymizer replaces personal data with stable pseudonyms: the same value
+// always maps to the same pseudonym for a given secret, so records can still
+// be correlated.
+type Anonymizer struct {
+	secret []byte
+}
+
+// NewAnonymizer returns an Anonymizer keyed with secret, or with a random
+// secret when none is given.
+func NewAnonymizer(secret string) Anonymizer {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return Anonymizer{secret: key}
+}
+
+func (a Anonymizer) hash(s string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+func (a Anonymizer) token(s string) string {
+	return hex.EncodeToString(a.hash(s)[:6])
+}
+
+func (a Anonymizer) pick(s string, names []string) string {
+	if s == "" {
+		return ""
+	}
+	return names[binary.BigEndian.Uint32(a.hash(s))%uint32(len(names))]
+}
+
+// Email returns a hashed, undeliverable address.
+func (a Anonymizer) Email(e string) string {
+	if e == "" {
+		return ""
+	}
+	return a.token(users.NormalizeEmail(e)) + "@example.invalid"
+}
+
+// Username returns a pseudonym shared by usernames differing only in case.
+func (a Anonymizer) Username(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "user-" + a.token(strings.ToLower(name))
+}
+
+// User masks the user's names, email, credentials and attributes, drops
+// the profile image and keeps only the year of birth.
+func (a Anonymizer) User(u users.User) users.User {
+	u.FirstName = a.pick(u.FirstName, pseudoFirstNames)
+	u.LastName = a.pick(u.LastName, pseudoLastNames)
+	u.Email = a.Email(u.Email)
+	u.EmailNormalized = ""
+	u.Username = a.Username(u.Username)
+	u.UsernameNormalized = ""
+	u.Password = ""
+	u.Salt = ""
+	u.Avatar = ""
+	if u.DateOfBirth != "" {
+		u.DateOfBirth = birthYear(u.DateOfBirth) + "-01-01"
+	}
+	u.Addresses = a.Addresses(u.Addresses)
+	u.Cards = a.Cards(u.Cards)
+	return u
+}
+
+func (a Anonymizer) Users(us []users.User) []users.User {
+	out := make([]users.User, len(us))
+	for k, u := range us {
+		out[k] = a.User(u)
+	}
+	return out
+}
+
+// Address masks the street and number, keeping the area.
+func (a Anonymizer) Address(ad users.Address) users.Address {
+	if ad.Street != "" {
+		ad.Street = a.pick(ad.Street, pseudoLastNames) + " Street"
+	}
+	if ad.Number != "" {
+		ad.Number = "1"
+	}
+	return ad
+}
+
+func (a Anonymizer) Addresses(as []users.Address) []users.Address {
+	if as == nil {
+		return nil
+	}
+	out := make([]users.Address, len(as))
+	for k, ad := range as {
+		out[k] = a.Address(ad)
+	}
+	return out
+}
+
+// Card masks all but the last four digits and the security code.
+func (a Anonymizer) Card(c users.Card) users.Card {
+	if len(c.LongNum) > 4 {
+		c.MaskCC()
+	} else {
+		c.LongNum = strings.Repeat("*", len(c.LongNum))
+	}
+	if c.CCV != "" {
+		c.CCV = "***"
+	}
+	return c
+}
+
+func (a Anonymizer) Cards(cs []users.Card) []users.Card {
+	if cs == nil {
+		return nil
+	}
+	out := make([]users.Card, len(cs))
+	for k, c := range cs {
+		out[k] = a.Card(c)
+	}
+	return out
+}
+
+// Login masks the username, the host part of the address and the device
+// fingerprint.
+func (a Anonymizer) Login(l users.LoginAttempt) users.LoginAttempt {
+	l.Username = a.Username(l.Username)
+	if l.Device != "" {
+		l.Device = "device-" + a.token(l.Device)
+	}
+	if ip := net.ParseIP(l.IP); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			l.IP = v4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			l.IP = ip.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+	return l
+}
+
+func (a Anonymizer) Logins(ls []users.LoginAttempt) []users.LoginAttempt {
+	out := make([]users.LoginAttempt, len(ls))
+	for k, l := range ls {
+		out[k] = a.Login(l)
+	}
+	return out
+}
+
+// Notes replaces the text of each note, which is free-form and cannot be
+// masked, and pseudonymizes its author.
+func (a Anonymizer) Notes(ns []users.Note) []users.Note {
+	out := make([]users.Note, len(ns))
+	for k, n := range ns {
+		n.Author = a.Username(n.Author)
+		n.Text = "note-" + a.token(n.Text)
+		out[k] = n
+	}
+	return out
+}
+
+// Response anonymizes an endpoint response. Responses without personal
+// data are returned unchanged.
+func (a Anonymizer) Response(response interface{}) interface{} {
+	switch r := response.(type) {
+	case EmbedStruct:
+		return EmbedStruct{a.Response(r.Embed)}
+	case pageResponse:
+		// Cursors hold the IDs and sort values of results, so pages are
+		// not linked; they are still served by number.
+		return EmbedStruct{a.Response(r.Embed)}
+	case listResponse:
+		// Streamed lists are not linked either.
+		each := r.Each
+		r.Each = func(f func(interface{}) error) (users.Links, error) {
+			_, err := each(func(v interface{}) error { return f(a.Response(v)) })
+			return nil, err
+		}
+		return r
+	case users.User:
+		return a.User(r)
+	case userResponse:
+		return userResponse{User: a.User(r.User)}
+	case usersResponse:
+		return usersResponse{Users: a.Users(r.Users)}
+	case users.Address:
+		return a.Address(r)
+	case addressesResponse:
+		return addressesResponse{Addresses: a.Addresses(r.Addresses)}
+	case users.Card:
+		return a.Card(r)
+	case cardsResponse:
+		return cardsResponse{Cards: a.Cards(r.Cards)}
+	case loginsResponse:
+		return loginsResponse{Logins: a.Logins(r.Logins)}
+	case notesResponse:
+		r.Embed.Notes = a.Notes(r.Embed.Notes)
+		return r
+	case duplicatesResponse:
+		ds := make([]db.Duplicate, len(r.Embed.Duplicates))
+		for k, d := range r.Embed.Duplicates {
+			d.Key = a.token(d.Key)
+			ds[k] = d
+		}
+		r.Embed.Duplicates = ds
+		return r
+	case Backup:
+		return a.Backup(r)
+	case exportResponse:
+		each := r.Each
+		// Cursors encode user IDs, so anonymized exports cannot be resumed.
+		r.Each = func(f func(users.User, string) error) error {
+			return each(func(u users.User, _ string) error { return f(a.User(u), "") })
+		}
+		return r
+	}
+	return response
+}
+
+// Backup anonymizes a backup like User, so that every field User masks is
+// masked in backups too. Credentials are dropped, so restored accounts
+// cannot log in. Backups that are not valid are replaced with empty ones.
+func (a Anonymizer) Backup(b Backup) Backup {
+	u, err := b.User()
+	if err != nil {
+		return Backup{}
+	}
+	return newBackup(a.User(u), a.Logins(b.Logins), b.Created)
+}
+
+// Middleware anonymizes the responses of the wrapped endpoint.
+func (a Anonymizer) Middleware(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := next(ctx, request)
+		return a.Response(response), err
+	}
+}
+
+// Anonymized returns a copy of e whose read endpoints anonymize their
+// responses.
+func (e Endpoints) Anonymized(a Anonymizer) Endpoints {
+	e.LoginEndpoint = a.Middleware(e.LoginEndpoint)
+	e.LoginVerifyEndpoint = a.Middleware(e.LoginVerifyEndpoint)
+	e.UserGetEndpoint = a.Middleware(e.UserGetEndpoint)
+	e.UserSearchEndpoint = a.Middleware(e.UserSearchEndpoint)
+	e.ExportEndpoint = a.Middleware(e.ExportEndpoint)
+	e.DuplicatesEndpoint = a.Middleware(e.DuplicatesEndpoint)
+	e.AddressGetEndpoint = a.Middleware(e.AddressGetEndpoint)
+	e.CardGetEndpoint = a.Middleware(e.CardGetEndpoint)
+	e.LoginsGetEndpoint = a.Middleware(e.LoginsGetEndpoint)
+	e.NotesGetEndpoint = a.Middleware(e.NotesGetEndpoint)
+	e.CustomerAddressesGetEndpoint = a.Middleware(e.CustomerAddressesGetEndpoint)
+	e.CustomerCardsGetEndpoint = a.Middleware(e.CustomerCardsGetEndpoint)
+	e.BackupGetEndpoint = a.Middleware(e.BackupGetEndpoint)
+	// Profile images cannot be masked, so none are served.
+	e.AvatarGetEndpoint = func(context.Context, interface{}) (interface{}, error) {
+		return nil, ErrAvatarNotFound
+	}
+	return e
+}
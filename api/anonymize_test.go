@@ -0,0 +1,84 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/users"
+)
+
+func TestAnonymizeUser(t *testing.T) {
+	a := NewAnonymizer("secret")
+	u := users.User{
+		FirstName:   "Eve",
+		LastName:    "Berger",
+		Email:       "eve@example.com",
+		Username:    "Eve_Berger",
+		Password:    "hash",
+		DateOfBirth: "1990-05-17",
+		Cards:       []users.Card{{LongNum: "5953580604169678", CCV: "678"}},
+		Addresses:   []users.Address{{Street: "Whitelees Road", Number: "246", City: "Glasgow"}},
+	}
+	got := a.User(u)
+	if got.FirstName == "Eve" || got.LastName == "Berger" || got.Username == "Eve_Berger" {
+		t.Errorf("Expected names to be pseudonymized, received %+v", got)
+	}
+	if !strings.HasSuffix(got.Email, "@example.invalid") || got.Password != "" {
+		t.Errorf("Expected email hashed and password dropped, received %+v", got)
+	}
+	if got.DateOfBirth != "1990-01-01" {
+		t.Errorf("Expected only the year of birth kept, received %v", got.DateOfBirth)
+	}
+	if got.Cards[0].LongNum != "************9678" || got.Cards[0].CCV != "***" {
+		t.Errorf("Expected card masked, received %+v", got.Cards[0])
+	}
+	if got.Addresses[0].Street == "Whitelees Road" || got.Addresses[0].City != "Glasgow" {
+		t.Errorf("Expected street masked and city kept, received %+v", got.Addresses[0])
+	}
+	if u.Cards[0].LongNum != "5953580604169678" {
+		t.Error("Expected original user to be left untouched")
+	}
+	if again := a.User(u); again.FirstName != got.FirstName || again.Email != got.Email {
+		t.Error("Expected stable pseudonyms")
+	}
+}
+
+func TestAnonymizeResponse(t *testing.T) {
+	a := NewAnonymizer("secret")
+	r := a.Response(EmbedStruct{usersResponse{Users: []users.User{{Username: "eve"}}}})
+	if u := r.(EmbedStruct).Embed.(usersResponse).Users[0]; u.Username == "eve" {
+		t.Error("Expected embedded users to be anonymized")
+	}
+	l := a.Login(users.LoginAttempt{Username: "eve", IP: "10.1.2.3", Device: "3f9a2c"})
+	if l.IP != "10.1.2.0" || l.Username != a.Username("EVE") || l.Device != "device-"+a.token("3f9a2c") {
+		t.Errorf("Expected masked login, received %+v", l)
+	}
+	if s := a.Response(statusResponse{Status: true}); s != (statusResponse{Status: true}) {
+		t.Error("Expected responses without personal data to be unchanged")
+	}
+}
+
+func TestAnonymizeBackup(t *testing.T) {
+	a := NewAnonymizer("secret")
+	b := newBackup(users.User{
+		UserID:      "u1",
+		Username:    "eve",
+		Password:    "hash",
+		Salt:        "salt",
+		DateOfBirth: "1990-05-17",
+		Avatar:      "avatars/u1",
+		Cards:       []users.Card{{LongNum: "5953580604169678"}},
+	}, []users.LoginAttempt{{IP: "10.1.2.3"}}, time.Now())
+	got := a.Backup(b)
+	c := got.Customer
+	if c.Username == "eve" || c.Password != "" || c.Salt != "" || c.DateOfBirth != "1990-01-01" || c.Avatar != "" {
+		t.Errorf("Expected the customer masked like a user, received %+v", c)
+	}
+	if got.Cards[0].LongNum != "************9678" || got.Logins[0].IP != "10.1.2.0" {
+		t.Errorf("Expected cards and logins masked, received %+v", got)
+	}
+	if got.Version != backupVersion || c.ID != "u1" {
+		t.Errorf("Expected a restorable backup, received %+v", got)
+	}
+}
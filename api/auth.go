@@ -0,0 +1,267 @@
+package api
+
+// auth.go contains the authentication middleware enforcing, per route, the
+// access level declared in a startup policy, and asking an authorizer, if
+// any, whether the caller may make the request.
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mikesay/user/authz"
+	"github.com/mikesay/user/users"
+)
+
+var (
+	ErrForbidden = users.NewError(users.CodeForbidden, "Forbidden")
+)
+
+// ErrAuthzUnavailable refuses requests the authorizer could not decide.
+var ErrAuthzUnavailable = users.NewError(users.CodeAuthzUnavailable, "Authorization unavailable, try again later")
+
+// AuthLevel is the access a route requires.
+type AuthLevel int
+
+const (
+	Anonymous AuthLevel = iota
+	UserAuth
+	AdminAuth
+)
+
+var authLevels = map[string]AuthLevel{
+	"anonymous": Anonymous,
+	"user":      UserAuth,
+	"admin":     AdminAuth,
+}
+
+// Principal is the authenticated caller. ActAs names the admin acting as
+// the user with an impersonation token.
+type Principal struct {
+	UserID   string
+	Username string
+	Admin    bool
+	ActAs    string
+}
+
+// PrincipalFromContext returns the caller authenticated by Auth, if any.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey).(Principal)
+	return p, ok
+}
+
+// AuthRule requires Level on requests matching Method, if set, and Path. In
+// Path a "*" segment matches any one segment and a final "**" any remainder.
+type AuthRule struct {
+	Method string
+	Path   string
+	Level  AuthLevel
+}
+
+func (ar AuthRule) matches(r *http.Request) bool {
+	if ar.Method != "" && !strings.EqualFold(ar.Method, r.Method) {
+		return false
+	}
+	pattern := strings.Split(strings.Trim(ar.Path, "/"), "/")
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for i, seg := range pattern {
+		if seg == "**" && i == len(pattern)-1 {
+			return true
+		}
+		if i >= len(path) || (seg != "*" && seg != path[i]) {
+			return false
+		}
+	}
+	return len(path) == len(pattern)
+}
+
+// AuthPolicy is an ordered list of rules; the first matching rule applies.
+// Requests matching no rule are anonymous.
+type AuthPolicy []AuthRule
+
+// ParseAuthPolicy parses comma separated "[METHOD ]PATH=LEVEL" rules, such
+// as "GET /customers=admin,/admin/**=admin,/customers/**=user".
+func ParseAuthPolicy(s string) (AuthPolicy, error) {
+	p := make(AuthPolicy, 0)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, level, ok := strings.Cut(entry, "=")
+		l, known := authLevels[strings.ToLower(strings.TrimSpace(level))]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid auth rule %q", entry)
+		}
+		rule := AuthRule{Path: strings.TrimSpace(route), Level: l}
+		if method, path, ok := strings.Cut(rule.Path, " "); ok {
+			rule.Method, rule.Path = method, strings.TrimSpace(path)
+		}
+		if !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("invalid auth rule %q", entry)
+		}
+		p = append(p, rule)
+	}
+	return p, nil
+}
+
+// Level returns the level required for r.
+func (p AuthPolicy) Level(r *http.Request) AuthLevel {
+	for _, rule := range p {
+		if rule.matches(r) {
+			return rule.Level
+		}
+	}
+	return Anonymous
+}
+
+// Covers reports whether every request below prefix, such as "/admin",
+// requires at least level: whether a rule requiring it of all methods and
+// ending in "**" matches the whole of prefix before any rule that might
+// match a request below prefix requires less.
+func (p AuthPolicy) Covers(prefix string, level AuthLevel) bool {
+	under := strings.Split(strings.Trim(prefix, "/"), "/")
+	for _, rule := range p {
+		pattern := strings.Split(strings.Trim(rule.Path, "/"), "/")
+		rest := pattern[len(pattern)-1] == "**"
+		if rest {
+			pattern = pattern[:len(pattern)-1]
+		} else if len(pattern) <= len(under) {
+			// The rule only matches paths no longer than prefix.
+			continue
+		}
+		overlaps := true
+		for i := 0; i < len(pattern) && i < len(under); i++ {
+			if pattern[i] != "*" && pattern[i] != under[i] {
+				overlaps = false
+				break
+			}
+		}
+		if !overlaps {
+			continue
+		}
+		if rest && rule.Method == "" && len(pattern) <= len(under) {
+			return rule.Level >= level
+		}
+		if rule.Level < level {
+			return false
+		}
+	}
+	return false
+}
+
+// customerID returns the {id} of routes below /customers/{id}, which users
+// may only call for themselves.
+func customerID(r *http.Request) (string, bool) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/customers/")
+	if !ok {
+		return "", false
+	}
+	id, _, _ := strings.Cut(rest, "/")
+	if id == "" || id == "search" {
+		return "", false
+	}
+	return id, true
+}
+
+// Auth authenticates requests to routes the policy protects. Users sign in
+// with HTTP basic credentials; admins are the users listed in AdminUsers or
+// callers presenting AdminToken as a bearer token. Other bearer tokens are
+// impersonation tokens, acting as users. On routes requiring users, users
+// other than admins may only call the routes below /customers/{id} with
+// their own ID, or that of the user their impersonation token acts as.
+//
+// Authorizer, if set, then decides every request, anonymous ones included.
+// Requests are refused when it cannot decide.
+type Auth struct {
+	Policy     AuthPolicy
+	AdminUsers map[string]bool
+	AdminToken string
+
+	Authorizer authz.Authorizer
+
+	service Service
+}
+
+// NewAuth returns an Auth checking credentials with s.
+func NewAuth(s Service, policy AuthPolicy, adminUsers []string, adminToken string) *Auth {
+	a := &Auth{Policy: policy, AdminUsers: make(map[string]bool), AdminToken: adminToken, service: s}
+	for _, u := range adminUsers {
+		if u = strings.TrimSpace(u); u != "" {
+			a.AdminUsers[strings.ToLower(u)] = true
+		}
+	}
+	return a
+}
+
+func (a *Auth) authenticate(r *http.Request) (Principal, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if a.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) == 1 {
+			return Principal{Admin: true}, nil
+		}
+		return a.service.AuthenticateImpersonation(r.Context(), token)
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return Principal{}, ErrUnauthorized
+	}
+	u, err := a.service.Authenticate(r.Context(), username, password)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{UserID: u.UserID, Username: u.Username, Admin: a.AdminUsers[strings.ToLower(u.Username)]}, nil
+}
+
+// Wrap implements middleware.Interface.
+func (a *Auth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level := a.Policy.Level(r)
+		if level == Anonymous {
+			if err := a.authorize(r, authz.Subject{}); err != nil {
+				encodeError(languageToContext(r.Context(), r), err, w)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := a.authenticate(r)
+		if err != nil {
+			if err == ErrUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="user"`)
+			}
+			encodeError(languageToContext(r.Context(), r), err, w)
+			return
+		}
+		if level == AdminAuth && !p.Admin {
+			encodeError(languageToContext(r.Context(), r), ErrForbidden, w)
+			return
+		}
+		if id, ok := customerID(r); ok && level == UserAuth && !p.Admin && id != p.UserID {
+			encodeError(languageToContext(r.Context(), r), ErrForbidden, w)
+			return
+		}
+		subject := authz.Subject{Authenticated: true, UserID: p.UserID, Username: p.Username, Admin: p.Admin, ActAs: p.ActAs}
+		if err := a.authorize(r, subject); err != nil {
+			encodeError(languageToContext(r.Context(), r), err, w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// authorize asks the authorizer whether subject may make r, failing closed.
+func (a *Auth) authorize(r *http.Request, subject authz.Subject) error {
+	if a.Authorizer == nil {
+		return nil
+	}
+	allowed, err := authz.Authorize(r.Context(), a.Authorizer, authz.NewInput(subject, r))
+	if err != nil {
+		return ErrAuthzUnavailable
+	}
+	if !allowed {
+		return ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mikesay/user/authz"
+	"github.com/mikesay/user/users"
+)
+
+// authService accepts the password "secret" for any user.
+type authService struct {
+	Service
+}
+
+func (authService) Authenticate(ctx context.Context, username, password string) (users.User, error) {
+	if password != "secret" {
+		return users.User{}, ErrUnauthorized
+	}
+	return users.User{UserID: "id-" + username, Username: username}, nil
+}
+
+func (authService) AuthenticateImpersonation(ctx context.Context, token string) (Principal, error) {
+	if token != "impersonation" {
+		return Principal{}, ErrUnauthorized
+	}
+	return Principal{UserID: "id-alice", Username: "alice", ActAs: "boss"}, nil
+}
+
+func TestParseAuthPolicy(t *testing.T) {
+	p, err := ParseAuthPolicy("GET /customers=admin, /customers/**=user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, level := range map[string]AuthLevel{
+		"/customers":          AdminAuth,
+		"/customers/":         AdminAuth,
+		"/customers/1":        UserAuth,
+		"/customers/1/cards":  UserAuth,
+		"/cards":              Anonymous,
+		"/customersearch/abc": Anonymous,
+	} {
+		if l := p.Level(httptest.NewRequest("GET", path, nil)); l != level {
+			t.Errorf("Expected level %v for %v, received %v", level, path, l)
+		}
+	}
+	if l := p.Level(httptest.NewRequest("POST", "/customers", nil)); l != UserAuth {
+		t.Errorf("Expected method specific rule to be skipped, received %v", l)
+	}
+	for _, s := range []string{"/customers", "/customers=root", "customers=user"} {
+		if _, err := ParseAuthPolicy(s); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	p, _ := ParseAuthPolicy("/admin/**=admin,/customers/*=user")
+	a := NewAuth(authService{}, p, []string{"Boss"}, "token")
+	var principal Principal
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFromContext(r.Context())
+	}))
+	cases := []struct {
+		path   string
+		auth   func(r *http.Request)
+		status int
+	}{
+		{"/health", func(*http.Request) {}, http.StatusOK},
+		{"/customers/1", func(*http.Request) {}, http.StatusUnauthorized},
+		{"/customers/1", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized},
+		{"/customers/id-alice", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK},
+		{"/customers/id-bob", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusForbidden},
+		{"/customers/id-bob", func(r *http.Request) { r.SetBasicAuth("boss", "secret") }, http.StatusOK},
+		{"/admin/jobs/1", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusForbidden},
+		{"/admin/jobs/1", func(r *http.Request) { r.SetBasicAuth("boss", "secret") }, http.StatusOK},
+		{"/admin/jobs/1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, http.StatusOK},
+		{"/admin/jobs/1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+		{"/customers/id-alice", func(r *http.Request) { r.Header.Set("Authorization", "Bearer impersonation") }, http.StatusOK},
+		{"/customers/id-bob", func(r *http.Request) { r.Header.Set("Authorization", "Bearer impersonation") }, http.StatusForbidden},
+		{"/admin/jobs/1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer impersonation") }, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		c.auth(r)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.status {
+			t.Errorf("Expected %v for %v, received %v", c.status, c.path, rec.Code)
+		}
+	}
+	r := httptest.NewRequest("GET", "/customers/id-alice", nil)
+	r.SetBasicAuth("alice", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if principal.UserID != "id-alice" || principal.Admin {
+		t.Errorf("Expected alice in the request context, received %+v", principal)
+	}
+	r = httptest.NewRequest("GET", "/customers/id-alice", nil)
+	r.Header.Set("Authorization", "Bearer impersonation")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if principal.UserID != "id-alice" || principal.ActAs != "boss" || principal.Admin {
+		t.Errorf("Expected boss acting as alice in the request context, received %+v", principal)
+	}
+}
+
+func TestAuthPolicyCovers(t *testing.T) {
+	for policy, covers := range map[string]bool{
+		"":                                      false,
+		"/admin/**=admin":                       true,
+		"/**=admin":                             true,
+		"/*/**=admin":                           true,
+		"/customers/**=user,/admin/**=admin":    true,
+		"/admin/**=user":                        false,
+		"GET /admin/**=admin":                   false,
+		"/admin/jobs/**=admin":                  false,
+		"/admin/info=anonymous,/admin/**=admin": false,
+		"/*/info=user,/admin/**=admin":          false,
+		"/admin/jobs=admin,/admin/**=admin":     true,
+		"/admin=anonymous,/admin/**=admin":      true,
+	} {
+		p, err := ParseAuthPolicy(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Covers("/admin", AdminAuth) != covers {
+			t.Errorf("Expected %q covering /admin/** to be %v", policy, covers)
+		}
+	}
+}
+
+// ownerAuthorizer lets customers read only their own resources, and fails
+// on deletes.
+type ownerAuthorizer struct {
+	inputs []authz.Input
+}
+
+func (o *ownerAuthorizer) Authorize(ctx context.Context, in authz.Input) (bool, error) {
+	o.inputs = append(o.inputs, in)
+	if in.Action == authz.Delete {
+		return false, errors.New("engine down")
+	}
+	return !in.Subject.Authenticated || in.Subject.Admin || in.Resource.ID == in.Subject.UserID, nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	p, _ := ParseAuthPolicy("/customers/*=user")
+	a := NewAuth(authService{}, p, nil, "token")
+	o := &ownerAuthorizer{}
+	a.Authorizer = o
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		method, path string
+		auth         func(r *http.Request)
+		status       int
+	}{
+		{"GET", "/health", func(*http.Request) {}, http.StatusOK},
+		{"GET", "/customers/id-alice", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK},
+		{"GET", "/customers/id-bob", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusForbidden},
+		{"GET", "/customers/id-bob", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, http.StatusOK},
+		{"GET", "/customers/id-bob", func(*http.Request) {}, http.StatusUnauthorized},
+		{"DELETE", "/customers/id-alice", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		c.auth(r)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.status {
+			t.Errorf("Expected %v for %v %v, received %v", c.status, c.method, c.path, rec.Code)
+		}
+	}
+	if len(o.inputs) != 4 {
+		t.Fatalf("Expected unauthenticated requests and requests for other customers not to be authorized, received %+v", o.inputs)
+	}
+	in := o.inputs[1]
+	if !in.Subject.Authenticated || in.Subject.Username != "alice" || in.Resource.Type != "customers" || in.Resource.ID != "id-alice" || in.Action != authz.Read {
+		t.Errorf("Unexpected input %+v", in)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+// avatar.go contains the validation of uploaded profile images.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"github.com/mikesay/user/users"
+)
+
+// defaultAvatarMaxBytes bounds uploads when WithAvatars is given no limit.
+const defaultAvatarMaxBytes = 1 << 20
+
+var (
+	ErrAvatarNotFound = users.NewError(users.CodeAvatarNotFound, "Avatar not found")
+	ErrInvalidAvatar  = users.NewError(users.CodeInvalidAvatar, "Avatar must be a PNG, JPEG, GIF or WebP image")
+	ErrAvatarTooLarge = users.NewError(users.CodeAvatarTooLarge, "Avatar is too large")
+	ErrNoAvatarStore  = users.NewError(users.CodeForbidden, "Avatars are not enabled")
+)
+
+// avatarTypes are the media types accepted for avatars, as detected from the
+// image data rather than taken from the client.
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// readAvatar reads an uploaded image of at most maxBytes, returning it with
+// its media type.
+func readAvatar(r io.Reader, maxBytes int64) ([]byte, string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, "", ErrAvatarTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	if !avatarTypes[contentType] {
+		return nil, "", ErrInvalidAvatar
+	}
+	return data, contentType, nil
+}
+
+// avatarKey returns the blob key of a user's image. Keys name the content,
+// so a replaced image gets a new key and URL.
+func avatarKey(id string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return "avatars/" + id + "/" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mikesay/user/blobs"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestReadAvatar(t *testing.T) {
+	data, contentType, err := readAvatar(bytes.NewReader(testPNG), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "image/png" || len(data) != len(testPNG) {
+		t.Errorf("Expected a PNG, received %v", contentType)
+	}
+	if _, _, err := readAvatar(bytes.NewReader(testPNG), 10); err != ErrAvatarTooLarge {
+		t.Errorf("Expected too large error, received %v", err)
+	}
+	if _, _, err := readAvatar(strings.NewReader("<svg></svg>"), 100); err != ErrInvalidAvatar {
+		t.Errorf("Expected invalid type error, received %v", err)
+	}
+}
+
+// avatarDB holds a single user in memory.
+type avatarDB struct {
+	db.Database
+	user users.User
+}
+
+func (d *avatarDB) GetUser(id string) (users.User, error) {
+	if id != d.user.UserID {
+		return users.User{}, users.ErrUserNotFound
+	}
+	return d.user, nil
+}
+
+func (d *avatarDB) UpdateAvatar(id, key string) error {
+	d.user.Avatar = key
+	return nil
+}
+
+func TestPutAvatar(t *testing.T) {
+	prev := db.DefaultDb
+	db.DefaultDb = &avatarDB{user: users.User{UserID: "a"}}
+	defer func() { db.DefaultDb = prev }()
+
+	store := blobs.Dir(t.TempDir())
+	s := NewFixedService(WithAvatars(store, 0))
+	ctx := context.Background()
+	url, err := s.PutAvatar(ctx, "a", bytes.NewReader(testPNG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(url, "/customers/a/avatar?v="+strings.TrimPrefix(avatarKey("a", testPNG), "avatars/a/")) {
+		t.Errorf("Expected versioned avatar URL, received %v", url)
+	}
+	b, err := s.GetAvatar(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ContentType != "image/png" {
+		t.Errorf("Expected stored PNG, received %v", b.ContentType)
+	}
+
+	old := avatarKey("a", testPNG)
+	other := append(append([]byte{}, testPNG...), 0)
+	if _, err := s.PutAvatar(ctx, "a", bytes.NewReader(other)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, old); err != blobs.ErrNotFound {
+		t.Errorf("Expected replaced avatar to be deleted, received %v", err)
+	}
+	if _, err := NewFixedService().GetAvatar(ctx, "a"); err != ErrAvatarNotFound {
+		t.Errorf("Expected no avatar without a store, received %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+// backup.go contains the archive format used to back up and restore a single
+// customer. Unlike the regular responses it carries every stored field, so
+// that a restored account keeps its IDs and can still log in.
+
+import (
+	"time"
+
+	"github.com/mikesay/user/users"
+)
+
+const backupVersion = 1
+
+var (
+	ErrInvalidBackup = users.NewError(users.CodeInvalidBackup, "Invalid backup")
+)
+
+// Backup is a self-contained copy of a customer, its addresses and cards,
+// and its login history.
+type Backup struct {
+	Version   int                  `json:"version"`
+	Created   time.Time            `json:"created"`
+	Customer  BackupCustomer       `json:"customer"`
+	Addresses []users.Address      `json:"addresses"`
+	Cards     []users.Card         `json:"cards"`
+	Logins    []users.LoginAttempt `json:"logins"`
+}
+
+// BackupCustomer holds all stored fields of a customer.
+type BackupCustomer struct {
+	ID        string    `json:"id"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	Email     string    `json:"email"`
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	Salt      string    `json:"salt"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	LastLogin time.Time `json:"lastLogin"`
+	// Residency, DateOfBirth, Tags and Avatar are left out of backups
+	// taken before they were added.
+	Residency   string   `json:"residency,omitempty"`
+	DateOfBirth string   `json:"dateOfBirth,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Avatar is the blob key of the profile image. The image itself is
+	// not backed up, so it is restored only while the blob is kept.
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// newBackup builds a Backup from a user with resolved attributes.
+func newBackup(u users.User, logins []users.LoginAttempt, now time.Time) Backup {
+	b := Backup{
+		Version: backupVersion,
+		Created: now,
+		Customer: BackupCustomer{
+			ID:          u.UserID,
+			FirstName:   u.FirstName,
+			LastName:    u.LastName,
+			Email:       u.Email,
+			Username:    u.Username,
+			Password:    u.Password,
+			Salt:        u.Salt,
+			CreatedAt:   u.CreatedAt,
+			UpdatedAt:   u.UpdatedAt,
+			LastLogin:   u.LastLogin,
+			Residency:   u.Residency,
+			DateOfBirth: u.DateOfBirth,
+			Tags:        append([]string(nil), u.Tags...),
+			Avatar:      u.Avatar,
+		},
+		Addresses: append(make([]users.Address, 0, len(u.Addresses)), u.Addresses...),
+		Cards:     append(make([]users.Card, 0, len(u.Cards)), u.Cards...),
+		Logins:    logins,
+	}
+	if b.Logins == nil {
+		b.Logins = make([]users.LoginAttempt, 0)
+	}
+	return b
+}
+
+// User returns the customer held in the backup.
+func (b Backup) User() (users.User, error) {
+	if b.Version != backupVersion || b.Customer.ID == "" || b.Customer.Username == "" {
+		return users.User{}, ErrInvalidBackup
+	}
+	c := b.Customer
+	return users.User{
+		UserID:      c.ID,
+		FirstName:   c.FirstName,
+		LastName:    c.LastName,
+		Email:       c.Email,
+		Username:    c.Username,
+		Password:    c.Password,
+		Salt:        c.Salt,
+		CreatedAt:   c.CreatedAt,
+		UpdatedAt:   c.UpdatedAt,
+		LastLogin:   c.LastLogin,
+		Residency:   c.Residency,
+		DateOfBirth: c.DateOfBirth,
+		Tags:        append([]string(nil), c.Tags...),
+		Avatar:      c.Avatar,
+		Addresses:   append(make([]users.Address, 0, len(b.Addresses)), b.Addresses...),
+		Cards:       append(make([]users.Card, 0, len(b.Cards)), b.Cards...),
+	}, nil
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/users"
+)
+
+func TestBackupRoundTrip(t *testing.T) {
+	u := users.New()
+	u.UserID = "57a98d98e4b00679b4a830af"
+	u.Username = "eve"
+	u.Email = "eve@example.com"
+	u.Password = "hash"
+	u.Residency = "eu"
+	u.DateOfBirth = "1990-04-01"
+	u.Tags = []string{"vip"}
+	u.Avatar = "avatars/57a98d98e4b00679b4a830af/abc.png"
+	u.Addresses = append(u.Addresses, users.Address{ID: "57a98d98e4b00679b4a830ad", Street: "street"})
+	u.Cards = append(u.Cards, users.Card{ID: "57a98d98e4b00679b4a830ae", LongNum: "1234"})
+
+	b := newBackup(u, nil, time.Now())
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Backup
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := decoded.User()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"UserID", "Username", "Email", "Password", "Salt", "Residency", "DateOfBirth", "Tags", "Avatar", "Addresses", "Cards"} {
+		got := reflect.ValueOf(restored).FieldByName(f).Interface()
+		want := reflect.ValueOf(u).FieldByName(f).Interface()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v to survive the round trip, received %v", f, got)
+		}
+	}
+}
+
+func TestBackupInvalid(t *testing.T) {
+	if _, err := (Backup{}).User(); err != ErrInvalidBackup {
+		t.Error("Expected invalid backup error for empty backup")
+	}
+	b := newBackup(users.User{UserID: "1", Username: "eve"}, nil, time.Now())
+	b.Version = 99
+	if _, err := b.User(); err != ErrInvalidBackup {
+		t.Error("Expected invalid backup error for unknown version")
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+// confirm.go contains the signed tokens used to confirm destructive
+// operations. Tokens are stateless so any replica sharing the secret can
+// verify them.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/users"
+)
+
+var (
+	ErrConfirmationRequired = users.NewError(users.CodeConfirmationRequired, "Confirmation required")
+	ErrInvalidConfirmation  = users.NewError(users.CodeInvalidConfirmation, "Invalid or expired confirmation")
+)
+
+// DeletePlan describes what a confirmed delete will remove.
+type DeletePlan struct {
+	Entity    string    `json:"entity"`
+	ID        string    `json:"id"`
+	Addresses int       `json:"addresses"`
+	Cards     int       `json:"cards"`
+	Token     string    `json:"token"`
+	Expires   time.Time `json:"expires"`
+}
+
+type confirmer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// newConfirmer returns a confirmer signing with secret, or with a random
+// secret when none is given.
+func newConfirmer(secret string, ttl time.Duration) *confirmer {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &confirmer{secret: key, ttl: ttl}
+}
+
+func (c *confirmer) sign(entity, id string, expires int64) string {
+	mac := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(mac, "%v/%v/%v", entity, id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// token returns a token confirming the delete of entity id and its expiry.
+func (c *confirmer) token(entity, id string, now time.Time) (string, time.Time) {
+	expires := now.Add(c.ttl).Truncate(time.Second)
+	return fmt.Sprintf("%v.%v", expires.Unix(), c.sign(entity, id, expires.Unix())), expires
+}
+
+// verify checks that token confirms the delete of entity id at now.
+func (c *confirmer) verify(entity, id, token string, now time.Time) error {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return ErrInvalidConfirmation
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return ErrInvalidConfirmation
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(c.sign(entity, id, expires))) {
+		return ErrInvalidConfirmation
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/clock"
+)
+
+func TestConfirmerRoundTrip(t *testing.T) {
+	c := newConfirmer("secret", time.Minute)
+	now := time.Now()
+	token, expires := c.token("customers", "1", now)
+	if !expires.After(now) {
+		t.Error("Expected expiry in the future")
+	}
+	if err := c.verify("customers", "1", token, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfirmerRejects(t *testing.T) {
+	c := newConfirmer("secret", time.Minute)
+	other := newConfirmer("other", time.Minute)
+	now := time.Now()
+	token, _ := c.token("customers", "1", now)
+	cases := map[string]error{
+		"other id":     c.verify("customers", "2", token, now),
+		"expired":      c.verify("customers", "1", token, now.Add(2*time.Minute)),
+		"other secret": other.verify("customers", "1", token, now),
+		"malformed":    c.verify("customers", "1", "nope", now),
+	}
+	for name, err := range cases {
+		if err != ErrInvalidConfirmation {
+			t.Errorf("Expected invalid confirmation for %v", name)
+		}
+	}
+}
+
+func TestConfirmerRandomSecret(t *testing.T) {
+	a := newConfirmer("", time.Minute)
+	b := newConfirmer("", time.Minute)
+	now := time.Now()
+	token, _ := a.token("customers", "1", now)
+	if b.verify("customers", "1", token, now) == nil {
+		t.Error("Expected random secrets to differ")
+	}
+}
+
+func TestDeleteConfirmationExpires(t *testing.T) {
+	withLoginDB(t)
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewFixedService(WithDeleteConfirmation("secret", time.Minute), WithClock(c))
+	ctx := context.Background()
+
+	plan, err := s.PlanDelete(ctx, "customers", "5a934e000102030405000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Expires.Equal(c.Now().Add(time.Minute)) {
+		t.Errorf("Expected the token to expire in a minute, received %v", plan.Expires)
+	}
+	c.Advance(time.Minute + time.Second)
+	if err := s.Delete(ctx, "customers", "5a934e000102030405000000", plan.Token); err != ErrInvalidConfirmation {
+		t.Errorf("Expected the expired token refused, received %v", err)
+	}
+}
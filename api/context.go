@@ -0,0 +1,156 @@
+package api
+
+// context.go contains helpers for carrying request metadata from the
+// transport into the service.
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/i18n"
+	"github.com/mikesay/user/middleware"
+	"github.com/mikesay/user/timing"
+	"golang.org/x/text/language"
+)
+
+type contextKey int
+
+const (
+	clientInfoKey contextKey = iota
+	principalKey
+	languageKey
+	modifiedSinceKey
+	honeypotKey
+	routeKey
+)
+
+// DeviceHeader carries an optional fingerprint of the client's device, such
+// as a hash computed by a browser fingerprinting script, to tell devices
+// apart beyond their user agent.
+const DeviceHeader = "X-Device-Fingerprint"
+
+// maxDeviceLength bounds the fingerprints kept; longer ones are ignored.
+const maxDeviceLength = 128
+
+// ClientInfo describes the client that issued a request.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+	// Client is the calling application as name/version, if known.
+	Client string
+	// Device is the fingerprint given by DeviceHeader, if any.
+	Device string
+}
+
+// WithClientInfo returns a copy of ctx carrying ci.
+func WithClientInfo(ctx context.Context, ci ClientInfo) context.Context {
+	return context.WithValue(ctx, clientInfoKey, ci)
+}
+
+// ClientInfoFromContext returns the ClientInfo stored in ctx, if any.
+func ClientInfoFromContext(ctx context.Context) ClientInfo {
+	ci, _ := ctx.Value(clientInfoKey).(ClientInfo)
+	return ci
+}
+
+// clientInfoToContext is a ServerBefore hook storing the caller's address and
+// user agent in the request context.
+func clientInfoToContext(ctx context.Context, r *http.Request) context.Context {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	ci := ClientInfo{IP: ip, UserAgent: r.UserAgent(), Device: parseDevice(r.Header.Get(DeviceHeader))}
+	if name, version := middleware.ParseClient(r); name != "" {
+		ci.Client = name
+		if version != "" {
+			ci.Client += "/" + version
+		}
+	}
+	return WithClientInfo(ctx, ci)
+}
+
+// parseDevice returns the fingerprint if it is printable ASCII of at most
+// maxDeviceLength characters, and nothing otherwise.
+func parseDevice(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > maxDeviceLength {
+		return ""
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return ""
+		}
+	}
+	return s
+}
+
+// requestCacheToContext is a ServerBefore hook memoizing database reads for
+// the lifetime of the request.
+func requestCacheToContext(ctx context.Context, r *http.Request) context.Context {
+	return db.WithRequestCache(ctx)
+}
+
+// serializationToContext is a ServerBefore hook counting the time until the
+// endpoint is called, decoding the request, as serialization.
+func serializationToContext(ctx context.Context, r *http.Request) context.Context {
+	timing.Enter(ctx, timing.Serialization)
+	return ctx
+}
+
+// serializationDone is a ServerFinalizer returning the request to its
+// handler once its response is encoded.
+func serializationDone(ctx context.Context, code int, r *http.Request) {
+	timing.Enter(ctx, timing.Handler)
+}
+
+// languageToContext is a ServerBefore hook storing the language error
+// messages are written in, as negotiated by Accept-Language.
+func languageToContext(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, languageKey, i18n.Match(r.Header.Get("Accept-Language")))
+}
+
+// modifiedSinceToContext is a ServerBefore hook storing the time given by
+// If-Modified-Since. It is ignored alongside If-None-Match, which takes
+// precedence.
+func modifiedSinceToContext(ctx context.Context, r *http.Request) context.Context {
+	if r.Method != "GET" || r.Header.Get("If-None-Match") != "" {
+		return ctx
+	}
+	t, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, modifiedSinceKey, t)
+}
+
+// modifiedSinceFromContext returns the time given by If-Modified-Since, if
+// any.
+func modifiedSinceFromContext(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(modifiedSinceKey).(time.Time)
+	return t, ok
+}
+
+// withHoneypot returns a copy of ctx carrying the registration form's
+// honeypot field, which people leave empty.
+func withHoneypot(ctx context.Context, value string) context.Context {
+	return context.WithValue(ctx, honeypotKey, value)
+}
+
+// honeypotFromContext returns the honeypot field given at registration.
+func honeypotFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(honeypotKey).(string)
+	return v
+}
+
+// languageFromContext returns the negotiated language, English if none was.
+func languageFromContext(ctx context.Context) language.Tag {
+	if lang, ok := ctx.Value(languageKey).(language.Tag); ok {
+		return lang
+	}
+	return language.English
+}
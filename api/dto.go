@@ -0,0 +1,232 @@
+package api
+
+// dto.go contains the wire representations of customers, addresses and
+// cards. Requests are decoded into them and responses encoded from them, so
+// that how the users structs are stored cannot change the API. Field names
+// and omission rules here are the wire format and must not change. Links are
+// generated here, from IDs, rather than stored.
+
+import (
+	"time"
+
+	"github.com/mikesay/user/users"
+)
+
+type userDTO struct {
+	FirstName string      `json:"firstName"`
+	LastName  string      `json:"lastName"`
+	Username  string      `json:"username"`
+	ID        string      `json:"id"`
+	Links     users.Links `json:"_links"`
+	CreatedAt time.Time   `json:"createdAt,omitzero"`
+	UpdatedAt time.Time   `json:"updatedAt,omitzero"`
+	LastLogin time.Time   `json:"lastLogin,omitzero"`
+	AvatarURL string      `json:"avatarURL,omitempty"`
+	Residency string      `json:"residency,omitempty"`
+	// DateOfBirth is for age-restricted products; exports only carry the
+	// year.
+	DateOfBirth string   `json:"dateOfBirth,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+func toUserDTO(u users.User) userDTO {
+	d := userDTO{
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		Username:    u.Username,
+		ID:          u.UserID,
+		Links:       users.CustomerLinks(u.UserID),
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+		LastLogin:   u.LastLogin,
+		Residency:   u.Residency,
+		Tags:        u.Tags,
+		DateOfBirth: u.DateOfBirth,
+	}
+	if u.Avatar != "" {
+		d.AvatarURL = users.AvatarURL(u.UserID, u.Avatar)
+	}
+	return d
+}
+
+func toUserDTOs(us []users.User) []userDTO {
+	if us == nil {
+		return nil
+	}
+	out := make([]userDTO, len(us))
+	for k, u := range us {
+		out[k] = toUserDTO(u)
+	}
+	return out
+}
+
+// userRequest is the body of POST /customers. Fields the service sets
+// itself, such as IDs and timestamps, are not read from clients.
+type userRequest struct {
+	FirstName   string   `json:"firstName"`
+	LastName    string   `json:"lastName"`
+	Username    string   `json:"username"`
+	Residency   string   `json:"residency"`
+	DateOfBirth string   `json:"dateOfBirth"`
+	Tags        []string `json:"tags"`
+}
+
+func (r userRequest) user() users.User {
+	return users.User{
+		FirstName:   r.FirstName,
+		LastName:    r.LastName,
+		Username:    r.Username,
+		Residency:   r.Residency,
+		Tags:        r.Tags,
+		DateOfBirth: r.DateOfBirth,
+	}
+}
+
+type addressDTO struct {
+	Street    string      `json:"street"`
+	Number    string      `json:"number"`
+	Country   string      `json:"country"`
+	City      string      `json:"city"`
+	PostCode  string      `json:"postcode"`
+	ID        string      `json:"id"`
+	Links     users.Links `json:"_links"`
+	CreatedAt time.Time   `json:"createdAt,omitzero"`
+	UpdatedAt time.Time   `json:"updatedAt,omitzero"`
+}
+
+func toAddressDTO(a users.Address) addressDTO {
+	return addressDTO{
+		Street:    a.Street,
+		Number:    a.Number,
+		Country:   a.Country,
+		City:      a.City,
+		PostCode:  a.PostCode,
+		ID:        a.ID,
+		Links:     users.AddressLinks(a.ID),
+		CreatedAt: a.CreatedAt,
+		UpdatedAt: a.UpdatedAt,
+	}
+}
+
+func toAddressDTOs(as []users.Address) []addressDTO {
+	if as == nil {
+		return nil
+	}
+	out := make([]addressDTO, len(as))
+	for k, a := range as {
+		out[k] = toAddressDTO(a)
+	}
+	return out
+}
+
+// addressRequest is the body of POST /addresses.
+type addressRequest struct {
+	Street   string `json:"street"`
+	Number   string `json:"number"`
+	Country  string `json:"country"`
+	City     string `json:"city"`
+	PostCode string `json:"postcode"`
+	UserID   string `json:"userID"`
+}
+
+func (r addressRequest) address() users.Address {
+	return users.Address{
+		Street:   r.Street,
+		Number:   r.Number,
+		Country:  r.Country,
+		City:     r.City,
+		PostCode: r.PostCode,
+	}
+}
+
+type cardDTO struct {
+	LongNum   string       `json:"longNum"`
+	Expires   string       `json:"expires"`
+	CCV       string       `json:"ccv"`
+	ID        string       `json:"id"`
+	Links     users.Links  `json:"_links"`
+	CreatedAt time.Time    `json:"createdAt,omitzero"`
+	UpdatedAt time.Time    `json:"updatedAt,omitzero"`
+	Status    string       `json:"status,omitempty"`
+	Flag      *cardFlagDTO `json:"flag,omitempty"`
+}
+
+type cardFlagDTO struct {
+	Reason    string    `json:"reason"`
+	Actor     string    `json:"actor"`
+	FlaggedAt time.Time `json:"flaggedAt"`
+}
+
+func toCardDTO(c users.Card) cardDTO {
+	d := cardDTO{
+		LongNum:   c.LongNum,
+		Expires:   c.Expires,
+		CCV:       c.CCV,
+		ID:        c.ID,
+		Links:     users.CardLinks(c.ID),
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		Status:    c.Status,
+	}
+	if c.Flag != nil {
+		d.Flag = &cardFlagDTO{Reason: c.Flag.Reason, Actor: c.Flag.Actor, FlaggedAt: c.Flag.FlaggedAt}
+	}
+	return d
+}
+
+func toCardDTOs(cs []users.Card) []cardDTO {
+	if cs == nil {
+		return nil
+	}
+	out := make([]cardDTO, len(cs))
+	for k, c := range cs {
+		out[k] = toCardDTO(c)
+	}
+	return out
+}
+
+// cardRequest is the body of POST /cards. Cards are always created active.
+type cardRequest struct {
+	LongNum string `json:"longNum"`
+	Expires string `json:"expires"`
+	CCV     string `json:"ccv"`
+	UserID  string `json:"userID"`
+}
+
+func (r cardRequest) card() users.Card {
+	return users.Card{LongNum: r.LongNum, Expires: r.Expires, CCV: r.CCV}
+}
+
+// toWire replaces the users structs in a response, however embedded, with
+// their DTOs. Other responses are encoded as they are.
+func toWire(response interface{}) interface{} {
+	switch r := response.(type) {
+	case EmbedStruct:
+		return EmbedStruct{toWire(r.Embed)}
+	case pageResponse:
+		return pageResponse{toWire(r.Embed), r.Links}
+	case users.User:
+		return toUserDTO(r)
+	case userResponse:
+		return struct {
+			User userDTO `json:"user"`
+		}{toUserDTO(r.User)}
+	case usersResponse:
+		return struct {
+			Users []userDTO `json:"customer"`
+		}{toUserDTOs(r.Users)}
+	case users.Address:
+		return toAddressDTO(r)
+	case addressesResponse:
+		return struct {
+			Addresses []addressDTO `json:"address"`
+		}{toAddressDTOs(r.Addresses)}
+	case users.Card:
+		return toCardDTO(r)
+	case cardsResponse:
+		return struct {
+			Cards []cardDTO `json:"card"`
+		}{toCardDTOs(r.Cards)}
+	}
+	return response
+}
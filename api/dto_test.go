@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/users"
+)
+
+var dtoTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func wireJSON(t *testing.T, response interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(toWire(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// The expected documents below are the wire format. A change to them is a
+// change to the API.
+func TestUserWireFormat(t *testing.T) {
+	u := users.User{
+		FirstName: "Eve", LastName: "Doe", Username: "eve", UserID: "u1",
+		Email: "eve@example.com", Password: "hash", Salt: "salt",
+		CreatedAt: dtoTime, UpdatedAt: dtoTime, LastLogin: dtoTime,
+		UsernameNormalized: "eve", EmailNormalized: "eve@example.com",
+		Avatar:    "avatars/u1/1",
+		Residency: "eu", Tags: []string{"vip"},
+	}
+	want := `{"firstName":"Eve","lastName":"Doe","username":"eve","id":"u1",` +
+		`"_links":{"addresses":{"href":"http:///customers/u1/addresses"},"cards":{"href":"http:///customers/u1/cards"},` +
+		`"customer":{"href":"http:///customers/u1"},"self":{"href":"http:///customers/u1"}},` +
+		`"createdAt":"2020-01-02T03:04:05Z","updatedAt":"2020-01-02T03:04:05Z","lastLogin":"2020-01-02T03:04:05Z",` +
+		`"avatarURL":"http:///customers/u1/avatar?v=1","residency":"eu","tags":["vip"]}`
+	if got := wireJSON(t, u); got != want {
+		t.Errorf("Expected\n%v\nreceived\n%v", want, got)
+	}
+	want = `{"firstName":"","lastName":"","username":"","id":"","_links":null}`
+	if got := wireJSON(t, users.User{}); got != want {
+		t.Errorf("Expected\n%v\nreceived\n%v", want, got)
+	}
+	if got := wireJSON(t, userResponse{User: users.User{Username: "eve"}}); !strings.HasPrefix(got, `{"user":{"firstName":"","lastName":"","username":"eve"`) {
+		t.Errorf("Expected the user wrapped, received %v", got)
+	}
+	if got := wireJSON(t, EmbedStruct{usersResponse{}}); got != `{"_embedded":{"customer":null}}` {
+		t.Errorf("Expected an empty embedded list, received %v", got)
+	}
+}
+
+func TestAddressWireFormat(t *testing.T) {
+	a := users.Address{Street: "High St", Number: "1", Country: "UK", City: "London", PostCode: "N1 9GU", ID: "a1", CreatedAt: dtoTime}
+	want := `{"street":"High St","number":"1","country":"UK","city":"London","postcode":"N1 9GU","id":"a1",` +
+		`"_links":{"address":{"href":"http:///addresses/a1"},"self":{"href":"http:///addresses/a1"}},"createdAt":"2020-01-02T03:04:05Z"}`
+	if got := wireJSON(t, a); got != want {
+		t.Errorf("Expected\n%v\nreceived\n%v", want, got)
+	}
+	if got := wireJSON(t, EmbedStruct{addressesResponse{Addresses: []users.Address{a}}}); got != `{"_embedded":{"address":[`+want+`]}}` {
+		t.Errorf("Expected the embedded list, received %v", got)
+	}
+}
+
+func TestCardWireFormat(t *testing.T) {
+	c := users.Card{LongNum: "4111", Expires: "01/30", CCV: "123", ID: "c1", Status: users.CardSuspectedFraud,
+		Flag: &users.CardFlag{Reason: "chargeback", Actor: "risk", FlaggedAt: dtoTime}}
+	want := `{"longNum":"4111","expires":"01/30","ccv":"123","id":"c1",` +
+		`"_links":{"card":{"href":"http:///cards/c1"},"self":{"href":"http:///cards/c1"}},"status":"suspected_fraud",` +
+		`"flag":{"reason":"chargeback","actor":"risk","flaggedAt":"2020-01-02T03:04:05Z"}}`
+	if got := wireJSON(t, c); got != want {
+		t.Errorf("Expected\n%v\nreceived\n%v", want, got)
+	}
+	if got := wireJSON(t, EmbedStruct{cardsResponse{Cards: []users.Card{c}}}); got != `{"_embedded":{"card":[`+want+`]}}` {
+		t.Errorf("Expected the embedded list, received %v", got)
+	}
+}
+
+func TestDecodeWireRequests(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("POST", "/customers", strings.NewReader(
+		`{"firstName":"Eve","lastName":"Doe","username":"eve","residency":"eu","tags":["vip"],"id":"u1","lastLogin":"2020-01-02T03:04:05Z"}`))
+	req, err := decodeUserRequest(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := req.(users.User)
+	if u.Username != "eve" || u.Residency != "eu" || len(u.Tags) != 1 {
+		t.Errorf("Expected the user's fields, received %+v", u)
+	}
+	if u.UserID != "" || !u.LastLogin.IsZero() {
+		t.Errorf("Expected fields set by the service to be ignored, received %+v", u)
+	}
+
+	r = httptest.NewRequest("POST", "/addresses", strings.NewReader(`{"street":"High St","postcode":"N1 9GU","userID":"u1","id":"a1"}`))
+	req, err = decodeAddressRequest(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := req.(addressPostRequest); a.Street != "High St" || a.PostCode != "N1 9GU" || a.UserID != "u1" || a.ID != "" {
+		t.Errorf("Expected the address and owner, received %+v", a)
+	}
+
+	r = httptest.NewRequest("POST", "/cards", strings.NewReader(`{"longNum":"4111","expires":"01/30","ccv":"123","userID":"u1","status":"suspected_fraud"}`))
+	req, err = decodeCardRequest(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := req.(cardPostRequest); c.LongNum != "4111" || c.CCV != "123" || c.UserID != "u1" || c.Status != "" {
+		t.Errorf("Expected the card and owner, received %+v", c)
+	}
+}
@@ -6,9 +6,13 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
 
 	"github.com/go-kit/kit/endpoint"
-	"github.com/go-kit/kit/tracing/opentracing"
 	"github.com/mikesay/user/db"
 	"github.com/mikesay/user/users"
 	stdopentracing "github.com/opentracing/opentracing-go"
@@ -16,32 +20,74 @@ import (
 
 // Endpoints collects the endpoints that comprise the Service.
 type Endpoints struct {
-	LoginEndpoint       endpoint.Endpoint
-	RegisterEndpoint    endpoint.Endpoint
-	UserGetEndpoint     endpoint.Endpoint
-	UserPostEndpoint    endpoint.Endpoint
-	AddressGetEndpoint  endpoint.Endpoint
-	AddressPostEndpoint endpoint.Endpoint
-	CardGetEndpoint     endpoint.Endpoint
-	CardPostEndpoint    endpoint.Endpoint
-	DeleteEndpoint      endpoint.Endpoint
-	HealthEndpoint      endpoint.Endpoint
+	LoginEndpoint                endpoint.Endpoint
+	LoginVerifyEndpoint          endpoint.Endpoint
+	RegisterEndpoint             endpoint.Endpoint
+	UserGetEndpoint              endpoint.Endpoint
+	UserSearchEndpoint           endpoint.Endpoint
+	ExportEndpoint               endpoint.Endpoint
+	UserPostEndpoint             endpoint.Endpoint
+	DuplicatesEndpoint           endpoint.Endpoint
+	AddressGetEndpoint           endpoint.Endpoint
+	AddressPostEndpoint          endpoint.Endpoint
+	CardGetEndpoint              endpoint.Endpoint
+	CardPostEndpoint             endpoint.Endpoint
+	CardPatchEndpoint            endpoint.Endpoint
+	DeleteEndpoint               endpoint.Endpoint
+	LoginsGetEndpoint            endpoint.Endpoint
+	NotePostEndpoint             endpoint.Endpoint
+	NotesGetEndpoint             endpoint.Endpoint
+	AvatarPutEndpoint            endpoint.Endpoint
+	AvatarGetEndpoint            endpoint.Endpoint
+	TagPutEndpoint               endpoint.Endpoint
+	TagDeleteEndpoint            endpoint.Endpoint
+	CustomerAddressesGetEndpoint endpoint.Endpoint
+	CustomerCardsGetEndpoint     endpoint.Endpoint
+	BackupGetEndpoint            endpoint.Endpoint
+	RestorePostEndpoint          endpoint.Endpoint
+	JobPostEndpoint              endpoint.Endpoint
+	JobGetEndpoint               endpoint.Endpoint
+	IndexesEndpoint              endpoint.Endpoint
+	HealthEndpoint               endpoint.Endpoint
+	ImpersonatePostEndpoint      endpoint.Endpoint
+	ImpersonateDeleteEndpoint    endpoint.Endpoint
 }
 
 // MakeEndpoints returns an Endpoints structure, where each endpoint is
 // backed by the given service.
 func MakeEndpoints(s Service, tracer stdopentracing.Tracer) Endpoints {
 	return Endpoints{
-		LoginEndpoint:       opentracing.TraceServer(tracer, "GET /login")(MakeLoginEndpoint(s)),
-		RegisterEndpoint:    opentracing.TraceServer(tracer, "POST /register")(MakeRegisterEndpoint(s)),
-		HealthEndpoint:      opentracing.TraceServer(tracer, "GET /health")(MakeHealthEndpoint(s)),
-		UserGetEndpoint:     opentracing.TraceServer(tracer, "GET /customers")(MakeUserGetEndpoint(s)),
-		UserPostEndpoint:    opentracing.TraceServer(tracer, "POST /customers")(MakeUserPostEndpoint(s)),
-		AddressGetEndpoint:  opentracing.TraceServer(tracer, "GET /addresses")(MakeAddressGetEndpoint(s)),
-		AddressPostEndpoint: opentracing.TraceServer(tracer, "POST /addresses")(MakeAddressPostEndpoint(s)),
-		CardGetEndpoint:     opentracing.TraceServer(tracer, "GET /cards")(MakeCardGetEndpoint(s)),
-		DeleteEndpoint:      opentracing.TraceServer(tracer, "DELETE /")(MakeDeleteEndpoint(s)),
-		CardPostEndpoint:    opentracing.TraceServer(tracer, "POST /cards")(MakeCardPostEndpoint(s)),
+		LoginEndpoint:                traceServer(tracer, "GET /login")(MakeLoginEndpoint(s)),
+		LoginVerifyEndpoint:          traceServer(tracer, "POST /login/verify")(MakeLoginVerifyEndpoint(s)),
+		RegisterEndpoint:             traceServer(tracer, "POST /register")(MakeRegisterEndpoint(s)),
+		HealthEndpoint:               traceServer(tracer, "GET /health")(MakeHealthEndpoint(s)),
+		UserGetEndpoint:              traceServer(tracer, "GET /customers")(MakeUserGetEndpoint(s)),
+		UserSearchEndpoint:           traceServer(tracer, "GET /customers/search")(MakeUserSearchEndpoint(s)),
+		ExportEndpoint:               traceServer(tracer, "GET /admin/export.csv")(MakeExportEndpoint(s)),
+		DuplicatesEndpoint:           traceServer(tracer, "GET /admin/duplicates")(MakeDuplicatesEndpoint(s)),
+		UserPostEndpoint:             traceServer(tracer, "POST /customers")(MakeUserPostEndpoint(s)),
+		AddressGetEndpoint:           traceServer(tracer, "GET /addresses")(MakeAddressGetEndpoint(s)),
+		AddressPostEndpoint:          traceServer(tracer, "POST /addresses")(MakeAddressPostEndpoint(s)),
+		CardGetEndpoint:              traceServer(tracer, "GET /cards")(MakeCardGetEndpoint(s)),
+		DeleteEndpoint:               traceServer(tracer, "DELETE /")(MakeDeleteEndpoint(s)),
+		CardPostEndpoint:             traceServer(tracer, "POST /cards")(MakeCardPostEndpoint(s)),
+		CardPatchEndpoint:            traceServer(tracer, "PATCH /cards/{id}")(MakeCardPatchEndpoint(s)),
+		LoginsGetEndpoint:            traceServer(tracer, "GET /customers/{id}/logins")(MakeLoginsGetEndpoint(s)),
+		AvatarPutEndpoint:            traceServer(tracer, "PUT /customers/{id}/avatar")(MakeAvatarPutEndpoint(s)),
+		AvatarGetEndpoint:            traceServer(tracer, "GET /customers/{id}/avatar")(MakeAvatarGetEndpoint(s)),
+		TagPutEndpoint:               traceServer(tracer, "PUT /customers/{id}/tags/{tag}")(MakeTagPutEndpoint(s)),
+		TagDeleteEndpoint:            traceServer(tracer, "DELETE /customers/{id}/tags/{tag}")(MakeTagDeleteEndpoint(s)),
+		NotePostEndpoint:             traceServer(tracer, "POST /admin/customers/{id}/notes")(MakeNotePostEndpoint(s)),
+		NotesGetEndpoint:             traceServer(tracer, "GET /admin/customers/{id}/notes")(MakeNotesGetEndpoint(s)),
+		BackupGetEndpoint:            traceServer(tracer, "GET /admin/customers/{id}/backup")(MakeBackupGetEndpoint(s)),
+		RestorePostEndpoint:          traceServer(tracer, "POST /admin/customers/restore")(MakeRestorePostEndpoint(s)),
+		JobPostEndpoint:              traceServer(tracer, "POST /admin/jobs")(MakeJobPostEndpoint(s)),
+		JobGetEndpoint:               traceServer(tracer, "GET /admin/jobs/{id}")(MakeJobGetEndpoint(s)),
+		IndexesEndpoint:              traceServer(tracer, "GET /admin/indexes")(MakeIndexesEndpoint(s)),
+		CustomerAddressesGetEndpoint: traceServer(tracer, "GET /customers/{id}/addresses")(MakeCustomerAddressesGetEndpoint(s)),
+		CustomerCardsGetEndpoint:     traceServer(tracer, "GET /customers/{id}/cards")(MakeCustomerCardsGetEndpoint(s)),
+		ImpersonatePostEndpoint:      traceServer(tracer, "POST /admin/impersonate/{id}")(MakeImpersonatePostEndpoint(s)),
+		ImpersonateDeleteEndpoint:    traceServer(tracer, "DELETE /admin/impersonate/{id}")(MakeImpersonateDeleteEndpoint(s)),
 	}
 }
 
@@ -53,7 +99,20 @@ func MakeLoginEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(loginRequest)
-		u, err := s.Login(req.Username, req.Password)
+		u, err := s.Login(ctx, req.Username, req.Password)
+		return userResponse{User: u}, err
+	}
+}
+
+// MakeLoginVerifyEndpoint returns an endpoint via the given service.
+func MakeLoginVerifyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "verify login")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(loginVerifyRequest)
+		u, err := s.VerifyLogin(ctx, req.Challenge, req.Code)
 		return userResponse{User: u}, err
 	}
 }
@@ -66,7 +125,8 @@ func MakeRegisterEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(registerRequest)
-		id, err := s.Register(req.Username, req.Password, req.Email, req.FirstName, req.LastName)
+		ctx = withHoneypot(ctx, req.Website)
+		id, err := s.Register(ctx, req.Username, req.Password, req.Email, req.FirstName, req.LastName, req.Residency, req.DateOfBirth)
 		return postResponse{ID: id}, err
 	}
 }
@@ -81,32 +141,78 @@ func MakeUserGetEndpoint(s Service) endpoint.Endpoint {
 
 		req := request.(GetRequest)
 
+		if req.ID != "" && req.Attr != "" {
+			// The user is read with their addresses and cards, in a single
+			// query where the database supports it.
+			attrspan := stdopentracing.StartSpan("user with attributes from db", stdopentracing.ChildOf(span.Context()))
+			user, err := db.GetUserWithAttributes(ctx, req.ID)
+			attrspan.Finish()
+			switch {
+			case db.AttributeFailed(err, req.Attr):
+			case errors.As(err, new(*db.AttributeError)):
+				// Only an attribute not asked for could not be read.
+				err = nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if req.Attr == "addresses" {
+				return EmbedStruct{addressesResponse{Addresses: user.Addresses}}, err
+			}
+			if req.Attr == "cards" {
+				return EmbedStruct{cardsResponse{Cards: visibleCards(ctx, user.Cards)}}, err
+			}
+			return user, err
+		}
+
+		if req.ID == "" && db.Batched(req.List) {
+			return streamList(ctx, "customer", req.List, func(ctx context.Context, l db.ListOptions) ([]users.User, error) {
+				return s.GetUsers(ctx, "", l)
+			}), nil
+		}
 		userspan := stdopentracing.StartSpan("users from db", stdopentracing.ChildOf(span.Context()))
-		usrs, err := s.GetUsers(req.ID)
+		usrs, err := s.GetUsers(ctx, req.ID, req.List)
 		userspan.Finish()
 		if req.ID == "" {
-			return EmbedStruct{usersResponse{Users: usrs}}, err
+			return pageResponse{usersResponse{Users: usrs}, nextLinks("customer", req.List, usrs)}, err
 		}
 		if len(usrs) == 0 {
-			if req.Attr == "addresses" {
-				return EmbedStruct{addressesResponse{Addresses: make([]users.Address, 0)}}, err
-			}
-			if req.Attr == "cards" {
-				return EmbedStruct{cardsResponse{Cards: make([]users.Card, 0)}}, err
-			}
 			return users.User{}, err
 		}
-		user := usrs[0]
-		attrspan := stdopentracing.StartSpan("attributes from db", stdopentracing.ChildOf(span.Context()))
-		db.GetUserAttributes(&user)
-		attrspan.Finish()
-		if req.Attr == "addresses" {
-			return EmbedStruct{addressesResponse{Addresses: user.Addresses}}, err
-		}
-		if req.Attr == "cards" {
-			return EmbedStruct{cardsResponse{Cards: user.Cards}}, err
+		// Addresses and cards are not part of the user's representation, so
+		// they are only read when asked for.
+		return usrs[0], err
+	}
+}
+
+// MakeUserSearchEndpoint returns an endpoint via the given service.
+func MakeUserSearchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "search users")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(db.Query)
+		if db.MaxListDecoded > 0 {
+			// Searches may match more users than a list may decode, so
+			// they are streamed as they are read.
+			return streamSearch(ctx, s, req), nil
 		}
-		return user, err
+		usrs, err := s.SearchUsers(ctx, req)
+		return EmbedStruct{usersResponse{Users: usrs}}, err
+	}
+}
+
+// MakeDuplicatesEndpoint returns an endpoint via the given service.
+func MakeDuplicatesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "find duplicates")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(Page)
+		ds, err := s.FindDuplicates(ctx, req)
+		return duplicatesResponse{Embed: duplicatesEmbed{Duplicates: ds}, Page: req}, err
 	}
 }
 
@@ -118,7 +224,7 @@ func MakeUserPostEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(users.User)
-		id, err := s.PostUser(req)
+		id, err := s.PostUser(ctx, req)
 		return postResponse{ID: id}, err
 	}
 }
@@ -131,11 +237,16 @@ func MakeAddressGetEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(GetRequest)
+		if req.ID == "" && db.Batched(req.List) {
+			return streamList(ctx, "address", req.List, func(ctx context.Context, l db.ListOptions) ([]users.Address, error) {
+				return s.GetAddresses(ctx, "", l)
+			}), nil
+		}
 		addrspan := stdopentracing.StartSpan("addresses from db", stdopentracing.ChildOf(span.Context()))
-		adds, err := s.GetAddresses(req.ID)
+		adds, err := s.GetAddresses(ctx, req.ID, req.List)
 		addrspan.Finish()
 		if req.ID == "" {
-			return EmbedStruct{addressesResponse{Addresses: adds}}, err
+			return pageResponse{addressesResponse{Addresses: adds}, nextLinks("address", req.List, adds)}, err
 		}
 		if len(adds) == 0 {
 			return users.Address{}, err
@@ -152,7 +263,7 @@ func MakeAddressPostEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(addressPostRequest)
-		id, err := s.PostAddress(req.Address, req.UserID)
+		id, err := s.PostAddress(ctx, req.Address, req.UserID)
 		return postResponse{ID: id}, err
 	}
 }
@@ -165,11 +276,28 @@ func MakeCardGetEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(GetRequest)
+		// Flagged cards are dropped from listings once they are paged, so
+		// that the next page follows on from the last card read.
+		if req.ID == "" && db.Batched(req.List) {
+			list := streamList(ctx, "card", req.List, func(ctx context.Context, l db.ListOptions) ([]users.Card, error) {
+				return s.GetCards(ctx, "", l)
+			})
+			each := list.Each
+			list.Each = func(f func(interface{}) error) (users.Links, error) {
+				return each(func(v interface{}) error {
+					if !cardVisible(ctx, v.(users.Card)) {
+						return nil
+					}
+					return f(v)
+				})
+			}
+			return list, nil
+		}
 		cardspan := stdopentracing.StartSpan("addresses from db", stdopentracing.ChildOf(span.Context()))
-		cards, err := s.GetCards(req.ID)
+		cards, err := s.GetCards(ctx, req.ID, req.List)
 		cardspan.Finish()
 		if req.ID == "" {
-			return EmbedStruct{cardsResponse{Cards: cards}}, err
+			return pageResponse{cardsResponse{Cards: visibleCards(ctx, cards)}, nextLinks("card", req.List, cards)}, err
 		}
 		if len(cards) == 0 {
 			return users.Card{}, err
@@ -186,11 +314,23 @@ func MakeCardPostEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(cardPostRequest)
-		id, err := s.PostCard(req.Card, req.UserID)
+		id, err := s.PostCard(ctx, req.Card, req.UserID)
 		return postResponse{ID: id}, err
 	}
 }
 
+// MakeCardPatchEndpoint returns an endpoint via the given service.
+func MakeCardPatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "patch card")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(cardPatchRequest)
+		return s.PatchCard(ctx, req.ID, req.CardPatch)
+	}
+}
+
 // MakeLoginEndpoint returns an endpoint via the given service.
 func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -199,7 +339,11 @@ func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(deleteRequest)
-		err = s.Delete(req.Entity, req.ID)
+		err = s.Delete(ctx, req.Entity, req.ID, req.Confirm)
+		if err == ErrConfirmationRequired {
+			plan, err := s.PlanDelete(ctx, req.Entity, req.ID)
+			return deletePlanResponse{Status: false, Plan: plan}, err
+		}
 		if err == nil {
 			return statusResponse{Status: true}, err
 		}
@@ -207,6 +351,221 @@ func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeLoginsGetEndpoint returns an endpoint via the given service.
+func MakeLoginsGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get logins")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(GetRequest)
+		logins, err := s.GetLogins(ctx, req.ID)
+		return EmbedStruct{loginsResponse{Logins: logins}}, err
+	}
+}
+
+// MakeNotePostEndpoint returns an endpoint via the given service.
+func MakeNotePostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "post note")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(notePostRequest)
+		return s.PostNote(ctx, req.ID, req.Note)
+	}
+}
+
+// MakeNotesGetEndpoint returns an endpoint via the given service.
+func MakeNotesGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get notes")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(notesRequest)
+		ns, err := s.GetNotes(ctx, req.ID, req.Page)
+		return notesResponse{Embed: notesEmbed{Notes: ns}, Page: req.Page}, err
+	}
+}
+
+// MakeCustomerAddressesGetEndpoint returns an endpoint via the given service.
+func MakeCustomerAddressesGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get customer addresses")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(GetRequest)
+		adds, err := s.GetCustomerAddresses(ctx, req.ID)
+		return EmbedStruct{addressesResponse{Addresses: adds}}, err
+	}
+}
+
+// MakeCustomerCardsGetEndpoint returns an endpoint via the given service.
+func MakeCustomerCardsGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get customer cards")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(GetRequest)
+		cards, err := s.GetCustomerCards(ctx, req.ID)
+		return EmbedStruct{cardsResponse{Cards: cards}}, err
+	}
+}
+
+// MakeExportEndpoint returns an endpoint via the given service. The users
+// are read as the response is encoded.
+func MakeExportEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(exportRequest)
+		return exportResponse{Columns: req.Columns, Each: func(f func(users.User, string) error) error {
+			span, ctx := stdopentracing.StartSpanFromContext(ctx, "export users")
+			span.SetTag("service", "user")
+			defer span.Finish()
+			return s.ExportUsers(ctx, req.Query, req.Cursor, f)
+		}}, nil
+	}
+}
+
+// MakeAvatarPutEndpoint returns an endpoint via the given service.
+func MakeAvatarPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "put avatar")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(avatarPutRequest)
+		url, err := s.PutAvatar(ctx, req.ID, req.Body)
+		return avatarResponse{URL: url}, err
+	}
+}
+
+// MakeAvatarGetEndpoint returns an endpoint via the given service.
+func MakeAvatarGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get avatar")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(GetRequest)
+		return s.GetAvatar(ctx, req.ID)
+	}
+}
+
+// MakeTagPutEndpoint returns an endpoint via the given service.
+func MakeTagPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "add tag")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(tagRequest)
+		err = s.AddTag(ctx, req.ID, req.Tag)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeTagDeleteEndpoint returns an endpoint via the given service.
+func MakeTagDeleteEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "remove tag")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(tagRequest)
+		err = s.RemoveTag(ctx, req.ID, req.Tag)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeBackupGetEndpoint returns an endpoint via the given service.
+func MakeBackupGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "backup user")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(GetRequest)
+		return s.BackupUser(ctx, req.ID)
+	}
+}
+
+// MakeImpersonatePostEndpoint returns an endpoint via the given service.
+func MakeImpersonatePostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "impersonate user")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(GetRequest)
+		return s.Impersonate(ctx, req.ID)
+	}
+}
+
+// MakeImpersonateDeleteEndpoint returns an endpoint via the given service.
+func MakeImpersonateDeleteEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "revoke impersonation")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(GetRequest)
+		err = s.RevokeImpersonation(ctx, req.ID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeRestorePostEndpoint returns an endpoint via the given service.
+func MakeRestorePostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "restore user")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(Backup)
+		id, err := s.RestoreUser(ctx, req)
+		return postResponse{ID: id}, err
+	}
+}
+
+// MakeJobPostEndpoint returns an endpoint via the given service.
+func MakeJobPostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "submit job")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(jobPostRequest)
+		return s.SubmitJob(ctx, req.Kind, req.Params)
+	}
+}
+
+// MakeJobGetEndpoint returns an endpoint via the given service.
+func MakeJobGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get job")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(GetRequest)
+		return s.GetJob(ctx, req.ID)
+	}
+}
+
+// MakeIndexesEndpoint returns an endpoint via the given service.
+func MakeIndexesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get indexes")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		is, err := s.Indexes(ctx)
+		return EmbedStruct{indexesResponse{Indexes: is}}, err
+	}
+}
+
 // MakeHealthEndpoint returns current health of the given service.
 func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -214,7 +573,7 @@ func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 		span, ctx = stdopentracing.StartSpanFromContext(ctx, "health check")
 		span.SetTag("service", "user")
 		defer span.Finish()
-		health := s.Health()
+		health := s.Health(ctx)
 		return healthResponse{Health: health}, nil
 	}
 }
@@ -222,6 +581,8 @@ func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 type GetRequest struct {
 	ID   string
 	Attr string
+	// List orders and pages the results when no ID is given.
+	List db.ListOptions
 }
 
 type loginRequest struct {
@@ -229,6 +590,11 @@ type loginRequest struct {
 	Password string
 }
 
+type loginVerifyRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
 type userResponse struct {
 	User users.User `json:"user"`
 }
@@ -239,7 +605,7 @@ type usersResponse struct {
 
 type addressPostRequest struct {
 	users.Address
-	UserID string `json:"userID"`
+	UserID string
 }
 
 type addressesResponse struct {
@@ -248,19 +614,84 @@ type addressesResponse struct {
 
 type cardPostRequest struct {
 	users.Card
-	UserID string `json:"userID"`
+	UserID string
+}
+
+type cardPatchRequest struct {
+	CardPatch
+	ID string `json:"-"`
 }
 
 type cardsResponse struct {
 	Cards []users.Card `json:"card"`
 }
 
+type duplicatesEmbed struct {
+	Duplicates []db.Duplicate `json:"duplicate"`
+}
+
+type duplicatesResponse struct {
+	Embed duplicatesEmbed `json:"_embedded"`
+	Page  Page            `json:"page"`
+}
+
+type notePostRequest struct {
+	users.Note
+	ID string `json:"-"`
+}
+
+type notesRequest struct {
+	ID   string
+	Page Page
+}
+
+type notesEmbed struct {
+	Notes []users.Note `json:"note"`
+}
+
+type notesResponse struct {
+	Embed notesEmbed `json:"_embedded"`
+	Page  Page       `json:"page"`
+}
+
+type loginsResponse struct {
+	Logins []users.LoginAttempt `json:"login"`
+}
+
+type jobPostRequest struct {
+	Kind   string          `json:"kind"`
+	Params json.RawMessage `json:"params"`
+}
+
+// avatarPutRequest carries the uploaded image unread, so that the service
+// can bound how much of it is read.
+type avatarPutRequest struct {
+	ID   string
+	Body io.Reader
+}
+
+type tagRequest struct {
+	ID  string
+	Tag string
+}
+
+type avatarResponse struct {
+	URL string `json:"avatarURL"`
+}
+
 type registerRequest struct {
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 	Email     string `json:"email"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
+	// Residency is the jurisdiction the customer registers in, which sets
+	// the minimum age they must be.
+	Residency   string `json:"residency"`
+	DateOfBirth string `json:"dateOfBirth"`
+	// Website is the honeypot field registration forms hide from people,
+	// so that only bots fill it in.
+	Website string `json:"website"`
 }
 
 type statusResponse struct {
@@ -272,14 +703,24 @@ type postResponse struct {
 }
 
 type deleteRequest struct {
-	Entity string
-	ID     string
+	Entity  string
+	ID      string
+	Confirm string
+}
+
+type deletePlanResponse struct {
+	Status bool       `json:"status"`
+	Plan   DeletePlan `json:"confirmation"`
 }
 
 type healthRequest struct {
 	//
 }
 
+type indexesResponse struct {
+	Indexes []db.Index `json:"index"`
+}
+
 type healthResponse struct {
 	Health []Health `json:"health"`
 }
@@ -287,3 +728,78 @@ type healthResponse struct {
 type EmbedStruct struct {
 	Embed interface{} `json:"_embedded"`
 }
+
+// pageResponse is a page of a list, linking the next page when it is full.
+type pageResponse struct {
+	Embed interface{} `json:"_embedded"`
+	Links users.Links `json:"_links,omitempty"`
+}
+
+// nextLinks links the page after page, a page of a list of the entity,
+// continuing after its last result. Lists returned whole, and pages that are
+// not full, are not continued.
+func nextLinks[T any](ent string, l db.ListOptions, page []T) users.Links {
+	if l.Limit == 0 || len(page) < l.Limit {
+		return nil
+	}
+	return linksAfter(ent, l, page[len(page)-1])
+}
+
+// linksAfter links the page of the list l continuing after last.
+func linksAfter(ent string, l db.ListOptions, last interface{}) users.Links {
+	q := url.Values{"size": {strconv.Itoa(l.Limit)}, "after": {db.After(l, last)}}
+	if l.Sort != "" {
+		q.Set("sort", l.Sort)
+	}
+	if l.Descending {
+		q.Set("order", "desc")
+	}
+	if l.Tag != "" {
+		q.Set("tag", l.Tag)
+	}
+	return users.NextLinks(ent, q.Encode())
+}
+
+// listResponse is a list longer than db.MaxListDecoded, read and encoded a
+// batch at a time so that it is never held in memory whole.
+type listResponse struct {
+	// Key names the results in _embedded.
+	Key string
+	// Each calls f with each result in turn, then returns the links of the
+	// list as pageResponse would.
+	Each func(f func(interface{}) error) (users.Links, error)
+}
+
+// streamSearch returns the users matching q, read with ExportUsers, which
+// decodes them a cursor batch at a time, in the shape of a search response.
+func streamSearch(ctx context.Context, s Service, q db.Query) listResponse {
+	return listResponse{Key: "customer", Each: func(f func(interface{}) error) (users.Links, error) {
+		span, ctx := stdopentracing.StartSpanFromContext(ctx, "stream customer search")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		return nil, s.ExportUsers(ctx, q, "", func(u users.User, _ string) error { return f(u) })
+	}}
+}
+
+// streamList returns the list l of the entity, read by list in batches.
+func streamList[T any](ctx context.Context, ent string, l db.ListOptions, list func(context.Context, db.ListOptions) ([]T, error)) listResponse {
+	return listResponse{Key: ent, Each: func(f func(interface{}) error) (users.Links, error) {
+		span, ctx := stdopentracing.StartSpanFromContext(ctx, "stream "+ent+" list")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		n, last := 0, interface{}(nil)
+		err := db.Batches(l, func(l db.ListOptions) ([]T, error) { return list(ctx, l) }, func(batch []T) error {
+			for _, v := range batch {
+				if err := f(v); err != nil {
+					return err
+				}
+			}
+			n, last = n+len(batch), batch[len(batch)-1]
+			return nil
+		})
+		if err != nil || l.Limit == 0 || n < l.Limit {
+			return nil, err
+		}
+		return linksAfter(ent, l, last), nil
+	}}
+}
@@ -2,7 +2,13 @@ package api
 
 /// needs actual tests
 
-import "testing"
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
 
 func TestMakeEndpoints(t *testing.T) {
 	//	eps := MakeEndpoints(TestService)
@@ -15,3 +21,24 @@ func TestMakeLoginEndpoint(t *testing.T) {
 func TestMakeRegisterEndpoint(t *testing.T) {
 	//	r := MakeRegisterEndpoint(TestService)
 }
+
+func TestNextLinks(t *testing.T) {
+	l := db.ListOptions{Sort: "lastName", Descending: true, Limit: 2, Tag: "vip"}
+	page := []users.User{{UserID: "u1", LastName: "Doe"}, {UserID: "u2", LastName: "Cole"}}
+	links := nextLinks("customer", l, page)
+	u, err := url.Parse(links["next"].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/customers" || q.Get("sort") != "lastName" || q.Get("order") != "desc" || q.Get("size") != "2" || q.Get("tag") != "vip" {
+		t.Errorf("Expected the next page of the same list, received %v", u)
+	}
+	l.After = q.Get("after")
+	if c, err := db.ListCursor(l); err != nil || c.ID != "u2" || c.Value != "Cole" {
+		t.Errorf("Expected the cursor after the last user, received %+v %v", c, err)
+	}
+	if links := nextLinks("customer", l, page[:1]); links != nil {
+		t.Errorf("Expected no link after the last page, received %v", links)
+	}
+}
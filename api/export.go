@@ -0,0 +1,85 @@
+package api
+
+// export.go contains the CSV export of customers for reporting tools that
+// cannot consume JSON.
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// exportColumns maps the column names an export may select to their values.
+var exportColumns = map[string]func(users.User) string{
+	"id":        func(u users.User) string { return u.UserID },
+	"username":  func(u users.User) string { return u.Username },
+	"firstName": func(u users.User) string { return u.FirstName },
+	"lastName":  func(u users.User) string { return u.LastName },
+	"email":     func(u users.User) string { return u.Email },
+	"createdAt": func(u users.User) string { return exportTime(u.CreatedAt) },
+	"updatedAt": func(u users.User) string { return exportTime(u.UpdatedAt) },
+	"lastLogin": func(u users.User) string { return exportTime(u.LastLogin) },
+	// Exports are shared with reporting tools, so dates of birth are
+	// redacted to the year.
+	"birthYear": func(u users.User) string { return birthYear(u.DateOfBirth) },
+}
+
+// cursorColumn may be selected to export, with each user, the cursor that
+// resumes an interrupted export after it.
+const cursorColumn = "cursor"
+
+// defaultExportColumns are exported when no columns are selected.
+var defaultExportColumns = []string{"id", "username", "firstName", "lastName", "email", "createdAt"}
+
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func birthYear(dob string) string {
+	if len(dob) < 4 {
+		return ""
+	}
+	return dob[:4]
+}
+
+// exportRow returns the values of the columns for u, exported at cursor.
+func exportRow(u users.User, cursor string, columns []string) []string {
+	row := make([]string, len(columns))
+	for i, c := range columns {
+		if c == cursorColumn {
+			row[i] = cursor
+			continue
+		}
+		row[i] = exportCell(exportColumns[c](u))
+	}
+	return row
+}
+
+// exportCell quotes v with a leading ' when it starts like a formula, so
+// that spreadsheets opening the export show customer-supplied text, such as
+// a last name of "=HYPERLINK(...)", instead of evaluating it.
+func exportCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+type exportRequest struct {
+	Query   db.Query
+	Columns []string
+	// Cursor resumes an earlier export after the row it was exported with.
+	Cursor string
+}
+
+// exportResponse streams the exported users to the encoder: Each calls f
+// with every user and its cursor, so the export is read while it is written.
+type exportResponse struct {
+	Columns []string
+	Each    func(f func(users.User, string) error) error
+}
@@ -0,0 +1,117 @@
+package api
+
+// fraud.go contains the flagging of cards suspected of fraud by the payments
+// risk team. Flagged cards are withheld from customers' card lists, which
+// the orders service charges from, until they are reinstated.
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/events"
+	"github.com/mikesay/user/users"
+)
+
+var (
+	ErrInvalidCardStatus = users.NewError(users.CodeInvalidCardStatus, "Card status must be active or suspected_fraud")
+	ErrCardFlagged       = users.NewError(users.CodeCardFlagged, "Card is flagged as suspected fraud")
+)
+
+// CardPatch changes the status of a card. Actor names who made the change;
+// it is taken from the authenticated caller when there is one. Reason is
+// required to flag a card.
+type CardPatch struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+}
+
+// cardStatusEvent is the data of card.flagged and card.unflagged events.
+type cardStatusEvent struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	Actor  string `json:"actor"`
+}
+
+// WithEvents publishes events, such as cards being flagged and users being
+// created, through p.
+func WithEvents(p events.Publisher) Option {
+	return func(s *fixedService) {
+		s.events = p
+	}
+}
+
+// publish delivers e through p, timed by the service's clock and with an
+// ID read from its RNG.
+func (s *fixedService) publish(ctx context.Context, p events.Publisher, e events.Event) {
+	if e.Time.IsZero() {
+		e.Time = s.clock.Now().UTC()
+	}
+	if e.ID == "" {
+		e.ID = hex.EncodeToString(clock.Bytes(s.rng, 16))
+	}
+	events.Publish(ctx, p, e)
+}
+
+// PatchCard flags the card as suspected fraud or reinstates it, returning
+// the updated card.
+func (s *fixedService) PatchCard(ctx context.Context, id string, p CardPatch) (users.Card, error) {
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		p.Actor = principal.Username
+	}
+	if p.Actor == "" {
+		return users.Card{}, users.NewError(users.CodeMissingField, fmt.Sprintf(users.ErrMissingField, "actor"))
+	}
+	var flag *users.CardFlag
+	event := events.CardUnflagged
+	switch p.Status {
+	case users.CardActive:
+		p.Reason = ""
+	case users.CardSuspectedFraud:
+		if p.Reason == "" {
+			return users.Card{}, users.NewError(users.CodeMissingField, fmt.Sprintf(users.ErrMissingField, "reason"))
+		}
+		flag = &users.CardFlag{Reason: p.Reason, Actor: p.Actor, FlaggedAt: s.clock.Now().UTC()}
+		event = events.CardFlagged
+	default:
+		return users.Card{}, ErrInvalidCardStatus
+	}
+	c, err := db.GetCard(ctx, id)
+	if err != nil {
+		return users.Card{}, err
+	}
+	if err := db.UpdateCardStatus(ctx, id, p.Status, flag); err != nil {
+		return users.Card{}, err
+	}
+	c.Status, c.Flag = p.Status, flag
+	s.publish(ctx, s.events, events.Event{
+		Type:    event,
+		Subject: id,
+		Data:    cardStatusEvent{Status: p.Status, Reason: p.Reason, Actor: p.Actor},
+	})
+	return c, nil
+}
+
+// cardVisible reports whether the caller may see the card: admins see all
+// cards, and others only usable ones, so that flagged cards are not
+// charged.
+func cardVisible(ctx context.Context, c users.Card) bool {
+	if p, ok := PrincipalFromContext(ctx); ok && p.Admin {
+		return true
+	}
+	return c.Usable()
+}
+
+// visibleCards drops the cards the caller may not see.
+func visibleCards(ctx context.Context, cs []users.Card) []users.Card {
+	visible := make([]users.Card, 0, len(cs))
+	for _, c := range cs {
+		if cardVisible(ctx, c) {
+			visible = append(visible, c)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/events"
+	"github.com/mikesay/user/users"
+)
+
+// cardDB holds cards in memory.
+type cardDB struct {
+	db.Database
+	cards map[string]users.Card
+}
+
+func (d *cardDB) GetCard(id string) (users.Card, error) {
+	c, ok := d.cards[id]
+	if !ok {
+		return users.Card{}, users.ErrCardNotFound
+	}
+	return c, nil
+}
+
+func (d *cardDB) GetCustomerCards(string) ([]users.Card, error) {
+	cs := make([]users.Card, 0)
+	for _, c := range d.cards {
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// GetCards lists the cards by ID.
+func (d *cardDB) GetCards(l db.ListOptions) ([]users.Card, error) {
+	cs, _ := d.GetCustomerCards("")
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ID < cs[j].ID })
+	if l.Limit > 0 && l.Limit < len(cs) {
+		cs = cs[:l.Limit]
+	}
+	return cs, nil
+}
+
+func (d *cardDB) GetUserWithAttributes(id string) (users.User, error) {
+	cs, _ := d.GetCustomerCards(id)
+	return users.User{UserID: id, Cards: cs}, nil
+}
+
+func (d *cardDB) UpdateCardStatus(id, status string, flag *users.CardFlag) error {
+	c := d.cards[id]
+	c.Status, c.Flag = status, flag
+	d.cards[id] = c
+	return nil
+}
+
+type recorder []events.Event
+
+func (r *recorder) Publish(ctx context.Context, e events.Event) error {
+	*r = append(*r, e)
+	return nil
+}
+
+func TestPatchCard(t *testing.T) {
+	prev := db.DefaultDb
+	cards := &cardDB{cards: map[string]users.Card{"c1": {ID: "c1"}}}
+	db.DefaultDb = cards
+	defer func() { db.DefaultDb = prev }()
+
+	var published recorder
+	s := NewFixedService(WithEvents(&published))
+	ctx := context.Background()
+	c, err := s.PatchCard(ctx, "c1", CardPatch{Status: users.CardSuspectedFraud, Reason: "chargeback", Actor: "risk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Usable() || c.Flag == nil || c.Flag.Actor != "risk" {
+		t.Errorf("Expected the card flagged by risk, received %+v", c)
+	}
+	if len(published) != 1 || published[0].Type != events.CardFlagged || published[0].Subject != "c1" {
+		t.Errorf("Expected a card.flagged event, received %+v", published)
+	}
+
+	if cs, _ := s.GetCustomerCards(ctx, "u1"); len(cs) != 0 {
+		t.Errorf("Expected flagged card withheld, received %v", cs)
+	}
+	if _, err := s.GetCards(ctx, "c1", db.ListOptions{}); err != ErrCardFlagged {
+		t.Errorf("Expected flagged card refused, received %v", err)
+	}
+	admin := context.WithValue(ctx, principalKey, Principal{Username: "ops", Admin: true})
+	if cs, err := s.GetCards(admin, "c1", db.ListOptions{}); err != nil || len(cs) != 1 {
+		t.Errorf("Expected admins to see flagged card, received %v %v", cs, err)
+	}
+
+	c, err = s.PatchCard(admin, "c1", CardPatch{Status: users.CardActive, Actor: "spoofed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Usable() || c.Flag != nil {
+		t.Errorf("Expected the card reinstated, received %+v", c)
+	}
+	if e := published[len(published)-1]; e.Type != events.CardUnflagged || e.Data.(cardStatusEvent).Actor != "ops" {
+		t.Errorf("Expected a card.unflagged event by the caller, received %+v", e)
+	}
+	if cs, _ := s.GetCustomerCards(ctx, "u1"); len(cs) != 1 {
+		t.Errorf("Expected reinstated card listed, received %v", cs)
+	}
+}
+
+func TestPatchCardInvalid(t *testing.T) {
+	ctx := context.Background()
+	for _, p := range []CardPatch{
+		{Status: "stolen", Actor: "risk"},
+		{Status: users.CardSuspectedFraud, Actor: "risk"},
+		{Status: users.CardSuspectedFraud, Reason: "chargeback"},
+	} {
+		if _, err := TestService.PatchCard(ctx, "c1", p); users.ErrorCode(err) == users.CodeInternal {
+			t.Errorf("Expected %+v to be refused, received %v", p, err)
+		}
+	}
+}
+
+func TestFlaggedCardsHidden(t *testing.T) {
+	prev := db.DefaultDb
+	db.DefaultDb = &cardDB{cards: map[string]users.Card{
+		"c1": {ID: "c1"},
+		"c2": {ID: "c2", Status: users.CardSuspectedFraud},
+		"c3": {ID: "c3"},
+	}}
+	defer func() { db.DefaultDb = prev }()
+	ctx := context.Background()
+	admin := context.WithValue(ctx, principalKey, Principal{Username: "ops", Admin: true})
+
+	list := MakeCardGetEndpoint(TestService)
+	resp, err := list(ctx, GetRequest{List: db.ListOptions{Limit: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := resp.(pageResponse)
+	if cs := page.Embed.(cardsResponse).Cards; len(cs) != 1 || cs[0].ID != "c1" {
+		t.Errorf("Expected the flagged card left out of the listing, received %v", cs)
+	}
+	if page.Links == nil {
+		t.Error("Expected the next page linked after the last card read")
+	}
+	if resp, _ := list(admin, GetRequest{List: db.ListOptions{Limit: 2}}); len(resp.(pageResponse).Embed.(cardsResponse).Cards) != 2 {
+		t.Errorf("Expected admins to list flagged cards, received %v", resp)
+	}
+
+	get := MakeUserGetEndpoint(TestService)
+	resp, err = get(ctx, GetRequest{ID: "u1", Attr: "cards"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs := resp.(EmbedStruct).Embed.(cardsResponse).Cards; len(cs) != 2 {
+		t.Errorf("Expected the flagged card left out of the customer's cards, received %v", cs)
+	}
+	if cs, _ := TestService.GetCustomerCards(admin, "u1"); len(cs) != 3 {
+		t.Errorf("Expected admins to see the customer's flagged cards, received %v", cs)
+	}
+}
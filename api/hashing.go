@@ -0,0 +1,84 @@
+package api
+
+// hashing.go contains the bounded pool password hashing runs in, so that
+// login spikes queue for CPU instead of starving the rest of the service,
+// and are shed once the queue is full.
+
+import (
+	"context"
+	"time"
+
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ErrOverloaded = users.NewError(users.CodeOverloaded, "Service overloaded, try again later")
+
+	HashDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "password_hash_duration_seconds",
+		Help:    "Time spent hashing passwords.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+	HashQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "password_hash_queue_length",
+		Help: "Number of password hashes waiting for a worker.",
+	})
+	HashRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "password_hash_rejected_total",
+		Help: "Number of password hashes refused because the queue was full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(HashDuration)
+	prometheus.MustRegister(HashQueueLength)
+	prometheus.MustRegister(HashRejected)
+}
+
+// hashPool runs at most workers hashes at once, with up to queue more
+// waiting.
+type hashPool struct {
+	workers  chan struct{}
+	admitted chan struct{}
+}
+
+func newHashPool(workers, queue int) *hashPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	return &hashPool{
+		workers:  make(chan struct{}, workers),
+		admitted: make(chan struct{}, workers+queue),
+	}
+}
+
+// hash returns the salted hash of pass, or ErrOverloaded when the queue is
+// full.
+func (p *hashPool) hash(ctx context.Context, pass, salt string) (string, error) {
+	select {
+	case p.admitted <- struct{}{}:
+	default:
+		HashRejected.Inc()
+		return "", ErrOverloaded
+	}
+	defer func() { <-p.admitted }()
+
+	HashQueueLength.Inc()
+	select {
+	case p.workers <- struct{}{}:
+		HashQueueLength.Dec()
+	case <-ctx.Done():
+		HashQueueLength.Dec()
+		return "", ctx.Err()
+	}
+	defer func() { <-p.workers }()
+
+	begin := time.Now()
+	h := calculatePassHash(pass, salt)
+	HashDuration.Observe(time.Since(begin).Seconds())
+	return h, nil
+}
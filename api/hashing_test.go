@@ -0,0 +1,38 @@
+package api
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHashPool(t *testing.T) {
+	p := newHashPool(1, 0)
+	h, err := p.hash(context.Background(), "eve", "c748112bc027878aa62812ba1ae00e40ad46d497")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != "fec51acb3365747fc61247da5e249674cf8463c2" {
+		t.Errorf("Expected pooled hash to match, received %v", h)
+	}
+}
+
+func TestHashPoolSheds(t *testing.T) {
+	p := newHashPool(1, 0)
+	p.admitted <- struct{}{}
+	if _, err := p.hash(context.Background(), "eve", "salt"); err != ErrOverloaded {
+		t.Errorf("Expected overload error, received %v", err)
+	}
+}
+
+func TestHashPoolCancelled(t *testing.T) {
+	p := newHashPool(1, 1)
+	p.workers <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.hash(ctx, "eve", "salt"); err != context.Canceled {
+		t.Errorf("Expected cancellation while queued, received %v", err)
+	}
+	if len(p.admitted) != 0 {
+		t.Error("Expected queue slot to be released")
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+// impersonate.go contains the tokens support agents act as customers with,
+// to reproduce their issues. Like confirmation tokens they are signed and
+// stateless, so any replica sharing the secret verifies them. Issuing and
+// revoking them is recorded in the customer's notes, which are the audit
+// trail of impersonation: a token is only honoured while its note is not
+// followed by a revocation. Requests made with a token are logged with the
+// admin acting.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// Impersonation is a token acting as a customer, issued to an admin.
+type Impersonation struct {
+	Token   string    `json:"token"`
+	UserID  string    `json:"userID"`
+	ActAs   string    `json:"act-as"`
+	Expires time.Time `json:"expires"`
+}
+
+// impersonationClaims are signed in an impersonation token. ID is the ID of
+// the note recording the token.
+type impersonationClaims struct {
+	Subject string `json:"sub"`
+	ActAs   string `json:"act-as"`
+	ID      string `json:"jti"`
+	Expires int64  `json:"exp"`
+}
+
+// revocationPage is how many notes are read at a time looking for the note
+// of a token.
+const revocationPage = 50
+
+type impersonator struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// newImpersonator returns an impersonator signing with secret, or with a
+// random secret when none is given.
+func newImpersonator(secret string, ttl time.Duration) *impersonator {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &impersonator{secret: key, ttl: ttl}
+}
+
+func (im *impersonator) sign(payload string) string {
+	mac := hmac.New(sha256.New, im.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// token returns the signed claims.
+func (im *impersonator) token(c impersonationClaims) string {
+	b, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + im.sign(payload)
+}
+
+// verify returns the claims of token if it is signed and unexpired at now.
+func (im *impersonator) verify(token string, now time.Time) (impersonationClaims, error) {
+	var c impersonationClaims
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(im.sign(payload))) {
+		return c, ErrUnauthorized
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Subject == "" || c.ID == "" || now.Unix() >= c.Expires {
+		return c, ErrUnauthorized
+	}
+	return c, nil
+}
+
+// impersonatingAdmin names the admin calling, as recorded in notes and
+// tokens. Admins presenting the admin token have no username.
+func impersonatingAdmin(ctx context.Context) (string, error) {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok || !p.Admin {
+		return "", ErrForbidden
+	}
+	if p.Username == "" {
+		return "admin token", nil
+	}
+	return p.Username, nil
+}
+
+// Impersonate issues the calling admin a token acting as the customer,
+// recording it in the customer's notes.
+func (s *fixedService) Impersonate(ctx context.Context, id string) (Impersonation, error) {
+	if s.impersonator == nil {
+		return Impersonation{}, ErrForbidden
+	}
+	admin, err := impersonatingAdmin(ctx)
+	if err != nil {
+		return Impersonation{}, err
+	}
+	if _, err := db.GetUser(ctx, id); err != nil {
+		return Impersonation{}, err
+	}
+	expires := s.clock.Now().Add(s.impersonator.ttl).Truncate(time.Second)
+	n := users.Note{
+		UserID:     id,
+		Author:     admin,
+		Text:       fmt.Sprintf("Impersonation by %v until %v", admin, expires.UTC().Format(time.RFC3339)),
+		Visibility: users.NoteInternal,
+		Kind:       users.NoteImpersonation,
+	}
+	if err := db.CreateNote(ctx, &n); err != nil {
+		return Impersonation{}, err
+	}
+	c := impersonationClaims{Subject: id, ActAs: admin, ID: n.ID, Expires: expires.Unix()}
+	return Impersonation{Token: s.impersonator.token(c), UserID: id, ActAs: admin, Expires: expires}, nil
+}
+
+// RevokeImpersonation revokes every token acting as the customer issued so
+// far, recording it in the customer's notes.
+func (s *fixedService) RevokeImpersonation(ctx context.Context, id string) error {
+	admin, err := impersonatingAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := db.GetUser(ctx, id); err != nil {
+		return err
+	}
+	return db.CreateNote(ctx, &users.Note{
+		UserID:     id,
+		Author:     admin,
+		Text:       fmt.Sprintf("Impersonation revoked by %v", admin),
+		Visibility: users.NoteInternal,
+		Kind:       users.NoteImpersonationRevoked,
+	})
+}
+
+// AuthenticateImpersonation returns the customer an impersonation token
+// acts as, with the admin acting. Tokens are refused with ErrUnauthorized
+// once expired or revoked, or if their note is missing.
+func (s *fixedService) AuthenticateImpersonation(ctx context.Context, token string) (Principal, error) {
+	if s.impersonator == nil {
+		return Principal{}, ErrUnauthorized
+	}
+	c, err := s.impersonator.verify(token, s.clock.Now())
+	if err != nil {
+		return Principal{}, err
+	}
+	u, err := db.GetUser(ctx, c.Subject)
+	if err == users.ErrUserNotFound {
+		return Principal{}, ErrUnauthorized
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	// Notes are read newest first, so a revocation read before the
+	// token's note came after it.
+	for offset := 0; ; offset += revocationPage {
+		ns, err := db.GetNotes(ctx, c.Subject, offset, revocationPage)
+		if err != nil {
+			return Principal{}, err
+		}
+		for _, n := range ns {
+			switch {
+			case n.Kind == users.NoteImpersonationRevoked:
+				return Principal{}, ErrUnauthorized
+			case n.Kind == users.NoteImpersonation && n.ID == c.ID:
+				return Principal{UserID: u.UserID, Username: u.Username, ActAs: c.ActAs}, nil
+			}
+		}
+		if len(ns) < revocationPage {
+			return Principal{}, ErrUnauthorized
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+func TestImpersonate(t *testing.T) {
+	prev := db.DefaultDb
+	notes := &notesDB{}
+	db.DefaultDb = notes
+	defer func() { db.DefaultDb = prev }()
+
+	c := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	s := NewFixedService(WithClock(c), WithImpersonation("secret", 15*time.Minute))
+	ctx := context.Background()
+	admin := context.WithValue(ctx, principalKey, Principal{Username: "ops", Admin: true})
+	if _, err := s.Impersonate(ctx, "u1"); err != ErrForbidden {
+		t.Errorf("Expected impersonation refused without an admin, received %v", err)
+	}
+	if _, err := s.Impersonate(admin, "u2"); err != users.ErrUserNotFound {
+		t.Errorf("Expected a missing customer refused, received %v", err)
+	}
+
+	imp, err := s.Impersonate(admin, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.UserID != "u1" || imp.ActAs != "ops" || !imp.Expires.Equal(c.Now().Add(15*time.Minute)) {
+		t.Errorf("Unexpected impersonation %+v", imp)
+	}
+	if len(notes.notes) != 1 || notes.notes[0].Kind != users.NoteImpersonation || notes.notes[0].Author != "ops" {
+		t.Errorf("Expected the impersonation noted, received %+v", notes.notes)
+	}
+	p, err := s.AuthenticateImpersonation(ctx, imp.Token)
+	if err != nil || p.UserID != "u1" || p.ActAs != "ops" || p.Admin {
+		t.Errorf("Expected to act as u1 for ops, received %+v %v", p, err)
+	}
+	if _, err := s.PostNote(admin, "u1", users.Note{Text: "Reproduced the issue", Kind: users.NoteImpersonationRevoked}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthenticateImpersonation(ctx, imp.Token); err != nil {
+		t.Errorf("Expected notes posted by agents not to revoke tokens, received %v", err)
+	}
+
+	tampered := []byte(imp.Token)
+	tampered[len(tampered)-1] ^= 1
+	for name, token := range map[string]string{
+		"tampered": string(tampered),
+		"foreign":  NewFixedService(WithImpersonation("other", time.Minute)).(*fixedService).impersonator.token(impersonationClaims{Subject: "u1", ID: "a", Expires: c.Now().Add(time.Minute).Unix()}),
+		"unnoted":  s.(*fixedService).impersonator.token(impersonationClaims{Subject: "u1", ID: "z", Expires: c.Now().Add(time.Minute).Unix()}),
+		"garbage":  "not a token",
+	} {
+		if _, err := s.AuthenticateImpersonation(ctx, token); err != ErrUnauthorized {
+			t.Errorf("Expected the %v token refused, received %v", name, err)
+		}
+	}
+
+	c.Advance(16 * time.Minute)
+	if _, err := s.AuthenticateImpersonation(ctx, imp.Token); err != ErrUnauthorized {
+		t.Errorf("Expected an expired token refused, received %v", err)
+	}
+
+	imp, _ = s.Impersonate(admin, "u1")
+	if err := s.RevokeImpersonation(admin, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthenticateImpersonation(ctx, imp.Token); err != ErrUnauthorized {
+		t.Errorf("Expected a revoked token refused, received %v", err)
+	}
+	again, _ := s.Impersonate(admin, "u1")
+	if _, err := s.AuthenticateImpersonation(ctx, again.Token); err != nil {
+		t.Errorf("Expected a token issued after the revocation accepted, received %v", err)
+	}
+}
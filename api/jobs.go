@@ -0,0 +1,413 @@
+package api
+
+// jobs.go contains the handlers for background jobs run on behalf of the
+// service.
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/mikesay/user/blobs"
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// orphanGrace is how old an address or card must be to be collected as an
+// orphan. Attributes of a new user are written before the user, so a
+// younger one may belong to a user still being created.
+const orphanGrace = time.Hour
+
+var OrphansCollected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "orphaned_attributes_total",
+	Help: "Number of addresses and cards found referenced by no customer, by kind and whether they were deleted or only reported in a dry run.",
+}, []string{"kind", "action"})
+
+var Purged = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "retention_purged_documents_total",
+	Help: "Number of documents or rows purged by retention jobs, by kind of data. Data the database expires itself, such as with TTL indexes, is not counted.",
+}, []string{"data"})
+
+func init() {
+	prometheus.MustRegister(OrphansCollected)
+	prometheus.MustRegister(Purged)
+}
+
+// RegisterJobs adds the job kinds backed by s to runner. Exports are
+// written to store, and not offered without one. Cutoffs are taken from
+// the runner's clock.
+func RegisterJobs(runner *jobs.Runner, s Service, store blobs.Store) {
+	runner.Register("restore", RestoreJob(s))
+	runner.Register("gc", GCJob(runner.Clock))
+	runner.Register("retention", RetentionJob(runner.Clock))
+	runner.Register("import", ImportJob(s))
+	runner.Register("merge", MergeJob(s))
+	runner.Register("anonymize", AnonymizeJob(s))
+	if store != nil {
+		runner.Register("export", ExportJob(s, store))
+	}
+}
+
+// jobContext returns ctx acting as an admin. Only admins submit jobs, so
+// jobs are not held to the write limits of customers.
+func jobContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, principalKey, Principal{Username: "jobs", Admin: true})
+}
+
+// RestoreJob restores a list of customer backups, continuing past failures.
+// Its params are a JSON array of Backups.
+func RestoreJob(s Service) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		var bs []Backup
+		if err := json.Unmarshal(params, &bs); err != nil {
+			return nil, ErrInvalidRequest
+		}
+		restored := make([]string, 0, len(bs))
+		failed := make(map[string]string)
+		for k, b := range bs {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			id, err := s.RestoreUser(ctx, b)
+			if err != nil {
+				failed[b.Customer.ID] = err.Error()
+			} else {
+				restored = append(restored, id)
+			}
+			progress(jobs.Progress{Done: k + 1, Total: len(bs)})
+		}
+		return map[string]interface{}{"restored": restored, "failed": failed}, nil
+	}
+}
+
+// GCParams are the params of a gc job.
+type GCParams struct {
+	// DryRun reports the orphans without deleting them.
+	DryRun bool `json:"dryRun"`
+}
+
+// GCJob collects the addresses and cards no customer references. Its params
+// are GCParams, or none to delete the orphans. The grace period of new
+// attributes counts back from c.
+func GCJob(c clock.Clock) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		var p GCParams
+		if len(params) > 0 && string(params) != "null" {
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, ErrInvalidRequest
+			}
+		}
+		o, err := db.CollectOrphans(c.Now().Add(-orphanGrace), p.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		action := "deleted"
+		if p.DryRun {
+			action = "found"
+		}
+		OrphansCollected.WithLabelValues("address", action).Add(float64(o.Addresses))
+		OrphansCollected.WithLabelValues("card", action).Add(float64(o.Cards))
+		progress(jobs.Progress{Done: 1, Total: 1})
+		return map[string]interface{}{"dryRun": p.DryRun, "addresses": o.Addresses, "cards": o.Cards}, nil
+	}
+}
+
+// RetentionJob purges the data kept longer than its db.Retention from
+// databases that do not expire it themselves, counting back from c. It
+// takes no params.
+func RetentionJob(c clock.Clock) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		kinds := make([]string, 0, len(db.Retention))
+		for kind := range db.Retention {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		purged := make(map[string]int64)
+		for i, kind := range kinds {
+			n, err := db.Purge(ctx, kind, c.Now().Add(-db.Retention[kind]))
+			Purged.WithLabelValues(kind).Add(float64(n))
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", kind, err)
+			}
+			purged[kind] = n
+			progress(jobs.Progress{Done: i + 1, Total: len(kinds)})
+		}
+		return map[string]interface{}{"purged": purged}, nil
+	}
+}
+
+// ExportParams are the params of an export job.
+type ExportParams struct {
+	// Filter holds the search filters of GET /admin/export.csv as a
+	// query string, such as tag=vip&createdAfter=2024-01-01T00:00:00Z.
+	Filter string `json:"filter"`
+	// Columns are those exported, or the default ones if none are given.
+	Columns []string `json:"columns"`
+}
+
+// ExportJob writes the customers matching its ExportParams as CSV to store,
+// for exports too large to download in one request. Its result holds the
+// key of the blob and the number of rows.
+func ExportJob(s Service, store blobs.Store) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		var p ExportParams
+		if len(params) > 0 && string(params) != "null" {
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, ErrInvalidRequest
+			}
+		}
+		v, err := url.ParseQuery(p.Filter)
+		if err != nil {
+			return nil, ErrInvalidRequest
+		}
+		q, err := parseQuery(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(p.Columns) == 0 {
+			p.Columns = defaultExportColumns
+		}
+		for _, c := range p.Columns {
+			if _, ok := exportColumns[c]; !ok && c != cursorColumn {
+				return nil, ErrInvalidRequest
+			}
+		}
+		var buf bytes.Buffer
+		cw := csv.NewWriter(&buf)
+		cw.Write(p.Columns)
+		rows := 0
+		err = s.ExportUsers(jobContext(ctx), q, "", func(u users.User, cursor string) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			rows++
+			if rows%1000 == 0 {
+				progress(jobs.Progress{Done: rows})
+			}
+			return cw.Write(exportRow(u, cursor, p.Columns))
+		})
+		if err != nil {
+			return nil, err
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return nil, err
+		}
+		key := "exports/" + hex.EncodeToString(clock.Bytes(nil, 16)) + ".csv"
+		if err := store.Put(ctx, key, blobs.Blob{ContentType: "text/csv; charset=utf-8", Data: buf.Bytes()}); err != nil {
+			return nil, err
+		}
+		progress(jobs.Progress{Done: rows, Total: rows})
+		return map[string]interface{}{"key": key, "rows": rows}, nil
+	}
+}
+
+// ImportUser is a customer to create in an import job.
+type ImportUser struct {
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	Email       string   `json:"email"`
+	FirstName   string   `json:"firstName"`
+	LastName    string   `json:"lastName"`
+	Residency   string   `json:"residency"`
+	DateOfBirth string   `json:"dateOfBirth"`
+	Tags        []string `json:"tags"`
+}
+
+// ImportJob creates customers, continuing past failures. Its params are a
+// JSON array of ImportUsers; failures are reported by username.
+func ImportJob(s Service) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		var us []ImportUser
+		if err := json.Unmarshal(params, &us); err != nil {
+			return nil, ErrInvalidRequest
+		}
+		imported := make([]string, 0, len(us))
+		failed := make(map[string]string)
+		for k, iu := range us {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			id, err := s.PostUser(jobContext(ctx), users.User{
+				Username:    iu.Username,
+				Password:    iu.Password,
+				Email:       iu.Email,
+				FirstName:   iu.FirstName,
+				LastName:    iu.LastName,
+				Residency:   iu.Residency,
+				DateOfBirth: iu.DateOfBirth,
+				Tags:        iu.Tags,
+			})
+			if err != nil {
+				failed[iu.Username] = err.Error()
+			} else {
+				imported = append(imported, id)
+			}
+			progress(jobs.Progress{Done: k + 1, Total: len(us)})
+		}
+		return map[string]interface{}{"imported": imported, "failed": failed}, nil
+	}
+}
+
+// MergeParams are the params of a merge job.
+type MergeParams struct {
+	// Into is the customer kept.
+	Into string `json:"into"`
+	// From are the duplicates merged into it and deleted.
+	From []string `json:"from"`
+}
+
+// MergeJob merges duplicate customers, such as those FindDuplicates
+// reports, into one: their addresses, usable cards and tags are added to
+// the customer kept, and they are then deleted. Flagged cards are not
+// moved, so that merging does not clear their flag; they are deleted with
+// their customer. Duplicates are merged one at a time, continuing past
+// failures.
+func MergeJob(s Service) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		var p MergeParams
+		if err := json.Unmarshal(params, &p); err != nil || p.Into == "" || len(p.From) == 0 {
+			return nil, ErrInvalidRequest
+		}
+		ctx = jobContext(ctx)
+		if _, err := s.BackupUser(ctx, p.Into); err != nil {
+			return nil, err
+		}
+		merged := make([]string, 0, len(p.From))
+		failed := make(map[string]string)
+		for k, id := range p.From {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err := merge(ctx, s, p.Into, id); err != nil {
+				failed[id] = err.Error()
+			} else {
+				merged = append(merged, id)
+			}
+			progress(jobs.Progress{Done: k + 1, Total: len(p.From)})
+		}
+		return map[string]interface{}{"into": p.Into, "merged": merged, "failed": failed}, nil
+	}
+}
+
+// merge moves the attributes of customer from onto into, then deletes it.
+func merge(ctx context.Context, s Service, into, from string) error {
+	if from == into {
+		return ErrInvalidRequest
+	}
+	b, err := s.BackupUser(ctx, from)
+	if err != nil {
+		return err
+	}
+	for _, a := range b.Addresses {
+		a.ID = ""
+		if _, err := s.PostAddress(ctx, a, into); err != nil {
+			return err
+		}
+	}
+	for _, c := range b.Cards {
+		if !c.Usable() {
+			continue
+		}
+		c.ID = ""
+		if _, err := s.PostCard(ctx, c, into); err != nil {
+			return err
+		}
+	}
+	u, err := s.GetUsers(ctx, from, db.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, t := range u[0].Tags {
+		if err := s.AddTag(ctx, into, t); err != nil {
+			return err
+		}
+	}
+	return deleteCustomer(ctx, s, from)
+}
+
+// deleteCustomer deletes the customer with the token of its delete plan,
+// as jobs are confirmed when submitted.
+func deleteCustomer(ctx context.Context, s Service, id string) error {
+	plan, err := s.PlanDelete(ctx, "customers", id)
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, "customers", id, plan.Token)
+}
+
+// AnonymizeParams are the params of an anonymize job.
+type AnonymizeParams struct {
+	IDs []string `json:"ids"`
+}
+
+// AnonymizeJob erases the personal data of customers who asked to be
+// forgotten but whose accounts must be kept, such as for order history.
+// Their names and email are replaced with pseudonyms keyed with a random
+// secret, so they cannot be recovered, and their addresses and cards are
+// deleted. Customers are anonymized one at a time, continuing past
+// failures.
+func AnonymizeJob(s Service) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		var p AnonymizeParams
+		if err := json.Unmarshal(params, &p); err != nil || len(p.IDs) == 0 {
+			return nil, ErrInvalidRequest
+		}
+		ctx = jobContext(ctx)
+		a := NewAnonymizer("")
+		anonymized := make([]string, 0, len(p.IDs))
+		failed := make(map[string]string)
+		for k, id := range p.IDs {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err := anonymize(ctx, s, a, id); err != nil {
+				failed[id] = err.Error()
+			} else {
+				anonymized = append(anonymized, id)
+			}
+			progress(jobs.Progress{Done: k + 1, Total: len(p.IDs)})
+		}
+		return map[string]interface{}{"anonymized": anonymized, "failed": failed}, nil
+	}
+}
+
+func anonymize(ctx context.Context, s Service, a Anonymizer, id string) error {
+	b, err := s.BackupUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	u, err := b.User()
+	if err != nil {
+		return err
+	}
+	masked := a.User(u)
+	if err := s.UpdateProfile(ctx, users.User{
+		UserID:    id,
+		FirstName: masked.FirstName,
+		LastName:  masked.LastName,
+		Email:     masked.Email,
+	}); err != nil {
+		return err
+	}
+	for _, ad := range b.Addresses {
+		if err := s.Delete(ctx, "addresses", ad.ID, ""); err != nil {
+			return err
+		}
+	}
+	for _, c := range b.Cards {
+		if err := s.Delete(ctx, "cards", c.ID, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
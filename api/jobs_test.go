@@ -0,0 +1,298 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/blobs"
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+)
+
+type restoreService struct {
+	Service
+}
+
+func (restoreService) RestoreUser(ctx context.Context, b Backup) (string, error) {
+	u, err := b.User()
+	return u.UserID, err
+}
+
+func TestRestoreJob(t *testing.T) {
+	params, _ := json.Marshal([]Backup{
+		{Version: backupVersion, Customer: BackupCustomer{ID: "1", Username: "a"}},
+		{Version: backupVersion + 1, Customer: BackupCustomer{ID: "2", Username: "b"}},
+	})
+	var last jobs.Progress
+	result, err := RestoreJob(restoreService{})(context.Background(), params, func(p jobs.Progress) { last = p })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Done != 2 || last.Total != 2 {
+		t.Errorf("Expected full progress, received %+v", last)
+	}
+	if len(result["restored"].([]string)) != 1 || len(result["failed"].(map[string]string)) != 1 {
+		t.Errorf("Expected one restored and one failed, received %v", result)
+	}
+}
+
+func TestRestoreJobInvalidParams(t *testing.T) {
+	_, err := RestoreJob(restoreService{})(context.Background(), json.RawMessage("{}"), func(jobs.Progress) {})
+	if err != ErrInvalidRequest {
+		t.Errorf("Expected invalid request, received %v", err)
+	}
+}
+
+type orphanDB struct {
+	db.Database
+	before time.Time
+	dryRun bool
+}
+
+func (d *orphanDB) CollectOrphans(before time.Time, dryRun bool) (db.Orphans, error) {
+	d.before, d.dryRun = before, dryRun
+	return db.Orphans{Addresses: 2, Cards: 1}, nil
+}
+
+func TestGCJob(t *testing.T) {
+	prev := db.DefaultDb
+	d := &orphanDB{}
+	db.DefaultDb = d
+	defer func() { db.DefaultDb = prev }()
+
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	result, err := GCJob(c)(context.Background(), nil, func(jobs.Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["addresses"] != 2 || result["cards"] != 1 || d.dryRun {
+		t.Errorf("Expected the orphans deleted, received %v", result)
+	}
+	if c.Now().Sub(d.before) != orphanGrace {
+		t.Errorf("Expected recent attributes spared, received cutoff %v", d.before)
+	}
+	if _, err := GCJob(c)(context.Background(), json.RawMessage(`{"dryRun": true}`), func(jobs.Progress) {}); err != nil || !d.dryRun {
+		t.Errorf("Expected a dry run, received %v", err)
+	}
+	if _, err := GCJob(c)(context.Background(), json.RawMessage(`[]`), func(jobs.Progress) {}); err != ErrInvalidRequest {
+		t.Errorf("Expected invalid params refused, received %v", err)
+	}
+}
+
+type purgeDB struct {
+	db.Database
+	before map[string]time.Time
+}
+
+func (d *purgeDB) Purge(kind string, before time.Time) (int64, error) {
+	d.before[kind] = before
+	return 4, nil
+}
+
+func TestRetentionJob(t *testing.T) {
+	prev, retention := db.DefaultDb, db.Retention
+	d := &purgeDB{before: make(map[string]time.Time)}
+	db.DefaultDb, db.Retention = d, map[string]time.Duration{db.LoginHistory: 24 * time.Hour}
+	defer func() { db.DefaultDb, db.Retention = prev, retention }()
+
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	result, err := RetentionJob(c)(context.Background(), nil, func(jobs.Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged := result["purged"].(map[string]int64); len(purged) != 1 || purged[db.LoginHistory] != 4 {
+		t.Errorf("Expected the login history purged, received %v", result)
+	}
+	if age := c.Now().Sub(d.before[db.LoginHistory]); age != 24*time.Hour {
+		t.Errorf("Expected attempts from the last day kept, received cutoff %v", d.before[db.LoginHistory])
+	}
+}
+
+type exportService struct {
+	Service
+	query db.Query
+}
+
+func (s *exportService) ExportUsers(ctx context.Context, q db.Query, cursor string, f func(users.User, string) error) error {
+	s.query = q
+	for _, u := range []users.User{{UserID: "1", Username: "a"}, {UserID: "2", Username: "b"}} {
+		if err := f(u, u.UserID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExportJob(t *testing.T) {
+	s := &exportService{}
+	store := blobs.Dir(t.TempDir())
+	params := json.RawMessage(`{"filter": "tag=vip", "columns": ["id", "username"]}`)
+	result, err := ExportJob(s, store)(context.Background(), params, func(jobs.Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.query.Tag != "vip" || result["rows"] != 2 {
+		t.Errorf("Expected the tagged customers exported, received %+v, %v", s.query, result)
+	}
+	b, err := store.Get(context.Background(), result["key"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Data) != "id,username\n1,a\n2,b\n" {
+		t.Errorf("Expected the export stored, received %q", b.Data)
+	}
+	if _, err := ExportJob(s, store)(context.Background(), json.RawMessage(`{"columns": ["password"]}`), func(jobs.Progress) {}); err != ErrInvalidRequest {
+		t.Errorf("Expected an unknown column refused, received %v", err)
+	}
+}
+
+type importService struct {
+	Service
+	admin bool
+}
+
+func (s *importService) PostUser(ctx context.Context, u users.User) (string, error) {
+	p, _ := PrincipalFromContext(ctx)
+	s.admin = p.Admin
+	if u.Username == "taken" {
+		return "", errors.New("Username taken")
+	}
+	return "id-" + u.Username, nil
+}
+
+func TestImportJob(t *testing.T) {
+	s := &importService{}
+	params := json.RawMessage(`[{"username": "eve", "password": "secret"}, {"username": "taken"}]`)
+	result, err := ImportJob(s)(context.Background(), params, func(jobs.Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result["imported"].([]string)) != 1 || len(result["failed"].(map[string]string)) != 1 {
+		t.Errorf("Expected one imported and one failed, received %v", result)
+	}
+	if !s.admin {
+		t.Error("Expected customers imported as an admin")
+	}
+}
+
+// mergeService holds customers by ID and records what is moved between them.
+type mergeService struct {
+	Service
+	customers map[string]Backup
+	tags      map[string][]string
+	addresses []string
+	cards     []string
+	deleted   []string
+}
+
+func (s *mergeService) BackupUser(ctx context.Context, id string) (Backup, error) {
+	b, ok := s.customers[id]
+	if !ok {
+		return Backup{}, users.ErrUserNotFound
+	}
+	return b, nil
+}
+
+func (s *mergeService) GetUsers(ctx context.Context, id string, l db.ListOptions) ([]users.User, error) {
+	return []users.User{{UserID: id, Tags: s.tags[id]}}, nil
+}
+
+func (s *mergeService) PostAddress(ctx context.Context, a users.Address, userid string) (string, error) {
+	s.addresses = append(s.addresses, userid+":"+a.Street)
+	return "new", nil
+}
+
+func (s *mergeService) PostCard(ctx context.Context, c users.Card, userid string) (string, error) {
+	s.cards = append(s.cards, userid+":"+c.LongNum)
+	return "new", nil
+}
+
+func (s *mergeService) AddTag(ctx context.Context, id, tag string) error {
+	s.tags[id] = append(s.tags[id], tag)
+	return nil
+}
+
+func (s *mergeService) UpdateProfile(ctx context.Context, u users.User) error {
+	b := s.customers[u.UserID]
+	b.Customer.FirstName, b.Customer.LastName, b.Customer.Email = u.FirstName, u.LastName, u.Email
+	s.customers[u.UserID] = b
+	return nil
+}
+
+func (s *mergeService) PlanDelete(ctx context.Context, entity, id string) (DeletePlan, error) {
+	return DeletePlan{Entity: entity, ID: id, Token: "token"}, nil
+}
+
+func (s *mergeService) Delete(ctx context.Context, entity, id, confirm string) error {
+	if entity == "customers" && confirm != "token" {
+		return ErrConfirmationRequired
+	}
+	s.deleted = append(s.deleted, entity+"/"+id)
+	return nil
+}
+
+func TestMergeJob(t *testing.T) {
+	s := &mergeService{
+		customers: map[string]Backup{
+			"keep": {Version: backupVersion, Customer: BackupCustomer{ID: "keep", Username: "eve"}},
+			"dup": {
+				Version:   backupVersion,
+				Customer:  BackupCustomer{ID: "dup", Username: "eve2"},
+				Addresses: []users.Address{{ID: "a1", Street: "High"}},
+				Cards: []users.Card{
+					{ID: "c1", LongNum: "4111"},
+					{ID: "c2", LongNum: "4222", Status: users.CardSuspectedFraud},
+				},
+			},
+		},
+		tags: map[string][]string{"dup": {"vip"}},
+	}
+	params := json.RawMessage(`{"into": "keep", "from": ["dup", "missing"]}`)
+	result, err := MergeJob(s)(context.Background(), params, func(jobs.Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result["merged"].([]string)) != 1 || len(result["failed"].(map[string]string)) != 1 {
+		t.Errorf("Expected one merged and one failed, received %v", result)
+	}
+	if strings.Join(s.addresses, ",") != "keep:High" || strings.Join(s.cards, ",") != "keep:4111" {
+		t.Errorf("Expected the address and usable card moved, received %v, %v", s.addresses, s.cards)
+	}
+	if strings.Join(s.tags["keep"], ",") != "vip" || strings.Join(s.deleted, ",") != "customers/dup" {
+		t.Errorf("Expected the tags moved and the duplicate deleted, received %v, %v", s.tags, s.deleted)
+	}
+	if _, err := MergeJob(s)(context.Background(), json.RawMessage(`{"into": "keep"}`), func(jobs.Progress) {}); err != ErrInvalidRequest {
+		t.Errorf("Expected a merge of nothing refused, received %v", err)
+	}
+}
+
+func TestAnonymizeJob(t *testing.T) {
+	s := &mergeService{customers: map[string]Backup{
+		"1": {
+			Version:   backupVersion,
+			Customer:  BackupCustomer{ID: "1", Username: "eve", FirstName: "Eve", LastName: "Berger", Email: "eve@example.com"},
+			Addresses: []users.Address{{ID: "a1"}},
+			Cards:     []users.Card{{ID: "c1"}},
+		},
+	}}
+	result, err := AnonymizeJob(s)(context.Background(), json.RawMessage(`{"ids": ["1"]}`), func(jobs.Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result["anonymized"].([]string)) != 1 {
+		t.Errorf("Expected the customer anonymized, received %v", result)
+	}
+	c := s.customers["1"].Customer
+	if c.FirstName == "Eve" || c.LastName == "Berger" || !strings.HasSuffix(c.Email, "@example.invalid") {
+		t.Errorf("Expected the profile masked, received %+v", c)
+	}
+	if strings.Join(s.deleted, ",") != "addresses/a1,cards/c1" {
+		t.Errorf("Expected the addresses and cards deleted, received %v", s.deleted)
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+// logincache.go contains the cache of the credentials logins are verified
+// against, so that repeated logins and API requests authenticated with the
+// same username do not each read and decode the whole customer document.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var LoginCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "login_cache_lookups_total",
+	Help: "Number of credential lookups for logins, by whether they were served from the cache.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(LoginCacheLookups)
+}
+
+// credentials are what verifying a login needs of a user.
+type credentials struct {
+	userID   string
+	username string
+	salt     string
+	hash     string
+	expires  time.Time
+}
+
+// user returns a user with only the credentials set.
+func (c credentials) user() users.User {
+	return users.User{UserID: c.userID, Username: c.username, Password: c.hash, Salt: c.salt}
+}
+
+// loginCache keeps up to size credentials for ttl, by the normalized
+// username or email they were looked up with. Entries are dropped when
+// their user is deleted, restored or has their profile updated, so that the
+// cache only outlives changes made on other replicas, for at most ttl.
+type loginCache struct {
+	ttl  time.Duration
+	size int
+
+	mtx        sync.Mutex
+	entries    map[string]credentials
+	generation uint64
+}
+
+func newLoginCache(ttl time.Duration, size int) *loginCache {
+	return &loginCache{ttl: ttl, size: size, entries: make(map[string]credentials)}
+}
+
+func (c *loginCache) get(key string, now time.Time) (credentials, bool) {
+	if c == nil {
+		return credentials{}, false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[key]
+	if !ok || now.After(e.expires) {
+		LoginCacheLookups.WithLabelValues("miss").Inc()
+		return credentials{}, false
+	}
+	LoginCacheLookups.WithLabelValues("hit").Inc()
+	return e, true
+}
+
+// currentGeneration returns the generation to pass to put for a user about
+// to be read.
+func (c *loginCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.generation
+}
+
+// put stores the credentials of u, unless a user was forgotten since
+// generation, when u may have been read before the change.
+func (c *loginCache) put(key string, u users.User, generation uint64, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			return
+		}
+	}
+	c.entries[key] = credentials{
+		userID:   u.UserID,
+		username: u.Username,
+		salt:     u.Salt,
+		hash:     u.Password,
+		expires:  now.Add(c.ttl),
+	}
+}
+
+// forget drops the credentials of the user with id.
+func (c *loginCache) forget(id string) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generation++
+	for k, e := range c.entries {
+		if e.userID == id {
+			delete(c.entries, k)
+		}
+	}
+}
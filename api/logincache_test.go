@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// loginDB serves one user, counting how often it is looked up by name.
+type loginDB struct {
+	db.Database
+	user    users.User
+	lookups int
+}
+
+func (d *loginDB) GetUserByName(string) (users.User, error) {
+	d.lookups++
+	if d.user.UserID == "" {
+		return users.User{}, users.ErrUserNotFound
+	}
+	return d.user, nil
+}
+
+func (d *loginDB) GetUser(string) (users.User, error) {
+	if d.user.UserID == "" {
+		return users.User{}, users.ErrUserNotFound
+	}
+	return d.user, nil
+}
+
+func (d *loginDB) GetUserAttributes(*users.User) error          { return nil }
+func (d *loginDB) UpdateLastLogin(string) error                 { return nil }
+func (d *loginDB) CreateLoginAttempt(*users.LoginAttempt) error { return nil }
+func (d *loginDB) UpdateProfile(u *users.User) error {
+	d.user.Email = u.Email
+	return nil
+}
+func (d *loginDB) Delete(string, string) error {
+	d.user = users.User{}
+	return nil
+}
+
+func withLoginDB(t *testing.T) *loginDB {
+	u := users.User{Username: "eve", UserID: "5a934e000102030405000000", Salt: "salt", FirstName: "Eve"}
+	u.Password = calculatePassHash("pass", u.Salt)
+	d := &loginDB{user: u}
+	prev := db.DefaultDb
+	db.DefaultDb = d
+	t.Cleanup(func() { db.DefaultDb = prev })
+	return d
+}
+
+func TestLoginCache(t *testing.T) {
+	d := withLoginDB(t)
+	s := NewFixedService(WithLoginCache(time.Minute, 10))
+	ctx := context.Background()
+
+	for k := 0; k < 2; k++ {
+		if _, err := s.Authenticate(ctx, "Eve", "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Authenticate(ctx, "eve", "wrong"); err != ErrUnauthorized {
+		t.Errorf("Expected a wrong password refused, received %v", err)
+	}
+	u, err := s.Login(ctx, "eve", "pass")
+	if err != nil || u.FirstName != "Eve" {
+		t.Errorf("Expected the whole user logged in, received %+v, %v", u, err)
+	}
+	if d.lookups != 1 {
+		t.Errorf("Expected the credentials read once, read %v times", d.lookups)
+	}
+
+	if err := s.Delete(ctx, "customers", d.user.UserID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, "eve", "pass"); err != ErrUnauthorized {
+		t.Errorf("Expected a deleted user refused, received %v", err)
+	}
+}
+
+func TestLoginCacheStale(t *testing.T) {
+	d := withLoginDB(t)
+	s := NewFixedService(WithLoginCache(time.Minute, 10))
+	ctx := context.Background()
+
+	if _, err := s.Authenticate(ctx, "eve", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	// The password changes on another replica.
+	d.user.Password = calculatePassHash("new", d.user.Salt)
+	if _, err := s.Login(ctx, "eve", "pass"); err != ErrUnauthorized {
+		t.Errorf("Expected stale credentials refused, received %v", err)
+	}
+	if _, err := s.Login(ctx, "eve", "new"); err != nil {
+		t.Errorf("Expected the new password accepted, received %v", err)
+	}
+}
+
+func TestLoginCacheProfileUpdated(t *testing.T) {
+	d := withLoginDB(t)
+	s := NewFixedService(WithLoginCache(time.Minute, 10))
+	ctx := context.Background()
+
+	if _, err := s.Authenticate(ctx, "eve", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateProfile(ctx, users.User{UserID: d.user.UserID, Email: "eve@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, "eve", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if d.lookups != 2 {
+		t.Errorf("Expected the credentials read again after a profile update, read %v times", d.lookups)
+	}
+}
+
+func TestLoginCachePutAfterForget(t *testing.T) {
+	c := newLoginCache(time.Minute, 10)
+	now := time.Now()
+	generation := c.currentGeneration()
+	c.forget("a")
+	c.put("eve", users.User{UserID: "a"}, generation, now)
+	if _, ok := c.get("eve", now); ok {
+		t.Error("Expected credentials read before a delete not to be cached")
+	}
+}
+
+func TestLoginCacheExpires(t *testing.T) {
+	d := withLoginDB(t)
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewFixedService(WithLoginCache(time.Minute, 10), WithClock(c))
+	ctx := context.Background()
+
+	for _, advance := range []time.Duration{0, 59 * time.Second, 2 * time.Second} {
+		c.Advance(advance)
+		if _, err := s.Authenticate(ctx, "eve", "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.lookups != 2 {
+		t.Errorf("Expected the user read again once the cache expired, read %v times", d.lookups)
+	}
+}
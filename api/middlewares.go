@@ -1,10 +1,16 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"time"
 
 	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/log"
+	"github.com/mikesay/user/blobs"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/jobs"
 	"github.com/mikesay/user/users"
 )
 
@@ -26,31 +32,66 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
-func (mw loggingMiddleware) Login(username, password string) (user users.User, err error) {
+func (mw loggingMiddleware) Login(ctx context.Context, username, password string) (user users.User, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
 			"method", "Login",
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Login(username, password)
+	return mw.next.Login(ctx, username, password)
 }
 
-func (mw loggingMiddleware) Register(username, password, email, first, last string) (string, error) {
+func (mw loggingMiddleware) VerifyLogin(ctx context.Context, challenge, code string) (user users.User, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
+			"method", "VerifyLogin",
+			"verified", err == nil,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.VerifyLogin(ctx, challenge, code)
+}
+
+func (mw loggingMiddleware) Authenticate(ctx context.Context, username, password string) (user users.User, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "Authenticate",
+			"authenticated", err == nil,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Authenticate(ctx, username, password)
+}
+
+func (mw loggingMiddleware) Register(ctx context.Context, username, password, email, first, last, residency, dob string) (string, error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
 			"method", "Register",
 			"username", username,
 			"email", email,
+			"residency", residency,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Register(username, password, email, first, last)
+	return mw.next.Register(ctx, username, password, email, first, last, residency, dob)
 }
 
-func (mw loggingMiddleware) PostUser(user users.User) (id string, err error) {
+func (mw loggingMiddleware) FindDuplicates(ctx context.Context, p Page) (ds []db.Duplicate, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
+			"method", "FindDuplicates",
+			"page", p.Number,
+			"result", len(ds),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.FindDuplicates(ctx, p)
+}
+
+func (mw loggingMiddleware) PostUser(ctx context.Context, user users.User) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
 			"method", "PostUser",
 			"username", user.Username,
 			"email", user.Email,
@@ -58,28 +99,56 @@ func (mw loggingMiddleware) PostUser(user users.User) (id string, err error) {
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.PostUser(user)
+	return mw.next.PostUser(ctx, user)
 }
 
-func (mw loggingMiddleware) GetUsers(id string) (u []users.User, err error) {
+func (mw loggingMiddleware) GetUsers(ctx context.Context, id string, l db.ListOptions) (u []users.User, err error) {
 	defer func(begin time.Time) {
 		who := id
 		if who == "" {
 			who = "all"
 		}
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
 			"method", "GetUsers",
 			"id", who,
+			"sort", l.Sort,
+			"result", len(u),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetUsers(ctx, id, l)
+}
+
+func (mw loggingMiddleware) SearchUsers(ctx context.Context, q db.Query) (u []users.User, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "SearchUsers",
 			"result", len(u),
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetUsers(id)
+	return mw.next.SearchUsers(ctx, q)
 }
 
-func (mw loggingMiddleware) PostAddress(add users.Address, id string) (string, error) {
+func (mw loggingMiddleware) ExportUsers(ctx context.Context, q db.Query, cursor string, f func(users.User, string) error) (err error) {
+	var n int
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
+			"method", "ExportUsers",
+			"resumed", cursor != "",
+			"result", n,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ExportUsers(ctx, q, cursor, func(u users.User, c string) error {
+		n++
+		return f(u, c)
+	})
+}
+
+func (mw loggingMiddleware) PostAddress(ctx context.Context, add users.Address, id string) (string, error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
 			"method", "PostAddress",
 			"street", add.Street,
 			"number", add.Number,
@@ -87,76 +156,344 @@ func (mw loggingMiddleware) PostAddress(add users.Address, id string) (string, e
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.PostAddress(add, id)
+	return mw.next.PostAddress(ctx, add, id)
 }
 
-func (mw loggingMiddleware) GetAddresses(id string) (a []users.Address, err error) {
+func (mw loggingMiddleware) GetAddresses(ctx context.Context, id string, l db.ListOptions) (a []users.Address, err error) {
 	defer func(begin time.Time) {
 		who := id
 		if who == "" {
 			who = "all"
 		}
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
 			"method", "GetAddresses",
 			"id", who,
+			"sort", l.Sort,
 			"result", len(a),
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetAddresses(id)
+	return mw.next.GetAddresses(ctx, id, l)
 }
 
-func (mw loggingMiddleware) PostCard(card users.Card, id string) (string, error) {
+func (mw loggingMiddleware) PostCard(ctx context.Context, card users.Card, id string) (string, error) {
 	defer func(begin time.Time) {
 		cc := card
 		cc.MaskCC()
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
 			"method", "PostCard",
 			"card", cc.LongNum,
 			"user", id,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.PostCard(card, id)
+	return mw.next.PostCard(ctx, card, id)
+}
+
+func (mw loggingMiddleware) PatchCard(ctx context.Context, id string, p CardPatch) (c users.Card, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "PatchCard",
+			"id", id,
+			"status", p.Status,
+			"result", err == nil,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PatchCard(ctx, id, p)
 }
 
-func (mw loggingMiddleware) GetCards(id string) (a []users.Card, err error) {
+func (mw loggingMiddleware) GetCards(ctx context.Context, id string, l db.ListOptions) (a []users.Card, err error) {
 	defer func(begin time.Time) {
 		who := id
 		if who == "" {
 			who = "all"
 		}
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
 			"method", "GetCards",
 			"id", who,
+			"sort", l.Sort,
 			"result", len(a),
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetCards(id)
+	return mw.next.GetCards(ctx, id, l)
 }
 
-func (mw loggingMiddleware) Delete(entity, id string) (err error) {
+func (mw loggingMiddleware) GetCustomerAddresses(ctx context.Context, id string) (a []users.Address, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
+			"method", "GetCustomerAddresses",
+			"id", id,
+			"result", len(a),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetCustomerAddresses(ctx, id)
+}
+
+func (mw loggingMiddleware) GetCustomerCards(ctx context.Context, id string) (c []users.Card, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "GetCustomerCards",
+			"id", id,
+			"result", len(c),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetCustomerCards(ctx, id)
+}
+
+func (mw loggingMiddleware) Delete(ctx context.Context, entity, id, confirm string) (err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
 			"method", "Delete",
 			"entity", entity,
 			"id", id,
+			"confirmed", confirm != "",
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Delete(ctx, entity, id, confirm)
+}
+
+func (mw loggingMiddleware) PlanDelete(ctx context.Context, entity, id string) (plan DeletePlan, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "PlanDelete",
+			"entity", entity,
+			"id", id,
+			"addresses", plan.Addresses,
+			"cards", plan.Cards,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PlanDelete(ctx, entity, id)
+}
+
+func (mw loggingMiddleware) GetLogins(ctx context.Context, id string) (l []users.LoginAttempt, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "GetLogins",
+			"id", id,
+			"result", len(l),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetLogins(ctx, id)
+}
+
+func (mw loggingMiddleware) PostNote(ctx context.Context, id string, n users.Note) (note users.Note, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "PostNote",
+			"id", id,
+			"visibility", n.Visibility,
+			"result", note.ID,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PostNote(ctx, id, n)
+}
+
+func (mw loggingMiddleware) GetNotes(ctx context.Context, id string, p Page) (ns []users.Note, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "GetNotes",
+			"id", id,
+			"page", p.Number,
+			"result", len(ns),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetNotes(ctx, id, p)
+}
+
+func (mw loggingMiddleware) PutAvatar(ctx context.Context, id string, r io.Reader) (url string, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "PutAvatar",
+			"id", id,
+			"result", url != "",
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PutAvatar(ctx, id, r)
+}
+
+func (mw loggingMiddleware) GetAvatar(ctx context.Context, id string) (b blobs.Blob, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "GetAvatar",
+			"id", id,
+			"result", len(b.Data),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetAvatar(ctx, id)
+}
+
+func (mw loggingMiddleware) UpdateProfile(ctx context.Context, u users.User) (err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "UpdateProfile",
+			"id", u.UserID,
+			"result", err == nil,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.UpdateProfile(ctx, u)
+}
+
+func (mw loggingMiddleware) AddTag(ctx context.Context, id, tag string) (err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "AddTag",
+			"id", id,
+			"tag", tag,
+			"result", err == nil,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.AddTag(ctx, id, tag)
+}
+
+func (mw loggingMiddleware) RemoveTag(ctx context.Context, id, tag string) (err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "RemoveTag",
+			"id", id,
+			"tag", tag,
+			"result", err == nil,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RemoveTag(ctx, id, tag)
+}
+
+func (mw loggingMiddleware) BackupUser(ctx context.Context, id string) (b Backup, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "BackupUser",
+			"id", id,
+			"addresses", len(b.Addresses),
+			"cards", len(b.Cards),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.BackupUser(ctx, id)
+}
+
+func (mw loggingMiddleware) RestoreUser(ctx context.Context, b Backup) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "RestoreUser",
+			"id", b.Customer.ID,
+			"result", id,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RestoreUser(ctx, b)
+}
+
+func (mw loggingMiddleware) SubmitJob(ctx context.Context, kind string, params json.RawMessage) (j jobs.Job, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "SubmitJob",
+			"kind", kind,
+			"result", j.ID,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SubmitJob(ctx, kind, params)
+}
+
+func (mw loggingMiddleware) GetJob(ctx context.Context, id string) (j jobs.Job, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "GetJob",
+			"id", id,
+			"result", j.Status,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetJob(ctx, id)
+}
+
+func (mw loggingMiddleware) Indexes(ctx context.Context) (is []db.Index, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "Indexes",
+			"result", len(is),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Indexes(ctx)
+}
+
+func (mw loggingMiddleware) Impersonate(ctx context.Context, id string) (imp Impersonation, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "Impersonate",
+			"id", id,
+			"act_as", imp.ActAs,
+			"expires", imp.Expires,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Impersonate(ctx, id)
+}
+
+func (mw loggingMiddleware) RevokeImpersonation(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "RevokeImpersonation",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RevokeImpersonation(ctx, id)
+}
+
+func (mw loggingMiddleware) AuthenticateImpersonation(ctx context.Context, token string) (p Principal, err error) {
+	defer func(begin time.Time) {
+		mw.clientLogger(ctx).Log(
+			"method", "AuthenticateImpersonation",
+			"id", p.UserID,
+			"act_as", p.ActAs,
+			"authenticated", err == nil,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Delete(entity, id)
+	return mw.next.AuthenticateImpersonation(ctx, token)
 }
 
-func (mw loggingMiddleware) Health() (health []Health) {
+func (mw loggingMiddleware) Health(ctx context.Context) (health []Health) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.clientLogger(ctx).Log(
 			"method", "Health",
 			"result", len(health),
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Health()
+	return mw.next.Health(ctx)
+}
+
+// clientLogger annotates the logger with the calling client, if known.
+// clientLogger returns the logger for a call, naming its client and trace.
+func (mw loggingMiddleware) clientLogger(ctx context.Context) log.Logger {
+	logger := WithTrace(ctx, mw.logger)
+	// Everything done with an impersonation token is logged with the
+	// admin acting, as an audit trail.
+	if p, ok := PrincipalFromContext(ctx); ok && p.ActAs != "" {
+		logger = log.With(logger, "act_as", p.ActAs, "impersonating", p.UserID)
+	}
+	if c := ClientInfoFromContext(ctx).Client; c != "" {
+		return log.With(logger, "client", c)
+	}
+	return logger
 }
 
 type instrumentingService struct {
@@ -174,92 +511,317 @@ func NewInstrumentingService(requestCount metrics.Counter, requestLatency metric
 	}
 }
 
-func (s *instrumentingService) Login(username, password string) (users.User, error) {
+func (s *instrumentingService) Authenticate(ctx context.Context, username, password string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "authenticate").Add(1)
+		s.requestLatency.With("method", "authenticate").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Authenticate(ctx, username, password)
+}
+
+func (s *instrumentingService) Login(ctx context.Context, username, password string) (users.User, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "login").Add(1)
 		s.requestLatency.With("method", "login").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Login(username, password)
+	return s.Service.Login(ctx, username, password)
 }
 
-func (s *instrumentingService) Register(username, password, email, first, last string) (string, error) {
+func (s *instrumentingService) VerifyLogin(ctx context.Context, challenge, code string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "verify_login").Add(1)
+		s.requestLatency.With("method", "verify_login").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.VerifyLogin(ctx, challenge, code)
+}
+
+func (s *instrumentingService) Register(ctx context.Context, username, password, email, first, last, residency, dob string) (string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "register").Add(1)
 		s.requestLatency.With("method", "register").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Register(username, password, email, first, last)
+	return s.Service.Register(ctx, username, password, email, first, last, residency, dob)
 }
 
-func (s *instrumentingService) PostUser(user users.User) (string, error) {
+func (s *instrumentingService) FindDuplicates(ctx context.Context, p Page) ([]db.Duplicate, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "findDuplicates").Add(1)
+		s.requestLatency.With("method", "findDuplicates").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.FindDuplicates(ctx, p)
+}
+
+func (s *instrumentingService) PostUser(ctx context.Context, user users.User) (string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "postUser").Add(1)
 		s.requestLatency.With("method", "postUser").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.PostUser(user)
+	return s.Service.PostUser(ctx, user)
 }
 
-func (s *instrumentingService) GetUsers(id string) (u []users.User, err error) {
+func (s *instrumentingService) GetUsers(ctx context.Context, id string, l db.ListOptions) (u []users.User, err error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "getUsers").Add(1)
 		s.requestLatency.With("method", "getUsers").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetUsers(id)
+	return s.Service.GetUsers(ctx, id, l)
+}
+
+func (s *instrumentingService) SearchUsers(ctx context.Context, q db.Query) ([]users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "searchUsers").Add(1)
+		s.requestLatency.With("method", "searchUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SearchUsers(ctx, q)
 }
 
-func (s *instrumentingService) PostAddress(add users.Address, id string) (string, error) {
+func (s *instrumentingService) ExportUsers(ctx context.Context, q db.Query, cursor string, f func(users.User, string) error) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "exportUsers").Add(1)
+		s.requestLatency.With("method", "exportUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ExportUsers(ctx, q, cursor, f)
+}
+
+func (s *instrumentingService) PostAddress(ctx context.Context, add users.Address, id string) (string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "postAddress").Add(1)
 		s.requestLatency.With("method", "postAddress").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.PostAddress(add, id)
+	return s.Service.PostAddress(ctx, add, id)
 }
 
-func (s *instrumentingService) GetAddresses(id string) ([]users.Address, error) {
+func (s *instrumentingService) GetAddresses(ctx context.Context, id string, l db.ListOptions) ([]users.Address, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "getAddresses").Add(1)
 		s.requestLatency.With("method", "getAddresses").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetAddresses(id)
+	return s.Service.GetAddresses(ctx, id, l)
 }
 
-func (s *instrumentingService) PostCard(card users.Card, id string) (string, error) {
+func (s *instrumentingService) PostCard(ctx context.Context, card users.Card, id string) (string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "postCard").Add(1)
 		s.requestLatency.With("method", "postCard").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.PostCard(card, id)
+	return s.Service.PostCard(ctx, card, id)
 }
 
-func (s *instrumentingService) GetCards(id string) ([]users.Card, error) {
+func (s *instrumentingService) PatchCard(ctx context.Context, id string, p CardPatch) (users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "patchCard").Add(1)
+		s.requestLatency.With("method", "patchCard").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PatchCard(ctx, id, p)
+}
+
+func (s *instrumentingService) GetCards(ctx context.Context, id string, l db.ListOptions) ([]users.Card, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "getCards").Add(1)
 		s.requestLatency.With("method", "getCards").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetCards(id)
+	return s.Service.GetCards(ctx, id, l)
 }
 
-func (s *instrumentingService) Delete(entity, id string) error {
+func (s *instrumentingService) GetCustomerAddresses(ctx context.Context, id string) ([]users.Address, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getCustomerAddresses").Add(1)
+		s.requestLatency.With("method", "getCustomerAddresses").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetCustomerAddresses(ctx, id)
+}
+
+func (s *instrumentingService) GetCustomerCards(ctx context.Context, id string) ([]users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getCustomerCards").Add(1)
+		s.requestLatency.With("method", "getCustomerCards").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetCustomerCards(ctx, id)
+}
+
+func (s *instrumentingService) Delete(ctx context.Context, entity, id, confirm string) error {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "delete").Add(1)
 		s.requestLatency.With("method", "delete").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Delete(entity, id)
+	return s.Service.Delete(ctx, entity, id, confirm)
+}
+
+func (s *instrumentingService) PlanDelete(ctx context.Context, entity, id string) (DeletePlan, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "planDelete").Add(1)
+		s.requestLatency.With("method", "planDelete").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PlanDelete(ctx, entity, id)
+}
+
+func (s *instrumentingService) GetLogins(ctx context.Context, id string) ([]users.LoginAttempt, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getLogins").Add(1)
+		s.requestLatency.With("method", "getLogins").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetLogins(ctx, id)
+}
+
+func (s *instrumentingService) PostNote(ctx context.Context, id string, n users.Note) (users.Note, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "postNote").Add(1)
+		s.requestLatency.With("method", "postNote").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PostNote(ctx, id, n)
+}
+
+func (s *instrumentingService) GetNotes(ctx context.Context, id string, p Page) ([]users.Note, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getNotes").Add(1)
+		s.requestLatency.With("method", "getNotes").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetNotes(ctx, id, p)
+}
+
+func (s *instrumentingService) PutAvatar(ctx context.Context, id string, r io.Reader) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "putAvatar").Add(1)
+		s.requestLatency.With("method", "putAvatar").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PutAvatar(ctx, id, r)
+}
+
+func (s *instrumentingService) GetAvatar(ctx context.Context, id string) (blobs.Blob, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getAvatar").Add(1)
+		s.requestLatency.With("method", "getAvatar").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetAvatar(ctx, id)
+}
+
+func (s *instrumentingService) UpdateProfile(ctx context.Context, u users.User) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "updateProfile").Add(1)
+		s.requestLatency.With("method", "updateProfile").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.UpdateProfile(ctx, u)
+}
+
+func (s *instrumentingService) AddTag(ctx context.Context, id, tag string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "addTag").Add(1)
+		s.requestLatency.With("method", "addTag").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AddTag(ctx, id, tag)
+}
+
+func (s *instrumentingService) RemoveTag(ctx context.Context, id, tag string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "removeTag").Add(1)
+		s.requestLatency.With("method", "removeTag").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.RemoveTag(ctx, id, tag)
+}
+
+func (s *instrumentingService) BackupUser(ctx context.Context, id string) (Backup, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "backupUser").Add(1)
+		s.requestLatency.With("method", "backupUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.BackupUser(ctx, id)
+}
+
+func (s *instrumentingService) RestoreUser(ctx context.Context, b Backup) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "restoreUser").Add(1)
+		s.requestLatency.With("method", "restoreUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.RestoreUser(ctx, b)
+}
+
+func (s *instrumentingService) SubmitJob(ctx context.Context, kind string, params json.RawMessage) (jobs.Job, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "submitJob").Add(1)
+		s.requestLatency.With("method", "submitJob").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SubmitJob(ctx, kind, params)
+}
+
+func (s *instrumentingService) GetJob(ctx context.Context, id string) (jobs.Job, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getJob").Add(1)
+		s.requestLatency.With("method", "getJob").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetJob(ctx, id)
+}
+
+func (s *instrumentingService) Indexes(ctx context.Context) ([]db.Index, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "indexes").Add(1)
+		s.requestLatency.With("method", "indexes").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Indexes(ctx)
+}
+
+func (s *instrumentingService) Impersonate(ctx context.Context, id string) (Impersonation, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "impersonate").Add(1)
+		s.requestLatency.With("method", "impersonate").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Impersonate(ctx, id)
+}
+
+func (s *instrumentingService) RevokeImpersonation(ctx context.Context, id string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "revokeImpersonation").Add(1)
+		s.requestLatency.With("method", "revokeImpersonation").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.RevokeImpersonation(ctx, id)
+}
+
+func (s *instrumentingService) AuthenticateImpersonation(ctx context.Context, token string) (Principal, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "authenticateImpersonation").Add(1)
+		s.requestLatency.With("method", "authenticateImpersonation").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AuthenticateImpersonation(ctx, token)
 }
 
-func (s *instrumentingService) Health() []Health {
+func (s *instrumentingService) Health(ctx context.Context) []Health {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "health").Add(1)
 		s.requestLatency.With("method", "health").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Health()
+	return s.Service.Health(ctx)
 }
@@ -0,0 +1,271 @@
+package api
+
+// migrate.go contains the job copying customers to a database with IDs of
+// ULIDs, keeping a mapping table so that links holding old IDs can still be
+// resolved. IDs are not rewritten in place: each customer is copied with its
+// addresses, cards, login history and notes to the target database under
+// new IDs, and the service is then switched over to it.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+)
+
+// copiedCustomers is the kind under which customers are mapped once they
+// are copied whole.
+const copiedCustomers = "customer-copied"
+
+// migrateNotesPage is how many notes are read at a time when copying them.
+const migrateNotesPage = 100
+
+// MigrateIDsJob copies every customer to target under new ULIDs, and
+// records the new IDs of customers, addresses and cards in target, which
+// must be a db.IDMapper and db.AttributeImporter taking ULIDs. The new IDs
+// are recorded before anything is copied and each copy is skipped if done
+// already, so a failed job is resumed by submitting it again. Customers
+// changed after being copied are not copied again, so the service should be
+// made read-only before the job is submitted. Customers are copied one at a
+// time, continuing past failures. It takes no params.
+func MigrateIDsJob(target db.Database) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		if _, ok := target.(db.IDMapper); !ok {
+			return nil, db.ErrNoIDMap
+		}
+		importer, ok := target.(db.AttributeImporter)
+		if !ok {
+			return nil, errors.New("target database cannot import addresses and cards")
+		}
+		gen := ids.ULID{}
+		if g, ok := target.(db.IDGenerator); ok && g.IDs() != nil && !g.IDs().Valid(gen.New()) {
+			return nil, errors.New("target database does not take ULIDs")
+		}
+		total, err := db.CountUsers(ctx, db.Query{})
+		if err != nil {
+			return nil, err
+		}
+		migrated, skipped := 0, 0
+		failed := make(map[string]string)
+		err = db.ExportUsers(db.Query{}, "", func(u users.User, _ string) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			switch _, err := db.MappedID(target, copiedCustomers, u.UserID); {
+			case err == nil:
+				skipped++
+			case err != db.ErrNotMapped:
+				failed[u.UserID] = err.Error()
+			default:
+				if err := migrateCustomer(target, importer, gen, u.UserID); err != nil {
+					failed[u.UserID] = err.Error()
+				} else {
+					migrated++
+				}
+			}
+			if done := migrated + skipped + len(failed); done%100 == 0 {
+				progress(jobs.Progress{Done: done, Total: int(total)})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		progress(jobs.Progress{Done: migrated + skipped + len(failed), Total: int(total)})
+		return map[string]interface{}{"migrated": migrated, "skipped": skipped, "failed": failed}, nil
+	}
+}
+
+// migrateCustomer copies the customer with the ID old to target under the
+// new IDs mapped for it, drawing those not mapped yet from gen, and maps it
+// as copied once everything is.
+func migrateCustomer(target db.Database, importer db.AttributeImporter, gen ids.Generator, old string) error {
+	u, err := db.ReadUserWithAttributes(db.DefaultDb, old)
+	if err != nil {
+		return err
+	}
+	customers, err := mapNewIDs(target, gen, db.CustomerIDs, []string{old})
+	if err != nil {
+		return err
+	}
+	addresses, err := mapNewIDs(target, gen, db.AddressIDs, addressIDs(u.Addresses))
+	if err != nil {
+		return err
+	}
+	cards, err := mapNewIDs(target, gen, db.CardIDs, cardIDs(u.Cards))
+	if err != nil {
+		return err
+	}
+
+	id := customers[old]
+	switch _, err := target.GetUser(id); err {
+	case nil:
+	case users.ErrUserNotFound:
+		c := u
+		c.UserID, c.Addresses, c.Cards = id, nil, nil
+		if err := target.ImportUser(&c); err != nil {
+			return fmt.Errorf("import: %w", err)
+		}
+	default:
+		return fmt.Errorf("import: %w", err)
+	}
+	for _, a := range u.Addresses {
+		a.ID = addresses[a.ID]
+		switch _, err := target.GetAddress(a.ID); err {
+		case nil:
+			continue
+		case users.ErrAddressNotFound:
+		default:
+			return fmt.Errorf("addresses: %w", err)
+		}
+		if err := importer.ImportAddress(&a, id); err != nil {
+			return fmt.Errorf("addresses: %w", err)
+		}
+	}
+	for _, c := range u.Cards {
+		c.ID = cards[c.ID]
+		switch _, err := target.GetCard(c.ID); err {
+		case nil:
+			continue
+		case users.ErrCardNotFound:
+		default:
+			return fmt.Errorf("cards: %w", err)
+		}
+		if err := importer.ImportCard(&c, id); err != nil {
+			return fmt.Errorf("cards: %w", err)
+		}
+	}
+	if err := migrateLoginAttempts(target, old, id); err != nil {
+		return fmt.Errorf("login attempts: %w", err)
+	}
+	if err := migrateNotes(target, old, id); err != nil {
+		return fmt.Errorf("notes: %w", err)
+	}
+	return db.MapIDs(target, copiedCustomers, map[string]string{old: id})
+}
+
+// mapNewIDs returns the new IDs of the entities of kind with the old IDs,
+// mapping those not mapped yet in target to new ones from gen.
+func mapNewIDs(target db.Database, gen ids.Generator, kind string, olds []string) (map[string]string, error) {
+	mapped := make(map[string]string, len(olds))
+	fresh := make(map[string]string)
+	for _, old := range olds {
+		id, err := db.MappedID(target, kind, old)
+		if err == db.ErrNotMapped {
+			id = gen.New()
+			fresh[old] = id
+		} else if err != nil {
+			return nil, err
+		}
+		mapped[old] = id
+	}
+	if len(fresh) == 0 {
+		return mapped, nil
+	}
+	return mapped, db.MapIDs(target, kind, fresh)
+}
+
+func addressIDs(as []users.Address) []string {
+	ids := make([]string, 0, len(as))
+	for _, a := range as {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func cardIDs(cs []users.Card) []string {
+	ids := make([]string, 0, len(cs))
+	for _, c := range cs {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// migrateLoginAttempts copies the login attempts of the customer old to
+// the customer id of target, leaving out those it has already.
+func migrateLoginAttempts(target db.Database, old, id string) error {
+	attempts, err := db.DefaultDb.GetLoginAttempts(old)
+	if err != nil {
+		return err
+	}
+	copied, err := target.GetLoginAttempts(id)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(copied))
+	for _, a := range copied {
+		have[attemptKey(a)] = true
+	}
+	// Attempts are read newest first and written oldest first, keeping
+	// their order in the target.
+	for k := len(attempts) - 1; k >= 0; k-- {
+		a := attempts[k]
+		a.UserID = id
+		if have[attemptKey(a)] {
+			continue
+		}
+		if err := target.CreateLoginAttempt(&a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attemptKey identifies a login attempt of a customer.
+func attemptKey(a users.LoginAttempt) string {
+	return fmt.Sprintf("%d/%v/%v/%v/%v", a.Time.UnixMilli(), a.Success, a.IP, a.UserAgent, a.Outcome)
+}
+
+// migrateNotes copies the notes of the customer old to the customer id of
+// target, leaving out those it has already.
+func migrateNotes(target db.Database, old, id string) error {
+	notes, err := allNotes(db.DefaultDb, old)
+	if err != nil {
+		return err
+	}
+	copied, err := allNotes(target, id)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(copied))
+	for _, n := range copied {
+		have[noteKey(n)] = true
+	}
+	for k := len(notes) - 1; k >= 0; k-- {
+		n := notes[k]
+		n.ID = ""
+		n.UserID = id
+		if have[noteKey(n)] {
+			continue
+		}
+		if err := target.CreateNote(&n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allNotes reads every note of the user from d, newest first.
+func allNotes(d db.Database, userid string) ([]users.Note, error) {
+	var notes []users.Note
+	for offset := 0; ; offset += migrateNotesPage {
+		page, err := d.GetNotes(userid, offset, migrateNotesPage)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, page...)
+		if len(page) < migrateNotesPage {
+			return notes, nil
+		}
+	}
+}
+
+// noteKey identifies a note about a customer.
+func noteKey(n users.Note) string {
+	return fmt.Sprintf("%d/%v/%v/%v", n.CreatedAt.UnixMilli(), n.Author, n.Kind, n.Text)
+}
@@ -0,0 +1,293 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+)
+
+type migrateSourceDB struct {
+	db.Database
+	users []users.User
+}
+
+func (d *migrateSourceDB) CountUsers(db.Query) (int64, error) { return int64(len(d.users)), nil }
+
+func (d *migrateSourceDB) ExportUsers(_ db.Query, _ string, f func(users.User, string) error) error {
+	for _, u := range d.users {
+		if err := f(u, u.UserID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *migrateSourceDB) GetUser(id string) (users.User, error) {
+	for _, u := range d.users {
+		if u.UserID == id {
+			return u, nil
+		}
+	}
+	return users.User{}, users.ErrUserNotFound
+}
+
+func (d *migrateSourceDB) GetUserAttributes(u *users.User) error {
+	u.Addresses = []users.Address{{ID: u.UserID + "-a", Street: "Main"}}
+	u.Cards = []users.Card{{ID: u.UserID + "-c", LongNum: "4111"}}
+	return nil
+}
+
+func (d *migrateSourceDB) GetLoginAttempts(id string) ([]users.LoginAttempt, error) {
+	return []users.LoginAttempt{{UserID: id, Success: true}, {UserID: id}}, nil
+}
+
+func (d *migrateSourceDB) GetNotes(id string, offset, limit int) ([]users.Note, error) {
+	if offset > 0 {
+		return nil, nil
+	}
+	return []users.Note{{ID: "n", UserID: id, Text: "hi", CreatedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}}, nil
+}
+
+type migrateTargetDB struct {
+	db.Database
+	imported  []users.User
+	addresses []users.Address
+	cards     []users.Card
+	attempts  []users.LoginAttempt
+	notes     []users.Note
+	mapped    map[string]map[string]string
+	// failKind fails the mapping of IDs of that kind.
+	failKind string
+}
+
+func (d *migrateTargetDB) IDs() ids.Generator { return ids.ULID{} }
+
+func (d *migrateTargetDB) ImportUser(u *users.User) error {
+	if u.Username == "taken" {
+		return db.ErrUsernameTaken
+	}
+	d.imported = append(d.imported, *u)
+	return nil
+}
+
+func (d *migrateTargetDB) GetUser(id string) (users.User, error) {
+	for _, u := range d.imported {
+		if u.UserID == id {
+			return u, nil
+		}
+	}
+	return users.User{}, users.ErrUserNotFound
+}
+
+func (d *migrateTargetDB) ImportAddress(a *users.Address, userid string) error {
+	d.addresses = append(d.addresses, *a)
+	return nil
+}
+
+func (d *migrateTargetDB) GetAddress(id string) (users.Address, error) {
+	for _, a := range d.addresses {
+		if a.ID == id {
+			return a, nil
+		}
+	}
+	return users.Address{}, users.ErrAddressNotFound
+}
+
+func (d *migrateTargetDB) ImportCard(c *users.Card, userid string) error {
+	d.cards = append(d.cards, *c)
+	return nil
+}
+
+func (d *migrateTargetDB) GetCard(id string) (users.Card, error) {
+	for _, c := range d.cards {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return users.Card{}, users.ErrCardNotFound
+}
+
+func (d *migrateTargetDB) CreateLoginAttempt(a *users.LoginAttempt) error {
+	d.attempts = append(d.attempts, *a)
+	return nil
+}
+
+func (d *migrateTargetDB) GetLoginAttempts(id string) ([]users.LoginAttempt, error) {
+	var ls []users.LoginAttempt
+	for _, a := range d.attempts {
+		if a.UserID == id {
+			ls = append(ls, a)
+		}
+	}
+	return ls, nil
+}
+
+func (d *migrateTargetDB) CreateNote(n *users.Note) error {
+	d.notes = append(d.notes, *n)
+	return nil
+}
+
+func (d *migrateTargetDB) GetNotes(id string, offset, limit int) ([]users.Note, error) {
+	var ns []users.Note
+	for _, n := range d.notes {
+		if n.UserID == id {
+			ns = append(ns, n)
+		}
+	}
+	if offset >= len(ns) {
+		return nil, nil
+	}
+	return ns[offset:min(len(ns), offset+limit)], nil
+}
+
+func (d *migrateTargetDB) MapIDs(kind string, m map[string]string) error {
+	if kind == d.failKind {
+		return errors.New("unavailable")
+	}
+	if d.mapped[kind] == nil {
+		d.mapped[kind] = make(map[string]string)
+	}
+	for old, id := range m {
+		d.mapped[kind][old] = id
+	}
+	return nil
+}
+
+func (d *migrateTargetDB) MappedID(kind, old string) (string, error) {
+	if id, ok := d.mapped[kind][old]; ok {
+		return id, nil
+	}
+	return "", db.ErrNotMapped
+}
+
+func TestMigrateIDsJob(t *testing.T) {
+	prev := db.DefaultDb
+	db.DefaultDb = &migrateSourceDB{users: []users.User{
+		{UserID: "1", Username: "a"},
+		{UserID: "2", Username: "b"},
+		{UserID: "3", Username: "taken"},
+	}}
+	defer func() { db.DefaultDb = prev }()
+	target := &migrateTargetDB{mapped: map[string]map[string]string{copiedCustomers: {"2": "01ARZ3NDEKTSV4RRFFQ69G5FAV"}}}
+
+	var last jobs.Progress
+	result, err := MigrateIDsJob(target)(context.Background(), nil, func(p jobs.Progress) { last = p })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["migrated"] != 1 || result["skipped"] != 1 || len(result["failed"].(map[string]string)) != 1 {
+		t.Errorf("Expected one customer migrated, one skipped and one failed, received %v", result)
+	}
+	if last.Done != 3 || last.Total != 3 {
+		t.Errorf("Expected full progress, received %+v", last)
+	}
+	if len(target.imported) != 1 || len(target.addresses) != 1 || len(target.cards) != 1 {
+		t.Fatalf("Expected one customer imported with their address and card, received %v %v %v", target.imported, target.addresses, target.cards)
+	}
+	u, a, c := target.imported[0], target.addresses[0], target.cards[0]
+	if !(ids.ULID{}).Valid(u.UserID) || !(ids.ULID{}).Valid(a.ID) || !(ids.ULID{}).Valid(c.ID) {
+		t.Errorf("Expected ULIDs, received %v %v %v", u.UserID, a.ID, c.ID)
+	}
+	if target.mapped[db.CustomerIDs]["1"] != u.UserID || target.mapped[db.AddressIDs]["1-a"] != a.ID || target.mapped[db.CardIDs]["1-c"] != c.ID {
+		t.Errorf("Expected the new IDs mapped, received %v", target.mapped)
+	}
+	if target.mapped[copiedCustomers]["1"] != u.UserID {
+		t.Errorf("Expected the customer marked copied, received %v", target.mapped)
+	}
+	if len(target.attempts) != 2 || target.attempts[0].UserID != u.UserID || target.attempts[1].Success != true {
+		t.Errorf("Expected the login attempts copied oldest first, received %+v", target.attempts)
+	}
+	if len(target.notes) != 1 || target.notes[0].ID != "" || target.notes[0].UserID != u.UserID || target.notes[0].CreatedAt.Year() != 2020 {
+		t.Errorf("Expected the note copied with its creation time, received %+v", target.notes)
+	}
+}
+
+func TestMigrateIDsJobResumes(t *testing.T) {
+	prev := db.DefaultDb
+	db.DefaultDb = &migrateSourceDB{users: []users.User{{UserID: "1", Username: "a"}}}
+	defer func() { db.DefaultDb = prev }()
+	target := &migrateTargetDB{mapped: make(map[string]map[string]string), failKind: copiedCustomers}
+
+	job := MigrateIDsJob(target)
+	result, err := job(context.Background(), nil, func(jobs.Progress) {})
+	if err != nil || len(result["failed"].(map[string]string)) != 1 {
+		t.Fatalf("Expected the customer failed, received %v %v", result, err)
+	}
+	id := target.mapped[db.CustomerIDs]["1"]
+	if id == "" {
+		t.Fatal("Expected the customer mapped before being copied")
+	}
+	target.failKind = ""
+	if result, err = job(context.Background(), nil, func(jobs.Progress) {}); err != nil || result["migrated"] != 1 {
+		t.Fatalf("Expected the customer migrated on the rerun, received %v %v", result, err)
+	}
+	if target.mapped[db.CustomerIDs]["1"] != id || target.mapped[copiedCustomers]["1"] != id {
+		t.Errorf("Expected the rerun to keep the new ID %v, received %v", id, target.mapped)
+	}
+	if len(target.imported) != 1 || len(target.addresses) != 1 || len(target.cards) != 1 || len(target.attempts) != 2 || len(target.notes) != 1 {
+		t.Errorf("Expected nothing copied twice, received %d customers, %d addresses, %d cards, %d attempts and %d notes",
+			len(target.imported), len(target.addresses), len(target.cards), len(target.attempts), len(target.notes))
+	}
+}
+
+func TestMigrateIDsJobWithoutMapper(t *testing.T) {
+	_, err := MigrateIDsJob(&migrateSourceDB{})(context.Background(), nil, func(jobs.Progress) {})
+	if err != db.ErrNoIDMap {
+		t.Errorf("Expected a target without a mapping table refused, received %v", err)
+	}
+}
+
+func TestMigrateIDsJobWithoutULIDs(t *testing.T) {
+	_, err := MigrateIDsJob(&objectIDTargetDB{migrateTargetDB{mapped: make(map[string]map[string]string)}})(context.Background(), nil, func(jobs.Progress) {})
+	if err == nil {
+		t.Error("Expected a target creating ObjectIDs refused")
+	}
+}
+
+type objectIDTargetDB struct{ migrateTargetDB }
+
+func (d *objectIDTargetDB) IDs() ids.Generator { return ids.ObjectID{} }
+
+// migratedDB holds a customer migrated from a database of ObjectIDs.
+type migratedDB struct{ db.Database }
+
+func (migratedDB) IDs() ids.Generator { return ids.ULID{} }
+
+func (migratedDB) MapIDs(string, map[string]string) error { return nil }
+
+func (migratedDB) MappedID(kind, old string) (string, error) {
+	if kind == db.CustomerIDs && old == "57a98d98e4b00679b4a830b2" {
+		return "01ARZ3NDEKTSV4RRFFQ69G5FAV", nil
+	}
+	return "", db.ErrNotMapped
+}
+
+func (migratedDB) GetUser(id string) (users.User, error) {
+	if id == "01ARZ3NDEKTSV4RRFFQ69G5FAV" {
+		return users.User{UserID: id, Username: "eve"}, nil
+	}
+	return users.User{}, users.ErrUserNotFound
+}
+
+func TestFindByOldID(t *testing.T) {
+	prev := db.DefaultDb
+	db.DefaultDb = migratedDB{}
+	defer func() { db.DefaultDb = prev }()
+
+	if err := checkID("57a98d98e4b00679b4a830b2"); err != nil {
+		t.Errorf("Expected a mapped old ID accepted, received %v", err)
+	}
+	if err := checkID("57a98d98e4b00679b4a830b3"); err != users.ErrInvalidID {
+		t.Errorf("Expected an unmapped old ID refused, received %v", err)
+	}
+	us, err := NewFixedService().GetUsers(context.Background(), "57a98d98e4b00679b4a830b2", db.ListOptions{})
+	if err != nil || len(us) != 1 || us[0].UserID != "01ARZ3NDEKTSV4RRFFQ69G5FAV" {
+		t.Errorf("Expected the customer found by their old ID, received %v %v", us, err)
+	}
+}
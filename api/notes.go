@@ -0,0 +1,41 @@
+package api
+
+// notes.go contains the support notes agents keep on customers: a record of
+// each interaction, either internal to support or shareable with the
+// customer.
+
+import (
+	"context"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// PostNote records a note about the customer, returning it with its ID and
+// creation time. The author is taken from the authenticated caller when
+// there is one. Only the service records notes of a kind.
+func (s *fixedService) PostNote(ctx context.Context, id string, n users.Note) (users.Note, error) {
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		n.Author = principal.Username
+	}
+	n.ID, n.UserID, n.CreatedAt, n.Kind = "", id, time.Time{}, ""
+	if err := n.Validate(); err != nil {
+		return users.Note{}, err
+	}
+	if _, err := db.GetUser(ctx, id); err != nil {
+		return users.Note{}, err
+	}
+	if err := db.CreateNote(ctx, &n); err != nil {
+		return users.Note{}, err
+	}
+	return n, nil
+}
+
+// GetNotes returns a page of the customer's notes, newest first.
+func (s *fixedService) GetNotes(ctx context.Context, id string, p Page) ([]users.Note, error) {
+	if _, err := db.GetUser(ctx, id); err != nil {
+		return nil, err
+	}
+	return db.GetNotes(ctx, id, (p.Number-1)*p.Size, p.Size)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// notesDB holds one customer and their notes in memory.
+type notesDB struct {
+	db.Database
+	notes []users.Note
+}
+
+func (d *notesDB) GetUser(id string) (users.User, error) {
+	if id != "u1" {
+		return users.User{}, users.ErrUserNotFound
+	}
+	return users.User{UserID: id}, nil
+}
+
+func (d *notesDB) CreateNote(n *users.Note) error {
+	n.ID = string(rune('a' + len(d.notes)))
+	d.notes = append([]users.Note{*n}, d.notes...)
+	return nil
+}
+
+func (d *notesDB) GetNotes(userid string, offset, limit int) ([]users.Note, error) {
+	ns := d.notes[min(offset, len(d.notes)):]
+	return ns[:min(limit, len(ns))], nil
+}
+
+func TestPostNote(t *testing.T) {
+	prev := db.DefaultDb
+	notes := &notesDB{}
+	db.DefaultDb = notes
+	defer func() { db.DefaultDb = prev }()
+
+	s := NewFixedService()
+	ctx := context.Background()
+	n, err := s.PostNote(ctx, "u1", users.Note{Author: "agent", Text: "Refunded order 12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.ID == "" || n.UserID != "u1" || n.Visibility != users.NoteInternal {
+		t.Errorf("Expected an internal note on u1, received %+v", n)
+	}
+	admin := context.WithValue(ctx, principalKey, Principal{Username: "ops", Admin: true})
+	if n, _ := s.PostNote(admin, "u1", users.Note{Author: "spoofed", Text: "Called back", Visibility: users.NoteCustomer}); n.Author != "ops" {
+		t.Errorf("Expected the caller recorded as author, received %q", n.Author)
+	}
+	if _, err := s.PostNote(ctx, "u1", users.Note{Author: "agent"}); err == nil {
+		t.Error("Expected a note without text refused")
+	}
+	if _, err := s.PostNote(ctx, "u1", users.Note{Author: "agent", Text: "x", Visibility: "public"}); err != users.ErrInvalidNote {
+		t.Errorf("Expected an unknown visibility refused, received %v", err)
+	}
+	if _, err := s.PostNote(ctx, "u2", users.Note{Author: "agent", Text: "x"}); err != users.ErrUserNotFound {
+		t.Errorf("Expected a note on a missing customer refused, received %v", err)
+	}
+
+	ns, err := s.GetNotes(ctx, "u1", Page{Number: 1, Size: 1})
+	if err != nil || len(ns) != 1 || ns[0].Text != "Called back" {
+		t.Errorf("Expected the newest note first, received %+v %v", ns, err)
+	}
+	if ns, _ := s.GetNotes(ctx, "u1", Page{Number: 2, Size: 1}); len(ns) != 1 || ns[0].Text != "Refunded order 12" {
+		t.Errorf("Expected the older note on the second page, received %+v", ns)
+	}
+	if _, err := s.GetNotes(ctx, "u2", Page{Number: 1, Size: 1}); err != users.ErrUserNotFound {
+		t.Errorf("Expected notes of a missing customer refused, received %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+// reporting.go contains the reports of server errors and panics sent to an
+// error tracker, identifying the customer by CustomerHash only.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mikesay/user/reporting"
+	"github.com/mikesay/user/users"
+	commonMiddleware "github.com/weaveworks/common/middleware"
+)
+
+// requestRoute is the method and route of a request, for its reports.
+type requestRoute struct {
+	method, route string
+}
+
+// routeToContext is a ServerBefore hook storing the method and route of the
+// request, named as in HTTP metrics.
+func routeToContext(ctx context.Context, r *http.Request) context.Context {
+	rr := requestRoute{method: r.Method}
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			rr.route = commonMiddleware.MakeLabelValue(tmpl)
+		}
+	}
+	return context.WithValue(ctx, routeKey, rr)
+}
+
+// newReport returns a report of the request in ctx with the customer and
+// trace it carries, if any.
+func newReport(ctx context.Context) reporting.Report {
+	rr, _ := ctx.Value(routeKey).(requestRoute)
+	r := reporting.Report{Method: rr.method, Route: rr.route}
+	r.TraceID, _ = TraceIDs(ctx)
+	if p, ok := PrincipalFromContext(ctx); ok && p.UserID != "" {
+		r.UserHash = CustomerHash(p.UserID)
+	}
+	return r
+}
+
+// reportError reports err to reporter if it is a server error.
+func reportError(ctx context.Context, reporter reporting.Reporter, err error) {
+	status := ErrorStatus(err)
+	if reporter == nil || status < http.StatusInternalServerError {
+		return
+	}
+	r := newReport(ctx)
+	r.Type, r.Message, r.Status = users.ErrorCode(err), err.Error(), status
+	reporter.Report(ctx, r)
+}
+
+// PanicReporter returns the Report hook of middleware.Recover, reporting
+// panics to reporter. route names the request as in HTTP metrics.
+func PanicReporter(reporter reporting.Reporter) func(r *http.Request, route string, v interface{}, stack []byte) {
+	return func(r *http.Request, route string, v interface{}, stack []byte) {
+		report := newReport(r.Context())
+		report.Type, report.Message, report.Stack = "panic", fmt.Sprint(v), stack
+		report.Method, report.Route, report.Status = r.Method, route, http.StatusInternalServerError
+		reporter.Report(r.Context(), report)
+	}
+}
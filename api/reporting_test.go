@@ -0,0 +1,33 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mikesay/user/reporting"
+	"github.com/mikesay/user/users"
+)
+
+type reports []reporting.Report
+
+func (rs *reports) Report(ctx context.Context, r reporting.Report) error {
+	*rs = append(*rs, r)
+	return nil
+}
+
+func TestReportError(t *testing.T) {
+	var sent reports
+	ctx := context.WithValue(context.Background(), principalKey, Principal{UserID: "57a98d98e4b00679b4a830af"})
+	ctx = context.WithValue(ctx, routeKey, requestRoute{method: "GET", route: "customers_id"})
+	reportError(ctx, &sent, users.NewError(users.CodeUserNotFound, "Not found"))
+	reportError(ctx, &sent, errors.New("connection refused"))
+	reportError(ctx, nil, errors.New("connection refused"))
+	if len(sent) != 1 {
+		t.Fatalf("Expected only the server error reported, received %+v", sent)
+	}
+	r := sent[0]
+	if r.Type != users.CodeInternal || r.Status != 500 || r.Route != "customers_id" || r.UserHash != CustomerHash("57a98d98e4b00679b4a830af") {
+		t.Errorf("Expected the error with its request and hashed customer, received %+v", r)
+	}
+}
@@ -4,40 +4,232 @@ package api
 // user service. Everything here is agnostic to the transport (HTTP).
 
 import (
+	"context"
 	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"runtime"
+	"strings"
 	"time"
 
+	"github.com/mikesay/user/blobs"
+	"github.com/mikesay/user/clock"
 	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/events"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/middleware"
+	"github.com/mikesay/user/ratelimit"
+	"github.com/mikesay/user/risk"
+	"github.com/mikesay/user/signup"
 	"github.com/mikesay/user/users"
 )
 
 var (
-	ErrUnauthorized = errors.New("Unauthorized")
+	ErrUnauthorized   = users.NewError(users.CodeUnauthorized, "Unauthorized")
+	ErrLoginChallenge = users.NewError(users.CodeLoginChallenge, "Additional verification required")
+	ErrLoginDenied    = users.NewError(users.CodeLoginDenied, "Login denied")
 )
 
 // Service is the user service, providing operations for users to login, register, and retrieve customer information.
 type Service interface {
-	Login(username, password string) (users.User, error) // GET /login
-	Register(username, password, email, first, last string) (string, error)
-	GetUsers(id string) ([]users.User, error)
-	PostUser(u users.User) (string, error)
-	GetAddresses(id string) ([]users.Address, error)
-	PostAddress(u users.Address, userid string) (string, error)
-	GetCards(id string) ([]users.Card, error)
-	PostCard(u users.Card, userid string) (string, error)
-	Delete(entity, id string) error
-	Health() []Health // GET /health
+	Login(ctx context.Context, username, password string) (users.User, error) // GET /login
+	VerifyLogin(ctx context.Context, challenge, code string) (users.User, error)
+	Authenticate(ctx context.Context, username, password string) (users.User, error)
+	Register(ctx context.Context, username, password, email, first, last, residency, dob string) (string, error)
+	GetUsers(ctx context.Context, id string, l db.ListOptions) ([]users.User, error)
+	SearchUsers(ctx context.Context, q db.Query) ([]users.User, error)
+	ExportUsers(ctx context.Context, q db.Query, cursor string, f func(users.User, string) error) error
+	FindDuplicates(ctx context.Context, p Page) ([]db.Duplicate, error)
+	PostUser(ctx context.Context, u users.User) (string, error)
+	UpdateProfile(ctx context.Context, u users.User) error
+	GetAddresses(ctx context.Context, id string, l db.ListOptions) ([]users.Address, error)
+	PostAddress(ctx context.Context, u users.Address, userid string) (string, error)
+	GetCards(ctx context.Context, id string, l db.ListOptions) ([]users.Card, error)
+	GetCustomerAddresses(ctx context.Context, id string) ([]users.Address, error)
+	GetCustomerCards(ctx context.Context, id string) ([]users.Card, error)
+	PostCard(ctx context.Context, u users.Card, userid string) (string, error)
+	PatchCard(ctx context.Context, id string, p CardPatch) (users.Card, error)
+	Delete(ctx context.Context, entity, id, confirm string) error
+	PlanDelete(ctx context.Context, entity, id string) (DeletePlan, error)
+	GetLogins(ctx context.Context, id string) ([]users.LoginAttempt, error)
+	PostNote(ctx context.Context, id string, n users.Note) (users.Note, error)
+	GetNotes(ctx context.Context, id string, p Page) ([]users.Note, error)
+	PutAvatar(ctx context.Context, id string, r io.Reader) (string, error)
+	GetAvatar(ctx context.Context, id string) (blobs.Blob, error)
+	AddTag(ctx context.Context, id, tag string) error
+	RemoveTag(ctx context.Context, id, tag string) error
+	BackupUser(ctx context.Context, id string) (Backup, error)
+	RestoreUser(ctx context.Context, b Backup) (string, error)
+	SubmitJob(ctx context.Context, kind string, params json.RawMessage) (jobs.Job, error)
+	GetJob(ctx context.Context, id string) (jobs.Job, error)
+	Indexes(ctx context.Context) ([]db.Index, error)
+	Impersonate(ctx context.Context, id string) (Impersonation, error)
+	RevokeImpersonation(ctx context.Context, id string) error
+	AuthenticateImpersonation(ctx context.Context, token string) (Principal, error)
+	Health(ctx context.Context) []Health // GET /health
+}
+
+// Option configures the service returned by NewFixedService.
+type Option func(*fixedService)
+
+// WithRiskEvaluator evaluates every login with valid credentials, refusing
+// those the evaluator challenges or denies.
+func WithRiskEvaluator(e *risk.Evaluator) Option {
+	return func(s *fixedService) {
+		s.risk = e
+	}
+}
+
+// WithDeleteConfirmation requires customer deletes to be confirmed with a
+// token obtained from PlanDelete and valid for ttl.
+func WithDeleteConfirmation(secret string, ttl time.Duration) Option {
+	return func(s *fixedService) {
+		s.confirmer = newConfirmer(secret, ttl)
+	}
+}
+
+// WithImpersonation lets admins impersonate customers with tokens signed
+// with secret and valid for ttl.
+func WithImpersonation(secret string, ttl time.Duration) Option {
+	return func(s *fixedService) {
+		s.impersonator = newImpersonator(secret, ttl)
+	}
+}
+
+// WithJobs queues background jobs on runner. Without it no job kinds are
+// available.
+func WithJobs(runner *jobs.Runner) Option {
+	return func(s *fixedService) {
+		s.jobs = runner
+	}
+}
+
+// WithUsernamePolicy replaces the default policy enforced on new usernames.
+func WithUsernamePolicy(p users.UsernamePolicy) Option {
+	return func(s *fixedService) {
+		s.usernames = p
+	}
+}
+
+// WithAgePolicy enforces a minimum age, by residency, on registration.
+// Without it dates of birth are optional and only validated.
+func WithAgePolicy(p users.AgePolicy) Option {
+	return func(s *fixedService) {
+		s.ages = p
+	}
+}
+
+// WithHashPool bounds password hashing to workers concurrent hashes with up
+// to queue more waiting; further requests fail with ErrOverloaded.
+func WithHashPool(workers, queue int) Option {
+	return func(s *fixedService) {
+		s.hashes = newHashPool(workers, queue)
+	}
+}
+
+// WithSignupGuard refuses registrations the guard blocks.
+func WithSignupGuard(g *signup.Guard) Option {
+	return func(s *fixedService) {
+		s.signup = g
+	}
+}
+
+// WithSpamFilter scores registrations with f, flagging, challenging or
+// rejecting those it finds spam.
+func WithSpamFilter(f *signup.SpamFilter) Option {
+	return func(s *fixedService) {
+		s.spam = f
+	}
+}
+
+// WithWriteLimits limits the cards, addresses and profile updates of each
+// customer with l. Admins are not limited.
+func WithWriteLimits(l *ratelimit.Limiter) Option {
+	return func(s *fixedService) {
+		s.writeLimits = l
+	}
+}
+
+// WithAvatars stores profile images of up to maxBytes in store. Without it
+// uploads are refused.
+func WithAvatars(store blobs.Store, maxBytes int64) Option {
+	return func(s *fixedService) {
+		s.avatars = store
+		s.avatarMaxBytes = maxBytes
+		if maxBytes <= 0 {
+			s.avatarMaxBytes = defaultAvatarMaxBytes
+		}
+	}
+}
+
+// WithLoginCache keeps the credentials of up to size users for ttl, so that
+// repeated logins and API authentication skip reading the user.
+func WithLoginCache(ttl time.Duration, size int) Option {
+	return func(s *fixedService) {
+		s.logins = newLoginCache(ttl, size)
+	}
+}
+
+// WithClock tells time by c, for expiry, windows and timestamps, instead of
+// the wall clock.
+func WithClock(c clock.Clock) Option {
+	return func(s *fixedService) {
+		s.clock = c
+	}
+}
+
+// WithRNG reads salts from rng instead of clock.Random.
+func WithRNG(rng clock.RNG) Option {
+	return func(s *fixedService) {
+		s.rng = rng
+	}
 }
 
 // NewFixedService returns a simple implementation of the Service interface,
-func NewFixedService() Service {
-	return &fixedService{}
+func NewFixedService(opts ...Option) Service {
+	s := &fixedService{
+		usernames: users.DefaultUsernamePolicy(),
+		hashes:    newHashPool(runtime.NumCPU(), 100),
+		clock:     clock.System{},
+		rng:       clock.Random,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-type fixedService struct{}
+type fixedService struct {
+	risk      *risk.Evaluator
+	confirmer *confirmer
+	jobs      *jobs.Runner
+	usernames users.UsernamePolicy
+	ages      users.AgePolicy
+	hashes    *hashPool
+	signup    *signup.Guard
+	events    events.Publisher
+	logins    *loginCache
+	clock     clock.Clock
+	rng       clock.RNG
+	stepUp    *stepUp
+
+	avatars        blobs.Store
+	avatarMaxBytes int64
+
+	spam        *signup.SpamFilter
+	writeLimits *ratelimit.Limiter
+
+	// impersonator issues impersonation tokens, if enabled.
+	impersonator *impersonator
+}
+
+// Page selects a 1-based page of Size results.
+type Page struct {
+	Number int `json:"number"`
+	Size   int `json:"size"`
+}
 
 type Health struct {
 	Service string `json:"service"`
@@ -45,95 +237,514 @@ type Health struct {
 	Time    string `json:"time"`
 }
 
-func (s *fixedService) Login(username, password string) (users.User, error) {
-	u, err := db.GetUserByName(username)
+// Login accepts either a username or an email address.
+func (s *fixedService) Login(ctx context.Context, username, password string) (users.User, error) {
+	u, err := s.login(ctx, username, password)
+	Logins.WithLabelValues(loginResult(err)).Inc()
+	return u, err
+}
+
+func (s *fixedService) login(ctx context.Context, username, password string) (users.User, error) {
+	u, cached, err := s.findCredentials(ctx, username)
+	if err == users.ErrUserNotFound {
+		err = ErrUnauthorized
+	}
 	if err != nil {
-		return users.New(), err
+		recordLogin(ctx, username, "", users.LoginFailed)
+		return users.User{}, err
 	}
-	if u.Password != calculatePassHash(password, u.Salt) {
-		return users.New(), ErrUnauthorized
+	hash, err := s.hashes.hash(ctx, password, u.Salt)
+	if err != nil {
+		return users.User{}, err
+	}
+	if u.Password != hash {
+		recordLogin(ctx, username, u.UserID, users.LoginFailed)
+		return users.User{}, ErrUnauthorized
+	}
+	if cached {
+		// Successful logins return the whole user, read by ID, which also
+		// catches credentials changed on another replica.
+		full, err := db.GetUserWithAttributes(ctx, u.UserID)
+		if err == nil && (full.Password != u.Password || full.Salt != u.Salt) {
+			err = users.ErrUserNotFound
+		}
+		if err == users.ErrUserNotFound {
+			s.logins.forget(u.UserID)
+			recordLogin(ctx, username, u.UserID, users.LoginFailed)
+			return users.User{}, ErrUnauthorized
+		}
+		var attrErr *db.AttributeError
+		if err != nil && !errors.As(err, &attrErr) {
+			return users.User{}, err
+		}
+		u = full
+	}
+	// Logins the evaluator stops are recorded with their own outcome, not
+	// as failures: challenged ones are sent a one-time code, and the
+	// device is only seen once a login from it is verified.
+	switch err := s.assessLogin(ctx, u); err {
+	case nil:
+	case ErrLoginChallenge:
+		return users.User{}, s.challenge(ctx, username, u)
+	default:
+		recordLogin(ctx, username, u.UserID, users.LoginDenied)
+		return users.User{}, err
+	}
+	recordLogin(ctx, username, u.UserID, users.LoginSucceeded)
+	updateLastLogin(ctx, u.UserID)
+	if !cached {
+		db.GetUserAttributes(ctx, &u)
 	}
-	db.GetUserAttributes(&u)
 	u.MaskCCs()
 	return u, nil
 
 }
 
-func (s *fixedService) Register(username, password, email, first, last string) (string, error) {
-	u := users.New()
+// Authenticate checks credentials like Login, without recording a login or
+// evaluating its risk. It authenticates API requests, so with a login cache
+// only the user's ID, username and credentials may be set.
+func (s *fixedService) Authenticate(ctx context.Context, username, password string) (users.User, error) {
+	u, _, err := s.findCredentials(ctx, username)
+	if err == users.ErrUserNotFound {
+		return users.User{}, ErrUnauthorized
+	}
+	if err != nil {
+		return users.User{}, err
+	}
+	hash, err := s.hashes.hash(ctx, password, u.Salt)
+	if err != nil {
+		return users.User{}, err
+	}
+	if u.Password != hash {
+		return users.User{}, ErrUnauthorized
+	}
+	return u, nil
+}
+
+// findCredentials looks a user up like findUser, from the login cache if it
+// has them, in which case cached is true and only the user's ID, username
+// and credentials are set.
+func (s *fixedService) findCredentials(ctx context.Context, username string) (u users.User, cached bool, err error) {
+	key := s.usernames.Normalize(username)
+	if strings.Contains(username, "@") {
+		key = users.NormalizeEmail(username)
+	}
+	now := s.clock.Now()
+	if c, ok := s.logins.get(key, now); ok {
+		return c.user(), true, nil
+	}
+	generation := s.logins.currentGeneration()
+	if u, err = s.findUser(ctx, username); err != nil {
+		return u, false, err
+	}
+	s.logins.put(key, u, generation, now)
+	return u, false, nil
+}
+
+// findUser looks a user up by username or, as usernames cannot contain "@",
+// by email address. Usernames registered before that rule may contain "@",
+// so they are looked up by username when no user has the email address.
+func (s *fixedService) findUser(ctx context.Context, username string) (users.User, error) {
+	if strings.Contains(username, "@") {
+		u, err := db.GetUserByEmail(ctx, username)
+		if err != users.ErrUserNotFound {
+			return u, err
+		}
+	}
+	return db.GetUserByName(ctx, s.usernames.Normalize(username))
+}
+
+func (s *fixedService) Register(ctx context.Context, username, password, email, first, last, residency, dob string) (string, error) {
+	if err := s.usernames.Validate(username); err != nil {
+		return "", err
+	}
+	if err := s.ages.Check(dob, residency, s.clock.Now()); err != nil {
+		return "", err
+	}
+	if s.signup != nil {
+		if err := s.signup.Check(ClientInfoFromContext(ctx).IP, email, s.clock.Now()); err != nil {
+			return "", err
+		}
+	}
+	u := users.User{Addresses: make([]users.Address, 0), Cards: make([]users.Card, 0)}
+	u.NewSaltFrom(s.rng)
+	if s.spam != nil {
+		action, _ := s.spam.Assess(signup.Registration{
+			Username:  username,
+			Email:     email,
+			FirstName: first,
+			LastName:  last,
+			IP:        ClientInfoFromContext(ctx).IP,
+			Honeypot:  honeypotFromContext(ctx),
+			Time:      s.clock.Now(),
+		})
+		switch action {
+		case signup.Reject:
+			return "", signup.ErrSpamRejected
+		case signup.Challenge:
+			return "", signup.ErrSpamChallenge
+		case signup.Flag:
+			u.Tags = []string{signup.SpamTag}
+		}
+	}
 	u.Username = username
-	u.Password = calculatePassHash(password, u.Salt)
+	u.UsernameNormalized = s.usernames.Normalize(username)
+	if err := registered(ctx, u.UsernameNormalized, email); err != nil {
+		return "", err
+	}
+	hash, err := s.hashes.hash(ctx, password, u.Salt)
+	if err != nil {
+		return "", err
+	}
+	u.Password = hash
 	u.Email = email
+	u.EmailNormalized = users.NormalizeEmail(email)
 	u.FirstName = first
 	u.LastName = last
-	err := db.CreateUser(&u)
-	return u.UserID, err
+	u.Residency = residency
+	u.DateOfBirth = dob
+	if err := db.CreateUser(ctx, &u); err != nil {
+		return "", err
+	}
+	Signups.Inc()
+	e := events.Event{Type: events.UserCreated, Subject: u.UserID}
+	if len(u.Tags) > 0 {
+		// Consumers such as marketing can leave flagged customers out.
+		e.Data = map[string]interface{}{"tags": u.Tags}
+	}
+	s.publish(ctx, s.events, e)
+	return u.UserID, nil
 }
 
-func (s *fixedService) GetUsers(id string) ([]users.User, error) {
+func (s *fixedService) GetUsers(ctx context.Context, id string, l db.ListOptions) ([]users.User, error) {
+	// The db package adds the links.
 	if id == "" {
-		us, err := db.GetUsers()
-		for k, u := range us {
-			u.AddLinks()
-			us[k] = u
-		}
-		return us, err
+		return db.GetUsers(ctx, l)
 	}
-	u, err := db.GetUser(id)
-	u.AddLinks()
+	u, err := db.GetUser(ctx, currentID(db.CustomerIDs, id))
 	return []users.User{u}, err
 }
 
-func (s *fixedService) PostUser(u users.User) (string, error) {
-	u.NewSalt()
-	u.Password = calculatePassHash(u.Password, u.Salt)
-	err := db.CreateUser(&u)
-	return u.UserID, err
+// currentID returns the ID the entity of kind has in the database: id, or
+// for an ID the database could not have created, the new ID recorded for it
+// when it was migrated from another database, if any.
+func currentID(kind, id string) string {
+	if db.ValidID(id) {
+		return id
+	}
+	if n, err := db.MappedID(db.DefaultDb, kind, id); err == nil {
+		return n
+	}
+	return id
 }
 
-func (s *fixedService) GetAddresses(id string) ([]users.Address, error) {
-	if id == "" {
-		as, err := db.GetAddresses()
-		for k, a := range as {
-			a.AddLinks()
-			as[k] = a
+func (s *fixedService) SearchUsers(ctx context.Context, q db.Query) ([]users.User, error) {
+	return db.SearchUsers(ctx, s.normalizeQuery(q))
+}
+
+func (s *fixedService) ExportUsers(ctx context.Context, q db.Query, cursor string, f func(users.User, string) error) error {
+	return db.ExportUsers(s.normalizeQuery(q), cursor, f)
+}
+
+// normalizeQuery puts q in the form its fields are stored in, and sets
+// InactiveSince from InactiveDays.
+func (s *fixedService) normalizeQuery(q db.Query) db.Query {
+	if q.InactiveDays > 0 {
+		q.InactiveSince = s.clock.Now().AddDate(0, 0, -q.InactiveDays)
+		q.InactiveDays = 0
+	}
+	if q.Username != "" {
+		q.Username = s.usernames.Normalize(q.Username)
+	}
+	if q.UsernamePrefix != "" {
+		q.UsernamePrefix = s.usernames.Normalize(q.UsernamePrefix)
+	}
+	q.EmailDomain = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(q.EmailDomain, "@")))
+	q.Country = strings.TrimSpace(q.Country)
+	return q
+}
+
+func (s *fixedService) FindDuplicates(ctx context.Context, p Page) ([]db.Duplicate, error) {
+	return db.FindDuplicates(ctx, (p.Number-1)*p.Size, p.Size)
+}
+
+// registered refuses a username, or with db.UniqueEmail an email, that is
+// already taken, before the password is hashed for nothing.
+func registered(ctx context.Context, username, email string) error {
+	if ok, err := db.ExistsUsername(ctx, username); err != nil {
+		return err
+	} else if ok {
+		return db.ErrUsernameTaken
+	}
+	if !db.UniqueEmail || email == "" {
+		return nil
+	}
+	if ok, err := db.ExistsEmail(ctx, users.NormalizeEmail(email)); err != nil {
+		return err
+	} else if ok {
+		return db.ErrEmailTaken
+	}
+	return nil
+}
+
+func (s *fixedService) PostUser(ctx context.Context, u users.User) (string, error) {
+	if err := s.usernames.Validate(u.Username); err != nil {
+		return "", err
+	}
+	if u.DateOfBirth != "" {
+		if _, err := users.ParseDateOfBirth(u.DateOfBirth, s.clock.Now()); err != nil {
+			return "", err
 		}
-		return as, err
 	}
-	a, err := db.GetAddress(id)
-	a.AddLinks()
+	u.UsernameNormalized = s.usernames.Normalize(u.Username)
+	u.EmailNormalized = users.NormalizeEmail(u.Email)
+	u.NewSaltFrom(s.rng)
+	hash, err := s.hashes.hash(ctx, u.Password, u.Salt)
+	if err != nil {
+		return "", err
+	}
+	u.Password = hash
+	if err := db.CreateUser(ctx, &u); err != nil {
+		return "", err
+	}
+	s.publish(ctx, s.events, events.Event{Type: events.UserCreated, Subject: u.UserID})
+	return u.UserID, nil
+}
+
+// UpdateProfile replaces the names and email of the user with u's ID. Their
+// cached credentials are dropped, as logins may look them up by email.
+func (s *fixedService) UpdateProfile(ctx context.Context, u users.User) error {
+	if err := s.limitWrite(ctx, ratelimit.Profile, u.UserID); err != nil {
+		return err
+	}
+	defer s.logins.forget(u.UserID)
+	u.EmailNormalized = users.NormalizeEmail(u.Email)
+	if err := db.UpdateProfile(ctx, &u); err != nil {
+		return err
+	}
+	s.publish(ctx, s.events, events.Event{Type: events.UserUpdated, Subject: u.UserID})
+	return nil
+}
+
+func (s *fixedService) GetAddresses(ctx context.Context, id string, l db.ListOptions) ([]users.Address, error) {
+	if id == "" {
+		return db.GetAddresses(ctx, l)
+	}
+	a, err := db.GetAddress(ctx, currentID(db.AddressIDs, id))
 	return []users.Address{a}, err
 }
 
-func (s *fixedService) PostAddress(add users.Address, userid string) (string, error) {
-	err := db.CreateAddress(&add, userid)
+func (s *fixedService) PostAddress(ctx context.Context, add users.Address, userid string) (string, error) {
+	if err := add.Validate(); err != nil {
+		return "", err
+	}
+	if err := s.limitWrite(ctx, ratelimit.Addresses, userid); err != nil {
+		return "", err
+	}
+	err := db.CreateAddress(ctx, &add, userid)
 	return add.ID, err
 }
 
-func (s *fixedService) GetCards(id string) ([]users.Card, error) {
+// GetCards returns a card, refusing flagged ones to all but admins, or a
+// page of the card listing. Pages are returned whole, so that the next one
+// follows on from their last card; the endpoint drops the flagged cards of
+// listings with visibleCards.
+func (s *fixedService) GetCards(ctx context.Context, id string, l db.ListOptions) ([]users.Card, error) {
 	if id == "" {
-		cs, err := db.GetCards()
-		for k, c := range cs {
-			c.AddLinks()
-			cs[k] = c
-		}
-		return cs, err
+		return db.GetCards(ctx, l)
+	}
+	c, err := db.GetCard(ctx, currentID(db.CardIDs, id))
+	if err == nil && !cardVisible(ctx, c) {
+		return nil, ErrCardFlagged
 	}
-	c, err := db.GetCard(id)
-	c.AddLinks()
 	return []users.Card{c}, err
 }
 
-func (s *fixedService) PostCard(card users.Card, userid string) (string, error) {
-	err := db.CreateCard(&card, userid)
-	return card.ID, err
+func (s *fixedService) PostCard(ctx context.Context, card users.Card, userid string) (string, error) {
+	// Only the payments risk team may flag cards, through PatchCard.
+	card.Status, card.Flag = "", nil
+	if err := s.limitWrite(ctx, ratelimit.Cards, userid); err != nil {
+		return "", err
+	}
+	if err := db.CreateCard(ctx, &card, userid); err != nil {
+		return "", err
+	}
+	CardsAdded.Inc()
+	return card.ID, nil
+}
+
+// limitWrite applies the write limit of op to customer, unless an admin is
+// writing.
+func (s *fixedService) limitWrite(ctx context.Context, op, customer string) error {
+	if s.writeLimits == nil {
+		return nil
+	}
+	if p, ok := PrincipalFromContext(ctx); ok && p.Admin {
+		return nil
+	}
+	return s.writeLimits.Allow(ctx, op, customer, s.clock.Now())
+}
+
+func (s *fixedService) GetCustomerAddresses(ctx context.Context, id string) ([]users.Address, error) {
+	return db.GetCustomerAddresses(ctx, currentID(db.CustomerIDs, id))
+}
+
+// GetCustomerCards returns the user's cards, leaving out those flagged as
+// suspected fraud unless an admin is asking.
+func (s *fixedService) GetCustomerCards(ctx context.Context, id string) ([]users.Card, error) {
+	cs, err := db.GetCustomerCards(ctx, currentID(db.CustomerIDs, id))
+	if err != nil {
+		return nil, err
+	}
+	return visibleCards(ctx, cs), nil
+}
+
+func (s *fixedService) Delete(ctx context.Context, entity, id, confirm string) error {
+	if s.confirmer != nil && entity == "customers" {
+		if confirm == "" {
+			return ErrConfirmationRequired
+		}
+		if err := s.confirmer.verify(entity, id, confirm, s.clock.Now()); err != nil {
+			return err
+		}
+	}
+	if entity == "customers" {
+		defer s.logins.forget(id)
+	}
+	if err := db.Delete(ctx, entity, id); err != nil {
+		return err
+	}
+	Deletions.WithLabelValues(entity).Inc()
+	if entity == "customers" {
+		s.publish(ctx, s.events, events.Event{Type: events.UserDeleted, Subject: id})
+	}
+	return nil
+}
+
+// PlanDelete summarises what deleting a customer cascades to, along with the
+// token confirming it.
+func (s *fixedService) PlanDelete(ctx context.Context, entity, id string) (DeletePlan, error) {
+	plan := DeletePlan{Entity: entity, ID: id}
+	if entity == "customers" {
+		u, err := db.GetUser(ctx, id)
+		if err != nil {
+			return plan, err
+		}
+		plan.Addresses = len(u.Addresses)
+		plan.Cards = len(u.Cards)
+	}
+	if s.confirmer != nil {
+		plan.Token, plan.Expires = s.confirmer.token(entity, id, s.clock.Now())
+	}
+	return plan, nil
+}
+
+func (s *fixedService) GetLogins(ctx context.Context, id string) ([]users.LoginAttempt, error) {
+	return db.GetLoginAttempts(ctx, currentID(db.CustomerIDs, id))
+}
+
+// PutAvatar stores the user's profile image, returning its URL. The image
+// it replaces is deleted on a best-effort basis.
+func (s *fixedService) PutAvatar(ctx context.Context, id string, r io.Reader) (string, error) {
+	if s.avatars == nil {
+		return "", ErrNoAvatarStore
+	}
+	u, err := db.GetUser(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	data, contentType, err := readAvatar(r, s.avatarMaxBytes)
+	if err != nil {
+		return "", err
+	}
+	key := avatarKey(u.UserID, data)
+	if err := s.avatars.Put(ctx, key, blobs.Blob{ContentType: contentType, Data: data}); err != nil {
+		return "", err
+	}
+	if err := db.UpdateAvatar(ctx, u.UserID, key); err != nil {
+		return "", err
+	}
+	if u.Avatar != "" && u.Avatar != key {
+		s.avatars.Delete(ctx, u.Avatar)
+	}
+	return users.AvatarURL(u.UserID, key), nil
+}
+
+func (s *fixedService) GetAvatar(ctx context.Context, id string) (blobs.Blob, error) {
+	u, err := db.GetUser(ctx, currentID(db.CustomerIDs, id))
+	if err != nil {
+		return blobs.Blob{}, err
+	}
+	if s.avatars == nil || u.Avatar == "" {
+		return blobs.Blob{}, ErrAvatarNotFound
+	}
+	b, err := s.avatars.Get(ctx, u.Avatar)
+	if err == blobs.ErrNotFound {
+		return blobs.Blob{}, ErrAvatarNotFound
+	}
+	return b, err
+}
+
+// AddTag tags the user, refusing malformed tags.
+func (s *fixedService) AddTag(ctx context.Context, id, tag string) error {
+	if err := users.ValidateTag(tag); err != nil {
+		return err
+	}
+	return db.AddTag(ctx, id, tag)
+}
+
+func (s *fixedService) RemoveTag(ctx context.Context, id, tag string) error {
+	return db.RemoveTag(ctx, id, tag)
+}
+
+func (s *fixedService) BackupUser(ctx context.Context, id string) (Backup, error) {
+	u, err := db.GetUserWithAttributes(ctx, id)
+	if err != nil {
+		return Backup{}, err
+	}
+	logins, err := db.GetLoginAttempts(ctx, id)
+	if err != nil {
+		return Backup{}, err
+	}
+	return newBackup(u, logins, s.clock.Now()), nil
+}
+
+// RestoreUser recreates a backed up customer with its original IDs. Login
+// history is restored on a best-effort basis once the account exists.
+func (s *fixedService) RestoreUser(ctx context.Context, b Backup) (string, error) {
+	u, err := b.User()
+	if err != nil {
+		return "", err
+	}
+	u.UsernameNormalized = s.usernames.Normalize(u.Username)
+	u.EmailNormalized = users.NormalizeEmail(u.Email)
+	if err := db.ImportUser(ctx, &u); err != nil {
+		return "", err
+	}
+	s.logins.forget(u.UserID)
+	for _, l := range b.Logins {
+		db.CreateLoginAttempt(ctx, &l)
+	}
+	s.publish(ctx, s.events, events.Event{Type: events.UserCreated, Subject: u.UserID})
+	return u.UserID, nil
 }
 
-func (s *fixedService) Delete(entity, id string) error {
-	return db.Delete(entity, id)
+func (s *fixedService) SubmitJob(ctx context.Context, kind string, params json.RawMessage) (jobs.Job, error) {
+	if s.jobs == nil {
+		return jobs.Job{}, jobs.ErrUnknownKind
+	}
+	return s.jobs.Submit(kind, params)
 }
 
-func (s *fixedService) Health() []Health {
+func (s *fixedService) GetJob(ctx context.Context, id string) (jobs.Job, error) {
+	return db.GetJob(ctx, id)
+}
+
+func (s *fixedService) Indexes(ctx context.Context) ([]db.Index, error) {
+	return db.Indexes(ctx)
+}
+
+func (s *fixedService) Health(ctx context.Context) []Health {
 	var health []Health
 	dbstatus := "OK"
 
@@ -142,8 +753,8 @@ func (s *fixedService) Health() []Health {
 		dbstatus = "err"
 	}
 
-	app := Health{"user", "OK", time.Now().String()}
-	db := Health{"user-db", dbstatus, time.Now().String()}
+	app := Health{"user", "OK", s.clock.Now().String()}
+	db := Health{"user-db", dbstatus, s.clock.Now().String()}
 
 	health = append(health, app)
 	health = append(health, db)
@@ -151,9 +762,76 @@ func (s *fixedService) Health() []Health {
 	return health
 }
 
+// assessLogin runs the risk evaluator, if any, against the user's history.
+func (s *fixedService) assessLogin(ctx context.Context, u users.User) error {
+	if s.risk == nil {
+		return nil
+	}
+	ci := ClientInfoFromContext(ctx)
+	previous, _ := db.GetLoginAttempts(ctx, u.UserID)
+	a := s.risk.Evaluate(risk.Login{
+		UserID:    u.UserID,
+		Username:  u.Username,
+		IP:        ci.IP,
+		UserAgent: ci.UserAgent,
+		Device:    ci.Device,
+		Time:      s.clock.Now(),
+		Previous:  previous,
+	})
+	switch a.Decision {
+	case risk.Deny:
+		return ErrLoginDenied
+	case risk.Challenge:
+		return ErrLoginChallenge
+	}
+	return nil
+}
+
+// recordLogin stores a login attempt along with the client it came from.
+// History is best-effort so storage errors are not returned to the caller.
+func recordLogin(ctx context.Context, username, userid, outcome string) {
+	a := loginAttempt(ctx, username, userid, outcome)
+	createLoginAttempt(ctx, &a)
+}
+
+// createLoginAttempt records a login attempt, unless the service is
+// read-only. Logins are served while read-only, but neither their history
+// nor the last login is kept, so failed logins are not counted against
+// the customer until writes resume.
+func createLoginAttempt(ctx context.Context, a *users.LoginAttempt) {
+	if middleware.ReadOnlyFromContext(ctx) {
+		return
+	}
+	db.CreateLoginAttempt(ctx, a)
+}
+
+// updateLastLogin records the login time of the user, unless the service
+// is read-only.
+func updateLastLogin(ctx context.Context, id string) {
+	if middleware.ReadOnlyFromContext(ctx) {
+		return
+	}
+	db.UpdateLastLogin(ctx, id)
+}
+
+// loginAttempt returns a login attempt with outcome from the client of ctx.
+func loginAttempt(ctx context.Context, username, userid, outcome string) users.LoginAttempt {
+	ci := ClientInfoFromContext(ctx)
+	return users.LoginAttempt{
+		UserID:    userid,
+		Username:  username,
+		Success:   users.Successful(outcome),
+		Outcome:   outcome,
+		IP:        ci.IP,
+		UserAgent: ci.UserAgent,
+		Device:    ci.Device,
+	}
+}
+
 func calculatePassHash(pass, salt string) string {
 	h := sha1.New()
 	io.WriteString(h, salt)
 	io.WriteString(h, pass)
-	return fmt.Sprintf("%x", h.Sum(nil))
+	var sum [sha1.Size]byte
+	return hex.EncodeToString(h.Sum(sum[:0]))
 }
@@ -1,8 +1,20 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/middleware"
+	"github.com/mikesay/user/ratelimit"
+	"github.com/mikesay/user/signup"
 	"github.com/mikesay/user/users"
 )
 
@@ -23,6 +35,193 @@ func TestRegister(t *testing.T) {
 
 }
 
+func TestLoginReadOnly(t *testing.T) {
+	d := withHistoryDB(t)
+	var ctx context.Context
+	middleware.NewReadOnly(true).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+	s := NewFixedService()
+	if _, err := s.Login(ctx, "eve", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Login(ctx, "eve", "wrong"); err != ErrUnauthorized {
+		t.Fatalf("Expected a wrong password refused, received %v", err)
+	}
+	if len(d.attempts) != 0 {
+		t.Errorf("Expected no login history kept while read-only, received %+v", d.attempts)
+	}
+}
+
+func TestRegisterUsernamePolicy(t *testing.T) {
+	ctx := context.Background()
+	if _, err := TestService.Register(ctx, "admin", "pass", "", "", "", "", ""); err != users.ErrUsernameReserved {
+		t.Errorf("Expected reserved username error, received %v", err)
+	}
+	if _, err := TestService.PostUser(ctx, users.User{Username: "a b c"}); err != users.ErrUsernameCharset {
+		t.Errorf("Expected charset error, received %v", err)
+	}
+}
+
+func TestRegisterSignupGuard(t *testing.T) {
+	s := NewFixedService(WithSignupGuard(&signup.Guard{Addresses: signup.NewLimiter(0, time.Hour)}))
+	ctx := WithClientInfo(context.Background(), ClientInfo{IP: "192.0.2.1"})
+	if _, err := s.Register(ctx, "newuser", "pass", "a@example.com", "", "", "", ""); err != signup.ErrThrottled {
+		t.Errorf("Expected registration to be throttled, received %v", err)
+	}
+}
+
+func TestRegisterSpamFilter(t *testing.T) {
+	d := &saltDB{}
+	prev := db.DefaultDb
+	db.DefaultDb = d
+	t.Cleanup(func() { db.DefaultDb = prev })
+	f := &signup.SpamFilter{Scorer: signup.NewHeuristics(0, time.Hour), Threshold: 1, Action: signup.Reject}
+	s := NewFixedService(WithSpamFilter(f))
+	ctx := context.Background()
+	if _, err := s.Register(withHoneypot(ctx, "http://spam.example.com"), "bot", "pass", "", "", "", "", ""); err != signup.ErrSpamRejected {
+		t.Errorf("Expected a filled honeypot rejected, received %v", err)
+	}
+	if _, err := s.Register(ctx, "xkcdqwrtzp", "pass", "", "", "", "", ""); err != nil || len(d.tags) != 0 {
+		t.Errorf("Expected a gibberish name alone registered, received %v %v", err, d.tags)
+	}
+	f.Action = signup.Challenge
+	if _, err := s.Register(withHoneypot(ctx, "x"), "bot", "pass", "", "", "", "", ""); err != signup.ErrSpamChallenge {
+		t.Errorf("Expected a filled honeypot challenged, received %v", err)
+	}
+	f.Action = signup.Flag
+	if _, err := s.Register(withHoneypot(ctx, "x"), "bot", "pass", "", "", "", "", ""); err != nil || len(d.tags) != 1 || d.tags[0] != signup.SpamTag {
+		t.Errorf("Expected a filled honeypot registered for review, received %v %v", err, d.tags)
+	}
+}
+
+func TestWriteLimits(t *testing.T) {
+	l := &ratelimit.Limiter{Store: ratelimit.NewMemory(), Limits: map[string]ratelimit.Limit{ratelimit.Cards: {Count: 1, Per: time.Hour}}}
+	s := NewFixedService(WithWriteLimits(l)).(*fixedService)
+	ctx := context.Background()
+	if err := s.limitWrite(ctx, ratelimit.Cards, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PostCard(ctx, users.Card{}, "c1"); err != ratelimit.ErrLimited {
+		t.Errorf("Expected the second card limited, received %v", err)
+	}
+	if err := s.limitWrite(context.WithValue(ctx, principalKey, Principal{Admin: true}), ratelimit.Cards, "c1"); err != nil {
+		t.Errorf("Expected admins not limited, received %v", err)
+	}
+	if ErrorStatus(ratelimit.ErrLimited) != 429 {
+		t.Errorf("Expected 429, received %v", ErrorStatus(ratelimit.ErrLimited))
+	}
+}
+
+func TestRegisterMinimumAge(t *testing.T) {
+	d := &saltDB{}
+	prev := db.DefaultDb
+	db.DefaultDb = d
+	t.Cleanup(func() { db.DefaultDb = prev })
+	ages, _ := users.ParseAgePolicy(0, []string{"us=21"})
+	s := NewFixedService(WithAgePolicy(ages), WithClock(clock.NewFake(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))))
+	ctx := context.Background()
+	if _, err := s.Register(ctx, "teen", "pass", "", "", "", "us", "2005-01-01"); err != users.ErrUnderage {
+		t.Errorf("Expected an underage registration refused, received %v", err)
+	}
+	if _, err := s.Register(ctx, "nodob", "pass", "", "", "", "us", ""); err == nil {
+		t.Error("Expected a date of birth required in us")
+	}
+	if _, err := s.Register(ctx, "adult", "pass", "", "", "", "us", "2003-03-01"); err != nil {
+		t.Errorf("Expected a 21 year old registered, received %v", err)
+	}
+	if _, err := s.Register(ctx, "european", "pass", "", "", "", "eu", ""); err != nil {
+		t.Errorf("Expected no minimum age outside us, received %v", err)
+	}
+	if _, err := s.PostUser(ctx, users.User{Username: "future", DateOfBirth: "2030-01-01"}); err != users.ErrInvalidDateOfBirth {
+		t.Errorf("Expected a future date of birth refused, received %v", err)
+	}
+}
+
+func TestAddTagInvalid(t *testing.T) {
+	if err := TestService.AddTag(context.Background(), "a", "Not A Tag"); err != users.ErrInvalidTag {
+		t.Errorf("Expected malformed tag to be refused, received %v", err)
+	}
+}
+
+// saltDB records the salt of the user created.
+type saltDB struct {
+	db.Database
+	salt string
+	tags []string
+}
+
+func (d *saltDB) CreateUser(u *users.User) error {
+	d.salt, d.tags = u.Salt, u.Tags
+	return nil
+}
+
+func (d *saltDB) ExistsUsername(name string) (bool, error) { return name == "taken", nil }
+func (d *saltDB) ExistsEmail(email string) (bool, error)   { return email == "taken@example.com", nil }
+
+func TestRegisterTaken(t *testing.T) {
+	prev, unique := db.DefaultDb, db.UniqueEmail
+	db.DefaultDb, db.UniqueEmail = &saltDB{}, true
+	t.Cleanup(func() { db.DefaultDb, db.UniqueEmail = prev, unique })
+	ctx := context.Background()
+	if _, err := TestService.Register(ctx, "taken", "pass", "", "", "", "", ""); err != db.ErrUsernameTaken {
+		t.Errorf("Expected a taken username refused, received %v", err)
+	}
+	if _, err := TestService.Register(ctx, "newuser", "pass", "Taken@Example.com", "", "", "", ""); err != db.ErrEmailTaken {
+		t.Errorf("Expected a taken email refused, received %v", err)
+	}
+	if ErrorStatus(db.ErrUsernameTaken) != 409 {
+		t.Errorf("Expected 409, received %v", ErrorStatus(db.ErrUsernameTaken))
+	}
+}
+
+func TestPostUserSalt(t *testing.T) {
+	d := &saltDB{}
+	prev := db.DefaultDb
+	db.DefaultDb = d
+	t.Cleanup(func() { db.DefaultDb = prev })
+	s := NewFixedService(WithRNG(bytes.NewReader(make([]byte, 20))))
+	if _, err := s.PostUser(context.Background(), users.User{Username: "eve", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if d.salt != strings.Repeat("0", 40) {
+		t.Errorf("Expected the salt read from the rng, received %v", d.salt)
+	}
+	s = NewFixedService(WithRNG(bytes.NewReader(make([]byte, 20))))
+	if _, err := s.Register(context.Background(), "newuser", "pass", "", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if d.salt != strings.Repeat("0", 40) {
+		t.Errorf("Expected the salt of a registration read from the rng, received %v", d.salt)
+	}
+}
+
+// queryDB records the query users are searched with.
+type queryDB struct {
+	db.Database
+	q db.Query
+}
+
+func (d *queryDB) SearchUsers(q db.Query) ([]users.User, error) {
+	d.q = q
+	return nil, nil
+}
+
+func TestSearchInactiveDays(t *testing.T) {
+	d := &queryDB{}
+	prev := db.DefaultDb
+	db.DefaultDb = d
+	t.Cleanup(func() { db.DefaultDb = prev })
+	c := clock.NewFake(time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC))
+	s := NewFixedService(WithClock(c))
+	if _, err := s.SearchUsers(context.Background(), db.Query{InactiveDays: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if !d.q.InactiveSince.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) || d.q.InactiveDays != 0 {
+		t.Errorf("Expected inactive customers counted back from the clock, received %+v", d.q)
+	}
+}
+
 func TestCalculatePassHash(t *testing.T) {
 	hash1 := calculatePassHash("eve", "c748112bc027878aa62812ba1ae00e40ad46d497")
 	if hash1 != "fec51acb3365747fc61247da5e249674cf8463c2" {
@@ -37,3 +236,58 @@ func TestCalculatePassHash(t *testing.T) {
 		t.Error("user1's password failed hash test")
 	}
 }
+
+// lifecycleDB accepts every user write.
+type lifecycleDB struct {
+	saltDB
+}
+
+func (d *lifecycleDB) UpdateProfile(u *users.User) error { return nil }
+func (d *lifecycleDB) Delete(entity, id string) error    { return nil }
+
+func TestUserEvents(t *testing.T) {
+	prev := db.DefaultDb
+	db.DefaultDb = &lifecycleDB{}
+	t.Cleanup(func() { db.DefaultDb = prev })
+	var published recorder
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewFixedService(WithEvents(&published), WithClock(c), WithRNG(bytes.NewReader(make([]byte, 64))))
+	ctx := context.Background()
+
+	if _, err := s.Register(ctx, "newuser", "pass", "", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateProfile(ctx, users.User{UserID: "u1", Email: "New@Example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Delete(ctx, "cards", "c1", "")
+	s.Delete(ctx, "customers", "u1", "")
+	var types []string
+	for _, e := range published {
+		types = append(types, e.Type)
+	}
+	if fmt.Sprint(types) != "[user.created user.updated user.deleted]" || published[2].Subject != "u1" {
+		t.Errorf("Expected the user's lifecycle published, received %v", published)
+	}
+	if !published[0].Time.Equal(c.Now()) || published[0].ID != strings.Repeat("0", 32) {
+		t.Errorf("Expected events timed by the clock with IDs from the rng, received %+v", published[0])
+	}
+}
+
+type legacyUsernameDB struct{ loginDB }
+
+func (d *legacyUsernameDB) GetUserByEmail(string) (users.User, error) {
+	return users.User{}, users.ErrUserNotFound
+}
+
+func TestLoginLegacyUsernameWithAt(t *testing.T) {
+	d := &legacyUsernameDB{loginDB: *withLoginDB(t)}
+	d.user.Username = "eve@home"
+	db.DefaultDb = d
+	if _, err := NewFixedService().Login(context.Background(), "eve@home", "pass"); err != nil {
+		t.Errorf("Expected a username containing @ found when no email matches, received %v", err)
+	}
+	if d.lookups != 1 {
+		t.Errorf("Expected a username lookup, received %v", d.lookups)
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+// stepup.go contains the step-up verification of logins the risk evaluator
+// challenges. The customer is sent a one-time code in a login.challenged
+// event, for the notification service to deliver, and the client exchanges
+// it along with the challenge token for the login at POST /login/verify.
+// Like confirmation tokens, challenge tokens are signed and stateless: the
+// code is not in the token but bound into its signature, so any replica
+// sharing the secret verifies it. Attempts are recorded in the login
+// history with the challenge's ID, which bounds wrong codes and stops a
+// challenge being verified twice.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/events"
+	"github.com/mikesay/user/users"
+)
+
+// maxChallengeFailures is how many wrong codes a challenge takes before it
+// is refused; the customer then logs in again for a new code.
+const maxChallengeFailures = 5
+
+// LoginChallenge is returned, wrapping ErrLoginChallenge, by logins that
+// must be verified with the one-time code sent to the customer.
+type LoginChallenge struct {
+	Token   string    `json:"challenge"`
+	Expires time.Time `json:"expires"`
+}
+
+func (c *LoginChallenge) Error() string { return ErrLoginChallenge.Error() }
+
+func (c *LoginChallenge) Unwrap() error { return ErrLoginChallenge }
+
+// loginChallengedEvent is the data of login.challenged events.
+type loginChallengedEvent struct {
+	Username string    `json:"username"`
+	Email    string    `json:"email"`
+	Code     string    `json:"code"`
+	Expires  time.Time `json:"expires"`
+	IP       string    `json:"ip"`
+}
+
+// challengeClaims are signed in a challenge token, binding it to the
+// client that was challenged.
+type challengeClaims struct {
+	Subject   string `json:"sub"`
+	Username  string `json:"username"`
+	Device    string `json:"device,omitempty"`
+	UserAgent string `json:"agent"`
+	ID        string `json:"jti"`
+	Expires   int64  `json:"exp"`
+}
+
+type stepUp struct {
+	secret []byte
+	ttl    time.Duration
+	codes  events.Publisher
+}
+
+// WithStepUp challenges the logins the risk evaluator challenges with a
+// one-time code, valid for ttl and published as a login.challenged event
+// through codes. Challenge tokens are signed with secret, or with a random
+// secret when none is given. Without it challenged logins fail with
+// ErrLoginChallenge and cannot be completed.
+func WithStepUp(secret string, ttl time.Duration, codes events.Publisher) Option {
+	return func(s *fixedService) {
+		key := []byte(secret)
+		if secret == "" {
+			key = make([]byte, 32)
+			rand.Read(key)
+		}
+		s.stepUp = &stepUp{secret: key, ttl: ttl, codes: codes}
+	}
+}
+
+func (st *stepUp) sign(payload, code string) string {
+	mac := hmac.New(sha256.New, st.secret)
+	fmt.Fprintf(mac, "%v.%v", payload, code)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// token returns the signed claims, verified with code.
+func (st *stepUp) token(c challengeClaims, code string) string {
+	b, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + st.sign(payload, code)
+}
+
+// claims returns the claims of token if it is unexpired at now, without
+// checking its code.
+func (st *stepUp) claims(token string, now time.Time) (challengeClaims, error) {
+	var c challengeClaims
+	payload, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, ErrUnauthorized
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Subject == "" || c.ID == "" || now.Unix() >= c.Expires {
+		return c, ErrUnauthorized
+	}
+	return c, nil
+}
+
+// verify reports whether token was issued with code.
+func (st *stepUp) verify(token, code string) bool {
+	payload, sig, _ := strings.Cut(token, ".")
+	return hmac.Equal([]byte(sig), []byte(st.sign(payload, code)))
+}
+
+// newCode returns a six digit one-time code read from rng.
+func newCode(rng clock.RNG) string {
+	n := binary.BigEndian.Uint32(clock.Bytes(rng, 4))
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// challenge records the challenged login of u, sends the customer a code
+// and returns the challenge to verify it with. Without step-up it returns
+// ErrLoginChallenge, which cannot be verified.
+func (s *fixedService) challenge(ctx context.Context, username string, u users.User) error {
+	if s.stepUp == nil {
+		recordLogin(ctx, username, u.UserID, users.LoginChallenged)
+		return ErrLoginChallenge
+	}
+	ci := ClientInfoFromContext(ctx)
+	expires := s.clock.Now().Add(s.stepUp.ttl).Truncate(time.Second)
+	c := challengeClaims{
+		Subject:   u.UserID,
+		Username:  username,
+		Device:    ci.Device,
+		UserAgent: ci.UserAgent,
+		ID:        hex.EncodeToString(clock.Bytes(s.rng, 16)),
+		Expires:   expires.Unix(),
+	}
+	code := newCode(s.rng)
+	a := loginAttempt(ctx, username, u.UserID, users.LoginChallenged)
+	a.Challenge = c.ID
+	createLoginAttempt(ctx, &a)
+	s.publish(ctx, s.stepUp.codes, events.Event{
+		Type:    events.LoginChallenged,
+		Subject: u.UserID,
+		Data: loginChallengedEvent{
+			Username: u.Username,
+			Email:    u.Email,
+			Code:     code,
+			Expires:  expires.UTC(),
+			IP:       ci.IP,
+		},
+	})
+	return &LoginChallenge{Token: s.stepUp.token(c, code), Expires: expires}
+}
+
+// VerifyLogin completes a challenged login with the one-time code sent to
+// the customer. It must come from the client that was challenged. The
+// verified login is recorded as successful, so later logins from the
+// device are no longer challenged for being new.
+func (s *fixedService) VerifyLogin(ctx context.Context, token, code string) (users.User, error) {
+	u, err := s.verifyLogin(ctx, token, code)
+	Logins.WithLabelValues(loginResult(err)).Inc()
+	return u, err
+}
+
+func (s *fixedService) verifyLogin(ctx context.Context, token, code string) (users.User, error) {
+	if s.stepUp == nil {
+		return users.User{}, ErrUnauthorized
+	}
+	c, err := s.stepUp.claims(token, s.clock.Now())
+	if err != nil {
+		return users.User{}, err
+	}
+	ci := ClientInfoFromContext(ctx)
+	if c.Device != ci.Device || c.UserAgent != ci.UserAgent {
+		return users.User{}, ErrUnauthorized
+	}
+	previous, err := db.GetLoginAttempts(ctx, c.Subject)
+	if err != nil {
+		return users.User{}, err
+	}
+	failures := 0
+	for _, p := range previous {
+		if p.Challenge != c.ID {
+			continue
+		}
+		switch p.Outcome {
+		case users.LoginVerified:
+			return users.User{}, ErrUnauthorized
+		case users.LoginUnverified:
+			failures++
+		}
+	}
+	if failures >= maxChallengeFailures {
+		return users.User{}, ErrUnauthorized
+	}
+	outcome := users.LoginVerified
+	if !s.stepUp.verify(token, code) {
+		outcome = users.LoginUnverified
+	}
+	a := loginAttempt(ctx, c.Username, c.Subject, outcome)
+	a.Challenge = c.ID
+	createLoginAttempt(ctx, &a)
+	if outcome != users.LoginVerified {
+		return users.User{}, ErrUnauthorized
+	}
+	u, err := db.GetUserWithAttributes(ctx, c.Subject)
+	if err == users.ErrUserNotFound {
+		return users.User{}, ErrUnauthorized
+	}
+	var attrErr *db.AttributeError
+	if err != nil && !errors.As(err, &attrErr) {
+		return users.User{}, err
+	}
+	updateLastLogin(ctx, u.UserID)
+	u.MaskCCs()
+	return u, nil
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/risk"
+	"github.com/mikesay/user/users"
+)
+
+// historyDB keeps the login attempts of loginDB's user, newest first.
+type historyDB struct {
+	loginDB
+	attempts []users.LoginAttempt
+}
+
+func (d *historyDB) CreateLoginAttempt(l *users.LoginAttempt) error {
+	d.attempts = append([]users.LoginAttempt{*l}, d.attempts...)
+	return nil
+}
+
+func (d *historyDB) GetLoginAttempts(string) ([]users.LoginAttempt, error) {
+	return d.attempts, nil
+}
+
+func withHistoryDB(t *testing.T) *historyDB {
+	d := &historyDB{loginDB: *withLoginDB(t)}
+	db.DefaultDb = d
+	return d
+}
+
+func TestStepUp(t *testing.T) {
+	d := withHistoryDB(t)
+	var codes recorder
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewFixedService(
+		WithRiskEvaluator(risk.NewEvaluator(risk.Challenge, nil, nil)),
+		WithStepUp("secret", time.Minute, &codes),
+		WithClock(c),
+	)
+	laptop := WithClientInfo(context.Background(), ClientInfo{UserAgent: "laptop", Device: "a"})
+	phone := WithClientInfo(context.Background(), ClientInfo{UserAgent: "phone", Device: "b"})
+
+	if _, err := s.Login(laptop, "eve", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.Login(phone, "eve", "pass")
+	var challenge *LoginChallenge
+	if !errors.As(err, &challenge) || !errors.Is(err, ErrLoginChallenge) {
+		t.Fatalf("Expected a login from a new device challenged, received %v", err)
+	}
+	if d.attempts[0].Outcome != users.LoginChallenged || d.attempts[0].Success {
+		t.Errorf("Expected the challenged login recorded as such, received %+v", d.attempts[0])
+	}
+	if len(codes) != 1 {
+		t.Fatalf("Expected a code sent, received %v events", len(codes))
+	}
+	code := codes[0].Data.(loginChallengedEvent).Code
+
+	if _, err := s.VerifyLogin(phone, challenge.Token, "wrong"); err != ErrUnauthorized {
+		t.Errorf("Expected a wrong code refused, received %v", err)
+	}
+	if _, err := s.VerifyLogin(laptop, challenge.Token, code); err != ErrUnauthorized {
+		t.Errorf("Expected a code from another device refused, received %v", err)
+	}
+	u, err := s.VerifyLogin(phone, challenge.Token, code)
+	if err != nil || u.UserID != d.user.UserID {
+		t.Fatalf("Expected the login verified, received %+v, %v", u, err)
+	}
+	if _, err := s.VerifyLogin(phone, challenge.Token, code); err != ErrUnauthorized {
+		t.Errorf("Expected a challenge verified once, received %v", err)
+	}
+	if _, err := s.Login(phone, "eve", "pass"); err != nil {
+		t.Errorf("Expected the verified device seen, received %v", err)
+	}
+}
+
+func TestStepUpLimits(t *testing.T) {
+	withHistoryDB(t)
+	var codes recorder
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewFixedService(
+		WithRiskEvaluator(risk.NewEvaluator(risk.Challenge, nil, nil)),
+		WithStepUp("secret", time.Minute, &codes),
+		WithClock(c),
+	)
+	laptop := WithClientInfo(context.Background(), ClientInfo{UserAgent: "laptop"})
+	phone := WithClientInfo(context.Background(), ClientInfo{UserAgent: "phone"})
+	if _, err := s.Login(laptop, "eve", "pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	var challenge *LoginChallenge
+	_, err := s.Login(phone, "eve", "pass")
+	if !errors.As(err, &challenge) {
+		t.Fatalf("Expected a challenge, received %v", err)
+	}
+	code := codes[len(codes)-1].Data.(loginChallengedEvent).Code
+	for k := 0; k < maxChallengeFailures; k++ {
+		s.VerifyLogin(phone, challenge.Token, "wrong")
+	}
+	if _, err := s.VerifyLogin(phone, challenge.Token, code); err != ErrUnauthorized {
+		t.Errorf("Expected a challenge refused after %v wrong codes, received %v", maxChallengeFailures, err)
+	}
+
+	_, err = s.Login(phone, "eve", "pass")
+	if !errors.As(err, &challenge) {
+		t.Fatalf("Expected a challenge, received %v", err)
+	}
+	code = codes[len(codes)-1].Data.(loginChallengedEvent).Code
+	c.Advance(time.Minute)
+	if _, err := s.VerifyLogin(phone, challenge.Token, code); err != ErrUnauthorized {
+		t.Errorf("Expected an expired challenge refused, received %v", err)
+	}
+}
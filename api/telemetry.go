@@ -0,0 +1,53 @@
+package api
+
+// telemetry.go contains the counters of business events, such as signups and
+// logins, for product dashboards. Unlike the request metrics they count what
+// happened rather than which routes were called, and only once it succeeded.
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	Signups = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "user_signups_total",
+		Help: "Number of customers who registered.",
+	})
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_logins_total",
+		Help: "Number of logins by result: success, failure, challenge, denied or error.",
+	}, []string{"result"})
+	CardsAdded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cards_added_total",
+		Help: "Number of cards added to customers.",
+	})
+	Deletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deletions_total",
+		Help: "Number of customers, addresses and cards deleted, by entity.",
+	}, []string{"entity"})
+)
+
+func init() {
+	prometheus.MustRegister(Signups)
+	prometheus.MustRegister(Logins)
+	prometheus.MustRegister(CardsAdded)
+	prometheus.MustRegister(Deletions)
+}
+
+// loginResult names the result of a login for the Logins counter. Failures
+// are refused credentials; errors are logins that could not be checked.
+func loginResult(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case err == ErrUnauthorized:
+		return "failure"
+	case errors.Is(err, ErrLoginChallenge):
+		return "challenge"
+	case err == ErrLoginDenied:
+		return "denied"
+	}
+	return "error"
+}
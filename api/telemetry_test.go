@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+// eventsDB accepts every write.
+type eventsDB struct {
+	saltDB
+}
+
+func (d *eventsDB) CreateCard(c *users.Card, userid string) error {
+	c.ID = "c1"
+	return nil
+}
+
+func (d *eventsDB) Delete(entity, id string) error {
+	if entity != "cards" {
+		return errors.New("unknown entity")
+	}
+	return nil
+}
+
+func TestBusinessCounters(t *testing.T) {
+	prev := db.DefaultDb
+	db.DefaultDb = &eventsDB{}
+	t.Cleanup(func() { db.DefaultDb = prev })
+	s := NewFixedService()
+	ctx := context.Background()
+
+	signups, cards, deletions := counterValue(Signups), counterValue(CardsAdded), counterValue(Deletions.WithLabelValues("cards"))
+	if _, err := s.Register(ctx, "newuser", "pass", "", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register(ctx, "admin", "pass", "", "", "", "", ""); err == nil {
+		t.Fatal("Expected reserved username refused")
+	}
+	if n := counterValue(Signups) - signups; n != 1 {
+		t.Errorf("Expected one signup counted, received %v", n)
+	}
+	if _, err := s.PostCard(ctx, users.Card{LongNum: "4111111111111111"}, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := counterValue(CardsAdded) - cards; n != 1 {
+		t.Errorf("Expected one card counted, received %v", n)
+	}
+	s.Delete(ctx, "cards", "c1", "")
+	s.Delete(ctx, "widgets", "w1", "")
+	if n := counterValue(Deletions.WithLabelValues("cards")) - deletions; n != 1 {
+		t.Errorf("Expected one card deletion counted, received %v", n)
+	}
+}
+
+func TestLoginResult(t *testing.T) {
+	for err, result := range map[error]string{
+		nil:                   "success",
+		ErrUnauthorized:       "failure",
+		ErrLoginChallenge:     "challenge",
+		&LoginChallenge{}:     "challenge",
+		ErrLoginDenied:        "denied",
+		users.ErrUserNotFound: "error",
+	} {
+		if r := loginResult(err); r != result {
+			t.Errorf("Expected %v to be counted as %v, received %v", err, result, r)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+// tracing.go contains the correlation of log lines with traces, so that a
+// log line found during an incident leads to its trace in Zipkin, and the
+// tags every endpoint span carries.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/tracing/opentracing"
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/timing"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	zipkinot "github.com/openzipkin-contrib/zipkin-go-opentracing"
+)
+
+// CustomerHashTag is the span tag holding CustomerHash of the authenticated
+// customer.
+const CustomerHashTag = "customer.id_hash"
+
+// TraceIDs returns the hex IDs of the trace and span active in ctx. They are
+// empty unless ctx carries a Zipkin span.
+func TraceIDs(ctx context.Context) (traceID, spanID string) {
+	span := stdopentracing.SpanFromContext(ctx)
+	if span == nil {
+		return "", ""
+	}
+	sc, ok := span.Context().(zipkinot.SpanContext)
+	if !ok {
+		return "", ""
+	}
+	return sc.TraceID.String(), sc.ID.String()
+}
+
+// WithTrace returns logger, logging the trace_id and span_id of the span
+// active in ctx, if any.
+func WithTrace(ctx context.Context, logger log.Logger) log.Logger {
+	traceID, spanID := TraceIDs(ctx)
+	if traceID == "" {
+		return logger
+	}
+	return log.With(logger, "trace_id", traceID, "span_id", spanID)
+}
+
+// CustomerHash returns a short hash of a customer ID, so the traces of one
+// customer can be found without the traces naming them.
+func CustomerHash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// traceServer traces an endpoint like opentracing.TraceServer, tagging its
+// span with the hash of the authenticated customer, if any, and the status
+// of the error it returns. The time in the
+// endpoint counts as the handler's in the request's timing.
+func traceServer(tracer stdopentracing.Tracer, operationName string) endpoint.Middleware {
+	trace := opentracing.TraceServer(tracer, operationName)
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return trace(func(ctx context.Context, request interface{}) (interface{}, error) {
+			if p, ok := PrincipalFromContext(ctx); ok && p.UserID != "" {
+				if span := stdopentracing.SpanFromContext(ctx); span != nil {
+					span.SetTag(CustomerHashTag, CustomerHash(p.UserID))
+				}
+			}
+			timing.Enter(ctx, timing.Handler)
+			defer timing.Enter(ctx, timing.Serialization)
+			response, err := next(ctx, request)
+			if err != nil {
+				// The span is tagged as failed for any error; the status
+				// tells server errors from the customer's.
+				if span := stdopentracing.SpanFromContext(ctx); span != nil {
+					ext.HTTPStatusCode.Set(span, uint16(ErrorStatus(err)))
+				}
+			}
+			return response, err
+		})
+	}
+}
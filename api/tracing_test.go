@@ -0,0 +1,73 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/users"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	zipkinot "github.com/openzipkin-contrib/zipkin-go-opentracing"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/reporter"
+)
+
+func TestWithTrace(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+	WithTrace(context.Background(), logger).Log("msg", "untraced")
+	if strings.Contains(buf.String(), "trace_id") {
+		t.Errorf("Expected no trace outside a span, logged %q", buf.String())
+	}
+
+	native, err := zipkin.NewTracer(reporter.NewNoopReporter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := zipkinot.Wrap(native).StartSpan("GET /login")
+	defer span.Finish()
+	ctx := stdopentracing.ContextWithSpan(context.Background(), span)
+	traceID, spanID := TraceIDs(ctx)
+	if traceID == "" || spanID == "" {
+		t.Fatal("Expected the IDs of the span")
+	}
+	buf.Reset()
+	WithTrace(ctx, logger).Log("msg", "traced")
+	if want := "trace_id=" + traceID + " span_id=" + spanID; !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected %q, logged %q", want, buf.String())
+	}
+}
+
+func TestTraceServerTagsCustomer(t *testing.T) {
+	tracer := mocktracer.New()
+	e := traceServer(tracer, "GET /cards")(func(context.Context, interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	e(context.Background(), nil)
+	ctx := context.WithValue(context.Background(), principalKey, Principal{UserID: "57a98d98e4b00679b4a830af", Username: "eve"})
+	e(ctx, nil)
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected two spans, received %v", len(spans))
+	}
+	if tag := spans[0].Tag(CustomerHashTag); tag != nil {
+		t.Errorf("Expected anonymous requests untagged, received %v", tag)
+	}
+	if tag := spans[1].Tag(CustomerHashTag); tag != CustomerHash("57a98d98e4b00679b4a830af") || strings.Contains(tag.(string), "57a98d98") {
+		t.Errorf("Expected the hashed customer ID, received %v", tag)
+	}
+}
+
+func TestTraceServerTagsStatus(t *testing.T) {
+	tracer := mocktracer.New()
+	e := traceServer(tracer, "GET /customers/{id}")(func(context.Context, interface{}) (interface{}, error) {
+		return nil, users.ErrUserNotFound
+	})
+	e(context.Background(), nil)
+	if tag := tracer.FinishedSpans()[0].Tag("http.status_code"); tag != uint16(404) {
+		t.Errorf("Expected the status of the error, received %v", tag)
+	}
+}
@@ -4,34 +4,61 @@ package api
 // In our case we just use a REST-y HTTP transport.
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/tracing/opentracing"
+	"github.com/go-kit/kit/transport"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/go-kit/log"
 	"github.com/gorilla/mux"
+	"github.com/mikesay/user/blobs"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/i18n"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/reporting"
 	"github.com/mikesay/user/users"
 	stdopentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 var (
-	ErrInvalidRequest = errors.New("Invalid request")
+	ErrInvalidRequest = users.NewError(users.CodeInvalidRequest, "Invalid request")
 )
 
-// MakeHTTPHandler mounts the endpoints into a REST-y HTTP handler.
-func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Tracer) *mux.Router {
+// MakeHTTPHandler mounts the endpoints into a REST-y HTTP handler. Server
+// errors are logged and, unless reporter is nil, reported.
+func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Tracer, reporter reporting.Reporter) *mux.Router {
 	r := mux.NewRouter().StrictSlash(false)
 	options := []httptransport.ServerOption{
-		httptransport.ServerErrorLogger(logger),
+		httptransport.ServerErrorHandler(transport.ErrorHandlerFunc(func(ctx context.Context, err error) {
+			WithTrace(ctx, logger).Log("err", err)
+			reportError(ctx, reporter, err)
+		})),
 		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(clientInfoToContext, requestCacheToContext, languageToContext, modifiedSinceToContext, serializationToContext, routeToContext),
+		httptransport.ServerFinalizer(serializationDone),
 	}
 
 	// GET /login       Login
+	// POST /login/verify Verify a challenged login
 	// GET /register    Register
 	// GET /health      Health Check
 
@@ -41,12 +68,66 @@ func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Trace
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /login", logger)))...,
 	))
+	r.Methods("POST").Path("/login/verify").Handler(httptransport.NewServer(
+		e.LoginVerifyEndpoint,
+		decodeLoginVerifyRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "POST /login/verify", logger)))...,
+	))
 	r.Methods("POST").Path("/register").Handler(httptransport.NewServer(
 		e.RegisterEndpoint,
 		decodeRegisterRequest,
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "POST /register", logger)))...,
 	))
+	r.Methods("GET").Path("/customers/search").Handler(httptransport.NewServer(
+		e.UserSearchEndpoint,
+		decodeSearchRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /customers/search", logger)))...,
+	))
+	r.Methods("GET").Path("/customers/{id}/logins").Handler(httptransport.NewServer(
+		e.LoginsGetEndpoint,
+		decodeIDRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /customers/{id}/logins", logger)))...,
+	))
+	r.Methods("GET").Path("/customers/{id}/addresses").Handler(httptransport.NewServer(
+		e.CustomerAddressesGetEndpoint,
+		decodeIDRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /customers/{id}/addresses", logger)))...,
+	))
+	r.Methods("GET").Path("/customers/{id}/cards").Handler(httptransport.NewServer(
+		e.CustomerCardsGetEndpoint,
+		decodeIDRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /customers/{id}/cards", logger)))...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/avatar").Handler(httptransport.NewServer(
+		e.AvatarPutEndpoint,
+		decodeAvatarRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "PUT /customers/{id}/avatar", logger)))...,
+	))
+	r.Methods("GET").Path("/customers/{id}/avatar").Handler(httptransport.NewServer(
+		e.AvatarGetEndpoint,
+		decodeIDRequest,
+		encodeAvatarResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /customers/{id}/avatar", logger)))...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/tags/{tag}").Handler(httptransport.NewServer(
+		e.TagPutEndpoint,
+		decodeTagRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "PUT /customers/{id}/tags/{tag}", logger)))...,
+	))
+	r.Methods("DELETE").Path("/customers/{id}/tags/{tag}").Handler(httptransport.NewServer(
+		e.TagDeleteEndpoint,
+		decodeTagRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "DELETE /customers/{id}/tags/{tag}", logger)))...,
+	))
 	r.Methods("GET").PathPrefix("/customers").Handler(httptransport.NewServer(
 		e.UserGetEndpoint,
 		decodeGetRequest,
@@ -56,13 +137,13 @@ func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Trace
 	r.Methods("GET").PathPrefix("/cards").Handler(httptransport.NewServer(
 		e.CardGetEndpoint,
 		decodeGetRequest,
-		encodeResponse,
+		encodeModifiedResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /cards", logger)))...,
 	))
 	r.Methods("GET").PathPrefix("/addresses").Handler(httptransport.NewServer(
 		e.AddressGetEndpoint,
 		decodeGetRequest,
-		encodeResponse,
+		encodeModifiedResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /addresses", logger)))...,
 	))
 	r.Methods("POST").Path("/customers").Handler(httptransport.NewServer(
@@ -83,35 +164,187 @@ func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Trace
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "POST /cards", logger)))...,
 	))
+	r.Methods("PATCH").Path("/cards/{id}").Handler(httptransport.NewServer(
+		e.CardPatchEndpoint,
+		decodeCardPatchRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "PATCH /cards/{id}", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/customers/{id}/notes").Handler(httptransport.NewServer(
+		e.NotePostEndpoint,
+		decodeNotePostRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "POST /admin/customers/{id}/notes", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/customers/{id}/notes").Handler(httptransport.NewServer(
+		e.NotesGetEndpoint,
+		decodeNotesRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /admin/customers/{id}/notes", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/impersonate/{id}").Handler(httptransport.NewServer(
+		e.ImpersonatePostEndpoint,
+		decodeIDRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "POST /admin/impersonate/{id}", logger)))...,
+	))
+	r.Methods("DELETE").Path("/admin/impersonate/{id}").Handler(httptransport.NewServer(
+		e.ImpersonateDeleteEndpoint,
+		decodeIDRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "DELETE /admin/impersonate/{id}", logger)))...,
+	))
 	r.Methods("DELETE").PathPrefix("/").Handler(httptransport.NewServer(
 		e.DeleteEndpoint,
 		decodeDeleteRequest,
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "DELETE /", logger)))...,
 	))
+	r.Methods("GET").Path("/admin/customers/{id}/backup").Handler(httptransport.NewServer(
+		e.BackupGetEndpoint,
+		decodeIDRequest,
+		encodeBackupResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /admin/customers/{id}/backup", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/customers/restore").Handler(httptransport.NewServer(
+		e.RestorePostEndpoint,
+		decodeRestoreRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "POST /admin/customers/restore", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/export.csv").Handler(httptransport.NewServer(
+		e.ExportEndpoint,
+		decodeExportRequest,
+		encodeExportResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /admin/export.csv", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/duplicates").Handler(httptransport.NewServer(
+		e.DuplicatesEndpoint,
+		decodePageRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /admin/duplicates", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/jobs").Handler(httptransport.NewServer(
+		e.JobPostEndpoint,
+		decodeJobRequest,
+		encodeJobResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "POST /admin/jobs", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/gc").Handler(httptransport.NewServer(
+		e.JobPostEndpoint,
+		decodeGCRequest,
+		encodeJobResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "POST /admin/gc", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/jobs/{id}").Handler(httptransport.NewServer(
+		e.JobGetEndpoint,
+		decodeIDRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /admin/jobs/{id}", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/indexes").Handler(httptransport.NewServer(
+		e.IndexesEndpoint,
+		decodeHealthRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /admin/indexes", logger)))...,
+	))
 	r.Methods("GET").PathPrefix("/health").Handler(httptransport.NewServer(
 		e.HealthEndpoint,
 		decodeHealthRequest,
 		encodeHealthResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GET /health", logger)))...,
 	))
-	r.Handle("/metrics", promhttp.Handler())
+	r.Handle("/metrics", promhttp.Handler()).Name("metrics")
 	return r
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
-	code := http.StatusInternalServerError
-	switch err {
-	case ErrUnauthorized:
-		code = http.StatusUnauthorized
+// errorStatus maps error codes to response statuses. Other codes are
+// internal errors.
+var errorStatus = map[string]int{
+	users.CodeUnauthorized:         http.StatusUnauthorized,
+	users.CodeLoginChallenge:       http.StatusUnauthorized,
+	users.CodeLoginDenied:          http.StatusForbidden,
+	users.CodeForbidden:            http.StatusForbidden,
+	users.CodeInvalidRequest:       http.StatusBadRequest,
+	users.CodeInvalidID:            http.StatusBadRequest,
+	users.CodeMissingField:         http.StatusBadRequest,
+	users.CodeInvalidPostcode:      http.StatusBadRequest,
+	users.CodeInvalidBackup:        http.StatusBadRequest,
+	users.CodeUsernameLength:       http.StatusBadRequest,
+	users.CodeUsernameCharset:      http.StatusBadRequest,
+	users.CodeUsernameReserved:     http.StatusBadRequest,
+	users.CodeUserNotFound:         http.StatusNotFound,
+	users.CodeAddressNotFound:      http.StatusNotFound,
+	users.CodeCardNotFound:         http.StatusNotFound,
+	users.CodeInvalidConfirmation:  http.StatusConflict,
+	users.CodeIDConflict:           http.StatusConflict,
+	users.CodeAddressLimitExceeded: http.StatusConflict,
+	users.CodeCardLimitExceeded:    http.StatusConflict,
+	users.CodeOverloaded:           http.StatusServiceUnavailable,
+	users.CodeInvalidTag:           http.StatusBadRequest,
+	users.CodeInvalidCardStatus:    http.StatusBadRequest,
+	users.CodeCardFlagged:          http.StatusForbidden,
+	users.CodeInvalidNote:          http.StatusBadRequest,
+	users.CodeReadOnly:             http.StatusServiceUnavailable,
+	users.CodeAvatarNotFound:       http.StatusNotFound,
+	users.CodeInvalidAvatar:        http.StatusUnsupportedMediaType,
+	users.CodeAvatarTooLarge:       http.StatusRequestEntityTooLarge,
+	users.CodeSignupThrottled:      http.StatusTooManyRequests,
+	users.CodeDisposableEmail:      http.StatusBadRequest,
+	users.CodeInvalidDateOfBirth:   http.StatusBadRequest,
+	users.CodeUnderage:             http.StatusBadRequest,
+	users.CodeAuthzUnavailable:     http.StatusServiceUnavailable,
+	users.CodeSignupChallenge:      http.StatusUnauthorized,
+	users.CodeSignupRejected:       http.StatusForbidden,
+	users.CodeRateLimited:          http.StatusTooManyRequests,
+}
+
+// ErrorStatus returns the response status for err.
+func ErrorStatus(err error) int {
+	if err == jobs.ErrUnknownKind {
+		return http.StatusBadRequest
 	}
-	w.WriteHeader(code)
+	code, ok := errorStatus[users.ErrorCode(err)]
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	return code
+}
+
+// encodeError writes err with its code and status. The message is in the
+// language negotiated by languageToContext; codes are never translated.
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	if errors.As(err, new(*streamError)) {
+		// The response was sent and already ends with the error.
+		return
+	}
+	code, body := errorBody(ctx, err)
 	w.Header().Set("Content-Type", "application/hal+json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error":       err.Error(),
+	w.Header().Set("Content-Language", languageFromContext(ctx).String())
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// errorBody returns the status and body of the error response for err.
+func errorBody(ctx context.Context, err error) (int, map[string]interface{}) {
+	errCode := users.ErrorCode(err)
+	if err == jobs.ErrUnknownKind {
+		errCode = users.CodeInvalidRequest
+	}
+	code := ErrorStatus(err)
+	lang := languageFromContext(ctx)
+	body := map[string]interface{}{
+		"error":       i18n.Message(lang, errCode, err.Error()),
+		"code":        errCode,
 		"status_code": code,
 		"status_text": http.StatusText(code),
-	})
+	}
+	var challenge *LoginChallenge
+	if errors.As(err, &challenge) {
+		body["challenge"] = challenge.Token
+		body["expires"] = challenge.Expires.UTC()
+	}
+	return code, body
 }
 
 func decodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
@@ -126,6 +359,17 @@ func decodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error)
 	}, nil
 }
 
+func decodeLoginVerifyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := loginVerifyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	if req.Challenge == "" || req.Code == "" {
+		return nil, ErrUnauthorized
+	}
+	return req, nil
+}
+
 func decodeRegisterRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	reg := registerRequest{}
 	err := json.NewDecoder(r.Body).Decode(&reg)
@@ -141,7 +385,8 @@ func decodeDeleteRequest(_ context.Context, r *http.Request) (interface{}, error
 	if len(u) == 3 {
 		d.Entity = u[1]
 		d.ID = u[2]
-		return d, nil
+		d.Confirm = r.URL.Query().Get("confirm")
+		return d, checkID(d.ID)
 	}
 	return d, ErrInvalidRequest
 }
@@ -155,37 +400,264 @@ func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
 			g.Attr = u[3]
 		}
 	}
+	if g.ID == "" {
+		var err error
+		if g.List, err = parseList(r.URL.Query()); err != nil {
+			return nil, err
+		}
+	} else if err := checkID(g.ID); err != nil {
+		return nil, err
+	}
 	return g, nil
 }
 
+// decodeSearchRequest reads the search filters from the query string. Times
+// are RFC3339, inactiveDays counts back from now, usernamePrefix matches the
+// start of usernames and emailDomain the whole domain of emails.
+func decodeSearchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return parseQuery(r.URL.Query())
+}
+
+// decodeExportRequest reads the search filters, the comma separated columns
+// to export, refusing unknown columns, and the cursor to resume from.
+func decodeExportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := r.URL.Query()
+	q, err := parseQuery(v)
+	if err != nil {
+		return nil, err
+	}
+	req := exportRequest{Query: q, Columns: defaultExportColumns, Cursor: v.Get("cursor")}
+	if s := v.Get("columns"); s != "" {
+		req.Columns = strings.Split(s, ",")
+		for _, c := range req.Columns {
+			if _, ok := exportColumns[c]; !ok && c != cursorColumn {
+				return nil, ErrInvalidRequest
+			}
+		}
+	}
+	return req, nil
+}
+
+// parseQuery reads the search filters.
+func parseQuery(v url.Values) (db.Query, error) {
+	q := db.Query{}
+	var err error
+	if s := v.Get("createdAfter"); s != "" {
+		if q.CreatedAfter, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, ErrInvalidRequest
+		}
+	}
+	if s := v.Get("createdBefore"); s != "" {
+		if q.CreatedBefore, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, ErrInvalidRequest
+		}
+	}
+	if s := v.Get("inactiveDays"); s != "" {
+		days, err := strconv.Atoi(s)
+		if err != nil || days < 0 {
+			return q, ErrInvalidRequest
+		}
+		q.InactiveDays = days
+	}
+	q.UsernamePrefix = v.Get("usernamePrefix")
+	q.EmailDomain = v.Get("emailDomain")
+	if strings.Contains(strings.TrimPrefix(q.EmailDomain, "@"), "@") {
+		return q, ErrInvalidRequest
+	}
+	q.Country = v.Get("country")
+	q.Tag = v.Get("tag")
+	if q.Tag != "" {
+		if err := users.ValidateTag(q.Tag); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// decodePageRequest reads the page and size query parameters, defaulting to
+// the first page of defaultPageSize results.
+func decodePageRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return parsePage(r.URL.Query())
+}
+
+// parsePage reads the page and size parameters, defaulting to the first
+// page of defaultPageSize results.
+func parsePage(v url.Values) (Page, error) {
+	p := Page{Number: 1, Size: defaultPageSize}
+	var err error
+	if s := v.Get("page"); s != "" {
+		if p.Number, err = strconv.Atoi(s); err != nil || p.Number < 1 {
+			return p, ErrInvalidRequest
+		}
+	}
+	if s := v.Get("size"); s != "" {
+		if p.Size, err = strconv.Atoi(s); err != nil || p.Size < 1 || p.Size > maxPageSize {
+			return p, ErrInvalidRequest
+		}
+	}
+	return p, nil
+}
+
+// parseList reads the sort, order, page, size and after parameters of a
+// list. Lists are returned whole unless a page or size is asked for. After
+// is the cursor of the next link of a page, which, unlike page numbers,
+// neither skips nor repeats results added or removed in the meantime.
+func parseList(v url.Values) (db.ListOptions, error) {
+	l := db.ListOptions{Sort: v.Get("sort"), Tag: v.Get("tag")}
+	if l.Tag != "" {
+		if err := users.ValidateTag(l.Tag); err != nil {
+			return l, err
+		}
+	}
+	switch v.Get("order") {
+	case "", "asc":
+	case "desc":
+		l.Descending = true
+	default:
+		return l, ErrInvalidRequest
+	}
+	if v.Has("page") || v.Has("size") {
+		p, err := parsePage(v)
+		if err != nil {
+			return l, err
+		}
+		l.Offset, l.Limit = (p.Number-1)*p.Size, p.Size
+	}
+	if l.After = v.Get("after"); l.After != "" && v.Has("page") {
+		// Pages after a cursor are counted from it.
+		return l, ErrInvalidRequest
+	}
+	return l, nil
+}
+
+// checkID refuses IDs the database could not have created, before the
+// entity is queried, unless they are old IDs it maps to new ones. IDs are
+// otherwise opaque.
+func checkID(id string) error {
+	if db.ValidID(id) {
+		return nil
+	}
+	for _, kind := range []string{db.CustomerIDs, db.AddressIDs, db.CardIDs} {
+		if _, err := db.MappedID(db.DefaultDb, kind, id); err == nil {
+			return nil
+		}
+	}
+	return users.ErrInvalidID
+}
+
+// decodeIDRequest reads the {id} route variable.
+func decodeIDRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id := mux.Vars(r)["id"]
+	return GetRequest{ID: id}, checkID(id)
+}
+
+func decodeAvatarRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id := mux.Vars(r)["id"]
+	return avatarPutRequest{ID: id, Body: r.Body}, checkID(id)
+}
+
+func decodeTagRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := mux.Vars(r)
+	return tagRequest{ID: v["id"], Tag: v["tag"]}, checkID(v["id"])
+}
+
 func decodeUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
-	u := users.User{}
+	u := userRequest{}
 	err := json.NewDecoder(r.Body).Decode(&u)
 	if err != nil {
 		return nil, err
 	}
-	return u, nil
+	return u.user(), nil
 }
 
 func decodeAddressRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
-	a := addressPostRequest{}
+	a := addressRequest{}
 	err := json.NewDecoder(r.Body).Decode(&a)
 	if err != nil {
 		return nil, err
 	}
-	return a, nil
+	return addressPostRequest{Address: a.address(), UserID: a.UserID}, nil
 }
 
 func decodeCardRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
-	c := cardPostRequest{}
+	c := cardRequest{}
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+	return cardPostRequest{Card: c.card(), UserID: c.UserID}, nil
+}
+
+func decodeCardPatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	c := cardPatchRequest{}
 	err := json.NewDecoder(r.Body).Decode(&c)
 	if err != nil {
 		return nil, err
 	}
-	return c, nil
+	c.ID = mux.Vars(r)["id"]
+	return c, checkID(c.ID)
+}
+
+func decodeNotePostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	n := notePostRequest{}
+	err := json.NewDecoder(r.Body).Decode(&n)
+	if err != nil {
+		return nil, err
+	}
+	n.ID = mux.Vars(r)["id"]
+	return n, checkID(n.ID)
+}
+
+func decodeNotesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id := mux.Vars(r)["id"]
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+	p, err := parsePage(r.URL.Query())
+	return notesRequest{ID: id, Page: p}, err
+}
+
+func decodeRestoreRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	b := Backup{}
+	err := json.NewDecoder(r.Body).Decode(&b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func decodeJobRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	j := jobPostRequest{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// decodeGCRequest queues a gc job, a dry run if the dryRun query parameter
+// is true.
+func decodeGCRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var p GCParams
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, ErrInvalidRequest
+		}
+		p.DryRun = dryRun
+	}
+	params, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return jobPostRequest{Kind: "gc", Params: params}, nil
 }
 
 func decodeHealthRequest(_ context.Context, r *http.Request) (interface{}, error) {
@@ -196,8 +668,208 @@ func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response i
 	return encodeResponse(ctx, w, response.(healthResponse))
 }
 
-func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
-	// All of our response objects are JSON serializable, so we just do that.
+// encodeBackupResponse serves the backup as a downloadable file.
+func encodeBackupResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	b := response.(Backup)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"customer-%v.json\"", b.Customer.ID))
+	return encodeResponse(ctx, w, b)
+}
+
+// encodeExportResponse writes the export as CSV while reading it. Headers
+// are held back until the first user is read, so that a failure to start
+// the export is still reported as an error response.
+func encodeExportResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	r := response.(exportResponse)
+	cw := csv.NewWriter(w)
+	started := false
+	start := func() error {
+		if started {
+			return nil
+		}
+		started = true
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"customers.csv\"")
+		return cw.Write(r.Columns)
+	}
+	err := r.Each(func(u users.User, cursor string) error {
+		if err := start(); err != nil {
+			return err
+		}
+		return cw.Write(exportRow(u, cursor, r.Columns))
+	})
+	if err != nil {
+		return err
+	}
+	if err := start(); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// encodeAvatarResponse serves the image itself. Avatar URLs change with the
+// image, so caching only briefly delays clients requesting it unversioned.
+func encodeAvatarResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	b := response.(blobs.Blob)
+	w.Header().Set("Content-Type", b.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b.Data)))
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err := w.Write(b.Data)
+	return err
+}
+
+// encodeModifiedResponse sets Last-Modified on single addresses and cards,
+// answering 304 if they are unchanged since If-Modified-Since, so that
+// clients revalidate them cheaply. Lists are encoded as usual; entries
+// removed from them leave no timestamp behind.
+func encodeModifiedResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	var modified time.Time
+	switch v := response.(type) {
+	case users.Address:
+		modified = v.UpdatedAt
+	case users.Card:
+		modified = v.UpdatedAt
+	}
+	if modified.IsZero() {
+		return encodeResponse(ctx, w, response)
+	}
+	// HTTP dates have a resolution of seconds.
+	modified = modified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	if since, ok := modifiedSinceFromContext(ctx); ok && !modified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	return encodeResponse(ctx, w, response)
+}
+
+// encodeJobResponse acknowledges a queued job, pointing at its status.
+func encodeJobResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	j := response.(jobs.Job)
+	w.Header().Set("Content-Type", "application/hal+json")
+	w.Header().Set("Location", "/admin/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(j)
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if r, ok := response.(listResponse); ok {
+		return encodeListResponse(ctx, w, r)
+	}
+	// All of our response objects are JSON serializable, once the users
+	// structs in them are replaced by their DTOs. They are encoded into a
+	// pooled buffer, so that the length is known and an encoding error is
+	// still reported as an error response.
+	buf := buffers.Get().(*bytes.Buffer)
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(toWire(response)); err != nil {
+		return err
+	}
 	w.Header().Set("Content-Type", "application/hal+json")
-	return json.NewEncoder(w).Encode(response)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// StreamErrorTrailer is the trailer set to the error code of a streamed
+// list cut short by an error.
+const StreamErrorTrailer = "X-Stream-Error"
+
+// streamError is an error cutting a streamed list short once its status was
+// sent. The list is closed with the error, so it is not encoded again.
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string { return "list cut short: " + e.err.Error() }
+
+func (e *streamError) Unwrap() error { return e.err }
+
+// sentWriter records whether anything was written to w.
+type sentWriter struct {
+	w    io.Writer
+	sent bool
+}
+
+func (s *sentWriter) Write(p []byte) (int, error) {
+	s.sent = true
+	return s.w.Write(p)
+}
+
+// encodeListResponse writes a list in the shape of pageResponse as its
+// batches are read, so that its length is unknown and it is sent chunked.
+// An error before the buffered start of the list is sent is still reported
+// as an error response. A later one closes the list with an "error" member
+// holding the error response's body, sets StreamErrorTrailer, and is
+// returned as a *streamError.
+func encodeListResponse(ctx context.Context, w http.ResponseWriter, r listResponse) error {
+	sw := &sentWriter{w: w}
+	bw := bufio.NewWriter(sw)
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.Header().Set("Trailer", StreamErrorTrailer)
+		fmt.Fprintf(bw, `{"_embedded":{%q:[`, r.Key)
+	}
+	links, err := r.Each(func(v interface{}) error {
+		b, err := json.Marshal(toWire(v))
+		if err != nil {
+			return err
+		}
+		if started {
+			bw.WriteByte(',')
+		}
+		start()
+		_, err = bw.Write(b)
+		return err
+	})
+	if err != nil && !sw.sent {
+		w.Header().Del("Trailer")
+		return err
+	}
+	if err != nil {
+		_, body := errorBody(ctx, err)
+		b, _ := json.Marshal(body)
+		bw.WriteString(`]},"error":`)
+		bw.Write(b)
+		bw.WriteString("}\n")
+		bw.Flush()
+		w.Header().Set(StreamErrorTrailer, users.ErrorCode(err))
+		return &streamError{err: err}
+	}
+	start()
+	bw.WriteString("]}")
+	if links != nil {
+		b, err := json.Marshal(links)
+		if err != nil {
+			return err
+		}
+		bw.WriteString(`,"_links":`)
+		bw.Write(b)
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// maxPooledBuffer is the largest buffer returned to the pool, so that one
+// very large list does not stay allocated.
+const maxPooledBuffer = 1 << 20
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	buffers.Put(buf)
 }
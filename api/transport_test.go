@@ -0,0 +1,581 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestDecodeSearchRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/customers/search?createdAfter=2020-01-02T03:04:05Z&inactiveDays=90", nil)
+	req, err := decodeSearchRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := req.(db.Query)
+	if !q.CreatedAfter.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Expected createdAfter to be parsed, received %v", q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		t.Error("Expected empty createdBefore")
+	}
+	if q.InactiveDays != 90 {
+		t.Errorf("Expected inactiveDays to be parsed, received %v", q.InactiveDays)
+	}
+}
+
+func TestDecodeSearchRequestPrefix(t *testing.T) {
+	r := httptest.NewRequest("GET", "/customers/search?usernamePrefix=ev&emailDomain=example.com", nil)
+	req, err := decodeSearchRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := req.(db.Query); q.UsernamePrefix != "ev" || q.EmailDomain != "example.com" {
+		t.Errorf("Expected prefix and domain filters, received %+v", q)
+	}
+}
+
+func TestDecodeTagFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/customers/search?tag=vip", nil)
+	if req, err := decodeSearchRequest(context.Background(), r); err != nil || req.(db.Query).Tag != "vip" {
+		t.Errorf("Expected search by tag, received %+v %v", req, err)
+	}
+	r = httptest.NewRequest("GET", "/customers?tag=fraud_review", nil)
+	if req, err := decodeGetRequest(context.Background(), r); err != nil || req.(GetRequest).List.Tag != "fraud_review" {
+		t.Errorf("Expected list by tag, received %+v %v", req, err)
+	}
+	r = httptest.NewRequest("GET", "/customers?tag=VIP", nil)
+	if _, err := decodeGetRequest(context.Background(), r); err != users.ErrInvalidTag {
+		t.Errorf("Expected malformed tag to be refused, received %v", err)
+	}
+}
+
+func TestDecodeGCRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/admin/gc?dryRun=true", nil)
+	req, err := decodeGCRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := req.(jobPostRequest); j.Kind != "gc" || string(j.Params) != `{"dryRun":true}` {
+		t.Errorf("Expected a dry run gc job, received %+v", j)
+	}
+	r = httptest.NewRequest("POST", "/admin/gc?dryRun=maybe", nil)
+	if _, err := decodeGCRequest(context.Background(), r); err != ErrInvalidRequest {
+		t.Errorf("Expected malformed dryRun to be refused, received %v", err)
+	}
+}
+
+func TestDecodeSearchRequestInvalid(t *testing.T) {
+	for _, qs := range []string{"createdAfter=yesterday", "createdBefore=1", "inactiveDays=-1", "inactiveDays=x", "emailDomain=a@b.com"} {
+		r := httptest.NewRequest("GET", "/customers/search?"+qs, nil)
+		if _, err := decodeSearchRequest(context.Background(), r); err != ErrInvalidRequest {
+			t.Errorf("Expected invalid request for %v", qs)
+		}
+	}
+}
+
+func TestDecodeExportRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/admin/export.csv?columns=id,email,cursor&country=UK&createdAfter=2020-01-02T03:04:05Z&cursor=abc", nil)
+	req, err := decodeExportRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := req.(exportRequest)
+	if len(e.Columns) != 3 || e.Columns[1] != "email" || e.Query.Country != "UK" || e.Query.CreatedAfter.IsZero() || e.Cursor != "abc" {
+		t.Errorf("Expected columns and filters, received %+v", e)
+	}
+	for _, column := range []string{"password", "dateOfBirth"} {
+		r = httptest.NewRequest("GET", "/admin/export.csv?columns=id,"+column, nil)
+		if _, err := decodeExportRequest(context.Background(), r); err != ErrInvalidRequest {
+			t.Errorf("Expected %v column to be refused", column)
+		}
+	}
+}
+
+func TestEncodeExportResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := encodeExportResponse(context.Background(), w, exportResponse{
+		Columns: []string{"username", "lastName", "birthYear", "cursor"},
+		Each: func(f func(users.User, string) error) error {
+			return f(users.User{Username: "eve", LastName: "O'Neil, \"Jr\"", DateOfBirth: "1990-05-17"}, "c1")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Expected CSV content type, received %v", ct)
+	}
+	if want := "username,lastName,birthYear,cursor\neve,\"O'Neil, \"\"Jr\"\"\",1990,c1\n"; w.Body.String() != want {
+		t.Errorf("Expected %q, received %q", want, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	encodeExportResponse(context.Background(), w, exportResponse{
+		Columns: []string{"username", "firstName", "lastName", "email"},
+		Each: func(f func(users.User, string) error) error {
+			return f(users.User{Username: "=1+1", FirstName: "+SUM(A1)", LastName: "-2", Email: "@x"}, "")
+		},
+	})
+	if want := "username,firstName,lastName,email\n'=1+1,'+SUM(A1),'-2,'@x\n"; w.Body.String() != want {
+		t.Errorf("Expected formulas quoted, received %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	err = encodeExportResponse(context.Background(), w, exportResponse{
+		Columns: defaultExportColumns,
+		Each:    func(func(users.User, string) error) error { return errors.New("db down") },
+	})
+	if err == nil || w.Body.Len() != 0 {
+		t.Errorf("Expected failure before the first row to write nothing, received %q", w.Body.String())
+	}
+}
+
+func TestEncodeListResponse(t *testing.T) {
+	defer func(m int) { db.MaxListDecoded = m }(db.MaxListDecoded)
+	db.MaxListDecoded = 2
+	all := []users.User{{UserID: "u1", LastName: "Doe"}, {UserID: "u2", LastName: "Cole"}, {UserID: "u3", LastName: "Bell"}}
+	list := func(_ context.Context, l db.ListOptions) ([]users.User, error) {
+		if l.Limit > db.MaxListDecoded {
+			t.Fatalf("Expected batches of at most %v, received a limit of %v", db.MaxListDecoded, l.Limit)
+		}
+		us := all
+		if c, _ := db.ListCursor(l); c != nil {
+			for len(us) > 0 && us[0].UserID <= c.ID {
+				us = us[1:]
+			}
+		}
+		return us[:min(l.Limit, len(us))], nil
+	}
+	for _, l := range []db.ListOptions{{}, {Limit: 3}} {
+		streamed, whole := httptest.NewRecorder(), httptest.NewRecorder()
+		if err := encodeResponse(context.Background(), streamed, streamList(context.Background(), "customer", l, list)); err != nil {
+			t.Fatal(err)
+		}
+		encodeResponse(context.Background(), whole, pageResponse{usersResponse{Users: all}, nextLinks("customer", l, all)})
+		if streamed.Body.String() != whole.Body.String() {
+			t.Errorf("Expected %+v streamed as %s, received %s", l, whole.Body, streamed.Body)
+		}
+		if ct := streamed.Header().Get("Content-Type"); ct != "application/hal+json" {
+			t.Errorf("Expected HAL content type, received %v", ct)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	err := encodeResponse(context.Background(), w, streamList(context.Background(), "card", db.ListOptions{}, func(context.Context, db.ListOptions) ([]users.Card, error) {
+		return nil, errors.New("db down")
+	}))
+	if err == nil || w.Body.Len() != 0 {
+		t.Errorf("Expected failure before the first result to write nothing, received %q", w.Body.String())
+	}
+
+	// A batch larger than the write buffer is sent before the next fails.
+	long := []users.User{{UserID: "u1", LastName: strings.Repeat("x", 5000)}, {UserID: "u2"}}
+	w = httptest.NewRecorder()
+	err = encodeResponse(context.Background(), w, streamList(context.Background(), "customer", db.ListOptions{}, func(_ context.Context, l db.ListOptions) ([]users.User, error) {
+		if l.After != "" {
+			return nil, users.ErrUserNotFound
+		}
+		return long, nil
+	}))
+	var cut *streamError
+	if !errors.As(err, &cut) {
+		t.Fatalf("Expected the list cut short, received %v", err)
+	}
+	var body struct {
+		Embed struct {
+			Customers []json.RawMessage `json:"customer"`
+		} `json:"_embedded"`
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Embed.Customers) != 2 || body.Error.Code != users.CodeUserNotFound {
+		t.Errorf("Expected the sent results closed with the error, received %v %.100q", err, w.Body.String())
+	}
+	if c := w.Result().Trailer.Get(StreamErrorTrailer); c != users.CodeUserNotFound {
+		t.Errorf("Expected the error code trailer, received %q", c)
+	}
+	w = httptest.NewRecorder()
+	encodeError(context.Background(), cut, w)
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected a cut list not encoded again, received %q", w.Body.String())
+	}
+}
+
+type searchService struct {
+	Service
+	found []users.User
+}
+
+func (s searchService) ExportUsers(_ context.Context, _ db.Query, _ string, f func(users.User, string) error) error {
+	for _, u := range s.found {
+		if err := f(u, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSearchStreamed(t *testing.T) {
+	defer func(m int) { db.MaxListDecoded = m }(db.MaxListDecoded)
+	db.MaxListDecoded = 2
+	found := []users.User{{UserID: "u1"}, {UserID: "u2"}, {UserID: "u3"}}
+	response, err := MakeUserSearchEndpoint(searchService{found: found})(context.Background(), db.Query{Tag: "vip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, whole := httptest.NewRecorder(), httptest.NewRecorder()
+	if err := encodeResponse(context.Background(), streamed, response); err != nil {
+		t.Fatal(err)
+	}
+	encodeResponse(context.Background(), whole, EmbedStruct{usersResponse{Users: found}})
+	if streamed.Body.String() != whole.Body.String() {
+		t.Errorf("Expected a search past the cap streamed as %s, received %s", whole.Body, streamed.Body)
+	}
+}
+
+func TestDecodePageRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/admin/duplicates", nil)
+	req, err := decodePageRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := req.(Page); p.Number != 1 || p.Size != defaultPageSize {
+		t.Errorf("Expected default page, received %+v", p)
+	}
+	r = httptest.NewRequest("GET", "/admin/duplicates?page=3&size=50", nil)
+	req, _ = decodePageRequest(context.Background(), r)
+	if p := req.(Page); p.Number != 3 || p.Size != 50 {
+		t.Errorf("Expected page 3 of 50, received %+v", p)
+	}
+	for _, qs := range []string{"page=0", "page=x", "size=0", "size=1000"} {
+		r := httptest.NewRequest("GET", "/admin/duplicates?"+qs, nil)
+		if _, err := decodePageRequest(context.Background(), r); err != ErrInvalidRequest {
+			t.Errorf("Expected invalid request for %v", qs)
+		}
+	}
+}
+
+func TestDecodeGetRequestList(t *testing.T) {
+	r := httptest.NewRequest("GET", "/customers?sort=lastName&order=desc&page=2&size=10", nil)
+	req, err := decodeGetRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := req.(GetRequest).List
+	if l.Sort != "lastName" || !l.Descending || l.Offset != 10 || l.Limit != 10 {
+		t.Errorf("Expected second page of 10 by descending last name, received %+v", l)
+	}
+	r = httptest.NewRequest("GET", "/cards", nil)
+	req, _ = decodeGetRequest(context.Background(), r)
+	if l := req.(GetRequest).List; l != (db.ListOptions{}) {
+		t.Errorf("Expected whole list, received %+v", l)
+	}
+	r = httptest.NewRequest("GET", "/customers?size=10&after=abc", nil)
+	req, _ = decodeGetRequest(context.Background(), r)
+	if l := req.(GetRequest).List; l.After != "abc" || l.Offset != 0 || l.Limit != 10 {
+		t.Errorf("Expected the page of 10 after the cursor, received %+v", l)
+	}
+	for _, qs := range []string{"order=up", "page=0", "size=x", "page=2&after=abc"} {
+		r := httptest.NewRequest("GET", "/addresses?"+qs, nil)
+		if _, err := decodeGetRequest(context.Background(), r); err != ErrInvalidRequest {
+			t.Errorf("Expected invalid request for %v", qs)
+		}
+	}
+}
+
+// objectIDDB declares Mongo's ID scheme.
+type objectIDDB struct {
+	db.Database
+}
+
+func (objectIDDB) IDs() ids.Generator { return ids.ObjectID{} }
+
+func TestDecodeInvalidID(t *testing.T) {
+	prev := db.DefaultDb
+	db.DefaultDb = objectIDDB{}
+	defer func() { db.DefaultDb = prev }()
+
+	if _, err := decodeGetRequest(context.Background(), httptest.NewRequest("GET", "/cards/57a98d98e4b00679b4a830b2", nil)); err != nil {
+		t.Errorf("Expected a valid ID accepted, received %v", err)
+	}
+	if _, err := decodeGetRequest(context.Background(), httptest.NewRequest("GET", "/cards/nothex", nil)); err != users.ErrInvalidID {
+		t.Errorf("Expected an invalid ID refused, received %v", err)
+	}
+	if _, err := decodeDeleteRequest(context.Background(), httptest.NewRequest("DELETE", "/cards/nothex", nil)); err != users.ErrInvalidID {
+		t.Errorf("Expected an invalid ID refused on delete, received %v", err)
+	}
+	db.DefaultDb = prev
+	if _, err := decodeGetRequest(context.Background(), httptest.NewRequest("GET", "/cards/nothex", nil)); err != nil {
+		t.Errorf("Expected any ID accepted without a declared scheme, received %v", err)
+	}
+}
+
+// FuzzDecodeID checks that decoding never panics and only lets through IDs
+// the database could hold.
+func FuzzDecodeID(f *testing.F) {
+	for _, id := range []string{"57a98d98e4b00679b4a830b2", "57A98D98E4B00679B4A830B2", "nothex", "", "57a98d98e4b00679b4a830b2/cards", "57a98d98e4b00679b4a830bé"} {
+		f.Add(id)
+	}
+	f.Fuzz(func(t *testing.T, id string) {
+		prev := db.DefaultDb
+		db.DefaultDb = objectIDDB{}
+		defer func() { db.DefaultDb = prev }()
+
+		r := httptest.NewRequest("GET", "/cards", nil)
+		r.URL.Path = "/cards/" + id
+		req, err := decodeGetRequest(context.Background(), r)
+		if g, ok := req.(GetRequest); err == nil && ok && g.ID != "" && !(ids.ObjectID{}).Valid(g.ID) {
+			t.Errorf("Expected %q refused, decoded %+v", id, g)
+		}
+		r = httptest.NewRequest("DELETE", "/cards", nil)
+		r.URL.Path = "/cards/" + id
+		req, err = decodeDeleteRequest(context.Background(), r)
+		if d := req.(deleteRequest); err == nil && !(ids.ObjectID{}).Valid(d.ID) {
+			t.Errorf("Expected %q refused on delete, decoded %+v", id, d)
+		}
+	})
+}
+
+// roundTrip encodes response as the API does and decodes it into v,
+// failing if the response cannot be encoded.
+func roundTrip(t *testing.T, response interface{}, v interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := encodeResponse(context.Background(), w, response); err != nil {
+		t.Fatalf("Expected %+v encoded, received %v", response, err)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("Expected valid JSON, received %v: %s", err, w.Body)
+	}
+}
+
+func FuzzDecodeRegisterRequest(f *testing.F) {
+	f.Add(`{"username":"eve","password":"pass","email":"eve@example.com","firstName":"Eve","lastName":"Berger"}`)
+	f.Add(`{"username":"ève\u0000","firstName":"\ud800","lastName":"` + "\xff" + `"}`)
+	f.Add(`{"username":1}`)
+	f.Add(`[]`)
+	f.Fuzz(func(t *testing.T, body string) {
+		req, err := decodeRegisterRequest(context.Background(), httptest.NewRequest("POST", "/register", strings.NewReader(body)))
+		if err != nil {
+			return
+		}
+		reg := req.(registerRequest)
+		u := users.User{Username: reg.Username, FirstName: reg.FirstName, LastName: reg.LastName}
+		var got userDTO
+		roundTrip(t, u, &got)
+		if got.Username != reg.Username || got.FirstName != reg.FirstName || got.LastName != reg.LastName {
+			t.Errorf("Expected %+v returned as registered, received %+v", reg, got)
+		}
+	})
+}
+
+func FuzzDecodeAddressRequest(f *testing.F) {
+	f.Add(`{"street":"Main Street","number":"1","country":"US","city":"Springfield","postcode":"12345","userID":"57a98d98e4b00679b4a830b2"}`)
+	f.Add(`{"street":"Straße","postcode":"` + "\xff" + `"}`)
+	f.Add(`{"postcode":null}`)
+	f.Fuzz(func(t *testing.T, body string) {
+		req, err := decodeAddressRequest(context.Background(), httptest.NewRequest("POST", "/addresses", strings.NewReader(body)))
+		if err != nil {
+			return
+		}
+		a := req.(addressPostRequest).Address
+		if a.Validate() != nil {
+			return
+		}
+		var got addressDTO
+		roundTrip(t, a, &got)
+		if got.Street != a.Street || got.PostCode != a.PostCode || got.City != a.City || got.Country != a.Country {
+			t.Errorf("Expected %+v returned as posted, received %+v", a, got)
+		}
+	})
+}
+
+func FuzzDecodeCardRequest(f *testing.F) {
+	f.Add(`{"longNum":"4111111111111111","expires":"12/30","ccv":"123","userID":"57a98d98e4b00679b4a830b2"}`)
+	f.Add(`{"longNum":"12"}`)
+	f.Add(`{"longNum":"４１１１１１１１"}`)
+	f.Fuzz(func(t *testing.T, body string) {
+		req, err := decodeCardRequest(context.Background(), httptest.NewRequest("POST", "/cards", strings.NewReader(body)))
+		if err != nil {
+			return
+		}
+		c := req.(cardPostRequest).Card
+		if c.Status != "" || c.Flag != nil {
+			t.Errorf("Expected a new card active, decoded %+v", c)
+		}
+		n := []rune(c.LongNum)
+		c.MaskCC()
+		var got cardDTO
+		roundTrip(t, c, &got)
+		if m := []rune(got.LongNum); len(m) != len(n) || (len(n) > 4 && strings.Trim(string(m[:len(n)-4]), "*") != "") {
+			t.Errorf("Expected %q masked, received %q", string(n), got.LongNum)
+		}
+	})
+}
+
+func TestEncodeModifiedResponse(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	card := users.Card{ID: "1", UpdatedAt: modified}
+	serve := func(header string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/cards/1", nil)
+		if header != "" {
+			r.Header.Set("If-Modified-Since", header)
+		}
+		rec := httptest.NewRecorder()
+		encodeModifiedResponse(modifiedSinceToContext(context.Background(), r), rec, card)
+		return rec
+	}
+
+	rec := serve("")
+	if rec.Code != http.StatusOK || rec.Header().Get("Last-Modified") != "Wed, 01 May 2024 12:00:00 GMT" {
+		t.Errorf("Expected the card served with its modification date, received %v %v", rec.Code, rec.Header())
+	}
+	if rec := serve("Wed, 01 May 2024 12:00:00 GMT"); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected an unchanged card answered 304, received %v", rec.Code)
+	}
+	if rec := serve("Wed, 01 May 2024 11:59:59 GMT"); rec.Code != http.StatusOK {
+		t.Errorf("Expected a changed card served, received %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	encodeModifiedResponse(context.Background(), rec, EmbedStruct{cardsResponse{Cards: []users.Card{card}}})
+	if rec.Header().Get("Last-Modified") != "" {
+		t.Errorf("Expected lists without a modification date, received %v", rec.Header())
+	}
+}
+
+func TestClientInfoToContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	r.Header.Set("User-Agent", "front-end/1.0")
+	ci := ClientInfoFromContext(clientInfoToContext(context.Background(), r))
+	if ci.IP != "10.0.0.1" {
+		t.Errorf("Expected IP 10.0.0.1 received %v", ci.IP)
+	}
+	if ci.UserAgent != "front-end/1.0" {
+		t.Errorf("Expected user agent front-end/1.0 received %v", ci.UserAgent)
+	}
+	if ci.Client != "front-end/1.0" {
+		t.Errorf("Expected client front-end/1.0 received %v", ci.Client)
+	}
+	for device, want := range map[string]string{
+		" 3f9a2c ":               "3f9a2c",
+		"two words":              "",
+		strings.Repeat("f", 129): "",
+		strings.Repeat("f", 128): strings.Repeat("f", 128),
+	} {
+		r.Header.Set(DeviceHeader, device)
+		if ci := ClientInfoFromContext(clientInfoToContext(context.Background(), r)); ci.Device != want {
+			t.Errorf("Expected fingerprint %q kept as %q, received %q", device, want, ci.Device)
+		}
+	}
+	if (ClientInfoFromContext(context.Background()) != ClientInfo{}) {
+		t.Error("Expected empty client info for bare context")
+	}
+}
+
+func TestEncodeErrorLanguage(t *testing.T) {
+	r := httptest.NewRequest("GET", "/customers/1", nil)
+	r.Header.Set("Accept-Language", "de-DE,de;q=0.9,en;q=0.5")
+	w := httptest.NewRecorder()
+	encodeError(languageToContext(context.Background(), r), users.ErrUserNotFound, w)
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if body.Error != "Benutzer nicht gefunden" || body.Code != users.CodeUserNotFound {
+		t.Errorf("Expected German message with a stable code, received %+v", body)
+	}
+	if lang := w.Header().Get("Content-Language"); lang != "de" {
+		t.Errorf("Expected content language de, received %v", lang)
+	}
+}
+
+func TestEncodeErrorCode(t *testing.T) {
+	for err, status := range map[error]int{
+		users.ErrUserNotFound: http.StatusNotFound,
+		db.ErrCardLimit:       http.StatusConflict,
+		jobs.ErrUnknownKind:   http.StatusBadRequest,
+		errors.New("boom"):    http.StatusInternalServerError,
+	} {
+		w := httptest.NewRecorder()
+		encodeError(context.Background(), err, w)
+		if w.Code != status {
+			t.Errorf("Expected status %v for %v, received %v", status, err, w.Code)
+		}
+		var body struct {
+			Code string `json:"code"`
+		}
+		if jerr := json.NewDecoder(w.Body).Decode(&body); jerr != nil || body.Code == "" {
+			t.Errorf("Expected an error code for %v, received %q", err, body.Code)
+		}
+	}
+}
+
+// benchDB serves one user with an address and a card from memory.
+type benchDB struct {
+	db.Database
+	user users.User
+}
+
+func (d *benchDB) GetUserByName(string) (users.User, error) { return d.user, nil }
+func (d *benchDB) GetUser(string) (users.User, error)       { return d.user, nil }
+func (d *benchDB) UpdateLastLogin(string) error             { return nil }
+func (d *benchDB) CreateLoginAttempt(*users.LoginAttempt) error {
+	return nil
+}
+
+func (d *benchDB) GetUserAttributes(u *users.User) error {
+	u.Addresses = []users.Address{{ID: "a1", Street: "High St", City: "London", PostCode: "N1 9GU"}}
+	u.Cards = []users.Card{{ID: "c1", LongNum: "4111111111111111", Expires: "01/30"}}
+	return nil
+}
+
+func benchHandler(b *testing.B) http.Handler {
+	u := users.User{FirstName: "Eve", LastName: "Doe", Username: "eve", UserID: "5a934e000102030405000000", Salt: "salt", CreatedAt: time.Now()}
+	u.Password = calculatePassHash("pass", u.Salt)
+	prev := db.DefaultDb
+	db.DefaultDb = &benchDB{user: u}
+	b.Cleanup(func() { db.DefaultDb = prev })
+	return MakeHTTPHandler(MakeEndpoints(NewFixedService(), opentracing.NoopTracer{}), log.NewNopLogger(), opentracing.NoopTracer{}, nil)
+}
+
+func benchRequests(b *testing.B, h http.Handler, newRequest func() *http.Request) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest())
+		if w.Code != http.StatusOK {
+			b.Fatalf("Expected 200, received %v: %v", w.Code, w.Body)
+		}
+	}
+}
+
+func BenchmarkLogin(b *testing.B) {
+	benchRequests(b, benchHandler(b), func() *http.Request {
+		r := httptest.NewRequest("GET", "/login", nil)
+		r.SetBasicAuth("eve", "pass")
+		return r
+	})
+}
+
+func BenchmarkGetCustomer(b *testing.B) {
+	benchRequests(b, benchHandler(b), func() *http.Request {
+		return httptest.NewRequest("GET", "/customers/5a934e000102030405000000", nil)
+	})
+}
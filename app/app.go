@@ -0,0 +1,1030 @@
+package app
+
+// app.go assembles the service from a Config and runs it. Dependencies are
+// started by ordered hooks and stopped in reverse order, so the whole service
+// can be run inside tests or embedded in another binary.
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/adminui"
+	"github.com/mikesay/user/api"
+	"github.com/mikesay/user/authz"
+	"github.com/mikesay/user/blobs"
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/db/bulkhead"
+	"github.com/mikesay/user/db/hedge"
+	"github.com/mikesay/user/db/mongodb"
+	"github.com/mikesay/user/db/shadow"
+	"github.com/mikesay/user/db/shard"
+	"github.com/mikesay/user/db/writebuffer"
+	"github.com/mikesay/user/events"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/middleware"
+	"github.com/mikesay/user/outbox"
+	"github.com/mikesay/user/proxyproto"
+	"github.com/mikesay/user/ratelimit"
+	"github.com/mikesay/user/redact"
+	"github.com/mikesay/user/reporting"
+	"github.com/mikesay/user/risk"
+	"github.com/mikesay/user/scim"
+	"github.com/mikesay/user/signup"
+	"github.com/mikesay/user/users"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	zipkinot "github.com/openzipkin-contrib/zipkin-go-opentracing"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/reporter"
+	httpreporter "github.com/openzipkin/zipkin-go/reporter/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	commonMiddleware "github.com/weaveworks/common/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+const (
+	ServiceName = "user"
+	// DefaultShard is the name of the database selected by flag when users
+	// are sharded.
+	DefaultShard = "default"
+	// DefaultAuthPolicy restricts the admin routes, which are always
+	// served, to admins.
+	DefaultAuthPolicy = "/admin/**=admin"
+)
+
+var (
+	HTTPLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time (in seconds) spent serving HTTP requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "path", "status_code", "isWS"})
+
+	HTTPRequestActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_request_active",
+		Help: "The number of HTTP requests currently being handled.",
+	}, []string{"method", "path"})
+
+	HTTPRequestSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "http_request_size_bytes",
+		Help: "Size of HTTP request bodies in bytes.",
+		// Exponential buckets are better for sizes (e.g., 100B to 10MB).
+		Buckets: prometheus.ExponentialBuckets(100, 10, 6),
+	}, []string{"method", "handler"})
+
+	HTTPResponseSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_response_size_bytes",
+		Help:    "Size of HTTP response bodies in bytes.",
+		Buckets: prometheus.ExponentialBuckets(100, 10, 6),
+	}, []string{"method", "handler"})
+
+	fieldKeys    = []string{"method"}
+	requestCount = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "request_count",
+		Help:      "Number of requests received.",
+	}, fieldKeys)
+	requestLatency = kitprometheus.NewSummaryFrom(prometheus.SummaryOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "request_latency_microseconds",
+		Help:      "Total duration of requests in microseconds.",
+	}, fieldKeys)
+)
+
+// connectBackoff is the wait after a first failed database connection,
+// doubled after each further failure up to maxConnectBackoff.
+var (
+	connectBackoff    = time.Second
+	maxConnectBackoff = 30 * time.Second
+)
+
+var (
+	DBConnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_connect_attempts_total",
+		Help: "Number of attempts to connect to the database at startup, by result.",
+	}, []string{"result"})
+
+	DBConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_connected",
+		Help: "Whether the database has been connected to since startup.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(DBConnectAttempts)
+	prometheus.MustRegister(DBConnected)
+	prometheus.MustRegister(HTTPLatency)
+	prometheus.MustRegister(HTTPRequestActive)
+	prometheus.MustRegister(HTTPRequestSizeBytes)
+	prometheus.MustRegister(HTTPResponseSizeBytes)
+	db.Register("mongodb", &mongodb.Mongo{})
+}
+
+// Hook is a step of the service lifecycle. Either function may be nil.
+type Hook struct {
+	Name  string
+	Start func(context.Context) error
+	Stop  func(context.Context) error
+}
+
+// App is the user service, assembled from a Config.
+type App struct {
+	cfg     Config
+	logger  log.Logger
+	hooks   []Hook
+	started int
+	errc    chan error
+
+	usernames users.UsernamePolicy
+	auth      api.AuthPolicy
+	opts      []api.Option
+	signup    *signup.Guard
+	proxies   middleware.Networks
+	// routeLimits bounds the concurrent requests to single routes.
+	routeLimits map[string]int
+	// maxAges are how long the GET responses of routes may be cached.
+	maxAges map[string]time.Duration
+	// slos are the objectives of routes.
+	slos map[string]middleware.SLO
+	// bulkheads bound the database queries of each compartment.
+	bulkheads map[string]bulkhead.Limit
+	// shards maps shard names to the registered databases they are on.
+	shards    map[string]string
+	shardURIs map[string]string
+	// residencies maps residencies to the shards their users are placed on.
+	residencies map[string]string
+	// scim pushes users to downstream SCIM services, if any are set.
+	scim *scim.Client
+	// blobs stores avatars and exports, if a store is set.
+	blobs blobs.Store
+	// outbox catches mail and webhooks in dev mode.
+	outbox *outbox.Outbox
+	smtp   net.Listener
+
+	tracer   stdopentracing.Tracer
+	reporter reporter.Reporter
+	// errors reports server errors and panics, if a tracker is set.
+	errors   *reporting.Queue
+	redact   redact.Fields
+	shadow   *shadow.DB
+	idTarget db.Database
+	writes   *writebuffer.Buffer
+	runner   *jobs.Runner
+	handler  http.Handler
+	readOnly *middleware.ReadOnly
+	listener net.Listener
+	server   *http.Server
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	grpcListener net.Listener
+	grpcServer   *grpc.Server
+	grpcCancel   context.CancelFunc
+	health       *health.Server
+}
+
+// New validates cfg, see Config.Validate, and returns an App ready to be started. Hooks start the
+// tracer, the database, the service and its jobs, then the HTTP and gRPC
+// servers.
+func New(cfg Config) (*App, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	a := &App{cfg: cfg, redact: redact.NewFields(cfg.RedactFields), errc: make(chan error, 1)}
+	if cfg.Logger != nil {
+		a.logger = redact.Logger(cfg.Logger, a.redact)
+	} else {
+		// Lines are redacted beneath the context, so that the caller is
+		// still found at its usual depth.
+		a.logger = redact.Logger(log.NewLogfmtLogger(os.Stderr), a.redact)
+		a.logger = log.With(a.logger, "ts", log.DefaultTimestampUTC)
+		a.logger = log.With(a.logger, "caller", log.DefaultCaller)
+	}
+
+	var err error
+	a.usernames, err = users.NewUsernamePolicy(cfg.UsernameMinLength, cfg.UsernameMaxLength, cfg.UsernameCharset, !cfg.UsernameCaseSensitive, cfg.ReservedUsernames)
+	if err != nil {
+		return nil, fmt.Errorf("invalid username charset: %v", err)
+	}
+	a.opts = append(a.opts, api.WithUsernamePolicy(a.usernames), api.WithHashPool(cfg.HashWorkers, cfg.HashQueue))
+	ages, err := users.ParseAgePolicy(cfg.MinimumAge, cfg.MinimumAges)
+	if err != nil {
+		return nil, err
+	}
+	a.opts = append(a.opts, api.WithAgePolicy(ages))
+	if cfg.Clock != nil {
+		a.opts = append(a.opts, api.WithClock(cfg.Clock))
+	}
+	if cfg.RNG != nil {
+		a.opts = append(a.opts, api.WithRNG(cfg.RNG))
+	}
+	if cfg.LoginCacheTTL > 0 && cfg.LoginCacheSize > 0 {
+		a.opts = append(a.opts, api.WithLoginCache(cfg.LoginCacheTTL, cfg.LoginCacheSize))
+	}
+	if cfg.LoginRisk != "" {
+		switch risk.Decision(cfg.LoginRisk) {
+		case risk.Allow, risk.Challenge, risk.Deny:
+		default:
+			return nil, fmt.Errorf("invalid login risk action %q", cfg.LoginRisk)
+		}
+		var locator risk.Locator
+		if cfg.GeoIPFile != "" {
+			nl, err := risk.NewNetworkLocatorFile(cfg.GeoIPFile)
+			if err != nil {
+				return nil, err
+			}
+			locator = nl
+		}
+		evaluator := risk.NewEvaluator(risk.Decision(cfg.LoginRisk), locator, risk.LogNotifier{Logger: a.logger})
+		a.opts = append(a.opts, api.WithRiskEvaluator(evaluator))
+	}
+	a.auth, err = api.ParseAuthPolicy(cfg.AuthPolicy)
+	if err != nil {
+		return nil, err
+	}
+	a.proxies, err = middleware.ParseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+	if a.routeLimits, err = middleware.ParseRouteLimits(cfg.ConcurrencyRoutes); err != nil {
+		return nil, fmt.Errorf("invalid concurrency routes: %v", err)
+	}
+	if a.maxAges, err = middleware.ParseRouteMaxAges(cfg.CacheRoutes); err != nil {
+		return nil, fmt.Errorf("invalid cache routes: %v", err)
+	}
+	if a.bulkheads, err = bulkhead.ParseLimits(cfg.DBBulkheads); err != nil {
+		return nil, fmt.Errorf("invalid db bulkheads: %v", err)
+	}
+	if a.slos, err = middleware.ParseSLOs(cfg.SLORoutes); err != nil {
+		return nil, fmt.Errorf("invalid slo routes: %v", err)
+	}
+	if a.shards, err = parsePairs(cfg.Shards); err != nil {
+		return nil, fmt.Errorf("invalid shards: %v", err)
+	}
+	if a.shardURIs, err = parsePairs(cfg.ShardMongoURIs); err != nil {
+		return nil, fmt.Errorf("invalid shard mongo uris: %v", err)
+	}
+	for name := range a.shardURIs {
+		a.shards[name] = "mongodb-" + name
+	}
+	if _, ok := a.shards[DefaultShard]; ok {
+		return nil, fmt.Errorf("shard name %v is reserved", DefaultShard)
+	}
+	if a.residencies, err = parsePairs(cfg.ShardResidencies); err != nil {
+		return nil, fmt.Errorf("invalid shard residencies: %v", err)
+	}
+	if cfg.ConfirmDeletes {
+		a.opts = append(a.opts, api.WithDeleteConfirmation(cfg.ConfirmSecret, 5*time.Minute))
+	}
+	if cfg.ImpersonationTTL > 0 {
+		a.opts = append(a.opts, api.WithImpersonation(cfg.ImpersonationSecret, cfg.ImpersonationTTL))
+	}
+	if cfg.SignupAddressLimit > 0 || cfg.SignupSubnetLimit > 0 || cfg.DisposableDomains != "" {
+		a.signup = &signup.Guard{}
+		if cfg.SignupAddressLimit > 0 {
+			a.signup.Addresses = signup.NewLimiter(cfg.SignupAddressLimit, cfg.SignupWindow)
+		}
+		if cfg.SignupSubnetLimit > 0 {
+			a.signup.Subnets = signup.NewLimiter(cfg.SignupSubnetLimit, cfg.SignupWindow)
+		}
+		if cfg.DisposableDomains != "" {
+			a.signup.Disposable = &signup.DomainList{Source: signup.OpenSource(cfg.DisposableDomains)}
+		}
+		a.opts = append(a.opts, api.WithSignupGuard(a.signup))
+	}
+	if db.Retention, err = db.ParseRetention(cfg.Retention); err != nil {
+		return nil, fmt.Errorf("invalid retention: %v", err)
+	}
+	writeLimits, err := ratelimit.ParseLimits(cfg.CustomerWriteLimits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid customer write limits: %v", err)
+	}
+	if len(writeLimits) > 0 {
+		var store ratelimit.Store = ratelimit.NewMemory()
+		if cfg.WriteLimitRedis != "" {
+			if store, err = ratelimit.NewRedis(cfg.WriteLimitRedis, time.Second); err != nil {
+				return nil, err
+			}
+		}
+		a.opts = append(a.opts, api.WithWriteLimits(&ratelimit.Limiter{Store: store, Limits: writeLimits}))
+	}
+	if cfg.SpamAction != "" {
+		a.opts = append(a.opts, api.WithSpamFilter(&signup.SpamFilter{
+			Scorer:    signup.NewHeuristics(cfg.SpamVelocityLimit, cfg.SpamVelocityWindow),
+			Threshold: cfg.SpamThreshold,
+			Action:    signup.Action(cfg.SpamAction),
+		}))
+	}
+	var publisher events.Publisher = events.Log{Logger: log.With(a.logger, "component", "events")}
+	if cfg.Dev {
+		a.outbox = outbox.New(100)
+	}
+	var format events.Format = events.JSON{}
+	if cfg.EventFormat == "cloudevents" {
+		format = events.CloudEvents{Source: cfg.EventSource, TypePrefix: cfg.EventTypePrefix}
+	}
+	if cfg.EventWebhookURL != "" {
+		w := events.NewWebhook(cfg.EventWebhookURL, 5*time.Second)
+		w.Format = format
+		publisher = w
+	} else if a.outbox != nil {
+		a.outbox.Format = format
+		publisher = events.Multi{publisher, a.outbox}
+	}
+	// Codes are only sent to the step-up publisher: the others log or
+	// post every event, which would leak them.
+	if cfg.LoginRisk == string(risk.Challenge) {
+		var codes events.Publisher
+		if cfg.StepUpWebhookURL != "" {
+			w := events.NewWebhook(cfg.StepUpWebhookURL, 5*time.Second)
+			w.Format = format
+			codes = w
+		} else if a.outbox != nil {
+			codes = a.outbox
+		}
+		a.opts = append(a.opts, api.WithStepUp(cfg.StepUpSecret, cfg.StepUpTTL, codes))
+	}
+	if cfg.SentryDSN != "" {
+		sentry, err := reporting.NewSentry(cfg.SentryDSN, cfg.Environment, Version, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		a.errors = reporting.NewQueue(sentry, 100, log.With(a.logger, "component", "reporting"))
+	}
+	targets, err := parseSCIMTargets(cfg.SCIMTargets, cfg.SCIMTargetTokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scim targets: %v", err)
+	}
+	if len(targets) > 0 {
+		a.scim = scim.NewClient(targets, 10*time.Second, log.With(a.logger, "component", "scim"))
+		publisher = events.Multi{publisher, a.scim}
+	}
+	a.opts = append(a.opts, api.WithEvents(publisher))
+	store, err := blobs.Default()
+	if err != nil {
+		return nil, err
+	}
+	if store != nil {
+		a.opts = append(a.opts, api.WithAvatars(store, int64(cfg.AvatarMaxBytes)))
+	}
+	a.blobs = store
+
+	a.hooks = []Hook{
+		{Name: "tracer", Start: a.startTracer, Stop: a.stopTracer},
+		{Name: "database", Start: a.startDatabase, Stop: a.stopDatabase},
+		{Name: "service", Start: a.startService, Stop: a.stopService},
+		{Name: "http", Start: a.startHTTP, Stop: a.stopHTTP},
+		{Name: "grpc", Start: a.startGRPC, Stop: a.stopGRPC},
+	}
+	if a.outbox != nil {
+		a.hooks = append(a.hooks, Hook{Name: "dev", Start: a.startDev, Stop: a.stopDev})
+	}
+	return a, nil
+}
+
+// Append adds hooks started after, and stopped before, those already added.
+func (a *App) Append(hooks ...Hook) {
+	a.hooks = append(a.hooks, hooks...)
+}
+
+// Start runs the start hooks in order. If one fails, those already started
+// are stopped again.
+func (a *App) Start(ctx context.Context) error {
+	for _, h := range a.hooks[a.started:] {
+		if h.Start != nil {
+			if err := h.Start(ctx); err != nil {
+				stopCtx, cancel := context.WithTimeout(context.Background(), a.cfg.ShutdownTimeout)
+				defer cancel()
+				a.Stop(stopCtx)
+				return fmt.Errorf("%s: %w", h.Name, err)
+			}
+		}
+		a.started++
+	}
+	return nil
+}
+
+// Stop runs the stop hooks of started hooks in reverse order.
+func (a *App) Stop(ctx context.Context) error {
+	var errs []error
+	for ; a.started > 0; a.started-- {
+		h := a.hooks[a.started-1]
+		if h.Stop == nil {
+			continue
+		}
+		if err := h.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Addr returns the address the HTTP server listens on, once started.
+func (a *App) Addr() net.Addr {
+	if a.listener == nil {
+		return nil
+	}
+	return a.listener.Addr()
+}
+
+// Err reports the HTTP server failing while running.
+func (a *App) Err() <-chan error {
+	return a.errc
+}
+
+// Reload reloads the database credentials, reconnecting if they changed.
+func (a *App) Reload() error {
+	err := db.Reload()
+	a.logger.Log("reload", "credentials", "err", err)
+	return err
+}
+
+// Run starts the service described by cfg and stops it when ctx is done or
+// the server fails. SIGHUP reloads the database credentials.
+func Run(ctx context.Context, cfg Config) error {
+	a, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	if err := a.Start(ctx); err != nil {
+		return err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var runErr error
+run:
+	for {
+		select {
+		case <-ctx.Done():
+			break run
+		case runErr = <-a.Err():
+			break run
+		case <-hup:
+			a.Reload()
+		}
+	}
+	stopCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	return errors.Join(runErr, a.Stop(stopCtx))
+}
+
+func (a *App) startTracer(ctx context.Context) error {
+	if a.cfg.Zipkin == "" {
+		a.tracer = stdopentracing.NoopTracer{}
+		return nil
+	}
+	// Find service local IP.
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return err
+	}
+	host := strings.Split(conn.LocalAddr().(*net.UDPAddr).String(), ":")[0]
+	conn.Close()
+
+	endpoint, err := zipkin.NewEndpoint(ServiceName, fmt.Sprintf("%v:%v", host, a.cfg.Port))
+	if err != nil {
+		return err
+	}
+	c := a.cfg.Clock
+	if c == nil {
+		c = clock.System{}
+	}
+	sampler, err := newSampler(a.cfg.TraceSampleRate, a.cfg.TraceRateLimit, c)
+	if err != nil {
+		return err
+	}
+	tags := map[string]string{"service.version": Version}
+	if a.cfg.Environment != "" {
+		tags["deployment.environment"] = a.cfg.Environment
+	}
+	a.reporter = httpreporter.NewReporter(a.cfg.Zipkin)
+	if a.cfg.TraceErrors || a.cfg.TraceLatency > 0 {
+		// Every trace is recorded, and sampled once it ends.
+		a.reporter = newTailReporter(a.reporter, sampler, a.cfg.TraceErrors, a.cfg.TraceLatency, c)
+		sampler = zipkin.AlwaysSample
+	}
+	nativeTracer, err := zipkin.NewTracer(a.reporter,
+		zipkin.WithLocalEndpoint(endpoint),
+		zipkin.WithSampler(sampler),
+		zipkin.WithTags(tags),
+	)
+	if err != nil {
+		a.reporter.Close()
+		return err
+	}
+	a.tracer = redact.Tracer(zipkinot.Wrap(nativeTracer), a.redact)
+	return nil
+}
+
+func (a *App) stopTracer(ctx context.Context) error {
+	if a.reporter == nil {
+		return nil
+	}
+	return a.reporter.Close()
+}
+
+// startDatabase connects to the database, retrying with exponential backoff
+// until ctx is done, and runs the startup migrations. Each attempt is traced,
+// counted and logged, showing why an instance is not ready.
+func (a *App) startDatabase(ctx context.Context) error {
+	if a.cfg.ShadowMongoURI != "" {
+		db.Register("mongodb-shadow", &mongodb.Mongo{URI: a.cfg.ShadowMongoURI})
+	}
+	for name, uri := range a.shardURIs {
+		db.Register("mongodb-"+name, &mongodb.Mongo{URI: uri})
+	}
+	if a.cfg.IDMigrationMongoURI != "" {
+		db.Register("mongodb-id-migration", &mongodb.Mongo{URI: a.cfg.IDMigrationMongoURI, Name: a.cfg.IDMigrationMongoDB, Scheme: ids.ULIDScheme})
+	}
+	backoff := connectBackoff
+	for attempt := 1; ; attempt++ {
+		span := a.tracer.StartSpan("connect database")
+		span.SetTag("attempt", attempt)
+		err := a.openDatabase()
+		if err != nil {
+			span.SetTag("error", true)
+			span.LogKV("event", "error", "message", err.Error())
+		}
+		span.Finish()
+		if err == nil {
+			DBConnectAttempts.WithLabelValues("success").Inc()
+			DBConnected.Set(1)
+			break
+		}
+		DBConnectAttempts.WithLabelValues("error").Inc()
+		if err == db.ErrNoDatabaseSelected {
+			return err
+		}
+		a.logger.Log("database", "init", "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxConnectBackoff)
+	}
+
+	if a.cfg.ShadowDatabase != "" {
+		s, err := db.Open(a.cfg.ShadowDatabase)
+		if err != nil {
+			return fmt.Errorf("shadow database: %v", err)
+		}
+		a.shadow = shadow.New(db.DefaultDb, s, 16)
+		a.shadow.OnError = func(method string, err error) {
+			a.logger.Log("shadow", method, "err", err)
+		}
+		// Results hold customer data, so only the method is logged.
+		a.shadow.OnDivergence = func(method, primary, shadow string) {
+			a.logger.Log("shadow", method, "result", "divergence")
+		}
+		db.DefaultDb = a.shadow
+		a.logger.Log("shadow", a.cfg.ShadowDatabase)
+	}
+	if a.cfg.IDMigrationDatabase != "" {
+		t, err := db.Open(a.cfg.IDMigrationDatabase)
+		if err != nil {
+			return fmt.Errorf("id migration database: %v", err)
+		}
+		a.idTarget = t
+	}
+	// Hedges are sent inside the bulkheads, so a hedged read holds a single
+	// worker of its compartment.
+	if a.cfg.DBHedgeDelay > 0 {
+		h := hedge.New(db.DefaultDb, a.cfg.DBHedgeDelay)
+		h.Percentile = a.cfg.DBHedgePercentile
+		db.DefaultDb = h
+		a.logger.Log("db_hedge_delay", a.cfg.DBHedgeDelay, "percentile", a.cfg.DBHedgePercentile)
+	}
+	if len(a.bulkheads) > 0 {
+		db.DefaultDb = bulkhead.New(db.DefaultDb, a.bulkheads)
+		a.logger.Log("db_bulkheads", len(a.bulkheads))
+	}
+	if a.cfg.WriteBufferSize > 0 {
+		a.writes = writebuffer.New(db.DefaultDb, a.cfg.WriteBufferSize)
+		a.writes.Spool = a.cfg.WriteBufferSpool
+		if a.cfg.Clock != nil {
+			a.writes.Clock = a.cfg.Clock
+		}
+		if err := a.writes.Start(); err != nil {
+			return fmt.Errorf("write buffer: %v", err)
+		}
+		db.DefaultDb = a.writes
+		a.logger.Log("write_buffer", a.cfg.WriteBufferSize, "pending", a.writes.Len())
+	}
+
+	if n, err := db.NormalizeUsernames(a.usernames.Normalize); err != nil {
+		a.logger.Log("migration", "usernames", "normalized", n, "err", err)
+	} else if n > 0 {
+		a.logger.Log("migration", "usernames", "normalized", n)
+	}
+	return nil
+}
+
+func (a *App) openDatabase() error {
+	if a.cfg.Database == "" {
+		if err := db.Init(); err != nil {
+			return err
+		}
+	} else {
+		d, err := db.Open(a.cfg.Database)
+		if err != nil {
+			return err
+		}
+		db.DefaultDb = d
+	}
+	return a.openShards()
+}
+
+// openShards spreads users over the configured shards and the opened
+// database, which keeps jobs.
+func (a *App) openShards() error {
+	if len(a.shards) == 0 {
+		return nil
+	}
+	shards := map[string]db.Database{DefaultShard: db.DefaultDb}
+	for name, database := range a.shards {
+		d, err := db.Open(database)
+		if err != nil {
+			return fmt.Errorf("shard %v: %v", name, err)
+		}
+		shards[name] = d
+	}
+	s, err := shard.New(shards, DefaultShard)
+	if err != nil {
+		return err
+	}
+	s.Residencies = a.residencies
+	db.DefaultDb = s
+	a.logger.Log("shards", strings.Join(s.Shards(), ","))
+	return nil
+}
+
+// parsePairs reads name=value pairs, ignoring empty entries.
+func parsePairs(ss []string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, s := range ss {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(s, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("%q is not name=value", s)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// parseSCIMTargets pairs the "name=URL" targets with their "name=token"
+// tokens, returning them by name.
+func parseSCIMTargets(targets, tokens []string) ([]scim.Target, error) {
+	urls, err := parsePairs(targets)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := parsePairs(tokens)
+	if err != nil {
+		return nil, err
+	}
+	for name := range secrets {
+		if _, ok := urls[name]; !ok {
+			return nil, fmt.Errorf("token of %q, which is not a target", name)
+		}
+	}
+	var ts []scim.Target
+	for name, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q is not an http(s) URL", raw)
+		}
+		ts = append(ts, scim.Target{Name: name, URL: raw, Token: secrets[name]})
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Name < ts[j].Name })
+	return ts, nil
+}
+
+func (a *App) stopDatabase(ctx context.Context) error {
+	DBConnected.Set(0)
+	if a.shadow != nil {
+		a.shadow.Wait()
+	}
+	if a.writes != nil {
+		if err := a.writes.Stop(ctx); err != nil {
+			return fmt.Errorf("write buffer: %v", err)
+		}
+	}
+	return nil
+}
+
+// startService builds the service and its HTTP handler, and starts the job
+// runner and the load shedding probe.
+func (a *App) startService(ctx context.Context) error {
+	a.runner = jobs.NewRunner(db.DefaultDb, log.With(a.logger, "component", "jobs"))
+	if a.cfg.Clock != nil {
+		a.runner.Clock = a.cfg.Clock
+	}
+
+	var service api.Service
+	{
+		service = api.NewFixedService(append(a.opts, api.WithJobs(a.runner))...)
+		service = api.LoggingMiddleware(a.logger)(service)
+		service = api.NewInstrumentingService(requestCount, requestLatency, service)
+	}
+	api.RegisterJobs(a.runner, service, a.blobs)
+	if a.idTarget != nil {
+		a.runner.Register("migrate-ids", api.MigrateIDsJob(a.idTarget))
+	}
+	if a.scim != nil {
+		a.runner.Register("scim-reconcile", scim.ReconcileJob(a.scim))
+	}
+
+	// Endpoint domain.
+	endpoints := api.MakeEndpoints(service, a.tracer)
+	if a.cfg.Anonymize {
+		endpoints = endpoints.Anonymized(api.NewAnonymizer(a.cfg.AnonymizeSecret))
+		a.logger.Log("anonymize", "enabled")
+	}
+
+	// Background work runs until the service is stopped, not until the
+	// start context is done.
+	bg, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+
+	var errorReporter reporting.Reporter
+	recovery := middleware.Recover{Logger: log.With(a.logger, "component", "http")}
+	if a.errors != nil {
+		errorReporter = a.errors
+		recovery.Report = api.PanicReporter(a.errors)
+		a.goBackground(func() { a.errors.Run(bg) })
+		a.logger.Log("error_reporting", "sentry")
+	}
+
+	// HTTP router
+	router := api.MakeHTTPHandler(endpoints, a.logger, a.tracer, errorReporter)
+
+	routes := middleware.NewRoutes(router, !a.cfg.MetricsOtherPaths)
+	recovery.Routes = routes
+	// Timing wraps the other middleware, so the time requests spend in them
+	// is told apart from the time in the router.
+	timing := middleware.NewTiming(routes, a.cfg.ServerTiming)
+	httpMiddleware := []commonMiddleware.Interface{
+		commonMiddleware.Instrument{
+			Duration:         HTTPLatency,
+			RouteMatcher:     routes,
+			InflightRequests: HTTPRequestActive,
+			RequestBodySize:  HTTPRequestSizeBytes,
+			ResponseBodySize: HTTPResponseSizeBytes,
+		},
+		// Panics are recovered inside Instrument, so that they are measured
+		// as the 500 responses they become.
+		recovery,
+		timing,
+		middleware.NewClients(a.cfg.KnownClients),
+	}
+	if len(a.slos) > 0 {
+		// Objectives are measured like HTTP latency, including the time
+		// requests spend shed, limited or queued.
+		httpMiddleware = append(httpMiddleware, middleware.NewObjectives(routes, a.slos))
+		a.logger.Log("slo_routes", len(a.slos))
+	}
+	if a.cfg.Compress {
+		// Instrument measures the compressed response sizes.
+		httpMiddleware = append(httpMiddleware, middleware.Compress{})
+		a.logger.Log("compression", "gzip")
+	}
+	if len(a.proxies) > 0 {
+		// Client addresses are restored first, for all later middleware.
+		httpMiddleware = append([]commonMiddleware.Interface{middleware.RealIP{Trusted: a.proxies}}, httpMiddleware...)
+	}
+	if len(a.auth) > 0 || a.cfg.OPAURL != "" {
+		auth := api.NewAuth(service, a.auth, a.cfg.AdminUsers, a.cfg.AdminToken)
+		if a.cfg.OPAURL != "" {
+			auth.Authorizer = authz.NewOPA(a.cfg.OPAURL, a.cfg.OPATimeout)
+			a.logger.Log("authorizer", "opa", "url", a.cfg.OPAURL)
+		}
+		httpMiddleware = append(httpMiddleware, auth)
+		a.logger.Log("auth", "enabled", "rules", len(a.auth))
+	}
+	if a.cfg.ShedMaxInflight > 0 || a.cfg.ShedMaxDBLatency > 0 {
+		shedder := middleware.NewShedder(HTTPRequestActive, float64(a.cfg.ShedMaxInflight), a.cfg.ShedMaxDBLatency)
+		a.goBackground(func() { shedder.Probe(bg, time.Second, db.Ping) })
+		httpMiddleware = append(httpMiddleware, shedder)
+		a.logger.Log("shedding", "enabled", "max_inflight", a.cfg.ShedMaxInflight, "max_db_latency", a.cfg.ShedMaxDBLatency)
+	}
+	if a.cfg.ConcurrencyLimit > 0 || len(a.routeLimits) > 0 {
+		httpMiddleware = append(httpMiddleware, middleware.NewLimiter(routes, a.cfg.ConcurrencyLimit, a.routeLimits, a.cfg.ConcurrencyWait))
+		a.logger.Log("concurrency_limit", a.cfg.ConcurrencyLimit, "routes", len(a.routeLimits))
+	}
+	if len(a.maxAges) > 0 {
+		httpMiddleware = append(httpMiddleware, middleware.NewCache(routes, a.maxAges, a.cfg.ResponseCacheSize))
+		a.logger.Log("cache_routes", len(a.maxAges), "response_cache_size", a.cfg.ResponseCacheSize)
+	}
+	if a.cfg.MirrorURL != "" {
+		mirror, err := middleware.NewMirror(a.cfg.MirrorURL, a.cfg.MirrorPercent, 100)
+		if err != nil {
+			return fmt.Errorf("mirror url: %v", err)
+		}
+		httpMiddleware = append(httpMiddleware, mirror)
+		a.logger.Log("mirror", a.cfg.MirrorURL, "percent", a.cfg.MirrorPercent)
+	}
+	if a.signup != nil && a.signup.Disposable != nil {
+		// The list is loaded in the background, so a slow or failing source
+		// does not hold up startup; registrations are checked against it once
+		// it is read.
+		logger := log.With(a.logger, "component", "signup")
+		a.goBackground(func() {
+			if err := a.signup.Disposable.Refresh(bg); err != nil {
+				logger.Log("disposable_domains", a.cfg.DisposableDomains, "err", err)
+			}
+			a.signup.Disposable.Run(bg, a.cfg.DisposableRefresh, func(err error) {
+				logger.Log("disposable_domains", a.cfg.DisposableDomains, "err", err)
+			})
+		})
+	}
+	if a.cfg.MetricsNamespace != "" || a.cfg.MetricsSubsystem != "" || len(nonEmpty(a.cfg.MetricsDrop)) > 0 || a.cfg.MetricsOpenMetrics {
+		router.Get("metrics").Handler(newMetricsHandler(a.cfg))
+		a.logger.Log("metrics_prefix", metricsPrefix(a.cfg.MetricsNamespace, a.cfg.MetricsSubsystem), "metrics_dropped", len(nonEmpty(a.cfg.MetricsDrop)), "openmetrics", a.cfg.MetricsOpenMetrics)
+	}
+	router.Methods("GET").Path("/admin/info").HandlerFunc(a.serveInfo)
+	if a.cfg.AdminUI {
+		router.Methods("GET").Path(strings.TrimSuffix(adminui.Prefix, "/")).Handler(http.RedirectHandler(adminui.Prefix, http.StatusMovedPermanently))
+		router.Methods("GET").PathPrefix(adminui.Prefix).Handler(adminui.Handler())
+		a.logger.Log("admin_ui", adminui.Prefix)
+	}
+	if a.cfg.SCIM {
+		router.PathPrefix(scim.Prefix).Handler(scim.NewHandler(service, a.cfg.RNG))
+		a.logger.Log("scim", scim.Prefix)
+	}
+	if a.outbox != nil {
+		router.PathPrefix(outbox.Prefix).Handler(a.outbox)
+	}
+	a.readOnly = middleware.NewReadOnly(a.cfg.ReadOnly)
+	router.Methods("GET", "PUT").Path(middleware.ReadOnlyPath).Handler(a.readOnly)
+	httpMiddleware = append(httpMiddleware, a.readOnly)
+	if a.cfg.ReadOnly {
+		a.logger.Log("read_only", "enabled")
+	}
+	if a.cfg.Faults {
+		injector := middleware.NewFaults()
+		router.Methods("GET", "PUT").Path("/admin/faults").Handler(injector)
+		httpMiddleware = append(httpMiddleware, injector)
+		a.logger.Log("faults", "enabled")
+	}
+	a.handler = commonMiddleware.Merge(httpMiddleware...).Wrap(timing.Handler(router))
+
+	a.goBackground(func() { a.runner.Run(bg) })
+	if a.cfg.GCInterval > 0 {
+		params, _ := json.Marshal(api.GCParams{DryRun: a.cfg.GCDryRun})
+		a.goBackground(func() { a.schedule(bg, "gc", params, a.cfg.GCInterval) })
+		a.logger.Log("gc_interval", a.cfg.GCInterval, "dry_run", a.cfg.GCDryRun)
+	}
+	if len(db.Retention) > 0 {
+		a.goBackground(func() { a.schedule(bg, "retention", nil, a.cfg.RetentionInterval) })
+		a.logger.Log("retention", strings.Join(nonEmpty(a.cfg.Retention), ","), "retention_interval", a.cfg.RetentionInterval)
+	}
+	if a.scim != nil {
+		a.goBackground(func() { a.scim.Run(bg) })
+		if a.cfg.SCIMReconcileInterval > 0 {
+			a.goBackground(func() { a.schedule(bg, "scim-reconcile", nil, a.cfg.SCIMReconcileInterval) })
+		}
+		a.logger.Log("scim_targets", len(a.scim.Targets), "reconcile_interval", a.cfg.SCIMReconcileInterval)
+	}
+	return nil
+}
+
+// schedule queues a job of the kind every interval until ctx is done. Each
+// replica queues its own; the scheduled jobs, collecting orphans and
+// reconciling SCIM targets, are harmless to run twice.
+func (a *App) schedule(ctx context.Context, kind string, params json.RawMessage, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := a.runner.Submit(kind, params); err != nil {
+				a.logger.Log("job", kind, "err", err)
+			}
+		}
+	}
+}
+
+func (a *App) goBackground(f func()) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		f()
+	}()
+}
+
+// stopService stops background work, waiting for running jobs until ctx is
+// done.
+func (a *App) stopService(ctx context.Context) error {
+	a.cancel()
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *App) startHTTP(ctx context.Context) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", a.cfg.Port))
+	if err != nil {
+		return err
+	}
+	if a.cfg.ProxyProtocol {
+		pl := &proxyproto.Listener{Listener: l, Timeout: 5 * time.Second}
+		if len(a.proxies) > 0 {
+			pl.Trusted = a.proxies.ContainsAddr
+		}
+		l = pl
+	}
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(a.cfg.HTTP2)
+	protocols.SetUnencryptedHTTP2(a.cfg.H2C)
+	a.server = &http.Server{Handler: a.handler, Protocols: &protocols}
+	if a.cfg.TLSCertFile != "" {
+		// The pair is loaded now so that a bad one fails the start.
+		cert, err := tls.LoadX509KeyPair(a.cfg.TLSCertFile, a.cfg.TLSKeyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		a.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	a.listener = l
+	a.logger.Log("transport", "HTTP", "addr", l.Addr(), "tls", a.server.TLSConfig != nil, "http2", a.cfg.HTTP2, "h2c", a.cfg.H2C)
+	go func() {
+		var err error
+		if a.server.TLSConfig != nil {
+			err = a.server.ServeTLS(l, "", "")
+		} else {
+			err = a.server.Serve(l)
+		}
+		if err != http.ErrServerClosed {
+			a.errc <- err
+		}
+	}()
+	return nil
+}
+
+// stopHTTP stops accepting requests and waits for those in flight.
+func (a *App) stopHTTP(ctx context.Context) error {
+	return a.server.Shutdown(ctx)
+}
+
+// startDev starts the dev mode mail catcher.
+func (a *App) startDev(ctx context.Context) error {
+	l, err := net.Listen("tcp", a.cfg.DevSMTPAddr)
+	if err != nil {
+		return err
+	}
+	a.smtp = l
+	a.logger.Log("dev", "enabled", "outbox", outbox.Prefix, "smtp", l.Addr())
+	go a.outbox.ServeSMTP(l)
+	return nil
+}
+
+// SMTPAddr returns the address the dev mode mail catcher listens on, once
+// started.
+func (a *App) SMTPAddr() net.Addr {
+	if a.smtp == nil {
+		return nil
+	}
+	return a.smtp.Addr()
+}
+
+func (a *App) stopDev(ctx context.Context) error {
+	return a.smtp.Close()
+}
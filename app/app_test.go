@@ -0,0 +1,452 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/outbox"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+)
+
+// memDB is the minimum database the service needs to start and answer
+// health checks.
+type memDB struct {
+	db.Database
+}
+
+func (memDB) Init() error { return nil }
+func (memDB) Ping() error { return nil }
+func (memDB) NormalizeUsernames(func(string) string) (int, error) {
+	return 0, nil
+}
+func (memDB) ClaimJob(string, time.Time, time.Time) (jobs.Job, error) {
+	return jobs.Job{}, jobs.ErrNoJob
+}
+func (memDB) GetUser(string) (users.User, error) {
+	return users.User{}, users.ErrUserNotFound
+}
+func (memDB) GetUserAttributes(*users.User) error { return nil }
+
+// flakyDB fails to initialise until failures runs out.
+type flakyDB struct {
+	memDB
+	failures int
+}
+
+func (f *flakyDB) Init() error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Port = "0"
+	cfg.Zipkin = ""
+	cfg.Database = "apptest"
+	cfg.Logger = log.NewNopLogger()
+	return cfg
+}
+
+func TestAppLifecycle(t *testing.T) {
+	db.Register("apptest", memDB{})
+	cfg := testConfig()
+	cfg.AdminToken = "token"
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	a.Append(Hook{
+		Name:  "probe",
+		Start: func(context.Context) error { order = append(order, "start"); return nil },
+		Stop:  func(context.Context) error { order = append(order, "stop"); return nil },
+	})
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The test's own client lets its connections be closed before
+	// stopping, as the server waits for new connections left idle.
+	client := &http.Client{Transport: &http.Transport{}}
+	url := fmt.Sprintf("http://%v", a.Addr())
+	res, err := client.Get(url + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected healthy service, received %v", res.StatusCode)
+	}
+	if !strings.Contains(res.Header.Get("Server-Timing"), "db;dur=") {
+		t.Errorf("Expected the request's timing, received %q", res.Header.Get("Server-Timing"))
+	}
+	res, err = client.Get(url + "/admin/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected admin routes restricted by default, received %v", res.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", url+"/admin/info", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info Info
+	json.NewDecoder(res.Body).Decode(&info)
+	res.Body.Close()
+	if info.Database != "apptest" || info.Version == "" || info.Features.Tracing {
+		t.Errorf("Expected build and feature report, received %+v", info)
+	}
+	res, err = client.Get(url + "/customers/5a9f4f6c1c4a9c0001a1a1a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected missing customer, received %v", res.StatusCode)
+	}
+
+	client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "start" || order[1] != "stop" {
+		t.Errorf("Expected appended hook to be started and stopped, received %v", order)
+	}
+	if _, err := client.Get(url + "/health"); err == nil {
+		t.Error("Expected server to be stopped")
+	}
+}
+
+func TestDevOutbox(t *testing.T) {
+	db.Register("apptest", memDB{})
+	cfg := testConfig()
+	cfg.Dev = true
+	cfg.DevSMTPAddr = "127.0.0.1:0"
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop(context.Background())
+	msg := "Subject: Verify your email\r\n\r\nClick the link.\r\n"
+	if err := smtp.SendMail(a.SMTPAddr().String(), nil, "shop@example.com", []string{"eve@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("http://%v%v", a.Addr(), outbox.Prefix)
+	res, err := http.Post(url+"/webhook", "application/json", strings.NewReader(`{"ok":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ms []outbox.Message
+	json.NewDecoder(res.Body).Decode(&ms)
+	res.Body.Close()
+	if len(ms) != 2 || ms[0].Body != `{"ok":true}` || ms[1].Subject != "Verify your email" {
+		t.Errorf("Expected the webhook and the mail caught, received %+v", ms)
+	}
+	if info := a.Info(); !info.Features.Dev || info.Features.EventBus != "outbox" {
+		t.Errorf("Expected dev mode reported, received %+v", info.Features)
+	}
+}
+
+// selfSigned writes a certificate for 127.0.0.1 and its key to dir.
+func selfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	return certFile, keyFile
+}
+
+func TestHTTP2(t *testing.T) {
+	db.Register("apptest", memDB{})
+	cfg := testConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = selfSigned(t, t.TempDir())
+	cfg.H2C = true
+	for _, c := range []struct {
+		name      string
+		tls       bool
+		scheme    string
+		protocols func(*http.Protocols)
+	}{
+		{"tls", true, "https", func(p *http.Protocols) { p.SetHTTP2(true) }},
+		{"h2c", false, "http", func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) }},
+	} {
+		cfg := cfg
+		if !c.tls {
+			cfg.TLSCertFile, cfg.TLSKeyFile = "", ""
+		}
+		a, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, Protocols: new(http.Protocols)}
+		c.protocols(tr.Protocols)
+		res, err := (&http.Client{Transport: tr}).Get(fmt.Sprintf("%v://%v/health", c.scheme, a.Addr()))
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		res.Body.Close()
+		if res.ProtoMajor != 2 {
+			t.Errorf("%v: Expected HTTP/2, received %v", c.name, res.Proto)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		a.Stop(ctx)
+		cancel()
+	}
+}
+
+func TestAppStartFailure(t *testing.T) {
+	db.Register("apptest", memDB{})
+	a, err := New(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	a.Append(
+		Hook{Name: "first", Stop: func(context.Context) error { stopped = true; return nil }},
+		Hook{Name: "broken", Start: func(context.Context) error { return errors.New("broken") }},
+	)
+	if err := a.Start(context.Background()); err == nil {
+		t.Fatal("Expected start to fail")
+	}
+	if !stopped {
+		t.Error("Expected started hooks to be stopped after a failure")
+	}
+	if a.started != 0 {
+		t.Errorf("Expected every hook to be stopped, %v still running", a.started)
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.LoginRisk = "maybe"
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected invalid login risk to be refused")
+	}
+	cfg = testConfig()
+	cfg.MinimumAges = []string{"us=old"}
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected invalid minimum ages to be refused")
+	}
+	cfg = testConfig()
+	cfg.TrustedProxies = []string{"10.0.0.0/33"}
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected invalid trusted proxies to be refused")
+	}
+	for _, shards := range [][]string{{"eu"}, {"default=mongodb"}} {
+		cfg = testConfig()
+		cfg.Shards = shards
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected shards %v to be refused", shards)
+		}
+	}
+	for _, tokens := range [][]string{{"crm=token"}, {"idp"}} {
+		cfg = testConfig()
+		cfg.SCIMTargets = []string{"idp=https://idp.example.com/scim/v2"}
+		cfg.SCIMTargetTokens = tokens
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected scim target tokens %v to be refused", tokens)
+		}
+	}
+	cfg = testConfig()
+	cfg.SCIMTargets = []string{"idp=idp.example.com"}
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected a scim target without a scheme to be refused")
+	}
+}
+
+func TestParseSCIMTargets(t *testing.T) {
+	ts, err := parseSCIMTargets([]string{"idp=https://idp.example.com/scim/v2", "crm=http://crm:8080/scim", ""}, []string{"idp=secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ts) != "[{crm http://crm:8080/scim } {idp https://idp.example.com/scim/v2 secret}]" {
+		t.Errorf("Expected the targets by name with their tokens, received %v", ts)
+	}
+}
+
+func TestLogsRedacted(t *testing.T) {
+	db.Register("apptest", memDB{})
+	var buf bytes.Buffer
+	cfg := testConfig()
+	cfg.Logger = log.NewLogfmtLogger(&buf)
+	cfg.RedactFields = []string{"password"}
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.logger.Log("method", "Login", "password", "hunter2")
+	if s := buf.String(); strings.Contains(s, "hunter2") || !strings.Contains(s, "method=Login") {
+		t.Errorf("Expected the password masked, received %q", s)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testConfig().Validate(); err != nil {
+		t.Fatalf("Expected the test config valid, received %v", err)
+	}
+	cfg := testConfig()
+	cfg.LoginRisk = "maybe"
+	cfg.AuthPolicy = ""
+	cfg.AdminToken = "token"
+	cfg.AdminUI = true
+	cfg.SCIM = true
+	cfg.Anonymize = true
+	cfg.Retention = []string{"audit=100y"}
+	cfg.RetentionInterval = time.Hour
+	cfg.ImpersonationTTL = time.Minute
+	cfg.OPAURL = "localhost:8181/v1/data/user/allow"
+	cfg.IDMigrationMongoURI = "mongodb://copy:27017"
+	cfg.ResponseCacheSize = 100
+	cfg.MirrorPercent = 120
+	cfg.TraceRateLimit = -1
+	err := cfg.Validate()
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Expected a ConfigError, received %v", err)
+	}
+	var flags []string
+	for _, p := range cerr.Problems {
+		flags = append(flags, p.Flag)
+	}
+	if fmt.Sprint(flags) != "[login-risk trace-rate-limit scim auth-policy admin-token admin-ui impersonation-ttl scim opa-url id-migration-mongo-uri response-cache-size mirror-percent retention]" {
+		t.Errorf("Expected every problem reported, received %v", flags)
+	}
+	if _, err := New(cfg); !errors.As(err, &cerr) {
+		t.Errorf("Expected New to refuse the config, received %v", err)
+	}
+}
+
+func TestGRPCHealth(t *testing.T) {
+	db.Register("apptest", memDB{})
+	cfg := testConfig()
+	cfg.GRPCPort = "0"
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop(context.Background())
+
+	conn, err := grpc.NewClient(a.GRPCAddr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, service := range []string{"", ServiceName} {
+		res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Expected %q to be serving, received %v", service, res.Status)
+		}
+	}
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{}})
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(res.GetListServicesResponse().GetService()); n < 2 {
+		t.Errorf("Expected health and reflection services to be listed, received %v", n)
+	}
+}
+
+func metricValue(m prometheus.Metric) float64 {
+	var d dto.Metric
+	m.Write(&d)
+	return d.GetCounter().GetValue() + d.GetGauge().GetValue()
+}
+
+func TestDatabaseRetried(t *testing.T) {
+	connectBackoff = time.Millisecond
+	db.Register("apptest", &flakyDB{failures: 2})
+	a, err := New(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := metricValue(DBConnectAttempts.WithLabelValues("error"))
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop(context.Background())
+	if n := metricValue(DBConnectAttempts.WithLabelValues("error")) - failed; n != 2 {
+		t.Errorf("Expected two failed attempts, received %v", n)
+	}
+	if metricValue(DBConnected) != 1 {
+		t.Error("Expected database to be reported connected")
+	}
+}
@@ -0,0 +1,594 @@
+package app
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/redact"
+	"github.com/mikesay/user/users"
+)
+
+// Config holds the settings of the service. Database and backend specific
+// settings are flags of their own packages.
+type Config struct {
+	// Port is listened on for HTTP. "0" picks a free port, see App.Addr.
+	Port string
+	// TLSCertFile and TLSKeyFile, if set, serve HTTP over TLS, negotiating
+	// HTTP/2 unless HTTP2 is off. H2C accepts cleartext HTTP/2 from clients
+	// with prior knowledge, for in-cluster traffic.
+	TLSCertFile string
+	TLSKeyFile  string
+	HTTP2       bool
+	H2C         bool
+	// GRPCPort is listened on for the gRPC health and reflection services.
+	// Empty disables gRPC.
+	GRPCPort string
+	// Zipkin is the address spans are reported to. Empty disables tracing.
+	Zipkin string
+	// TraceSampleRate is the fraction of new traces recorded, of which at
+	// most TraceRateLimit a second are kept unless it is 0.
+	TraceSampleRate float64
+	TraceRateLimit  float64
+	// TraceErrors keeps the traces of requests failing with a server
+	// error, and TraceLatency those taking it or more unless it is 0, even
+	// if they are not sampled. Traces are then held until their request
+	// ends, and sampled by these and the rate.
+	TraceErrors  bool
+	TraceLatency time.Duration
+	// Environment names the deployment, such as production, on every span.
+	Environment string
+	// SentryDSN is the Sentry project server errors and panics are reported
+	// to, tagged with Environment. Empty disables reporting.
+	SentryDSN string
+	// RedactFields are the field names whose values are masked in every log
+	// line and span tag, see package redact.
+	RedactFields []string
+	// Database is the registered database to use, overriding the -database
+	// flag if set.
+	Database string
+	Faults   bool
+	// ReadOnly starts the service refusing mutating requests. It can be
+	// switched at /admin/read-only.
+	ReadOnly bool
+
+	LoginRisk      string
+	GeoIPFile      string
+	ConfirmDeletes bool
+	ConfirmSecret  string
+
+	// StepUpWebhookURL is posted the one-time codes of logins challenged
+	// for their risk, as login.challenged events, for the notification
+	// service to send. In dev mode they are caught by the outbox instead.
+	// Codes are valid for StepUpTTL and their challenges signed with
+	// StepUpSecret.
+	StepUpWebhookURL string
+	StepUpTTL        time.Duration
+	StepUpSecret     string
+
+	// ImpersonationTTL is how long the tokens admins impersonate customers
+	// with at /admin/impersonate/{id} are valid. Zero disables
+	// impersonation. ImpersonationSecret signs them.
+	ImpersonationTTL    time.Duration
+	ImpersonationSecret string
+
+	UsernameMinLength     int
+	UsernameMaxLength     int
+	UsernameCharset       string
+	UsernameCaseSensitive bool
+	ReservedUsernames     []string
+
+	// MinimumAge customers must be to register, unless MinimumAges, given
+	// as residency=age pairs, sets another for their residency. Zero
+	// leaves dates of birth optional.
+	MinimumAge  int
+	MinimumAges []string
+
+	// AuthPolicy declares the access each route requires, see
+	// api.ParseAuthPolicy. It must restrict /admin/** to admins, which it
+	// does by default.
+	AuthPolicy string
+	AdminUsers []string
+	AdminToken string
+	// AdminUI serves the embedded admin UI at /admin/ui/. The auth policy
+	// must require admin access to it.
+	AdminUI bool
+	// SCIM serves the SCIM 2.0 Users endpoints at /scim/v2/, for identity
+	// providers to provision customers. The auth policy must require admin
+	// access to them.
+	SCIM bool
+	// OPAURL is the Open Policy Agent decision every request is authorized
+	// with, after the auth policy authenticates it, such as
+	// http://localhost:8181/v1/data/user/allow. Empty leaves authorization
+	// to the auth policy.
+	OPAURL     string
+	OPATimeout time.Duration
+
+	ShadowDatabase string
+	ShadowMongoURI string
+	// IDMigrationDatabase is the registered database the migrate-ids job
+	// copies customers to under new IDs. Empty does not offer the job.
+	IDMigrationDatabase string
+	// IDMigrationMongoURI, if set, registers the database IDMigrationMongoDB
+	// of that Mongo, creating ULIDs, as mongodb-id-migration.
+	IDMigrationMongoURI string
+	IDMigrationMongoDB  string
+
+	// Shards spread users over further registered databases, given as
+	// name=database pairs, with the database as the shard named "default".
+	// Users are placed on the shard named by their residency, or by hash.
+	// ShardMongoURIs adds name=URI pairs as Mongo shards. ShardResidencies
+	// maps residencies, given as residency=shard pairs, to the shards of
+	// their region; users with a residency naming no shard are refused.
+	Shards           []string
+	ShardMongoURIs   []string
+	ShardResidencies []string
+
+	Anonymize       bool
+	AnonymizeSecret string
+
+	HashWorkers int
+	HashQueue   int
+
+	// LoginCacheTTL is how long the credentials of up to LoginCacheSize
+	// users are kept for logins. 0 disables the cache.
+	LoginCacheTTL  time.Duration
+	LoginCacheSize int
+
+	ShedMaxInflight  int
+	ShedMaxDBLatency time.Duration
+
+	// DBBulkheads bounds kinds of database queries, as
+	// compartment=workers/queue pairs.
+	DBBulkheads []string
+
+	// DBHedgeDelay, if not 0, sends reads logins wait on a second time when
+	// the first has not answered within it or, once enough reads are timed,
+	// within DBHedgePercentile of recent read latencies, if set.
+	DBHedgeDelay      time.Duration
+	DBHedgePercentile float64
+
+	// WriteBufferSize, if not 0, buffers up to that many login history and
+	// last login writes while the database is unreachable, saving them to
+	// WriteBufferSpool on shutdown if it is set.
+	WriteBufferSize  int
+	WriteBufferSpool string
+
+	// ConcurrencyLimit bounds the requests served at once, and
+	// ConcurrencyRoutes, as route=limit pairs, those to single routes.
+	// Requests wait up to ConcurrencyWait for a slot before being refused.
+	ConcurrencyLimit  int
+	ConcurrencyRoutes []string
+	ConcurrencyWait   time.Duration
+
+	// CacheRoutes gives route=duration max ages to the GET responses of
+	// routes, and ResponseCacheSize how many of them are cached in process.
+	CacheRoutes       []string
+	ResponseCacheSize int
+
+	// SLORoutes gives route=latency/availability objectives, counted in
+	// http_slo_requests_total.
+	SLORoutes []string
+
+	// TrustedProxies lists the CIDRs of proxies whose X-Forwarded-For and
+	// PROXY protocol headers give the client address. With ProxyProtocol
+	// and no TrustedProxies, PROXY headers are accepted from any peer.
+	TrustedProxies []string
+	ProxyProtocol  bool
+
+	// KnownClients are the client names, from X-Client or the User-Agent,
+	// counted under their own name in http_requests_by_client_total.
+	KnownClients []string
+
+	// MirrorURL is the base URL of a canary receiving a copy of
+	// MirrorPercent percent of read requests. Empty disables mirroring.
+	MirrorURL     string
+	MirrorPercent int
+
+	// Compress gzips text and JSON responses for clients accepting it.
+	Compress bool
+
+	// MetricsOtherPaths labels requests matching no route as "other" in
+	// HTTP metrics, rather than by their path.
+	MetricsOtherPaths bool
+
+	// MetricsNamespace and MetricsSubsystem prefix the names of exposed
+	// metrics, so instances for several brands can share one Prometheus.
+	// MetricsDrop names metrics, without the prefix, left out of /metrics,
+	// such as high-cardinality histograms. MetricsOpenMetrics serves the
+	// OpenMetrics format to scrapers asking for it; exemplars are never
+	// exposed.
+	MetricsNamespace   string
+	MetricsSubsystem   string
+	MetricsDrop        []string
+	MetricsOpenMetrics bool
+
+	// ServerTiming sends the time requests spent in the database,
+	// serialization, their handler and middleware in a Server-Timing
+	// header. The phases are measured in metrics either way.
+	ServerTiming bool
+
+	AvatarMaxBytes int
+
+	// SignupAddressLimit and SignupSubnetLimit bound registrations per
+	// client address and per subnet in each SignupWindow. Zero disables.
+	SignupAddressLimit int
+	SignupSubnetLimit  int
+	SignupWindow       time.Duration
+	// DisposableDomains is a file or URL listing email domains refused at
+	// registration. Empty disables the check.
+	DisposableDomains string
+	DisposableRefresh time.Duration
+	// CustomerWriteLimits gives operation=count/duration limits on the
+	// cards and addresses each customer adds and their profile updates,
+	// kept in Redis at WriteLimitRedis if set, else in each replica.
+	CustomerWriteLimits []string
+	WriteLimitRedis     string
+	// SpamAction is taken on registrations scoring SpamThreshold or more:
+	// flag, challenge or reject. Empty disables spam scoring. More than
+	// SpamVelocityLimit registrations per address in each SpamVelocityWindow
+	// raise the velocity signal; zero disables it.
+	SpamAction         string
+	SpamThreshold      float64
+	SpamVelocityLimit  int
+	SpamVelocityWindow time.Duration
+
+	// GCInterval is how often a gc job collecting orphaned addresses and
+	// cards is queued. Zero disables it; jobs can still be queued at
+	// /admin/gc. With GCDryRun the orphans are only reported.
+	GCInterval time.Duration
+	GCDryRun   bool
+	// Retention gives kind=age limits on how long login history and the
+	// audit trail are kept, such as "login-history=90d". Backends expire
+	// what they can themselves; a retention job queued every
+	// RetentionInterval purges the rest.
+	Retention         []string
+	RetentionInterval time.Duration
+
+	// EventWebhookURL is posted events, such as cards flagged as suspected
+	// fraud, as JSON. Empty logs them instead.
+	EventWebhookURL string
+	// EventFormat is json, or cloudevents to post CloudEvents 1.0 with
+	// EventSource as their source and types prefixed with EventTypePrefix.
+	EventFormat     string
+	EventSource     string
+	EventTypePrefix string
+
+	// SCIMTargets are downstream SCIM services the users are pushed to as
+	// they change, given as "name=URL" pairs, with bearer tokens given as
+	// "name=token" pairs in SCIMTargetTokens. SCIMReconcileInterval is how
+	// often a scim-reconcile job catching the targets up is queued; zero
+	// disables it.
+	SCIMTargets           []string
+	SCIMTargetTokens      []string
+	SCIMReconcileInterval time.Duration
+
+	// Dev catches the mail sent to DevSMTPAddr and the webhooks posted to
+	// /dev/outbox/webhook, showing them at /dev/outbox. Events are caught
+	// too unless EventWebhookURL is set.
+	Dev         bool
+	DevSMTPAddr string
+
+	// ShutdownTimeout bounds how long stopping may take.
+	ShutdownTimeout time.Duration
+	// Logger defaults to logfmt on stderr.
+	Logger log.Logger
+	// Clock and RNG, if set, replace the wall clock and clock.Random in the
+	// service, so programs embedding it can test expiry deterministically.
+	Clock clock.Clock
+	RNG   clock.RNG
+}
+
+// DefaultConfig returns the default settings, overridden by the environment.
+func DefaultConfig() Config {
+	return Config{
+		Port:                  env("PORT", "8084"),
+		GRPCPort:              os.Getenv("GRPC_PORT"),
+		TLSCertFile:           os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:            os.Getenv("TLS_KEY_FILE"),
+		HTTP2:                 os.Getenv("HTTP2") != "false",
+		H2C:                   os.Getenv("H2C") == "true",
+		Zipkin:                os.Getenv("ZIPKIN"),
+		TraceSampleRate:       envFloat("TRACE_SAMPLE_RATE", 1),
+		TraceRateLimit:        envFloat("TRACE_RATE_LIMIT", 0),
+		TraceErrors:           os.Getenv("TRACE_ERRORS") == "true",
+		TraceLatency:          envDuration("TRACE_LATENCY", 0),
+		Environment:           os.Getenv("ENVIRONMENT"),
+		SentryDSN:             os.Getenv("SENTRY_DSN"),
+		RedactFields:          envList("REDACT_FIELDS", redact.DefaultFields),
+		Faults:                os.Getenv("FAULT_INJECTION") == "true",
+		ReadOnly:              os.Getenv("READ_ONLY") == "true",
+		LoginRisk:             os.Getenv("LOGIN_RISK"),
+		GeoIPFile:             os.Getenv("GEOIP_FILE"),
+		ConfirmDeletes:        os.Getenv("CONFIRM_DELETES") == "true",
+		ConfirmSecret:         os.Getenv("CONFIRM_SECRET"),
+		StepUpWebhookURL:      os.Getenv("STEP_UP_WEBHOOK_URL"),
+		StepUpTTL:             envDuration("STEP_UP_TTL", 10*time.Minute),
+		StepUpSecret:          os.Getenv("STEP_UP_SECRET"),
+		ImpersonationTTL:      envDuration("IMPERSONATION_TTL", 0),
+		ImpersonationSecret:   os.Getenv("IMPERSONATION_SECRET"),
+		UsernameMinLength:     envInt("USERNAME_MIN_LENGTH", 3),
+		UsernameMaxLength:     envInt("USERNAME_MAX_LENGTH", 32),
+		UsernameCharset:       env("USERNAME_CHARSET", users.DefaultUsernameCharset),
+		UsernameCaseSensitive: os.Getenv("USERNAME_CASE_SENSITIVE") == "true",
+		ReservedUsernames:     strings.Split(env("RESERVED_USERNAMES", strings.Join(users.DefaultReservedUsernames, ",")), ","),
+		MinimumAge:            envInt("MINIMUM_AGE", 0),
+		MinimumAges:           strings.Split(os.Getenv("MINIMUM_AGES"), ","),
+		AuthPolicy:            env("AUTH_POLICY", DefaultAuthPolicy),
+		AdminUsers:            strings.Split(os.Getenv("ADMIN_USERS"), ","),
+		AdminToken:            os.Getenv("ADMIN_TOKEN"),
+		AdminUI:               os.Getenv("ADMIN_UI") == "true",
+		SCIM:                  os.Getenv("SCIM") == "true",
+		OPAURL:                os.Getenv("OPA_URL"),
+		OPATimeout:            envDuration("OPA_TIMEOUT", 500*time.Millisecond),
+		ShadowDatabase:        os.Getenv("SHADOW_DATABASE"),
+		ShadowMongoURI:        os.Getenv("SHADOW_MONGO_URI"),
+		IDMigrationDatabase:   os.Getenv("ID_MIGRATION_DATABASE"),
+		IDMigrationMongoURI:   os.Getenv("ID_MIGRATION_MONGO_URI"),
+		IDMigrationMongoDB:    env("ID_MIGRATION_MONGO_DATABASE", "users"),
+		Shards:                strings.Split(os.Getenv("SHARDS"), ","),
+		ShardMongoURIs:        strings.Split(os.Getenv("SHARD_MONGO_URIS"), ","),
+		ShardResidencies:      strings.Split(os.Getenv("SHARD_RESIDENCIES"), ","),
+		Anonymize:             os.Getenv("ANONYMIZE") == "true",
+		AnonymizeSecret:       os.Getenv("ANONYMIZE_SECRET"),
+		HashWorkers:           envInt("HASH_WORKERS", runtime.NumCPU()),
+		HashQueue:             envInt("HASH_QUEUE", 100),
+		LoginCacheTTL:         envDuration("LOGIN_CACHE_TTL", 30*time.Second),
+		LoginCacheSize:        envInt("LOGIN_CACHE_SIZE", 10000),
+		ShedMaxInflight:       envInt("SHED_MAX_INFLIGHT", 0),
+		ShedMaxDBLatency:      envDuration("SHED_MAX_DB_LATENCY", 0),
+		ConcurrencyLimit:      envInt("CONCURRENCY_LIMIT", 0),
+		ConcurrencyRoutes:     strings.Split(os.Getenv("CONCURRENCY_ROUTES"), ","),
+		ConcurrencyWait:       envDuration("CONCURRENCY_WAIT", 100*time.Millisecond),
+		CacheRoutes:           strings.Split(os.Getenv("CACHE_ROUTES"), ","),
+		ResponseCacheSize:     envInt("RESPONSE_CACHE_SIZE", 0),
+		SLORoutes:             strings.Split(os.Getenv("SLO_ROUTES"), ","),
+		DBBulkheads:           strings.Split(os.Getenv("DB_BULKHEADS"), ","),
+		DBHedgeDelay:          envDuration("DB_HEDGE_DELAY", 0),
+		DBHedgePercentile:     envFloat("DB_HEDGE_PERCENTILE", 0),
+		WriteBufferSize:       envInt("WRITE_BUFFER_SIZE", 0),
+		WriteBufferSpool:      os.Getenv("WRITE_BUFFER_SPOOL"),
+		TrustedProxies:        strings.Split(os.Getenv("TRUSTED_PROXIES"), ","),
+		ProxyProtocol:         os.Getenv("PROXY_PROTOCOL") == "true",
+		KnownClients:          strings.Split(env("KNOWN_CLIENTS", "front-end"), ","),
+		MirrorURL:             os.Getenv("MIRROR_URL"),
+		MirrorPercent:         envInt("MIRROR_PERCENT", 100),
+		Compress:              os.Getenv("COMPRESS_RESPONSES") == "true",
+		GCInterval:            envDuration("GC_INTERVAL", 0),
+		GCDryRun:              os.Getenv("GC_DRY_RUN") == "true",
+		Retention:             strings.Split(os.Getenv("RETENTION"), ","),
+		RetentionInterval:     envDuration("RETENTION_INTERVAL", time.Hour),
+		MetricsOtherPaths:     os.Getenv("METRICS_OTHER_PATHS") != "false",
+		MetricsNamespace:      os.Getenv("METRICS_NAMESPACE"),
+		MetricsSubsystem:      os.Getenv("METRICS_SUBSYSTEM"),
+		MetricsDrop:           strings.Split(os.Getenv("METRICS_DROP"), ","),
+		MetricsOpenMetrics:    os.Getenv("METRICS_OPENMETRICS") == "true",
+		ServerTiming:          os.Getenv("SERVER_TIMING") != "false",
+		AvatarMaxBytes:        envInt("AVATAR_MAX_BYTES", 1<<20),
+		SignupAddressLimit:    envInt("SIGNUP_ADDRESS_LIMIT", 0),
+		SignupSubnetLimit:     envInt("SIGNUP_SUBNET_LIMIT", 0),
+		SignupWindow:          envDuration("SIGNUP_WINDOW", time.Hour),
+		DisposableDomains:     os.Getenv("DISPOSABLE_DOMAINS"),
+		DisposableRefresh:     envDuration("DISPOSABLE_DOMAINS_REFRESH", 24*time.Hour),
+		CustomerWriteLimits:   strings.Split(os.Getenv("CUSTOMER_WRITE_LIMITS"), ","),
+		WriteLimitRedis:       os.Getenv("WRITE_LIMIT_REDIS"),
+		SpamAction:            os.Getenv("SPAM_ACTION"),
+		SpamThreshold:         envFloat("SPAM_THRESHOLD", 1),
+		SpamVelocityLimit:     envInt("SPAM_VELOCITY_LIMIT", 3),
+		SpamVelocityWindow:    envDuration("SPAM_VELOCITY_WINDOW", time.Hour),
+		EventWebhookURL:       os.Getenv("EVENT_WEBHOOK_URL"),
+		EventFormat:           env("EVENT_FORMAT", "json"),
+		EventSource:           env("EVENT_SOURCE", "/"+ServiceName),
+		EventTypePrefix:       os.Getenv("EVENT_TYPE_PREFIX"),
+		SCIMTargets:           strings.Split(os.Getenv("SCIM_TARGETS"), ","),
+		SCIMTargetTokens:      strings.Split(os.Getenv("SCIM_TARGET_TOKENS"), ","),
+		SCIMReconcileInterval: envDuration("SCIM_RECONCILE_INTERVAL", 24*time.Hour),
+		ShutdownTimeout:       envDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		Dev:                   os.Getenv("DEV") == "true",
+		DevSMTPAddr:           env("DEV_SMTP_ADDR", "localhost:2525"),
+	}
+}
+
+// RegisterFlags binds c to command line flags, using its values as defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Zipkin, "zipkin", c.Zipkin, "Zipkin address")
+	fs.Float64Var(&c.TraceSampleRate, "trace-sample-rate", c.TraceSampleRate, "Fraction of new traces recorded, from 0 to 1")
+	fs.Float64Var(&c.TraceRateLimit, "trace-rate-limit", c.TraceRateLimit, "Most new traces recorded a second. 0 sets no limit")
+	fs.BoolVar(&c.TraceErrors, "trace-errors", c.TraceErrors, "Record the traces of requests failing with a server error, even if they are not sampled")
+	fs.DurationVar(&c.TraceLatency, "trace-latency", c.TraceLatency, "Record the traces of requests taking this long or more, even if they are not sampled. 0 disables")
+	fs.StringVar(&c.Environment, "environment", c.Environment, "Deployment environment, such as production, tagged on every span")
+	fs.StringVar(&c.SentryDSN, "sentry-dsn", c.SentryDSN, "Sentry DSN server errors and panics are reported to, such as https://key@o1.ingest.sentry.io/42. Empty disables reporting")
+	fs.Func("redact-fields", "Comma separated field names masked in logs and span tags, ignoring case, \"_\", \"-\" and \".\" (default "+strings.Join(c.RedactFields, ",")+")", func(s string) error {
+		c.RedactFields = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&c.Port, "port", c.Port, "Port on which to run")
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", c.TLSCertFile, "PEM certificate chain to serve HTTP over TLS with. Empty serves cleartext")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", c.TLSKeyFile, "PEM private key of -tls-cert-file")
+	fs.BoolVar(&c.HTTP2, "http2", c.HTTP2, "Negotiate HTTP/2 with TLS clients")
+	fs.BoolVar(&c.H2C, "h2c", c.H2C, "Accept cleartext HTTP/2 from clients with prior knowledge, for in-cluster traffic")
+	fs.StringVar(&c.GRPCPort, "grpc-port", c.GRPCPort, "Port serving gRPC health checks and reflection. Empty disables gRPC")
+	fs.StringVar(&c.LoginRisk, "login-risk", c.LoginRisk, "Action for suspicious logins: allow, challenge or deny. Empty disables risk evaluation")
+	fs.StringVar(&c.GeoIPFile, "geoip-file", c.GeoIPFile, "CSV of cidr,country,lat,lon used to locate login addresses")
+	fs.StringVar(&c.StepUpWebhookURL, "step-up-webhook-url", c.StepUpWebhookURL, "URL the one-time codes of challenged logins are posted to, for the notification service to send")
+	fs.DurationVar(&c.StepUpTTL, "step-up-ttl", c.StepUpTTL, "How long the one-time codes of challenged logins are valid")
+	fs.StringVar(&c.StepUpSecret, "step-up-secret", c.StepUpSecret, "Secret signing login challenges. Must be shared by all replicas; random if empty")
+	fs.BoolVar(&c.ConfirmDeletes, "confirm-deletes", c.ConfirmDeletes, "Require customer deletes to be confirmed with a token from a first DELETE call")
+	fs.StringVar(&c.ConfirmSecret, "confirm-secret", c.ConfirmSecret, "Secret signing delete confirmations. Must be shared by all replicas; random if empty")
+	fs.DurationVar(&c.ImpersonationTTL, "impersonation-ttl", c.ImpersonationTTL, "How long the tokens admins impersonate customers with at /admin/impersonate/{id} are valid. 0 disables impersonation")
+	fs.StringVar(&c.ImpersonationSecret, "impersonation-secret", c.ImpersonationSecret, "Secret signing impersonation tokens. Must be shared by all replicas; random if empty")
+	fs.BoolVar(&c.Faults, "fault-injection", c.Faults, "Enable the fault injection admin endpoint")
+	fs.BoolVar(&c.ReadOnly, "read-only", c.ReadOnly, "Refuse mutating requests with 503 while serving reads, for database maintenance. Switched at runtime through /admin/read-only")
+	fs.IntVar(&c.UsernameMinLength, "username-min-length", c.UsernameMinLength, "Minimum username length")
+	fs.IntVar(&c.UsernameMaxLength, "username-max-length", c.UsernameMaxLength, "Maximum username length")
+	fs.StringVar(&c.UsernameCharset, "username-charset", c.UsernameCharset, "Regular expression matching valid usernames")
+	fs.BoolVar(&c.UsernameCaseSensitive, "username-case-sensitive", c.UsernameCaseSensitive, "Treat usernames differing only in case as different users")
+	fs.Func("reserved-usernames", "Comma separated usernames that cannot be registered (default "+strings.Join(c.ReservedUsernames, ",")+")", func(s string) error {
+		c.ReservedUsernames = strings.Split(s, ",")
+		return nil
+	})
+	fs.IntVar(&c.MinimumAge, "minimum-age", c.MinimumAge, "Minimum age customers must be to register. 0 leaves dates of birth optional")
+	fs.Func("minimum-ages", `Comma separated "residency=age" minimum ages overriding -minimum-age for customers registering with that residency`, func(s string) error {
+		c.MinimumAges = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&c.AuthPolicy, "auth-policy", c.AuthPolicy, `Comma separated "[METHOD ]PATH=anonymous|user|admin" rules, first match applies. Unmatched routes are anonymous. /admin/** must require admin`)
+	fs.Func("admin-users", "Comma separated usernames granted admin access", func(s string) error {
+		c.AdminUsers = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Bearer token granting admin access. Empty disables it")
+	fs.BoolVar(&c.AdminUI, "admin-ui", c.AdminUI, "Serve the admin web UI at /admin/ui/, which the auth policy must restrict to admins")
+	fs.BoolVar(&c.SCIM, "scim", c.SCIM, "Serve the SCIM 2.0 Users endpoints at /scim/v2/, which the auth policy must restrict to admins")
+	fs.StringVar(&c.OPAURL, "opa-url", c.OPAURL, "Open Policy Agent decision URL every request is authorized with, such as http://localhost:8181/v1/data/user/allow. Empty disables it")
+	fs.DurationVar(&c.OPATimeout, "opa-timeout", c.OPATimeout, "How long to wait for an Open Policy Agent decision before refusing the request")
+	fs.StringVar(&c.ShadowDatabase, "shadow-database", c.ShadowDatabase, "Registered database to mirror writes and compare reads against, for migration testing")
+	fs.StringVar(&c.ShadowMongoURI, "shadow-mongo-uri", c.ShadowMongoURI, "URI of a Mongo registered as the mongodb-shadow database")
+	fs.StringVar(&c.IDMigrationDatabase, "id-migration-database", c.IDMigrationDatabase, "Registered database the migrate-ids job copies customers to under new IDs, with a mapping from their old IDs. Empty does not offer the job")
+	fs.StringVar(&c.IDMigrationMongoURI, "id-migration-mongo-uri", c.IDMigrationMongoURI, "URI of a Mongo registered as the mongodb-id-migration database, which creates ULIDs")
+	fs.StringVar(&c.IDMigrationMongoDB, "id-migration-mongo-database", c.IDMigrationMongoDB, "Database of the -id-migration-mongo-uri Mongo")
+	fs.Func("shards", `Comma separated "name=database" shards users are spread over, by residency or hash, besides the database as the "default" shard`, func(s string) error {
+		c.Shards = strings.Split(s, ",")
+		return nil
+	})
+	fs.Func("shard-mongo-uris", `Comma separated "name=URI" Mongo shards, registered as the mongodb-name databases`, func(s string) error {
+		c.ShardMongoURIs = strings.Split(s, ",")
+		return nil
+	})
+	fs.Func("shard-residencies", `Comma separated "residency=shard" pairs placing users of a residency on a shard. Users with a residency neither mapped nor naming a shard are refused`, func(s string) error {
+		c.ShardResidencies = strings.Split(s, ",")
+		return nil
+	})
+	fs.BoolVar(&c.Anonymize, "anonymize", c.Anonymize, "Mask personal data in all read responses. For non-production environments")
+	fs.StringVar(&c.AnonymizeSecret, "anonymize-secret", c.AnonymizeSecret, "Secret keying pseudonyms, keeping them stable across restarts; random if empty")
+	fs.IntVar(&c.HashWorkers, "hash-workers", c.HashWorkers, "Number of passwords hashed concurrently")
+	fs.IntVar(&c.HashQueue, "hash-queue", c.HashQueue, "Number of password hashes allowed to wait before requests are refused with 503")
+	fs.DurationVar(&c.LoginCacheTTL, "login-cache-ttl", c.LoginCacheTTL, "How long the credentials logins are checked against are cached. 0 disables the cache")
+	fs.IntVar(&c.LoginCacheSize, "login-cache-size", c.LoginCacheSize, "Number of users whose credentials are cached for logins")
+	fs.IntVar(&c.ShedMaxInflight, "shed-max-inflight", c.ShedMaxInflight, "Requests in flight above which list requests are refused with 503. 0 disables")
+	fs.DurationVar(&c.ShedMaxDBLatency, "shed-max-db-latency", c.ShedMaxDBLatency, "Average database latency above which list requests are refused with 503. 0 disables")
+	fs.IntVar(&c.ConcurrencyLimit, "concurrency-limit", c.ConcurrencyLimit, "Requests served at once above which requests are refused with 503. 0 disables")
+	fs.Func("concurrency-routes", `Comma separated "route=limit" limits on requests to single routes served at once, with routes named as in HTTP metrics`, func(s string) error {
+		c.ConcurrencyRoutes = strings.Split(s, ",")
+		return nil
+	})
+	fs.Func("cache-routes", `Comma separated "route=duration" max ages clients may cache GET responses of routes for, with routes named as in HTTP metrics`, func(s string) error {
+		c.CacheRoutes = strings.Split(s, ",")
+		return nil
+	})
+	fs.Func("db-bulkheads", `Comma separated "compartment=workers/queue" bounds on database queries, such as "lists=4/8". Compartments are reads, lists, writes, logins and jobs`, func(s string) error {
+		c.DBBulkheads = strings.Split(s, ",")
+		return nil
+	})
+	fs.DurationVar(&c.DBHedgeDelay, "db-hedge-delay", c.DBHedgeDelay, "Time after which reads of a user, such as on login, are sent again and the first answer used. 0 disables hedging")
+	fs.IntVar(&c.WriteBufferSize, "write-buffer-size", c.WriteBufferSize, "Login history and last login writes buffered while the database is unreachable. 0 disables buffering")
+	fs.StringVar(&c.WriteBufferSpool, "write-buffer-spool", c.WriteBufferSpool, "File writes still buffered on shutdown are saved to, and read back from on start")
+	fs.Float64Var(&c.DBHedgePercentile, "db-hedge-percentile", c.DBHedgePercentile, "Percentile of recent read latencies, such as 95, after which reads are hedged instead of -db-hedge-delay")
+	fs.Func("slo-routes", `Comma separated "route=latency/availability" objectives, such as "login=300ms/99.9", with routes named as in HTTP metrics`, func(s string) error {
+		c.SLORoutes = strings.Split(s, ",")
+		return nil
+	})
+	fs.IntVar(&c.ResponseCacheSize, "response-cache-size", c.ResponseCacheSize, "Number of responses to -cache-routes kept in process until their max age or a write. 0 disables")
+	fs.DurationVar(&c.ConcurrencyWait, "concurrency-wait", c.ConcurrencyWait, "How long requests over a concurrency limit wait for a slot before being refused")
+	fs.Func("trusted-proxies", "Comma separated CIDRs or addresses of proxies trusted to report the client address in X-Forwarded-For and PROXY protocol headers", func(s string) error {
+		c.TrustedProxies = strings.Split(s, ",")
+		return nil
+	})
+	fs.Func("known-clients", "Comma separated client names counted under their own name by client metrics, others are counted as other (default "+strings.Join(c.KnownClients, ",")+")", func(s string) error {
+		c.KnownClients = strings.Split(s, ",")
+		return nil
+	})
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "Read PROXY protocol v1 and v2 headers from connections of trusted proxies, for layer 4 load balancers")
+	fs.StringVar(&c.MirrorURL, "mirror-url", c.MirrorURL, "Base URL of a canary sent a copy of read requests, responses discarded. Empty disables")
+	fs.IntVar(&c.MirrorPercent, "mirror-percent", c.MirrorPercent, "Percentage of read requests copied to the mirror URL")
+	fs.BoolVar(&c.Compress, "compress", c.Compress, "Gzip text and JSON responses for clients accepting gzip")
+	fs.DurationVar(&c.GCInterval, "gc-interval", c.GCInterval, "How often to queue a job deleting addresses and cards no customer references. 0 disables")
+	fs.BoolVar(&c.GCDryRun, "gc-dry-run", c.GCDryRun, "Only report orphaned addresses and cards in scheduled gc jobs")
+	fs.Func("retention", `Comma separated "data=age" limits on how long data is kept, for login-history and audit, such as "login-history=90d,audit=2y"`, func(s string) error {
+		c.Retention = strings.Split(s, ",")
+		return nil
+	})
+	fs.DurationVar(&c.RetentionInterval, "retention-interval", c.RetentionInterval, "How often to queue a job purging data kept longer than its retention, where the database does not expire it itself")
+	fs.BoolVar(&c.MetricsOtherPaths, "metrics-other-paths", c.MetricsOtherPaths, "Label HTTP metrics of requests matching no route as \"other\". Disabling labels them by path, which may create a series per request")
+	fs.StringVar(&c.MetricsNamespace, "metrics-namespace", c.MetricsNamespace, "Namespace prefixed to the names of exposed metrics, such as a brand. Empty adds none")
+	fs.StringVar(&c.MetricsSubsystem, "metrics-subsystem", c.MetricsSubsystem, "Subsystem prefixed to the names of exposed metrics, after the namespace. Empty adds none")
+	fs.Func("metrics-drop", "Comma separated names of metrics, without the prefix, left out of /metrics, such as http_request_size_bytes", func(s string) error {
+		c.MetricsDrop = strings.Split(s, ",")
+		return nil
+	})
+	fs.BoolVar(&c.MetricsOpenMetrics, "metrics-openmetrics", c.MetricsOpenMetrics, "Serve metrics in the OpenMetrics format to scrapers asking for it. Exemplars are never exposed")
+	fs.BoolVar(&c.ServerTiming, "server-timing", c.ServerTiming, "Send a Server-Timing header breaking responses down into db, serialization, handler and middleware time")
+	fs.IntVar(&c.AvatarMaxBytes, "avatar-max-bytes", c.AvatarMaxBytes, "Largest profile image accepted, in bytes")
+	fs.IntVar(&c.SignupAddressLimit, "signup-address-limit", c.SignupAddressLimit, "Registrations allowed per client address in each signup window. 0 disables")
+	fs.IntVar(&c.SignupSubnetLimit, "signup-subnet-limit", c.SignupSubnetLimit, "Registrations allowed per /24 IPv4 or /48 IPv6 subnet in each signup window. 0 disables")
+	fs.DurationVar(&c.SignupWindow, "signup-window", c.SignupWindow, "Window over which registrations are limited")
+	fs.StringVar(&c.DisposableDomains, "disposable-domains", c.DisposableDomains, "File or http(s) URL listing email domains refused at registration, one per line. Empty disables")
+	fs.DurationVar(&c.DisposableRefresh, "disposable-domains-refresh", c.DisposableRefresh, "How often the disposable domain list is read again")
+	fs.Func("customer-write-limits", `Comma separated "operation=count/duration" limits on each customer's writes, for the operations cards, addresses and profile, such as "cards=10/1h"`, func(s string) error {
+		c.CustomerWriteLimits = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&c.WriteLimitRedis, "write-limit-redis", c.WriteLimitRedis, "Redis URL customer write limits are kept at, shared by replicas, such as redis://:password@localhost:6379. Empty keeps them in each replica")
+	fs.StringVar(&c.SpamAction, "spam-action", c.SpamAction, "Action for registrations scored as spam: flag, challenge or reject. Empty disables spam scoring")
+	fs.Float64Var(&c.SpamThreshold, "spam-threshold", c.SpamThreshold, "Spam score registrations are acted on from. A filled honeypot scores 1, gibberish names and velocity 0.5 each")
+	fs.IntVar(&c.SpamVelocityLimit, "spam-velocity-limit", c.SpamVelocityLimit, "Registrations per client address in each spam velocity window before the velocity signal is raised. 0 disables it")
+	fs.DurationVar(&c.SpamVelocityWindow, "spam-velocity-window", c.SpamVelocityWindow, "Window over which registration velocity is measured")
+	fs.StringVar(&c.EventWebhookURL, "event-webhook-url", c.EventWebhookURL, "URL events such as flagged cards are posted to as JSON. Empty logs them")
+	fs.StringVar(&c.EventFormat, "event-format", c.EventFormat, "Format events are posted in: json, or cloudevents for CloudEvents 1.0 structured JSON")
+	fs.StringVar(&c.EventSource, "event-source", c.EventSource, "Source attribute of CloudEvents, a URI reference")
+	fs.StringVar(&c.EventTypePrefix, "event-type-prefix", c.EventTypePrefix, `Prefix of the types of CloudEvents, such as "com.example." for "com.example.user.created"`)
+	fs.Func("scim-targets", `Comma separated "name=URL" downstream SCIM services users are pushed to, such as "idp=https://example.com/scim/v2"`, func(s string) error {
+		c.SCIMTargets = strings.Split(s, ",")
+		return nil
+	})
+	fs.Func("scim-target-tokens", `Comma separated "name=token" bearer tokens of the SCIM targets`, func(s string) error {
+		c.SCIMTargetTokens = strings.Split(s, ",")
+		return nil
+	})
+	fs.DurationVar(&c.SCIMReconcileInterval, "scim-reconcile-interval", c.SCIMReconcileInterval, "How often to queue a job catching the SCIM targets up with every user. 0 disables")
+	fs.BoolVar(&c.Dev, "dev", c.Dev, "Catch mail and webhooks in memory and show them at /dev/outbox. For local development only")
+	fs.StringVar(&c.DevSMTPAddr, "dev-smtp-addr", c.DevSMTPAddr, "Address the dev mode mail catcher listens on for SMTP")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "Time allowed for in-flight requests and jobs to finish on shutdown")
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envList splits a comma separated variable, returning fallback if it is
+// unset.
+func envList(key string, fallback []string) []string {
+	if v, ok := os.LookupEnv(key); ok {
+		return strings.Split(v, ",")
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func envFloat(key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,101 @@
+package app
+
+// grpc.go serves the standard gRPC health and reflection services, so
+// Kubernetes gRPC probes and grpcurl work against the service.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// healthInterval is how often the database is pinged to update the health
+// status.
+var healthInterval = 5 * time.Second
+
+// GRPCAddr returns the address the gRPC server listens on, once started.
+func (a *App) GRPCAddr() net.Addr {
+	if a.grpcListener == nil {
+		return nil
+	}
+	return a.grpcListener.Addr()
+}
+
+func (a *App) startGRPC(ctx context.Context) error {
+	if a.cfg.GRPCPort == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", a.cfg.GRPCPort))
+	if err != nil {
+		return err
+	}
+	a.grpcListener = l
+	a.grpcServer = grpc.NewServer()
+	a.health = health.NewServer()
+	healthpb.RegisterHealthServer(a.grpcServer, a.health)
+	reflection.Register(a.grpcServer)
+	a.checkHealth()
+
+	probe, cancel := context.WithCancel(context.Background())
+	a.grpcCancel = cancel
+	go func() {
+		t := time.NewTicker(healthInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-probe.Done():
+				return
+			case <-t.C:
+				a.checkHealth()
+			}
+		}
+	}()
+
+	a.logger.Log("transport", "gRPC", "addr", l.Addr())
+	go func() {
+		if err := a.grpcServer.Serve(l); err != nil {
+			a.errc <- err
+		}
+	}()
+	return nil
+}
+
+// checkHealth reports the service, and the server as a whole, serving while
+// the database answers.
+func (a *App) checkHealth() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if err := db.Ping(); err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	a.health.SetServingStatus("", status)
+	a.health.SetServingStatus(ServiceName, status)
+}
+
+// stopGRPC reports NOT_SERVING to watchers, then waits for calls in flight
+// until ctx is done.
+func (a *App) stopGRPC(ctx context.Context) error {
+	if a.grpcServer == nil {
+		return nil
+	}
+	a.grpcCancel()
+	a.health.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		a.grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		a.grpcServer.Stop()
+		return ctx.Err()
+	}
+}
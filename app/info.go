@@ -0,0 +1,171 @@
+package app
+
+// info.go reports the build and the features enabled, for support
+// diagnostics and fleet audits.
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/mikesay/user/blobs"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/db/shard"
+)
+
+// Build information, set with -ldflags "-X github.com/mikesay/user/app.Version=...".
+// Commit and BuildDate default to the version control information Go
+// records in binaries built from a checkout.
+var (
+	Version   = "dev"
+	Commit    string
+	BuildDate string
+)
+
+// Info is the report served at /admin/info.
+type Info struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"buildDate"`
+	GoVersion string   `json:"goVersion"`
+	Database  string   `json:"database"`
+	Features  Features `json:"features"`
+}
+
+// Features lists the optional behaviour enabled by configuration.
+type Features struct {
+	Tracing        bool   `json:"tracing"`
+	RequestCache   bool   `json:"requestCache"`
+	EventBus       string `json:"eventBus"`
+	GRPC           bool   `json:"grpc"`
+	Auth           bool   `json:"auth"`
+	LoginRisk      string `json:"loginRisk,omitempty"`
+	ConfirmDeletes bool   `json:"confirmDeletes"`
+	Shedding       bool   `json:"shedding"`
+	Faults         bool   `json:"faults"`
+	ReadOnly       bool   `json:"readOnly"`
+	Anonymize      bool   `json:"anonymize"`
+	ShadowDatabase string `json:"shadowDatabase,omitempty"`
+	Shards         string `json:"shards,omitempty"`
+	SCIMTargets    string `json:"scimTargets,omitempty"`
+	AvatarStore    string `json:"avatarStore,omitempty"`
+	SignupGuard    bool   `json:"signupGuard"`
+	Mirror         bool   `json:"mirror"`
+	ProxyProtocol  bool   `json:"proxyProtocol"`
+	Compression    bool   `json:"compression"`
+	ServerTiming   bool   `json:"serverTiming"`
+	OrphanGC       bool   `json:"orphanGC"`
+	Concurrency    bool   `json:"concurrencyLimit"`
+	ResponseCache  bool   `json:"responseCache"`
+	LoginCache     bool   `json:"loginCache"`
+	SLOs           bool   `json:"slos"`
+	DBBulkheads    bool   `json:"dbBulkheads"`
+	DBHedging      bool   `json:"dbHedging"`
+	WriteBuffer    bool   `json:"writeBuffer"`
+	TLS            bool   `json:"tls"`
+	HTTP2          bool   `json:"http2"`
+	H2C            bool   `json:"h2c"`
+	AdminUI        bool   `json:"adminUI"`
+	SCIM           bool   `json:"scim"`
+	Dev            bool   `json:"dev"`
+	Impersonation  bool   `json:"impersonation"`
+	OPA            bool   `json:"opa"`
+	SpamAction     string `json:"spamAction,omitempty"`
+	ErrorReporting bool   `json:"errorReporting"`
+	WriteLimits    string `json:"writeLimits,omitempty"`
+	Retention      bool   `json:"retention"`
+	EventFormat    string `json:"eventFormat"`
+}
+
+// Info returns the build and feature report.
+func (a *App) Info() Info {
+	i := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Database:  a.cfg.Database,
+		Features: Features{
+			Tracing:        a.cfg.Zipkin != "",
+			RequestCache:   true,
+			EventBus:       "log",
+			GRPC:           a.cfg.GRPCPort != "",
+			Auth:           len(a.auth) > 0,
+			LoginRisk:      a.cfg.LoginRisk,
+			ConfirmDeletes: a.cfg.ConfirmDeletes,
+			Shedding:       a.cfg.ShedMaxInflight > 0 || a.cfg.ShedMaxDBLatency > 0,
+			Faults:         a.cfg.Faults,
+			ReadOnly:       a.readOnly != nil && a.readOnly.Enabled(),
+			Anonymize:      a.cfg.Anonymize,
+			ShadowDatabase: a.cfg.ShadowDatabase,
+			AvatarStore:    blobs.Selected(),
+			SignupGuard:    a.signup != nil,
+			Mirror:         a.cfg.MirrorURL != "",
+			ProxyProtocol:  a.cfg.ProxyProtocol,
+			Compression:    a.cfg.Compress,
+			ServerTiming:   a.cfg.ServerTiming,
+			OrphanGC:       a.cfg.GCInterval > 0,
+			Concurrency:    a.cfg.ConcurrencyLimit > 0 || len(a.routeLimits) > 0,
+			ResponseCache:  len(a.maxAges) > 0 && a.cfg.ResponseCacheSize > 0,
+			LoginCache:     a.cfg.LoginCacheTTL > 0 && a.cfg.LoginCacheSize > 0,
+			SLOs:           len(a.slos) > 0,
+			DBBulkheads:    len(a.bulkheads) > 0,
+			DBHedging:      a.cfg.DBHedgeDelay > 0,
+			WriteBuffer:    a.cfg.WriteBufferSize > 0,
+			TLS:            a.cfg.TLSCertFile != "",
+			HTTP2:          a.cfg.HTTP2,
+			H2C:            a.cfg.H2C,
+			AdminUI:        a.cfg.AdminUI,
+			SCIM:           a.cfg.SCIM,
+			Dev:            a.cfg.Dev,
+			Impersonation:  a.cfg.ImpersonationTTL > 0,
+			OPA:            a.cfg.OPAURL != "",
+			SpamAction:     a.cfg.SpamAction,
+			ErrorReporting: a.cfg.SentryDSN != "",
+			Retention:      len(nonEmpty(a.cfg.Retention)) > 0,
+			EventFormat:    a.cfg.EventFormat,
+		},
+	}
+	if len(nonEmpty(a.cfg.CustomerWriteLimits)) > 0 {
+		i.Features.WriteLimits = "memory"
+		if a.cfg.WriteLimitRedis != "" {
+			i.Features.WriteLimits = "redis"
+		}
+	}
+	if a.cfg.EventWebhookURL != "" {
+		i.Features.EventBus = "webhook"
+	} else if a.cfg.Dev {
+		i.Features.EventBus = "outbox"
+	}
+	if i.Database == "" {
+		i.Database = db.Selected()
+	}
+	if s, ok := db.DefaultDb.(*shard.DB); ok {
+		i.Features.Shards = strings.Join(s.Shards(), ",")
+	}
+	if a.scim != nil {
+		var names []string
+		for _, t := range a.scim.Targets {
+			names = append(names, t.Name)
+		}
+		i.Features.SCIMTargets = strings.Join(names, ",")
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && i.Commit == "":
+				i.Commit = s.Value
+			case s.Key == "vcs.time" && i.BuildDate == "":
+				i.BuildDate = s.Value
+			}
+		}
+	}
+	return i
+}
+
+func (a *App) serveInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Info())
+}
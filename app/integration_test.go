@@ -0,0 +1,135 @@
+//go:build integration
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/db/mongodb"
+	"github.com/mikesay/user/testenv"
+)
+
+// startMongoApp starts the service on a Mongo of its own, skipping the test
+// when none can be started.
+func startMongoApp(t *testing.T) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	uri, stop, err := testenv.Mongo(ctx)
+	if errors.Is(err, testenv.ErrNoDocker) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+
+	db.Register("mongodb-integration", &mongodb.Mongo{URI: uri})
+	cfg := testConfig()
+	cfg.Database = "mongodb-integration"
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		a.Stop(ctx)
+	})
+	return fmt.Sprintf("http://%v", a.Addr())
+}
+
+// call sends body, if any, as JSON to path and checks the status, decoding
+// the response into a map.
+func call(t *testing.T, base, method, path string, body interface{}, status int) map[string]interface{} {
+	t.Helper()
+	var b bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&b).Encode(body)
+	}
+	req, err := http.NewRequest(method, base+path, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if method == "GET" && path == "/login" {
+		req.SetBasicAuth("integration", "secret")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var out map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&out)
+	if res.StatusCode != status {
+		t.Fatalf("%v %v: expected %v, received %v %v", method, path, status, res.StatusCode, out)
+	}
+	return out
+}
+
+// embedded returns the list named name in a HAL response.
+func embedded(out map[string]interface{}, name string) []interface{} {
+	e, _ := out["_embedded"].(map[string]interface{})
+	l, _ := e[name].([]interface{})
+	return l
+}
+
+func TestHTTPAPI(t *testing.T) {
+	base := startMongoApp(t)
+
+	reg := call(t, base, "POST", "/register", map[string]string{
+		"username": "integration", "password": "secret", "email": "integration@example.com",
+		"firstName": "Inte", "lastName": "Gration",
+	}, http.StatusOK)
+	id, _ := reg["id"].(string)
+	if id == "" {
+		t.Fatalf("Expected the customer's id, received %v", reg)
+	}
+
+	login := call(t, base, "GET", "/login", nil, http.StatusOK)
+	if u, _ := login["user"].(map[string]interface{}); u["id"] != id {
+		t.Errorf("Expected to log in as the customer, received %v", login)
+	}
+
+	customer := call(t, base, "GET", "/customers/"+id, nil, http.StatusOK)
+	if customer["username"] != "integration" || customer["firstName"] != "Inte" {
+		t.Errorf("Expected the customer, received %v", customer)
+	}
+	call(t, base, "POST", "/addresses", map[string]string{
+		"userID": id, "street": "Main Street", "number": "1", "city": "Springfield", "postcode": "12345", "country": "US",
+	}, http.StatusOK)
+	call(t, base, "POST", "/cards", map[string]string{
+		"userID": id, "longNum": "4111111111111111", "expires": "12/30", "ccv": "123",
+	}, http.StatusOK)
+	if a := embedded(call(t, base, "GET", "/customers/"+id+"/addresses", nil, http.StatusOK), "address"); len(a) != 1 {
+		t.Errorf("Expected the address, received %v", a)
+	}
+	cards := embedded(call(t, base, "GET", "/customers/"+id+"/cards", nil, http.StatusOK), "card")
+	if len(cards) != 1 || cards[0].(map[string]interface{})["longNum"] == "4111111111111111" {
+		t.Errorf("Expected the card masked, received %v", cards)
+	}
+
+	call(t, base, "PUT", "/customers/"+id+"/tags/beta", nil, http.StatusOK)
+	found := embedded(call(t, base, "GET", "/customers/search?tag=beta", nil, http.StatusOK), "customer")
+	if len(found) != 1 {
+		t.Errorf("Expected the tagged customer found, received %v", found)
+	}
+	if l := embedded(call(t, base, "GET", "/customers?page=1&size=10", nil, http.StatusOK), "customer"); len(l) != 1 {
+		t.Errorf("Expected the customer listed, received %v", l)
+	}
+
+	call(t, base, "DELETE", "/customers/"+id, nil, http.StatusOK)
+	call(t, base, "GET", "/customers/"+id, nil, http.StatusNotFound)
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricsPrefix returns the prefix of exposed metric names for namespace
+// and subsystem, empty if both are.
+func metricsPrefix(namespace, subsystem string) string {
+	var parts []string
+	for _, s := range []string{namespace, subsystem} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, "_") + "_"
+}
+
+// metricsGatherer gathers metrics from Gatherer, leaving out those named in
+// drop and prefixing the names of the others. Exemplars are removed, so
+// OpenMetrics scrapes carry no trace IDs either.
+type metricsGatherer struct {
+	prometheus.Gatherer
+	prefix string
+	drop   map[string]bool
+}
+
+func (g metricsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	out := mfs[:0]
+	for _, mf := range mfs {
+		if g.drop[mf.GetName()] {
+			continue
+		}
+		name := g.prefix + mf.GetName()
+		mf.Name = &name
+		for _, m := range mf.Metric {
+			if m.Counter != nil {
+				m.Counter.Exemplar = nil
+			}
+			if m.Histogram != nil {
+				m.Histogram.Exemplars = nil
+				for _, b := range m.Histogram.Bucket {
+					b.Exemplar = nil
+				}
+			}
+		}
+		out = append(out, mf)
+	}
+	return out, err
+}
+
+// newMetricsHandler returns the /metrics handler for c's prefix, dropped
+// metrics and exposition format.
+func newMetricsHandler(c Config) http.Handler {
+	g := metricsGatherer{
+		Gatherer: prometheus.DefaultGatherer,
+		prefix:   metricsPrefix(c.MetricsNamespace, c.MetricsSubsystem),
+		drop:     make(map[string]bool),
+	}
+	for _, name := range nonEmpty(c.MetricsDrop) {
+		g.drop[name] = true
+	}
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		EnableOpenMetrics: c.MetricsOpenMetrics,
+	}))
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsPrefix(t *testing.T) {
+	for _, c := range []struct{ namespace, subsystem, want string }{
+		{"", "", ""},
+		{"brand_a", "", "brand_a_"},
+		{"", "user", "user_"},
+		{"brand_a", "user", "brand_a_user_"},
+	} {
+		if got := metricsPrefix(c.namespace, c.subsystem); got != c.want {
+			t.Errorf("Expected %q for %q and %q, received %q", c.want, c.namespace, c.subsystem, got)
+		}
+	}
+}
+
+func TestMetricsGatherer(t *testing.T) {
+	r := prometheus.NewRegistry()
+	kept := prometheus.NewCounter(prometheus.CounterOpts{Name: "kept_total", Help: "Kept."})
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped_total", Help: "Dropped."})
+	r.MustRegister(kept, dropped)
+	kept.(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{"trace_id": "abc"})
+	dropped.Inc()
+
+	mfs, err := metricsGatherer{Gatherer: r, prefix: "brand_a_", drop: map[string]bool{"dropped_total": true}}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 1 || mfs[0].GetName() != "brand_a_kept_total" {
+		t.Fatalf("Expected only the prefixed kept metric, received %v", mfs)
+	}
+	if c := mfs[0].Metric[0].Counter; c.GetValue() != 1 || c.Exemplar != nil {
+		t.Errorf("Expected the count without its exemplar, received %v", c)
+	}
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/mikesay/user/serverless"
+)
+
+// RunLambda serves the service described by cfg from the Lambda Runtime API
+// at api until ctx is done. The HTTP and gRPC servers are not started; the
+// tracer, database and service start on the first invocation, so that cold
+// starts without traffic cost nothing, and stay up for the invocations that
+// follow, reusing their database connections. A failed start fails its
+// invocation and is retried by the next.
+func RunLambda(ctx context.Context, cfg Config, api string) error {
+	a, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	hooks := a.hooks[:0]
+	for _, h := range a.hooks {
+		if h.Name != "http" && h.Name != "grpc" {
+			hooks = append(hooks, h)
+		}
+	}
+	a.hooks = hooks
+	a.logger.Log("transport", "lambda", "api", api)
+
+	rt := &serverless.Runtime{API: api}
+	runErr := rt.Run(ctx, func(ctx context.Context) (http.Handler, error) {
+		if a.started < len(a.hooks) {
+			if err := a.Start(ctx); err != nil {
+				a.logger.Log("lambda", "start", "err", err)
+				return nil, err
+			}
+		}
+		return a.handler, nil
+	})
+	stopCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	return errors.Join(runErr, a.Stop(stopCtx))
+}
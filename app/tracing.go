@@ -0,0 +1,215 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/clock"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/model"
+	"github.com/openzipkin/zipkin-go/reporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxPendingTraces bounds the traces held by the tail sampler until
+	// their server span finishes. Spans of traces beyond it are kept or
+	// dropped as the head sampler decides.
+	maxPendingTraces = 10000
+	// maxTraceSpans bounds the spans held for each trace; later ones are
+	// dropped.
+	maxTraceSpans = 1000
+	// pendingTimeout is how long a trace is held for its server span, such
+	// as for spans finishing after it, before the head sampler decides.
+	pendingTimeout = time.Minute
+)
+
+var TailDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "trace_tail_decisions_total",
+	Help: "Number of traces decided by the tail sampler, by decision: sampled by the head sampler, kept for an error or latency, or dropped.",
+}, []string{"decision"})
+
+func init() {
+	prometheus.MustRegister(TailDecisions)
+}
+
+// newSampler returns the sampler deciding which new traces are recorded:
+// the fraction rate of them, limited to perSecond traces a second unless
+// perSecond is 0. Spans of traces started elsewhere follow the caller's
+// decision.
+func newSampler(rate, perSecond float64, c clock.Clock) (zipkin.Sampler, error) {
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("sample rate %v is not between 0 and 1", rate)
+	}
+	if perSecond < 0 {
+		return nil, fmt.Errorf("negative rate limit %v", perSecond)
+	}
+	sample := zipkin.AlwaysSample
+	if rate < 1 {
+		var err error
+		if sample, err = zipkin.NewBoundarySampler(rate, 0); err != nil {
+			return nil, err
+		}
+	}
+	if perSecond == 0 {
+		return sample, nil
+	}
+	l := &traceLimiter{perSecond: perSecond, tokens: max(perSecond, 1), clock: c}
+	return func(id uint64) bool {
+		return sample(id) && l.allow()
+	}, nil
+}
+
+// traceLimiter is a token bucket refilled at perSecond, holding up to a
+// second's worth of traces.
+type traceLimiter struct {
+	perSecond float64
+	clock     clock.Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (l *traceLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if !l.last.IsZero() {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.perSecond, max(l.perSecond, 1))
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// tailReporter holds the spans of each trace until its server span, or a
+// root span outside a request, finishes, then reports them if head samples
+// the trace or any span failed or took latency or more. The tracer it
+// reports for must record every trace.
+type tailReporter struct {
+	next    reporter.Reporter
+	head    zipkin.Sampler
+	errors  bool
+	latency time.Duration
+	clock   clock.Clock
+
+	mu     sync.Mutex
+	traces map[model.TraceID]*pendingTrace
+	swept  time.Time
+}
+
+type pendingTrace struct {
+	spans   []model.SpanModel
+	reason  string
+	started time.Time
+}
+
+// newTailReporter returns a tailReporter keeping traces with errors if
+// errors is set, and those taking latency or more unless it is 0.
+func newTailReporter(next reporter.Reporter, head zipkin.Sampler, errors bool, latency time.Duration, c clock.Clock) *tailReporter {
+	return &tailReporter{next: next, head: head, errors: errors, latency: latency, clock: c, traces: make(map[model.TraceID]*pendingTrace)}
+}
+
+// Send implements reporter.Reporter.
+func (r *tailReporter) Send(s model.SpanModel) {
+	r.mu.Lock()
+	now := r.clock.Now()
+	ready := r.sweep(now)
+	t, ok := r.traces[s.TraceID]
+	switch {
+	case !ok && len(r.traces) >= maxPendingTraces:
+		t = &pendingTrace{started: now}
+		ready = append(ready, t)
+	case !ok:
+		t = &pendingTrace{started: now}
+		r.traces[s.TraceID] = t
+	}
+	if len(t.spans) < maxTraceSpans {
+		t.spans = append(t.spans, s)
+	}
+	if t.reason == "" {
+		t.reason = r.keep(s)
+	}
+	if s.ParentID == nil || s.Kind == model.Server {
+		if r.traces[s.TraceID] == t {
+			delete(r.traces, s.TraceID)
+			ready = append(ready, t)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, t := range ready {
+		r.decide(t)
+	}
+}
+
+// sweep removes the traces held for pendingTimeout, at most once a second.
+func (r *tailReporter) sweep(now time.Time) []*pendingTrace {
+	if now.Sub(r.swept) < time.Second {
+		return nil
+	}
+	r.swept = now
+	var expired []*pendingTrace
+	for id, t := range r.traces {
+		if now.Sub(t.started) >= pendingTimeout {
+			delete(r.traces, id)
+			expired = append(expired, t)
+		}
+	}
+	return expired
+}
+
+// keep returns why s keeps its trace, if it does.
+func (r *tailReporter) keep(s model.SpanModel) string {
+	if r.errors && failed(s) {
+		return "error"
+	}
+	if r.latency > 0 && s.Duration >= r.latency {
+		return "latency"
+	}
+	return ""
+}
+
+// failed reports whether s ended in a server error, or in any error outside
+// a request. Client errors, such as an unknown customer, are not failures.
+func failed(s model.SpanModel) bool {
+	if code, err := strconv.Atoi(s.Tags["http.status_code"]); err == nil {
+		return code >= 500
+	}
+	_, ok := s.Tags["error"]
+	return ok
+}
+
+// decide reports the spans of t if it is kept or head sampled.
+func (r *tailReporter) decide(t *pendingTrace) {
+	decision := t.reason
+	if decision == "" && r.head(t.spans[0].TraceID.Low) {
+		decision = "sampled"
+	}
+	if decision == "" {
+		TailDecisions.WithLabelValues("dropped").Inc()
+		return
+	}
+	TailDecisions.WithLabelValues(decision).Inc()
+	for _, s := range t.spans {
+		r.next.Send(s)
+	}
+}
+
+// Close decides the pending traces and closes the next reporter.
+func (r *tailReporter) Close() error {
+	r.mu.Lock()
+	traces := r.traces
+	r.traces = make(map[model.TraceID]*pendingTrace)
+	r.mu.Unlock()
+	for _, t := range traces {
+		r.decide(t)
+	}
+	return r.next.Close()
+}
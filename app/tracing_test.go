@@ -0,0 +1,98 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/clock"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/model"
+)
+
+func TestSampler(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	count := func(rate, perSecond float64) int {
+		sample, err := newSampler(rate, perSecond, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for id := uint64(0); id < 1000; id++ {
+			if sample(id * 7919) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(1, 0); n != 1000 {
+		t.Errorf("Expected every trace sampled, received %v", n)
+	}
+	if n := count(0, 0); n != 0 {
+		t.Errorf("Expected no trace sampled, received %v", n)
+	}
+	if n := count(0.1, 0); n < 50 || n > 150 {
+		t.Errorf("Expected about a tenth of traces sampled, received %v", n)
+	}
+	if n := count(1, 5); n != 5 {
+		t.Errorf("Expected a second's worth of traces, received %v", n)
+	}
+
+	sample, _ := newSampler(1, 2, c)
+	sample(1)
+	sample(2)
+	if sample(3) {
+		t.Error("Expected the limit reached")
+	}
+	c.Advance(500 * time.Millisecond)
+	if !sample(4) || sample(5) {
+		t.Error("Expected one trace allowed after half a second")
+	}
+
+	for _, bad := range [][2]float64{{2, 0}, {-1, 0}, {1, -1}} {
+		if _, err := newSampler(bad[0], bad[1], c); err == nil {
+			t.Errorf("Expected rate %v and limit %v refused", bad[0], bad[1])
+		}
+	}
+}
+
+// spans records the spans reported to it.
+type spans []model.SpanModel
+
+func (s *spans) Send(span model.SpanModel) { *s = append(*s, span) }
+func (s *spans) Close() error              { return nil }
+
+func TestTailReporter(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var sent spans
+	r := newTailReporter(&sent, zipkin.NeverSample, true, time.Second, c)
+	request := func(trace uint64, duration time.Duration, tags map[string]string) {
+		id := model.ID(trace)
+		r.Send(model.SpanModel{SpanContext: model.SpanContext{TraceID: model.TraceID{Low: trace}, ID: 2, ParentID: &id}, Duration: duration})
+		r.Send(model.SpanModel{SpanContext: model.SpanContext{TraceID: model.TraceID{Low: trace}, ID: 1}, Kind: model.Server, Duration: duration, Tags: tags})
+	}
+
+	request(1, time.Millisecond, nil)
+	request(2, time.Millisecond, map[string]string{"error": "true", "http.status_code": "404"})
+	if len(sent) != 0 {
+		t.Errorf("Expected fast and client error traces dropped, received %v", sent)
+	}
+	request(3, time.Millisecond, map[string]string{"error": "true", "http.status_code": "503"})
+	if len(sent) != 2 || sent[0].TraceID.Low != 3 {
+		t.Errorf("Expected the failed trace kept whole, received %v", sent)
+	}
+	request(4, 2*time.Second, nil)
+	if len(sent) != 4 || sent[3].TraceID.Low != 4 {
+		t.Errorf("Expected the slow trace kept, received %v", sent)
+	}
+
+	r.head = zipkin.AlwaysSample
+	r.Send(model.SpanModel{SpanContext: model.SpanContext{TraceID: model.TraceID{Low: 5}, ID: 2, ParentID: new(model.ID)}})
+	if len(sent) != 4 {
+		t.Errorf("Expected the trace held until its request ends, received %v", sent)
+	}
+	c.Advance(pendingTimeout)
+	request(6, time.Millisecond, nil)
+	if len(sent) != 7 {
+		t.Errorf("Expected the held trace and the sampled one reported, received %v", sent)
+	}
+}
@@ -0,0 +1,325 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/adminui"
+	"github.com/mikesay/user/api"
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/db/bulkhead"
+	"github.com/mikesay/user/middleware"
+	"github.com/mikesay/user/ratelimit"
+	"github.com/mikesay/user/reporting"
+	"github.com/mikesay/user/risk"
+	"github.com/mikesay/user/scim"
+	"github.com/mikesay/user/signup"
+	"github.com/mikesay/user/users"
+)
+
+// Problem is a setting that is invalid, alone or given the others, named by
+// its flag.
+type Problem struct {
+	Flag    string
+	Message string
+	// Hint suggests a fix, if there is an obvious one.
+	Hint string
+}
+
+// ConfigError lists every problem found in a Config.
+type ConfigError struct {
+	Problems []Problem
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid configuration, %d problem(s):", len(e.Problems))
+	for _, p := range e.Problems {
+		fmt.Fprintf(&b, "\n  -%s: %s", p.Flag, p.Message)
+		if p.Hint != "" {
+			fmt.Fprintf(&b, "\n      %s", p.Hint)
+		}
+	}
+	return b.String()
+}
+
+// Validate checks c before anything is started, returning a *ConfigError
+// listing all invalid settings, including those that only make sense
+// together, rather than the first one found.
+func (c Config) Validate() error {
+	var problems []Problem
+	problem := func(flag, hint, format string, args ...interface{}) {
+		problems = append(problems, Problem{Flag: flag, Message: fmt.Sprintf(format, args...), Hint: hint})
+	}
+	parse := func(flag, hint string, err error) {
+		if err != nil {
+			problem(flag, hint, "%v", err)
+		}
+	}
+
+	if c.Port == "" {
+		problem("port", "Set a port, or 0 for any free one.", "empty")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problem("tls-cert-file", "Set both -tls-cert-file and -tls-key-file, or neither.", "a certificate needs its key")
+	}
+	if _, err := regexp.Compile(c.UsernameCharset); err != nil {
+		problem("username-charset", "Give a Go regular expression, such as ^[a-zA-Z0-9_.-]+$.", "%v", err)
+	}
+	if c.UsernameMinLength > c.UsernameMaxLength {
+		problem("username-min-length", "Lower it, or raise -username-max-length.", "%d is above -username-max-length %d", c.UsernameMinLength, c.UsernameMaxLength)
+	}
+	_, err := users.ParseAgePolicy(c.MinimumAge, c.MinimumAges)
+	parse("minimum-ages", `Give "residency=age" pairs, and a -minimum-age of 0 or more.`, err)
+
+	switch risk.Decision(c.LoginRisk) {
+	case "", risk.Allow, risk.Challenge, risk.Deny:
+	default:
+		problem("login-risk", "Use allow, challenge or deny, or leave it empty.", "unknown action %q", c.LoginRisk)
+	}
+	if c.LoginRisk == string(risk.Challenge) && c.StepUpWebhookURL == "" && !c.Dev {
+		problem("login-risk", "Set -step-up-webhook-url so challenged customers are sent a code, or use deny.", "challenged logins could never be verified")
+	}
+	if c.StepUpWebhookURL != "" {
+		if u, err := url.Parse(c.StepUpWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("step-up-webhook-url", "Give the notification service's URL, such as http://notify/codes.", "not an http URL: %q", c.StepUpWebhookURL)
+		}
+	}
+	if c.StepUpTTL <= 0 {
+		problem("step-up-ttl", "Set a duration, such as 10m.", "not positive")
+	}
+	if c.GeoIPFile != "" && c.LoginRisk == "" {
+		problem("geoip-file", "Set -login-risk, or drop -geoip-file.", "only read to evaluate login risk, which is disabled")
+	}
+	if c.TraceRateLimit < 0 {
+		problem("trace-rate-limit", "Set 0 or more; 0 sets no limit.", "negative")
+	} else if _, err := newSampler(c.TraceSampleRate, c.TraceRateLimit, clock.System{}); err != nil {
+		problem("trace-sample-rate", "Set a rate from 0 to 1.", "%v", err)
+	}
+	if c.TraceLatency < 0 {
+		problem("trace-latency", "Set a latency, such as 2s, or 0 to disable.", "negative")
+	}
+	if (c.TraceErrors || c.TraceLatency > 0) && c.Zipkin == "" {
+		problem("trace-errors", "Set -zipkin, or drop -trace-errors and -trace-latency.", "tracing is disabled")
+	}
+	if c.ConfirmSecret != "" && !c.ConfirmDeletes {
+		problem("confirm-secret", "Set -confirm-deletes, or drop -confirm-secret.", "set but deletes are not confirmed")
+	}
+	if c.ImpersonationTTL < 0 {
+		problem("impersonation-ttl", "Set 0 or more; 0 disables impersonation.", "negative")
+	}
+	if c.ImpersonationSecret != "" && c.ImpersonationTTL <= 0 {
+		problem("impersonation-secret", "Set -impersonation-ttl, or drop -impersonation-secret.", "set but impersonation is disabled")
+	}
+	if c.AnonymizeSecret != "" && !c.Anonymize {
+		problem("anonymize-secret", "Set -anonymize, or drop -anonymize-secret.", "set but responses are not anonymized")
+	}
+	if c.SCIM && c.Anonymize {
+		problem("scim", "Drop -scim or -anonymize.", "identity providers match users by username and email, which -anonymize replaces")
+	}
+
+	policy, err := api.ParseAuthPolicy(c.AuthPolicy)
+	parse("auth-policy", `Give "[METHOD ]PATH=anonymous|user|admin" rules.`, err)
+	if err == nil && !policy.Covers("/admin", api.AdminAuth) {
+		problem("auth-policy", "Add \"/admin/**=admin\" before any rule matching admin routes.", "/admin/** is not restricted to admins")
+	}
+	if err == nil && len(policy) == 0 {
+		if c.AdminToken != "" {
+			problem("admin-token", "Set -auth-policy, such as \"/admin/**=admin\", so admin routes require it.", "set but no route requires admin access")
+		}
+		if len(nonEmpty(c.AdminUsers)) > 0 {
+			problem("admin-users", "Set -auth-policy, such as \"/admin/**=admin\", so admin routes require it.", "set but no route requires admin access")
+		}
+	}
+	if err == nil && c.AdminUI {
+		ui := &http.Request{Method: "GET", URL: &url.URL{Path: adminui.Prefix}}
+		if policy.Level(ui) != api.AdminAuth {
+			problem("admin-ui", "Set -auth-policy, such as \"/admin/**=admin\", and -admin-users or -admin-token.", "%v is not restricted to admins", adminui.Prefix)
+		}
+	}
+	if err == nil && c.ImpersonationTTL > 0 {
+		impersonate := &http.Request{Method: "POST", URL: &url.URL{Path: "/admin/impersonate/id"}}
+		if policy.Level(impersonate) != api.AdminAuth {
+			problem("impersonation-ttl", "Set -auth-policy, such as \"/admin/**=admin\", and -admin-users or -admin-token.", "/admin/impersonate/{id} is not restricted to admins")
+		}
+	}
+	if err == nil && c.SCIM {
+		provision := &http.Request{Method: "POST", URL: &url.URL{Path: scim.Prefix + "Users"}}
+		if policy.Level(provision) != api.AdminAuth {
+			problem("scim", "Set -auth-policy, such as \"/scim/**=admin\", and -admin-token.", "%v is not restricted to admins", provision.URL.Path)
+		}
+	}
+	if c.SentryDSN != "" {
+		_, err := reporting.NewSentry(c.SentryDSN, c.Environment, Version, time.Second)
+		parse("sentry-dsn", "Copy the DSN from the project's Client Keys settings.", err)
+	}
+	if c.OPAURL != "" {
+		if u, err := url.Parse(c.OPAURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("opa-url", "Give the decision URL, such as http://localhost:8181/v1/data/user/allow.", "not an http URL: %q", c.OPAURL)
+		}
+		if c.OPATimeout <= 0 {
+			problem("opa-timeout", "Set a positive duration, such as 500ms.", "%v", c.OPATimeout)
+		}
+	}
+
+	if c.ShadowMongoURI != "" && c.ShadowDatabase != "mongodb-shadow" {
+		problem("shadow-mongo-uri", "Set -shadow-database=mongodb-shadow to compare against it.", "registers mongodb-shadow, but the shadow database is %q", c.ShadowDatabase)
+	}
+	if c.IDMigrationDatabase != "" && (c.IDMigrationDatabase == c.Database || c.IDMigrationDatabase == c.ShadowDatabase) {
+		problem("id-migration-database", "Name a database the service does not use.", "customers would be copied to %q, which the service already uses", c.IDMigrationDatabase)
+	}
+	if c.IDMigrationMongoURI != "" {
+		if c.IDMigrationDatabase != "mongodb-id-migration" {
+			problem("id-migration-mongo-uri", "Set -id-migration-database=mongodb-id-migration to copy customers to it.", "registers mongodb-id-migration, but the id migration database is %q", c.IDMigrationDatabase)
+		}
+		if c.IDMigrationMongoDB == "" {
+			problem("id-migration-mongo-database", "Name the database customers are copied to, such as users.", "empty")
+		}
+	}
+	shards, err := parsePairs(c.Shards)
+	parse("shards", `Give "name=database" pairs.`, err)
+	if _, ok := shards[DefaultShard]; ok {
+		problem("shards", "Name the shard otherwise.", "shard name %v is reserved", DefaultShard)
+	}
+	uris, err := parsePairs(c.ShardMongoURIs)
+	parse("shard-mongo-uris", `Give "name=URI" pairs.`, err)
+	if _, ok := uris[DefaultShard]; ok {
+		problem("shard-mongo-uris", "Name the shard otherwise.", "shard name %v is reserved", DefaultShard)
+	}
+	residencies, err := parsePairs(c.ShardResidencies)
+	parse("shard-residencies", `Give "residency=shard" pairs.`, err)
+	for residency, name := range residencies {
+		_, shard := shards[name]
+		_, uri := uris[name]
+		if !shard && !uri && name != DefaultShard {
+			problem("shard-residencies", "Name a shard given by -shards or -shard-mongo-uris, or default.", "%v is mapped to unknown shard %v", residency, name)
+		}
+	}
+
+	if c.HashWorkers <= 0 {
+		problem("hash-workers", "Set at least 1, such as the number of CPUs.", "%d workers cannot hash any password", c.HashWorkers)
+	}
+	if c.HashQueue < 0 {
+		problem("hash-queue", "Set 0 or more.", "negative")
+	}
+	if c.LoginCacheTTL > 0 && c.LoginCacheSize <= 0 {
+		problem("login-cache-size", "Set a size, or -login-cache-ttl=0 to disable the cache.", "the cache is enabled but holds no users")
+	}
+
+	_, err = middleware.ParseNetworks(c.TrustedProxies)
+	parse("trusted-proxies", "Give CIDRs or addresses, such as 10.0.0.0/8.", err)
+	_, err = middleware.ParseRouteLimits(c.ConcurrencyRoutes)
+	parse("concurrency-routes", `Give "route=limit" pairs.`, err)
+	maxAges, err := middleware.ParseRouteMaxAges(c.CacheRoutes)
+	parse("cache-routes", `Give "route=duration" pairs.`, err)
+	if err == nil && len(maxAges) == 0 && c.ResponseCacheSize > 0 {
+		problem("response-cache-size", "Set -cache-routes to choose the routes cached.", "set but no route is cached")
+	}
+	_, err = middleware.ParseSLOs(c.SLORoutes)
+	parse("slo-routes", `Give "route=latency/availability" pairs, such as "login=300ms/99.9".`, err)
+	_, err = bulkhead.ParseLimits(c.DBBulkheads)
+	parse("db-bulkheads", `Give "compartment=workers/queue" pairs, such as "lists=4/8".`, err)
+	if c.WriteBufferSize < 0 {
+		problem("write-buffer-size", "Set 0 or more.", "negative")
+	}
+	if c.WriteBufferSpool != "" && c.WriteBufferSize <= 0 {
+		problem("write-buffer-spool", "Set -write-buffer-size, or drop -write-buffer-spool.", "set but writes are not buffered")
+	}
+	if c.DBHedgeDelay < 0 {
+		problem("db-hedge-delay", "Set a delay, such as 50ms, or 0 to disable hedging.", "negative")
+	}
+	if c.DBHedgePercentile < 0 || c.DBHedgePercentile >= 100 {
+		problem("db-hedge-percentile", "Set a percentile such as 95, or 0.", "%v is not a percentile below 100", c.DBHedgePercentile)
+	} else if c.DBHedgePercentile > 0 && c.DBHedgeDelay == 0 {
+		problem("db-hedge-percentile", "Set -db-hedge-delay, used until enough reads are timed.", "set but hedging is disabled")
+	}
+
+	if c.MirrorPercent < 0 || c.MirrorPercent > 100 {
+		problem("mirror-percent", "Set a percentage from 0 to 100.", "%d is not a percentage", c.MirrorPercent)
+	}
+	if (c.SignupAddressLimit > 0 || c.SignupSubnetLimit > 0) && c.SignupWindow <= 0 {
+		problem("signup-window", "Set a window, such as 1h.", "registrations are limited over no window")
+	}
+	if c.DisposableDomains != "" && c.DisposableRefresh <= 0 {
+		problem("disposable-domains-refresh", "Set an interval, such as 24h.", "the disposable domain list is never read again")
+	}
+	if c.MetricsNamespace != "" && !metricNamePart.MatchString(c.MetricsNamespace) {
+		problem("metrics-namespace", "Use letters, digits and underscores, starting with a letter.", "%q is not valid in a metric name", c.MetricsNamespace)
+	}
+	if c.MetricsSubsystem != "" && !metricNamePart.MatchString(c.MetricsSubsystem) {
+		problem("metrics-subsystem", "Use letters, digits and underscores, starting with a letter.", "%q is not valid in a metric name", c.MetricsSubsystem)
+	}
+	writeLimits, err := ratelimit.ParseLimits(c.CustomerWriteLimits)
+	parse("customer-write-limits", `Give "operation=count/duration" pairs, such as "cards=10/1h".`, err)
+	if c.WriteLimitRedis != "" {
+		_, err := ratelimit.NewRedis(c.WriteLimitRedis, time.Second)
+		parse("write-limit-redis", "Give a URL such as redis://:password@localhost:6379.", err)
+		if len(writeLimits) == 0 {
+			problem("write-limit-redis", "Set -customer-write-limits to choose the writes limited.", "set but no write is limited")
+		}
+	}
+	switch signup.Action(c.SpamAction) {
+	case "", signup.Flag, signup.Challenge, signup.Reject:
+	default:
+		problem("spam-action", "Use flag, challenge or reject, or leave it empty.", "unknown action %q", c.SpamAction)
+	}
+	if c.SpamAction != "" && c.SpamThreshold <= 0 {
+		problem("spam-threshold", "Set a positive score, such as 1.", "every registration would be acted on")
+	}
+	if c.SpamAction != "" && c.SpamVelocityLimit > 0 && c.SpamVelocityWindow <= 0 {
+		problem("spam-velocity-window", "Set a window, such as 1h.", "not positive")
+	}
+	_, err = parseSCIMTargets(c.SCIMTargets, c.SCIMTargetTokens)
+	parse("scim-targets", `Give "name=URL" pairs, and "name=token" pairs of the same names in -scim-target-tokens.`, err)
+	if c.SCIMReconcileInterval < 0 {
+		problem("scim-reconcile-interval", "Set an interval, such as 24h, or 0 to disable reconciling.", "negative")
+	}
+	switch c.EventFormat {
+	case "json":
+	case "cloudevents":
+		if _, err := url.Parse(c.EventSource); err != nil || c.EventSource == "" {
+			problem("event-source", "Give a URI reference, such as /user or urn:example:user.", "%q is not a URI reference", c.EventSource)
+		}
+	default:
+		problem("event-format", "Use json or cloudevents.", "unknown format %q", c.EventFormat)
+	}
+	retention, err := db.ParseRetention(c.Retention)
+	parse("retention", `Give "data=age" pairs, such as "login-history=90d".`, err)
+	for _, kind := range []string{db.LoginHistory, db.AuditTrail} {
+		if retention[kind] > db.MaxRetention {
+			problem("retention", "Keep data at most 68 years, such as \"audit=10y\".", "%v is kept longer than the %v databases can expire", kind, db.MaxRetention)
+		}
+	}
+	if len(retention) > 0 && c.RetentionInterval <= 0 {
+		problem("retention-interval", "Set an interval, such as 1h.", "data would only be purged where the database expires it itself")
+	}
+	if c.GCDryRun && c.GCInterval <= 0 {
+		problem("gc-dry-run", "Set -gc-interval to schedule gc jobs, or drop -gc-dry-run.", "only applies to scheduled gc jobs, which are disabled")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problem("shutdown-timeout", "Set a timeout, such as 10s.", "in-flight requests would not be waited for")
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// metricNamePart matches namespaces and subsystems valid in metric names.
+var metricNamePart = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func nonEmpty(ss []string) []string {
+	var out []string
+	for _, s := range ss {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
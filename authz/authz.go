@@ -0,0 +1,167 @@
+// Package authz delegates authorization decisions to a policy engine, so
+// that who may do what can change without changing the service. Each
+// request is described as a subject acting on a resource, and the engine
+// allows or denies it.
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Actions, from the request method.
+const (
+	Read   = "read"
+	Create = "create"
+	Update = "update"
+	Delete = "delete"
+)
+
+var Decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "authz_decisions_total",
+	Help: "Number of authorization decisions, by result: allow, deny or error.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(Decisions)
+}
+
+// Subject is the caller. Unauthenticated callers, on routes the auth
+// policy leaves anonymous, have no user.
+type Subject struct {
+	Authenticated bool   `json:"authenticated"`
+	UserID        string `json:"userID,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Admin         bool   `json:"admin"`
+	ActAs         string `json:"act-as,omitempty"`
+}
+
+// Resource is what the request is for. Type and ID are the first two
+// segments of the path, such as "customers" and the customer ID.
+type Resource struct {
+	Path     string   `json:"path"`
+	Segments []string `json:"segments"`
+	Type     string   `json:"type"`
+	ID       string   `json:"id,omitempty"`
+}
+
+// Input describes a request to authorize.
+type Input struct {
+	Subject  Subject  `json:"subject"`
+	Resource Resource `json:"resource"`
+	Action   string   `json:"action"`
+	Method   string   `json:"method"`
+}
+
+// NewInput describes subject making r.
+func NewInput(subject Subject, r *http.Request) Input {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) == 1 && segments[0] == "" {
+		segments = []string{}
+	}
+	res := Resource{Path: r.URL.Path, Segments: segments}
+	if len(segments) > 0 {
+		res.Type = segments[0]
+	}
+	if len(segments) > 1 {
+		res.ID = segments[1]
+	}
+	return Input{Subject: subject, Resource: res, Action: Action(r.Method), Method: r.Method}
+}
+
+// Action returns the action of a request method.
+func Action(method string) string {
+	switch strings.ToUpper(method) {
+	case "POST":
+		return Create
+	case "PUT", "PATCH":
+		return Update
+	case "DELETE":
+		return Delete
+	}
+	return Read
+}
+
+// Authorizer decides whether requests are allowed.
+type Authorizer interface {
+	Authorize(ctx context.Context, in Input) (bool, error)
+}
+
+// Authorize asks a for a decision on in, counting the result.
+func Authorize(ctx context.Context, a Authorizer, in Input) (bool, error) {
+	allowed, err := a.Authorize(ctx, in)
+	result := "deny"
+	switch {
+	case err != nil:
+		result = "error"
+	case allowed:
+		result = "allow"
+	}
+	Decisions.WithLabelValues(result).Inc()
+	return allowed, err
+}
+
+// OPA asks an Open Policy Agent for decisions through its data API. URL is
+// the decision document, such as http://localhost:8181/v1/data/user/allow.
+// Policies are loaded into the agent, from files or bundles, rather than
+// into the service.
+type OPA struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewOPA returns an OPA giving up on decisions after timeout.
+func NewOPA(url string, timeout time.Duration) *OPA {
+	return &OPA{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+// Authorize implements Authorizer. The decision is either a boolean or an
+// object with an "allow" boolean; an undefined decision denies.
+func (o *OPA) Authorize(ctx context.Context, in Input) (bool, error) {
+	body, err := json.Marshal(struct {
+		Input Input `json:"input"`
+	}{in})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("policy engine returned %v", resp.Status)
+	}
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("policy engine decision: %v", err)
+	}
+	if len(decision.Result) == 0 {
+		return false, nil
+	}
+	var allowed bool
+	if json.Unmarshal(decision.Result, &allowed) == nil {
+		return allowed, nil
+	}
+	var doc struct {
+		Allow bool `json:"allow"`
+	}
+	if err := json.Unmarshal(decision.Result, &doc); err != nil {
+		return false, fmt.Errorf("policy engine decision: %v", err)
+	}
+	return doc.Allow, nil
+}
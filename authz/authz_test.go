@@ -0,0 +1,66 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewInput(t *testing.T) {
+	in := NewInput(Subject{Authenticated: true, UserID: "u1"}, httptest.NewRequest("PATCH", "/customers/u1/addresses", nil))
+	if in.Action != Update || in.Method != "PATCH" || in.Resource.Type != "customers" || in.Resource.ID != "u1" || len(in.Resource.Segments) != 3 {
+		t.Errorf("Unexpected input %+v", in)
+	}
+	in = NewInput(Subject{}, httptest.NewRequest("GET", "/", nil))
+	if in.Action != Read || in.Resource.Type != "" || len(in.Resource.Segments) != 0 {
+		t.Errorf("Unexpected input for the root %+v", in)
+	}
+}
+
+func TestOPA(t *testing.T) {
+	var got Input
+	results := map[string]string{
+		"admin":   `{"result": true}`,
+		"alice":   `{"result": {"allow": true, "reason": "owner"}}`,
+		"bob":     `{"result": false}`,
+		"nobody":  `{}`,
+		"garbage": `{"result": "yes"}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/data/user/allow" || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		var body struct {
+			Input Input `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		got = body.Input
+		if got.Subject.Username == "down" {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(results[got.Subject.Username]))
+	}))
+	defer srv.Close()
+
+	o := NewOPA(srv.URL+"/v1/data/user/allow", time.Second)
+	r := httptest.NewRequest("DELETE", "/customers/u1", nil)
+	for username, want := range map[string]bool{"admin": true, "alice": true, "bob": false, "nobody": false} {
+		allowed, err := o.Authorize(context.Background(), NewInput(Subject{Username: username}, r))
+		if err != nil || allowed != want {
+			t.Errorf("Expected %v for %v, received %v %v", want, username, allowed, err)
+		}
+	}
+	if got.Action != Delete || got.Resource.ID != "u1" {
+		t.Errorf("Expected the request posted as input, received %+v", got)
+	}
+	for _, username := range []string{"garbage", "down"} {
+		if allowed, err := o.Authorize(context.Background(), NewInput(Subject{Username: username}, r)); err == nil || allowed {
+			t.Errorf("Expected an error for %v, received %v %v", username, allowed, err)
+		}
+	}
+}
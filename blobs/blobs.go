@@ -0,0 +1,137 @@
+// Package blobs stores opaque files, such as profile images, on the local
+// filesystem or in S3.
+package blobs
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrNotFound   = errors.New("Blob not found")
+	ErrInvalidKey = errors.New("Invalid blob key")
+)
+
+// Blob is a stored file and its media type.
+type Blob struct {
+	ContentType string
+	Data        []byte
+}
+
+// Store saves blobs under slash separated keys. Putting an existing key
+// replaces its blob.
+type Store interface {
+	Put(ctx context.Context, key string, b Blob) error
+	// Get returns ErrNotFound if nothing is stored under key.
+	Get(ctx context.Context, key string) (Blob, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	store      = env("BLOB_STORE", "file")
+	dir        = env("BLOB_DIR", filepath.Join(os.TempDir(), "user-blobs"))
+	s3Bucket   = os.Getenv("BLOB_S3_BUCKET")
+	s3Endpoint = os.Getenv("BLOB_S3_ENDPOINT")
+)
+
+// RegisterFlags registers the flags choosing the store on fs, with defaults
+// from the environment.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&store, "blob-store", store, "Where blobs such as profile images are stored: file or s3. Empty disables them")
+	fs.StringVar(&dir, "blob-dir", dir, "Directory blobs are stored in, for the file store")
+	fs.StringVar(&s3Bucket, "blob-s3-bucket", s3Bucket, "Bucket blobs are stored in, for the s3 store. AWS_REGION and the AWS_ACCESS_KEY_ID family of variables authenticate")
+	fs.StringVar(&s3Endpoint, "blob-s3-endpoint", s3Endpoint, "S3 compatible endpoint, such as MinIO. Defaults to the regional AWS endpoint")
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Selected returns the kind of store selected by flags.
+func Selected() string {
+	return store
+}
+
+// Default returns the store selected by flags, or nil if none is.
+func Default() (Store, error) {
+	switch store {
+	case "":
+		return nil, nil
+	case "file":
+		return Dir(dir), nil
+	case "s3":
+		return NewS3(os.Getenv("AWS_REGION"), s3Bucket, s3Endpoint), nil
+	}
+	return nil, fmt.Errorf("unknown blob store %q", store)
+}
+
+// Dir stores blobs as files below a directory. Media types are not kept but
+// detected from the data when read.
+type Dir string
+
+func (d Dir) path(key string) (string, error) {
+	p := filepath.FromSlash(key)
+	if !filepath.IsLocal(p) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(string(d), p), nil
+}
+
+// Put writes the blob to a temporary file first, so readers never see a
+// partial blob.
+func (d Dir) Put(ctx context.Context, key string, b Blob) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b.Data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (d Dir) Get(ctx context.Context, key string) (Blob, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return Blob{}, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return Blob{}, ErrNotFound
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+	return Blob{ContentType: http.DetectContentType(data), Data: data}, nil
+}
+
+func (d Dir) Delete(ctx context.Context, key string) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package blobs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mikesay/user/sigv4"
+)
+
+var png = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	if err := s.Put(ctx, "avatars/a/1", Blob{ContentType: "image/png", Data: png}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Get(ctx, "avatars/a/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ContentType != "image/png" || string(b.Data) != string(png) {
+		t.Errorf("Expected the stored image, received %v %q", b.ContentType, b.Data)
+	}
+	if err := s.Delete(ctx, "avatars/a/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "avatars/a/1"); err != ErrNotFound {
+		t.Errorf("Expected deleted blob not to be found, received %v", err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	d := Dir(t.TempDir())
+	testStore(t, d)
+	if err := d.Put(context.Background(), "../escape", Blob{}); err != ErrInvalidKey {
+		t.Errorf("Expected key outside the directory to be refused, received %v", err)
+	}
+}
+
+func TestS3(t *testing.T) {
+	var mtx sync.Mutex
+	objects := map[string]Blob{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.HasPrefix(r.URL.Path, "/bucket/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch r.Method {
+		case "PUT":
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = Blob{ContentType: r.Header.Get("Content-Type"), Data: data}
+		case "GET":
+			b, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", b.ContentType)
+			w.Write(b.Data)
+		case "DELETE":
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+	s := NewS3("eu-west-1", "bucket", srv.URL)
+	s.Auth = sigv4.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	testStore(t, s)
+}
@@ -0,0 +1,95 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/sigv4"
+)
+
+// S3 stores blobs as objects in an S3 bucket, addressed path-style so that
+// S3 compatible stores such as MinIO work too.
+type S3 struct {
+	Region string
+	Bucket string
+	// Endpoint defaults to the regional S3 endpoint.
+	Endpoint string
+	Auth     sigv4.Credentials
+	Client   *http.Client
+}
+
+// NewS3 returns an S3 store authenticating with the standard AWS
+// environment variables.
+func NewS3(region, bucket, endpoint string) *S3 {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", region)
+	}
+	return &S3{Region: region, Bucket: bucket, Endpoint: endpoint, Auth: sigv4.FromEnv()}
+}
+
+func (s *S3) do(ctx context.Context, method, key string, b Blob) (*http.Response, error) {
+	u := strings.TrimSuffix(s.Endpoint, "/") + "/" + url.PathEscape(s.Bucket) + "/" + (&url.URL{Path: key}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(b.Data))
+	if err != nil {
+		return nil, err
+	}
+	if b.ContentType != "" {
+		req.Header.Set("Content-Type", b.ContentType)
+	}
+	s.Auth.Sign(req, b.Data, s.Region, "s3", time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+func (s *S3) Put(ctx context.Context, key string, b Blob) error {
+	res, err := s.do(ctx, "PUT", key, b)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3: putting %v: %v", key, res.Status)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (Blob, error) {
+	res, err := s.do(ctx, "GET", key, Blob{})
+	if err != nil {
+		return Blob{}, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Blob{}, ErrNotFound
+	default:
+		return Blob{}, fmt.Errorf("s3: getting %v: %v", key, res.Status)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return Blob{}, err
+	}
+	return Blob{ContentType: res.Header.Get("Content-Type"), Data: data}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, "DELETE", key, Blob{})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3: deleting %v: %v", key, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package clock
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	if !f.Now().Equal(start) {
+		t.Errorf("Expected %v, received %v", start, f.Now())
+	}
+	f.Advance(time.Hour)
+	if got := f.Now().Sub(start); got != time.Hour {
+		t.Errorf("Expected the clock advanced an hour, received %v", got)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	if b := Bytes(bytes.NewReader([]byte{1, 2, 3}), 2); !bytes.Equal(b, []byte{1, 2}) {
+		t.Errorf("Expected bytes read from the rng, received %v", b)
+	}
+	if a, b := Bytes(nil, 16), Bytes(nil, 16); bytes.Equal(a, b) {
+		t.Error("Expected random bytes by default")
+	}
+}
@@ -0,0 +1,363 @@
+package bulkhead
+
+// bulkhead.go contains a Database decorator running each kind of query in a
+// compartment of its own, with a bounded number of workers and a bounded
+// queue, so that one pathological kind of query, such as slow searches,
+// cannot take every database connection from logins and profile reads.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Compartments queries are run in.
+const (
+	// Reads are reads of single customers, addresses and cards.
+	Reads = "reads"
+	// Lists are listings, searches, exports and duplicate scans.
+	Lists = "lists"
+	// Writes change customers, addresses and cards.
+	Writes = "writes"
+	// Logins record and read login history.
+	Logins = "logins"
+	// Jobs are background jobs and maintenance.
+	Jobs = "jobs"
+)
+
+var compartments = []string{Reads, Lists, Writes, Logins, Jobs}
+
+var (
+	ErrRejected = users.NewError(users.CodeOverloaded, "Database busy, try again later")
+
+	Rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_bulkhead_rejected_total",
+		Help: "Number of queries refused because their compartment's queue was full.",
+	}, []string{"compartment"})
+	Queued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_bulkhead_queued",
+		Help: "Number of queries waiting for a worker of their compartment.",
+	}, []string{"compartment"})
+)
+
+func init() {
+	prometheus.MustRegister(Rejected)
+	prometheus.MustRegister(Queued)
+}
+
+// Limit bounds a compartment to Workers queries at once, with up to Queue
+// more waiting.
+type Limit struct {
+	Workers int
+	Queue   int
+}
+
+// ParseLimits parses compartment=workers/queue pairs, such as
+// "lists=4/8".
+func ParseLimits(ss []string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, pair := range ss {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, l, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		w, q, ok2 := strings.Cut(l, "/")
+		workers, err := strconv.Atoi(strings.TrimSpace(w))
+		queue, err2 := strconv.Atoi(strings.TrimSpace(q))
+		if !ok || !ok2 || err != nil || err2 != nil || workers <= 0 || queue < 0 {
+			return nil, fmt.Errorf("invalid bulkhead %q", pair)
+		}
+		if !known(name) {
+			return nil, fmt.Errorf("unknown bulkhead compartment %q, expected one of %v", name, strings.Join(compartments, ", "))
+		}
+		limits[name] = Limit{Workers: workers, Queue: queue}
+	}
+	return limits, nil
+}
+
+func known(name string) bool {
+	for _, c := range compartments {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+type pool struct {
+	workers  chan struct{}
+	admitted chan struct{}
+}
+
+// DB serves the embedded Database, running queries in the compartment of
+// their kind. Compartments without a limit are not bounded. Init, Indexes
+// and Ping are never bounded, so that health checks report the database
+// itself.
+type DB struct {
+	db.Database
+
+	pools map[string]*pool
+}
+
+// New returns a DB bounding the compartments of d to limits.
+func New(d db.Database, limits map[string]Limit) *DB {
+	b := &DB{Database: d, pools: make(map[string]*pool, len(limits))}
+	for name, l := range limits {
+		b.pools[name] = &pool{
+			workers:  make(chan struct{}, l.Workers),
+			admitted: make(chan struct{}, l.Workers+l.Queue),
+		}
+	}
+	return b
+}
+
+// acquire takes a worker of compartment, queueing for one if the queue has
+// room, and returns the function releasing it.
+func (d *DB) acquire(compartment string) (release func(), err error) {
+	p := d.pools[compartment]
+	if p == nil {
+		return func() {}, nil
+	}
+	select {
+	case p.admitted <- struct{}{}:
+	default:
+		Rejected.WithLabelValues(compartment).Inc()
+		return nil, ErrRejected
+	}
+	Queued.WithLabelValues(compartment).Inc()
+	p.workers <- struct{}{}
+	Queued.WithLabelValues(compartment).Dec()
+	return func() {
+		<-p.workers
+		<-p.admitted
+	}, nil
+}
+
+func run[T any](d *DB, compartment string, query func() (T, error)) (T, error) {
+	release, err := d.acquire(compartment)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer release()
+	return query()
+}
+
+func (d *DB) do(compartment string, query func() error) error {
+	release, err := d.acquire(compartment)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return query()
+}
+
+// Reload reloads the credentials of the embedded Database, if it supports
+// it.
+func (d *DB) Reload() error {
+	if r, ok := d.Database.(db.Reloader); ok {
+		return r.Reload()
+	}
+	return nil
+}
+
+// IDs returns the ID scheme of the embedded Database, if it declares one.
+func (d *DB) IDs() ids.Generator {
+	if g, ok := d.Database.(db.IDGenerator); ok {
+		return g.IDs()
+	}
+	return nil
+}
+
+// Reserve reserves the key of kind on the embedded Database.
+func (d *DB) Reserve(kind, key string) (bool, error) {
+	return db.Reserve(d.Database, kind, key)
+}
+
+func (d *DB) Release(kind, key string) error {
+	return db.Release(d.Database, kind, key)
+}
+
+// MapIDs records the new IDs of entities of kind with the embedded Database.
+func (d *DB) MapIDs(kind string, ids map[string]string) error {
+	return db.MapIDs(d.Database, kind, ids)
+}
+
+func (d *DB) MappedID(kind, old string) (string, error) {
+	return db.MappedID(d.Database, kind, old)
+}
+
+// Purge purges the data of the embedded Database, if it is a Purger.
+func (d *DB) Purge(kind string, before time.Time) (int64, error) {
+	if p, ok := d.Database.(db.Purger); ok {
+		return p.Purge(kind, before)
+	}
+	return 0, nil
+}
+
+func (d *DB) GetUserWithAttributes(id string) (users.User, error) {
+	return run(d, Reads, func() (users.User, error) { return db.ReadUserWithAttributes(d.Database, id) })
+}
+
+func (d *DB) GetUserByName(name string) (users.User, error) {
+	return run(d, Reads, func() (users.User, error) { return d.Database.GetUserByName(name) })
+}
+
+func (d *DB) GetUserByEmail(email string) (users.User, error) {
+	return run(d, Reads, func() (users.User, error) { return d.Database.GetUserByEmail(email) })
+}
+
+func (d *DB) ExistsUsername(name string) (bool, error) {
+	return run(d, Reads, func() (bool, error) { return d.Database.ExistsUsername(name) })
+}
+
+func (d *DB) ExistsEmail(email string) (bool, error) {
+	return run(d, Reads, func() (bool, error) { return d.Database.ExistsEmail(email) })
+}
+
+func (d *DB) GetUser(id string) (users.User, error) {
+	return run(d, Reads, func() (users.User, error) { return d.Database.GetUser(id) })
+}
+
+func (d *DB) GetUserAttributes(u *users.User) error {
+	return d.do(Reads, func() error { return d.Database.GetUserAttributes(u) })
+}
+
+func (d *DB) GetAddress(id string) (users.Address, error) {
+	return run(d, Reads, func() (users.Address, error) { return d.Database.GetAddress(id) })
+}
+
+func (d *DB) GetCustomerAddresses(userid string) ([]users.Address, error) {
+	return run(d, Reads, func() ([]users.Address, error) { return d.Database.GetCustomerAddresses(userid) })
+}
+
+func (d *DB) GetCard(id string) (users.Card, error) {
+	return run(d, Reads, func() (users.Card, error) { return d.Database.GetCard(id) })
+}
+
+func (d *DB) GetCustomerCards(userid string) ([]users.Card, error) {
+	return run(d, Reads, func() ([]users.Card, error) { return d.Database.GetCustomerCards(userid) })
+}
+
+func (d *DB) GetUsers(l db.ListOptions) ([]users.User, error) {
+	return run(d, Lists, func() ([]users.User, error) { return d.Database.GetUsers(l) })
+}
+
+func (d *DB) SearchUsers(q db.Query) ([]users.User, error) {
+	return run(d, Lists, func() ([]users.User, error) { return d.Database.SearchUsers(q) })
+}
+
+// CountUsers is a list, as counting may scan as many users as listing.
+func (d *DB) CountUsers(q db.Query) (int64, error) {
+	return run(d, Lists, func() (int64, error) { return d.Database.CountUsers(q) })
+}
+
+// ExportUsers holds a worker for the whole export.
+func (d *DB) ExportUsers(q db.Query, cursor string, f func(users.User, string) error) error {
+	return d.do(Lists, func() error { return d.Database.ExportUsers(q, cursor, f) })
+}
+
+func (d *DB) FindDuplicates(offset, limit int) ([]db.Duplicate, error) {
+	return run(d, Lists, func() ([]db.Duplicate, error) { return d.Database.FindDuplicates(offset, limit) })
+}
+
+func (d *DB) GetAddresses(l db.ListOptions) ([]users.Address, error) {
+	return run(d, Lists, func() ([]users.Address, error) { return d.Database.GetAddresses(l) })
+}
+
+func (d *DB) GetCards(l db.ListOptions) ([]users.Card, error) {
+	return run(d, Lists, func() ([]users.Card, error) { return d.Database.GetCards(l) })
+}
+
+func (d *DB) CreateUser(u *users.User) error {
+	return d.do(Writes, func() error { return d.Database.CreateUser(u) })
+}
+
+func (d *DB) ImportUser(u *users.User) error {
+	return d.do(Writes, func() error { return d.Database.ImportUser(u) })
+}
+
+func (d *DB) UpdateAvatar(id, key string) error {
+	return d.do(Writes, func() error { return d.Database.UpdateAvatar(id, key) })
+}
+
+func (d *DB) UpdateProfile(u *users.User) error {
+	return d.do(Writes, func() error { return d.Database.UpdateProfile(u) })
+}
+
+func (d *DB) AddTag(id, tag string) error {
+	return d.do(Writes, func() error { return d.Database.AddTag(id, tag) })
+}
+
+func (d *DB) RemoveTag(id, tag string) error {
+	return d.do(Writes, func() error { return d.Database.RemoveTag(id, tag) })
+}
+
+func (d *DB) CreateAddress(a *users.Address, userid string) error {
+	return d.do(Writes, func() error { return d.Database.CreateAddress(a, userid) })
+}
+
+func (d *DB) CreateCard(c *users.Card, userid string) error {
+	return d.do(Writes, func() error { return d.Database.CreateCard(c, userid) })
+}
+
+func (d *DB) UpdateCardStatus(id, status string, flag *users.CardFlag) error {
+	return d.do(Writes, func() error { return d.Database.UpdateCardStatus(id, status, flag) })
+}
+
+func (d *DB) Delete(entity, id string) error {
+	return d.do(Writes, func() error { return d.Database.Delete(entity, id) })
+}
+
+func (d *DB) UpdateLastLogin(id string) error {
+	return d.do(Logins, func() error { return d.Database.UpdateLastLogin(id) })
+}
+
+func (d *DB) CreateLoginAttempt(l *users.LoginAttempt) error {
+	return d.do(Logins, func() error { return d.Database.CreateLoginAttempt(l) })
+}
+
+func (d *DB) GetLoginAttempts(userid string) ([]users.LoginAttempt, error) {
+	return run(d, Logins, func() ([]users.LoginAttempt, error) { return d.Database.GetLoginAttempts(userid) })
+}
+
+func (d *DB) CreateNote(n *users.Note) error {
+	return d.do(Writes, func() error { return d.Database.CreateNote(n) })
+}
+
+func (d *DB) GetNotes(userid string, offset, limit int) ([]users.Note, error) {
+	return run(d, Lists, func() ([]users.Note, error) { return d.Database.GetNotes(userid, offset, limit) })
+}
+
+func (d *DB) NormalizeUsernames(normalize func(string) string) (int, error) {
+	return run(d, Jobs, func() (int, error) { return d.Database.NormalizeUsernames(normalize) })
+}
+
+func (d *DB) CollectOrphans(before time.Time, dryRun bool) (db.Orphans, error) {
+	return run(d, Jobs, func() (db.Orphans, error) { return d.Database.CollectOrphans(before, dryRun) })
+}
+
+func (d *DB) CreateJob(j *jobs.Job) error {
+	return d.do(Jobs, func() error { return d.Database.CreateJob(j) })
+}
+
+func (d *DB) GetJob(id string) (jobs.Job, error) {
+	return run(d, Jobs, func() (jobs.Job, error) { return d.Database.GetJob(id) })
+}
+
+func (d *DB) UpdateJob(j *jobs.Job, leaseUntil time.Time) error {
+	return d.do(Jobs, func() error { return d.Database.UpdateJob(j, leaseUntil) })
+}
+
+func (d *DB) ClaimJob(owner string, now, leaseUntil time.Time) (jobs.Job, error) {
+	return run(d, Jobs, func() (jobs.Job, error) { return d.Database.ClaimJob(owner, now, leaseUntil) })
+}
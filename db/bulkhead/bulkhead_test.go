@@ -0,0 +1,72 @@
+package bulkhead
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits([]string{" lists=4/8", "reads=32/0", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits[Lists] != (Limit{4, 8}) || limits[Reads] != (Limit{32, 0}) {
+		t.Errorf("Expected both limits, received %v", limits)
+	}
+	for _, s := range []string{"lists", "lists=4", "lists=0/8", "lists=4/-1", "searches=4/8"} {
+		if _, err := ParseLimits([]string{s}); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+// slowLists serves listings once release is closed, signalling started as
+// each begins.
+type slowLists struct {
+	db.Database
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowLists) GetUsers(db.ListOptions) ([]users.User, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return nil, nil
+}
+
+func (s *slowLists) GetUser(id string) (users.User, error) {
+	return users.User{UserID: id}, nil
+}
+
+func TestBulkhead(t *testing.T) {
+	s := &slowLists{started: make(chan struct{}, 2), release: make(chan struct{})}
+	d := New(s, map[string]Limit{Lists: {Workers: 1, Queue: 1}, Reads: {Workers: 1}})
+
+	done := make(chan error, 2)
+	for k := 0; k < 2; k++ {
+		go func() {
+			_, err := d.GetUsers(db.ListOptions{})
+			done <- err
+		}()
+	}
+	<-s.started
+	// One listing runs and the other waits, filling the compartment.
+	for len(d.pools[Lists].admitted) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := d.GetUsers(db.ListOptions{}); err != ErrRejected {
+		t.Errorf("Expected a listing beyond the queue refused, received %v", err)
+	}
+	if u, err := d.GetUser("a"); err != nil || u.UserID != "a" {
+		t.Errorf("Expected reads unaffected by listings, received %v", err)
+	}
+	close(s.release)
+	for k := 0; k < 2; k++ {
+		if err := <-done; err != nil {
+			t.Errorf("Expected the admitted listings served, received %v", err)
+		}
+	}
+}
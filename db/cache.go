@@ -0,0 +1,85 @@
+package db
+
+// cache.go contains the request-scoped read cache. Within one request each
+// distinct read reaches the database at most once; results, errors included,
+// are reused until the request ends. Writes do not invalidate it, so a
+// request sees the data as it first read it.
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/mikesay/user/timing"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	CacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_request_cache_hits_total",
+		Help: "Number of database reads answered from the request cache.",
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(CacheHits)
+}
+
+type cacheKey struct{}
+
+type cacheEntry struct {
+	v   interface{}
+	err error
+}
+
+type requestCache struct {
+	mtx     sync.Mutex
+	entries map[[2]string]cacheEntry
+}
+
+// WithRequestCache returns a copy of ctx in which reads are memoized.
+func WithRequestCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheKey{}, &requestCache{entries: make(map[[2]string]cacheEntry)})
+}
+
+// cached returns the result of read for method and arg, calling it only if
+// ctx carries no result for them yet. Reads are timed as the database's;
+// results from the cache are not.
+func cached(ctx context.Context, method, arg string, read func() (interface{}, error)) (interface{}, error) {
+	c, _ := ctx.Value(cacheKey{}).(*requestCache)
+	if c == nil {
+		defer timing.Database(ctx)()
+		return read()
+	}
+	key := [2]string{method, arg}
+	c.mtx.Lock()
+	e, ok := c.entries[key]
+	c.mtx.Unlock()
+	if ok {
+		CacheHits.WithLabelValues(method).Inc()
+		return e.v, e.err
+	}
+	done := timing.Database(ctx)
+	v, err := read()
+	done()
+	c.mtx.Lock()
+	c.entries[key] = cacheEntry{v, err}
+	c.mtx.Unlock()
+	return v, err
+}
+
+// cachedUser memoizes a user read. Callers get their own copy of the
+// attribute slices.
+func cachedUser(ctx context.Context, method, arg string, read func() (users.User, error)) (users.User, error) {
+	v, err := cached(ctx, method, arg, func() (interface{}, error) { return read() })
+	u, _ := v.(users.User)
+	u.Addresses = slices.Clone(u.Addresses)
+	u.Cards = slices.Clone(u.Cards)
+	return u, err
+}
+
+type attributes struct {
+	addresses []users.Address
+	cards     []users.Card
+}
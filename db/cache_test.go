@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mikesay/user/users"
+)
+
+type readCounter struct {
+	fake
+	reads int
+}
+
+func (c *readCounter) GetUser(id string) (users.User, error) {
+	c.reads++
+	return users.User{UserID: id, Addresses: []users.Address{TestAddress}}, nil
+}
+
+func TestRequestCache(t *testing.T) {
+	c := &readCounter{}
+	prev := DefaultDb
+	DefaultDb = c
+	defer func() { DefaultDb = prev }()
+
+	ctx := WithRequestCache(context.Background())
+	u, err := GetUser(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Addresses[0].Street = "changed"
+	u, err = GetUser(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.reads != 1 {
+		t.Errorf("Expected a single read, received %v", c.reads)
+	}
+	if u.Addresses[0].Street != TestAddress.Street {
+		t.Error("Expected cached user not to share addresses with callers")
+	}
+	GetUser(ctx, "b")
+	GetUser(context.Background(), "a")
+	if c.reads != 3 {
+		t.Errorf("Expected uncached reads to reach the db, received %v reads", c.reads)
+	}
+}
@@ -0,0 +1,161 @@
+package db
+
+// cursor.go contains the cursors of keyset pagination. A cursor holds the
+// position of the last result of a page, as its value in the field the list
+// is sorted by and its ID, so that the next page starts after it however
+// many results were inserted or deleted before it in the meantime. Lists
+// too long to hold in memory are read a batch at a time the same way.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Cursor is the position after a result in a list.
+type Cursor struct {
+	Sort       string
+	Descending bool
+	// Value is the result's value in the Sort field, a string or a
+	// time.Time. It is nil for lists in ID order.
+	Value interface{}
+	ID    string
+}
+
+// wireCursor is the encoded form of a Cursor, keeping the type of its value.
+type wireCursor struct {
+	Sort       string     `json:"s,omitempty"`
+	Descending bool       `json:"d,omitempty"`
+	String     *string    `json:"v,omitempty"`
+	Time       *time.Time `json:"t,omitempty"`
+	ID         string     `json:"i"`
+}
+
+// String encodes the cursor as an opaque URL safe token.
+func (c Cursor) String() string {
+	w := wireCursor{Sort: c.Sort, Descending: c.Descending, ID: c.ID}
+	switch v := c.Value.(type) {
+	case string:
+		w.String = &v
+	case time.Time:
+		w.Time = &v
+	}
+	b, _ := json.Marshal(w)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// After returns the token of the cursor after v, a result of the list l.
+func After(l ListOptions, v interface{}) string {
+	c := Cursor{Sort: l.Sort, Descending: l.Descending}
+	c.ID, _ = SortValue(v, "id").(string)
+	if l.Sort != "" {
+		c.Value = SortValue(v, l.Sort)
+	}
+	return c.String()
+}
+
+// ListCursor decodes l.After, returning nil if it is empty. Cursors of
+// another list order are refused with ErrInvalidCursor.
+func ListCursor(l ListOptions) (*Cursor, error) {
+	if l.After == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(l.After)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var w wireCursor
+	if err := json.Unmarshal(b, &w); err != nil || w.ID == "" || w.Sort != l.Sort || w.Descending != l.Descending {
+		return nil, ErrInvalidCursor
+	}
+	c := &Cursor{Sort: w.Sort, Descending: w.Descending, ID: w.ID}
+	switch {
+	case w.String != nil:
+		c.Value = *w.String
+	case w.Time != nil:
+		c.Value = *w.Time
+	}
+	if (c.Value == nil) != (c.Sort == "") {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// SortValue returns the field of the struct v with the given JSON name, as
+// lists are sorted by JSON names, or nil if it has none.
+func SortValue(v interface{}, name string) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < rv.NumField(); i++ {
+		tag, _, _ := strings.Cut(rv.Type().Field(i).Tag.Get("json"), ",")
+		if tag == name {
+			return rv.Field(i).Interface()
+		}
+	}
+	return nil
+}
+
+// Batched reports whether the list l may be longer than MaxListDecoded, and
+// so must be read with Batches.
+func Batched(l ListOptions) bool {
+	return MaxListDecoded > 0 && (l.Limit == 0 || l.Limit > MaxListDecoded)
+}
+
+// capped limits l to MaxListDecoded results.
+func capped(l ListOptions) ListOptions {
+	if Batched(l) {
+		l.Limit = MaxListDecoded
+	}
+	return l
+}
+
+// bounded reads the list l with list, decoding at most one result past
+// MaxListDecoded. A longer list is refused with ErrListTooLong rather than
+// cut short; it is read with Batches instead.
+func bounded[T any](l ListOptions, list func(ListOptions) ([]T, error)) ([]T, error) {
+	if !Batched(l) {
+		return list(l)
+	}
+	l.Limit = MaxListDecoded + 1
+	results, err := list(l)
+	if err == nil && len(results) > MaxListDecoded {
+		return nil, ErrListTooLong
+	}
+	return results, err
+}
+
+// Batches calls f with the list l, as read by list, in batches of at most
+// MaxListDecoded results. Each batch continues after the last one's cursor,
+// so results inserted or deleted meanwhile neither repeat nor shift others
+// out of the list.
+func Batches[T any](l ListOptions, list func(ListOptions) ([]T, error), f func([]T) error) error {
+	left := l.Limit
+	for {
+		b := capped(l)
+		if left > 0 && b.Limit > left {
+			b.Limit = left
+		}
+		batch, err := list(b)
+		if err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			if err := f(batch); err != nil {
+				return err
+			}
+		}
+		if b.Limit == 0 || len(batch) < b.Limit {
+			return nil
+		}
+		if left > 0 {
+			if left -= len(batch); left == 0 {
+				return nil
+			}
+		}
+		l.Offset, l.After = 0, After(l, batch[len(batch)-1])
+	}
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/users"
+)
+
+func TestListCursor(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		l    ListOptions
+		last interface{}
+		want Cursor
+	}{
+		{ListOptions{}, users.User{UserID: "u1"}, Cursor{ID: "u1"}},
+		{ListOptions{Sort: "lastName", Descending: true}, users.User{UserID: "u1", LastName: "Doe"}, Cursor{Sort: "lastName", Descending: true, Value: "Doe", ID: "u1"}},
+		{ListOptions{Sort: "createdAt"}, users.Card{ID: "c1", CreatedAt: created}, Cursor{Sort: "createdAt", Value: created, ID: "c1"}},
+	} {
+		c.l.After = After(c.l, c.last)
+		got, err := ListCursor(c.l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != c.want {
+			t.Errorf("Expected %+v, received %+v", c.want, *got)
+		}
+	}
+	if c, err := ListCursor(ListOptions{}); c != nil || err != nil {
+		t.Errorf("Expected no cursor, received %v %v", c, err)
+	}
+
+	after := After(ListOptions{Sort: "lastName"}, users.User{UserID: "u1", LastName: "Doe"})
+	for _, l := range []ListOptions{
+		{Sort: "createdAt", After: after},
+		{Sort: "lastName", Descending: true, After: after},
+		{Sort: "lastName", After: "not a cursor"},
+		{After: Cursor{ID: "u1", Value: "Doe"}.String()},
+	} {
+		if _, err := ListCursor(l); err != ErrInvalidCursor {
+			t.Errorf("Expected %+v refused, received %v", l, err)
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	defer func(m int) { MaxListDecoded = m }(MaxListDecoded)
+	MaxListDecoded = 2
+	var all []users.Card
+	for _, id := range []string{"c1", "c2", "c3", "c4", "c5"} {
+		all = append(all, users.Card{ID: id})
+	}
+	list := func(l ListOptions) ([]users.Card, error) {
+		if l.Limit > MaxListDecoded {
+			t.Fatalf("Expected at most %v results asked for, received %v", MaxListDecoded, l.Limit)
+		}
+		c, err := ListCursor(l)
+		if err != nil {
+			return nil, err
+		}
+		cards := all[l.Offset:]
+		for c != nil && len(cards) > 0 && cards[0].ID <= c.ID {
+			cards = cards[1:]
+		}
+		return cards[:min(l.Limit, len(cards))], nil
+	}
+	for _, c := range []struct {
+		l    ListOptions
+		want []int
+	}{
+		{ListOptions{}, []int{2, 2, 1}},
+		{ListOptions{Limit: 3}, []int{2, 1}},
+		{ListOptions{Limit: 2}, []int{2}},
+		{ListOptions{Offset: 1, Limit: 4}, []int{2, 2}},
+		{ListOptions{Offset: 4, Limit: 10}, []int{1}},
+	} {
+		var sizes []int
+		var ids []string
+		err := Batches(c.l, list, func(batch []users.Card) error {
+			sizes = append(sizes, len(batch))
+			for _, card := range batch {
+				ids = append(ids, card.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(sizes, c.want) {
+			t.Errorf("Expected batches of %v for %+v, received %v", c.want, c.l, sizes)
+		}
+		for i, id := range ids {
+			if id != all[c.l.Offset+i].ID {
+				t.Errorf("Expected %v at %v for %+v, received %v", all[c.l.Offset+i].ID, i, c.l, id)
+			}
+		}
+	}
+}
+
+func TestBounded(t *testing.T) {
+	defer func(m int) { MaxListDecoded = m }(MaxListDecoded)
+	MaxListDecoded = 2
+	var asked int
+	list := func(n int) func(ListOptions) ([]users.Card, error) {
+		return func(l ListOptions) ([]users.Card, error) {
+			asked = l.Limit
+			cards := make([]users.Card, n)
+			if l.Limit > 0 {
+				cards = cards[:min(l.Limit, n)]
+			}
+			return cards, nil
+		}
+	}
+	if cards, err := bounded(ListOptions{}, list(2)); err != nil || len(cards) != 2 || asked != 3 {
+		t.Errorf("Expected a list within the cap read whole, received %v, %v asking for %v", len(cards), err, asked)
+	}
+	if _, err := bounded(ListOptions{}, list(5)); err != ErrListTooLong {
+		t.Errorf("Expected a list past the cap refused, received %v", err)
+	}
+	if cards, err := bounded(ListOptions{Limit: 2}, list(5)); err != nil || len(cards) != 2 || asked != 2 {
+		t.Errorf("Expected a page within the cap read as asked, received %v, %v asking for %v", len(cards), err, asked)
+	}
+}
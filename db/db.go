@@ -1,11 +1,19 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/timing"
 	"github.com/mikesay/user/users"
 )
 
@@ -14,35 +22,416 @@ import (
 type Database interface {
 	Init() error
 	GetUserByName(string) (users.User, error)
+	GetUserByEmail(string) (users.User, error)
 	GetUser(string) (users.User, error)
-	GetUsers() ([]users.User, error)
+	// GetUsers, GetAddresses and GetCards return the results listed by
+	// ListOptions. Pages continued with After neither skip nor repeat
+	// results, however many are inserted or deleted while a client pages
+	// through the list, which Offset does not guarantee.
+	GetUsers(ListOptions) ([]users.User, error)
+	SearchUsers(Query) ([]users.User, error)
+	// CountUsers returns how many users match q, without reading them.
+	CountUsers(Query) (int64, error)
+	// ExistsUsername and ExistsEmail report whether a user has the
+	// normalized username or email, as found by GetUserByName and
+	// GetUserByEmail, without reading them.
+	ExistsUsername(string) (bool, error)
+	ExistsEmail(string) (bool, error)
+	// ExportUsers calls f with each user matching q, in a stable order,
+	// stopping at the first error f returns. f also receives a cursor that
+	// resumes the export after its user; an empty cursor starts a new
+	// export. Resumed exports only return users that existed when the
+	// export started.
+	ExportUsers(q Query, cursor string, f func(u users.User, cursor string) error) error
+	FindDuplicates(offset, limit int) ([]Duplicate, error)
 	CreateUser(*users.User) error
+	ImportUser(*users.User) error
+	// NormalizeUsernames stores the normalized form of the username of
+	// users saved without one, returning how many were updated.
+	NormalizeUsernames(func(string) string) (int, error)
+	UpdateLastLogin(string) error
+	// UpdateAvatar sets the blob key of the user's profile image.
+	UpdateAvatar(id, key string) error
+	// UpdateProfile sets the names and email of the user with u's ID.
+	UpdateProfile(u *users.User) error
+	// AddTag and RemoveTag add a tag to the user or remove it. Adding a tag
+	// the user has, or removing one they do not, changes nothing.
+	AddTag(id, tag string) error
+	RemoveTag(id, tag string) error
+	// GetUserAttributes replaces the user's address and card references
+	// with the addresses and cards. When one of them cannot be read, the
+	// other is still returned, along with an *AttributeError.
 	GetUserAttributes(*users.User) error
 	GetAddress(string) (users.Address, error)
-	GetAddresses() ([]users.Address, error)
+	GetAddresses(ListOptions) ([]users.Address, error)
+	// GetCustomerAddresses returns the addresses owned by a user.
+	GetCustomerAddresses(string) ([]users.Address, error)
 	CreateAddress(*users.Address, string) error
 	GetCard(string) (users.Card, error)
-	GetCards() ([]users.Card, error)
+	GetCards(ListOptions) ([]users.Card, error)
+	// GetCustomerCards returns the cards owned by a user.
+	GetCustomerCards(string) ([]users.Card, error)
+	// UpdateCardStatus sets the card's status, with the flag explaining it
+	// or nil to clear the flag.
+	UpdateCardStatus(id, status string, flag *users.CardFlag) error
+	// CollectOrphans finds the addresses and cards created before the
+	// given time that no customer references, deleting them unless
+	// dryRun.
+	CollectOrphans(before time.Time, dryRun bool) (Orphans, error)
 	Delete(string, string) error
 	CreateCard(*users.Card, string) error
+	CreateLoginAttempt(*users.LoginAttempt) error
+	GetLoginAttempts(string) ([]users.LoginAttempt, error)
+	// CreateNote stores a note about the user it names, setting its ID and,
+	// unless it has one, its creation time. GetNotes returns the user's
+	// notes, newest first.
+	CreateNote(*users.Note) error
+	GetNotes(userid string, offset, limit int) ([]users.Note, error)
+	CreateJob(*jobs.Job) error
+	GetJob(string) (jobs.Job, error)
+	UpdateJob(*jobs.Job, time.Time) error
+	ClaimJob(string, time.Time, time.Time) (jobs.Job, error)
+	// Indexes compares the indexes the backend declares with those it has.
+	Indexes() ([]Index, error)
 	Ping() error
 }
 
+// Reloader is implemented by databases that can reload their credentials
+// without a restart.
+type Reloader interface {
+	Reload() error
+}
+
+// UserHydrator is implemented by databases that can read a user along with
+// their addresses and cards in a single query.
+type UserHydrator interface {
+	GetUserWithAttributes(id string) (users.User, error)
+}
+
+// ReadUserWithAttributes reads the user with their addresses and cards from
+// d, in a single query if d is a UserHydrator. Like GetUserAttributes, it
+// returns the user with an *AttributeError if only some attributes could
+// be read.
+func ReadUserWithAttributes(d Database, id string) (users.User, error) {
+	if h, ok := d.(UserHydrator); ok {
+		return h.GetUserWithAttributes(id)
+	}
+	u, err := d.GetUser(id)
+	if err != nil {
+		return u, err
+	}
+	return u, d.GetUserAttributes(&u)
+}
+
+// AttributeImporter is implemented by databases that can add an address or
+// card under the ID and timestamps it already has, as ImportUser does for
+// those of a new user.
+type AttributeImporter interface {
+	ImportAddress(a *users.Address, userid string) error
+	ImportCard(c *users.Card, userid string) error
+}
+
+// IDMapper is implemented by databases keeping the IDs entities had in the
+// database they were migrated from, so that links holding old IDs can still
+// be resolved.
+type IDMapper interface {
+	// MapIDs records the new IDs of entities of kind, such as customers,
+	// by their old IDs.
+	MapIDs(kind string, ids map[string]string) error
+	// MappedID returns the new ID of the entity of kind with the old ID,
+	// or ErrNotMapped.
+	MappedID(kind, old string) (string, error)
+}
+
+// Kinds of the IDs mapped by IDMappers.
+const (
+	CustomerIDs = "customer"
+	AddressIDs  = "address"
+	CardIDs     = "card"
+)
+
+// MapIDs records the new IDs of entities of kind with d, or returns
+// ErrNoIDMap if d is not an IDMapper.
+func MapIDs(d Database, kind string, ids map[string]string) error {
+	if m, ok := d.(IDMapper); ok {
+		return m.MapIDs(kind, ids)
+	}
+	return ErrNoIDMap
+}
+
+// MappedID returns the new ID d recorded for the entity of kind with the
+// old ID, or ErrNotMapped, as it does if d is not an IDMapper.
+func MappedID(d Database, kind, old string) (string, error) {
+	if m, ok := d.(IDMapper); ok {
+		return m.MappedID(kind, old)
+	}
+	return "", ErrNotMapped
+}
+
+// Reserver is implemented by databases that can hold short-lived
+// reservations of keys, such as usernames, so that databases spread over
+// several stores can keep them unique without racing.
+type Reserver interface {
+	// Reserve reserves the key of kind, reporting false if it is reserved
+	// already. Reservations not released run out after a while, so that
+	// those of crashed callers do not hold keys for good.
+	Reserve(kind, key string) (bool, error)
+	// Release releases the reservation of the key of kind.
+	Release(kind, key string) error
+}
+
 var (
-	database string
+	reservedMtx sync.Mutex
+	reserved    = make(map[string]bool)
+)
+
+// Reserve reserves the key of kind on d if it is a Reserver, or else only
+// within the process, where reservations last until released.
+func Reserve(d Database, kind, key string) (bool, error) {
+	if r, ok := d.(Reserver); ok {
+		return r.Reserve(kind, key)
+	}
+	reservedMtx.Lock()
+	defer reservedMtx.Unlock()
+	if reserved[kind+"/"+key] {
+		return false, nil
+	}
+	reserved[kind+"/"+key] = true
+	return true, nil
+}
+
+// Release releases the reservation Reserve made on d.
+func Release(d Database, kind, key string) error {
+	if r, ok := d.(Reserver); ok {
+		return r.Release(kind, key)
+	}
+	reservedMtx.Lock()
+	defer reservedMtx.Unlock()
+	delete(reserved, kind+"/"+key)
+	return nil
+}
+
+// IDGenerator is implemented by databases choosing the scheme of the IDs
+// they create.
+type IDGenerator interface {
+	IDs() ids.Generator
+}
+
+// ValidID reports whether id could name an entity of DefaultDb. Databases
+// that do not declare their scheme accept any ID.
+func ValidID(id string) bool {
+	if g, ok := DefaultDb.(IDGenerator); ok && g.IDs() != nil {
+		return g.IDs().Valid(id)
+	}
+	return true
+}
+
+// Orphans counts the addresses and cards found by CollectOrphans.
+type Orphans struct {
+	Addresses int `json:"addresses"`
+	Cards     int `json:"cards"`
+}
+
+// Add returns the sum of o and p.
+func (o Orphans) Add(p Orphans) Orphans {
+	return Orphans{Addresses: o.Addresses + p.Addresses, Cards: o.Cards + p.Cards}
+}
+
+// Query narrows the users returned by SearchUsers. Zero values are ignored.
+type Query struct {
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// InactiveSince matches users who have not logged in since the given
+	// time, including those created before it who never logged in.
+	InactiveSince time.Time
+	// InactiveDays asks for InactiveSince that many days ago. The service
+	// sets InactiveSince from it with its clock; databases ignore it.
+	InactiveDays int
+	// Username matches users whose normalized username is it, ignoring
+	// UsernamePrefix.
+	Username string
+	// UsernamePrefix matches users whose normalized username starts with it.
+	UsernamePrefix string
+	// EmailDomain matches users whose email is at the domain, ignoring case.
+	EmailDomain string
+	// Country matches users with an address in the country.
+	Country string
+	// Tag matches users carrying the tag.
+	Tag string
+}
+
+// ListOptions orders and pages the results of GetUsers, GetAddresses and
+// GetCards. Sort names a field by its JSON name; backends support the fields
+// they can sort by index and refuse others with ErrInvalidSort. Results with
+// the same value are ordered by ID. A zero Limit returns every result. Tag
+// narrows GetUsers to users carrying it and is ignored by the other lists.
+//
+// After is the token of a Cursor, returned by After for the last result of
+// the previous page; the list continues with the results following it in
+// order, by key rather than by count, and Offset skips results from there.
+// Backends refuse cursors of another order with ErrInvalidCursor.
+type ListOptions struct {
+	Sort       string
+	Descending bool
+	Offset     int
+	Limit      int
+	Tag        string
+	After      string
+}
+
+// Reasons users are reported as likely duplicates.
+const (
+	DuplicateEmail        = "email"
+	DuplicateNamePostcode = "name_postcode"
+	DuplicateCard         = "card"
+)
+
+// Duplicate is a group of users sharing an identifying attribute. Key is the
+// shared value, normalized; card numbers are replaced by a fingerprint.
+type Duplicate struct {
+	Reason  string   `json:"reason"`
+	Key     string   `json:"key"`
+	UserIDs []string `json:"userIDs"`
+}
+
+// Index states reported by Indexes.
+const (
+	IndexOK = "ok"
+	// IndexMissing is declared but not built.
+	IndexMissing = "missing"
+	// IndexMismatch is built under a declared name with other keys or
+	// options. It is not rebuilt automatically.
+	IndexMismatch = "mismatch"
+	// IndexUnknown is built but not declared.
+	IndexUnknown = "unknown"
+)
+
+// Index is the state of an index on a collection. Keys lists the indexed
+// fields with their direction, such as "userID:1,time:-1".
+type Index struct {
+	Collection string `json:"collection"`
+	Name       string `json:"name"`
+	Keys       string `json:"keys"`
+	Unique     bool   `json:"unique"`
+	State      string `json:"state"`
+}
+
+var (
+	database = os.Getenv("USER_DATABASE")
+	// UniqueEmail makes backends refuse a second user with the same
+	// normalized email.
+	UniqueEmail = os.Getenv("UNIQUE_EMAIL") == "true"
+	// MaxAddresses and MaxCards limit how many addresses and cards a user
+	// may hold. Zero means no limit.
+	MaxAddresses = envInt("MAX_ADDRESSES", 20)
+	MaxCards     = envInt("MAX_CARDS", 10)
+	// MaxListDecoded caps how many results a list call decodes into memory.
+	// Longer lists are read in batches, with Batches, and refused with
+	// ErrListTooLong otherwise. Zero means no cap.
+	MaxListDecoded = envInt("MAX_LIST_DECODED", 1000)
 	//DefaultDb is the database set for the microservice
 	DefaultDb Database
 	//DBTypes is a map of DB interfaces that can be used for this service
 	DBTypes = map[string]Database{}
+	// instances holds the registered databases that have been initialised
+	instances = map[string]Database{}
+	dbMtx     sync.RWMutex
 	//ErrNoDatabaseFound error returnes when database interface does not exists in DBTypes
 	ErrNoDatabaseFound = "No database with name %v registered"
 	//ErrNoDatabaseSelected is returned when no database was designated in the flag or env
 	ErrNoDatabaseSelected = errors.New("No DB selected")
+	//ErrInvalidSort is returned when a list is sorted by an unsupported field
+	ErrInvalidSort = users.NewError(users.CodeInvalidRequest, "Unsupported sort field")
+	//ErrInvalidCursor is returned when an export or list is resumed from a malformed cursor
+	ErrInvalidCursor = users.NewError(users.CodeInvalidRequest, "Invalid cursor")
+	//ErrIDConflict is returned when an imported entity's ID is already in use
+	ErrIDConflict = users.NewError(users.CodeIDConflict, "ID already exists")
+	//ErrUsernameTaken is returned when a user already has the normalized username
+	ErrUsernameTaken = users.NewError(users.CodeIDConflict, "Username already taken")
+	//ErrEmailTaken is returned when UniqueEmail is set and a user already has the email
+	ErrEmailTaken = users.NewError(users.CodeIDConflict, "Email already registered")
+	//ErrAddressLimit is returned when a user already holds MaxAddresses addresses
+	ErrAddressLimit = users.NewError(users.CodeAddressLimitExceeded, "Address limit per user reached")
+	//ErrCardLimit is returned when a user already holds MaxCards cards
+	ErrCardLimit = users.NewError(users.CodeCardLimitExceeded, "Card limit per user reached")
+	//ErrNotMapped is returned when no new ID was recorded for an old one
+	ErrNotMapped = errors.New("ID not mapped")
+	//ErrNoIDMap is returned when IDs are mapped with a database that is not an IDMapper
+	ErrNoIDMap = errors.New("database does not map IDs")
+	// ErrListTooLong is returned for lists and searches with more results
+	// than MaxListDecoded that are not read in batches.
+	ErrListTooLong = users.NewError(users.CodeInvalidRequest, "Too many results; narrow the query or page through it with limit")
 )
 
-func init() {
-	flag.StringVar(&database, "database", os.Getenv("USER_DATABASE"), "Database to use, Mongodb or ...")
+// Attributes of a user, as named in AttributeError.
+const (
+	AttrAddresses = "addresses"
+	AttrCards     = "cards"
+)
+
+// AttributeError reports a user attribute that could not be read. The
+// attribute is left empty.
+type AttributeError struct {
+	Attr string
+	Err  error
+}
+
+func (e *AttributeError) Error() string {
+	return fmt.Sprintf("reading %v: %v", e.Attr, e.Err)
+}
+
+func (e *AttributeError) Unwrap() error {
+	return e.Err
+}
+
+// AttributeFailed reports whether err, as returned by GetUserAttributes,
+// includes a failure to read attr.
+func AttributeFailed(err error, attr string) bool {
+	if e, ok := err.(*AttributeError); ok {
+		return e.Attr == attr
+	}
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range j.Unwrap() {
+			if AttributeFailed(err, attr) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
+// RegisterFlags registers the database selection and limits on fs. Their
+// defaults are read from the environment.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&database, "database", database, "Database to use, Mongodb or ...")
+	fs.BoolVar(&UniqueEmail, "unique-email", UniqueEmail, "Require customer emails to be unique, ignoring case")
+	fs.IntVar(&MaxAddresses, "max-addresses", MaxAddresses, "Maximum number of addresses per user, 0 for no limit")
+	fs.IntVar(&MaxCards, "max-cards", MaxCards, "Maximum number of cards per user, 0 for no limit")
+	fs.IntVar(&MaxListDecoded, "max-list-decoded", MaxListDecoded, "Maximum number of results a list call holds in memory; longer lists are streamed in batches, 0 for no limit")
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// CheckLimits returns the error for a user holding more addresses or cards
+// than allowed, if any.
+func CheckLimits(u *users.User) error {
+	if MaxAddresses > 0 && len(u.Addresses) > MaxAddresses {
+		return ErrAddressLimit
+	}
+	if MaxCards > 0 && len(u.Cards) > MaxCards {
+		return ErrCardLimit
+	}
+	return nil
+}
+
+// Selected returns the name of the database selected by flag.
+func Selected() string {
+	return database
 }
 
 // Init inits the selected DB in DefaultDb
@@ -50,15 +439,18 @@ func Init() error {
 	if database == "" {
 		return ErrNoDatabaseSelected
 	}
-	err := Set()
+	d, err := Open(database)
 	if err != nil {
 		return err
 	}
-	return DefaultDb.Init()
+	DefaultDb = d
+	return nil
 }
 
 // Set the DefaultDb
 func Set() error {
+	dbMtx.RLock()
+	defer dbMtx.RUnlock()
 	if v, ok := DBTypes[database]; ok {
 		DefaultDb = v
 		return nil
@@ -66,105 +458,279 @@ func Set() error {
 	return fmt.Errorf(ErrNoDatabaseFound, database)
 }
 
-// Register registers the database interface in the DBTypes
+// Register registers the database interface in the DBTypes. Registering a
+// name again replaces it, and it must be opened again.
 func Register(name string, db Database) {
+	dbMtx.Lock()
+	defer dbMtx.Unlock()
 	DBTypes[name] = db
+	delete(instances, name)
+}
+
+// Open returns the database registered as name, initialising it on first
+// use. Later calls return the same instance, so several named databases can
+// be in use at once.
+func Open(name string) (Database, error) {
+	dbMtx.Lock()
+	defer dbMtx.Unlock()
+	if d, ok := instances[name]; ok {
+		return d, nil
+	}
+	d, ok := DBTypes[name]
+	if !ok {
+		return nil, fmt.Errorf(ErrNoDatabaseFound, name)
+	}
+	if err := d.Init(); err != nil {
+		return nil, err
+	}
+	instances[name] = d
+	return d, nil
 }
 
 // CreateUser invokes DefaultDb method
-func CreateUser(u *users.User) error {
+func CreateUser(ctx context.Context, u *users.User) error {
+	defer timing.Database(ctx)()
 	return DefaultDb.CreateUser(u)
 }
 
+// ImportUser invokes DefaultDb method
+func ImportUser(ctx context.Context, u *users.User) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.ImportUser(u)
+}
+
 // GetUserByName invokes DefaultDb method
-func GetUserByName(n string) (users.User, error) {
-	u, err := DefaultDb.GetUserByName(n)
-	if err == nil {
-		u.AddLinks()
-	}
-	return u, err
+func GetUserByName(ctx context.Context, n string) (users.User, error) {
+	return cachedUser(ctx, "GetUserByName", n, func() (users.User, error) { return DefaultDb.GetUserByName(n) })
+}
+
+// GetUserByEmail invokes DefaultDb method
+func GetUserByEmail(ctx context.Context, e string) (users.User, error) {
+	return cachedUser(ctx, "GetUserByEmail", e, func() (users.User, error) { return DefaultDb.GetUserByEmail(e) })
 }
 
 // GetUser invokes DefaultDb method
-func GetUser(n string) (users.User, error) {
-	u, err := DefaultDb.GetUser(n)
-	if err == nil {
-		u.AddLinks()
-	}
-	return u, err
+func GetUser(ctx context.Context, n string) (users.User, error) {
+	return cachedUser(ctx, "GetUser", n, func() (users.User, error) { return DefaultDb.GetUser(n) })
+}
+
+// GetUserWithAttributes reads the user from DefaultDb with their addresses
+// and cards.
+func GetUserWithAttributes(ctx context.Context, id string) (users.User, error) {
+	return cachedUser(ctx, "GetUserWithAttributes", id, func() (users.User, error) { return ReadUserWithAttributes(DefaultDb, id) })
 }
 
 // GetUsers invokes DefaultDb method
-func GetUsers() ([]users.User, error) {
-	us, err := DefaultDb.GetUsers()
-	for k, _ := range us {
-		us[k].AddLinks()
+func GetUsers(ctx context.Context, l ListOptions) ([]users.User, error) {
+	defer timing.Database(ctx)()
+	return bounded(l, DefaultDb.GetUsers)
+}
+
+// SearchUsers invokes DefaultDb method, refusing with ErrListTooLong more
+// than MaxListDecoded results. Backends stop decoding one result past it.
+func SearchUsers(ctx context.Context, q Query) ([]users.User, error) {
+	defer timing.Database(ctx)()
+	us, err := DefaultDb.SearchUsers(q)
+	if err == nil && MaxListDecoded > 0 && len(us) > MaxListDecoded {
+		return nil, ErrListTooLong
 	}
 	return us, err
 }
 
+// CountUsers invokes DefaultDb method
+func CountUsers(ctx context.Context, q Query) (int64, error) {
+	defer timing.Database(ctx)()
+	return DefaultDb.CountUsers(q)
+}
+
+// ExistsUsername invokes DefaultDb method
+func ExistsUsername(ctx context.Context, n string) (bool, error) {
+	defer timing.Database(ctx)()
+	return DefaultDb.ExistsUsername(n)
+}
+
+// ExistsEmail invokes DefaultDb method
+func ExistsEmail(ctx context.Context, e string) (bool, error) {
+	defer timing.Database(ctx)()
+	return DefaultDb.ExistsEmail(e)
+}
+
+// ExportUsers invokes DefaultDb method
+func ExportUsers(q Query, cursor string, f func(users.User, string) error) error {
+	return DefaultDb.ExportUsers(q, cursor, f)
+}
+
+// FindDuplicates invokes DefaultDb method
+func FindDuplicates(ctx context.Context, offset, limit int) ([]Duplicate, error) {
+	defer timing.Database(ctx)()
+	return DefaultDb.FindDuplicates(offset, limit)
+}
+
+// CollectOrphans invokes DefaultDb method
+func CollectOrphans(before time.Time, dryRun bool) (Orphans, error) {
+	return DefaultDb.CollectOrphans(before, dryRun)
+}
+
+// NormalizeUsernames invokes DefaultDb method
+func NormalizeUsernames(normalize func(string) string) (int, error) {
+	return DefaultDb.NormalizeUsernames(normalize)
+}
+
+// UpdateLastLogin invokes DefaultDb method
+func UpdateLastLogin(ctx context.Context, id string) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.UpdateLastLogin(id)
+}
+
+// UpdateAvatar invokes DefaultDb method
+func UpdateAvatar(ctx context.Context, id, key string) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.UpdateAvatar(id, key)
+}
+
+// UpdateProfile invokes DefaultDb method
+func UpdateProfile(ctx context.Context, u *users.User) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.UpdateProfile(u)
+}
+
+// AddTag invokes DefaultDb method
+func AddTag(ctx context.Context, id, tag string) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.AddTag(id, tag)
+}
+
+// RemoveTag invokes DefaultDb method
+func RemoveTag(ctx context.Context, id, tag string) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.RemoveTag(id, tag)
+}
+
 // GetUserAttributes invokes DefaultDb method
-func GetUserAttributes(u *users.User) error {
-	err := DefaultDb.GetUserAttributes(u)
-	if err != nil {
+func GetUserAttributes(ctx context.Context, u *users.User) error {
+	in := *u
+	v, err := cached(ctx, "GetUserAttributes", u.UserID, func() (interface{}, error) {
+		err := DefaultDb.GetUserAttributes(&in)
+		return attributes{in.Addresses, in.Cards}, err
+	})
+	attrs, ok := v.(attributes)
+	if !ok {
 		return err
 	}
-	for k, _ := range u.Addresses {
-		u.Addresses[k].AddLinks()
-	}
-	for k, _ := range u.Cards {
-		u.Cards[k].AddLinks()
-	}
-	return nil
+	u.Addresses = slices.Clone(attrs.addresses)
+	u.Cards = slices.Clone(attrs.cards)
+	return err
 }
 
 // CreateAddress invokes DefaultDb method
-func CreateAddress(a *users.Address, userid string) error {
+func CreateAddress(ctx context.Context, a *users.Address, userid string) error {
+	defer timing.Database(ctx)()
 	return DefaultDb.CreateAddress(a, userid)
 }
 
 // GetAddress invokes DefaultDb method
-func GetAddress(n string) (users.Address, error) {
-	a, err := DefaultDb.GetAddress(n)
-	if err == nil {
-		a.AddLinks()
-	}
+func GetAddress(ctx context.Context, n string) (users.Address, error) {
+	v, err := cached(ctx, "GetAddress", n, func() (interface{}, error) { return DefaultDb.GetAddress(n) })
+	a, _ := v.(users.Address)
 	return a, err
 }
 
 // GetAddresses invokes DefaultDb method
-func GetAddresses() ([]users.Address, error) {
-	as, err := DefaultDb.GetAddresses()
-	for k, _ := range as {
-		as[k].AddLinks()
-	}
-	return as, err
+func GetAddresses(ctx context.Context, l ListOptions) ([]users.Address, error) {
+	defer timing.Database(ctx)()
+	return bounded(l, DefaultDb.GetAddresses)
+}
+
+// GetCustomerAddresses invokes DefaultDb method
+func GetCustomerAddresses(ctx context.Context, userid string) ([]users.Address, error) {
+	v, err := cached(ctx, "GetCustomerAddresses", userid, func() (interface{}, error) { return DefaultDb.GetCustomerAddresses(userid) })
+	as, _ := v.([]users.Address)
+	return slices.Clone(as), err
 }
 
 // CreateCard invokes DefaultDb method
-func CreateCard(c *users.Card, userid string) error {
+func CreateCard(ctx context.Context, c *users.Card, userid string) error {
+	defer timing.Database(ctx)()
 	return DefaultDb.CreateCard(c, userid)
 }
 
 // GetCard invokes DefaultDb method
-func GetCard(n string) (users.Card, error) {
-	return DefaultDb.GetCard(n)
+func GetCard(ctx context.Context, n string) (users.Card, error) {
+	v, err := cached(ctx, "GetCard", n, func() (interface{}, error) { return DefaultDb.GetCard(n) })
+	c, _ := v.(users.Card)
+	return c, err
 }
 
 // GetCards invokes DefaultDb method
-func GetCards() ([]users.Card, error) {
-	cs, err := DefaultDb.GetCards()
-	for k, _ := range cs {
-		cs[k].AddLinks()
-	}
-	return cs, err
+func GetCards(ctx context.Context, l ListOptions) ([]users.Card, error) {
+	defer timing.Database(ctx)()
+	return bounded(l, DefaultDb.GetCards)
+}
+
+// GetCustomerCards invokes DefaultDb method
+func GetCustomerCards(ctx context.Context, userid string) ([]users.Card, error) {
+	v, err := cached(ctx, "GetCustomerCards", userid, func() (interface{}, error) { return DefaultDb.GetCustomerCards(userid) })
+	cs, _ := v.([]users.Card)
+	return slices.Clone(cs), err
+}
+
+// UpdateCardStatus invokes DefaultDb method
+func UpdateCardStatus(ctx context.Context, id, status string, flag *users.CardFlag) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.UpdateCardStatus(id, status, flag)
 }
 
 // Delete invokes DefaultDb method
-func Delete(entity, id string) error {
+func Delete(ctx context.Context, entity, id string) error {
+	defer timing.Database(ctx)()
 	return DefaultDb.Delete(entity, id)
 }
 
+// CreateLoginAttempt invokes DefaultDb method
+func CreateLoginAttempt(ctx context.Context, l *users.LoginAttempt) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.CreateLoginAttempt(l)
+}
+
+// GetLoginAttempts invokes DefaultDb method
+func GetLoginAttempts(ctx context.Context, userid string) ([]users.LoginAttempt, error) {
+	v, err := cached(ctx, "GetLoginAttempts", userid, func() (interface{}, error) { return DefaultDb.GetLoginAttempts(userid) })
+	ls, _ := v.([]users.LoginAttempt)
+	return slices.Clone(ls), err
+}
+
+// CreateNote invokes DefaultDb method
+func CreateNote(ctx context.Context, n *users.Note) error {
+	defer timing.Database(ctx)()
+	return DefaultDb.CreateNote(n)
+}
+
+// GetNotes invokes DefaultDb method
+func GetNotes(ctx context.Context, userid string, offset, limit int) ([]users.Note, error) {
+	defer timing.Database(ctx)()
+	return DefaultDb.GetNotes(userid, offset, limit)
+}
+
+// GetJob invokes DefaultDb method
+func GetJob(ctx context.Context, id string) (jobs.Job, error) {
+	defer timing.Database(ctx)()
+	return DefaultDb.GetJob(id)
+}
+
+// Indexes invokes DefaultDb method
+func Indexes(ctx context.Context) ([]Index, error) {
+	defer timing.Database(ctx)()
+	return DefaultDb.Indexes()
+}
+
+// Reload reloads the credentials of DefaultDb, if it supports it.
+func Reload() error {
+	if r, ok := DefaultDb.(Reloader); ok {
+		return r.Reload()
+	}
+	return nil
+}
+
 // Ping invokes DefaultDB method
 func Ping() error {
 	return DefaultDb.Ping()
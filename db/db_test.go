@@ -1,10 +1,15 @@
 package db
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mikesay/user/jobs"
 	"github.com/mikesay/user/users"
 )
 
@@ -20,6 +25,22 @@ var (
 	}
 )
 
+func TestRegisterFlags(t *testing.T) {
+	prev := MaxCards
+	defer func() { MaxCards = prev }()
+	// Flags can be registered on several sets without colliding.
+	for _, args := range [][]string{nil, {"-max-cards", "3"}} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		RegisterFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if MaxCards != 3 {
+		t.Errorf("Expected the parsed limit, received %v", MaxCards)
+	}
+}
+
 func TestInit(t *testing.T) {
 	err := Init()
 	if err == nil {
@@ -31,7 +52,6 @@ func TestInit(t *testing.T) {
 	if err != ErrFakeError {
 		t.Error("expected fake db error from init")
 	}
-	TestAddress.AddLinks()
 }
 
 func TestSet(t *testing.T) {
@@ -62,29 +82,133 @@ func TestRegister(t *testing.T) {
 }
 
 func TestCreateUser(t *testing.T) {
-	err := CreateUser(&users.User{})
+	err := CreateUser(context.Background(), &users.User{})
 	if err != ErrFakeError {
 		t.Error("expected fake db error from create")
 	}
 }
 
+func TestImportUser(t *testing.T) {
+	err := ImportUser(context.Background(), &users.User{})
+	if err != ErrFakeError {
+		t.Error("expected fake db error from import")
+	}
+}
+
 func TestGetUser(t *testing.T) {
-	_, err := GetUser("test")
+	_, err := GetUser(context.Background(), "test")
 	if err != ErrFakeError {
 		t.Error("expected fake db error from get")
 	}
 }
 
 func TestGetUserByName(t *testing.T) {
-	_, err := GetUserByName("test")
+	_, err := GetUserByName(context.Background(), "test")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from get")
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	_, err := GetUserByEmail(context.Background(), "test")
 	if err != ErrFakeError {
 		t.Error("expected fake db error from get")
 	}
 }
 
+func TestSearchUsers(t *testing.T) {
+	_, err := SearchUsers(context.Background(), Query{CreatedAfter: time.Now()})
+	if err != ErrFakeError {
+		t.Error("expected fake db error from search")
+	}
+}
+
+func TestCountUsers(t *testing.T) {
+	_, err := CountUsers(context.Background(), Query{Tag: "vip"})
+	if err != ErrFakeError {
+		t.Error("expected fake db error from count")
+	}
+}
+
+func TestExists(t *testing.T) {
+	if _, err := ExistsUsername(context.Background(), "test"); err != ErrFakeError {
+		t.Error("expected fake db error from username check")
+	}
+	if _, err := ExistsEmail(context.Background(), "test@example.com"); err != ErrFakeError {
+		t.Error("expected fake db error from email check")
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	err := ExportUsers(Query{}, "", func(users.User, string) error { return nil })
+	if err != ErrFakeError {
+		t.Error("expected fake db error from export")
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	_, err := FindDuplicates(context.Background(), 0, 10)
+	if err != ErrFakeError {
+		t.Error("expected fake db error from find")
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	_, err := Indexes(context.Background())
+	if err != ErrFakeError {
+		t.Error("expected fake db error from indexes")
+	}
+}
+
+func TestCollectOrphans(t *testing.T) {
+	_, err := CollectOrphans(time.Now(), true)
+	if err != ErrFakeError {
+		t.Error("expected fake db error from collect orphans")
+	}
+	if o := (Orphans{Addresses: 1, Cards: 2}).Add(Orphans{Addresses: 3}); o != (Orphans{Addresses: 4, Cards: 2}) {
+		t.Errorf("Expected the counts summed, received %+v", o)
+	}
+}
+
+func TestNormalizeUsernames(t *testing.T) {
+	_, err := NormalizeUsernames(strings.ToLower)
+	if err != ErrFakeError {
+		t.Error("expected fake db error from normalize")
+	}
+}
+
+func TestUpdateLastLogin(t *testing.T) {
+	err := UpdateLastLogin(context.Background(), "test")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from update")
+	}
+}
+
+func TestUpdateAvatar(t *testing.T) {
+	err := UpdateAvatar(context.Background(), "test", "avatars/test/1")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from update")
+	}
+}
+
+func TestTags(t *testing.T) {
+	if err := AddTag(context.Background(), "test", "vip"); err != ErrFakeError {
+		t.Error("expected fake db error from add")
+	}
+	if err := RemoveTag(context.Background(), "test", "vip"); err != ErrFakeError {
+		t.Error("expected fake db error from remove")
+	}
+}
+
+func TestUpdateCardStatus(t *testing.T) {
+	if err := UpdateCardStatus(context.Background(), "test", users.CardSuspectedFraud, nil); err != ErrFakeError {
+		t.Error("expected fake db error from update")
+	}
+}
+
 func TestGetUserAttributes(t *testing.T) {
 	u := users.New()
-	GetUserAttributes(&u)
+	GetUserAttributes(context.Background(), &u)
 	if len(u.Addresses) != 1 {
 		t.Error("expected one address added for GetUserAttributes")
 	}
@@ -93,6 +217,99 @@ func TestGetUserAttributes(t *testing.T) {
 	}
 }
 
+// cardsDown fails to read cards.
+type cardsDown struct {
+	fake
+}
+
+func (cardsDown) GetUserAttributes(u *users.User) error {
+	u.Addresses = []users.Address{TestAddress}
+	u.Cards = []users.Card{}
+	return errors.Join(&AttributeError{Attr: AttrCards, Err: ErrFakeError})
+}
+
+func TestGetUserAttributesPartial(t *testing.T) {
+	prev := DefaultDb
+	DefaultDb = cardsDown{}
+	defer func() { DefaultDb = prev }()
+
+	u := users.User{UserID: "u1", Cards: []users.Card{{ID: "c1"}}}
+	err := GetUserAttributes(context.Background(), &u)
+	if !AttributeFailed(err, AttrCards) || AttributeFailed(err, AttrAddresses) || !errors.Is(err, ErrFakeError) {
+		t.Errorf("Expected the cards reported failed, received %v", err)
+	}
+	if len(u.Addresses) != 1 || len(u.Cards) != 0 {
+		t.Errorf("Expected the addresses without the cards, received %+v", u)
+	}
+	if AttributeFailed(ErrFakeError, AttrCards) || AttributeFailed(nil, AttrCards) {
+		t.Error("Expected other errors not to be attribute failures")
+	}
+}
+
+// hydrator reads users with their attributes in one call.
+type hydrator struct {
+	cardsDown
+	calls int
+}
+
+func (h *hydrator) GetUser(id string) (users.User, error) {
+	return users.User{UserID: id}, nil
+}
+
+func (h *hydrator) GetUserWithAttributes(id string) (users.User, error) {
+	h.calls++
+	return users.User{UserID: id, Addresses: []users.Address{TestAddress}, Cards: []users.Card{}}, nil
+}
+
+func TestReadUserWithAttributes(t *testing.T) {
+	h := &hydrator{}
+	u, err := ReadUserWithAttributes(h, "u1")
+	if err != nil || h.calls != 1 || len(u.Addresses) != 1 {
+		t.Errorf("Expected a single hydrated read, received %+v %v after %v calls", u, err, h.calls)
+	}
+	// Without GetUserWithAttributes, the user and attributes are read apart.
+	u, err = ReadUserWithAttributes(&h.cardsDown, "u1")
+	if !errors.Is(err, ErrFakeError) {
+		t.Errorf("Expected the failed user read, received %v", err)
+	}
+
+	prev := DefaultDb
+	DefaultDb = h
+	defer func() { DefaultDb = prev }()
+	u, err = GetUserWithAttributes(context.Background(), "u1")
+	if err != nil || len(u.Addresses) == 0 {
+		t.Errorf("Expected the user with their addresses, received %+v %v", u, err)
+	}
+}
+
+func TestGetLoginAttempts(t *testing.T) {
+	_, err := GetLoginAttempts(context.Background(), "test")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from get")
+	}
+}
+
+func TestGetCustomerAddresses(t *testing.T) {
+	_, err := GetCustomerAddresses(context.Background(), "test")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from get")
+	}
+}
+
+func TestGetCustomerCards(t *testing.T) {
+	_, err := GetCustomerCards(context.Background(), "test")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from get")
+	}
+}
+
+func TestGetJob(t *testing.T) {
+	_, err := GetJob(context.Background(), "test")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from get")
+	}
+}
+
 func TestPing(t *testing.T) {
 	err := Ping()
 	if err != ErrFakeError {
@@ -113,24 +330,68 @@ func (f fake) GetUser(id string) (users.User, error) {
 	return users.User{}, ErrFakeError
 }
 
-func (f fake) GetUsers() ([]users.User, error) {
+func (f fake) GetUsers(l ListOptions) ([]users.User, error) {
+	return make([]users.User, 0), ErrFakeError
+}
+
+func (f fake) SearchUsers(q Query) ([]users.User, error) {
 	return make([]users.User, 0), ErrFakeError
 }
 
+func (f fake) CountUsers(q Query) (int64, error) {
+	return 0, ErrFakeError
+}
+
+func (f fake) ExistsUsername(name string) (bool, error) {
+	return false, ErrFakeError
+}
+
+func (f fake) ExistsEmail(email string) (bool, error) {
+	return false, ErrFakeError
+}
+
+func (f fake) ExportUsers(q Query, cursor string, fn func(users.User, string) error) error {
+	return ErrFakeError
+}
+
 func (f fake) CreateUser(*users.User) error {
 	return ErrFakeError
 }
 
+func (f fake) ImportUser(*users.User) error {
+	return ErrFakeError
+}
+
+func (f fake) UpdateLastLogin(id string) error {
+	return ErrFakeError
+}
+
+func (f fake) UpdateAvatar(id, key string) error {
+	return ErrFakeError
+}
+
+func (f fake) AddTag(id, tag string) error {
+	return ErrFakeError
+}
+
+func (f fake) RemoveTag(id, tag string) error {
+	return ErrFakeError
+}
+
 func (f fake) GetUserAttributes(u *users.User) error {
 	u.Addresses = append(u.Addresses, TestAddress)
 	return nil
 }
 
+func (f fake) UpdateCardStatus(id, status string, flag *users.CardFlag) error {
+	return ErrFakeError
+}
+
 func (f fake) GetCard(id string) (users.Card, error) {
 	return users.Card{}, ErrFakeError
 }
 
-func (f fake) GetCards() ([]users.Card, error) {
+func (f fake) GetCards(l ListOptions) ([]users.Card, error) {
 	return make([]users.Card, 0), ErrFakeError
 }
 
@@ -142,10 +403,18 @@ func (f fake) GetAddress(id string) (users.Address, error) {
 	return users.Address{}, ErrFakeError
 }
 
-func (f fake) GetAddresses() ([]users.Address, error) {
+func (f fake) GetAddresses(l ListOptions) ([]users.Address, error) {
+	return make([]users.Address, 0), ErrFakeError
+}
+
+func (f fake) GetCustomerAddresses(id string) ([]users.Address, error) {
 	return make([]users.Address, 0), ErrFakeError
 }
 
+func (f fake) GetCustomerCards(id string) ([]users.Card, error) {
+	return make([]users.Card, 0), ErrFakeError
+}
+
 func (f fake) CreateAddress(u *users.Address, id string) error {
 	return ErrFakeError
 }
@@ -154,6 +423,101 @@ func (f fake) Delete(entity, id string) error {
 	return ErrFakeError
 }
 
+func (f fake) CreateLoginAttempt(l *users.LoginAttempt) error {
+	return ErrFakeError
+}
+
+func (f fake) GetLoginAttempts(id string) ([]users.LoginAttempt, error) {
+	return make([]users.LoginAttempt, 0), ErrFakeError
+}
+
+func (f fake) GetUserByEmail(email string) (users.User, error) {
+	return users.User{}, ErrFakeError
+}
+
+func (f fake) CollectOrphans(before time.Time, dryRun bool) (Orphans, error) {
+	return Orphans{}, ErrFakeError
+}
+
+func (f fake) NormalizeUsernames(normalize func(string) string) (int, error) {
+	return 0, ErrFakeError
+}
+
+func (f fake) FindDuplicates(offset, limit int) ([]Duplicate, error) {
+	return make([]Duplicate, 0), ErrFakeError
+}
+
+func (f fake) UpdateProfile(u *users.User) error {
+	return ErrFakeError
+}
+
+func (f fake) CreateNote(n *users.Note) error {
+	return ErrFakeError
+}
+
+func (f fake) GetNotes(userid string, offset, limit int) ([]users.Note, error) {
+	return make([]users.Note, 0), ErrFakeError
+}
+
+func (f fake) CreateJob(j *jobs.Job) error {
+	return ErrFakeError
+}
+
+func (f fake) GetJob(id string) (jobs.Job, error) {
+	return jobs.Job{}, ErrFakeError
+}
+
+func (f fake) UpdateJob(j *jobs.Job, leaseUntil time.Time) error {
+	return ErrFakeError
+}
+
+func (f fake) ClaimJob(owner string, now, leaseUntil time.Time) (jobs.Job, error) {
+	return jobs.Job{}, ErrFakeError
+}
+
+func (f fake) Indexes() ([]Index, error) {
+	return nil, ErrFakeError
+}
+
 func (f fake) Ping() error {
 	return ErrFakeError
 }
+
+type initCounter struct {
+	fake
+	inits int
+}
+
+func (c *initCounter) Init() error {
+	c.inits++
+	return nil
+}
+
+func TestCheckLimits(t *testing.T) {
+	defer func(a, c int) { MaxAddresses, MaxCards = a, c }(MaxAddresses, MaxCards)
+	MaxAddresses, MaxCards = 1, 0
+	u := users.User{Addresses: make([]users.Address, 2), Cards: make([]users.Card, 5)}
+	if err := CheckLimits(&u); err != ErrAddressLimit {
+		t.Errorf("Expected address limit error, received %v", err)
+	}
+	MaxAddresses = 0
+	if err := CheckLimits(&u); err != nil {
+		t.Errorf("Expected zero limits to allow any count, received %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	c := &initCounter{}
+	Register("open", c)
+	for i := 0; i < 2; i++ {
+		if _, err := Open("open"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.inits != 1 {
+		t.Errorf("Expected a single Init, received %v", c.inits)
+	}
+	if _, err := Open("missing"); err == nil {
+		t.Error("Expected error opening unregistered db")
+	}
+}
@@ -0,0 +1,198 @@
+package hedge
+
+// hedge.go contains a Database decorator hedging the reads logins wait on:
+// when a read has not returned within a delay, such as the usual 95th
+// percentile latency, the same read is sent again and whichever answers
+// first is used, so that an occasional slow Mongo node does not stall
+// logins.
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Hedged is the number of reads whose hedge was sent, by method and by the
+// attempt that answered first: primary or hedge.
+var Hedged = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "db_hedged_reads_total",
+	Help: "Number of reads sent a second time for being slow, by the attempt that answered first.",
+}, []string{"method", "winner"})
+
+func init() {
+	prometheus.MustRegister(Hedged)
+}
+
+const (
+	// samples is the number of recent latencies the percentile is taken of.
+	samples = 1000
+	// minSamples are needed before the percentile replaces the delay.
+	minSamples = 100
+	// recompute is how many latencies are recorded between computations of
+	// the percentile.
+	recompute = 100
+)
+
+// DB serves the embedded Database, hedging reads of single users by
+// username, email or ID, alone or with their attributes. Other queries are
+// passed through.
+type DB struct {
+	db.Database
+
+	// Delay is waited for before a read is hedged, until enough reads have
+	// been timed to take the percentile of.
+	Delay time.Duration
+	// Percentile, if not 0, hedges reads slower than that percentile of
+	// recent reads, such as 95.
+	Percentile float64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+	recorded  int
+	current   time.Duration
+}
+
+// New returns a DB hedging reads of d after delay.
+func New(d db.Database, delay time.Duration) *DB {
+	return &DB{Database: d, Delay: delay}
+}
+
+// delay returns how long a read is waited for before it is hedged.
+func (d *DB) delay() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Percentile == 0 || len(d.latencies) < minSamples {
+		return d.Delay
+	}
+	return d.current
+}
+
+// observe records the latency of a first attempt.
+func (d *DB) observe(latency time.Duration) {
+	if d.Percentile == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.latencies) < samples {
+		d.latencies = append(d.latencies, latency)
+	} else {
+		d.latencies[d.next] = latency
+		d.next = (d.next + 1) % samples
+	}
+	d.recorded++
+	if len(d.latencies) >= minSamples && (d.current == 0 || d.recorded%recompute == 0) {
+		sorted := slices.Clone(d.latencies)
+		slices.Sort(sorted)
+		d.current = sorted[min(int(float64(len(sorted))*d.Percentile/100), len(sorted)-1)]
+	}
+}
+
+type result[T any] struct {
+	v     T
+	err   error
+	hedge bool
+}
+
+// hedged runs query, running it again if it has not returned within the
+// delay, and returns the first answer.
+func hedged[T any](d *DB, method string, query func() (T, error)) (T, error) {
+	results := make(chan result[T], 2)
+	start := time.Now()
+	go func() {
+		v, err := query()
+		d.observe(time.Since(start))
+		results <- result[T]{v: v, err: err}
+	}()
+	timer := time.NewTimer(d.delay())
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.v, r.err
+	case <-timer.C:
+	}
+	go func() {
+		v, err := query()
+		results <- result[T]{v: v, err: err, hedge: true}
+	}()
+	r := <-results
+	winner := "primary"
+	if r.hedge {
+		winner = "hedge"
+	}
+	Hedged.WithLabelValues(method, winner).Inc()
+	return r.v, r.err
+}
+
+// Reload reloads the credentials of the embedded Database, if it supports
+// it.
+func (d *DB) Reload() error {
+	if r, ok := d.Database.(db.Reloader); ok {
+		return r.Reload()
+	}
+	return nil
+}
+
+// IDs returns the ID scheme of the embedded Database, if it declares one.
+func (d *DB) IDs() ids.Generator {
+	if g, ok := d.Database.(db.IDGenerator); ok {
+		return g.IDs()
+	}
+	return nil
+}
+
+// Reserve reserves the key of kind on the embedded Database.
+func (d *DB) Reserve(kind, key string) (bool, error) {
+	return db.Reserve(d.Database, kind, key)
+}
+
+func (d *DB) Release(kind, key string) error {
+	return db.Release(d.Database, kind, key)
+}
+
+// MapIDs records the new IDs of entities of kind with the embedded Database.
+func (d *DB) MapIDs(kind string, ids map[string]string) error {
+	return db.MapIDs(d.Database, kind, ids)
+}
+
+func (d *DB) MappedID(kind, old string) (string, error) {
+	return db.MappedID(d.Database, kind, old)
+}
+
+// Purge purges the data of the embedded Database, if it is a Purger.
+func (d *DB) Purge(kind string, before time.Time) (int64, error) {
+	if p, ok := d.Database.(db.Purger); ok {
+		return p.Purge(kind, before)
+	}
+	return 0, nil
+}
+
+func (d *DB) GetUserWithAttributes(id string) (users.User, error) {
+	return hedged(d, "GetUserWithAttributes", func() (users.User, error) { return db.ReadUserWithAttributes(d.Database, id) })
+}
+
+func (d *DB) GetUserByName(name string) (users.User, error) {
+	return hedged(d, "GetUserByName", func() (users.User, error) { return d.Database.GetUserByName(name) })
+}
+
+func (d *DB) GetUserByEmail(email string) (users.User, error) {
+	return hedged(d, "GetUserByEmail", func() (users.User, error) { return d.Database.GetUserByEmail(email) })
+}
+
+func (d *DB) ExistsUsername(name string) (bool, error) {
+	return hedged(d, "ExistsUsername", func() (bool, error) { return d.Database.ExistsUsername(name) })
+}
+
+func (d *DB) ExistsEmail(email string) (bool, error) {
+	return hedged(d, "ExistsEmail", func() (bool, error) { return d.Database.ExistsEmail(email) })
+}
+
+func (d *DB) GetUser(id string) (users.User, error) {
+	return hedged(d, "GetUser", func() (users.User, error) { return d.Database.GetUser(id) })
+}
@@ -0,0 +1,76 @@
+package hedge
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func count(c prometheus.Counter) float64 {
+	var m dto.Metric
+	c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+// slowFirst answers its first read after slow, and later ones at once.
+type slowFirst struct {
+	db.Database
+	slow  time.Duration
+	reads atomic.Int32
+}
+
+func (s *slowFirst) GetUser(id string) (users.User, error) {
+	if s.reads.Add(1) == 1 {
+		time.Sleep(s.slow)
+		return users.User{UserID: id, Username: "slow"}, nil
+	}
+	return users.User{UserID: id, Username: "fast"}, nil
+}
+
+func TestHedge(t *testing.T) {
+	s := &slowFirst{slow: time.Second}
+	d := New(s, 10*time.Millisecond)
+	wins := count(Hedged.WithLabelValues("GetUser", "hedge"))
+	start := time.Now()
+	u, err := d.GetUser("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "fast" || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the hedge to answer, received %+v after %v", u, time.Since(start))
+	}
+	if n := count(Hedged.WithLabelValues("GetUser", "hedge")) - wins; n != 1 {
+		t.Errorf("Expected a hedge win counted, received %v", n)
+	}
+
+	reads := s.reads.Load()
+	if _, err := d.GetUser("u2"); err != nil || s.reads.Load() != reads+1 {
+		t.Errorf("Expected a fast read sent once, received %v reads", s.reads.Load()-reads)
+	}
+}
+
+func TestPercentileDelay(t *testing.T) {
+	d := New(nil, time.Second)
+	d.Percentile = 95
+	for k := 1; k < minSamples; k++ {
+		d.observe(time.Duration(k) * time.Millisecond)
+	}
+	if d.delay() != time.Second {
+		t.Errorf("Expected the delay until enough reads are timed, received %v", d.delay())
+	}
+	d.observe(minSamples * time.Millisecond)
+	if got := d.delay(); got != 96*time.Millisecond {
+		t.Errorf("Expected the 95th percentile, received %v", got)
+	}
+	for k := 0; k < samples; k++ {
+		d.observe(time.Millisecond)
+	}
+	if got := d.delay(); got != time.Millisecond {
+		t.Errorf("Expected older latencies forgotten, received %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+package mongodb
+
+// credentials.go replaces the client when the credentials of the secrets
+// provider change, as found periodically, by watching the provider or on
+// Reload. The new client is connected and verified before it is
+// swapped in; the old one is closed once the operations running on it are
+// done, so rotating a password causes no downtime.
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// drainTimeout bounds how long operations on a replaced client may run.
+const drainTimeout = time.Minute
+
+var (
+	CredentialRotations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_credential_rotations_total",
+		Help: "Number of database credential changes, by whether reconnecting succeeded.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(CredentialRotations)
+}
+
+func (m *Mongo) rotateCredentials(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.refreshCredentials()
+	}
+}
+
+// Reload reads the credentials again, reconnecting if they changed.
+func (m *Mongo) Reload() error {
+	if m.Secrets == nil {
+		return nil
+	}
+	return m.refreshCredentials()
+}
+
+// refreshCredentials reads the credentials again and, if they changed,
+// reconnects with them.
+func (m *Mongo) refreshCredentials() error {
+	m.rotateMtx.Lock()
+	defer m.rotateMtx.Unlock()
+	ctx, cancel := m.ctx()
+	defer cancel()
+	c, err := m.Secrets.Credentials(ctx)
+	if err != nil {
+		return err
+	}
+	m.mtx.RLock()
+	unchanged := c == m.creds
+	m.mtx.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	client, err := m.connect(ctx, &c, false)
+	if err != nil {
+		CredentialRotations.WithLabelValues("error").Inc()
+		return err
+	}
+	m.mtx.Lock()
+	old := m.Client
+	m.Client, m.creds = client, c
+	m.mtx.Unlock()
+	CredentialRotations.WithLabelValues("success").Inc()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		old.Disconnect(ctx)
+	}()
+	return nil
+}
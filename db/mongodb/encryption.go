@@ -0,0 +1,201 @@
+package mongodb
+
+// encryption.go configures Client-Side Field Level Encryption, available
+// with MongoDB Enterprise and Atlas: the driver encrypts customers' emails
+// and cards' numbers and security codes before they are sent, and decrypts
+// them as they are read, so the server and its backups only hold
+// ciphertext.
+//
+// The driver needs libmongocrypt and the cse build tag, and a data key
+// created beforehand in the key vault. Emails and their domains are
+// encrypted deterministically, so they can still be looked up by equality,
+// but prefix searches on them, duplicate scans and $lookup aggregations are
+// not supported on encrypted collections: reads do not use $lookup and
+// FindDuplicates fails while encryption is on. Fields saved in plaintext
+// before encryption was turned on are encrypted on startup.
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/secrets"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	deterministic = "AEAD_AES_256_CBC_HMAC_SHA_512-Deterministic"
+	random        = "AEAD_AES_256_CBC_HMAC_SHA_512-Random"
+)
+
+var (
+	// csfleKMS is the KMS provider holding the master key: local, aws, gcp
+	// or azure. Empty disables encryption.
+	csfleKMS = os.Getenv("MONGO_CSFLE_KMS")
+	// csfleLocalKey is the base64 96 byte master key of the local provider.
+	// Cloud providers take their credentials from the environment.
+	csfleLocalKey = os.Getenv("MONGO_CSFLE_LOCAL_KEY")
+	// csfleKeyVault is the namespace of the data keys.
+	csfleKeyVault = env("MONGO_CSFLE_KEY_VAULT", "encryption.__keyVault")
+	// csfleKeyID is the base64 UUID of the data key fields are encrypted
+	// with.
+	csfleKeyID = os.Getenv("MONGO_CSFLE_KEY_ID")
+)
+
+func registerEncryptionFlags(fs *flag.FlagSet) {
+	fs.StringVar(&csfleKMS, "mongo-csfle-kms", csfleKMS, "KMS provider of the master key encrypting emails and cards client side: local, aws, gcp or azure. Empty disables field level encryption")
+	fs.StringVar(&csfleLocalKey, "mongo-csfle-local-key", csfleLocalKey, "Base64 96 byte master key of the local KMS provider")
+	fs.StringVar(&csfleKeyVault, "mongo-csfle-key-vault", csfleKeyVault, "Namespace of the field level encryption data keys")
+	fs.StringVar(&csfleKeyID, "mongo-csfle-key-id", csfleKeyID, "Base64 UUID of the data key fields are encrypted with")
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// encrypting reports whether fields are encrypted client side.
+func encrypting() bool {
+	return csfleKMS != ""
+}
+
+// autoEncryption returns the driver's auto encryption options of database
+// for the configured KMS provider and data key.
+func autoEncryption(database string) (*options.AutoEncryptionOptions, error) {
+	var provider map[string]interface{}
+	switch csfleKMS {
+	case "local":
+		key, err := base64.StdEncoding.DecodeString(csfleLocalKey)
+		if err != nil || len(key) != 96 {
+			return nil, fmt.Errorf("mongo csfle local key must be 96 bytes in base64")
+		}
+		provider = map[string]interface{}{"key": key}
+	case "aws", "gcp", "azure":
+		// An empty provider has the driver fetch credentials on demand.
+		provider = map[string]interface{}{}
+	default:
+		return nil, fmt.Errorf("unknown mongo csfle kms provider %q", csfleKMS)
+	}
+	id, err := base64.StdEncoding.DecodeString(csfleKeyID)
+	if err != nil || len(id) != 16 {
+		return nil, fmt.Errorf("mongo csfle key id must be a UUID in base64")
+	}
+	if db, coll, ok := strings.Cut(csfleKeyVault, "."); !ok || db == "" || coll == "" {
+		return nil, fmt.Errorf("mongo csfle key vault %q is not database.collection", csfleKeyVault)
+	}
+	return options.AutoEncryption().
+		SetKmsProviders(map[string]map[string]interface{}{csfleKMS: provider}).
+		SetKeyVaultNamespace(csfleKeyVault).
+		SetSchemaMap(encryptionSchemas(database, primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: id})), nil
+}
+
+// encryptionSchemas returns the JSON schemas naming the encrypted fields of
+// each collection of database.
+func encryptionSchemas(database string, key primitive.Binary) map[string]interface{} {
+	field := func(algorithm string) bson.M {
+		return bson.M{"encrypt": bson.M{"bsonType": "string", "algorithm": algorithm}}
+	}
+	schema := func(properties bson.M) bson.M {
+		return bson.M{
+			"bsonType":        "object",
+			"encryptMetadata": bson.M{"keyId": bson.A{key}},
+			"properties":      properties,
+		}
+	}
+	return map[string]interface{}{
+		database + ".customers": schema(bson.M{"email": field(deterministic), "emailNormalized": field(deterministic), "emailDomain": field(deterministic)}),
+		database + ".cards":     schema(bson.M{"longNum": field(random), "ccv": field(random)}),
+	}
+}
+
+// encryptFields encrypts the fields of customers and cards saved in
+// plaintext, and stores the email domain of customers whose email was
+// encrypted without one. The documents are found with a client bypassing
+// encryption, whose filters on encrypted fields are sent as they are, and
+// rewritten through the encrypting client.
+func (m *Mongo) encryptFields() error {
+	if !encrypting() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	var creds *secrets.Credentials
+	if m.Secrets != nil {
+		m.mtx.RLock()
+		c := m.creds
+		m.mtx.RUnlock()
+		creds = &c
+	}
+	plain, err := m.connect(ctx, creds, true)
+	if err != nil {
+		return err
+	}
+	defer plain.Disconnect(ctx)
+
+	plaintext := func(field string) bson.M { return bson.M{field: bson.M{"$type": "string"}} }
+	customers := bson.M{"$or": bson.A{
+		plaintext("email"), plaintext("emailNormalized"), plaintext("emailDomain"),
+		bson.M{"email": bson.M{"$exists": true}, "emailDomain": bson.M{"$exists": false}},
+	}}
+	err = m.reencrypt(ctx, plain, "customers", customers, func(doc bson.M) bson.M {
+		set := bson.M{}
+		for _, f := range []string{"email", "emailNormalized"} {
+			if v, ok := doc[f].(string); ok {
+				set[f] = v
+			}
+		}
+		if email, ok := doc["email"].(string); ok {
+			if domain := emailDomain(email); domain != "" {
+				set["emailDomain"] = domain
+			}
+		}
+		return set
+	})
+	if err != nil {
+		return err
+	}
+	return m.reencrypt(ctx, plain, "cards", bson.M{"$or": bson.A{plaintext("longNum"), plaintext("ccv")}}, func(doc bson.M) bson.M {
+		set := bson.M{}
+		for _, f := range []string{"longNum", "ccv"} {
+			if v, ok := doc[f].(string); ok {
+				set[f] = v
+			}
+		}
+		return set
+	})
+}
+
+// reencrypt sets the fields fields returns for each document of coll that
+// plain finds with filter, decrypted, through the encrypting client.
+func (m *Mongo) reencrypt(ctx context.Context, plain *mongo.Client, coll string, filter bson.M, fields func(bson.M) bson.M) error {
+	cursor, err := plain.Database(m.databaseName()).Collection(coll).Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	target := m.database().Collection(coll)
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		set := fields(doc)
+		if len(set) == 0 {
+			continue
+		}
+		if _, err := target.UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": set}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,66 @@
+package mongodb
+
+// id.go stores the IDs of every scheme. IDs in ObjectID form are kept as
+// ObjectIDs, as they always were; IDs of other schemes are kept as strings.
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ID is the ID of a stored document, in the form the API sees.
+type ID string
+
+// MarshalBSONValue stores the ID as an ObjectID if it is one in hex, or as
+// a string otherwise.
+func (id ID) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	if oid, err := primitive.ObjectIDFromHex(string(id)); err == nil {
+		return bson.MarshalValue(oid)
+	}
+	return bson.MarshalValue(string(id))
+}
+
+// UnmarshalBSONValue reads an ID stored as an ObjectID or a string.
+func (id *ID) UnmarshalBSONValue(t bsontype.Type, b []byte) error {
+	v := bson.RawValue{Type: t, Value: b}
+	switch t {
+	case bson.TypeObjectID:
+		*id = ID(v.ObjectID().Hex())
+	case bson.TypeString:
+		*id = ID(v.StringValue())
+	case bson.TypeNull, bson.TypeUndefined:
+		*id = ""
+	default:
+		return fmt.Errorf("cannot decode %v into an ID", t)
+	}
+	return nil
+}
+
+// newID returns a new ID of the backend's scheme.
+func (m *Mongo) newID() ID {
+	return ID(m.IDs().New())
+}
+
+// parseID returns id if it is valid in the backend's scheme.
+func (m *Mongo) parseID(id string) (ID, error) {
+	if !m.IDs().Valid(id) {
+		return "", ErrInvalidHexID
+	}
+	return ID(id), nil
+}
+
+// parseIDs returns the IDs if all are valid in the backend's scheme.
+func (m *Mongo) parseIDs(ss []string) ([]ID, error) {
+	ids := make([]ID, 0, len(ss))
+	for _, s := range ss {
+		id, err := m.parseID(s)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
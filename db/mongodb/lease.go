@@ -0,0 +1,125 @@
+package mongodb
+
+// lease.go contains the lease serializing startup migrations across
+// replicas. A lease is a document in the locks collection naming its owner
+// and expiry; the owner renews it while working, and an expired lease may be
+// taken over, so a crashed replica does not block the others.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// migrationLease is held while indexes are built and data migrated.
+	migrationLease = "migrations"
+	// leaseTTL is how long a lease outlives its last renewal.
+	leaseTTL = 30 * time.Second
+)
+
+var (
+	LeaseContention = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_lease_contention_total",
+		Help: "Number of times a lease was found held by another instance.",
+	}, []string{"lease"})
+	LeaseWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_lease_wait_seconds",
+		Help:    "Time (in seconds) spent waiting to acquire a lease.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"lease"})
+)
+
+func init() {
+	prometheus.MustRegister(LeaseContention, LeaseWait)
+}
+
+// leaseOwner identifies this instance as a lease owner.
+var leaseOwner = func() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	host, _ := os.Hostname()
+	return host + "-" + hex.EncodeToString(b)
+}()
+
+// leaseFilter matches the named lease if it is free for owner to take.
+func leaseFilter(name, owner string, t time.Time) bson.M {
+	return bson.M{"_id": name, "$or": bson.A{
+		bson.M{"owner": owner},
+		bson.M{"expiresAt": bson.M{"$lt": t}},
+	}}
+}
+
+// acquireLease takes or renews the named lease, reporting whether it is held
+// by another instance.
+func (m *Mongo) acquireLease(ctx context.Context, name string) (bool, error) {
+	t := m.now()
+	_, err := m.database().Collection("locks").UpdateOne(ctx,
+		leaseFilter(name, leaseOwner, t),
+		bson.M{"$set": bson.M{"owner": leaseOwner, "expiresAt": t.Add(leaseTTL)}},
+		options.Update().SetUpsert(true))
+	// The upsert collides with the existing _id when the lease is held.
+	if mongo.IsDuplicateKeyError(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+func (m *Mongo) releaseLease(name string) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+	_, err := m.database().Collection("locks").DeleteOne(ctx, bson.M{"_id": name, "owner": leaseOwner})
+	return err
+}
+
+// withLease runs f while holding the named lease, waiting for other
+// instances to release it first. The lease is renewed until f returns.
+func (m *Mongo) withLease(ctx context.Context, name string, f func() error) error {
+	start := time.Now()
+	for {
+		held, err := m.acquireLease(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !held {
+			break
+		}
+		LeaseContention.WithLabelValues(name).Inc()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	LeaseWait.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+	renew, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(leaseTTL / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-renew.Done():
+				return
+			case <-t.C:
+				m.acquireLease(renew, name)
+			}
+		}
+	}()
+	err := f()
+	stop()
+	<-done
+	if rerr := m.releaseLease(name); err == nil {
+		err = rerr
+	}
+	return err
+}
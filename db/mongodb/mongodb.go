@@ -2,65 +2,306 @@ package mongodb
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/secrets"
 	"github.com/mikesay/user/users"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
-	name            string
-	password        string
-	host            string
-	db              = "users"
-	ErrInvalidHexID = errors.New("Invalid Id Hex")
+	name     = os.Getenv("MONGO_USER")
+	password = os.Getenv("MONGO_PASS")
+	host     = os.Getenv("MONGO_HOST")
+	// dropUnknownIndexes drops undeclared indexes on startup.
+	dropUnknownIndexes = os.Getenv("MONGO_DROP_UNKNOWN_INDEXES") == "true"
+	// dbName is the database of Mongos naming none.
+	dbName = env("MONGO_DATABASE", "users")
+	// idScheme is the scheme of the IDs created by Mongos naming none.
+	idScheme = os.Getenv("MONGO_ID_SCHEME")
+	// ErrInvalidHexID is users.ErrInvalidID, kept for callers comparing
+	// against it.
+	ErrInvalidHexID = users.ErrInvalidID
+	// ErrEncryptedDuplicates is returned by FindDuplicates while fields are
+	// encrypted client side: the server cannot group customers by emails
+	// and card numbers it only holds as ciphertext.
+	ErrEncryptedDuplicates = users.NewError(users.CodeInvalidRequest, "Duplicates cannot be found while fields are encrypted")
+
+	// lookup reads users with their addresses and cards in one $lookup
+	// aggregation. Servers without $lookup need it off.
+	lookup = os.Getenv("MONGO_LOOKUP") != "false"
+
+	// serverAPI pins the Stable API version, such as "1", which servers like
+	// Atlas serverless require. Empty leaves the version unpinned.
+	serverAPI = os.Getenv("MONGO_SERVER_API")
+	// compressors lists the wire compressors offered to the server, in order
+	// of preference.
+	compressors = os.Getenv("MONGO_COMPRESSORS")
 )
 
-func init() {
-	flag.StringVar(&name, "mongo-user", os.Getenv("MONGO_USER"), "Mongo user")
-	flag.StringVar(&password, "mongo-password", os.Getenv("MONGO_PASS"), "Mongo password")
-	flag.StringVar(&host, "mongo-host", os.Getenv("MONGO_HOST"), "Mongo host")
+const (
+	// loginHistoryBytes caps the size of the logins collection; Mongo drops
+	// the oldest attempts once it is full.
+	loginHistoryBytes = 64 << 20
+	// loginHistoryLimit is the number of attempts returned per user.
+	loginHistoryLimit = 100
+	// errNamespaceExists is returned when creating an existing collection.
+	errNamespaceExists = 48
+)
+
+// RegisterFlags registers the Mongo connection flags on fs. Programs that
+// do not register them configure Mongo through the environment alone.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&name, "mongo-user", name, "Mongo user")
+	fs.StringVar(&password, "mongo-password", password, "Mongo password")
+	fs.StringVar(&host, "mongo-host", host, "Mongo host")
+	fs.StringVar(&dbName, "mongo-database", dbName, "Mongo database")
+	fs.StringVar(&idScheme, "mongo-id-scheme", idScheme, "Scheme of the IDs created: objectid, ulid or uuidv7. Empty creates ObjectIDs. Only set another for a database migrated with the migrate-ids job")
+	fs.BoolVar(&dropUnknownIndexes, "mongo-drop-unknown-indexes", dropUnknownIndexes, "Drop indexes the service does not declare on the collections it uses")
+	fs.BoolVar(&lookup, "mongo-lookup", lookup, "Read users with their addresses and cards in a single $lookup aggregation. Disable for servers without $lookup")
+	fs.StringVar(&serverAPI, "mongo-server-api", serverAPI, `Stable API version to pin, such as "1", as required by Atlas serverless. Empty leaves it unpinned`)
+	fs.StringVar(&compressors, "mongo-compressors", compressors, "Comma separated wire compressors to offer, in order of preference, out of zstd, snappy and zlib")
+	registerEncryptionFlags(fs)
 }
 
 // Mongo meets the Database interface requirements
 type Mongo struct {
 	Client   *mongo.Client
 	Database *mongo.Database
+	// URI, if set, is connected to instead of the URL built from flags.
+	URI string
+	// Secrets, if set, provides the credentials instead of -mongo-user and
+	// -mongo-password. Defaults to the provider selected by flags, unless
+	// URI is set.
+	Secrets secrets.Provider
+	// Clock stamps creations, updates, logins and the IDs created.
+	// Defaults to the wall clock.
+	Clock clock.Clock
+	// RNG provides the random bits of ULIDs and UUIDv7s. Defaults to
+	// clock.Random.
+	RNG clock.RNG
+	// Name is the database used. Defaults to -mongo-database.
+	Name string
+	// Scheme is the ids scheme of the IDs created. Defaults to
+	// -mongo-id-scheme, or ObjectIDs.
+	Scheme string
+
+	// mtx guards Client, which is replaced when credentials rotate.
+	mtx       sync.RWMutex
+	creds     secrets.Credentials
+	rotateMtx sync.Mutex
 }
 
 // Init MongoDB using the official driver
 func (m *Mongo) Init() error {
+	if scheme := m.scheme(); scheme != "" {
+		if _, err := ids.Parse(scheme); err != nil {
+			return err
+		}
+	}
+	if m.Secrets == nil && m.URI == "" {
+		p, err := secrets.Default()
+		if err != nil {
+			return err
+		}
+		m.Secrets = p
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var creds *secrets.Credentials
+	if m.Secrets != nil {
+		c, err := m.Secrets.Credentials(ctx)
+		if err != nil {
+			return err
+		}
+		creds = &c
+	}
+	client, err := m.connect(ctx, creds, false)
+	if err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	m.Client = client
+	if creds != nil {
+		m.creds = *creds
+	}
+	m.mtx.Unlock()
+	if m.Secrets != nil && secrets.RotateInterval > 0 {
+		go m.rotateCredentials(secrets.RotateInterval)
+	}
+	if w, ok := m.Secrets.(secrets.Watcher); ok {
+		go w.Watch(context.Background(), func() { m.refreshCredentials() })
+	}
+	return m.migrate()
+}
+
+// connect returns a client verified to reach the database, authenticating
+// with creds if set. With bypassEncryption the client still decrypts the
+// fields it reads but sends commands unencrypted.
+func (m *Mongo) connect(ctx context.Context, creds *secrets.Credentials, bypassEncryption bool) (*mongo.Client, error) {
 	u := getURL()
+	if creds != nil {
+		u.User = url.UserPassword(creds.Username, creds.Password)
+	}
 
 	// Ensure directConnection=true for Podman/Mac standalone setups
 	q := u.Query()
 	q.Set("directConnection", "true")
 	u.RawQuery = q.Encode()
+	uri := u.String()
+	if m.URI != "" {
+		uri = m.URI
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(u.String()))
+	opts, err := clientOptions(uri, m.databaseName())
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if bypassEncryption && opts.AutoEncryptionOptions != nil {
+		opts.AutoEncryptionOptions.SetBypassAutoEncryption(true)
+	}
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
 	}
 
 	// Verify connection
 	if err := client.Ping(ctx, nil); err != nil {
-		return fmt.Errorf("mongo ping failed: %w", err)
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("mongo ping failed: %w", err)
 	}
+	return client, nil
+}
 
-	m.Client = client
-	return m.EnsureIndexes()
+// clientOptions returns the options of clients connecting to uri, pinning
+// the Stable API version, offering compressors and encrypting the fields of
+// database as flags set. Their pools are observed by poolMonitor.
+func clientOptions(uri, database string) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(uri).SetPoolMonitor(poolMonitor)
+	if serverAPI != "" {
+		if serverAPI != string(options.ServerAPIVersion1) {
+			return nil, fmt.Errorf("unsupported mongo server API version %q", serverAPI)
+		}
+		opts.SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1))
+	}
+	var cs []string
+	for _, c := range strings.Split(compressors, ",") {
+		switch c = strings.TrimSpace(c); c {
+		case "":
+		case "zstd", "snappy", "zlib":
+			cs = append(cs, c)
+		default:
+			return nil, fmt.Errorf("unsupported mongo compressor %q", c)
+		}
+	}
+	if len(cs) > 0 {
+		opts.SetCompressors(cs)
+	}
+	if encrypting() {
+		ae, err := autoEncryption(database)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetAutoEncryptionOptions(ae)
+	}
+	return opts, nil
+}
+
+// IDs returns the generator of the IDs Mongo creates, of Scheme. IDs in
+// ObjectID form are stored as ObjectIDs, others as strings.
+func (m *Mongo) IDs() ids.Generator {
+	switch m.scheme() {
+	case ids.ULIDScheme:
+		return ids.ULID{Clock: m.Clock, RNG: m.RNG}
+	case ids.UUIDv7Scheme:
+		return ids.UUIDv7{Clock: m.Clock, RNG: m.RNG}
+	}
+	return ids.ObjectID{Clock: m.Clock}
+}
+
+// scheme returns the scheme of the IDs created.
+func (m *Mongo) scheme() string {
+	if m.Scheme != "" {
+		return m.Scheme
+	}
+	return idScheme
+}
+
+// databaseName returns the name of the database used.
+func (m *Mongo) databaseName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return dbName
+}
+
+// database returns the database used, through the current client.
+func (m *Mongo) database() *mongo.Database {
+	return m.client().Database(m.databaseName())
+}
+
+// client returns the current client. Callers keep using the client they
+// got for the whole operation, so that replacing it does not interrupt them.
+func (m *Mongo) client() *mongo.Client {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.Client
+}
+
+// migrate builds indexes and migrates data, one replica at a time so that
+// replicas starting together do not all do so at once.
+func (m *Mongo) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	return m.withLease(ctx, migrationLease, func() error {
+		if err := m.EnsureIndexes(); err != nil {
+			return err
+		}
+		if err := m.backfillEmailDomains(); err != nil {
+			return err
+		}
+		if err := m.encryptFields(); err != nil {
+			return err
+		}
+		if err := m.stripLinks(); err != nil {
+			return err
+		}
+		return m.backfillOwners()
+	})
+}
+
+// notFound replaces the driver's error for a missing document with e.
+func notFound(err, e error) error {
+	if err == mongo.ErrNoDocuments {
+		return e
+	}
+	return err
 }
 
 // Helper for frequent context creation
@@ -68,12 +309,24 @@ func (m *Mongo) ctx() (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), 30*time.Second)
 }
 
+// now returns the current time at the millisecond precision Mongo stores.
+func (m *Mongo) now() time.Time {
+	c := m.Clock
+	if c == nil {
+		c = clock.System{}
+	}
+	return c.Now().UTC().Truncate(time.Millisecond)
+}
+
 // MongoUser is a wrapper for the users
 type MongoUser struct {
 	users.User `bson:",inline"`
-	ID         primitive.ObjectID   `bson:"_id"`
-	AddressIDs []primitive.ObjectID `bson:"addresses"`
-	CardIDs    []primitive.ObjectID `bson:"cards"`
+	ID         ID   `bson:"_id"`
+	AddressIDs []ID `bson:"addresses"`
+	CardIDs    []ID `bson:"cards"`
+	// EmailDomain is stored apart so that users can be found by domain
+	// from an index.
+	EmailDomain string `bson:"emailDomain,omitempty"`
 }
 
 // New Returns a new MongoUser
@@ -81,60 +334,81 @@ func New() MongoUser {
 	u := users.New()
 	return MongoUser{
 		User:       u,
-		AddressIDs: make([]primitive.ObjectID, 0),
-		CardIDs:    make([]primitive.ObjectID, 0),
+		AddressIDs: make([]ID, 0),
+		CardIDs:    make([]ID, 0),
 	}
 }
 
 // AddUserIDs adds userID as string to user
 func (mu *MongoUser) AddUserIDs() {
 	if mu.User.Addresses == nil {
-		mu.User.Addresses = make([]users.Address, 0)
+		mu.User.Addresses = make([]users.Address, 0, len(mu.AddressIDs))
 	}
 	for _, id := range mu.AddressIDs {
-		mu.User.Addresses = append(mu.User.Addresses, users.Address{ID: id.Hex()})
+		mu.User.Addresses = append(mu.User.Addresses, users.Address{ID: string(id)})
 	}
 	if mu.User.Cards == nil {
-		mu.User.Cards = make([]users.Card, 0)
+		mu.User.Cards = make([]users.Card, 0, len(mu.CardIDs))
 	}
 	for _, id := range mu.CardIDs {
-		mu.User.Cards = append(mu.User.Cards, users.Card{ID: id.Hex()})
-	}
-	mu.User.UserID = mu.ID.Hex()
-
-	if len(mu.User.Links) == 0 {
-		mu.User.Links = nil
+		mu.User.Cards = append(mu.User.Cards, users.Card{ID: string(id)})
 	}
+	mu.User.UserID = string(mu.ID)
 }
 
 type MongoAddress struct {
 	users.Address `bson:",inline"`
-	ID            primitive.ObjectID `bson:"_id"`
+	ID            ID `bson:"_id"`
+	// CustomerID is the owning user, so a user's addresses can be queried
+	// without loading the user first.
+	CustomerID ID `bson:"customerID,omitempty"`
 }
 
-func (ma *MongoAddress) AddID() { ma.Address.ID = ma.ID.Hex() }
+func (ma *MongoAddress) AddID() { ma.Address.ID = string(ma.ID) }
 
 type MongoCard struct {
 	users.Card `bson:",inline"`
-	ID         primitive.ObjectID `bson:"_id"`
+	ID         ID `bson:"_id"`
+	// CustomerID is the owning user.
+	CustomerID ID `bson:"customerID,omitempty"`
+}
+
+func (mc *MongoCard) AddID() { mc.Card.ID = string(mc.ID) }
+
+type MongoJob struct {
+	jobs.Job `bson:",inline"`
+	ID       ID `bson:"_id"`
 }
 
-func (mc *MongoCard) AddID() { mc.Card.ID = mc.ID.Hex() }
+func (mj *MongoJob) AddID() { mj.Job.ID = string(mj.ID) }
+
+// MongoNote is a wrapper for the notes
+type MongoNote struct {
+	users.Note `bson:",inline"`
+	ID         ID `bson:"_id"`
+}
 
 // CreateUser Insert user to MongoDB
 func (m *Mongo) CreateUser(u *users.User) error {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
+	if err := db.CheckLimits(u); err != nil {
+		return err
+	}
+
 	mu := New()
 	mu.User = *u
-	mu.ID = primitive.NewObjectID()
+	mu.ID = m.newID()
+	mu.EmailDomain = emailDomain(u.Email)
+	mu.CreatedAt = m.now()
+	mu.UpdatedAt = mu.CreatedAt
 
 	var carderr, addrerr error
-	mu.CardIDs, carderr = m.createCards(ctx, u.Cards)
-	mu.AddressIDs, addrerr = m.createAddresses(ctx, u.Addresses)
+	mu.CardIDs, carderr = m.createCards(ctx, u.Cards, mu.ID)
+	mu.AddressIDs, addrerr = m.createAddresses(ctx, u.Addresses, mu.ID)
 
-	coll := m.Client.Database(db).Collection("customers")
+	coll := m.database().Collection("customers")
 	opts := options.Replace().SetUpsert(true)
 
 	_, err := coll.ReplaceOne(ctx, bson.M{"_id": mu.ID}, mu, opts)
@@ -143,99 +417,385 @@ func (m *Mongo) CreateUser(u *users.User) error {
 		return err
 	}
 
-	mu.User.UserID = mu.ID.Hex()
+	mu.User.UserID = string(mu.ID)
 	if carderr != nil || addrerr != nil {
-		return fmt.Errorf("attribute errors: %v %v", carderr, addrerr)
+		return fmt.Errorf("attribute errors: %w", errors.Join(carderr, addrerr))
 	}
 	*u = mu.User
 	return nil
 }
 
-func (m *Mongo) createCards(ctx context.Context, cs []users.Card) ([]primitive.ObjectID, error) {
-	ids := make([]primitive.ObjectID, 0)
-	coll := m.Client.Database(db).Collection("cards")
-	opts := options.Replace().SetUpsert(true)
+// ImportUser inserts a user along with its addresses and cards, keeping the
+// IDs they already carry. Nothing is written if any ID or the username is
+// already taken.
+func (m *Mongo) ImportUser(u *users.User) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
 
-	for k, ca := range cs {
-		id := primitive.NewObjectID()
-		mc := MongoCard{Card: ca, ID: id}
-		_, err := coll.ReplaceOne(ctx, bson.M{"_id": mc.ID}, mc, opts)
+	uid, err := m.parseID(u.UserID)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+	if err := db.CheckLimits(u); err != nil {
+		return err
+	}
+	aids, err := m.parseIDs(addressIDs(u.Addresses))
+	if err != nil {
+		return err
+	}
+	cids, err := m.parseIDs(cardIDs(u.Cards))
+	if err != nil {
+		return err
+	}
+
+	database := m.database()
+	checks := []struct {
+		coll   string
+		filter bson.M
+	}{
+		{"customers", bson.M{"$or": bson.A{bson.M{"_id": uid}, bson.M{"username": u.Username}, bson.M{"usernameNormalized": u.UsernameNormalized}}}},
+		{"addresses", bson.M{"_id": bson.M{"$in": aids}}},
+		{"cards", bson.M{"_id": bson.M{"$in": cids}}},
+	}
+	for _, c := range checks {
+		n, err := database.Collection(c.coll).CountDocuments(ctx, c.filter)
 		if err != nil {
-			return ids, err
+			return err
+		}
+		if n > 0 {
+			return db.ErrIDConflict
+		}
+	}
+
+	if len(u.Addresses) > 0 {
+		docs := make([]interface{}, 0, len(u.Addresses))
+		for k, a := range u.Addresses {
+			docs = append(docs, MongoAddress{Address: a, ID: aids[k], CustomerID: uid})
+		}
+		if _, err := database.Collection("addresses").InsertMany(ctx, docs); err != nil {
+			return err
+		}
+	}
+	if len(u.Cards) > 0 {
+		docs := make([]interface{}, 0, len(u.Cards))
+		for k, c := range u.Cards {
+			docs = append(docs, MongoCard{Card: c, ID: cids[k], CustomerID: uid})
+		}
+		if _, err := database.Collection("cards").InsertMany(ctx, docs); err != nil {
+			return err
 		}
-		ids = append(ids, id)
-		cs[k].ID = id.Hex()
 	}
-	return ids, nil
+	mu := MongoUser{User: *u, ID: uid, AddressIDs: aids, CardIDs: cids, EmailDomain: emailDomain(u.Email)}
+	_, err = database.Collection("customers").InsertOne(ctx, mu)
+	return err
 }
 
-func (m *Mongo) createAddresses(ctx context.Context, as []users.Address) ([]primitive.ObjectID, error) {
-	ids := make([]primitive.ObjectID, 0)
-	coll := m.Client.Database(db).Collection("addresses")
-	opts := options.Replace().SetUpsert(true)
+// emailDomain returns the domain of an email, lower cased.
+func emailDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return strings.ToLower(strings.TrimSpace(email[i+1:]))
+	}
+	return ""
+}
+
+func addressIDs(as []users.Address) []string {
+	ids := make([]string, 0, len(as))
+	for _, a := range as {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func cardIDs(cs []users.Card) []string {
+	ids := make([]string, 0, len(cs))
+	for _, c := range cs {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func (m *Mongo) createCards(ctx context.Context, cs []users.Card, owner ID) ([]ID, error) {
+	created := m.now()
+	docs := make([]interface{}, len(cs))
+	for k, ca := range cs {
+		ca.CreatedAt = created
+		ca.UpdatedAt = created
+		docs[k] = MongoCard{Card: ca, ID: m.newID(), CustomerID: owner}
+	}
+	inserted, err := m.insertAttributes(ctx, "cards", "card", docs)
+	ids := make([]ID, 0, len(cs))
+	for k, d := range docs {
+		if !inserted[k] {
+			continue
+		}
+		mc := d.(MongoCard)
+		ids = append(ids, mc.ID)
+		cs[k] = mc.Card
+		cs[k].ID = string(mc.ID)
+	}
+	return ids, err
+}
 
+func (m *Mongo) createAddresses(ctx context.Context, as []users.Address, owner ID) ([]ID, error) {
+	created := m.now()
+	docs := make([]interface{}, len(as))
 	for k, a := range as {
-		id := primitive.NewObjectID()
-		ma := MongoAddress{Address: a, ID: id}
-		_, err := coll.ReplaceOne(ctx, bson.M{"_id": ma.ID}, ma, opts)
-		if err != nil {
-			return ids, err
+		a.CreatedAt = created
+		a.UpdatedAt = created
+		docs[k] = MongoAddress{Address: a, ID: m.newID(), CustomerID: owner}
+	}
+	inserted, err := m.insertAttributes(ctx, "addresses", "address", docs)
+	ids := make([]ID, 0, len(as))
+	for k, d := range docs {
+		if !inserted[k] {
+			continue
+		}
+		ma := d.(MongoAddress)
+		ids = append(ids, ma.ID)
+		as[k] = ma.Address
+		as[k].ID = string(ma.ID)
+	}
+	return ids, err
+}
+
+// insertAttributes inserts docs into collection in one unordered
+// InsertMany, so that a document failing does not stop the others. It
+// reports which documents were inserted.
+func (m *Mongo) insertAttributes(ctx context.Context, collection, kind string, docs []interface{}) ([]bool, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	_, err := m.database().Collection(collection).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return insertedDocs(kind, len(docs), err)
+}
+
+// insertedDocs attributes the error of an unordered InsertMany of n
+// documents to the documents that failed, naming each by kind and index.
+// Unless the error is a bulk write error, no document is known to be
+// inserted.
+func insertedDocs(kind string, n int, err error) ([]bool, error) {
+	inserted := make([]bool, n)
+	var bwe mongo.BulkWriteException
+	if err != nil && !errors.As(err, &bwe) {
+		return inserted, err
+	}
+	for k := range inserted {
+		inserted[k] = true
+	}
+	var errs []error
+	for _, we := range bwe.WriteErrors {
+		if we.Index >= 0 && we.Index < n {
+			inserted[we.Index] = false
 		}
-		ids = append(ids, id)
-		as[k].ID = id.Hex()
+		errs = append(errs, fmt.Errorf("%v %d: %v", kind, we.Index, we.Message))
 	}
-	return ids, nil
+	if bwe.WriteConcernError != nil {
+		errs = append(errs, bwe.WriteConcernError)
+	}
+	return inserted, errors.Join(errs...)
 }
 
 func (m *Mongo) cleanAttributes(mu MongoUser) error {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	collA := m.Client.Database(db).Collection("addresses")
-	collC := m.Client.Database(db).Collection("cards")
+	collA := m.database().Collection("addresses")
+	collC := m.database().Collection("cards")
 
 	_, _ = collA.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": mu.AddressIDs}})
 	_, _ = collC.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": mu.CardIDs}})
 	return nil
 }
 
-func (m *Mongo) appendAttributeId(attr string, id primitive.ObjectID, userid string) error {
+// appendAttributeId links an attribute to a user holding fewer than limit of
+// them, returning errLimit otherwise. The check and the update are a single
+// operation, so concurrent creates cannot exceed the limit.
+func (m *Mongo) appendAttributeId(attr string, id ID, userid string, limit int, errLimit error) error {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	uid, err := primitive.ObjectIDFromHex(userid)
+	uid, err := m.parseID(userid)
 	if err != nil {
 		return err
 	}
 
-	coll := m.Client.Database(db).Collection("customers")
-	_, err = coll.UpdateOne(ctx, bson.M{"_id": uid}, bson.M{"$addToSet": bson.M{attr: id}})
-	return err
+	coll := m.database().Collection("customers")
+	res, err := coll.UpdateOne(ctx, limitFilter(uid, attr, limit), bson.M{
+		"$addToSet": bson.M{attr: id},
+		"$set":      bson.M{"updatedAt": m.now()},
+	})
+	if err != nil || res.MatchedCount > 0 || limit <= 0 {
+		return err
+	}
+	n, err := coll.CountDocuments(ctx, bson.M{"_id": uid})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errLimit
+	}
+	return nil
+}
+
+// limitFilter matches the user if its attr array has fewer than limit
+// entries.
+func limitFilter(uid ID, attr string, limit int) bson.M {
+	f := bson.M{"_id": uid}
+	if limit > 0 {
+		f[fmt.Sprintf("%s.%d", attr, limit-1)] = bson.M{"$exists": false}
+	}
+	return f
 }
 
-func (m *Mongo) removeAttributeId(attr string, id primitive.ObjectID, userid string) error {
+func (m *Mongo) removeAttributeId(attr string, id ID, userid string) error {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	uid, err := primitive.ObjectIDFromHex(userid)
+	uid, err := m.parseID(userid)
 	if err != nil {
 		return err
 	}
 
-	coll := m.Client.Database(db).Collection("customers")
-	_, err = coll.UpdateOne(ctx, bson.M{"_id": uid}, bson.M{"$pull": bson.M{attr: id}})
+	coll := m.database().Collection("customers")
+	_, err = coll.UpdateOne(ctx, bson.M{"_id": uid}, bson.M{
+		"$pull": bson.M{attr: id},
+		"$set":  bson.M{"updatedAt": m.now()},
+	})
 	return err
 }
 
+// GetUserByName finds a user by normalized username. Users not yet
+// normalized are matched on their raw username.
 func (m *Mongo) GetUserByName(name string) (users.User, error) {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	coll := m.Client.Database(db).Collection("customers")
+	coll := m.database().Collection("customers")
 	mu := New()
-	err := coll.FindOne(ctx, bson.M{"username": name}).Decode(&mu)
+	err := coll.FindOne(ctx, usernameFilter(name)).Decode(&mu)
 	if err != nil {
-		return users.User{}, err
+		return users.User{}, notFound(err, users.ErrUserNotFound)
+	}
+	mu.AddUserIDs()
+	return mu.User, nil
+}
+
+// CollectOrphans finds the addresses and cards created before the given
+// time that their owner does not list, or that have no owner, deleting them
+// unless dryRun. Such attributes are left behind when creating a user or
+// attaching an attribute fails part way.
+func (m *Mongo) CollectOrphans(before time.Time, dryRun bool) (db.Orphans, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	database := m.database()
+	var o db.Orphans
+	for _, attr := range []string{"addresses", "cards"} {
+		cursor, err := database.Collection(attr).Aggregate(ctx, orphansPipeline(attr, before))
+		if err != nil {
+			return o, err
+		}
+		var orphans []struct {
+			ID ID `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &orphans); err != nil {
+			return o, err
+		}
+		n := len(orphans)
+		if !dryRun && n > 0 {
+			ids := make([]ID, n)
+			for k, orphan := range orphans {
+				ids[k] = orphan.ID
+			}
+			res, err := database.Collection(attr).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+			if err != nil {
+				return o, err
+			}
+			n = int(res.DeletedCount)
+		}
+		if attr == "addresses" {
+			o.Addresses = n
+		} else {
+			o.Cards = n
+		}
+	}
+	return o, nil
+}
+
+// orphansPipeline finds the IDs of the documents of attr, addresses or
+// cards, created before the given time that are missing from their owner's
+// list. Documents without a customerID join no owner, so they are found
+// too.
+func orphansPipeline(attr string, before time.Time) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(before)}},
+			// IDs of other schemes are strings, dated by their documents.
+			bson.M{"_id": bson.M{"$type": "string"}, "createdAt": bson.M{"$lt": before}},
+		}}}},
+		{{Key: "$lookup", Value: bson.M{"from": "customers", "localField": "customerID", "foreignField": "_id", "as": "owner"}}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$not": bson.A{
+			bson.M{"$in": bson.A{"$_id", bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$owner." + attr, 0}}, bson.A{}}}}},
+		}}}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+	}
+}
+
+// NormalizeUsernames backfills usernameNormalized. Users whose normalized
+// username is already taken are skipped and reported in the returned error,
+// so they can be merged or renamed.
+func (m *Mongo) NormalizeUsernames(normalize func(string) string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	coll := m.database().Collection("customers")
+	opts := options.Find().SetProjection(bson.M{"username": 1})
+	cursor, err := coll.Find(ctx, bson.M{"usernameNormalized": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	n := 0
+	var conflicts []string
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID       ID     `bson:"_id"`
+			Username string `bson:"username"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return n, err
+		}
+		_, err := coll.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{"usernameNormalized": normalize(doc.Username)}})
+		if mongo.IsDuplicateKeyError(err) {
+			conflicts = append(conflicts, doc.Username)
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := cursor.Err(); err != nil {
+		return n, err
+	}
+	if len(conflicts) > 0 {
+		return n, fmt.Errorf("usernames conflicting once normalized: %v", conflicts)
+	}
+	return n, nil
+}
+
+// GetUserByEmail finds a user by normalized email. Users stored before
+// emails were normalized are matched on their raw email.
+func (m *Mongo) GetUserByEmail(email string) (users.User, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	coll := m.database().Collection("customers")
+	mu := New()
+	err := coll.FindOne(ctx, emailFilter(email)).Decode(&mu)
+	if err != nil {
+		return users.User{}, notFound(err, users.ErrUserNotFound)
 	}
 	mu.AddUserIDs()
 	return mu.User, nil
@@ -245,27 +805,100 @@ func (m *Mongo) GetUser(id string) (users.User, error) {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	uid, err := primitive.ObjectIDFromHex(id)
+	uid, err := m.parseID(id)
 	if err != nil {
 		return users.New(), ErrInvalidHexID
 	}
 
-	coll := m.Client.Database(db).Collection("customers")
+	coll := m.database().Collection("customers")
 	mu := New()
 	err = coll.FindOne(ctx, bson.M{"_id": uid}).Decode(&mu)
 	if err != nil {
-		return users.User{}, err
+		return users.User{}, notFound(err, users.ErrUserNotFound)
 	}
 	mu.AddUserIDs()
 	return mu.User, nil
 }
 
-func (m *Mongo) GetUsers() ([]users.User, error) {
+// hydratedUser is a user with the addresses and cards joined by
+// userWithAttributesPipeline.
+type hydratedUser struct {
+	MongoUser   `bson:",inline"`
+	AddressDocs []MongoAddress `bson:"addressDocs"`
+	CardDocs    []MongoCard    `bson:"cardDocs"`
+}
+
+func userWithAttributesPipeline(id ID) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": id}}},
+		{{Key: "$lookup", Value: bson.M{"from": "addresses", "localField": "addresses", "foreignField": "_id", "as": "addressDocs"}}},
+		{{Key: "$lookup", Value: bson.M{"from": "cards", "localField": "cards", "foreignField": "_id", "as": "cardDocs"}}},
+	}
+}
+
+// GetUserWithAttributes reads the user with their addresses and cards in a
+// single aggregation, or with GetUser and GetUserAttributes if -mongo-lookup
+// is off or fields are encrypted.
+func (m *Mongo) GetUserWithAttributes(id string) (users.User, error) {
+	if !lookup || encrypting() {
+		u, err := m.GetUser(id)
+		if err != nil {
+			return u, err
+		}
+		return u, m.GetUserAttributes(&u)
+	}
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	uid, err := m.parseID(id)
+	if err != nil {
+		return users.User{}, ErrInvalidHexID
+	}
+	cursor, err := m.database().Collection("customers").Aggregate(ctx, userWithAttributesPipeline(uid))
+	if err != nil {
+		return users.User{}, err
+	}
+	var hus []hydratedUser
+	if err := cursor.All(ctx, &hus); err != nil {
+		return users.User{}, err
+	}
+	if len(hus) == 0 {
+		return users.User{}, users.ErrUserNotFound
+	}
+	hu := hus[0]
+	hu.User.Addresses = make([]users.Address, 0, len(hu.AddressDocs))
+	for _, a := range hu.AddressDocs {
+		a.AddID()
+		hu.User.Addresses = append(hu.User.Addresses, a.Address)
+	}
+	hu.User.Cards = make([]users.Card, 0, len(hu.CardDocs))
+	for _, c := range hu.CardDocs {
+		c.AddID()
+		hu.User.Cards = append(hu.User.Cards, c.Card)
+	}
+	hu.AddressIDs, hu.CardIDs = nil, nil
+	hu.AddUserIDs()
+	return hu.User, nil
+}
+
+// GetUsers gets users as listed by l
+func (m *Mongo) GetUsers(l db.ListOptions) ([]users.User, error) {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	coll := m.Client.Database(db).Collection("customers")
-	cursor, err := coll.Find(ctx, bson.M{})
+	opts, err := findOptions("customers", l)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{}
+	if l.Tag != "" {
+		filter["tags"] = l.Tag
+	}
+	if filter, err = m.afterFilter("customers", l, filter); err != nil {
+		return nil, err
+	}
+	coll := m.database().Collection("customers")
+	cursor, err := coll.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -284,82 +917,667 @@ func (m *Mongo) GetUsers() ([]users.User, error) {
 	return us, nil
 }
 
-func (m *Mongo) GetUserAttributes(u *users.User) error {
-	ctx, cancel := m.ctx()
-	defer cancel()
+// sortKeys maps, per collection, the fields lists may be sorted by to the
+// keys sorted on. Keys end with _id so that pages are stable, and each is
+// backed by an index.
+var sortKeys = map[string]map[string]bson.D{
+	"customers": {
+		"username":  {{Key: "username", Value: 1}},
+		"lastName":  {{Key: "lastName", Value: 1}, {Key: "_id", Value: 1}},
+		"createdAt": {{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+	},
+	"addresses": {
+		"city":      {{Key: "city", Value: 1}, {Key: "_id", Value: 1}},
+		"postcode":  {{Key: "postcode", Value: 1}, {Key: "_id", Value: 1}},
+		"createdAt": {{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+	},
+	"cards": {
+		"expires":   {{Key: "expires", Value: 1}, {Key: "_id", Value: 1}},
+		"createdAt": {{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+	},
+}
 
-	// Handle Addresses
-	addrIds := make([]primitive.ObjectID, 0)
-	for _, a := range u.Addresses {
-		if !primitive.IsValidObjectID(a.ID) {
-			return ErrInvalidHexID
+// findOptions translates l for a collection. Pages of unsorted lists are
+// taken in _id order.
+func findOptions(collection string, l db.ListOptions) (*options.FindOptions, error) {
+	opts := options.Find()
+	keys := bson.D{{Key: "_id", Value: 1}}
+	if l.Sort != "" {
+		var ok bool
+		if keys, ok = sortKeys[collection][l.Sort]; !ok {
+			return nil, db.ErrInvalidSort
 		}
-		aid, _ := primitive.ObjectIDFromHex(a.ID)
-		addrIds = append(addrIds, aid)
 	}
-
-	var ma []MongoAddress
-	cursorA, err := m.Client.Database(db).Collection("addresses").Find(ctx, bson.M{"_id": bson.M{"$in": addrIds}})
-	if err == nil {
-		cursorA.All(ctx, &ma)
-		na := make([]users.Address, 0)
-		for _, a := range ma {
-			a.AddID()
-			na = append(na, a.Address)
+	if l.Sort != "" || l.Offset > 0 || l.Limit > 0 || l.After != "" {
+		order := 1
+		if l.Descending {
+			order = -1
 		}
-		u.Addresses = na
-	}
-
-	// Handle Cards
-	cardIds := make([]primitive.ObjectID, 0)
-	for _, c := range u.Cards {
-		if !primitive.IsValidObjectID(c.ID) {
-			return ErrInvalidHexID
+		sort := make(bson.D, len(keys))
+		for i, k := range keys {
+			sort[i] = bson.E{Key: k.Key, Value: order}
 		}
-		cid, _ := primitive.ObjectIDFromHex(c.ID)
-		cardIds = append(cardIds, cid)
+		opts.SetSort(sort)
 	}
-
-	var mc []MongoCard
-	cursorC, err := m.Client.Database(db).Collection("cards").Find(ctx, bson.M{"_id": bson.M{"$in": cardIds}})
-	if err == nil {
-		cursorC.All(ctx, &mc)
-		nc := make([]users.Card, 0)
-		for _, ca := range mc {
-			ca.AddID()
-			nc = append(nc, ca.Card)
-		}
-		u.Cards = nc
+	if l.Offset > 0 {
+		opts.SetSkip(int64(l.Offset))
 	}
-
-	return nil
+	if l.Limit > 0 {
+		opts.SetLimit(int64(l.Limit))
+	}
+	return opts, nil
 }
 
-func (m *Mongo) GetCard(id string) (users.Card, error) {
-	ctx, cancel := m.ctx()
-	defer cancel()
-
-	if !primitive.IsValidObjectID(id) {
-		return users.Card{}, ErrInvalidHexID
+// sparseKeys are the sort keys left out of documents when zero, which sort
+// before every value, as null.
+var sparseKeys = map[string]bool{"city": true, "postcode": true, "createdAt": true}
+
+// afterFilter narrows filter to the results following the cursor of l, if
+// any, in the order findOptions sorts them: those beyond it in the first
+// key, or equal in it and beyond it in the next, and so on.
+func (m *Mongo) afterFilter(collection string, l db.ListOptions, filter bson.M) (bson.M, error) {
+	c, err := db.ListCursor(l)
+	if c == nil || err != nil {
+		return filter, err
 	}
-	cid, _ := primitive.ObjectIDFromHex(id)
-
-	coll := m.Client.Database(db).Collection("cards")
-	mc := MongoCard{}
-	err := coll.FindOne(ctx, bson.M{"_id": cid}).Decode(&mc)
+	id, err := m.parseID(c.ID)
 	if err != nil {
-		return users.Card{}, err
+		return nil, db.ErrInvalidCursor
+	}
+	keys := bson.D{{Key: "_id", Value: 1}}
+	if l.Sort != "" {
+		if keys = sortKeys[collection][l.Sort]; keys == nil {
+			return nil, db.ErrInvalidSort
+		}
+	}
+	beyond := "$gt"
+	if l.Descending {
+		beyond = "$lt"
+	}
+	var or bson.A
+	equal := bson.M{}
+	for _, k := range keys {
+		v := c.Value
+		if k.Key == "_id" {
+			v = id
+		} else if sparseKeys[k.Key] && reflect.ValueOf(v).IsZero() {
+			v = nil
+		}
+		switch {
+		case v != nil:
+			after := bson.M{k.Key: bson.M{beyond: v}}
+			if l.Descending && sparseKeys[k.Key] {
+				// Missing values come last in descending order.
+				after = bson.M{"$or": bson.A{after, bson.M{k.Key: nil}}}
+			}
+			or = append(or, and(equal, after))
+		case !l.Descending:
+			or = append(or, and(equal, bson.M{k.Key: bson.M{"$ne": nil}}))
+		}
+		equal = and(equal, bson.M{k.Key: v})
+	}
+	if len(or) == 0 {
+		or = bson.A{bson.M{"_id": bson.M{"$in": bson.A{}}}}
+	}
+	return bson.M{"$and": bson.A{filter, bson.M{"$or": or}}}, nil
+}
+
+// and returns the filter matching both a and b, which have no keys in
+// common.
+func and(a, b bson.M) bson.M {
+	m := make(bson.M, len(a)+len(b))
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
+
+// SearchUsers returns the users matching every non-zero field of q
+func (m *Mongo) SearchUsers(q db.Query) ([]users.User, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	filter, err := m.userFilter(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	coll := m.database().Collection("customers")
+	opts := options.Find()
+	if db.MaxListDecoded > 0 {
+		// One more than the cap tells the caller the search is too long.
+		opts.SetLimit(int64(db.MaxListDecoded + 1))
+	}
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var mus []MongoUser
+	if err = cursor.All(ctx, &mus); err != nil {
+		return nil, err
+	}
+
+	us := make([]users.User, 0, len(mus))
+	for _, mu := range mus {
+		mu.AddUserIDs()
+		us = append(us, mu.User)
+	}
+	return us, nil
+}
+
+// CountUsers counts the users matching q on the server.
+func (m *Mongo) CountUsers(q db.Query) (int64, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	filter, err := m.userFilter(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	return m.database().Collection("customers").CountDocuments(ctx, filter)
+}
+
+// usernameFilter matches the user with the normalized username, or the
+// username of users stored before it was normalized.
+func usernameFilter(name string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"usernameNormalized": name},
+		bson.M{"usernameNormalized": bson.M{"$exists": false}, "username": name},
+	}}
+}
+
+// emailFilter matches the user with the normalized email, or the email of
+// users stored before it was normalized.
+func emailFilter(email string) bson.M {
+	e := users.NormalizeEmail(email)
+	return bson.M{"$or": bson.A{
+		bson.M{"emailNormalized": e},
+		bson.M{"emailNormalized": bson.M{"$exists": false}, "email": e},
+	}}
+}
+
+func (m *Mongo) ExistsUsername(name string) (bool, error) {
+	return m.exists(usernameFilter(name))
+}
+
+func (m *Mongo) ExistsEmail(email string) (bool, error) {
+	return m.exists(emailFilter(email))
+}
+
+// exists reports whether a customer matches filter, reading only the ID of
+// the first from the index.
+func (m *Mongo) exists(filter bson.M) (bool, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	coll := m.database().Collection("customers")
+	var doc struct {
+		ID ID `bson:"_id"`
+	}
+	err := coll.FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ExportUsers streams the users matching q from a cursor in _id order, so
+// exports need not fit in memory. There is no overall timeout, as f may be
+// writing to a slow client.
+func (m *Mongo) ExportUsers(q db.Query, after string, f func(users.User, string) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	coll := m.database().Collection("customers")
+	pos, err := parseExportCursor(after)
+	if err != nil {
+		return err
+	}
+	if after == "" {
+		var newest MongoUser
+		err := coll.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.M{"_id": 1})).Decode(&newest)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pos.Until = newest.ID
+	}
+
+	filter, err := m.userFilter(ctx, q)
+	if err != nil {
+		return err
+	}
+	ids := bson.M{"$lte": pos.Until}
+	if pos.After != "" {
+		ids["$gt"] = pos.After
+	}
+	filter = bson.M{"$and": bson.A{filter, bson.M{"_id": ids}}}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var mu MongoUser
+		if err := cursor.Decode(&mu); err != nil {
+			return err
+		}
+		mu.AddUserIDs()
+		pos.After = mu.ID
+		if err := f(mu.User, pos.String()); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// exportCursor is the position of an export: the last user exported and the
+// newest user when the export started, which keeps resumed exports to the
+// users of the original one.
+type exportCursor struct {
+	After ID
+	Until ID
+}
+
+// String encodes the cursor as an opaque URL safe token. Cursors between
+// ObjectIDs are their 24 bytes, as they always were; others are the two IDs
+// separated by a space.
+func (c exportCursor) String() string {
+	after, aerr := primitive.ObjectIDFromHex(string(c.After))
+	until, uerr := primitive.ObjectIDFromHex(string(c.Until))
+	if (aerr == nil || c.After == "") && uerr == nil {
+		return base64.RawURLEncoding.EncodeToString(append(after[:], until[:]...))
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(string(c.After) + " " + string(c.Until)))
+}
+
+// parseExportCursor decodes a cursor token. The empty token is the zero
+// cursor.
+func parseExportCursor(s string) (exportCursor, error) {
+	var c exportCursor
+	if s == "" {
+		return c, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, db.ErrInvalidCursor
+	}
+	var after, until primitive.ObjectID
+	if len(b) == len(after)+len(until) {
+		copy(after[:], b)
+		copy(until[:], b[len(after):])
+		if until.IsZero() {
+			return c, db.ErrInvalidCursor
+		}
+		if !after.IsZero() {
+			c.After = ID(after.Hex())
+		}
+		c.Until = ID(until.Hex())
+		return c, nil
+	}
+	a, u, ok := strings.Cut(string(b), " ")
+	if !ok || u == "" {
+		return c, db.ErrInvalidCursor
+	}
+	c.After, c.Until = ID(a), ID(u)
+	return c, nil
+}
+
+// userFilter returns the filter matching q, resolving the country to the
+// owners of addresses in it.
+func (m *Mongo) userFilter(ctx context.Context, q db.Query) (bson.M, error) {
+	filter := searchFilter(q)
+	if q.Country != "" {
+		ids, err := m.database().Collection("addresses").Distinct(ctx, "customerID", bson.M{"country": q.Country})
+		if err != nil {
+			return nil, err
+		}
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	return filter, nil
+}
+
+func searchFilter(q db.Query) bson.M {
+	filter := bson.M{}
+	created := bson.M{}
+	if !q.CreatedAfter.IsZero() {
+		created["$gte"] = q.CreatedAfter
+	}
+	if !q.CreatedBefore.IsZero() {
+		created["$lt"] = q.CreatedBefore
+	}
+	if len(created) > 0 {
+		filter["createdAt"] = created
+	}
+	if !q.InactiveSince.IsZero() {
+		filter["$or"] = bson.A{
+			bson.M{"lastLogin": bson.M{"$lt": q.InactiveSince}},
+			bson.M{"lastLogin": bson.M{"$exists": false}, "createdAt": bson.M{"$lt": q.InactiveSince}},
+		}
+	}
+	// An anchored, case sensitive regular expression is answered from the
+	// index bounds. The type matches the partial index filter, without which
+	// the index is not used.
+	switch {
+	case q.Username != "":
+		filter["usernameNormalized"] = q.Username
+	case q.UsernamePrefix != "":
+		filter["usernameNormalized"] = bson.M{"$type": "string", "$regex": "^" + regexp.QuoteMeta(q.UsernamePrefix)}
+	}
+	if q.EmailDomain != "" {
+		filter["emailDomain"] = q.EmailDomain
+	}
+	if q.Tag != "" {
+		filter["tags"] = q.Tag
+	}
+	return filter
+}
+
+// FindDuplicates reports groups of users sharing a normalized email, a name
+// and postcode, or a card number, ordered by reason and key.
+func (m *Mongo) FindDuplicates(offset, limit int) ([]db.Duplicate, error) {
+	if encrypting() {
+		return nil, ErrEncryptedDuplicates
+	}
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	coll := m.database().Collection("customers")
+	cursor, err := coll.Aggregate(ctx, duplicatesPipeline(offset, limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Reason string `bson:"reason"`
+		Key    string `bson:"key"`
+		IDs    []ID   `bson:"ids"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	ds := make([]db.Duplicate, 0, len(groups))
+	for _, g := range groups {
+		d := db.Duplicate{Reason: g.Reason, Key: g.Key, UserIDs: make([]string, 0, len(g.IDs))}
+		if d.Reason == db.DuplicateCard {
+			d.Key = fingerprint(d.Key)
+		}
+		for _, id := range g.IDs {
+			d.UserIDs = append(d.UserIDs, string(id))
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// duplicatesPipeline unions one grouping per duplicate reason over the
+// customers collection, keeping only groups with more than one user.
+func duplicatesPipeline(offset, limit int) bson.A {
+	group := func(reason string, key interface{}) bson.A {
+		return bson.A{
+			bson.M{"$group": bson.M{"_id": key, "ids": bson.M{"$addToSet": "$_id"}}},
+			bson.M{"$match": bson.M{"_id": bson.M{"$nin": bson.A{"", nil}}, "ids.1": bson.M{"$exists": true}}},
+			bson.M{"$project": bson.M{"_id": 0, "reason": bson.M{"$literal": reason}, "key": "$_id", "ids": 1}},
+		}
+	}
+	lower := func(field string) bson.M {
+		return bson.M{"$toLower": bson.M{"$trim": bson.M{"input": bson.M{"$ifNull": bson.A{field, ""}}}}}
+	}
+
+	email := group(db.DuplicateEmail, lower("$email"))
+	namePostcode := append(bson.A{
+		bson.M{"$lookup": bson.M{"from": "addresses", "localField": "addresses", "foreignField": "_id", "as": "address"}},
+		bson.M{"$unwind": "$address"},
+		bson.M{"$match": bson.M{"address.postcode": bson.M{"$nin": bson.A{"", nil}}}},
+	}, group(db.DuplicateNamePostcode, bson.M{"$concat": bson.A{
+		lower("$firstName"), " ", lower("$lastName"), "/", lower("$address.postcode"),
+	}})...)
+	card := append(bson.A{
+		bson.M{"$lookup": bson.M{"from": "cards", "localField": "cards", "foreignField": "_id", "as": "card"}},
+		bson.M{"$unwind": "$card"},
+	}, group(db.DuplicateCard, "$card.longNum")...)
+
+	return append(email,
+		bson.M{"$unionWith": bson.M{"coll": "customers", "pipeline": namePostcode}},
+		bson.M{"$unionWith": bson.M{"coll": "customers", "pipeline": card}},
+		bson.M{"$sort": bson.D{{Key: "reason", Value: 1}, {Key: "key", Value: 1}}},
+		bson.M{"$skip": offset},
+		bson.M{"$limit": limit},
+	)
+}
+
+// fingerprint hides a card number while still identifying it.
+func fingerprint(longNum string) string {
+	h := sha256.Sum256([]byte(longNum))
+	return hex.EncodeToString(h[:8])
+}
+
+// UpdateLastLogin stamps the user's last login time
+func (m *Mongo) UpdateLastLogin(id string) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	uid, err := m.parseID(id)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+
+	coll := m.database().Collection("customers")
+	_, err = coll.UpdateOne(ctx, bson.M{"_id": uid}, bson.M{"$set": bson.M{"lastLogin": m.now()}})
+	return err
+}
+
+// UpdateAvatar sets the user's profile image key
+func (m *Mongo) UpdateAvatar(id, key string) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	uid, err := m.parseID(id)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+
+	coll := m.database().Collection("customers")
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": uid}, bson.M{"$set": bson.M{"avatar": key, "updatedAt": m.now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return users.ErrUserNotFound
+	}
+	return nil
+}
+
+// UpdateProfile sets the user's names and email
+func (m *Mongo) UpdateProfile(u *users.User) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	uid, err := m.parseID(u.UserID)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+
+	u.UpdatedAt = m.now()
+	coll := m.database().Collection("customers")
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": uid}, bson.M{"$set": bson.M{
+		"firstName":       u.FirstName,
+		"lastName":        u.LastName,
+		"email":           u.Email,
+		"emailNormalized": u.EmailNormalized,
+		"updatedAt":       u.UpdatedAt,
+	}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return users.ErrUserNotFound
+	}
+	return nil
+}
+
+// AddTag adds a tag to the user
+func (m *Mongo) AddTag(id, tag string) error {
+	return m.updateTags(id, bson.M{"$addToSet": bson.M{"tags": tag}})
+}
+
+// RemoveTag removes a tag from the user
+func (m *Mongo) RemoveTag(id, tag string) error {
+	return m.updateTags(id, bson.M{"$pull": bson.M{"tags": tag}})
+}
+
+func (m *Mongo) updateTags(id string, update bson.M) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	uid, err := m.parseID(id)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+
+	update["$set"] = bson.M{"updatedAt": m.now()}
+	coll := m.database().Collection("customers")
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": uid}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return users.ErrUserNotFound
+	}
+	return nil
+}
+
+func (m *Mongo) GetUserAttributes(u *users.User) error {
+	addrIds, err := m.parseIDs(addressIDs(u.Addresses))
+	if err != nil {
+		return err
+	}
+	cardIds, err := m.parseIDs(cardIDs(u.Cards))
+	if err != nil {
+		return err
+	}
+
+	// Addresses and cards are read concurrently. A failure to read one
+	// does not stop the other, so that the user is returned with what
+	// could be read.
+	ctx, cancel := m.ctx()
+	defer cancel()
+	var g errgroup.Group
+	var addrErr, cardErr error
+	var na []users.Address
+	var nc []users.Card
+	g.Go(func() error {
+		var ma []MongoAddress
+		addrErr = m.findIn(ctx, "addresses", addrIds, &ma)
+		na = make([]users.Address, 0, len(ma))
+		for _, a := range ma {
+			a.AddID()
+			na = append(na, a.Address)
+		}
+		return addrErr
+	})
+	g.Go(func() error {
+		var mc []MongoCard
+		cardErr = m.findIn(ctx, "cards", cardIds, &mc)
+		nc = make([]users.Card, 0, len(mc))
+		for _, ca := range mc {
+			ca.AddID()
+			nc = append(nc, ca.Card)
+		}
+		return cardErr
+	})
+	g.Wait()
+
+	u.Addresses, u.Cards = na, nc
+	var errs []error
+	if addrErr != nil {
+		u.Addresses = make([]users.Address, 0)
+		errs = append(errs, &db.AttributeError{Attr: db.AttrAddresses, Err: addrErr})
+	}
+	if cardErr != nil {
+		u.Cards = make([]users.Card, 0)
+		errs = append(errs, &db.AttributeError{Attr: db.AttrCards, Err: cardErr})
+	}
+	return errors.Join(errs...)
+}
+
+// findIn decodes the documents of collection with the given IDs into out.
+func (m *Mongo) findIn(ctx context.Context, collection string, ids []ID, out interface{}) error {
+	cur, err := m.database().Collection(collection).Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, out)
+}
+
+func (m *Mongo) GetCard(id string) (users.Card, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	if !m.IDs().Valid(id) {
+		return users.Card{}, ErrInvalidHexID
+	}
+	cid := ID(id)
+
+	coll := m.database().Collection("cards")
+	mc := MongoCard{}
+	err := coll.FindOne(ctx, bson.M{"_id": cid}).Decode(&mc)
+	if err != nil {
+		return users.Card{}, notFound(err, users.ErrCardNotFound)
 	}
 	mc.AddID()
 	return mc.Card, nil
 }
 
-func (m *Mongo) GetCards() ([]users.Card, error) {
+// UpdateCardStatus sets the card's status and flag
+func (m *Mongo) UpdateCardStatus(id, status string, flag *users.CardFlag) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	cid, err := m.parseID(id)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+
+	update := bson.M{"$set": bson.M{"status": status, "flag": flag, "updatedAt": m.now()}}
+	if flag == nil {
+		update = bson.M{"$set": bson.M{"status": status, "updatedAt": m.now()}, "$unset": bson.M{"flag": ""}}
+	}
+	coll := m.database().Collection("cards")
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": cid}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return users.ErrCardNotFound
+	}
+	return nil
+}
+
+// GetCards gets cards as listed by l
+func (m *Mongo) GetCards(l db.ListOptions) ([]users.Card, error) {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	coll := m.Client.Database(db).Collection("cards")
-	cursor, err := coll.Find(ctx, bson.M{})
+	opts, err := findOptions("cards", l)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := m.afterFilter("cards", l, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	coll := m.database().Collection("cards")
+	cursor, err := coll.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -378,17 +1596,63 @@ func (m *Mongo) GetCards() ([]users.Card, error) {
 	return cs, nil
 }
 
+// GetCustomerCards gets the cards owned by a user
+func (m *Mongo) GetCustomerCards(userid string) ([]users.Card, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	uid, err := m.parseID(userid)
+	if err != nil {
+		return nil, ErrInvalidHexID
+	}
+	cursor, err := m.database().Collection("cards").Find(ctx, bson.M{"customerID": uid})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var mcs []MongoCard
+	if err = cursor.All(ctx, &mcs); err != nil {
+		return nil, err
+	}
+	cs := make([]users.Card, 0, len(mcs))
+	for _, mc := range mcs {
+		mc.AddID()
+		cs = append(cs, mc.Card)
+	}
+	return cs, nil
+}
+
 func (m *Mongo) CreateCard(ca *users.Card, userid string) error {
+	now := m.now()
+	ca.CreatedAt, ca.UpdatedAt = now, now
+	return m.putCard(ca, userid, m.newID())
+}
+
+// ImportCard adds the card under its ID, keeping its timestamps
+func (m *Mongo) ImportCard(ca *users.Card, userid string) error {
+	id, err := m.parseID(ca.ID)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+	if ca.CreatedAt.IsZero() {
+		now := m.now()
+		ca.CreatedAt, ca.UpdatedAt = now, now
+	}
+	return m.putCard(ca, userid, id)
+}
+
+func (m *Mongo) putCard(ca *users.Card, userid string, id ID) error {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	if userid != "" && !primitive.IsValidObjectID(userid) {
+	if userid != "" && !m.IDs().Valid(userid) {
 		return ErrInvalidHexID
 	}
+	uid := ID(userid)
 
-	coll := m.Client.Database(db).Collection("cards")
-	id := primitive.NewObjectID()
-	mc := MongoCard{Card: *ca, ID: id}
+	coll := m.database().Collection("cards")
+	mc := MongoCard{Card: *ca, ID: id, CustomerID: uid}
 
 	opts := options.Replace().SetUpsert(true)
 	_, err := coll.ReplaceOne(ctx, bson.M{"_id": mc.ID}, mc, opts)
@@ -397,8 +1661,9 @@ func (m *Mongo) CreateCard(ca *users.Card, userid string) error {
 	}
 
 	if userid != "" {
-		err = m.appendAttributeId("cards", mc.ID, userid)
+		err = m.appendAttributeId("cards", mc.ID, userid, db.MaxCards, db.ErrCardLimit)
 		if err != nil {
+			coll.DeleteOne(ctx, bson.M{"_id": mc.ID})
 			return err
 		}
 	}
@@ -412,28 +1677,36 @@ func (m *Mongo) GetAddress(id string) (users.Address, error) {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	if !primitive.IsValidObjectID(id) {
+	if !m.IDs().Valid(id) {
 		return users.Address{}, ErrInvalidHexID
 	}
-	aid, _ := primitive.ObjectIDFromHex(id)
+	aid := ID(id)
 
-	coll := m.Client.Database(db).Collection("addresses")
+	coll := m.database().Collection("addresses")
 	ma := MongoAddress{}
 	err := coll.FindOne(ctx, bson.M{"_id": aid}).Decode(&ma)
 	if err != nil {
-		return users.Address{}, err
+		return users.Address{}, notFound(err, users.ErrAddressNotFound)
 	}
 	ma.AddID()
 	return ma.Address, nil
 }
 
-// GetAddresses gets all addresses
-func (m *Mongo) GetAddresses() ([]users.Address, error) {
+// GetAddresses gets addresses as listed by l
+func (m *Mongo) GetAddresses(l db.ListOptions) ([]users.Address, error) {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	coll := m.Client.Database(db).Collection("addresses")
-	cursor, err := coll.Find(ctx, bson.M{})
+	opts, err := findOptions("addresses", l)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := m.afterFilter("addresses", l, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	coll := m.database().Collection("addresses")
+	cursor, err := coll.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -452,18 +1725,64 @@ func (m *Mongo) GetAddresses() ([]users.Address, error) {
 	return as, nil
 }
 
+// GetCustomerAddresses gets the addresses owned by a user
+func (m *Mongo) GetCustomerAddresses(userid string) ([]users.Address, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	uid, err := m.parseID(userid)
+	if err != nil {
+		return nil, ErrInvalidHexID
+	}
+	cursor, err := m.database().Collection("addresses").Find(ctx, bson.M{"customerID": uid})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var mas []MongoAddress
+	if err = cursor.All(ctx, &mas); err != nil {
+		return nil, err
+	}
+	as := make([]users.Address, 0, len(mas))
+	for _, ma := range mas {
+		ma.AddID()
+		as = append(as, ma.Address)
+	}
+	return as, nil
+}
+
 // CreateAddress Inserts Address into MongoDB
 func (m *Mongo) CreateAddress(a *users.Address, userid string) error {
+	now := m.now()
+	a.CreatedAt, a.UpdatedAt = now, now
+	return m.putAddress(a, userid, m.newID())
+}
+
+// ImportAddress adds the address under its ID, keeping its timestamps
+func (m *Mongo) ImportAddress(a *users.Address, userid string) error {
+	id, err := m.parseID(a.ID)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+	if a.CreatedAt.IsZero() {
+		now := m.now()
+		a.CreatedAt, a.UpdatedAt = now, now
+	}
+	return m.putAddress(a, userid, id)
+}
+
+func (m *Mongo) putAddress(a *users.Address, userid string, id ID) error {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	if userid != "" && !primitive.IsValidObjectID(userid) {
+	if userid != "" && !m.IDs().Valid(userid) {
 		return ErrInvalidHexID
 	}
+	uid := ID(userid)
 
-	coll := m.Client.Database(db).Collection("addresses")
-	id := primitive.NewObjectID()
-	ma := MongoAddress{Address: *a, ID: id}
+	coll := m.database().Collection("addresses")
+	ma := MongoAddress{Address: *a, ID: id, CustomerID: uid}
 
 	opts := options.Replace().SetUpsert(true)
 	_, err := coll.ReplaceOne(ctx, bson.M{"_id": ma.ID}, ma, opts)
@@ -472,8 +1791,9 @@ func (m *Mongo) CreateAddress(a *users.Address, userid string) error {
 	}
 
 	if userid != "" {
-		err = m.appendAttributeId("addresses", ma.ID, userid)
+		err = m.appendAttributeId("addresses", ma.ID, userid, db.MaxAddresses, db.ErrAddressLimit)
 		if err != nil {
+			coll.DeleteOne(ctx, bson.M{"_id": ma.ID})
 			return err
 		}
 	}
@@ -487,10 +1807,10 @@ func (m *Mongo) Delete(entity, id string) error {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	if !primitive.IsValidObjectID(id) {
+	if !m.IDs().Valid(id) {
 		return ErrInvalidHexID
 	}
-	oid, _ := primitive.ObjectIDFromHex(id)
+	oid := ID(id)
 
 	if entity == "customers" {
 		// Load user to find linked addresses and cards
@@ -499,30 +1819,34 @@ func (m *Mongo) Delete(entity, id string) error {
 			return err
 		}
 
-		aids := make([]primitive.ObjectID, 0)
+		aids := make([]ID, 0)
 		for _, a := range u.Addresses {
-			if aid, err := primitive.ObjectIDFromHex(a.ID); err == nil {
+			if aid, err := m.parseID(a.ID); err == nil {
 				aids = append(aids, aid)
 			}
 		}
-		cids := make([]primitive.ObjectID, 0)
+		cids := make([]ID, 0)
 		for _, c := range u.Cards {
-			if cid, err := primitive.ObjectIDFromHex(c.ID); err == nil {
+			if cid, err := m.parseID(c.ID); err == nil {
 				cids = append(cids, cid)
 			}
 		}
 
 		// Delete linked records
-		_, _ = m.Client.Database(db).Collection("addresses").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": aids}})
-		_, _ = m.Client.Database(db).Collection("cards").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": cids}})
+		_, _ = m.database().Collection("addresses").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": aids}})
+		_, _ = m.database().Collection("cards").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": cids}})
+		_, _ = m.database().Collection("notes").DeleteMany(ctx, bson.M{"userID": id})
 	} else {
 		// If deleting a card/address, pull the reference from all customers
-		collCust := m.Client.Database(db).Collection("customers")
-		_, _ = collCust.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{entity: oid}})
+		collCust := m.database().Collection("customers")
+		_, _ = collCust.UpdateMany(ctx, bson.M{entity: oid}, bson.M{
+			"$pull": bson.M{entity: oid},
+			"$set":  bson.M{"updatedAt": m.now()},
+		})
 	}
 
 	// Delete the actual entity
-	_, err := m.Client.Database(db).Collection(entity).DeleteOne(ctx, bson.M{"_id": oid})
+	_, err := m.database().Collection(entity).DeleteOne(ctx, bson.M{"_id": oid})
 	return err
 }
 
@@ -530,7 +1854,7 @@ func getURL() url.URL {
 	ur := url.URL{
 		Scheme: "mongodb",
 		Host:   host,
-		Path:   db,
+		Path:   dbName,
 	}
 	if name != "" {
 		ur.User = url.UserPassword(name, password)
@@ -538,26 +1862,566 @@ func getURL() url.URL {
 	return ur
 }
 
-// EnsureIndexes refactored for modern IndexModel
+// indexSpec is an index the service relies on.
+type indexSpec struct {
+	collection string
+	model      mongo.IndexModel
+}
+
+// declaredIndexes returns the indexes EnsureIndexes builds, including those
+// backing sortKeys. Each is named so that it can be compared with the built
+// ones.
+func declaredIndexes() []indexSpec {
+	index := func(collection, name string, keys bson.D, opts *options.IndexOptions) indexSpec {
+		if opts == nil {
+			opts = options.Index()
+		}
+		return indexSpec{collection, mongo.IndexModel{Keys: keys, Options: opts.SetName(name)}}
+	}
+	specs := []indexSpec{
+		index("customers", "username_1", bson.D{{Key: "username", Value: 1}}, options.Index().SetUnique(true)),
+		index("customers", "usernameNormalized_1", bson.D{{Key: "usernameNormalized", Value: 1}}, options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"usernameNormalized": bson.M{"$type": "string"}})),
+		{"customers", emailIndex(db.UniqueEmail)},
+		index("customers", "emailDomain_1", bson.D{{Key: "emailDomain", Value: 1}}, nil),
+		index("customers", "tags_1", bson.D{{Key: "tags", Value: 1}}, nil),
+		index("logins", "userID_1_time_-1", bson.D{{Key: "userID", Value: 1}, {Key: "time", Value: -1}}, nil),
+		index("notes", "userID_1_createdAt_-1", bson.D{{Key: "userID", Value: 1}, {Key: "createdAt", Value: -1}}, nil),
+		index("jobs", "status_1_createdAt_1", bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}, nil),
+		index("addresses", "customerID_1", bson.D{{Key: "customerID", Value: 1}}, nil),
+		index("addresses", "country_1_customerID_1", bson.D{{Key: "country", Value: 1}, {Key: "customerID", Value: 1}}, nil),
+		index("cards", "customerID_1", bson.D{{Key: "customerID", Value: 1}}, nil),
+	}
+	if age, ok := db.Retention[db.AuditTrail]; ok {
+		specs = append(specs, index("notes", auditTTLIndex, bson.D{{Key: "createdAt", Value: 1}}, options.Index().
+			// The configuration bounds age by db.MaxRetention.
+			SetExpireAfterSeconds(int32(age/time.Second)).
+			SetPartialFilterExpression(bson.M{"kind": bson.M{"$exists": true}})))
+	}
+	for _, collection := range []string{"customers", "addresses", "cards"} {
+		for _, keys := range sortKeys[collection] {
+			name := indexName(keys)
+			if !slices.ContainsFunc(specs, func(s indexSpec) bool { return s.collection == collection && *s.model.Options.Name == name }) {
+				specs = append(specs, index(collection, name, keys, nil))
+			}
+		}
+	}
+	return specs
+}
+
+// auditTTLIndex expires the notes the service records itself, which have a
+// kind, after the audit trail's retention.
+const auditTTLIndex = "createdAt_audit_ttl"
+
+// indexName returns the name Mongo gives an index on keys.
+func indexName(keys bson.D) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%v_%v", k.Key, k.Value)
+	}
+	return strings.Join(parts, "_")
+}
+
+// EnsureIndexes builds the declared indexes that are missing and, if
+// -mongo-drop-unknown-indexes is set, drops those that are not declared.
+// Mismatching indexes are left for an operator to rebuild.
 func (m *Mongo) EnsureIndexes() error {
 	ctx, cancel := m.ctx()
 	defer cancel()
 
-	coll := m.Client.Database(db).Collection("customers")
+	copts := options.CreateCollection().SetCapped(true).SetSizeInBytes(loginHistoryBytes)
+	err := m.database().CreateCollection(ctx, "logins", copts)
+	var cerr mongo.CommandError
+	if err != nil && !(errors.As(err, &cerr) && cerr.Code == errNamespaceExists) {
+		return err
+	}
+
+	declared := make(map[[2]string]mongo.IndexModel)
+	for _, spec := range declaredIndexes() {
+		declared[[2]string{spec.collection, *spec.model.Options.Name}] = spec.model
+	}
+	states, err := m.indexStates(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range states {
+		indexes := m.database().Collection(s.Collection).Indexes()
+		switch {
+		case s.State == db.IndexMissing:
+			_, err = indexes.CreateOne(ctx, declared[[2]string{s.Collection, s.Name}])
+		case s.State == db.IndexUnknown && dropUnknownIndexes:
+			_, err = indexes.DropOne(ctx, s.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return m.setAuditTTL(ctx)
+}
+
+// setAuditTTL updates the expiry of the audit trail's TTL index, which
+// is built with the retention at the time, to the current retention.
+func (m *Mongo) setAuditTTL(ctx context.Context) error {
+	age, ok := db.Retention[db.AuditTrail]
+	if !ok {
+		return nil
+	}
+	return m.database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: "notes"},
+		{Key: "index", Value: bson.D{
+			{Key: "name", Value: auditTTLIndex},
+			{Key: "expireAfterSeconds", Value: int64(age / time.Second)},
+		}},
+	}).Err()
+}
+
+// Indexes compares the declared indexes with those built on their
+// collections.
+func (m *Mongo) Indexes() ([]db.Index, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+	return m.indexStates(ctx)
+}
+
+func (m *Mongo) indexStates(ctx context.Context) ([]db.Index, error) {
+	var states []db.Index
+	built := make(map[string]map[string]db.Index)
+	for _, spec := range declaredIndexes() {
+		if _, ok := built[spec.collection]; !ok {
+			b, err := m.builtIndexes(ctx, spec.collection)
+			if err != nil {
+				return nil, err
+			}
+			built[spec.collection] = b
+		}
+		want := db.Index{
+			Collection: spec.collection,
+			Name:       *spec.model.Options.Name,
+			Keys:       indexKeys(spec.model.Keys.(bson.D)),
+			Unique:     spec.model.Options.Unique != nil && *spec.model.Options.Unique,
+			State:      db.IndexMissing,
+		}
+		if have, ok := built[spec.collection][want.Name]; ok {
+			want.State = db.IndexOK
+			if have.Keys != want.Keys || have.Unique != want.Unique {
+				want.State = db.IndexMismatch
+			}
+			delete(built[spec.collection], want.Name)
+		}
+		states = append(states, want)
+	}
+	for _, indexes := range built {
+		for _, i := range indexes {
+			states = append(states, i)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Collection != states[j].Collection {
+			return states[i].Collection < states[j].Collection
+		}
+		return states[i].Name < states[j].Name
+	})
+	return states, nil
+}
+
+// builtIndexes returns the indexes of a collection by name, as unknown,
+// leaving out the _id index every collection has.
+func (m *Mongo) builtIndexes(ctx context.Context, collection string) (map[string]db.Index, error) {
+	cursor, err := m.database().Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var specs []struct {
+		Name   string `bson:"name"`
+		Key    bson.D `bson:"key"`
+		Unique bool   `bson:"unique"`
+	}
+	if err := cursor.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+	indexes := make(map[string]db.Index)
+	for _, s := range specs {
+		if s.Name == "_id_" {
+			continue
+		}
+		indexes[s.Name] = db.Index{Collection: collection, Name: s.Name, Keys: indexKeys(s.Key), Unique: s.Unique, State: db.IndexUnknown}
+	}
+	return indexes, nil
+}
+
+// indexKeys renders index keys as "field:direction" pairs.
+func indexKeys(keys bson.D) string {
+	fields := make([]string, len(keys))
+	for i, k := range keys {
+		fields[i] = fmt.Sprintf("%v:%v", k.Key, k.Value)
+	}
+	return strings.Join(fields, ",")
+}
+
+// backfillEmailDomains stores the email domain of users saved before it was
+// recorded. The server cannot read encrypted emails, so encryptFields does
+// it while fields are encrypted.
+func (m *Mongo) backfillEmailDomains() error {
+	if encrypting() {
+		return nil
+	}
+	ctx, cancel := m.ctx()
+	defer cancel()
+	_, err := m.database().Collection("customers").UpdateMany(ctx,
+		bson.M{"emailDomain": bson.M{"$exists": false}, "email": bson.M{"$regex": "@"}},
+		bson.A{bson.M{"$set": bson.M{"emailDomain": bson.M{"$toLower": bson.M{"$trim": bson.M{"input": bson.M{"$arrayElemAt": bson.A{bson.M{"$split": bson.A{"$email", "@"}}, -1}}}}}}}})
+	return err
+}
+
+// stripLinks removes the hypermedia links customers and addresses were once
+// saved with. Links are generated from IDs when serving them.
+func (m *Mongo) stripLinks() error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+	for _, c := range []string{"customers", "addresses"} {
+		_, err := m.database().Collection(c).UpdateMany(ctx,
+			bson.M{"links": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"links": ""}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillOwners sets the owner of addresses and cards saved before they
+// recorded one, from the IDs listed on each customer.
+func (m *Mongo) backfillOwners() error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	database := m.database()
+	unowned := bson.M{"customerID": bson.M{"$exists": false}}
+	na, err := database.Collection("addresses").CountDocuments(ctx, unowned, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	nc, err := database.Collection("cards").CountDocuments(ctx, unowned, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if na == 0 && nc == 0 {
+		return nil
+	}
+
+	cursor, err := database.Collection("customers").Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"addresses": 1, "cards": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var mu MongoUser
+		if err := cursor.Decode(&mu); err != nil {
+			return err
+		}
+		for attr, ids := range map[string][]ID{"addresses": mu.AddressIDs, "cards": mu.CardIDs} {
+			if len(ids) == 0 {
+				continue
+			}
+			_, err := database.Collection(attr).UpdateMany(ctx,
+				bson.M{"_id": bson.M{"$in": ids}, "customerID": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"customerID": mu.ID}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return cursor.Err()
+}
 
-	indexModel := mongo.IndexModel{
-		Keys: bson.D{{Key: "username", Value: 1}},
-		Options: options.Index().
+// emailIndex indexes normalized emails, enforcing uniqueness if asked to.
+// The unique index is named apart so that enabling the flag adds it alongside
+// the plain one; disabling the flag again does not drop it.
+func emailIndex(unique bool) mongo.IndexModel {
+	opts := options.Index().SetName("emailNormalized_1")
+	if unique {
+		opts = options.Index().
+			SetName("emailNormalized_unique").
 			SetUnique(true).
-			SetBackground(true),
+			SetPartialFilterExpression(bson.M{"emailNormalized": bson.M{"$type": "string"}})
+	}
+	return mongo.IndexModel{Keys: bson.D{{Key: "emailNormalized", Value: 1}}, Options: opts}
+}
+
+// CreateLoginAttempt records a login attempt in the capped logins collection
+func (m *Mongo) CreateLoginAttempt(l *users.LoginAttempt) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	if l.Time.IsZero() {
+		l.Time = m.now()
+	}
+	_, err := m.database().Collection("logins").InsertOne(ctx, l)
+	return err
+}
+
+// Purge deletes the login attempts made before before. The logins
+// collection is capped, which rules out a TTL index; deleting from it needs
+// MongoDB 5.0 or later. The audit trail expires through its TTL index.
+func (m *Mongo) Purge(kind string, before time.Time) (int64, error) {
+	if kind != db.LoginHistory {
+		return 0, nil
+	}
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	r, err := m.database().Collection("logins").DeleteMany(ctx, bson.M{"time": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return r.DeletedCount, nil
+}
+
+// GetLoginAttempts returns the most recent login attempts for a user
+func (m *Mongo) GetLoginAttempts(userid string) ([]users.LoginAttempt, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	if !m.IDs().Valid(userid) {
+		return nil, ErrInvalidHexID
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}}).
+		SetLimit(loginHistoryLimit)
+	cursor, err := m.database().Collection("logins").Find(ctx, bson.M{"userID": userid}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	ls := make([]users.LoginAttempt, 0)
+	if err = cursor.All(ctx, &ls); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// CreateNote inserts a note about an existing user
+func (m *Mongo) CreateNote(n *users.Note) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	if !m.IDs().Valid(n.UserID) {
+		return ErrInvalidHexID
+	}
+	mn := MongoNote{Note: *n, ID: m.newID()}
+	if mn.CreatedAt.IsZero() {
+		mn.CreatedAt = m.now()
+	}
+	if _, err := m.database().Collection("notes").InsertOne(ctx, mn); err != nil {
+		return err
+	}
+	n.ID = string(mn.ID)
+	n.CreatedAt = mn.CreatedAt
+	return nil
+}
+
+// GetNotes returns a page of a user's notes, newest first
+func (m *Mongo) GetNotes(userid string, offset, limit int) ([]users.Note, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	if !m.IDs().Valid(userid) {
+		return nil, ErrInvalidHexID
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+	cursor, err := m.database().Collection("notes").Find(ctx, bson.M{"userID": userid}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var mns []MongoNote
+	if err = cursor.All(ctx, &mns); err != nil {
+		return nil, err
+	}
+	ns := make([]users.Note, 0, len(mns))
+	for _, mn := range mns {
+		mn.Note.ID = string(mn.ID)
+		ns = append(ns, mn.Note)
+	}
+	return ns, nil
+}
+
+// CreateJob inserts a queued job
+func (m *Mongo) CreateJob(j *jobs.Job) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	t := m.now()
+	j.Status = jobs.Queued
+	j.CreatedAt = t
+	j.UpdatedAt = t
+	mj := MongoJob{Job: *j, ID: m.newID()}
+	if _, err := m.database().Collection("jobs").InsertOne(ctx, mj); err != nil {
+		return err
+	}
+	j.ID = string(mj.ID)
+	return nil
+}
+
+// GetJob returns the job with the given ID
+func (m *Mongo) GetJob(id string) (jobs.Job, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	oid, err := m.parseID(id)
+	if err != nil {
+		return jobs.Job{}, ErrInvalidHexID
+	}
+	var mj MongoJob
+	err = m.database().Collection("jobs").FindOne(ctx, bson.M{"_id": oid}).Decode(&mj)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	mj.AddID()
+	return mj.Job, nil
+}
+
+// UpdateJob replaces a stored job still leased to its owner, refreshing its
+// heartbeat and extending its lease
+func (m *Mongo) UpdateJob(j *jobs.Job, leaseUntil time.Time) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	oid, err := m.parseID(j.ID)
+	if err != nil {
+		return ErrInvalidHexID
+	}
+	updated := *j
+	updated.UpdatedAt = m.now()
+	updated.LeaseUntil = leaseUntil
+	res, err := m.database().Collection("jobs").ReplaceOne(ctx, jobLeaseFilter(oid, j), MongoJob{Job: updated, ID: oid})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return jobs.ErrLeaseLost
+	}
+	*j = updated
+	return nil
+}
+
+// jobLeaseFilter matches the job while it is leased as j holds it, so a worker
+// whose lease was taken over cannot overwrite the new owner's progress.
+func jobLeaseFilter(oid ID, j *jobs.Job) bson.M {
+	return bson.M{"_id": oid, "owner": j.Owner, "leaseUntil": j.LeaseUntil}
+}
+
+// ClaimJob takes the oldest queued or expired running job for owner
+func (m *Mongo) ClaimJob(owner string, now, leaseUntil time.Time) (jobs.Job, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "createdAt", Value: 1}}).
+		SetReturnDocument(options.After)
+	var mj MongoJob
+	err := m.database().Collection("jobs").FindOneAndUpdate(ctx, claimFilter(now), bson.M{
+		"$set": bson.M{"status": jobs.Running, "owner": owner, "leaseUntil": leaseUntil, "updatedAt": m.now()},
+		"$inc": bson.M{"attempts": 1},
+	}, opts).Decode(&mj)
+	if err == mongo.ErrNoDocuments {
+		return jobs.Job{}, jobs.ErrNoJob
+	}
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	mj.AddID()
+	return mj.Job, nil
+}
+
+// claimFilter matches queued jobs and running jobs whose lease ran out
+// before now. Jobs claimed before leases were kept have none, so they are
+// taken over too.
+func claimFilter(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"status": jobs.Queued},
+		bson.M{"status": jobs.Running, "leaseUntil": bson.M{"$not": bson.M{"$gte": now}}},
+	}}
+}
+
+// idMapKey is the _id of the idmap document of the entity of kind with the
+// old ID, and of the reservation of a key of kind.
+func idMapKey(kind, old string) string {
+	return kind + "/" + old
+}
+
+// MapIDs records the new IDs of entities of kind by their old IDs
+func (m *Mongo) MapIDs(kind string, ids map[string]string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	models := make([]mongo.WriteModel, 0, len(ids))
+	for old, id := range ids {
+		key := idMapKey(kind, old)
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": key}).
+			SetReplacement(bson.M{"_id": key, "kind": kind, "new": id}).
+			SetUpsert(true))
+	}
+	_, err := m.database().Collection("idmap").BulkWrite(ctx, models)
+	return err
+}
+
+// MappedID returns the new ID recorded for the old one
+func (m *Mongo) MappedID(kind, old string) (string, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	var doc struct {
+		New string `bson:"new"`
+	}
+	err := m.database().Collection("idmap").FindOne(ctx, bson.M{"_id": idMapKey(kind, old)}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return "", db.ErrNotMapped
+	}
+	return doc.New, err
+}
+
+// reservationLease is how long a reservation is held when not released.
+const reservationLease = time.Minute
+
+// Reserve reserves the key of kind in the reservations collection. The
+// upsert only matches reservations that ran out, so a held one makes it
+// insert a duplicate _id, which is refused.
+func (m *Mongo) Reserve(kind, key string) (bool, error) {
+	ctx, cancel := m.ctx()
+	defer cancel()
+
+	now := m.now()
+	_, err := m.database().Collection("reservations").UpdateOne(ctx,
+		bson.M{"_id": idMapKey(kind, key), "until": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"until": now.Add(reservationLease)}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	_, err := coll.Indexes().CreateOne(ctx, indexModel)
+// Release deletes the reservation of the key of kind.
+func (m *Mongo) Release(kind, key string) error {
+	ctx, cancel := m.ctx()
+	defer cancel()
+	_, err := m.database().Collection("reservations").DeleteOne(ctx, bson.M{"_id": idMapKey(kind, key)})
 	return err
 }
 
 func (m *Mongo) Ping() error {
 	ctx, cancel := m.ctx()
 	defer cancel()
-	return m.Client.Ping(ctx, nil)
+	return m.client().Ping(ctx, nil)
 }
@@ -0,0 +1,742 @@
+//go:build integration
+
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/secrets"
+	"github.com/mikesay/user/testenv"
+	"github.com/mikesay/user/users"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive" // New BSON package
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	TestMongo Mongo
+	TestUser  = users.User{
+		FirstName: "firstname",
+		LastName:  "lastname",
+		Username:  "username",
+		Password:  "blahblah",
+		Addresses: []users.Address{{Street: "street"}},
+	}
+)
+
+func TestMain(m *testing.M) {
+	// Mongo is started in a container, unless MONGO_TEST_URI names one.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	uri, stop, err := testenv.Mongo(ctx)
+	if errors.Is(err, testenv.ErrNoDocker) {
+		fmt.Printf("Skipping Mongo tests: %v\n", err)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Printf("Failed to start Mongo: %v\n", err)
+		os.Exit(1)
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	cancel()
+	if err != nil {
+		fmt.Printf("Failed to connect to Mongo: %v\n", err)
+		stop()
+		os.Exit(1)
+	}
+
+	TestMongo.Client = client
+	TestMongo.Database = client.Database("test_users")
+	TestMongo.EnsureIndexes()
+
+	code := m.Run()
+
+	// Teardown
+	TestMongo.Database.Drop(context.Background())
+	client.Disconnect(context.Background())
+	stop()
+	os.Exit(code)
+}
+
+func TestStripLinks(t *testing.T) {
+	ctx := context.Background()
+	c := TestMongo.Client.Database(dbName).Collection("addresses")
+	id := primitive.NewObjectID()
+	if _, err := c.InsertOne(ctx, bson.M{"_id": id, "street": "street", "links": bson.M{"self": bson.M{"href": "http://x/addresses/1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.stripLinks(); err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := c.FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["links"]; ok || doc["street"] != "street" {
+		t.Errorf("Expected the links removed and nothing else, received %v", doc)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	err := TestMongo.CreateUser(&TestUser)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Test duplicate
+	err = TestMongo.CreateUser(&TestUser)
+	if err == nil {
+		t.Error("Expected duplicate key error")
+	}
+}
+
+func TestGetUserByName(t *testing.T) {
+	u, err := TestMongo.GetUserByName(TestUser.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != TestUser.Username {
+		t.Errorf("Expected %s, got %s", TestUser.Username, u.Username)
+	}
+}
+
+func TestNormalizeUsernames(t *testing.T) {
+	u := users.User{Username: "MixedCase"}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestMongo.NormalizeUsernames(strings.ToLower); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetUserByName("mixedcase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != u.UserID {
+		t.Errorf("Expected user %v, received %v", u.UserID, got.UserID)
+	}
+	dup := users.User{Username: "mixedCASE"}
+	if err := TestMongo.CreateUser(&dup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestMongo.NormalizeUsernames(strings.ToLower); err == nil {
+		t.Error("Expected conflicting usernames to be reported")
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	u := users.User{Username: "emailuser", Email: "Mail@Example.com", EmailNormalized: "mail@example.com"}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetUserByEmail(" MAIL@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != u.UserID {
+		t.Errorf("Expected user %v, received %v", u.UserID, got.UserID)
+	}
+}
+
+func TestExists(t *testing.T) {
+	for _, c := range []struct {
+		exists func(string) (bool, error)
+		key    string
+		want   bool
+	}{
+		{TestMongo.ExistsUsername, TestUser.Username, true},
+		{TestMongo.ExistsUsername, "nobody", false},
+		{TestMongo.ExistsEmail, " MAIL@example.com", true},
+		{TestMongo.ExistsEmail, "nobody@example.com", false},
+	} {
+		if got, err := c.exists(c.key); err != nil || got != c.want {
+			t.Errorf("Expected %v for %q, received %v %v", c.want, c.key, got, err)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	is, err := TestMongo.Indexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(is) < len(declaredIndexes()) {
+		t.Fatalf("Expected every declared index to be reported, received %v", is)
+	}
+	for _, i := range is {
+		if i.State == db.IndexMissing || i.State == db.IndexMismatch {
+			t.Errorf("Expected %v.%v to be built, received %v", i.Collection, i.Name, i.State)
+		}
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	// Reusing the global TestMongo.Client initialized in TestMain
+	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Ensure your Mongo struct method 'GetUser' is updated to accept context
+	_, err := TestMongo.GetUser(TestUser.UserID)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateLastLogin(t *testing.T) {
+	err := TestMongo.UpdateLastLogin(TestUser.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := TestMongo.GetUser(TestUser.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.LastLogin.IsZero() || u.CreatedAt.IsZero() {
+		t.Error("Expected created and last login timestamps")
+	}
+}
+
+func TestUpdateAvatar(t *testing.T) {
+	if err := TestMongo.UpdateAvatar(TestUser.UserID, "avatars/a/1"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := TestMongo.GetUser(TestUser.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Avatar != "avatars/a/1" {
+		t.Errorf("Expected avatar key to be stored, received %q", u.Avatar)
+	}
+	if err := TestMongo.UpdateAvatar(primitive.NewObjectID().Hex(), "avatars/b/1"); err != users.ErrUserNotFound {
+		t.Errorf("Expected unknown user to be reported, received %v", err)
+	}
+}
+
+func TestTags(t *testing.T) {
+	for _, tag := range []string{"vip", "beta", "vip"} {
+		if err := TestMongo.AddTag(TestUser.UserID, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := TestMongo.GetUser(TestUser.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(u.Tags) != "[vip beta]" {
+		t.Errorf("Expected each tag stored once, received %v", u.Tags)
+	}
+	us, err := TestMongo.GetUsers(db.ListOptions{Tag: "beta"})
+	if err != nil || len(us) != 1 || us[0].UserID != TestUser.UserID {
+		t.Errorf("Expected the tagged user listed, received %v %v", us, err)
+	}
+	if err := TestMongo.RemoveTag(TestUser.UserID, "beta"); err != nil {
+		t.Fatal(err)
+	}
+	if us, _ := TestMongo.SearchUsers(db.Query{Tag: "beta"}); len(us) != 0 {
+		t.Errorf("Expected no user tagged after removal, received %v", us)
+	}
+	if err := TestMongo.AddTag(primitive.NewObjectID().Hex(), "vip"); err != users.ErrUserNotFound {
+		t.Errorf("Expected unknown user to be reported, received %v", err)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	us, err := TestMongo.SearchUsers(db.Query{CreatedBefore: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(us) != 1 {
+		t.Errorf("Expected one user created before now, received %v", len(us))
+	}
+	us, err = TestMongo.SearchUsers(db.Query{InactiveSince: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(us) != 0 {
+		t.Errorf("Expected no inactive users, received %v", len(us))
+	}
+}
+
+func TestCountUsers(t *testing.T) {
+	q := db.Query{CreatedBefore: time.Now().Add(time.Minute)}
+	us, err := TestMongo.SearchUsers(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := TestMongo.CountUsers(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(us)) {
+		t.Errorf("Expected %v users counted, received %v", len(us), n)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	var n int
+	var last string
+	count := func(_ users.User, cursor string) error {
+		n++
+		last = cursor
+		return nil
+	}
+	if err := TestMongo.ExportUsers(db.Query{}, "", count); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected one user exported, received %v", n)
+	}
+	n = 0
+	if err := TestMongo.ExportUsers(db.Query{}, last, count); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("Expected nothing after the last cursor, received %v", n)
+	}
+	if err := TestMongo.ExportUsers(db.Query{Country: "Atlantis"}, "", count); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("Expected no users with an address in Atlantis, received %v", n)
+	}
+	if err := TestMongo.ExportUsers(db.Query{}, "bogus", count); err != db.ErrInvalidCursor {
+		t.Errorf("Expected invalid cursor, received %v", err)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	a := users.User{Username: "dup-a", Email: "Dup@Example.com"}
+	b := users.User{Username: "dup-b", Email: " dup@example.com"}
+	for _, u := range []*users.User{&a, &b} {
+		if err := TestMongo.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ds, err := TestMongo.FindDuplicates(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range ds {
+		if d.Reason == db.DuplicateEmail && d.Key == "dup@example.com" && len(d.UserIDs) == 2 {
+			return
+		}
+	}
+	t.Errorf("Expected email duplicate, received %v", ds)
+}
+
+func TestLoginAttempts(t *testing.T) {
+	err := TestMongo.CreateLoginAttempt(&users.LoginAttempt{UserID: TestUser.UserID, Username: TestUser.Username, Success: true, IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := TestMongo.GetLoginAttempts(TestUser.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 || ls[0].IP != "10.0.0.1" || ls[0].Time.IsZero() {
+		t.Errorf("Expected one timestamped login attempt, received %v", ls)
+	}
+	if _, err := TestMongo.GetLoginAttempts("nothex"); err != ErrInvalidHexID {
+		t.Error("Expected invalid hex id error")
+	}
+}
+
+func TestPurgeLoginHistory(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+	for _, at := range []time.Time{old, time.Now()} {
+		if err := TestMongo.CreateLoginAttempt(&users.LoginAttempt{UserID: TestUser.UserID, Username: "purged", Time: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := TestMongo.Purge(db.LoginHistory, time.Now().Add(-24*time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("Expected the old attempt purged, received %v %v", n, err)
+	}
+	if n, err := TestMongo.Purge(db.AuditTrail, time.Now()); err != nil || n != 0 {
+		t.Errorf("Expected the audit trail left to its TTL index, received %v %v", n, err)
+	}
+}
+
+func TestNotes(t *testing.T) {
+	u := users.User{Username: "noted", FirstName: "Noted", LastName: "User"}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"first", "second", "third"} {
+		n := users.Note{UserID: u.UserID, Author: "agent", Text: text, Visibility: users.NoteInternal}
+		if err := TestMongo.CreateNote(&n); err != nil || n.ID == "" || n.CreatedAt.IsZero() {
+			t.Fatalf("Expected the note stored, received %v %+v", err, n)
+		}
+	}
+	ns, err := TestMongo.GetNotes(u.UserID, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 2 || ns[0].Text != "second" || ns[1].Text != "first" || ns[0].ID == "" {
+		t.Errorf("Expected the second page of notes newest first, received %+v", ns)
+	}
+	if err := TestMongo.Delete("customers", u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if ns, err := TestMongo.GetNotes(u.UserID, 0, 5); err != nil || len(ns) != 0 {
+		t.Errorf("Expected notes deleted with the customer, received %v %v", ns, err)
+	}
+}
+
+func TestImportUser(t *testing.T) {
+	u := users.User{
+		UserID:    primitive.NewObjectID().Hex(),
+		Username:  "imported",
+		Addresses: []users.Address{{ID: primitive.NewObjectID().Hex(), Street: "street"}},
+		Cards:     []users.Card{{ID: primitive.NewObjectID().Hex(), LongNum: "1234"}},
+	}
+	if err := TestMongo.ImportUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Addresses) != 1 || got.Addresses[0].ID != u.Addresses[0].ID {
+		t.Error("Expected imported address ID to be kept")
+	}
+	if err := TestMongo.ImportUser(&u); err != db.ErrIDConflict {
+		t.Errorf("Expected ID conflict on second import, received %v", err)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	j := jobs.Job{Kind: "restore"}
+	if err := TestMongo.CreateJob(&j); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Millisecond)
+	claimed, err := TestMongo.ClaimJob("worker", now, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.ID != j.ID || claimed.Status != jobs.Running || claimed.Owner != "worker" || claimed.Attempts != 1 {
+		t.Errorf("Expected job to be claimed, received %+v", claimed)
+	}
+	if _, err := TestMongo.ClaimJob("other", now, now.Add(time.Minute)); err != jobs.ErrNoJob {
+		t.Error("Expected running job not to be claimed again before its lease expires")
+	}
+	stale := claimed
+	taken, err := TestMongo.ClaimJob("other", now.Add(2*time.Minute), now.Add(3*time.Minute))
+	if err != nil || taken.Owner != "other" || taken.Attempts != 2 {
+		t.Fatalf("Expected expired job taken over, received %+v, %v", taken, err)
+	}
+	if err := TestMongo.UpdateJob(&stale, now.Add(4*time.Minute)); err != jobs.ErrLeaseLost {
+		t.Errorf("Expected an update under a lost lease refused, received %v", err)
+	}
+	claimed = taken
+	claimed.Status = jobs.Succeeded
+	if err := TestMongo.UpdateJob(&claimed, now.Add(4*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != jobs.Succeeded {
+		t.Errorf("Expected updated status, received %v", got.Status)
+	}
+}
+
+func TestCardLimit(t *testing.T) {
+	defer func(n int) { db.MaxCards = n }(db.MaxCards)
+	db.MaxCards = 1
+	u := users.User{Username: "limited"}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.CreateCard(&users.Card{LongNum: "1"}, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.CreateCard(&users.Card{LongNum: "2"}, u.UserID); err != db.ErrCardLimit {
+		t.Errorf("Expected card limit error, received %v", err)
+	}
+	cs, err := TestMongo.GetCustomerCards(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 {
+		t.Errorf("Expected the refused card to be removed, received %v", cs)
+	}
+}
+
+func TestSortedUsers(t *testing.T) {
+	for _, name := range []string{"sortb", "sorta", "sortc"} {
+		u := users.User{Username: name, LastName: name}
+		if err := TestMongo.CreateUser(&u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	us, err := TestMongo.GetUsers(db.ListOptions{Sort: "username", Descending: true, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(us) != 2 || us[0].Username < us[1].Username {
+		t.Errorf("Expected two users in descending order, received %v", us)
+	}
+}
+
+func TestKeysetPaging(t *testing.T) {
+	add := func(name string) {
+		u := users.User{Username: name, LastName: "Keyset", Tags: []string{"keyset"}}
+		if err := TestMongo.CreateUser(&u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"keyb", "keyd", "keyf"} {
+		add(name)
+	}
+	for _, sort := range []string{"", "username", "lastName", "createdAt"} {
+		l := db.ListOptions{Sort: sort, Tag: "keyset", Limit: 2}
+		seen, names := map[string]bool{}, map[string]bool{}
+		for {
+			page, err := TestMongo.GetUsers(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range page {
+				if seen[u.UserID] {
+					t.Errorf("Expected %v listed once by %q", u.Username, sort)
+				}
+				seen[u.UserID], names[u.Username] = true, true
+			}
+			if len(page) < l.Limit {
+				break
+			}
+			l.After = db.After(l, page[len(page)-1])
+			// A user inserted while paging may or may not be listed, but
+			// the others are neither skipped nor repeated.
+			add(fmt.Sprintf("keya%v%v", sort, len(seen)))
+		}
+		if !names["keyb"] || !names["keyd"] || !names["keyf"] {
+			t.Errorf("Expected every user listed by %q, received %v", sort, names)
+		}
+	}
+}
+
+func TestGetCustomerAttributes(t *testing.T) {
+	u := users.User{Username: "owner", Addresses: []users.Address{{Street: "street"}}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111"}
+	if err := TestMongo.CreateCard(&c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	as, err := TestMongo.GetCustomerAddresses(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 1 || as[0].ID != u.Addresses[0].ID {
+		t.Errorf("Expected the user's address, received %v", as)
+	}
+	cs, err := TestMongo.GetCustomerCards(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 || cs[0].ID != c.ID {
+		t.Errorf("Expected the user's card, received %v", cs)
+	}
+	if _, err := TestMongo.GetCustomerCards("nothex"); err != ErrInvalidHexID {
+		t.Error("Expected invalid hex id error")
+	}
+}
+
+func TestUpdateCardStatus(t *testing.T) {
+	c := users.Card{LongNum: "4000"}
+	if err := TestMongo.CreateCard(&c, ""); err != nil {
+		t.Fatal(err)
+	}
+	flag := &users.CardFlag{Reason: "chargeback", Actor: "risk", FlaggedAt: time.Now().UTC().Truncate(time.Millisecond)}
+	if err := TestMongo.UpdateCardStatus(c.ID, users.CardSuspectedFraud, flag); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetCard(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != users.CardSuspectedFraud || got.Flag == nil || got.Flag.Reason != "chargeback" {
+		t.Errorf("Expected the card flagged, received %+v", got)
+	}
+	if err := TestMongo.UpdateCardStatus(c.ID, users.CardActive, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = TestMongo.GetCard(c.ID); !got.Usable() || got.Flag != nil {
+		t.Errorf("Expected the card reinstated, received %+v", got)
+	}
+	if err := TestMongo.UpdateCardStatus(primitive.NewObjectID().Hex(), users.CardActive, nil); err != users.ErrCardNotFound {
+		t.Errorf("Expected unknown card to be reported, received %v", err)
+	}
+}
+
+func TestCreateUserAttributes(t *testing.T) {
+	u := users.User{Username: "many"}
+	for k := 0; k < 20; k++ {
+		u.Addresses = append(u.Addresses, users.Address{Street: fmt.Sprint("street ", k)})
+	}
+	u.Cards = []users.Card{{LongNum: "4111"}, {LongNum: "4222"}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetUserWithAttributes(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Addresses) != 20 || len(got.Cards) != 2 {
+		t.Errorf("Expected every address and card stored, received %v and %v", len(got.Addresses), len(got.Cards))
+	}
+	for _, a := range u.Addresses {
+		if a.ID == "" || a.CreatedAt.IsZero() {
+			t.Errorf("Expected the address given its ID, received %+v", a)
+		}
+	}
+}
+
+func TestGetUserAttributes(t *testing.T) {
+	a := users.Address{Street: "Attr St"}
+	if err := TestMongo.CreateAddress(&a, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111"}
+	if err := TestMongo.CreateCard(&c, ""); err != nil {
+		t.Fatal(err)
+	}
+	u := users.User{Addresses: []users.Address{{ID: a.ID}}, Cards: []users.Card{{ID: c.ID}}}
+	if err := TestMongo.GetUserAttributes(&u); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Addresses) != 1 || u.Addresses[0].Street != "Attr St" || len(u.Cards) != 1 || u.Cards[0].LongNum != "4111" {
+		t.Errorf("Expected the address and card read, received %+v", u)
+	}
+	u = users.User{Cards: []users.Card{{ID: "bad"}}}
+	if err := TestMongo.GetUserAttributes(&u); err != ErrInvalidHexID {
+		t.Errorf("Expected invalid IDs refused, received %v", err)
+	}
+}
+
+func TestGetUserWithAttributes(t *testing.T) {
+	u := users.User{Username: "hydrated", Addresses: []users.Address{{Street: "street"}}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111"}
+	if err := TestMongo.CreateCard(&c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []bool{true, false} {
+		lookup = l
+		got, err := TestMongo.GetUserWithAttributes(u.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Username != "hydrated" || len(got.Addresses) != 1 || got.Addresses[0].Street != "street" ||
+			len(got.Cards) != 1 || got.Cards[0].ID != c.ID {
+			t.Errorf("Expected the user with their address and card (lookup %v), received %+v", l, got)
+		}
+		if _, err := TestMongo.GetUserWithAttributes(primitive.NewObjectID().Hex()); err != users.ErrUserNotFound {
+			t.Errorf("Expected unknown user to be reported (lookup %v), received %v", l, err)
+		}
+	}
+	lookup = true
+}
+
+func TestCollectOrphans(t *testing.T) {
+	u := users.User{Username: "orphans", Addresses: []users.Address{{Street: "kept"}}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	unowned := users.Card{LongNum: "4999"}
+	if err := TestMongo.CreateCard(&unowned, ""); err != nil {
+		t.Fatal(err)
+	}
+	// An address naming its owner without being listed by them.
+	unlisted := users.Address{Street: "unlisted"}
+	if err := TestMongo.CreateAddress(&unlisted, ""); err != nil {
+		t.Fatal(err)
+	}
+	aid, _ := primitive.ObjectIDFromHex(unlisted.ID)
+	uid, _ := primitive.ObjectIDFromHex(u.UserID)
+	TestMongo.Client.Database(dbName).Collection("addresses").UpdateOne(context.Background(), bson.M{"_id": aid}, bson.M{"$set": bson.M{"customerID": uid}})
+
+	if o, err := TestMongo.CollectOrphans(time.Now().Add(-time.Hour), false); err != nil || o != (db.Orphans{}) {
+		t.Errorf("Expected recent attributes spared, received %+v %v", o, err)
+	}
+	o, err := TestMongo.CollectOrphans(time.Now().Add(time.Minute), true)
+	if err != nil || o.Addresses < 1 || o.Cards < 1 {
+		t.Errorf("Expected the orphans found, received %+v %v", o, err)
+	}
+	if _, err := TestMongo.GetCard(unowned.ID); err != nil {
+		t.Errorf("Expected a dry run to keep the orphan card, received %v", err)
+	}
+	if _, err := TestMongo.CollectOrphans(time.Now().Add(time.Minute), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestMongo.GetCard(unowned.ID); err != users.ErrCardNotFound {
+		t.Errorf("Expected the unowned card deleted, received %v", err)
+	}
+	if _, err := TestMongo.GetAddress(unlisted.ID); err != users.ErrAddressNotFound {
+		t.Errorf("Expected the unlisted address deleted, received %v", err)
+	}
+	if _, err := TestMongo.GetAddress(u.Addresses[0].ID); err != nil {
+		t.Errorf("Expected the owned address kept, received %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	// The official driver uses Ping(ctx, readpref)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// Use the official Ping method on the Client
+	err := TestMongo.Client.Ping(ctx, nil) // passing nil defaults to Primary
+	if err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	if held, err := TestMongo.acquireLease(ctx, "test"); err != nil || held {
+		t.Fatalf("Expected free lease, received %v, %v", held, err)
+	}
+	if held, err := TestMongo.acquireLease(ctx, "test"); err != nil || held {
+		t.Fatalf("Expected lease to be renewed, received %v, %v", held, err)
+	}
+	if err := TestMongo.releaseLease("test"); err != nil {
+		t.Fatal(err)
+	}
+	ran := false
+	if err := TestMongo.withLease(ctx, "test", func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("Expected function to run under the lease, received %v", err)
+	}
+}
+
+type staticSecrets secrets.Credentials
+
+func (s staticSecrets) Credentials(context.Context) (secrets.Credentials, error) {
+	return secrets.Credentials(s), nil
+}
+
+func TestRefreshUnchangedCredentials(t *testing.T) {
+	m := &Mongo{Client: TestMongo.Client, Secrets: staticSecrets{Username: "user", Password: "pass"}}
+	m.creds = secrets.Credentials{Username: "user", Password: "pass"}
+	if err := m.refreshCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if m.client() != TestMongo.Client {
+		t.Error("Expected client to be kept while credentials are unchanged")
+	}
+}
@@ -1,54 +1,28 @@
 package mongodb
 
 import (
+	"bytes"
 	"context"
-	"fmt"
-	"os"
+	"encoding/base64"
+	"reflect"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
 	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive" // New BSON package
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var (
-	TestMongo Mongo
-	TestUser  = users.User{
-		FirstName: "firstname",
-		LastName:  "lastname",
-		Username:  "username",
-		Password:  "blahblah",
-		Addresses: []users.Address{{Street: "street"}},
-	}
-)
-
-func TestMain(m *testing.M) {
-	// Setup: Connect to a real local mongo or a container
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		fmt.Printf("Failed to connect to Mongo: %v\n", err)
-		os.Exit(1)
-	}
-
-	TestMongo.Client = client
-	TestMongo.Database = client.Database("test_users")
-
-	// Replace EnsureIndexes with your new implementation
-	TestMongo.EnsureIndexes()
-
-	code := m.Run()
-
-	// Teardown
-	TestMongo.Database.Drop(context.Background())
-	client.Disconnect(context.Background())
-	os.Exit(code)
-}
-
 func TestAddUserIDs(t *testing.T) {
 	// Refactor mgo.ObjectId to primitive.ObjectID
 	uid := primitive.NewObjectID()
@@ -57,9 +31,9 @@ func TestAddUserIDs(t *testing.T) {
 
 	// Logic remains similar, but ensure types match primitive.ObjectID
 	m := New()
-	m.ID = uid
-	m.AddressIDs = append(m.AddressIDs, aid)
-	m.CardIDs = append(m.CardIDs, cid)
+	m.ID = ID(uid.Hex())
+	m.AddressIDs = append(m.AddressIDs, ID(aid.Hex()))
+	m.CardIDs = append(m.CardIDs, ID(cid.Hex()))
 	m.AddUserIDs()
 
 	if m.UserID != uid.Hex() {
@@ -67,48 +41,235 @@ func TestAddUserIDs(t *testing.T) {
 	}
 }
 
-func TestCreate(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// storedFields are the fields customers, addresses and cards are saved with.
+var storedFields = []string{
+	"_id", "firstName", "lastName", "email", "username", "password", "salt", "createdAt", "updatedAt", "lastLogin",
+	"usernameNormalized", "emailNormalized", "emailDomain", "avatar", "residency", "tags", "addresses", "cards",
+	"street", "number", "country", "city", "postcode", "customerID", "longNum", "expires", "ccv", "status", "flag",
+}
 
-	err := TestMongo.CreateUser(&TestUser)
-	if err != nil {
-		t.Error(err)
+func TestStoredFields(t *testing.T) {
+	mu := New()
+	mu.User = users.User{UserID: "u1", FirstName: "Eve", Username: "eve", Avatar: "avatars/u1/1", CreatedAt: time.Now(),
+		Addresses: []users.Address{{ID: "a1", Street: "street"}}, Cards: []users.Card{{ID: "c1", LongNum: "1234"}}}
+	docs := []interface{}{
+		mu,
+		MongoAddress{Address: users.Address{ID: "a1", Street: "street", City: "London"}},
+		MongoCard{Card: users.Card{ID: "c1", LongNum: "1234", Status: users.CardActive}},
 	}
+	for _, doc := range docs {
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d bson.D
+		if err := bson.Unmarshal(b, &d); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range d {
+			if !slices.Contains(storedFields, e.Key) {
+				t.Errorf("Expected only domain fields stored, received %q in %T", e.Key, doc)
+			}
+		}
+	}
+}
+
+func TestEmailIndex(t *testing.T) {
+	if *emailIndex(false).Options.Name == *emailIndex(true).Options.Name {
+		t.Error("Expected unique email index to be named apart")
+	}
+	if u := emailIndex(true).Options.Unique; u == nil || !*u {
+		t.Error("Expected unique email index")
+	}
+}
+
+func TestDeclaredIndexes(t *testing.T) {
+	names := make(map[string]bool)
+	for _, spec := range declaredIndexes() {
+		name := spec.collection + "." + *spec.model.Options.Name
+		if names[name] {
+			t.Errorf("Expected %v to be declared once", name)
+		}
+		names[name] = true
+	}
+	if k := indexKeys(bson.D{{Key: "userID", Value: 1}, {Key: "time", Value: int32(-1)}}); k != "userID:1,time:-1" {
+		t.Errorf("Expected rendered keys, received %v", k)
+	}
+}
 
-	// Test duplicate
-	err = TestMongo.CreateUser(&TestUser)
-	if err == nil {
-		t.Error("Expected duplicate key error")
+func TestExportCursor(t *testing.T) {
+	c := exportCursor{After: ID(primitive.NewObjectID().Hex()), Until: ID(primitive.NewObjectID().Hex())}
+	for _, c := range []exportCursor{c, {Until: c.Until}, {After: "01J0000000000000000000000A", Until: "01J0000000000000000000000B"}} {
+		got, err := parseExportCursor(c.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c {
+			t.Errorf("Expected %v, received %v", c, got)
+		}
+	}
+	if b, _ := base64.RawURLEncoding.DecodeString(c.String()); len(b) != 24 {
+		t.Errorf("Expected a cursor between ObjectIDs kept to their bytes, received %d", len(b))
+	}
+	if c, err := parseExportCursor(""); err != nil || c.After != "" {
+		t.Errorf("Expected empty cursor to start from the beginning, received %v %v", c, err)
+	}
+	for _, s := range []string{"!!", "AAAA", (exportCursor{After: c.After}).String()} {
+		if _, err := parseExportCursor(s); err != db.ErrInvalidCursor {
+			t.Errorf("Expected %q to be refused, received %v", s, err)
+		}
 	}
 }
 
-func TestGetUserByName(t *testing.T) {
-	u, err := TestMongo.GetUserByName(TestUser.Username)
+func TestSearchFilter(t *testing.T) {
+	if len(searchFilter(db.Query{})) != 0 {
+		t.Error("Expected empty filter for empty query")
+	}
+	f := searchFilter(db.Query{CreatedAfter: time.Now(), InactiveSince: time.Now()})
+	if _, ok := f["createdAt"]; !ok {
+		t.Error("Expected createdAt filter")
+	}
+	if _, ok := f["$or"]; !ok {
+		t.Error("Expected inactivity filter")
+	}
+	f = searchFilter(db.Query{UsernamePrefix: "a.b", EmailDomain: "example.com"})
+	if re := f["usernameNormalized"].(bson.M)["$regex"]; re != `^a\.b` {
+		t.Errorf("Expected anchored, quoted prefix, received %v", re)
+	}
+	if f["emailDomain"] != "example.com" {
+		t.Errorf("Expected email domain filter, received %v", f)
+	}
+	if f = searchFilter(db.Query{Username: "a.b", UsernamePrefix: "a"}); f["usernameNormalized"] != "a.b" {
+		t.Errorf("Expected exact username filter, received %v", f)
+	}
+	if f = searchFilter(db.Query{Tag: "vip"}); f["tags"] != "vip" {
+		t.Errorf("Expected tag filter, received %v", f)
+	}
+}
+
+func TestEmailDomain(t *testing.T) {
+	for email, domain := range map[string]string{"a@Example.COM": "example.com", "a@b@c.org": "c.org", "none": ""} {
+		if d := emailDomain(email); d != domain {
+			t.Errorf("Expected domain %q of %q, received %q", domain, email, d)
+		}
+	}
+}
+
+func TestDuplicatesPipeline(t *testing.T) {
+	p := duplicatesPipeline(20, 10)
+	if p[len(p)-2].(bson.M)["$skip"] != 20 || p[len(p)-1].(bson.M)["$limit"] != 10 {
+		t.Error("Expected pipeline to end with pagination")
+	}
+	if fingerprint("4111") == "4111" || fingerprint("4111") != fingerprint("4111") {
+		t.Error("Expected stable fingerprint hiding the card number")
+	}
+}
+
+func TestLimitFilter(t *testing.T) {
+	f := limitFilter(ID(primitive.NewObjectID().Hex()), "cards", 10)
+	if _, ok := f["cards.9"]; !ok {
+		t.Error("Expected tenth card to be required absent")
+	}
+	if len(limitFilter("", "cards", 0)) != 1 {
+		t.Error("Expected no limit filter for zero limit")
+	}
+}
+
+func TestFindOptions(t *testing.T) {
+	opts, err := findOptions("customers", db.ListOptions{Sort: "lastName", Descending: true, Offset: 20, Limit: 10})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if u.Username != TestUser.Username {
-		t.Errorf("Expected %s, got %s", TestUser.Username, u.Username)
+	sort := opts.Sort.(bson.D)
+	if len(sort) != 2 || sort[0].Key != "lastName" || sort[0].Value != -1 || sort[1].Value != -1 {
+		t.Errorf("Expected descending last name sort, received %v", sort)
+	}
+	if *opts.Skip != 20 || *opts.Limit != 10 {
+		t.Errorf("Expected second page, received skip %v limit %v", *opts.Skip, *opts.Limit)
+	}
+	if opts, _ := findOptions("cards", db.ListOptions{}); opts.Sort != nil {
+		t.Error("Expected whole lists to be unsorted")
+	}
+	if _, err := findOptions("cards", db.ListOptions{Sort: "longNum"}); err != db.ErrInvalidSort {
+		t.Errorf("Expected unindexed sort to be refused, received %v", err)
+	}
+	for collection, sorts := range sortKeys {
+		for _, keys := range sorts {
+			if !slices.ContainsFunc(declaredIndexes(), func(s indexSpec) bool {
+				return s.collection == collection && *s.model.Options.Name == indexName(keys)
+			}) {
+				t.Errorf("Expected index backing %v sort %v", collection, keys)
+			}
+		}
 	}
 }
 
-func TestGetUser(t *testing.T) {
-	// Reusing the global TestMongo.Client initialized in TestMain
-	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func TestAfterFilter(t *testing.T) {
+	id := ID(primitive.NewObjectID().Hex())
+	m := &Mongo{}
+	if f, err := m.afterFilter("customers", db.ListOptions{}, bson.M{"tags": "vip"}); err != nil || !reflect.DeepEqual(f, bson.M{"tags": "vip"}) {
+		t.Errorf("Expected the filter unchanged without a cursor, received %v %v", f, err)
+	}
+	for _, c := range []struct {
+		l    db.ListOptions
+		last interface{}
+		want bson.A
+	}{
+		{db.ListOptions{}, users.User{UserID: string(id)}, bson.A{
+			bson.M{"_id": bson.M{"$gt": id}},
+		}},
+		{db.ListOptions{Sort: "lastName", Descending: true}, users.User{UserID: string(id), LastName: "Doe"}, bson.A{
+			bson.M{"lastName": bson.M{"$lt": "Doe"}},
+			bson.M{"lastName": "Doe", "_id": bson.M{"$lt": id}},
+		}},
+		{db.ListOptions{Sort: "city"}, users.Address{ID: string(id)}, bson.A{
+			bson.M{"city": bson.M{"$ne": nil}},
+			bson.M{"city": nil, "_id": bson.M{"$gt": id}},
+		}},
+		{db.ListOptions{Sort: "city", Descending: true}, users.Address{ID: string(id), City: "Oslo"}, bson.A{
+			bson.M{"$or": bson.A{bson.M{"city": bson.M{"$lt": "Oslo"}}, bson.M{"city": nil}}},
+			bson.M{"city": "Oslo", "_id": bson.M{"$lt": id}},
+		}},
+	} {
+		c.l.After = db.After(c.l, c.last)
+		collection := map[bool]string{true: "customers", false: "addresses"}[c.l.Sort != "city"]
+		f, err := m.afterFilter(collection, c.l, bson.M{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (bson.M{"$and": bson.A{bson.M{}, bson.M{"$or": c.want}}}); !reflect.DeepEqual(f, want) {
+			t.Errorf("Expected %v after %+v, received %v", want, c.last, f)
+		}
+	}
+	after := db.After(db.ListOptions{}, users.User{UserID: "x"})
+	if _, err := m.afterFilter("customers", db.ListOptions{After: after}, bson.M{}); err != db.ErrInvalidCursor {
+		t.Errorf("Expected a cursor of another database refused, received %v", err)
+	}
+}
 
-	// Ensure your Mongo struct method 'GetUser' is updated to accept context
-	_, err := TestMongo.GetUser(TestUser.UserID)
-	if err != nil {
-		t.Error(err)
+func TestClaimFilter(t *testing.T) {
+	if _, ok := claimFilter(time.Now())["$or"]; !ok {
+		t.Error("Expected queued or stale filter")
 	}
 }
 
-func TestGetUserAttributes(t *testing.T) {
-	// No session copying needed; just use the global client
-	ctx := context.Background()
-	_ = ctx // Use this context for any DB calls here
+func TestInsertedDocs(t *testing.T) {
+	inserted, err := insertedDocs("address", 3, mongo.BulkWriteException{
+		WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 1, Code: 11000, Message: "duplicate key"}}},
+	})
+	if !slices.Equal(inserted, []bool{true, false, true}) {
+		t.Errorf("Expected the second address failed, received %v", inserted)
+	}
+	if err == nil || err.Error() != "address 1: duplicate key" {
+		t.Errorf("Expected the failure attributed, received %v", err)
+	}
+	inserted, err = insertedDocs("card", 2, context.DeadlineExceeded)
+	if !slices.Equal(inserted, []bool{false, false}) || err != context.DeadlineExceeded {
+		t.Errorf("Expected no card known inserted, received %v %v", inserted, err)
+	}
+	if inserted, err = insertedDocs("card", 2, nil); !slices.Equal(inserted, []bool{true, true}) || err != nil {
+		t.Errorf("Expected every card inserted, received %v %v", inserted, err)
+	}
 }
 
 func TestGetURL(t *testing.T) {
@@ -125,14 +286,197 @@ func TestGetURL(t *testing.T) {
 	}
 }
 
-func TestPing(t *testing.T) {
-	// The official driver uses Ping(ctx, readpref)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+func TestNow(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 123456789, time.FixedZone("CET", 3600)))
+	m := &Mongo{Clock: c}
+	if got := m.now(); !got.Equal(time.Date(2024, 1, 1, 11, 0, 0, 123000000, time.UTC)) || got.Location() != time.UTC {
+		t.Errorf("Expected the clock's time in UTC to the millisecond, received %v", got)
+	}
+}
+
+func TestIDsUseClock(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	oid, err := primitive.ObjectIDFromHex(string((&Mongo{Clock: c}).newID()))
+	if err != nil || !oid.Timestamp().Equal(c.Now()) {
+		t.Errorf("Expected an ObjectID of the clock's time, received %v %v", oid.Timestamp(), err)
+	}
+	rng := func() clock.RNG { return bytes.NewReader(make([]byte, 10)) }
+	m := &Mongo{Clock: c, RNG: rng(), Scheme: ids.ULIDScheme}
+	if id, want := m.newID(), (ids.ULID{Clock: c, RNG: rng()}).New(); string(id) != want {
+		t.Errorf("Expected %v from the clock and RNG, received %v", want, id)
+	}
+}
+
+// FuzzIDs checks that every ID the backend declares valid is an ObjectID it
+// can query by.
+func FuzzIDs(f *testing.F) {
+	for _, id := range []string{"57a98d98e4b00679b4a830b2", "57A98D98E4B00679B4A830B2", "nothex", "57a98d98e4b00679b4a830bé", ""} {
+		f.Add(id)
+	}
+	f.Fuzz(func(t *testing.T, id string) {
+		if !(&Mongo{}).IDs().Valid(id) {
+			return
+		}
+		if _, err := primitive.ObjectIDFromHex(id); err != nil {
+			t.Errorf("Expected %q parsed, received %v", id, err)
+		}
+	})
+}
+
+func TestIDStorage(t *testing.T) {
+	oid := primitive.NewObjectID()
+	for _, c := range []struct {
+		id   ID
+		want bsontype.Type
+	}{
+		{ID(oid.Hex()), bson.TypeObjectID},
+		{"01J0000000000000000000000A", bson.TypeString},
+	} {
+		b, err := bson.Marshal(MongoNote{ID: c.id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bson.Raw(b).Lookup("_id").Type; got != c.want {
+			t.Errorf("Expected %v stored as %v, received %v", c.id, c.want, got)
+		}
+		var mn MongoNote
+		if err := bson.Unmarshal(b, &mn); err != nil || mn.ID != c.id {
+			t.Errorf("Expected %v read back, received %v %v", c.id, mn.ID, err)
+		}
+	}
+}
+
+func TestIDScheme(t *testing.T) {
+	for scheme, g := range map[string]ids.Generator{"": ids.ObjectID{}, ids.ULIDScheme: ids.ULID{}, ids.UUIDv7Scheme: ids.UUIDv7{}} {
+		m := &Mongo{Scheme: scheme}
+		if id := m.newID(); !g.Valid(string(id)) {
+			t.Errorf("Expected an ID of scheme %q, received %v", scheme, id)
+		}
+		if _, err := m.parseID(g.New()); err != nil {
+			t.Errorf("Expected an ID of scheme %q accepted, received %v", scheme, err)
+		}
+	}
+	if _, err := (&Mongo{Scheme: ids.ULIDScheme}).parseID(primitive.NewObjectID().Hex()); err != ErrInvalidHexID {
+		t.Errorf("Expected an ObjectID refused by a ULID backend, received %v", err)
+	}
+	if err := (&Mongo{Scheme: "serial"}).Init(); err == nil {
+		t.Error("Expected an unknown scheme refused")
+	}
+}
 
-	// Use the official Ping method on the Client
-	err := TestMongo.Client.Ping(ctx, nil) // passing nil defaults to Primary
+func TestClientOptions(t *testing.T) {
+	defer func(a, c string) { serverAPI, compressors = a, c }(serverAPI, compressors)
+	serverAPI, compressors = "1", "zstd, snappy"
+	opts, err := clientOptions("mongodb://localhost/users", "users")
 	if err != nil {
-		t.Errorf("Ping failed: %v", err)
+		t.Fatal(err)
+	}
+	if opts.ServerAPIOptions == nil || opts.ServerAPIOptions.ServerAPIVersion != options.ServerAPIVersion1 {
+		t.Errorf("Expected the Stable API pinned, received %+v", opts.ServerAPIOptions)
+	}
+	if len(opts.Compressors) != 2 || opts.Compressors[0] != "zstd" || opts.Compressors[1] != "snappy" {
+		t.Errorf("Expected the compressors in order, received %v", opts.Compressors)
+	}
+
+	serverAPI, compressors = "", "lz4"
+	if _, err := clientOptions("mongodb://localhost/users", "users"); err == nil {
+		t.Error("Expected an unsupported compressor refused")
+	}
+	serverAPI, compressors = "2", ""
+	if _, err := clientOptions("mongodb://localhost/users", "users"); err == nil {
+		t.Error("Expected an unsupported API version refused")
+	}
+}
+
+func TestAutoEncryption(t *testing.T) {
+	defer func(kms, key, id string) { csfleKMS, csfleLocalKey, csfleKeyID = kms, key, id }(csfleKMS, csfleLocalKey, csfleKeyID)
+	csfleKMS = "local"
+	csfleLocalKey = base64.StdEncoding.EncodeToString(make([]byte, 96))
+	csfleKeyID = base64.StdEncoding.EncodeToString(make([]byte, 16))
+	opts, err := clientOptions("mongodb://localhost/users", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ae := opts.AutoEncryptionOptions
+	if ae == nil || ae.KeyVaultNamespace != "encryption.__keyVault" || len(ae.KmsProviders["local"]["key"].([]byte)) != 96 {
+		t.Fatalf("Expected auto encryption with the local key, received %+v", ae)
+	}
+	customers := ae.SchemaMap["users.customers"].(bson.M)["properties"].(bson.M)
+	for _, f := range []string{"email", "emailDomain"} {
+		if customers[f].(bson.M)["encrypt"].(bson.M)["algorithm"] != deterministic {
+			t.Errorf("Expected %v encrypted deterministically, received %v", f, customers)
+		}
+	}
+	cards := ae.SchemaMap["users.cards"].(bson.M)["properties"].(bson.M)
+	if _, ok := cards["longNum"]; !ok {
+		t.Errorf("Expected card numbers encrypted, received %v", cards)
+	}
+
+	if _, err := (&Mongo{}).FindDuplicates(0, 10); err != ErrEncryptedDuplicates {
+		t.Errorf("Expected duplicate scans refused, received %v", err)
+	}
+
+	csfleKeyID = "short"
+	if _, err := clientOptions("mongodb://localhost/users", "users"); err == nil {
+		t.Error("Expected an invalid key id refused")
+	}
+	csfleKMS = "vault"
+	if _, err := clientOptions("mongodb://localhost/users", "users"); err == nil {
+		t.Error("Expected an unknown provider refused")
+	}
+}
+
+func TestLeaseFilter(t *testing.T) {
+	if f := leaseFilter("migrations", "me", time.Now()); f["_id"] != "migrations" || len(f["$or"].(bson.A)) != 2 {
+		t.Errorf("Expected lease owned by us or expired, received %v", f)
+	}
+}
+
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+	var d dto.Metric
+	if err := m.Write(&d); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case d.Counter != nil:
+		return d.Counter.GetValue()
+	case d.Gauge != nil:
+		return d.Gauge.GetValue()
+	}
+	return float64(d.Histogram.GetSampleCount())
+}
+
+func TestObservePool(t *testing.T) {
+	metrics := []prometheus.Metric{
+		PoolCheckouts, PoolCheckoutFailures.WithLabelValues(event.ReasonTimedOut), PoolCheckoutWait,
+		PoolConnectionsCreated, PoolConnectionsClosed.WithLabelValues(event.ReasonIdle), PoolConnectionsInUse, PoolConnectionsMax,
+	}
+	before := make([]float64, len(metrics))
+	for i, m := range metrics {
+		before[i] = metricValue(t, m)
+	}
+	for _, e := range []event.PoolEvent{
+		{Type: event.PoolCreated, Address: "db:27017", PoolOptions: &event.MonitorPoolOptions{MaxPoolSize: 100}},
+		{Type: event.PoolCreated, Address: "db:27017", PoolOptions: &event.MonitorPoolOptions{MaxPoolSize: 50}},
+		{Type: event.ConnectionCreated},
+		{Type: event.GetSucceeded, Duration: time.Millisecond},
+		{Type: event.GetSucceeded, Duration: time.Millisecond},
+		{Type: event.ConnectionReturned},
+		{Type: event.GetFailed, Reason: event.ReasonTimedOut, Duration: time.Second},
+		{Type: event.ConnectionClosed, Reason: event.ReasonIdle},
+		{Type: event.PoolClosedEvent, Address: "db:27017"},
+		{Type: event.PoolClosedEvent, Address: "other:27017"},
+	} {
+		observePool(&e)
+	}
+	// The pool left open is closed again, so that repeated runs start
+	// from the same pools.
+	defer observePool(&event.PoolEvent{Type: event.PoolClosedEvent, Address: "db:27017"})
+	want := []float64{2, 1, 3, 1, 1, 1, 50}
+	for i, m := range metrics {
+		if d := metricValue(t, m) - before[i]; d != want[i] {
+			t.Errorf("Expected %v of %v, received %v", want[i], m.Desc(), d)
+		}
 	}
 }
@@ -0,0 +1,95 @@
+package mongodb
+
+// pool.go exports the events of the driver's connection pools as metrics,
+// so that a pool running out of connections is alerted on while checkouts
+// are merely slow, before they time out.
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	PoolCheckouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_pool_checkouts_total",
+		Help: "Number of connections checked out of the pool.",
+	})
+	PoolCheckoutFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_pool_checkout_failures_total",
+		Help: "Number of failed connection checkouts, by reason: timeout, connectionError or poolClosed.",
+	}, []string{"reason"})
+	PoolCheckoutWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_pool_checkout_wait_seconds",
+		Help:    "Time (in seconds) spent checking a connection out of the pool, whether or not it succeeded.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+	PoolConnectionsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_pool_connections_created_total",
+		Help: "Number of connections opened by the pool.",
+	})
+	PoolConnectionsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_pool_connections_closed_total",
+		Help: "Number of connections closed by the pool, by reason: idle, stale, connectionError, poolClosed or error.",
+	}, []string{"reason"})
+	PoolConnectionsInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_pool_connections_in_use",
+		Help: "Number of connections currently checked out of the pool.",
+	})
+	PoolConnectionsMax = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_pool_connections_max",
+		Help: "Most connections the open pools may hold, summed over servers.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(PoolCheckouts, PoolCheckoutFailures, PoolCheckoutWait,
+		PoolConnectionsCreated, PoolConnectionsClosed, PoolConnectionsInUse, PoolConnectionsMax)
+}
+
+// poolMonitor observes the pools of every client, including those replaced
+// on credential rotation, which return their connections as they drain.
+var poolMonitor = &event.PoolMonitor{Event: observePool}
+
+var (
+	// poolSizes holds the max sizes of the open pools by server address, as
+	// the events closing pools do not repeat them. Pools of replaced
+	// clients share addresses with the new ones, but not always sizes.
+	poolSizes   = map[string][]uint64{}
+	poolSizesMu sync.Mutex
+)
+
+func observePool(e *event.PoolEvent) {
+	switch e.Type {
+	case event.PoolCreated:
+		if e.PoolOptions != nil {
+			poolSizesMu.Lock()
+			poolSizes[e.Address] = append(poolSizes[e.Address], e.PoolOptions.MaxPoolSize)
+			poolSizesMu.Unlock()
+			PoolConnectionsMax.Add(float64(e.PoolOptions.MaxPoolSize))
+		}
+	case event.PoolClosedEvent:
+		poolSizesMu.Lock()
+		if sizes := poolSizes[e.Address]; len(sizes) > 0 {
+			PoolConnectionsMax.Sub(float64(sizes[0]))
+			if poolSizes[e.Address] = sizes[1:]; len(sizes) == 1 {
+				delete(poolSizes, e.Address)
+			}
+		}
+		poolSizesMu.Unlock()
+	case event.GetSucceeded:
+		PoolCheckouts.Inc()
+		PoolCheckoutWait.Observe(e.Duration.Seconds())
+		PoolConnectionsInUse.Inc()
+	case event.GetFailed:
+		PoolCheckoutFailures.WithLabelValues(e.Reason).Inc()
+		PoolCheckoutWait.Observe(e.Duration.Seconds())
+	case event.ConnectionReturned:
+		PoolConnectionsInUse.Dec()
+	case event.ConnectionCreated:
+		PoolConnectionsCreated.Inc()
+	case event.ConnectionClosed:
+		PoolConnectionsClosed.WithLabelValues(e.Reason).Inc()
+	}
+}
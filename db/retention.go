@@ -0,0 +1,96 @@
+package db
+
+// retention.go contains the retention policies of the data recorded about
+// customers as they use the service, rather than given by them, so that it
+// does not grow for as long as the customer stays. Backends expire the data
+// themselves where they can, such as with TTL indexes, and otherwise purge
+// it when asked by a scheduled job.
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/timing"
+)
+
+// Kinds of data kept for a limited time.
+const (
+	// LoginHistory is the login attempts, successful or not.
+	LoginHistory = "login-history"
+	// AuditTrail is the notes the service records itself, such as of
+	// impersonation. Notes written by agents are kept.
+	AuditTrail = "audit"
+)
+
+// MaxRetention is the longest retention backends can enforce, about 68
+// years: Mongo's TTL indexes take their age in seconds as a 32 bit integer.
+const MaxRetention = math.MaxInt32 * time.Second
+
+// Retention is how long each kind of data is kept. Kinds without a
+// retention are kept until the customer is deleted. It is read by backends
+// as they are initialised.
+var Retention = map[string]time.Duration{}
+
+// Purger is implemented by databases that cannot expire some data
+// themselves.
+type Purger interface {
+	// Purge deletes the data of the kind recorded before before, returning
+	// how many documents or rows were deleted. Data the database expires
+	// itself is left to it, and not counted.
+	Purge(kind string, before time.Time) (int64, error)
+}
+
+// Purge purges the data of the kind recorded before before from DefaultDb,
+// if it is a Purger.
+func Purge(ctx context.Context, kind string, before time.Time) (int64, error) {
+	defer timing.Database(ctx)()
+	if p, ok := DefaultDb.(Purger); ok {
+		return p.Purge(kind, before)
+	}
+	return 0, nil
+}
+
+// ParseRetention parses kind=age pairs, such as "login-history=90d". Ages
+// are Go durations or whole days, weeks or years, such as "2y".
+func ParseRetention(ss []string) (map[string]time.Duration, error) {
+	retention := make(map[string]time.Duration)
+	for _, pair := range ss {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kind, age, ok := strings.Cut(pair, "=")
+		kind = strings.TrimSpace(kind)
+		d, err := parseAge(strings.TrimSpace(age))
+		if !ok || err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid retention %q", pair)
+		}
+		switch kind {
+		case LoginHistory, AuditTrail:
+		default:
+			return nil, fmt.Errorf("unknown data %q, not %v or %v", kind, LoginHistory, AuditTrail)
+		}
+		retention[kind] = d
+	}
+	return retention, nil
+}
+
+// parseAge parses a Go duration, or a whole number of days (d), weeks (w)
+// or years of 365 days (y).
+func parseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+	if s != "" {
+		if unit, ok := units[s[len(s)-1:]]; ok {
+			n, err := strconv.Atoi(s[:len(s)-1])
+			if err == nil && int64(n) > math.MaxInt64/int64(unit) {
+				return 0, fmt.Errorf("age %q too long", s)
+			}
+			return time.Duration(n) * unit, err
+		}
+	}
+	return time.ParseDuration(s)
+}
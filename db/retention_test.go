@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	r, err := ParseRetention([]string{"login-history=90d", " audit = 2y", "", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 || r[LoginHistory] != 90*24*time.Hour || r[AuditTrail] != 2*365*24*time.Hour {
+		t.Errorf("Expected the retention, received %v", r)
+	}
+	if r, err := ParseRetention([]string{"audit=36h"}); err != nil || r[AuditTrail] != 36*time.Hour {
+		t.Errorf("Expected a Go duration accepted, received %v %v", r, err)
+	}
+	for _, s := range []string{"audit", "audit=", "audit=0d", "audit=-1h", "audit=twod", "audit=1000y", "notes=1y"} {
+		if _, err := ParseRetention([]string{s}); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+type purger struct {
+	fake
+	kind   string
+	before time.Time
+}
+
+func (p *purger) Purge(kind string, before time.Time) (int64, error) {
+	p.kind, p.before = kind, before
+	return 3, nil
+}
+
+func TestPurge(t *testing.T) {
+	prev := DefaultDb
+	t.Cleanup(func() { DefaultDb = prev })
+	DefaultDb = fake{}
+	if n, err := Purge(context.Background(), LoginHistory, time.Now()); n != 0 || err != nil {
+		t.Errorf("Expected nothing purged from a database expiring its data, received %v %v", n, err)
+	}
+	p := &purger{}
+	DefaultDb = p
+	before := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if n, err := Purge(context.Background(), LoginHistory, before); n != 3 || err != nil || p.kind != LoginHistory || !p.before.Equal(before) {
+		t.Errorf("Expected the login history purged, received %v %v %+v", n, err, p)
+	}
+}
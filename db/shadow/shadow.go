@@ -0,0 +1,383 @@
+package shadow
+
+// shadow.go contains a Database decorator used to migrate between backends.
+// Writes go to both the primary and the shadow, reads are served by the
+// primary and repeated on the shadow in the background, and differences are
+// reported as metrics so the new backend can be trusted before switching.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Read comparison results.
+const (
+	Match   = "match"
+	Diverge = "diverge"
+	Error   = "error"
+	Skipped = "skipped"
+)
+
+var (
+	WriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_shadow_write_errors_total",
+		Help: "Number of writes that failed on the shadow database.",
+	}, []string{"method"})
+	Reads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_shadow_reads_total",
+		Help: "Number of reads compared against the shadow database, by result.",
+	}, []string{"method", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(WriteErrors)
+	prometheus.MustRegister(Reads)
+}
+
+// DB serves the embedded primary Database and repeats customer data writes
+// and single-entity reads on Shadow. Shadow failures are counted and
+// reported but never returned to the caller.
+//
+// Users keep their primary IDs on the shadow, and so do addresses and cards
+// added later if the shadow is a db.AttributeImporter; otherwise they get
+// IDs of the shadow's choosing, so reads of them are expected to diverge
+// until backfilled. Listings, search and jobs are served by the primary
+// only.
+type DB struct {
+	db.Database
+	Shadow db.Database
+	// OnError, if set, is called for every failed shadow write.
+	OnError func(method string, err error)
+	// OnDivergence, if set, is called with both results of a read that
+	// differed.
+	OnDivergence func(method, primary, shadow string)
+
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+// New returns a DB comparing at most concurrency reads at a time. Reads
+// beyond that are served without comparison.
+func New(primary, shadow db.Database, concurrency int) *DB {
+	return &DB{Database: primary, Shadow: shadow, sem: make(chan struct{}, concurrency)}
+}
+
+// Wait blocks until pending comparisons are done.
+func (d *DB) Wait() {
+	d.wg.Wait()
+}
+
+// Reload reloads the credentials of the primary and the shadow.
+func (d *DB) Reload() error {
+	var errs []error
+	for _, database := range []db.Database{d.Database, d.Shadow} {
+		if r, ok := database.(db.Reloader); ok {
+			errs = append(errs, r.Reload())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// IDs returns the ID scheme of the primary, which creates the IDs the
+// shadow is written with.
+func (d *DB) IDs() ids.Generator {
+	if g, ok := d.Database.(db.IDGenerator); ok {
+		return g.IDs()
+	}
+	return nil
+}
+
+// Reserve reserves the key of kind on the primary, which creates users.
+func (d *DB) Reserve(kind, key string) (bool, error) {
+	return db.Reserve(d.Database, kind, key)
+}
+
+func (d *DB) Release(kind, key string) error {
+	return db.Release(d.Database, kind, key)
+}
+
+// MapIDs records the new IDs of entities of kind with the primary, which the mapped entities were copied to.
+func (d *DB) MapIDs(kind string, ids map[string]string) error {
+	return db.MapIDs(d.Database, kind, ids)
+}
+
+func (d *DB) MappedID(kind, old string) (string, error) {
+	return db.MappedID(d.Database, kind, old)
+}
+
+// Purge purges the data of the primary and the shadow, returning how much
+// the primary purged.
+func (d *DB) Purge(kind string, before time.Time) (int64, error) {
+	var n int64
+	var errs []error
+	for i, database := range []db.Database{d.Database, d.Shadow} {
+		if p, ok := database.(db.Purger); ok {
+			purged, err := p.Purge(kind, before)
+			if i == 0 {
+				n = purged
+			}
+			errs = append(errs, err)
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+func (d *DB) write(method string, err error) {
+	if err == nil {
+		return
+	}
+	WriteErrors.WithLabelValues(method).Inc()
+	if d.OnError != nil {
+		d.OnError(method, err)
+	}
+}
+
+// compare repeats a read on the shadow in the background. The primary
+// result is snapshotted first as callers may go on to modify it.
+func (d *DB) compare(method string, primary interface{}, perr error, read func() (interface{}, error)) {
+	select {
+	case d.sem <- struct{}{}:
+	default:
+		Reads.WithLabelValues(method, Skipped).Inc()
+		return
+	}
+	want := snapshot(primary, perr)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer func() { <-d.sem }()
+		v, err := read()
+		got := snapshot(v, err)
+		switch {
+		case want == got:
+			Reads.WithLabelValues(method, Match).Inc()
+		case err != nil && perr == nil:
+			Reads.WithLabelValues(method, Error).Inc()
+			d.write(method, err)
+		default:
+			Reads.WithLabelValues(method, Diverge).Inc()
+			if d.OnDivergence != nil {
+				d.OnDivergence(method, want, got)
+			}
+		}
+	}()
+}
+
+// snapshot renders a result for comparison. Backends report errors
+// differently, so only whether a read failed is compared.
+func snapshot(v interface{}, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return fmt.Sprintf("%#v", v)
+}
+
+func (d *DB) GetUserByName(name string) (users.User, error) {
+	u, err := d.Database.GetUserByName(name)
+	d.compare("GetUserByName", u, err, func() (interface{}, error) { return d.Shadow.GetUserByName(name) })
+	return u, err
+}
+
+func (d *DB) GetUserByEmail(email string) (users.User, error) {
+	u, err := d.Database.GetUserByEmail(email)
+	d.compare("GetUserByEmail", u, err, func() (interface{}, error) { return d.Shadow.GetUserByEmail(email) })
+	return u, err
+}
+
+func (d *DB) ExistsUsername(name string) (bool, error) {
+	ok, err := d.Database.ExistsUsername(name)
+	d.compare("ExistsUsername", ok, err, func() (interface{}, error) { return d.Shadow.ExistsUsername(name) })
+	return ok, err
+}
+
+func (d *DB) ExistsEmail(email string) (bool, error) {
+	ok, err := d.Database.ExistsEmail(email)
+	d.compare("ExistsEmail", ok, err, func() (interface{}, error) { return d.Shadow.ExistsEmail(email) })
+	return ok, err
+}
+
+func (d *DB) GetUser(id string) (users.User, error) {
+	u, err := d.Database.GetUser(id)
+	d.compare("GetUser", u, err, func() (interface{}, error) { return d.Shadow.GetUser(id) })
+	return u, err
+}
+
+func (d *DB) GetAddress(id string) (users.Address, error) {
+	a, err := d.Database.GetAddress(id)
+	d.compare("GetAddress", a, err, func() (interface{}, error) { return d.Shadow.GetAddress(id) })
+	return a, err
+}
+
+func (d *DB) GetCard(id string) (users.Card, error) {
+	c, err := d.Database.GetCard(id)
+	d.compare("GetCard", c, err, func() (interface{}, error) { return d.Shadow.GetCard(id) })
+	return c, err
+}
+
+func (d *DB) GetLoginAttempts(userid string) ([]users.LoginAttempt, error) {
+	ls, err := d.Database.GetLoginAttempts(userid)
+	d.compare("GetLoginAttempts", ls, err, func() (interface{}, error) { return d.Shadow.GetLoginAttempts(userid) })
+	return ls, err
+}
+
+func (d *DB) GetNotes(userid string, offset, limit int) ([]users.Note, error) {
+	ns, err := d.Database.GetNotes(userid, offset, limit)
+	d.compare("GetNotes", ns, err, func() (interface{}, error) { return d.Shadow.GetNotes(userid, offset, limit) })
+	return ns, err
+}
+
+func (d *DB) GetCustomerAddresses(userid string) ([]users.Address, error) {
+	as, err := d.Database.GetCustomerAddresses(userid)
+	d.compare("GetCustomerAddresses", as, err, func() (interface{}, error) { return d.Shadow.GetCustomerAddresses(userid) })
+	return as, err
+}
+
+func (d *DB) GetCustomerCards(userid string) ([]users.Card, error) {
+	cs, err := d.Database.GetCustomerCards(userid)
+	d.compare("GetCustomerCards", cs, err, func() (interface{}, error) { return d.Shadow.GetCustomerCards(userid) })
+	return cs, err
+}
+
+// CreateUser creates the user on the primary, then imports it with the same
+// IDs on the shadow.
+func (d *DB) CreateUser(u *users.User) error {
+	if err := d.Database.CreateUser(u); err != nil {
+		return err
+	}
+	c := *u
+	d.write("CreateUser", d.Shadow.ImportUser(&c))
+	return nil
+}
+
+func (d *DB) ImportUser(u *users.User) error {
+	if err := d.Database.ImportUser(u); err != nil {
+		return err
+	}
+	c := *u
+	d.write("ImportUser", d.Shadow.ImportUser(&c))
+	return nil
+}
+
+func (d *DB) NormalizeUsernames(normalize func(string) string) (int, error) {
+	n, err := d.Database.NormalizeUsernames(normalize)
+	_, serr := d.Shadow.NormalizeUsernames(normalize)
+	d.write("NormalizeUsernames", serr)
+	return n, err
+}
+
+func (d *DB) CollectOrphans(before time.Time, dryRun bool) (db.Orphans, error) {
+	o, err := d.Database.CollectOrphans(before, dryRun)
+	if !dryRun {
+		_, serr := d.Shadow.CollectOrphans(before, dryRun)
+		d.write("CollectOrphans", serr)
+	}
+	return o, err
+}
+
+func (d *DB) UpdateLastLogin(id string) error {
+	if err := d.Database.UpdateLastLogin(id); err != nil {
+		return err
+	}
+	d.write("UpdateLastLogin", d.Shadow.UpdateLastLogin(id))
+	return nil
+}
+
+func (d *DB) UpdateAvatar(id, key string) error {
+	if err := d.Database.UpdateAvatar(id, key); err != nil {
+		return err
+	}
+	d.write("UpdateAvatar", d.Shadow.UpdateAvatar(id, key))
+	return nil
+}
+
+func (d *DB) UpdateProfile(u *users.User) error {
+	if err := d.Database.UpdateProfile(u); err != nil {
+		return err
+	}
+	c := *u
+	d.write("UpdateProfile", d.Shadow.UpdateProfile(&c))
+	return nil
+}
+
+func (d *DB) AddTag(id, tag string) error {
+	if err := d.Database.AddTag(id, tag); err != nil {
+		return err
+	}
+	d.write("AddTag", d.Shadow.AddTag(id, tag))
+	return nil
+}
+
+func (d *DB) RemoveTag(id, tag string) error {
+	if err := d.Database.RemoveTag(id, tag); err != nil {
+		return err
+	}
+	d.write("RemoveTag", d.Shadow.RemoveTag(id, tag))
+	return nil
+}
+
+func (d *DB) CreateAddress(a *users.Address, userid string) error {
+	if err := d.Database.CreateAddress(a, userid); err != nil {
+		return err
+	}
+	c := *a
+	if imp, ok := d.Shadow.(db.AttributeImporter); ok {
+		d.write("CreateAddress", imp.ImportAddress(&c, userid))
+	} else {
+		d.write("CreateAddress", d.Shadow.CreateAddress(&c, userid))
+	}
+	return nil
+}
+
+func (d *DB) CreateCard(card *users.Card, userid string) error {
+	if err := d.Database.CreateCard(card, userid); err != nil {
+		return err
+	}
+	c := *card
+	if imp, ok := d.Shadow.(db.AttributeImporter); ok {
+		d.write("CreateCard", imp.ImportCard(&c, userid))
+	} else {
+		d.write("CreateCard", d.Shadow.CreateCard(&c, userid))
+	}
+	return nil
+}
+
+func (d *DB) CreateNote(n *users.Note) error {
+	if err := d.Database.CreateNote(n); err != nil {
+		return err
+	}
+	c := *n
+	d.write("CreateNote", d.Shadow.CreateNote(&c))
+	return nil
+}
+
+func (d *DB) UpdateCardStatus(id, status string, flag *users.CardFlag) error {
+	if err := d.Database.UpdateCardStatus(id, status, flag); err != nil {
+		return err
+	}
+	d.write("UpdateCardStatus", d.Shadow.UpdateCardStatus(id, status, flag))
+	return nil
+}
+
+func (d *DB) Delete(entity, id string) error {
+	if err := d.Database.Delete(entity, id); err != nil {
+		return err
+	}
+	d.write("Delete", d.Shadow.Delete(entity, id))
+	return nil
+}
+
+func (d *DB) CreateLoginAttempt(l *users.LoginAttempt) error {
+	if err := d.Database.CreateLoginAttempt(l); err != nil {
+		return err
+	}
+	c := *l
+	d.write("CreateLoginAttempt", d.Shadow.CreateLoginAttempt(&c))
+	return nil
+}
@@ -0,0 +1,177 @@
+package shadow
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+var errDown = errors.New("down")
+
+type stub struct {
+	db.Database
+	user    users.User
+	err     error
+	imports []string
+}
+
+func (s *stub) GetUser(id string) (users.User, error) {
+	return s.user, s.err
+}
+
+func (s *stub) CreateUser(u *users.User) error {
+	u.UserID = "primary"
+	return s.err
+}
+
+func (s *stub) ImportUser(u *users.User) error {
+	s.imports = append(s.imports, u.UserID)
+	return s.err
+}
+
+func (s *stub) Delete(entity, id string) error {
+	return s.err
+}
+
+func (s *stub) CreateAddress(a *users.Address, userid string) error {
+	a.ID = "primary"
+	return s.err
+}
+
+func (s *stub) CreateCard(c *users.Card, userid string) error {
+	c.ID = "primary"
+	return s.err
+}
+
+// importStub imports addresses and cards under the IDs they have.
+type importStub struct {
+	stub
+}
+
+func (s *importStub) ImportAddress(a *users.Address, userid string) error {
+	s.imports = append(s.imports, a.ID)
+	return s.err
+}
+
+func (s *importStub) ImportCard(c *users.Card, userid string) error {
+	s.imports = append(s.imports, c.ID)
+	return s.err
+}
+
+type reloadStub struct {
+	stub
+	reloads int
+}
+
+func (s *reloadStub) Reload() error {
+	s.reloads++
+	return s.err
+}
+
+func TestReload(t *testing.T) {
+	primary := &reloadStub{}
+	shadow := &reloadStub{stub: stub{err: errDown}}
+	if err := New(primary, shadow, 1).Reload(); !errors.Is(err, errDown) {
+		t.Errorf("Expected shadow reload error, received %v", err)
+	}
+	if primary.reloads != 1 || shadow.reloads != 1 {
+		t.Errorf("Expected both databases reloaded, received %v and %v", primary.reloads, shadow.reloads)
+	}
+	if err := New(&stub{}, &stub{}, 1).Reload(); err != nil {
+		t.Errorf("Expected databases without reload to be skipped, received %v", err)
+	}
+}
+
+func TestReadsCompared(t *testing.T) {
+	primary := &stub{user: users.User{Username: "a"}}
+	shadow := &stub{user: users.User{Username: "b"}}
+	d := New(primary, shadow, 1)
+	var diverged []string
+	d.OnDivergence = func(method, p, s string) { diverged = append(diverged, method) }
+
+	u, err := d.GetUser("1")
+	d.Wait()
+	if err != nil || u.Username != "a" {
+		t.Errorf("Expected primary result, received %v %v", u, err)
+	}
+	if len(diverged) != 1 || diverged[0] != "GetUser" {
+		t.Errorf("Expected divergence to be reported, received %v", diverged)
+	}
+
+	diverged = nil
+	shadow.user = primary.user
+	d.GetUser("1")
+	d.Wait()
+	if len(diverged) != 0 {
+		t.Error("Expected matching reads")
+	}
+}
+
+func TestReadErrorsCompared(t *testing.T) {
+	d := New(&stub{err: db.ErrIDConflict}, &stub{err: errDown}, 1)
+	var diverged int
+	d.OnDivergence = func(method, p, s string) { diverged++ }
+	d.GetUser("1")
+	d.Wait()
+	if diverged != 0 {
+		t.Error("Expected failures on both sides to match")
+	}
+}
+
+func TestReadsSkippedWhenBusy(t *testing.T) {
+	d := New(&stub{}, &stub{}, 1)
+	d.sem <- struct{}{}
+	called := false
+	d.compare("GetUser", nil, nil, func() (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	d.Wait()
+	if called {
+		t.Error("Expected comparison to be skipped")
+	}
+}
+
+func TestWritesMirrored(t *testing.T) {
+	primary, shadow := &stub{}, &stub{err: errDown}
+	d := New(primary, shadow, 1)
+	var failed []string
+	d.OnError = func(method string, err error) { failed = append(failed, method) }
+	u := users.User{}
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if len(shadow.imports) != 1 || shadow.imports[0] != "primary" {
+		t.Errorf("Expected user imported with primary ID, received %v", shadow.imports)
+	}
+	if len(failed) != 1 || failed[0] != "CreateUser" {
+		t.Errorf("Expected shadow error reported, received %v", failed)
+	}
+}
+
+func TestAttributesKeepPrimaryIDs(t *testing.T) {
+	shadow := &importStub{}
+	d := New(&stub{}, shadow, 1)
+	if err := d.CreateAddress(&users.Address{}, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateCard(&users.Card{}, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(shadow.imports) != 2 || shadow.imports[0] != "primary" || shadow.imports[1] != "primary" {
+		t.Errorf("Expected address and card imported with primary IDs, received %v", shadow.imports)
+	}
+}
+
+func TestFailedWritesNotMirrored(t *testing.T) {
+	primary, shadow := &stub{err: errDown}, &stub{}
+	d := New(primary, shadow, 1)
+	if err := d.ImportUser(&users.User{UserID: "1"}); err != errDown {
+		t.Error("Expected primary error")
+	}
+	if len(shadow.imports) != 0 {
+		t.Error("Expected failed write not to be mirrored")
+	}
+}
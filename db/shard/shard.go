@@ -0,0 +1,766 @@
+package shard
+
+// shard.go contains a Database spreading users over several databases, so
+// that customers' data stays in the cluster of the region they reside in.
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Lookup results.
+const (
+	Routed  = "routed"
+	Scanned = "scanned"
+	Missing = "missing"
+)
+
+// maxRoutes bounds the routing table. It is cleared when full and filled
+// again by lookups.
+const maxRoutes = 1 << 17
+
+var (
+	ErrUnknownResidency = users.NewError(users.CodeInvalidRequest, "Residency has no shard")
+
+	Lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_shard_lookups_total",
+		Help: "Number of lookups of the shard holding an entity, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(Lookups)
+}
+
+// DB stores each user, with their addresses, cards and login attempts, on
+// one of several shards. Users are placed on the shard their Residency maps
+// to or, without one, on a shard picked by a hash of their username, and
+// stay there. Users with a residency mapped to no shard are refused, so
+// that their data is not stored outside of their region.
+//
+// Usernames and, with db.UniqueEmail, emails are reserved with db.Reserve
+// on the home shard while a user is created, so that creations on different
+// shards cannot take the same one.
+//
+// Entities are found through a routing table of the shards holding them,
+// filled as they are created and read. Those not in it are looked for on
+// every shard in turn. Lists and exports merge the shards' results, while
+// duplicates are only found within a shard. Jobs are kept on the home shard.
+type DB struct {
+	// Residencies maps residencies to the names of the shards their users
+	// are placed on. Residencies naming a shard need not be mapped.
+	Residencies map[string]string
+
+	home   string
+	names  []string
+	shards map[string]db.Database
+
+	mtx    sync.RWMutex
+	routes map[string]string
+}
+
+// New returns a DB over shards, keeping jobs on the shard named home.
+func New(shards map[string]db.Database, home string) (*DB, error) {
+	if _, ok := shards[home]; !ok {
+		return nil, fmt.Errorf("home shard %v is not configured", home)
+	}
+	d := &DB{home: home, shards: shards, routes: make(map[string]string)}
+	for name := range shards {
+		d.names = append(d.names, name)
+	}
+	sort.Strings(d.names)
+	return d, nil
+}
+
+// Shards returns the names of the shards.
+func (d *DB) Shards() []string {
+	return d.names
+}
+
+// Place returns the name of the shard a new user is stored on, or
+// ErrUnknownResidency.
+func (d *DB) Place(u users.User) (string, error) {
+	if u.Residency == "" {
+		h := fnv.New32a()
+		h.Write([]byte(u.Username))
+		return d.names[h.Sum32()%uint32(len(d.names))], nil
+	}
+	if name, ok := d.Residencies[u.Residency]; ok {
+		return name, nil
+	}
+	if _, ok := d.shards[u.Residency]; ok {
+		return u.Residency, nil
+	}
+	return "", ErrUnknownResidency
+}
+
+func (d *DB) route(kind, id string) (string, bool) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	name, ok := d.routes[kind+"/"+id]
+	return name, ok
+}
+
+func (d *DB) setRoute(kind, id, name string) {
+	if id == "" {
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if len(d.routes) >= maxRoutes {
+		d.routes = make(map[string]string)
+	}
+	d.routes[kind+"/"+id] = name
+}
+
+func (d *DB) dropRoute(kind, id string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.routes, kind+"/"+id)
+}
+
+// find returns the name of the shard on which read finds the entity. Reads
+// failing other than with a not found error end the search. Routes to
+// entities no longer found, such as deleted users' names, are dropped.
+func (d *DB) find(kind, id string, read func(db.Database) error) (string, error) {
+	if name, ok := d.route(kind, id); ok {
+		err := read(d.shards[name])
+		if !notFound(err) {
+			Lookups.WithLabelValues(Routed).Inc()
+			return name, err
+		}
+		d.dropRoute(kind, id)
+	}
+	var err error
+	for _, name := range d.names {
+		err = read(d.shards[name])
+		if err == nil {
+			Lookups.WithLabelValues(Scanned).Inc()
+			d.setRoute(kind, id, name)
+			return name, nil
+		}
+		if !notFound(err) {
+			return "", err
+		}
+	}
+	Lookups.WithLabelValues(Missing).Inc()
+	return "", err
+}
+
+func notFound(err error) bool {
+	return errors.Is(err, users.ErrUserNotFound) || errors.Is(err, users.ErrAddressNotFound) || errors.Is(err, users.ErrCardNotFound)
+}
+
+// userShard returns the shard holding the user, or the home shard if no
+// shard does, so that the caller gets the home shard's answer.
+func (d *DB) userShard(id string) (db.Database, error) {
+	name, err := d.find("customers", id, func(s db.Database) error {
+		_, err := s.GetUser(id)
+		return err
+	})
+	if notFound(err) {
+		return d.shards[d.home], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.shards[name], nil
+}
+
+// Init initialises every shard.
+func (d *DB) Init() error {
+	for _, name := range d.names {
+		if err := d.shards[name].Init(); err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Reload reloads the credentials of the shards that support it.
+func (d *DB) Reload() error {
+	var errs []error
+	for _, name := range d.names {
+		if r, ok := d.shards[name].(db.Reloader); ok {
+			errs = append(errs, r.Reload())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// IDs returns the ID scheme of the home shard. Shards are expected to share
+// one, so that an ID is valid whichever shard holds it.
+func (d *DB) IDs() ids.Generator {
+	if g, ok := d.shards[d.home].(db.IDGenerator); ok {
+		return g.IDs()
+	}
+	return nil
+}
+
+// MapIDs records the new IDs of entities of kind on the home shard, which
+// keeps the mapping for all of them.
+func (d *DB) MapIDs(kind string, ids map[string]string) error {
+	return db.MapIDs(d.shards[d.home], kind, ids)
+}
+
+func (d *DB) MappedID(kind, old string) (string, error) {
+	return db.MappedID(d.shards[d.home], kind, old)
+}
+
+// Purge purges the data of every shard that is a Purger.
+func (d *DB) Purge(kind string, before time.Time) (int64, error) {
+	var total int64
+	for _, name := range d.names {
+		if p, ok := d.shards[name].(db.Purger); ok {
+			n, err := p.Purge(kind, before)
+			total += n
+			if err != nil {
+				return total, fmt.Errorf("%v: %w", name, err)
+			}
+		}
+	}
+	return total, nil
+}
+
+func (d *DB) Ping() error {
+	for _, name := range d.names {
+		if err := d.shards[name].Ping(); err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (d *DB) getUser(kind, key string, get func(db.Database) (users.User, error)) (users.User, error) {
+	var u users.User
+	name, err := d.find(kind, key, func(s db.Database) error {
+		var err error
+		u, err = get(s)
+		return err
+	})
+	if err == nil {
+		d.setRoute("customers", u.UserID, name)
+	}
+	return u, err
+}
+
+func (d *DB) GetUserByName(name string) (users.User, error) {
+	return d.getUser("usernames", name, func(s db.Database) (users.User, error) { return s.GetUserByName(name) })
+}
+
+func (d *DB) GetUserByEmail(email string) (users.User, error) {
+	return d.getUser("emails", email, func(s db.Database) (users.User, error) { return s.GetUserByEmail(email) })
+}
+
+func (d *DB) GetUser(id string) (users.User, error) {
+	return d.getUser("customers", id, func(s db.Database) (users.User, error) { return s.GetUser(id) })
+}
+
+func (d *DB) GetUserWithAttributes(id string) (users.User, error) {
+	return d.getUser("customers", id, func(s db.Database) (users.User, error) { return db.ReadUserWithAttributes(s, id) })
+}
+
+func (d *DB) GetUsers(l db.ListOptions) ([]users.User, error) {
+	return merge(d, l, func(s db.Database, l db.ListOptions) ([]users.User, error) { return s.GetUsers(l) })
+}
+
+func (d *DB) GetAddresses(l db.ListOptions) ([]users.Address, error) {
+	return merge(d, l, func(s db.Database, l db.ListOptions) ([]users.Address, error) { return s.GetAddresses(l) })
+}
+
+func (d *DB) GetCards(l db.ListOptions) ([]users.Card, error) {
+	return merge(d, l, func(s db.Database, l db.ListOptions) ([]users.Card, error) { return s.GetCards(l) })
+}
+
+// SearchUsers appends the users found on every shard, refusing with
+// db.ErrListTooLong more than db.MaxListDecoded.
+func (d *DB) SearchUsers(q db.Query) ([]users.User, error) {
+	us := make([]users.User, 0)
+	for _, name := range d.names {
+		found, err := d.shards[name].SearchUsers(q)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, found...)
+		if db.MaxListDecoded > 0 && len(us) > db.MaxListDecoded {
+			return nil, db.ErrListTooLong
+		}
+	}
+	return us, nil
+}
+
+// CountUsers sums the users matching q on every shard.
+func (d *DB) CountUsers(q db.Query) (int64, error) {
+	var total int64
+	for _, name := range d.names {
+		n, err := d.shards[name].CountUsers(q)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (d *DB) ExistsUsername(name string) (bool, error) {
+	return d.exists(func(s db.Database) (bool, error) { return s.ExistsUsername(name) })
+}
+
+func (d *DB) ExistsEmail(email string) (bool, error) {
+	return d.exists(func(s db.Database) (bool, error) { return s.ExistsEmail(email) })
+}
+
+// exists asks each shard in turn, stopping at the first that has the user.
+func (d *DB) exists(check func(db.Database) (bool, error)) (bool, error) {
+	for _, name := range d.names {
+		if ok, err := check(d.shards[name]); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// ExportUsers exports the shards one after another. Cursors are prefixed
+// with the shard they belong to.
+func (d *DB) ExportUsers(q db.Query, cursor string, f func(users.User, string) error) error {
+	start, inner := 0, ""
+	if cursor != "" {
+		i := strings.LastIndex(cursor, ":")
+		if i < 0 {
+			return db.ErrInvalidCursor
+		}
+		start = sort.SearchStrings(d.names, cursor[:i])
+		if start == len(d.names) || d.names[start] != cursor[:i] {
+			return db.ErrInvalidCursor
+		}
+		inner = cursor[i+1:]
+	}
+	for _, name := range d.names[start:] {
+		err := d.shards[name].ExportUsers(q, inner, func(u users.User, c string) error {
+			return f(u, name+":"+c)
+		})
+		if err != nil {
+			return err
+		}
+		inner = ""
+	}
+	return nil
+}
+
+// FindDuplicates pages through the duplicates found on each shard in turn.
+func (d *DB) FindDuplicates(offset, limit int) ([]db.Duplicate, error) {
+	ds := make([]db.Duplicate, 0)
+	for _, name := range d.names {
+		found, err := d.shards[name].FindDuplicates(0, offset+limit)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, found...)
+	}
+	return window(ds, offset, limit), nil
+}
+
+// CreateUser stores the user on the shard it is placed on, after checking
+// that no other shard has the username.
+func (d *DB) CreateUser(u *users.User) error {
+	return d.create(u, func(s db.Database) error { return s.CreateUser(u) })
+}
+
+func (d *DB) ImportUser(u *users.User) error {
+	return d.create(u, func(s db.Database) error { return s.ImportUser(u) })
+}
+
+// create creates u on the shard it is placed on, once no other shard holds
+// its username or, with db.UniqueEmail, its email. Like the shards
+// themselves, it compares them normalized, so that case variants of a
+// taken username are refused too.
+func (d *DB) create(u *users.User, create func(db.Database) error) error {
+	name, err := d.Place(*u)
+	if err != nil {
+		return err
+	}
+	username := u.UsernameNormalized
+	if username == "" {
+		username = u.Username
+	}
+	email := u.EmailNormalized
+	if email == "" {
+		email = users.NormalizeEmail(u.Email)
+	}
+	release, err := d.reserve(username, email)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for _, other := range d.names {
+		if other == name {
+			continue
+		}
+		if ok, err := d.shards[other].ExistsUsername(username); err != nil {
+			return err
+		} else if ok {
+			return db.ErrUsernameTaken
+		}
+		if !db.UniqueEmail || email == "" {
+			continue
+		}
+		if ok, err := d.shards[other].ExistsEmail(email); err != nil {
+			return err
+		} else if ok {
+			return db.ErrEmailTaken
+		}
+	}
+	if err := create(d.shards[name]); err != nil {
+		return err
+	}
+	d.setRoute("customers", u.UserID, name)
+	return nil
+}
+
+// reserve reserves the username and, with db.UniqueEmail, the email of a
+// user being created, returning a func releasing them. Reservations held by
+// another creation are refused as taken. Releases are not checked, as
+// reservations run out anyway.
+func (d *DB) reserve(username, email string) (func(), error) {
+	home := d.shards[d.home]
+	type reservation struct {
+		kind, key string
+		taken     error
+	}
+	wanted := []reservation{{"username", username, db.ErrUsernameTaken}}
+	if db.UniqueEmail && email != "" {
+		wanted = append(wanted, reservation{"email", email, db.ErrEmailTaken})
+	}
+	var held []reservation
+	release := func() {
+		for _, h := range held {
+			db.Release(home, h.kind, h.key)
+		}
+	}
+	for _, w := range wanted {
+		ok, err := db.Reserve(home, w.kind, w.key)
+		if err == nil && !ok {
+			err = w.taken
+		}
+		if err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, w)
+	}
+	return release, nil
+}
+
+func (d *DB) NormalizeUsernames(normalize func(string) string) (int, error) {
+	var total int
+	for _, name := range d.names {
+		n, err := d.shards[name].NormalizeUsernames(normalize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (d *DB) CollectOrphans(before time.Time, dryRun bool) (db.Orphans, error) {
+	var total db.Orphans
+	for _, name := range d.names {
+		o, err := d.shards[name].CollectOrphans(before, dryRun)
+		total = total.Add(o)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (d *DB) UpdateLastLogin(id string) error {
+	s, err := d.userShard(id)
+	if err != nil {
+		return err
+	}
+	return s.UpdateLastLogin(id)
+}
+
+func (d *DB) UpdateAvatar(id, key string) error {
+	s, err := d.userShard(id)
+	if err != nil {
+		return err
+	}
+	return s.UpdateAvatar(id, key)
+}
+
+func (d *DB) UpdateProfile(u *users.User) error {
+	s, err := d.userShard(u.UserID)
+	if err != nil {
+		return err
+	}
+	return s.UpdateProfile(u)
+}
+
+func (d *DB) AddTag(id, tag string) error {
+	s, err := d.userShard(id)
+	if err != nil {
+		return err
+	}
+	return s.AddTag(id, tag)
+}
+
+func (d *DB) RemoveTag(id, tag string) error {
+	s, err := d.userShard(id)
+	if err != nil {
+		return err
+	}
+	return s.RemoveTag(id, tag)
+}
+
+func (d *DB) GetUserAttributes(u *users.User) error {
+	s, err := d.userShard(u.UserID)
+	if err != nil {
+		return err
+	}
+	return s.GetUserAttributes(u)
+}
+
+func (d *DB) GetAddress(id string) (users.Address, error) {
+	var a users.Address
+	_, err := d.find("addresses", id, func(s db.Database) error {
+		var err error
+		a, err = s.GetAddress(id)
+		return err
+	})
+	return a, err
+}
+
+func (d *DB) GetCustomerAddresses(userid string) ([]users.Address, error) {
+	s, err := d.userShard(userid)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetCustomerAddresses(userid)
+}
+
+func (d *DB) CreateAddress(a *users.Address, userid string) error {
+	name, err := d.find("customers", userid, func(s db.Database) error {
+		_, err := s.GetUser(userid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.shards[name].CreateAddress(a, userid); err != nil {
+		return err
+	}
+	d.setRoute("addresses", a.ID, name)
+	return nil
+}
+
+func (d *DB) GetCard(id string) (users.Card, error) {
+	var c users.Card
+	_, err := d.find("cards", id, func(s db.Database) error {
+		var err error
+		c, err = s.GetCard(id)
+		return err
+	})
+	return c, err
+}
+
+func (d *DB) UpdateCardStatus(id, status string, flag *users.CardFlag) error {
+	_, err := d.find("cards", id, func(s db.Database) error {
+		return s.UpdateCardStatus(id, status, flag)
+	})
+	return err
+}
+
+func (d *DB) GetCustomerCards(userid string) ([]users.Card, error) {
+	s, err := d.userShard(userid)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetCustomerCards(userid)
+}
+
+func (d *DB) CreateCard(c *users.Card, userid string) error {
+	name, err := d.find("customers", userid, func(s db.Database) error {
+		_, err := s.GetUser(userid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.shards[name].CreateCard(c, userid); err != nil {
+		return err
+	}
+	d.setRoute("cards", c.ID, name)
+	return nil
+}
+
+// Delete deletes the entity from the shard holding it.
+func (d *DB) Delete(entity, id string) error {
+	name, err := d.find(entity, id, func(s db.Database) error {
+		var err error
+		switch entity {
+		case "customers":
+			_, err = s.GetUser(id)
+		case "addresses":
+			_, err = s.GetAddress(id)
+		case "cards":
+			_, err = s.GetCard(id)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.shards[name].Delete(entity, id); err != nil {
+		return err
+	}
+	d.dropRoute(entity, id)
+	return nil
+}
+
+// CreateLoginAttempt stores the attempt with the user it is for. Attempts
+// for unknown users are kept on the home shard.
+func (d *DB) CreateLoginAttempt(l *users.LoginAttempt) error {
+	if l.UserID == "" {
+		return d.shards[d.home].CreateLoginAttempt(l)
+	}
+	s, err := d.userShard(l.UserID)
+	if err != nil {
+		return err
+	}
+	return s.CreateLoginAttempt(l)
+}
+
+func (d *DB) GetLoginAttempts(userid string) ([]users.LoginAttempt, error) {
+	s, err := d.userShard(userid)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetLoginAttempts(userid)
+}
+
+// CreateNote stores the note with the user it is about.
+func (d *DB) CreateNote(n *users.Note) error {
+	s, err := d.userShard(n.UserID)
+	if err != nil {
+		return err
+	}
+	return s.CreateNote(n)
+}
+
+func (d *DB) GetNotes(userid string, offset, limit int) ([]users.Note, error) {
+	s, err := d.userShard(userid)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetNotes(userid, offset, limit)
+}
+
+func (d *DB) CreateJob(j *jobs.Job) error {
+	return d.shards[d.home].CreateJob(j)
+}
+
+func (d *DB) GetJob(id string) (jobs.Job, error) {
+	return d.shards[d.home].GetJob(id)
+}
+
+func (d *DB) UpdateJob(j *jobs.Job, leaseUntil time.Time) error {
+	return d.shards[d.home].UpdateJob(j, leaseUntil)
+}
+
+func (d *DB) ClaimJob(owner string, now, leaseUntil time.Time) (jobs.Job, error) {
+	return d.shards[d.home].ClaimJob(owner, now, leaseUntil)
+}
+
+// Indexes reports the indexes of every shard, prefixing collections with
+// the shard name.
+func (d *DB) Indexes() ([]db.Index, error) {
+	var is []db.Index
+	for _, name := range d.names {
+		found, err := d.shards[name].Indexes()
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range found {
+			i.Collection = name + "/" + i.Collection
+			is = append(is, i)
+		}
+	}
+	return is, nil
+}
+
+// merge reads the first offset+limit results of every shard and returns
+// the requested page of them in order. Each shard continues after the
+// cursor, if any, so the merged page does too.
+func merge[T any](d *DB, l db.ListOptions, list func(db.Database, db.ListOptions) ([]T, error)) ([]T, error) {
+	sl := l
+	sl.Offset = 0
+	if l.Limit > 0 {
+		sl.Limit = l.Offset + l.Limit
+	}
+	all := make([]T, 0)
+	for _, name := range d.names {
+		found, err := list(d.shards[name], sl)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, found...)
+	}
+	if l.Sort != "" || l.Offset > 0 || l.Limit > 0 || l.After != "" {
+		// Results are merged in the order of each shard: by the sort
+		// field, then by ID.
+		sort.SliceStable(all, func(i, j int) bool {
+			a, b := all[i], all[j]
+			if l.Descending {
+				a, b = b, a
+			}
+			if l.Sort != "" {
+				va, vb := db.SortValue(a, l.Sort), db.SortValue(b, l.Sort)
+				if less(va, vb) || less(vb, va) {
+					return less(va, vb)
+				}
+			}
+			return less(db.SortValue(a, "id"), db.SortValue(b, "id"))
+		})
+	}
+	return window(all, l.Offset, l.Limit), nil
+}
+
+// window returns the page of s starting at offset. A zero limit returns the
+// rest of s.
+func window[T any](s []T, offset, limit int) []T {
+	if offset >= len(s) {
+		return s[:0]
+	}
+	s = s[offset:]
+	if limit > 0 && limit < len(s) {
+		s = s[:limit]
+	}
+	return s
+}
+
+// less orders the sort values of results.
+func less(a, b interface{}) bool {
+	switch a := a.(type) {
+	case time.Time:
+		b, ok := b.(time.Time)
+		return ok && a.Before(b)
+	case string:
+		b, ok := b.(string)
+		return ok && a < b
+	}
+	return false
+}
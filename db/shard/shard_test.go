@@ -0,0 +1,296 @@
+package shard
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// mem is a shard holding users in memory.
+type mem struct {
+	db.Database
+	name  string
+	users []users.User
+}
+
+func (m *mem) CreateUser(u *users.User) error {
+	u.UserID = fmt.Sprintf("%v-%v", m.name, len(m.users))
+	m.users = append(m.users, *u)
+	return nil
+}
+
+func (m *mem) get(match func(users.User) bool) (users.User, error) {
+	for _, u := range m.users {
+		if match(u) {
+			return u, nil
+		}
+	}
+	return users.User{}, users.ErrUserNotFound
+}
+
+func (m *mem) GetUser(id string) (users.User, error) {
+	return m.get(func(u users.User) bool { return u.UserID == id })
+}
+
+func (m *mem) GetUserByName(name string) (users.User, error) {
+	return m.get(func(u users.User) bool { return u.Username == name })
+}
+
+// ExistsUsername and ExistsEmail match normalized values, as the
+// databases do.
+func (m *mem) ExistsUsername(name string) (bool, error) {
+	_, err := m.get(func(u users.User) bool { return u.UsernameNormalized == name })
+	return err == nil, nil
+}
+
+func (m *mem) ExistsEmail(email string) (bool, error) {
+	_, err := m.get(func(u users.User) bool { return u.EmailNormalized == email })
+	return err == nil, nil
+}
+
+// GetUsers lists users by username, continuing after the cursor.
+func (m *mem) GetUsers(l db.ListOptions) ([]users.User, error) {
+	c, err := db.ListCursor(l)
+	if err != nil {
+		return nil, err
+	}
+	var us []users.User
+	for _, u := range m.users {
+		if c == nil || u.Username > c.Value.(string) {
+			us = append(us, u)
+		}
+	}
+	sort.Slice(us, func(i, j int) bool { return us[i].Username < us[j].Username })
+	if l.Limit > 0 && l.Limit < len(us) {
+		return us[:l.Limit], nil
+	}
+	return us, nil
+}
+
+func (m *mem) ExportUsers(q db.Query, cursor string, f func(users.User, string) error) error {
+	for i, u := range m.users {
+		if cursor != "" && fmt.Sprint(i) <= cursor {
+			continue
+		}
+		if err := f(u, fmt.Sprint(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mem) Delete(entity, id string) error {
+	for i, u := range m.users {
+		if u.UserID == id {
+			m.users = append(m.users[:i], m.users[i+1:]...)
+			return nil
+		}
+	}
+	return users.ErrUserNotFound
+}
+
+func newTestDB(t *testing.T) (*DB, *mem, *mem) {
+	eu, us := &mem{name: "eu"}, &mem{name: "us"}
+	d, err := New(map[string]db.Database{"eu": eu, "us": us}, "us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, eu, us
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(map[string]db.Database{"eu": &mem{}}, "us"); err == nil {
+		t.Error("Expected unknown home shard to be refused")
+	}
+}
+
+func TestPlace(t *testing.T) {
+	d, _, _ := newTestDB(t)
+	d.Residencies = map[string]string{"DE": "eu"}
+	for _, residency := range []string{"eu", "DE"} {
+		if name, err := d.Place(users.User{Username: "jo", Residency: residency}); err != nil || name != "eu" {
+			t.Errorf("Expected resident of %v to be placed on eu, received %v %v", residency, name, err)
+		}
+	}
+	if name, err := d.Place(users.User{Username: "jo"}); err != nil || name == "" {
+		t.Errorf("Expected a user without residency placed by hash, received %q %v", name, err)
+	}
+	if _, err := d.Place(users.User{Username: "jo", Residency: "mars"}); err != ErrUnknownResidency {
+		t.Errorf("Expected an unknown residency refused, received %v", err)
+	}
+}
+
+func TestCreateAndGet(t *testing.T) {
+	d, eu, us := newTestDB(t)
+	u := users.User{Username: "hans", UsernameNormalized: "hans", Residency: "eu"}
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if len(eu.users) != 1 || len(us.users) != 0 {
+		t.Fatalf("Expected user stored on eu only, received %v and %v", eu.users, us.users)
+	}
+	d.routes = make(map[string]string)
+	for _, get := range []func() (users.User, error){
+		func() (users.User, error) { return d.GetUser(u.UserID) },
+		func() (users.User, error) { return d.GetUserByName("hans") },
+	} {
+		got, err := get()
+		if err != nil || got.UserID != u.UserID {
+			t.Errorf("Expected %v, received %v %v", u.UserID, got.UserID, err)
+		}
+	}
+	if name, ok := d.route("customers", u.UserID); !ok || name != "eu" {
+		t.Errorf("Expected user routed to eu, received %q", name)
+	}
+
+	dup := users.User{Username: "Hans", UsernameNormalized: "hans", Residency: "us"}
+	if err := d.CreateUser(&dup); err != db.ErrUsernameTaken {
+		t.Errorf("Expected case variant of a username on another shard to be taken, received %v", err)
+	}
+
+	if err := d.Delete("customers", u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetUserByName("hans"); err != users.ErrUserNotFound {
+		t.Errorf("Expected deleted user not to be found, received %v", err)
+	}
+}
+
+func TestCreateUniqueEmail(t *testing.T) {
+	defer func(unique bool) { db.UniqueEmail = unique }(db.UniqueEmail)
+	db.UniqueEmail = true
+	d, _, _ := newTestDB(t)
+	u := users.User{Username: "hans", UsernameNormalized: "hans", Email: "hans@example.com", EmailNormalized: "hans@example.com", Residency: "eu"}
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	dup := users.User{Username: "jo", UsernameNormalized: "jo", Email: "Hans@Example.com", Residency: "us"}
+	if err := d.CreateUser(&dup); err != db.ErrEmailTaken {
+		t.Errorf("Expected email on another shard to be taken, received %v", err)
+	}
+}
+
+// reserving is a home shard holding reservations.
+type reserving struct {
+	mem
+	reserved map[string]bool
+}
+
+func (r *reserving) Reserve(kind, key string) (bool, error) {
+	if r.reserved[kind+"/"+key] {
+		return false, nil
+	}
+	r.reserved[kind+"/"+key] = true
+	return true, nil
+}
+
+func (r *reserving) Release(kind, key string) error {
+	delete(r.reserved, kind+"/"+key)
+	return nil
+}
+
+func TestCreateReserves(t *testing.T) {
+	defer func(unique bool) { db.UniqueEmail = unique }(db.UniqueEmail)
+	db.UniqueEmail = true
+	home := &reserving{mem: mem{name: "us"}, reserved: map[string]bool{"username/hans": true}}
+	d, err := New(map[string]db.Database{"eu": &mem{name: "eu"}, "us": home}, "us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := users.User{Username: "hans", UsernameNormalized: "hans", Email: "hans@example.com", Residency: "eu"}
+	if err := d.CreateUser(&u); err != db.ErrUsernameTaken {
+		t.Errorf("Expected a username being created elsewhere to be taken, received %v", err)
+	}
+	home.reserved = map[string]bool{"email/hans@example.com": true}
+	if err := d.CreateUser(&u); err != db.ErrEmailTaken {
+		t.Errorf("Expected an email being created elsewhere to be taken, received %v", err)
+	}
+	if len(home.reserved) != 1 {
+		t.Errorf("Expected the username released after the refusal, received %v", home.reserved)
+	}
+	home.reserved = map[string]bool{}
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if len(home.reserved) != 0 {
+		t.Errorf("Expected the reservations released after creating, received %v", home.reserved)
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	d, eu, us := newTestDB(t)
+	eu.users = []users.User{{Username: "b"}, {Username: "d"}}
+	us.users = []users.User{{Username: "a"}, {Username: "c"}}
+	got, err := d.GetUsers(db.ListOptions{Sort: "username", Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Username != "b" || got[1].Username != "c" {
+		t.Errorf("Expected the second page of merged users, received %v", got)
+	}
+	got, _ = d.GetUsers(db.ListOptions{Sort: "username", Descending: true})
+	if len(got) != 4 || got[0].Username != "d" {
+		t.Errorf("Expected every user in descending order, received %v", got)
+	}
+}
+
+func TestGetUsersAfter(t *testing.T) {
+	d, eu, us := newTestDB(t)
+	eu.users = []users.User{{UserID: "1", Username: "b"}, {UserID: "2", Username: "d"}}
+	us.users = []users.User{{UserID: "3", Username: "a"}, {UserID: "4", Username: "e"}}
+	l := db.ListOptions{Sort: "username", Limit: 2}
+	var names []string
+	for {
+		page, err := d.GetUsers(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range page {
+			names = append(names, u.Username)
+		}
+		if len(page) < l.Limit {
+			break
+		}
+		l.After = db.After(l, page[len(page)-1])
+		// Users inserted before the cursor are not seen, nor do they
+		// shift the later pages.
+		us.users = append(us.users, users.User{UserID: "5" + l.After, Username: "0" + l.After})
+	}
+	if fmt.Sprint(names) != "[a b d e]" {
+		t.Errorf("Expected every user once, received %v", names)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	d, eu, us := newTestDB(t)
+	eu.users = []users.User{{Username: "a"}, {Username: "b"}}
+	us.users = []users.User{{Username: "c"}}
+	var names, cursors []string
+	export := func(u users.User, c string) error {
+		names = append(names, u.Username)
+		cursors = append(cursors, c)
+		return nil
+	}
+	if err := d.ExportUsers(db.Query{}, "", export); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[a b c]" {
+		t.Errorf("Expected every shard exported, received %v", names)
+	}
+	resume := cursors[0]
+	names = nil
+	if err := d.ExportUsers(db.Query{}, resume, export); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[b c]" {
+		t.Errorf("Expected export resumed after %v, received %v", resume, names)
+	}
+	for _, c := range []string{"nocolon", "mars:0"} {
+		if err := d.ExportUsers(db.Query{}, c, export); err != db.ErrInvalidCursor {
+			t.Errorf("Expected %q to be refused, received %v", c, err)
+		}
+	}
+}
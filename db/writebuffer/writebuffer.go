@@ -0,0 +1,297 @@
+package writebuffer
+
+// writebuffer.go contains a Database decorator buffering writes that
+// requests need not wait for, login history and last login times, while the
+// database is unreachable. They are retried until it recovers, so a brief
+// Mongo outage loses neither them nor the logins recording them.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/ids"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	Buffered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_write_buffer_buffered_total",
+		Help: "Number of writes buffered while the database was unreachable, by method.",
+	}, []string{"method"})
+	Dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_write_buffer_dropped_total",
+		Help: "Number of writes dropped because the buffer was full, by method.",
+	}, []string{"method"})
+	Pending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_write_buffer_pending",
+		Help: "Number of buffered writes waiting for the database.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(Buffered)
+	prometheus.MustRegister(Dropped)
+	prometheus.MustRegister(Pending)
+}
+
+// DefaultRetry is how often buffered writes are retried.
+const DefaultRetry = time.Second
+
+// Buffer serves the embedded Database, buffering login attempts and last
+// login updates that fail for reasons other than being invalid. While
+// writes are buffered, further ones are buffered without being tried, so
+// logins do not wait on a database that is down.
+type Buffer struct {
+	db.Database
+
+	// Size bounds the buffered writes; further ones are dropped.
+	Size int
+	// Retry is how often buffered writes are retried.
+	Retry time.Duration
+	// Spool, if set, is the file writes still buffered on Stop are saved to,
+	// and read back from on Start.
+	Spool string
+	Clock clock.Clock
+
+	// flushing is held by the one Flush writing buffered writes.
+	flushing   sync.Mutex
+	mu         sync.Mutex
+	attempts   []users.LoginAttempt
+	lastLogins []string
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// New returns a Buffer holding up to size writes to d.
+func New(d db.Database, size int) *Buffer {
+	return &Buffer{Database: d, Size: size, Retry: DefaultRetry, Clock: clock.System{}}
+}
+
+// spool is the saved form of the buffered writes.
+type spool struct {
+	Attempts   []users.LoginAttempt `json:"attempts"`
+	LastLogins []string             `json:"lastLogins"`
+}
+
+// Start reads back the writes spooled by the last Stop, if any, and starts
+// retrying buffered writes.
+func (b *Buffer) Start() error {
+	if b.Spool != "" {
+		data, err := os.ReadFile(b.Spool)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			var s spool
+			if err := json.Unmarshal(data, &s); err != nil {
+				return err
+			}
+			b.mu.Lock()
+			b.attempts, b.lastLogins = s.Attempts, s.LastLogins
+			b.updatePending()
+			b.mu.Unlock()
+			if err := os.Remove(b.Spool); err != nil {
+				return err
+			}
+		}
+	}
+	b.stop, b.done = make(chan struct{}), make(chan struct{})
+	go b.run()
+	return nil
+}
+
+func (b *Buffer) run() {
+	defer close(b.done)
+	t := time.NewTicker(b.Retry)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-t.C:
+			b.Flush()
+		}
+	}
+}
+
+// Stop stops retrying, tries the buffered writes a last time and saves
+// those still failing to the spool file, if there is one.
+func (b *Buffer) Stop(ctx context.Context) error {
+	if b.stop != nil {
+		close(b.stop)
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := b.Flush(); err == nil || b.Spool == "" {
+		return err
+	}
+	b.mu.Lock()
+	data, err := json.Marshal(spool{Attempts: b.attempts, LastLogins: b.lastLogins})
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := b.Spool + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.Spool)
+}
+
+// Flush writes the buffered writes, login attempts first, in the order
+// they were made, stopping at the first that fails. Writes are buffered
+// meanwhile rather than waiting for it.
+func (b *Buffer) Flush() error {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+	for {
+		b.mu.Lock()
+		var write func() error
+		var pop func()
+		switch {
+		case len(b.attempts) > 0:
+			a := b.attempts[0]
+			write = func() error { return b.Database.CreateLoginAttempt(&a) }
+			pop = func() { b.attempts = b.attempts[1:] }
+		case len(b.lastLogins) > 0:
+			id := b.lastLogins[0]
+			write = func() error { return b.Database.UpdateLastLogin(id) }
+			pop = func() { b.lastLogins = b.lastLogins[1:] }
+		}
+		b.mu.Unlock()
+		if write == nil {
+			return nil
+		}
+		if err := write(); err != nil && transient(err) {
+			return err
+		}
+		b.mu.Lock()
+		pop()
+		b.updatePending()
+		b.mu.Unlock()
+	}
+}
+
+// Len returns the number of buffered writes.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.attempts) + len(b.lastLogins)
+}
+
+func (b *Buffer) updatePending() {
+	Pending.Set(float64(len(b.attempts) + len(b.lastLogins)))
+}
+
+// transient reports whether a write failing with err may succeed later.
+// Domain errors, such as invalid IDs, never will.
+func transient(err error) bool {
+	var e *users.Error
+	return !errors.As(err, &e)
+}
+
+// buffering reports whether writes are being buffered.
+func (b *Buffer) buffering() bool {
+	return b.Len() > 0
+}
+
+// add buffers a write with add, unless the buffer is full.
+func (b *Buffer) add(method string, add func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.attempts)+len(b.lastLogins) >= b.Size {
+		Dropped.WithLabelValues(method).Inc()
+		return
+	}
+	add()
+	Buffered.WithLabelValues(method).Inc()
+	b.updatePending()
+}
+
+// CreateLoginAttempt records the attempt, buffering it if the database
+// cannot be reached. It is timed when made rather than when written.
+func (b *Buffer) CreateLoginAttempt(l *users.LoginAttempt) error {
+	if l.Time.IsZero() {
+		l.Time = b.Clock.Now()
+	}
+	if !b.buffering() {
+		err := b.Database.CreateLoginAttempt(l)
+		if err == nil || !transient(err) {
+			return err
+		}
+	}
+	a := *l
+	b.add("CreateLoginAttempt", func() { b.attempts = append(b.attempts, a) })
+	return nil
+}
+
+// UpdateLastLogin sets the user's last login, buffering the update if the
+// database cannot be reached. Buffered updates set the time they are
+// written.
+func (b *Buffer) UpdateLastLogin(id string) error {
+	if !b.buffering() {
+		err := b.Database.UpdateLastLogin(id)
+		if err == nil || !transient(err) {
+			return err
+		}
+	}
+	b.add("UpdateLastLogin", func() { b.lastLogins = append(b.lastLogins, id) })
+	return nil
+}
+
+// Reload reloads the credentials of the embedded Database, if it supports
+// it.
+func (b *Buffer) Reload() error {
+	if r, ok := b.Database.(db.Reloader); ok {
+		return r.Reload()
+	}
+	return nil
+}
+
+// IDs returns the ID scheme of the embedded Database, if it declares one.
+func (b *Buffer) IDs() ids.Generator {
+	if g, ok := b.Database.(db.IDGenerator); ok {
+		return g.IDs()
+	}
+	return nil
+}
+
+// Reserve reserves the key of kind on the embedded Database.
+func (b *Buffer) Reserve(kind, key string) (bool, error) {
+	return db.Reserve(b.Database, kind, key)
+}
+
+func (b *Buffer) Release(kind, key string) error {
+	return db.Release(b.Database, kind, key)
+}
+
+// MapIDs records the new IDs of entities of kind with the embedded Database.
+func (b *Buffer) MapIDs(kind string, ids map[string]string) error {
+	return db.MapIDs(b.Database, kind, ids)
+}
+
+func (b *Buffer) MappedID(kind, old string) (string, error) {
+	return db.MappedID(b.Database, kind, old)
+}
+
+// Purge purges the data of the embedded Database, if it is a Purger.
+func (b *Buffer) Purge(kind string, before time.Time) (int64, error) {
+	if p, ok := b.Database.(db.Purger); ok {
+		return p.Purge(kind, before)
+	}
+	return 0, nil
+}
+
+func (b *Buffer) GetUserWithAttributes(id string) (users.User, error) {
+	return db.ReadUserWithAttributes(b.Database, id)
+}
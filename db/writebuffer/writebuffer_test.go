@@ -0,0 +1,119 @@
+package writebuffer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// outageDB fails every write while down.
+type outageDB struct {
+	db.Database
+	mu         sync.Mutex
+	down       bool
+	tries      int
+	attempts   []users.LoginAttempt
+	lastLogins []string
+}
+
+func (d *outageDB) setDown(down bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down = down
+}
+
+func (d *outageDB) CreateLoginAttempt(l *users.LoginAttempt) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tries++
+	if d.down {
+		return errors.New("server selection timeout")
+	}
+	d.attempts = append(d.attempts, *l)
+	return nil
+}
+
+func (d *outageDB) UpdateLastLogin(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tries++
+	if d.down {
+		return errors.New("server selection timeout")
+	}
+	if id == "bad" {
+		return users.ErrInvalidID
+	}
+	d.lastLogins = append(d.lastLogins, id)
+	return nil
+}
+
+func TestBuffer(t *testing.T) {
+	d := &outageDB{down: true}
+	b := New(d, 3)
+	b.Clock = clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err := b.CreateLoginAttempt(&users.LoginAttempt{Username: "eve"}); err != nil {
+		t.Fatalf("Expected the attempt buffered, received %v", err)
+	}
+	b.UpdateLastLogin("u1")
+	b.CreateLoginAttempt(&users.LoginAttempt{Username: "jo"})
+	b.CreateLoginAttempt(&users.LoginAttempt{Username: "dropped"})
+	if b.Len() != 3 || d.tries != 1 {
+		t.Errorf("Expected later writes buffered untried, received %v buffered after %v tries", b.Len(), d.tries)
+	}
+	if err := b.Flush(); err == nil {
+		t.Error("Expected the flush to fail while the database is down")
+	}
+
+	d.setDown(false)
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 || len(d.attempts) != 2 || d.attempts[1].Username != "jo" || len(d.lastLogins) != 1 {
+		t.Errorf("Expected the buffered writes in order, received %+v %v", d.attempts, d.lastLogins)
+	}
+	if !d.attempts[0].Time.Equal(b.Clock.Now()) {
+		t.Errorf("Expected the attempt timed when made, received %v", d.attempts[0].Time)
+	}
+	if err := b.UpdateLastLogin("bad"); err != users.ErrInvalidID || b.Len() != 0 {
+		t.Errorf("Expected invalid writes refused rather than buffered, received %v", err)
+	}
+}
+
+func TestBufferSpool(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "writes.json")
+	d := &outageDB{down: true}
+	b := New(d, 10)
+	b.Spool = spool
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	b.CreateLoginAttempt(&users.LoginAttempt{Username: "eve"})
+	b.UpdateLastLogin("u1")
+	if err := b.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	d.setDown(false)
+	b = New(d, 10)
+	b.Spool = spool
+	b.Retry = time.Millisecond
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop(context.Background())
+	for deadline := time.Now().Add(5 * time.Second); b.Len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.attempts) != 1 || len(d.lastLogins) != 1 {
+		t.Errorf("Expected the spooled writes flushed after a restart, received %+v %v", d.attempts, d.lastLogins)
+	}
+}
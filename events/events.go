@@ -0,0 +1,207 @@
+// Package events publishes domain events, such as cards flagged as
+// suspected fraud, for other services to act on.
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Event types.
+const (
+	CardFlagged   = "card.flagged"
+	CardUnflagged = "card.unflagged"
+	UserCreated   = "user.created"
+	UserUpdated   = "user.updated"
+	UserDeleted   = "user.deleted"
+
+	// LoginChallenged carries the one-time code of a challenged login. It
+	// is only published to the step-up publisher, never with the others.
+	LoginChallenged = "login.challenged"
+)
+
+var Published = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "events_published_total",
+	Help: "Number of events published, by type and result.",
+}, []string{"type", "result"})
+
+func init() {
+	prometheus.MustRegister(Published)
+}
+
+// Event is something that happened to an entity, identified by Subject. ID
+// identifies the event itself, so that consumers can drop duplicates.
+type Event struct {
+	ID      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Subject string      `json:"subject"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Publisher delivers events.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Publish delivers e through p, counting the result. Events are published
+// after the change they describe is stored, so failures are counted rather
+// than returned. Events without a time or ID are given the current time
+// and a random ID; callers with an injected clock and RNG set them first.
+func Publish(ctx context.Context, p Publisher, e Event) {
+	if p == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	result := "ok"
+	if err := p.Publish(ctx, e); err != nil {
+		result = "error"
+	}
+	Published.WithLabelValues(e.Type, result).Inc()
+}
+
+// newID returns a random event ID.
+func newID() string {
+	return hex.EncodeToString(clock.Bytes(nil, 16))
+}
+
+// Format encodes events as they are delivered.
+type Format interface {
+	// Marshal returns the body of e and its content type.
+	Marshal(e Event) ([]byte, string, error)
+}
+
+// JSON formats events as the JSON of Event.
+type JSON struct{}
+
+// Marshal implements Format.
+func (JSON) Marshal(e Event) ([]byte, string, error) {
+	body, err := json.Marshal(e)
+	return body, "application/json", err
+}
+
+// CloudEvents formats events as CloudEvents 1.0 in structured JSON mode, as
+// consumed by Knative and EventBridge.
+type CloudEvents struct {
+	// Source is the source attribute of every event, a URI reference such
+	// as "/user".
+	Source string
+	// TypePrefix is prepended to the types of events, such as
+	// "com.example." for "com.example.user.created".
+	TypePrefix string
+}
+
+// cloudEvent is an event in the structured JSON format of CloudEvents 1.0.
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype,omitempty"`
+	Data            interface{} `json:"data,omitempty"`
+}
+
+// Marshal implements Format.
+func (c CloudEvents) Marshal(e Event) ([]byte, string, error) {
+	ce := cloudEvent{
+		SpecVersion: "1.0",
+		ID:          e.ID,
+		Source:      c.Source,
+		Type:        c.TypePrefix + e.Type,
+		Subject:     e.Subject,
+		Time:        e.Time,
+		Data:        e.Data,
+	}
+	if ce.ID == "" {
+		ce.ID = newID()
+	}
+	if ce.Data != nil {
+		ce.DataContentType = "application/json"
+	}
+	body, err := json.Marshal(ce)
+	return body, "application/cloudevents+json; charset=UTF-8", err
+}
+
+// Multi publishes events through each of its publishers, returning their
+// errors joined.
+type Multi []Publisher
+
+// Publish implements Publisher.
+func (m Multi) Publish(ctx context.Context, e Event) error {
+	var errs []error
+	for _, p := range m {
+		if err := p.Publish(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Log publishes events as log lines.
+type Log struct {
+	Logger log.Logger
+}
+
+// Publish implements Publisher.
+func (l Log) Publish(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	return l.Logger.Log("event", e.Type, "subject", e.Subject, "data", string(data))
+}
+
+// Webhook posts events to URL, in Format or as JSON if it is nil.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+	Format Format
+}
+
+// NewWebhook returns a Webhook giving up on deliveries after timeout.
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	return &Webhook{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+// Publish implements Publisher. Responses other than 2xx are errors.
+func (w *Webhook) Publish(ctx context.Context, e Event) error {
+	format := w.Format
+	if format == nil {
+		format = JSON{}
+	}
+	body, contentType, err := format.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("event webhook returned %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func count(typ, result string) float64 {
+	var d dto.Metric
+	Published.WithLabelValues(typ, result).Write(&d)
+	return d.GetCounter().GetValue()
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := Log{Logger: log.NewLogfmtLogger(&buf)}
+	if err := l.Publish(context.Background(), Event{Type: CardFlagged, Subject: "c1", Data: map[string]string{"reason": "chargeback"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); !strings.Contains(s, "event=card.flagged subject=c1") || !strings.Contains(s, "chargeback") {
+		t.Errorf("Expected the event logged, received %q", s)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		received <- e
+		if e.Subject == "fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL, time.Second)
+	if err := w.Publish(context.Background(), Event{Type: CardFlagged, Subject: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-received; e.Type != CardFlagged || e.Subject != "c1" {
+		t.Errorf("Expected the event posted, received %+v", e)
+	}
+	if err := w.Publish(context.Background(), Event{Type: CardFlagged, Subject: "fail"}); err == nil {
+		t.Error("Expected a failed delivery to be reported")
+	}
+	<-received
+}
+
+func TestPublish(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	before := count(CardUnflagged, "error")
+	Publish(context.Background(), NewWebhook(srv.URL, time.Second), Event{Type: CardUnflagged})
+	if n := count(CardUnflagged, "error") - before; n != 1 {
+		t.Errorf("Expected the failure counted, received %v", n)
+	}
+	Publish(context.Background(), nil, Event{Type: CardUnflagged})
+}
+
+type publisherFunc func(context.Context, Event) error
+
+func (f publisherFunc) Publish(ctx context.Context, e Event) error { return f(ctx, e) }
+
+func TestMulti(t *testing.T) {
+	var received []string
+	ok := publisherFunc(func(ctx context.Context, e Event) error {
+		received = append(received, e.Subject)
+		return nil
+	})
+	failing := publisherFunc(func(ctx context.Context, e Event) error {
+		return errors.New("unreachable")
+	})
+	err := Multi{failing, ok}.Publish(context.Background(), Event{Type: UserCreated, Subject: "u1"})
+	if err == nil || len(received) != 1 {
+		t.Errorf("Expected the event delivered despite the error, received %v %v", err, received)
+	}
+}
+
+func TestCloudEvents(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- r
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL, time.Second)
+	w.Format = CloudEvents{Source: "/user", TypePrefix: "com.example."}
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := w.Publish(context.Background(), Event{ID: "e1", Type: UserCreated, Subject: "u1", Time: at, Data: map[string]string{"tag": "vip"}}); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-received; !strings.HasPrefix(r.Header.Get("Content-Type"), "application/cloudevents+json") {
+		t.Errorf("Expected a structured CloudEvent, received %v", r.Header.Get("Content-Type"))
+	}
+	want := map[string]interface{}{
+		"specversion": "1.0", "id": "e1", "source": "/user", "type": "com.example.user.created", "subject": "u1",
+		"time": "2024-01-01T00:00:00Z", "datacontenttype": "application/json", "data": map[string]interface{}{"tag": "vip"},
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("Expected %v, received %v", want, body)
+	}
+}
+
+func TestPublishID(t *testing.T) {
+	var ids []string
+	p := publisherFunc(func(ctx context.Context, e Event) error {
+		ids = append(ids, e.ID)
+		return nil
+	})
+	Publish(context.Background(), p, Event{Type: UserCreated})
+	Publish(context.Background(), p, Event{Type: UserCreated})
+	if len(ids) != 2 || len(ids[0]) != 32 || ids[0] == ids[1] {
+		t.Errorf("Expected a unique ID given to each event, received %v", ids)
+	}
+}
@@ -0,0 +1,68 @@
+// Package i18n translates the messages of client errors. Messages are keyed
+// by error code; the English messages of the errors themselves are the
+// source language, so English needs no bundle.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"path"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+//go:embed messages/*.json
+var bundleFiles embed.FS
+
+var (
+	// bundles maps a language to its messages by error code.
+	bundles = map[language.Tag]map[string]string{}
+	// tags lists the supported languages, English first as the default.
+	tags    = []language.Tag{language.English}
+	matcher language.Matcher
+)
+
+func init() {
+	files, err := bundleFiles.ReadDir("messages")
+	if err != nil {
+		panic(err)
+	}
+	for _, f := range files {
+		tag := language.MustParse(strings.TrimSuffix(f.Name(), ".json"))
+		data, err := bundleFiles.ReadFile(path.Join("messages", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(err)
+		}
+		bundles[tag] = messages
+		tags = append(tags, tag)
+	}
+	matcher = language.NewMatcher(tags)
+}
+
+// Match returns the supported language best matching an Accept-Language
+// header, defaulting to English.
+func Match(acceptLanguage string) language.Tag {
+	prefs, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(prefs) == 0 {
+		return language.English
+	}
+	_, i, confidence := matcher.Match(prefs...)
+	if confidence == language.No {
+		return language.English
+	}
+	return tags[i]
+}
+
+// Message returns the message for code in lang, or fallback if the
+// language or code has no translation.
+func Message(lang language.Tag, code, fallback string) string {
+	if m, ok := bundles[lang][code]; ok {
+		return m
+	}
+	return fallback
+}
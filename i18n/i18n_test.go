@@ -0,0 +1,54 @@
+package i18n
+
+import (
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestMatch(t *testing.T) {
+	for header, want := range map[string]language.Tag{
+		"":                       language.English,
+		"de-CH, en;q=0.5":        language.German,
+		"fr-FR,fr;q=0.9":         language.French,
+		"ja, es;q=0.8":           language.Spanish,
+		"ja":                     language.English,
+		"not a language header!": language.English,
+	} {
+		if got := Match(header); got != want {
+			t.Errorf("Expected %v for %q, received %v", want, header, got)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	if m := Message(language.German, "USER_NOT_FOUND", "User not found"); m != "Benutzer nicht gefunden" {
+		t.Errorf("Expected German message, received %v", m)
+	}
+	if m := Message(language.English, "USER_NOT_FOUND", "User not found"); m != "User not found" {
+		t.Errorf("Expected the English source message, received %v", m)
+	}
+	if m := Message(language.German, "UNKNOWN_CODE", "fallback"); m != "fallback" {
+		t.Errorf("Expected fallback for untranslated code, received %v", m)
+	}
+}
+
+// TestBundlesComplete checks every bundle translates the same codes.
+func TestBundlesComplete(t *testing.T) {
+	de := bundles[language.German]
+	for tag, messages := range bundles {
+		if len(messages) != len(de) {
+			t.Errorf("Expected %v to translate %v codes, received %v", tag, len(de), len(messages))
+		}
+		for code := range de {
+			if messages[code] == "" {
+				t.Errorf("Expected %v to translate %v", tag, code)
+			}
+		}
+	}
+	data, _ := bundleFiles.ReadFile("messages/de.json")
+	if !json.Valid(data) {
+		t.Error("Expected valid JSON bundle")
+	}
+}
@@ -0,0 +1,158 @@
+// Package ids generates and recognizes the IDs of stored entities. Each
+// database backend picks the scheme matching its storage; the API treats
+// IDs as opaque strings and only asks the backend whether one could be
+// valid.
+package ids
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikesay/user/clock"
+)
+
+// Schemes of IDs.
+const (
+	ObjectIDScheme = "objectid"
+	ULIDScheme     = "ulid"
+	UUIDv7Scheme   = "uuidv7"
+)
+
+// Generator creates new IDs and tells whether a string is one. IDs of every
+// scheme sort by creation time, to the second at least.
+type Generator interface {
+	New() string
+	Valid(id string) bool
+}
+
+// Parse returns the generator of the named scheme.
+func Parse(scheme string) (Generator, error) {
+	switch strings.ToLower(strings.TrimSpace(scheme)) {
+	case ObjectIDScheme:
+		return ObjectID{}, nil
+	case ULIDScheme:
+		return ULID{}, nil
+	case UUIDv7Scheme:
+		return UUIDv7{}, nil
+	}
+	return nil, fmt.Errorf("unknown id scheme %q, expected %v, %v or %v", scheme, ObjectIDScheme, ULIDScheme, UUIDv7Scheme)
+}
+
+// now returns the time of c, or the wall clock if c is nil.
+func now(c clock.Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// ObjectID generates Mongo ObjectIDs in hex: a timestamp in seconds, a
+// random value per process and a counter. Timestamps are read from Clock,
+// or the wall clock if nil.
+type ObjectID struct {
+	Clock clock.Clock
+}
+
+var (
+	processUnique = func() [5]byte {
+		var b [5]byte
+		copy(b[:], clock.Bytes(nil, 5))
+		return b
+	}()
+	objectIDCounter = func() *atomic.Uint32 {
+		c := new(atomic.Uint32)
+		c.Store(binary.BigEndian.Uint32(clock.Bytes(nil, 4)))
+		return c
+	}()
+)
+
+func (g ObjectID) New() string {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[0:4], uint32(now(g.Clock).Unix()))
+	copy(b[4:9], processUnique[:])
+	n := objectIDCounter.Add(1)
+	b[9], b[10], b[11] = byte(n>>16), byte(n>>8), byte(n)
+	return hex.EncodeToString(b[:])
+}
+
+func (ObjectID) Valid(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// ULID generates ULIDs: a timestamp in milliseconds and 80 random bits, in
+// Crockford's base32. Timestamps are read from Clock and random bits from
+// RNG, or the wall clock and clock.Random if nil.
+type ULID struct {
+	Clock clock.Clock
+	RNG   clock.RNG
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g ULID) New() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], uint64(now(g.Clock).UnixMilli())<<16)
+	copy(b[6:], clock.Bytes(g.RNG, 10))
+	// 128 bits are 26 base32 digits, the first holding the top 3 bits.
+	hi, lo := binary.BigEndian.Uint64(b[0:8]), binary.BigEndian.Uint64(b[8:16])
+	var s [26]byte
+	for k := 25; k >= 0; k-- {
+		s[k] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
+
+func (ULID) Valid(id string) bool {
+	if len(id) != 26 || id[0] > '7' {
+		return false
+	}
+	for k := 0; k < len(id); k++ {
+		if strings.IndexByte(crockford, id[k]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// UUIDv7 generates version 7 UUIDs: a timestamp in milliseconds and random
+// bits, in the lowercase hyphenated form. Like ULID, it reads Clock and RNG
+// if set.
+type UUIDv7 struct {
+	Clock clock.Clock
+	RNG   clock.RNG
+}
+
+func (g UUIDv7) New() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], uint64(now(g.Clock).UnixMilli())<<16)
+	copy(b[6:], clock.Bytes(g.RNG, 10))
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+func (UUIDv7) Valid(id string) bool {
+	if len(id) != 36 || id[8] != '-' || id[13] != '-' || id[18] != '-' || id[23] != '-' {
+		return false
+	}
+	if id[14] != '7' || strings.IndexByte("89ab", id[19]) < 0 {
+		return false
+	}
+	h := id[0:8] + id[9:13] + id[14:18] + id[19:23] + id[24:36]
+	if strings.ToLower(h) != h {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
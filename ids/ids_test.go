@@ -0,0 +1,58 @@
+package ids
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/clock"
+)
+
+func TestGenerators(t *testing.T) {
+	for _, scheme := range []string{ObjectIDScheme, ULIDScheme, UUIDv7Scheme} {
+		g, err := Parse(scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := g.New()
+		time.Sleep(2 * time.Millisecond)
+		b := g.New()
+		if !g.Valid(a) || !g.Valid(b) || a == b {
+			t.Errorf("%v: Expected distinct valid IDs, received %v and %v", scheme, a, b)
+		}
+		if scheme != ObjectIDScheme && a >= b {
+			t.Errorf("%v: Expected IDs sorted by creation, received %v then %v", scheme, a, b)
+		}
+		for _, id := range []string{"", "nothex", a[1:], a + "0"} {
+			if g.Valid(id) {
+				t.Errorf("%v: Expected %q refused", scheme, id)
+			}
+		}
+	}
+	if _, err := Parse("serial"); err == nil {
+		t.Error("Expected an unknown scheme refused")
+	}
+}
+
+func TestSchemesApart(t *testing.T) {
+	if (ULID{}).Valid(UUIDv7{}.New()) || (UUIDv7{}).Valid(ObjectID{}.New()) || (ObjectID{}).Valid(ULID{}.New()) {
+		t.Error("Expected the IDs of one scheme refused by the others")
+	}
+	if !(ObjectID{}).Valid("5a934e000102030405000000") || !(UUIDv7{}).Valid("017f22e2-79b0-7cc3-98c4-dc0c0c07398f") || !(ULID{}).Valid("01ARZ3NDEKTSV4RRFFQ69G5FAV") {
+		t.Error("Expected well known IDs accepted")
+	}
+}
+
+func TestInjectedClockAndRNG(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	zeros := func() clock.RNG { return bytes.NewReader(make([]byte, 10)) }
+	if id := (ULID{Clock: c, RNG: zeros()}).New(); id != "01HK153X000000000000000000" {
+		t.Errorf("Expected the ULID of the fake time and zero bytes, received %v", id)
+	}
+	if id := (UUIDv7{Clock: c, RNG: zeros()}).New(); id != "018cc251-f400-7000-8000-000000000000" {
+		t.Errorf("Expected the UUID of the fake time and zero bytes, received %v", id)
+	}
+	if id := (ObjectID{Clock: c}).New(); id[:8] != "65920080" {
+		t.Errorf("Expected the ObjectID of the fake time, received %v", id)
+	}
+}
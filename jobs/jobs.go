@@ -0,0 +1,279 @@
+package jobs
+
+// jobs.go contains a small background job runner for long-running admin
+// operations. Jobs are persisted through a Store, which doubles as the queue:
+// workers claim queued jobs for a lease they extend as they heartbeat, and
+// jobs whose lease ran out are claimed again, so work survives restarts and
+// is shared between replicas. A worker that lost its lease can no longer
+// save the job, and jobs claimed too many times, such as those crashing
+// their worker, are failed.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Status is the lifecycle state of a job.
+type Status string
+
+const (
+	Queued    Status = "queued"
+	Running   Status = "running"
+	Succeeded Status = "succeeded"
+	Failed    Status = "failed"
+)
+
+var (
+	ErrNoJob       = errors.New("No job available")
+	ErrUnknownKind = errors.New("Unknown job kind")
+	ErrLeaseLost   = errors.New("Job lease lost")
+
+	Finished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jobs_finished_total",
+		Help: "Number of background jobs finished, by kind and status.",
+	}, []string{"kind", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(Finished)
+}
+
+// Progress reports how far along a job is.
+type Progress struct {
+	Done  int `json:"done" bson:"done"`
+	Total int `json:"total" bson:"total"`
+}
+
+// Job is a unit of background work.
+type Job struct {
+	ID        string                 `json:"id" bson:"-"`
+	Kind      string                 `json:"kind" bson:"kind"`
+	Params    json.RawMessage        `json:"params,omitempty" bson:"params,omitempty"`
+	Status    Status                 `json:"status" bson:"status"`
+	Progress  Progress               `json:"progress" bson:"progress"`
+	Result    map[string]interface{} `json:"result,omitempty" bson:"result,omitempty"`
+	Error     string                 `json:"error,omitempty" bson:"error,omitempty"`
+	Owner     string                 `json:"owner,omitempty" bson:"owner,omitempty"`
+	CreatedAt time.Time              `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time              `json:"updatedAt" bson:"updatedAt"`
+	// LeaseUntil is when Owner's claim on a running job runs out.
+	LeaseUntil time.Time `json:"leaseUntil,omitempty" bson:"leaseUntil,omitempty"`
+	// Attempts counts the claims of the job.
+	Attempts int `json:"attempts" bson:"attempts"`
+}
+
+// Store persists jobs.
+type Store interface {
+	// CreateJob saves a new job, assigning its ID.
+	CreateJob(*Job) error
+	GetJob(string) (Job, error)
+	// UpdateJob saves the job's status, progress and result, refreshing
+	// its UpdatedAt heartbeat and extending its LeaseUntil to leaseUntil.
+	// It only saves the job while it is still leased to the job's Owner
+	// until its LeaseUntil, returning ErrLeaseLost otherwise.
+	UpdateJob(j *Job, leaseUntil time.Time) error
+	// ClaimJob atomically marks the oldest queued job, or a running job
+	// whose lease ran out before now, as running for owner until
+	// leaseUntil, counting the attempt. It returns ErrNoJob when there is
+	// nothing to do.
+	ClaimJob(owner string, now, leaseUntil time.Time) (Job, error)
+}
+
+// Handler performs a job. It calls progress as work completes and returns a
+// result to store with the job.
+type Handler func(ctx context.Context, params json.RawMessage, progress func(Progress)) (map[string]interface{}, error)
+
+// Runner executes jobs from a Store.
+type Runner struct {
+	store    Store
+	logger   log.Logger
+	owner    string
+	handlers map[string]Handler
+	wake     chan struct{}
+
+	// Workers is the number of jobs run concurrently.
+	Workers int
+	// Poll is how often idle workers look for new jobs.
+	Poll time.Duration
+	// Lease is how long a running job may go without a heartbeat before
+	// another worker takes it over.
+	Lease time.Duration
+	// MaxAttempts is how many times a job is claimed before it is failed.
+	MaxAttempts int
+	// Clock tells the time leases are taken and extended at.
+	Clock clock.Clock
+}
+
+// NewRunner returns a Runner using store.
+func NewRunner(store Store, logger log.Logger) *Runner {
+	host, _ := os.Hostname()
+	return &Runner{
+		store:    store,
+		logger:   logger,
+		owner:    fmt.Sprintf("%v-%v", host, os.Getpid()),
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, 1),
+		Workers:  2,
+		Poll:     5 * time.Second,
+		Lease:    time.Minute,
+
+		MaxAttempts: 3,
+		Clock:       clock.System{},
+	}
+}
+
+// Register adds the handler for jobs of the given kind. It must be called
+// before Run.
+func (r *Runner) Register(kind string, h Handler) {
+	r.handlers[kind] = h
+}
+
+// Submit queues a new job.
+func (r *Runner) Submit(kind string, params json.RawMessage) (Job, error) {
+	if _, ok := r.handlers[kind]; !ok {
+		return Job{}, ErrUnknownKind
+	}
+	job := Job{Kind: kind, Params: params, Status: Queued}
+	if err := r.store.CreateJob(&job); err != nil {
+		return Job{}, err
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Get returns the job with the given ID.
+func (r *Runner) Get(id string) (Job, error) {
+	return r.store.GetJob(id)
+}
+
+// Run executes jobs until ctx is cancelled. Jobs interrupted by cancellation
+// are left running and picked up again once their lease expires.
+func (r *Runner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < r.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (r *Runner) work(ctx context.Context) {
+	for {
+		// A cancelled runner claims nothing more, so that it does not
+		// take a job it would leave running until its lease expires.
+		if ctx.Err() != nil {
+			return
+		}
+		now := r.Clock.Now()
+		job, err := r.store.ClaimJob(r.owner, now, r.leaseFrom(now))
+		if err == nil {
+			r.execute(ctx, job)
+			continue
+		}
+		if err != ErrNoJob {
+			r.logger.Log("jobs", "claim", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-time.After(r.Poll):
+		}
+	}
+}
+
+// leaseFrom returns when a lease taken or extended at now runs out. It is
+// truncated to the millisecond, which databases such as MongoDB keep
+// times to, so that the store finds the job by it.
+func (r *Runner) leaseFrom(now time.Time) time.Time {
+	return now.Add(r.Lease).Truncate(time.Millisecond)
+}
+
+func (r *Runner) execute(ctx context.Context, job Job) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mtx sync.Mutex
+	save := func(update func(*Job)) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if update != nil {
+			update(&job)
+		}
+		err := r.store.UpdateJob(&job, r.leaseFrom(r.Clock.Now()))
+		if err == ErrLeaseLost {
+			// Another worker took the job over; stop working on it.
+			cancel()
+		}
+		if err != nil {
+			r.logger.Log("jobs", "update", "id", job.ID, "err", err)
+		}
+	}
+
+	h, ok := r.handlers[job.Kind]
+	if !ok {
+		save(func(j *Job) {
+			j.Status = Failed
+			j.Error = ErrUnknownKind.Error()
+		})
+		Finished.WithLabelValues(job.Kind, string(Failed)).Inc()
+		return
+	}
+	if r.MaxAttempts > 0 && job.Attempts > r.MaxAttempts {
+		save(func(j *Job) {
+			j.Status = Failed
+			j.Error = fmt.Sprintf("Gave up after %v attempts", r.MaxAttempts)
+		})
+		Finished.WithLabelValues(job.Kind, string(Failed)).Inc()
+		r.logger.Log("jobs", "abandoned", "id", job.ID, "kind", job.Kind, "attempts", r.MaxAttempts)
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(r.Lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				save(nil)
+			}
+		}
+	}()
+
+	result, err := h(ctx, job.Params, func(p Progress) {
+		save(func(j *Job) { j.Progress = p })
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	status, msg := Succeeded, ""
+	if err != nil {
+		status, msg = Failed, err.Error()
+	}
+	save(func(j *Job) {
+		j.Result = result
+		j.Status = status
+		j.Error = msg
+	})
+	Finished.WithLabelValues(job.Kind, string(status)).Inc()
+	r.logger.Log("jobs", "finished", "id", job.ID, "kind", job.Kind, "status", status)
+}
@@ -0,0 +1,222 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+type memStore struct {
+	mtx  sync.Mutex
+	jobs []*Job
+}
+
+func (m *memStore) CreateJob(j *Job) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	j.ID = fmt.Sprint(len(m.jobs))
+	j.CreatedAt = time.Now()
+	j.UpdatedAt = j.CreatedAt
+	c := *j
+	m.jobs = append(m.jobs, &c)
+	return nil
+}
+
+func (m *memStore) GetJob(id string) (Job, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, j := range m.jobs {
+		if j.ID == id {
+			return *j, nil
+		}
+	}
+	return Job{}, errors.New("not found")
+}
+
+func (m *memStore) UpdateJob(j *Job, leaseUntil time.Time) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for k, stored := range m.jobs {
+		if stored.ID == j.ID {
+			if stored.Owner != j.Owner || !stored.LeaseUntil.Equal(j.LeaseUntil) {
+				return ErrLeaseLost
+			}
+			j.LeaseUntil = leaseUntil
+			c := *j
+			c.UpdatedAt = time.Now()
+			m.jobs[k] = &c
+		}
+	}
+	return nil
+}
+
+func (m *memStore) ClaimJob(owner string, now, leaseUntil time.Time) (Job, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, j := range m.jobs {
+		if j.Status == Queued || (j.Status == Running && j.LeaseUntil.Before(now)) {
+			j.Status = Running
+			j.Owner = owner
+			j.LeaseUntil = leaseUntil
+			j.Attempts++
+			j.UpdatedAt = time.Now()
+			return *j, nil
+		}
+	}
+	return Job{}, ErrNoJob
+}
+
+func waitFor(t *testing.T, r *Runner, id string, status Status) Job {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		j, err := r.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Status == status {
+			return j
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Job %v did not reach status %v", id, status)
+	return Job{}
+}
+
+func TestRunnerExecutes(t *testing.T) {
+	r := NewRunner(&memStore{}, log.NewNopLogger())
+	r.Register("count", func(ctx context.Context, params json.RawMessage, progress func(Progress)) (map[string]interface{}, error) {
+		var n int
+		json.Unmarshal(params, &n)
+		for i := 1; i <= n; i++ {
+			progress(Progress{Done: i, Total: n})
+		}
+		return map[string]interface{}{"counted": n}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	job, err := r.Submit("count", json.RawMessage("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := waitFor(t, r, job.ID, Succeeded)
+	if j.Progress.Done != 3 || j.Result["counted"] != 3 {
+		t.Errorf("Expected finished progress and result, received %+v", j)
+	}
+}
+
+func TestRunnerFailure(t *testing.T) {
+	r := NewRunner(&memStore{}, log.NewNopLogger())
+	r.Register("fail", func(ctx context.Context, params json.RawMessage, progress func(Progress)) (map[string]interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	job, _ := r.Submit("fail", nil)
+	j := waitFor(t, r, job.ID, Failed)
+	if j.Error != "boom" {
+		t.Errorf("Expected error to be recorded, received %v", j.Error)
+	}
+}
+
+func TestRunnerUnknownKind(t *testing.T) {
+	r := NewRunner(&memStore{}, log.NewNopLogger())
+	if _, err := r.Submit("nope", nil); err != ErrUnknownKind {
+		t.Error("Expected unknown kind error")
+	}
+}
+
+func TestRunnerResumesStaleJobs(t *testing.T) {
+	store := &memStore{}
+	store.CreateJob(&Job{Kind: "noop", Status: Running, Owner: "crashed"})
+	store.jobs[0].LeaseUntil = time.Now().Add(-time.Hour)
+
+	r := NewRunner(store, log.NewNopLogger())
+	r.Poll = 10 * time.Millisecond
+	r.Register("noop", func(ctx context.Context, params json.RawMessage, progress func(Progress)) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	j := waitFor(t, r, "0", Succeeded)
+	if j.Owner == "crashed" {
+		t.Error("Expected stale job to be claimed by the new runner")
+	}
+}
+
+func TestRunnerGivesUp(t *testing.T) {
+	store := &memStore{}
+	store.CreateJob(&Job{Kind: "noop", Status: Running, Owner: "crashed", Attempts: 3})
+
+	r := NewRunner(store, log.NewNopLogger())
+	r.Poll = 10 * time.Millisecond
+	ran := false
+	r.Register("noop", func(ctx context.Context, params json.RawMessage, progress func(Progress)) (map[string]interface{}, error) {
+		ran = true
+		return nil, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	j := waitFor(t, r, "0", Failed)
+	if ran || j.Attempts != 4 {
+		t.Errorf("Expected a job claimed a fourth time failed without running, received %+v", j)
+	}
+}
+
+func TestRunnerStopsOnLostLease(t *testing.T) {
+	store := &memStore{}
+	r := NewRunner(store, log.NewNopLogger())
+	r.Lease = 30 * time.Millisecond
+	stopped := make(chan struct{})
+	r.Register("wait", func(ctx context.Context, params json.RawMessage, progress func(Progress)) (map[string]interface{}, error) {
+		// Another worker takes the job over.
+		store.mtx.Lock()
+		store.jobs[0].Owner = "other"
+		store.mtx.Unlock()
+		<-ctx.Done()
+		close(stopped)
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	r.Submit("wait", nil)
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a worker that lost its lease to stop")
+	}
+	if j, _ := r.Get("0"); j.Status != Running || j.Owner != "other" {
+		t.Errorf("Expected the job left to its new owner, received %+v", j)
+	}
+}
+
+func TestRunnerCancelledClaimsNothing(t *testing.T) {
+	store := &memStore{}
+	r := NewRunner(store, log.NewNopLogger())
+	r.Register("noop", func(ctx context.Context, params json.RawMessage, progress func(Progress)) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	job, _ := r.Submit("noop", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.Run(ctx)
+
+	if j, _ := r.Get(job.ID); j.Status != Queued || j.Attempts != 0 {
+		t.Errorf("Expected the job left queued, received %+v", j)
+	}
+}
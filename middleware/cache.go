@@ -0,0 +1,265 @@
+package middleware
+
+// cache.go contains a middleware letting clients cache the responses of hot
+// GET routes, such as the customer profiles the front end fetches on every
+// page, and optionally caching them in process. Responses carry an ETag,
+// so that clients revalidating an unchanged response are answered 304.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of looking up a response in the Cache.
+const (
+	CacheHit         = "hit"
+	CacheMiss        = "miss"
+	CacheNotModified = "not_modified"
+)
+
+var ResponseCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_response_cache_total",
+	Help: "Number of cacheable requests, by whether they were served from the cache, read, or answered 304.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(ResponseCache)
+}
+
+// ParseRouteMaxAges parses route=duration pairs, such as "customers_id=30s".
+// Routes are named as in HTTP metrics.
+func ParseRouteMaxAges(ss []string) (map[string]time.Duration, error) {
+	ages := make(map[string]time.Duration)
+	for _, pair := range ss {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		route, d, ok := strings.Cut(pair, "=")
+		age, err := time.ParseDuration(strings.TrimSpace(d))
+		if !ok || err != nil || age < time.Second {
+			return nil, fmt.Errorf("invalid route max age %q", pair)
+		}
+		ages[strings.TrimSpace(route)] = age
+	}
+	return ages, nil
+}
+
+type cachedResponse struct {
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// Cache sets Cache-Control and ETag headers on the successful GET responses
+// of the routes given a max age, answering matching If-None-Match requests
+// with 304. Given a positive size, up to size responses are also kept for
+// their max age and served without reaching the handler. Responses are
+// cached per caller, and any mutating request clears the cache, so replicas
+// may only serve responses up to a max age old.
+type Cache struct {
+	routes  *Routes
+	maxAges map[string]time.Duration
+	size    int
+
+	mtx        sync.Mutex
+	entries    map[string]cachedResponse
+	generation uint64
+}
+
+// NewCache returns a Cache naming requests with routes.
+func NewCache(routes *Routes, maxAges map[string]time.Duration, size int) *Cache {
+	return &Cache{routes: routes, maxAges: maxAges, size: size, entries: make(map[string]cachedResponse)}
+}
+
+// maxAge returns the max age of responses to r, or zero if they are not
+// cacheable.
+func (c *Cache) maxAge(r *http.Request) time.Duration {
+	if r.Method != "GET" {
+		return 0
+	}
+	var match mux.RouteMatch
+	if !c.routes.Match(r, &match) {
+		return 0
+	}
+	return c.maxAges[match.Route.GetName()]
+}
+
+// cacheKey identifies a response. Responses depend on the caller, as
+// admins see more, so the credentials are part of the key.
+func cacheKey(r *http.Request) string {
+	return r.URL.RequestURI() + "\x00" + r.Header.Get("Authorization")
+}
+
+func (c *Cache) get(key string, now time.Time) (cachedResponse, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[key]
+	if !ok || now.After(e.expires) {
+		return cachedResponse{}, false
+	}
+	return e, true
+}
+
+// put stores e unless the cache was cleared since generation, when e may
+// predate a write.
+func (c *Cache) put(key string, e cachedResponse, generation uint64, now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= c.size {
+		for k, old := range c.entries {
+			if now.After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			return
+		}
+	}
+	c.entries[key] = e
+}
+
+// Clear drops every cached response.
+func (c *Cache) Clear() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generation++
+	clear(c.entries)
+}
+
+func (c *Cache) currentGeneration() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.generation
+}
+
+// Wrap implements middleware.Interface.
+func (c *Cache) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Mutating(r) {
+			if c.size > 0 {
+				defer c.Clear()
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		maxAge := c.maxAge(r)
+		if maxAge == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		k := cacheKey(r)
+		if c.size > 0 {
+			if e, ok := c.get(k, now); ok {
+				c.serve(w, r, e, CacheHit)
+				return
+			}
+		}
+		generation := c.currentGeneration()
+		rec := &recorder{header: make(http.Header), code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.code != http.StatusOK {
+			copyHeader(w.Header(), rec.header)
+			w.WriteHeader(rec.code)
+			w.Write(rec.body.Bytes())
+			return
+		}
+		sum := sha256.Sum256(rec.body.Bytes())
+		rec.header.Set("Cache-Control", "private, max-age="+strconv.Itoa(int(maxAge/time.Second)))
+		e := cachedResponse{
+			header:  rec.header,
+			body:    rec.body.Bytes(),
+			etag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+			expires: now.Add(maxAge),
+		}
+		if c.size > 0 {
+			c.put(k, e, generation, now)
+		}
+		c.serve(w, r, e, CacheMiss)
+	})
+}
+
+// serve writes e, or 304 if the client has it.
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e cachedResponse, result string) {
+	copyHeader(w.Header(), e.header)
+	w.Header().Set("ETag", e.etag)
+	if notModified(r, e) {
+		ResponseCache.WithLabelValues(CacheNotModified).Inc()
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	ResponseCache.WithLabelValues(result).Inc()
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+// notModified reports whether the client has e, by its ETag or, without
+// If-None-Match, by the Last-Modified date of the response.
+func notModified(r *http.Request, e cachedResponse) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, e.etag)
+	}
+	modified, err := http.ParseTime(e.header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.After(since)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(header, etag string) bool {
+	for _, m := range strings.Split(header, ",") {
+		m = strings.TrimPrefix(strings.TrimSpace(m), "W/")
+		if m == etag || m == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vs := range src {
+		dst[k] = append([]string(nil), vs...)
+	}
+}
+
+// recorder holds a response back, so that its ETag can be sent first.
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if !rec.wrote {
+		rec.code, rec.wrote = code, true
+	}
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wrote = true
+	return rec.body.Write(b)
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseRouteMaxAges(t *testing.T) {
+	ages, err := ParseRouteMaxAges([]string{"customers_id=30s", " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ages) != 1 || ages["customers_id"] != 30*time.Second {
+		t.Errorf("Expected the max age, received %v", ages)
+	}
+	for _, s := range []string{"customers_id", "customers_id=10ms", "customers_id=soon"} {
+		if _, err := ParseRouteMaxAges([]string{s}); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+// counting serves the number of GETs it has served.
+type counting struct {
+	gets int
+}
+
+func (h *counting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		h.gets++
+		w.Header().Set("Content-Type", "application/hal+json")
+		io.WriteString(w, `{"gets":`+string(rune('0'+h.gets))+`}`)
+	}
+}
+
+func cacheRouter() *Routes {
+	router := mux.NewRouter()
+	router.Path("/customers/{id}")
+	router.Path("/customers")
+	return NewRoutes(router, false)
+}
+
+func get(h http.Handler, path, auth, etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Authorization", auth)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCacheHeaders(t *testing.T) {
+	next := &counting{}
+	h := NewCache(cacheRouter(), map[string]time.Duration{"customers_id": 30 * time.Second}, 0).Wrap(next)
+
+	rec := get(h, "/customers/1", "", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "private, max-age=30" || etag == "" {
+		t.Fatalf("Expected a cacheable response, received %v %v", rec.Code, rec.Header())
+	}
+	if rec = get(h, "/customers/1", "", etag); rec.Code != http.StatusOK {
+		t.Errorf("Expected a changed response served, received %v", rec.Code)
+	}
+	etag = rec.Header().Get("ETag")
+	next.gets--
+	if rec = get(h, "/customers/1", "", etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected an unchanged response answered 304, received %v", rec.Code)
+	}
+	if rec = get(h, "/customers", "", ""); rec.Header().Get("Cache-Control") != "" || rec.Header().Get("ETag") != "" {
+		t.Errorf("Expected other routes left alone, received %v", rec.Header())
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	next := &counting{}
+	c := NewCache(cacheRouter(), map[string]time.Duration{"customers_id": 30 * time.Second}, 10)
+	h := c.Wrap(next)
+
+	first := get(h, "/customers/1", "Basic eve", "")
+	if rec := get(h, "/customers/1", "Basic eve", ""); rec.Body.String() != first.Body.String() || next.gets != 1 {
+		t.Errorf("Expected the response served from the cache, received %q after %v reads", rec.Body, next.gets)
+	}
+	if get(h, "/customers/1", "Basic bob", ""); next.gets != 2 {
+		t.Errorf("Expected responses cached per caller, received %v reads", next.gets)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/addresses/1", nil))
+	if get(h, "/customers/1", "Basic eve", ""); next.gets != 3 {
+		t.Errorf("Expected writes to clear the cache, received %v reads", next.gets)
+	}
+}
+
+func TestCacheLastModified(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		io.WriteString(w, "{}")
+	})
+	h := NewCache(cacheRouter(), map[string]time.Duration{"customers_id": 30 * time.Second}, 10).Wrap(next)
+	get(h, "/customers/1", "", "")
+
+	for since, code := range map[time.Time]int{modified: http.StatusNotModified, modified.Add(-time.Second): http.StatusOK} {
+		r := httptest.NewRequest("GET", "/customers/1", nil)
+		r.Header.Set("If-Modified-Since", since.Format(http.TimeFormat))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != code {
+			t.Errorf("Expected %v for a copy from %v, received %v", code, since, rec.Code)
+		}
+	}
+}
+
+func TestCachePutAfterClear(t *testing.T) {
+	c := NewCache(cacheRouter(), nil, 10)
+	now := time.Now()
+	generation := c.currentGeneration()
+	c.Clear()
+	c.put("k", cachedResponse{expires: now.Add(time.Minute)}, generation, now)
+	if _, ok := c.get("k", now); ok {
+		t.Error("Expected a response read before a write not to be cached")
+	}
+}
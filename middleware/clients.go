@@ -0,0 +1,108 @@
+package middleware
+
+// clients.go contains a middleware counting requests by client application
+// and version, to plan the deprecation of old frontends.
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// ClientHeader lets clients identify themselves as name/version, taking
+	// precedence over the User-Agent.
+	ClientHeader = "X-Client"
+	// OtherClient labels clients that are not known, and versions of known
+	// clients beyond MaxClientVersions.
+	OtherClient = "other"
+)
+
+// MaxClientVersions is how many versions of each known client get their
+// own series.
+const MaxClientVersions = 20
+
+var (
+	ClientRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_by_client_total",
+		Help: "Number of requests received, by client name and version.",
+	}, []string{"client", "version"})
+
+	clientToken = regexp.MustCompile(`^([A-Za-z0-9._-]+)(?:/v?(\d+)(?:\.(\d+))?)?`)
+)
+
+func init() {
+	prometheus.MustRegister(ClientRequests)
+}
+
+// ParseClient returns the name and major.minor version of the client that
+// sent r, from the X-Client header or the first User-Agent product. Either
+// is empty when unknown.
+func ParseClient(r *http.Request) (name, version string) {
+	s := r.Header.Get(ClientHeader)
+	if s == "" {
+		s = r.UserAgent()
+	}
+	m := clientToken.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return "", ""
+	}
+	name = strings.ToLower(m[1])
+	if m[2] != "" {
+		version = m[2]
+		if m[3] != "" {
+			version += "." + m[3]
+		}
+	}
+	return name, version
+}
+
+// Clients counts requests by client. Only the known clients get their own
+// series, so that clients naming themselves cannot crowd them out; others
+// are counted as OtherClient. Each known client gets a series for its first
+// MaxClientVersions versions, and later ones share a version of
+// OtherClient.
+type Clients struct {
+	mtx      sync.Mutex
+	versions map[string]map[string]bool
+}
+
+// NewClients returns a Clients tracking the named clients, compared as
+// ParseClient returns them, in lower case.
+func NewClients(known []string) *Clients {
+	c := &Clients{versions: make(map[string]map[string]bool)}
+	for _, name := range known {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			c.versions[name] = make(map[string]bool)
+		}
+	}
+	return c
+}
+
+// Labels returns the bounded metric labels for a client.
+func (c *Clients) Labels(name, version string) (string, string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	seen, ok := c.versions[name]
+	if !ok {
+		return OtherClient, ""
+	}
+	if !seen[version] {
+		if len(seen) >= MaxClientVersions {
+			return name, OtherClient
+		}
+		seen[version] = true
+	}
+	return name, version
+}
+
+// Wrap implements middleware.Interface.
+func (c *Clients) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ClientRequests.WithLabelValues(c.Labels(ParseClient(r))).Inc()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseClient(t *testing.T) {
+	cases := []struct {
+		header, ua    string
+		name, version string
+	}{
+		{"front-end/1.4.2", "Mozilla/5.0", "front-end", "1.4"},
+		{"", "curl/8.5.0", "curl", "8.5"},
+		{"", "Go-http-client/1.1", "go-http-client", "1.1"},
+		{"", "dredd", "dredd", ""},
+		{"", "", "", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", c.ua)
+		if c.header != "" {
+			r.Header.Set(ClientHeader, c.header)
+		}
+		name, version := ParseClient(r)
+		if name != c.name || version != c.version {
+			t.Errorf("Expected %v %v, received %v %v", c.name, c.version, name, version)
+		}
+	}
+}
+
+func TestClientsKnown(t *testing.T) {
+	c := NewClients([]string{"Front-End", ""})
+	if n, v := c.Labels("front-end", "1.4"); n != "front-end" || v != "1.4" {
+		t.Errorf("Expected known client to be tracked, received %v %v", n, v)
+	}
+	if n, v := c.Labels("curl", "8.5"); n != OtherClient || v != "" {
+		t.Errorf("Expected unknown client to be grouped, received %v %v", n, v)
+	}
+	if n, _ := c.Labels("", ""); n != OtherClient {
+		t.Error("Expected unnamed client to be grouped")
+	}
+}
+
+func TestClientVersionsLimit(t *testing.T) {
+	c := NewClients([]string{"front-end"})
+	for k := 0; k < MaxClientVersions; k++ {
+		c.Labels("front-end", strconv.Itoa(k))
+	}
+	if _, v := c.Labels("front-end", "99"); v != OtherClient {
+		t.Errorf("Expected versions beyond the limit to be grouped, received %v", v)
+	}
+	if _, v := c.Labels("front-end", "0"); v != "0" {
+		t.Errorf("Expected tracked version to keep its label, received %v", v)
+	}
+}
@@ -0,0 +1,124 @@
+package middleware
+
+// compress.go contains a middleware gzipping responses for clients accepting
+// it. Customer lists and exports are large and compress well; images and
+// other already compressed bodies are passed through as they are.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// gzipWriters reuses gzip writers, whose compression state is large, across
+// responses.
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// Compress gzips the responses of requests accepting gzip, when their
+// content type is text or JSON.
+type Compress struct{}
+
+// Wrap implements middleware.Interface.
+func (Compress) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, q, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(enc) == "gzip" && strings.TrimSpace(q) != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether responses of content type ct are worth
+// compressing.
+func compressible(ct string) bool {
+	ct, _, _ = strings.Cut(ct, ";")
+	return strings.HasPrefix(ct, "text/") || strings.HasSuffix(ct, "json")
+}
+
+// compressWriter decides whether to compress once the headers are written,
+// taking a gzip writer from the pool if it does.
+type compressWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	h := cw.Header()
+	if code != http.StatusNoContent && code != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		cw.gz = gzipWriters.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.gz == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.gz.Write(b)
+}
+
+// Flush sends what has been compressed so far, for streamed responses.
+func (cw *compressWriter) Flush() {
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Close finishes the gzip stream and returns the writer to the pool.
+func (cw *compressWriter) Close() error {
+	if cw.gz == nil {
+		return nil
+	}
+	err := cw.gz.Close()
+	cw.gz.Reset(io.Discard)
+	gzipWriters.Put(cw.gz)
+	cw.gz = nil
+	return err
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var listBody = `{"_embedded":{"customer":[` + strings.Repeat(`{"firstName":"Eve","lastName":"Doe","username":"eve"},`, 200) + `{}]}}`
+
+func jsonHandler(ct string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ct)
+		io.WriteString(w, listBody)
+	})
+}
+
+func TestCompress(t *testing.T) {
+	r := httptest.NewRequest("GET", "/customers", nil)
+	r.Header.Set("Accept-Encoding", "br, gzip")
+	rec := httptest.NewRecorder()
+	Compress{}.Wrap(jsonHandler("application/hal+json")).ServeHTTP(rec, r)
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Expected a gzipped response, received %v", rec.Header())
+	}
+	if rec.Body.Len() >= len(listBody) {
+		t.Errorf("Expected the body compressed, received %v bytes", rec.Body.Len())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(gz); string(b) != listBody {
+		t.Errorf("Expected the body once decompressed, received %q", b)
+	}
+}
+
+func TestCompressSkipped(t *testing.T) {
+	cases := []struct {
+		name, accept, ct string
+	}{
+		{"not accepted", "", "application/hal+json"},
+		{"refused", "gzip;q=0", "application/hal+json"},
+		{"image", "gzip", "image/png"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/customers", nil)
+		r.Header.Set("Accept-Encoding", c.accept)
+		rec := httptest.NewRecorder()
+		Compress{}.Wrap(jsonHandler(c.ct)).ServeHTTP(rec, r)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != listBody {
+			t.Errorf("%v: expected the body as it is, received %v", c.name, rec.Header())
+		}
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	h := Compress{}.Wrap(jsonHandler("application/hal+json"))
+	r := httptest.NewRequest("GET", "/customers", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
@@ -0,0 +1,144 @@
+package middleware
+
+// concurrency.go contains a middleware bounding the requests served at once,
+// in total and per route, so that a burst of expensive requests such as full
+// customer listings cannot take every database connection and starve logins.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GlobalLimit names the service-wide limit in RequestsThrottled.
+const GlobalLimit = "global"
+
+var RequestsThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_requests_throttled_total",
+	Help: "Number of requests refused for exceeding a concurrency limit, by the route limited or global.",
+}, []string{"limit"})
+
+func init() {
+	prometheus.MustRegister(RequestsThrottled)
+}
+
+// ParseRouteLimits parses route=limit pairs, such as "customers=20". Routes
+// are named as in HTTP metrics.
+func ParseRouteLimits(ss []string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range ss {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		route, n, ok := strings.Cut(pair, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if !ok || err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid route limit %q", pair)
+		}
+		limits[strings.TrimSpace(route)] = limit
+	}
+	return limits, nil
+}
+
+// Limiter refuses requests with 503 once more than its limits are being
+// served: Global requests in total, and the per-route limit for requests to
+// a limited route. Requests wait up to Wait for a slot first.
+type Limiter struct {
+	Wait time.Duration
+
+	routes *Routes
+	global chan struct{}
+	route  map[string]chan struct{}
+}
+
+// NewLimiter returns a Limiter naming requests with routes. A global limit
+// of zero only enforces the per-route limits.
+func NewLimiter(routes *Routes, global int, perRoute map[string]int, wait time.Duration) *Limiter {
+	l := &Limiter{Wait: wait, routes: routes, route: make(map[string]chan struct{}, len(perRoute))}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	for name, n := range perRoute {
+		l.route[name] = make(chan struct{}, n)
+	}
+	return l
+}
+
+// routeName returns the name of the route r is for, or "" if it has none.
+func (l *Limiter) routeName(r *http.Request) string {
+	var match mux.RouteMatch
+	if !l.routes.Match(r, &match) {
+		return ""
+	}
+	return match.Route.GetName()
+}
+
+// acquire takes a slot under each limit applying to route, waiting up to
+// Wait in all. If it cannot, it returns the limit that was full.
+func (l *Limiter) acquire(ctx context.Context, route string) (release func(), full string) {
+	var held []chan struct{}
+	release = func() {
+		for _, sem := range held {
+			<-sem
+		}
+	}
+	var timeout <-chan time.Time
+	for _, limit := range []string{route, GlobalLimit} {
+		sem := l.global
+		if limit != GlobalLimit {
+			sem = l.route[limit]
+		}
+		if sem == nil {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+			held = append(held, sem)
+			continue
+		default:
+		}
+		if timeout == nil {
+			t := time.NewTimer(l.Wait)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case sem <- struct{}{}:
+			held = append(held, sem)
+		case <-timeout:
+			release()
+			return nil, limit
+		case <-ctx.Done():
+			release()
+			return nil, limit
+		}
+	}
+	return release, ""
+}
+
+// Wrap implements middleware.Interface.
+func (l *Limiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if len(l.route) > 0 {
+			route = l.routeName(r)
+		}
+		release, full := l.acquire(r.Context(), route)
+		if full != "" {
+			RequestsThrottled.WithLabelValues(full).Inc()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, users.CodeOverloaded, "Too many concurrent requests, try again later")
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseRouteLimits(t *testing.T) {
+	limits, err := ParseRouteLimits([]string{" customers=20", " login=100", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["customers"] != 20 || limits["login"] != 100 {
+		t.Errorf("Expected both limits, received %v", limits)
+	}
+	for _, s := range []string{"customers", "customers=0", "customers=x"} {
+		if _, err := ParseRouteLimits([]string{s}); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+// blocking serves requests once release is closed, signalling started as
+// each begins.
+func blocking() (h http.Handler, started chan struct{}, release chan struct{}) {
+	started, release = make(chan struct{}, 10), make(chan struct{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), started, release
+}
+
+func limited(l *Limiter, h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	l.Wrap(h).ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestLimiter(t *testing.T) {
+	router := mux.NewRouter()
+	router.Path("/customers")
+	router.Path("/login")
+	l := NewLimiter(NewRoutes(router, false), 2, map[string]int{"customers": 1}, 10*time.Millisecond)
+	h, started, release := blocking()
+
+	done := make(chan int)
+	go func() { done <- limited(l, h, "/customers").Code }()
+	<-started
+	if rec := limited(l, h, "/customers"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the route limit enforced, received %v", rec.Code)
+	}
+	go func() { done <- limited(l, h, "/login").Code }()
+	<-started
+	if rec := limited(l, h, "/login"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the global limit enforced, received %v", rec.Code)
+	}
+	close(release)
+	for k := 0; k < 2; k++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Expected the requests within limits served, received %v", code)
+		}
+	}
+	if rec := limited(l, h, "/customers"); rec.Code != http.StatusOK {
+		t.Errorf("Expected slots released, received %v", rec.Code)
+	}
+}
+
+func TestLimiterWaits(t *testing.T) {
+	l := NewLimiter(NewRoutes(mux.NewRouter(), false), 1, nil, time.Second)
+	h, started, release := blocking()
+	done := make(chan int)
+	go func() { done <- limited(l, h, "/customers").Code }()
+	<-started
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	if rec := limited(l, h, "/customers"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the request to wait for a slot, received %v", rec.Code)
+	}
+	<-done
+}
@@ -0,0 +1,170 @@
+package middleware
+
+// faults.go contains a fault-injection middleware used to rehearse chaos
+// experiments. Rules are managed at runtime through the admin handler.
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ErrInvalidFaultRule = errors.New("Invalid fault rule")
+
+	FaultsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "faults_injected_total",
+		Help: "Number of synthetic faults injected into requests.",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(FaultsInjected)
+}
+
+// FaultRule describes the latency and errors to inject into requests whose
+// method and path match. An empty Method or PathPrefix matches everything.
+type FaultRule struct {
+	Method     string  `json:"method,omitempty"`
+	PathPrefix string  `json:"path,omitempty"`
+	LatencyMs  int     `json:"latency_ms,omitempty"`
+	ErrorRate  float64 `json:"error_rate,omitempty"`
+	StatusCode int     `json:"status_code,omitempty"`
+}
+
+func (fr FaultRule) validate() error {
+	if fr.LatencyMs < 0 || fr.ErrorRate < 0 || fr.ErrorRate > 1 {
+		return ErrInvalidFaultRule
+	}
+	if fr.StatusCode != 0 && (fr.StatusCode < 400 || fr.StatusCode > 599) {
+		return ErrInvalidFaultRule
+	}
+	return nil
+}
+
+func (fr FaultRule) matches(r *http.Request) bool {
+	if fr.Method != "" && !strings.EqualFold(fr.Method, r.Method) {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, fr.PathPrefix)
+}
+
+// Faults injects synthetic latency and errors into matching requests. Admin
+// routes are never affected so that faults can always be switched off again.
+type Faults struct {
+	mtx   sync.RWMutex
+	rules []FaultRule
+	rand  func() float64
+}
+
+// NewFaults returns a Faults middleware with no active rules.
+func NewFaults() *Faults {
+	return &Faults{rules: make([]FaultRule, 0), rand: rand.Float64}
+}
+
+// Rules returns the currently active rules.
+func (f *Faults) Rules() []FaultRule {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	return append(make([]FaultRule, 0, len(f.rules)), f.rules...)
+}
+
+// SetRules replaces the active rules. An empty slice disables injection.
+func (f *Faults) SetRules(rules []FaultRule) error {
+	for _, fr := range rules {
+		if err := fr.validate(); err != nil {
+			return err
+		}
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.rules = append(make([]FaultRule, 0, len(rules)), rules...)
+	return nil
+}
+
+func (f *Faults) match(r *http.Request) (FaultRule, bool) {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	for _, fr := range f.rules {
+		if fr.matches(r) {
+			return fr, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// Wrap implements middleware.Interface.
+func (f *Faults) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fr, ok := f.match(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if fr.LatencyMs > 0 {
+			FaultsInjected.WithLabelValues("latency").Inc()
+			select {
+			case <-time.After(time.Duration(fr.LatencyMs) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fr.ErrorRate > 0 && f.rand() < fr.ErrorRate {
+			FaultsInjected.WithLabelValues("error").Inc()
+			code := fr.StatusCode
+			if code == 0 {
+				code = http.StatusInternalServerError
+			}
+			writeError(w, code, users.CodeInternal, "Injected fault")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP is the admin handler: GET returns the active rules and PUT
+// replaces them with the JSON array in the request body.
+func (f *Faults) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		defer r.Body.Close()
+		rules := make([]FaultRule, 0)
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			writeError(w, http.StatusBadRequest, users.CodeInvalidRequest, err.Error())
+			return
+		}
+		if err := f.SetRules(rules); err != nil {
+			writeError(w, http.StatusBadRequest, users.CodeInvalidRequest, err.Error())
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, users.CodeInvalidRequest, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	w.Header().Set("Content-Type", "application/hal+json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": f.Rules()})
+}
+
+// writeError mirrors the error body produced by the api transport.
+func writeError(w http.ResponseWriter, code int, errCode, msg string) {
+	w.Header().Set("Content-Type", "application/hal+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       msg,
+		"code":        errCode,
+		"status_code": code,
+		"status_text": http.StatusText(code),
+	})
+}
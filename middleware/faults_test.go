@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestFaultsNoRules(t *testing.T) {
+	f := NewFaults()
+	rec := httptest.NewRecorder()
+	f.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/customers", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected %v received %v", http.StatusOK, rec.Code)
+	}
+}
+
+func TestFaultsInjectError(t *testing.T) {
+	f := NewFaults()
+	f.rand = func() float64 { return 0.5 }
+	err := f.SetRules([]FaultRule{{PathPrefix: "/customers", ErrorRate: 0.6, StatusCode: 503}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	f.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/customers/1", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %v received %v", http.StatusServiceUnavailable, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	f.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/cards", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("Expected unmatched route to pass through")
+	}
+	rec = httptest.NewRecorder()
+	f.rand = func() float64 { return 0.7 }
+	f.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/customers/1", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("Expected request above error rate to pass through")
+	}
+}
+
+func TestFaultsSkipAdmin(t *testing.T) {
+	f := NewFaults()
+	f.SetRules([]FaultRule{{ErrorRate: 1}})
+	rec := httptest.NewRecorder()
+	f.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/faults", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("Expected admin routes to be exempt from faults")
+	}
+}
+
+func TestFaultsInvalidRule(t *testing.T) {
+	f := NewFaults()
+	if err := f.SetRules([]FaultRule{{ErrorRate: 2}}); err != ErrInvalidFaultRule {
+		t.Error("Expected invalid rule error for error rate above one")
+	}
+	if err := f.SetRules([]FaultRule{{StatusCode: 200}}); err != ErrInvalidFaultRule {
+		t.Error("Expected invalid rule error for non-error status code")
+	}
+}
+
+func TestFaultsAdminHandler(t *testing.T) {
+	f := NewFaults()
+	body := `[{"method":"GET","path":"/cards","latency_ms":10}]`
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/faults", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %v received %v", http.StatusOK, rec.Code)
+	}
+	rules := f.Rules()
+	if len(rules) != 1 || rules[0].LatencyMs != 10 {
+		t.Errorf("Expected one rule with 10ms latency, received %v", rules)
+	}
+	rec = httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/faults", strings.NewReader("nope")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v received %v", http.StatusBadRequest, rec.Code)
+	}
+}
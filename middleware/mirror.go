@@ -0,0 +1,112 @@
+package middleware
+
+// mirror.go contains a middleware duplicating a share of read requests to a
+// canary instance, so that a new version can be validated under real load
+// without serving any client.
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MirrorHeader marks mirrored requests, so the canary can tell them apart.
+const MirrorHeader = "X-Mirrored"
+
+// Results of mirrored requests.
+const (
+	MirrorSent    = "sent"
+	MirrorFailed  = "failed"
+	MirrorDropped = "dropped"
+)
+
+var MirroredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_requests_mirrored_total",
+	Help: "Number of requests duplicated to the canary, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(MirroredRequests)
+}
+
+// ReadRequest reports whether r only reads. Admin requests are not counted,
+// as they include exports and other requests too heavy to duplicate.
+func ReadRequest(r *http.Request) bool {
+	return (r.Method == "GET" || r.Method == "HEAD") && !strings.HasPrefix(r.URL.Path, "/admin")
+}
+
+// Mirror sends a copy of Percent percent of the selected requests to a
+// canary in the background. Canary responses are discarded, and copies
+// beyond the in-flight limit are dropped rather than slowing the service.
+type Mirror struct {
+	Target  *url.URL
+	Percent int
+	// Mirrored selects the requests that may be copied.
+	Mirrored func(*http.Request) bool
+	Client   *http.Client
+
+	inflight chan struct{}
+}
+
+// NewMirror returns a Mirror copying read requests to the canary at target,
+// with at most maxInflight copies outstanding.
+func NewMirror(target string, percent, maxInflight int) (*Mirror, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		Target:   u,
+		Percent:  percent,
+		Mirrored: ReadRequest,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		inflight: make(chan struct{}, maxInflight),
+	}, nil
+}
+
+// Wrap implements middleware.Interface.
+func (m *Mirror) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Mirrored(r) && rand.IntN(100) < m.Percent {
+			m.send(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// send copies r to the canary unless too many copies are outstanding. The
+// copy does not share r's context, so it outlives the original request.
+func (m *Mirror) send(r *http.Request) {
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		MirroredRequests.WithLabelValues(MirrorDropped).Inc()
+		return
+	}
+	u := *m.Target
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(context.Background(), r.Method, u.String(), nil)
+	if err != nil {
+		<-m.inflight
+		MirroredRequests.WithLabelValues(MirrorFailed).Inc()
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(MirrorHeader, "true")
+	go func() {
+		defer func() { <-m.inflight }()
+		res, err := m.Client.Do(req)
+		if err != nil {
+			MirroredRequests.WithLabelValues(MirrorFailed).Inc()
+			return
+		}
+		res.Body.Close()
+		MirroredRequests.WithLabelValues(MirrorSent).Inc()
+	}()
+}
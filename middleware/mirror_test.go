@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan *http.Request, 10)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r
+	}))
+	defer canary.Close()
+
+	m, err := NewMirror(canary.URL+"/canary", 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*http.Request{
+		httptest.NewRequest("POST", "/customers", nil),
+		httptest.NewRequest("GET", "/admin/export.csv", nil),
+		httptest.NewRequest("GET", "/customers/1?x=y", nil),
+	} {
+		r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		rec := httptest.NewRecorder()
+		m.Wrap(okHandler).ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected %v %v to be served, received %v", r.Method, r.URL, rec.Code)
+		}
+	}
+	select {
+	case r := <-mirrored:
+		if r.URL.String() != "/canary/customers/1?x=y" || r.Header.Get(MirrorHeader) != "true" || r.Header.Get("Authorization") == "" {
+			t.Errorf("Expected a copy of the read request, received %v %v", r.URL, r.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected read request to be mirrored")
+	}
+	select {
+	case r := <-mirrored:
+		t.Errorf("Expected only read requests to be mirrored, received %v %v", r.Method, r.URL)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestMirrorPercent(t *testing.T) {
+	m, err := NewMirror("http://canary.invalid", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("Expected nothing mirrored at 0 percent, received %v", r.URL)
+		return nil, http.ErrHandlerTimeout
+	})
+	for i := 0; i < 100; i++ {
+		m.Wrap(okHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/customers", nil))
+	}
+	// Fill the only in-flight slot: further copies are dropped, not queued.
+	m.Percent = 100
+	m.inflight <- struct{}{}
+	m.Wrap(okHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/customers", nil))
+}
@@ -0,0 +1,122 @@
+package middleware
+
+// readonly.go contains a middleware refusing writes during database
+// maintenance and failover drills, while reads continue to be served.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	WritesRefused = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_writes_refused_total",
+		Help: "Number of mutating requests refused in read-only mode.",
+	})
+	ReadOnlyMode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "read_only_mode",
+		Help: "Whether mutating requests are refused.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(WritesRefused)
+	prometheus.MustRegister(ReadOnlyMode)
+}
+
+// Mutating reports whether r may change data.
+func Mutating(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return true
+}
+
+// ReadOnlyPath is where the admin handler of ReadOnly is served.
+const ReadOnlyPath = "/admin/read-only"
+
+type readOnlyKey struct{}
+
+// ReadOnlyFromContext reports whether the request of ctx was served in
+// read-only mode. Reads that write as a side effect, such as the login
+// history recorded by logins, skip those writes.
+func ReadOnlyFromContext(ctx context.Context) bool {
+	ro, _ := ctx.Value(readOnlyKey{}).(bool)
+	return ro
+}
+
+// ReadOnly refuses mutating requests with 503 while enabled. It is switched
+// at runtime through the admin handler at ReadOnlyPath, which is never
+// refused, so that it can always be switched off again.
+type ReadOnly struct {
+	enabled atomic.Bool
+}
+
+// NewReadOnly returns a ReadOnly, initially enabled or not.
+func NewReadOnly(enabled bool) *ReadOnly {
+	ro := &ReadOnly{}
+	ro.Set(enabled)
+	return ro
+}
+
+// Set enables or disables read-only mode.
+func (ro *ReadOnly) Set(enabled bool) {
+	ro.enabled.Store(enabled)
+	if enabled {
+		ReadOnlyMode.Set(1)
+	} else {
+		ReadOnlyMode.Set(0)
+	}
+}
+
+// Enabled reports whether mutating requests are refused.
+func (ro *ReadOnly) Enabled() bool {
+	return ro.enabled.Load()
+}
+
+// Wrap implements middleware.Interface.
+func (ro *ReadOnly) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ro.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if Mutating(r) && r.URL.Path != ReadOnlyPath {
+			WritesRefused.Inc()
+			w.Header().Set("Retry-After", "60")
+			writeError(w, http.StatusServiceUnavailable, users.CodeReadOnly, "Service is read-only, try again later")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), readOnlyKey{}, true)))
+	})
+}
+
+type readOnlyState struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// ServeHTTP is the admin handler: GET returns the mode and PUT sets it from
+// a {"readOnly": bool} body.
+func (ro *ReadOnly) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var s readOnlyState
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeError(w, http.StatusBadRequest, users.CodeInvalidRequest, err.Error())
+			return
+		}
+		ro.Set(s.ReadOnly)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, users.CodeInvalidRequest, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	w.Header().Set("Content-Type", "application/hal+json")
+	json.NewEncoder(w).Encode(readOnlyState{ReadOnly: ro.Enabled()})
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	ro := NewReadOnly(true)
+	cases := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/customers/1", http.StatusOK},
+		{"POST", "/register", http.StatusServiceUnavailable},
+		{"DELETE", "/customers/1", http.StatusServiceUnavailable},
+		{"PUT", "/admin/read-only", http.StatusOK},
+		{"POST", "/admin/jobs", http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		ro.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != c.code {
+			t.Errorf("Expected %v %v to return %v, received %v", c.method, c.path, c.code, rec.Code)
+		}
+	}
+	ro.Set(false)
+	rec := httptest.NewRecorder()
+	ro.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("POST", "/register", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected writes once disabled, received %v", rec.Code)
+	}
+}
+
+func TestReadOnlyContext(t *testing.T) {
+	ro := NewReadOnly(true)
+	var marked bool
+	h := ro.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		marked = ReadOnlyFromContext(r.Context())
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+	if !marked {
+		t.Error("Expected reads marked read-only")
+	}
+	ro.Set(false)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+	if marked {
+		t.Error("Expected reads unmarked once disabled")
+	}
+}
+
+func TestReadOnlyAdmin(t *testing.T) {
+	ro := NewReadOnly(false)
+	rec := httptest.NewRecorder()
+	ro.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/read-only", strings.NewReader(`{"readOnly": true}`)))
+	if rec.Code != http.StatusOK || !ro.Enabled() {
+		t.Errorf("Expected read-only mode to be enabled, received %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	ro.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/read-only", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `"readOnly":true`) {
+		t.Errorf("Expected the mode to be reported, received %v", body)
+	}
+	rec = httptest.NewRecorder()
+	ro.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/read-only", strings.NewReader("yes")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid body to be refused, received %v", rec.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package middleware
+
+// realip.go contains a middleware restoring the address of clients behind
+// trusted reverse proxies from X-Forwarded-For, so that rate limits and login
+// history see clients rather than the proxy.
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Networks is a list of trusted address ranges.
+type Networks []*net.IPNet
+
+// ParseNetworks parses CIDRs and single addresses.
+func ParseNetworks(ss []string) (Networks, error) {
+	var ns Networks
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ns = append(ns, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// Contains reports whether ip is in one of the networks.
+func (ns Networks) Contains(ip net.IP) bool {
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr reports whether the IP of a TCP address is in one of the
+// networks.
+func (ns Networks) ContainsAddr(addr net.Addr) bool {
+	a, ok := addr.(*net.TCPAddr)
+	return ok && ns.Contains(a.IP)
+}
+
+// RealIP sets the remote address of requests relayed by trusted proxies to
+// the client address they forwarded. X-Forwarded-For is read from the right,
+// skipping trusted proxies, so that addresses a client sends itself are
+// ignored.
+type RealIP struct {
+	Trusted Networks
+}
+
+// Wrap implements middleware.Interface.
+func (ri RealIP) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := ri.ClientIP(r); ip != "" {
+			r2 := *r
+			r2.RemoteAddr = net.JoinHostPort(ip, "0")
+			r = &r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientIP returns the forwarded client address of r, or "" if r did not
+// come from a trusted proxy or carries no valid forwarded address.
+func (ri RealIP) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !ri.Trusted.Contains(net.ParseIP(host)) {
+		return ""
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !ri.Trusted.Contains(ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	ns, err := ParseNetworks([]string{"10.0.0.0/8", " 192.0.2.1", "2001:db8::/32", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 3 {
+		t.Errorf("Expected three networks, received %v", ns)
+	}
+	if _, err := ParseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected invalid CIDR to be refused")
+	}
+	if _, err := ParseNetworks([]string{"proxy"}); err == nil {
+		t.Error("Expected invalid address to be refused")
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	ns, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	ri := RealIP{Trusted: ns}
+	cases := []struct {
+		remote, forwarded, want string
+	}{
+		{"10.0.0.1:1234", "203.0.113.7", "203.0.113.7"},
+		{"10.0.0.1:1234", "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "", ""},
+		{"10.0.0.1:1234", "garbage", ""},
+		{"203.0.113.9:1234", "198.51.100.1", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := ri.ClientIP(r); got != c.want {
+			t.Errorf("Expected %q from %v via %v, received %q", c.want, c.forwarded, c.remote, got)
+		}
+	}
+
+	var seen string
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	ri.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if seen != "203.0.113.7:0" {
+		t.Errorf("Expected handler to see the client address, received %v", seen)
+	}
+}
@@ -0,0 +1,84 @@
+package middleware
+
+// recover.go contains a middleware answering requests whose handler panics
+// with a 500 response, logged with its stack and counted, rather than
+// dropping the connection.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/go-kit/log"
+	"github.com/gorilla/mux"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var Panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_panics_total",
+	Help: "Number of panics recovered from while serving requests, by route.",
+}, []string{"route"})
+
+func init() {
+	prometheus.MustRegister(Panics)
+}
+
+// Recover recovers from panics serving requests. Each is logged with the
+// request and the stack, counted in Panics by route, passed to Report if
+// set, and answered with a 500 problem+json response unless the response
+// was already started. http.ErrAbortHandler is panicked again, as handlers
+// use it to abort responses on purpose.
+type Recover struct {
+	Routes *Routes
+	Logger log.Logger
+	// Report is called with the request's route, the recovered value and
+	// the stack, such as to send them to an error tracker.
+	Report func(r *http.Request, route string, v interface{}, stack []byte)
+}
+
+// Wrap implements middleware.Interface.
+func (rc Recover) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			stack := debug.Stack()
+			route := "other"
+			var match mux.RouteMatch
+			if rc.Routes != nil && rc.Routes.Match(r, &match) {
+				route = match.Route.GetName()
+			}
+			Panics.WithLabelValues(route).Inc()
+			rc.Logger.Log("panic", fmt.Sprint(v), "method", r.Method, "route", route, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "stack", string(stack))
+			if rc.Report != nil {
+				rc.Report(r, route, v, stack)
+			}
+			if !sw.wrote {
+				writeProblem(sw, http.StatusInternalServerError, users.CodeInternal, "The request could not be served.")
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// writeProblem writes an RFC 7807 problem details response, carrying the
+// error code like other error responses.
+func writeProblem(w http.ResponseWriter, code int, errCode, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "about:blank",
+		"title":  http.StatusText(code),
+		"status": code,
+		"detail": detail,
+		"code":   errCode,
+	})
+}
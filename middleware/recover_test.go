@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/gorilla/mux"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func panicCount(t *testing.T, route string) float64 {
+	t.Helper()
+	var d dto.Metric
+	if err := Panics.WithLabelValues(route).Write(&d); err != nil {
+		t.Fatal(err)
+	}
+	return d.GetCounter().GetValue()
+}
+
+func TestRecover(t *testing.T) {
+	router := mux.NewRouter()
+	router.Path("/customers/{id}")
+	var reported interface{}
+	rc := Recover{Routes: NewRoutes(router, false), Logger: log.NewNopLogger(), Report: func(r *http.Request, route string, v interface{}, stack []byte) {
+		reported = v
+	}}
+	before := panicCount(t, "customers_id")
+	rec := httptest.NewRecorder()
+	rc.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})).ServeHTTP(rec, httptest.NewRequest("GET", "/customers/1", nil))
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("Expected a 500 problem, received %v %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var problem struct {
+		Status int    `json:"status"`
+		Code   string `json:"code"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil || problem.Status != 500 || problem.Code != "INTERNAL_ERROR" {
+		t.Errorf("Expected problem details, received %+v %v", problem, err)
+	}
+	if n := panicCount(t, "customers_id") - before; n != 1 || reported != "boom" {
+		t.Errorf("Expected the panic counted and reported, received %v %v", n, reported)
+	}
+}
+
+func TestRecoverStartedResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Recover{Logger: log.NewNopLogger()}.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("boom")
+	})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusAccepted || rec.Body.Len() != 0 {
+		t.Errorf("Expected the started response left alone, received %v %q", rec.Code, rec.Body)
+	}
+}
+
+func TestRecoverAbort(t *testing.T) {
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("Expected the abort panicked again, received %v", v)
+		}
+	}()
+	Recover{Logger: log.NewNopLogger()}.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
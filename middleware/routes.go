@@ -0,0 +1,73 @@
+package middleware
+
+// routes.go contains the route matcher naming requests in HTTP metrics, so
+// that IDs in paths do not each make a series.
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	commonMiddleware "github.com/weaveworks/common/middleware"
+)
+
+// Routes matches requests for the Instrument middleware, naming them after
+// the template of their route. Requests below a prefix route are named after
+// its template followed by {id}, as the prefix handlers read the next
+// segment as an ID.
+type Routes struct {
+	router *mux.Router
+	paths  bool
+
+	mtx   sync.Mutex
+	named map[string]*mux.Route
+}
+
+// NewRoutes returns a Routes matching against router. Requests matching no
+// route are left to the Instrument middleware, which labels them "other",
+// or named by their path if paths is set. Paths are only safe labels when
+// the paths clients send are bounded.
+func NewRoutes(router *mux.Router, paths bool) *Routes {
+	return &Routes{router: router, paths: paths, named: make(map[string]*mux.Route)}
+}
+
+// Match implements the RouteMatcher of the Instrument middleware, setting
+// match.Route to a route named after the request.
+func (rs *Routes) Match(r *http.Request, match *mux.RouteMatch) bool {
+	if !rs.router.Match(r, match) || match.Route == nil {
+		if !rs.paths {
+			return false
+		}
+		match.MatchErr = nil
+		match.Route = mux.NewRouter().Name(r.URL.Path)
+		return true
+	}
+	if match.Route.GetName() != "" {
+		return true
+	}
+	tmpl, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return true
+	}
+	if re, _ := match.Route.GetPathRegexp(); !strings.HasSuffix(re, "$") {
+		if rest := strings.Trim(strings.TrimPrefix(r.URL.Path, tmpl), "/"); rest != "" {
+			tmpl = strings.TrimSuffix(tmpl, "/") + "/{id}"
+		}
+	}
+	match.Route = rs.route(commonMiddleware.MakeLabelValue(tmpl))
+	return true
+}
+
+// route returns the route named name. Names come from templates, so there
+// are only as many as the router has routes.
+func (rs *Routes) route(name string) *mux.Route {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	route, ok := rs.named[name]
+	if !ok {
+		route = mux.NewRouter().Name(name)
+		rs.named[name] = route
+	}
+	return route
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRoutes(t *testing.T) {
+	router := mux.NewRouter()
+	router.Methods("GET").Path("/customers/{id}/cards").HandlerFunc(http.NotFound)
+	router.Methods("GET").PathPrefix("/customers").HandlerFunc(http.NotFound)
+	router.Methods("GET").Path("/health").Name("health").HandlerFunc(http.NotFound)
+
+	cases := []struct {
+		path, name string
+	}{
+		{"/customers/57a98d98e4b00679b4a830af/cards", "customers_id_cards"},
+		{"/customers/57a98d98e4b00679b4a830af", "customers_id"},
+		{"/customers", "customers"},
+		{"/health", "health"},
+	}
+	rs := NewRoutes(router, false)
+	for _, c := range cases {
+		var m mux.RouteMatch
+		if !rs.Match(httptest.NewRequest("GET", c.path, nil), &m) {
+			t.Errorf("Expected %v to match", c.path)
+			continue
+		}
+		if name := m.Route.GetName(); name != c.name {
+			t.Errorf("Expected %v to be named %v, received %v", c.path, c.name, name)
+		}
+	}
+
+	var m mux.RouteMatch
+	if rs.Match(httptest.NewRequest("GET", "/unknown/1", nil), &m) {
+		t.Error("Expected unmatched path to be left to the other bucket")
+	}
+	m = mux.RouteMatch{}
+	if !NewRoutes(router, true).Match(httptest.NewRequest("GET", "/unknown/1", nil), &m) || m.Route.GetName() != "/unknown/1" {
+		t.Error("Expected unmatched path to be named by its path")
+	}
+}
@@ -0,0 +1,158 @@
+package middleware
+
+// shedding.go contains a load shedding middleware refusing low-priority
+// requests while the service is saturated, so that logins and health checks
+// stay responsive.
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Reasons requests are shed.
+const (
+	ShedInflight = "inflight"
+	ShedLatency  = "latency"
+)
+
+var (
+	RequestsShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_shed_total",
+		Help: "Number of low-priority requests refused while overloaded.",
+	}, []string{"reason"})
+
+	// listPaths are the collection endpoints shed first.
+	listPaths = map[string]bool{
+		"/customers":        true,
+		"/customers/search": true,
+		"/cards":            true,
+		"/addresses":        true,
+		"/admin/duplicates": true,
+	}
+)
+
+func init() {
+	prometheus.MustRegister(RequestsShed)
+}
+
+// ListRequest reports whether r lists a collection. These requests are the
+// most expensive and the least urgent.
+func ListRequest(r *http.Request) bool {
+	return r.Method == "GET" && listPaths[strings.TrimSuffix(r.URL.Path, "/")]
+}
+
+// Shedder refuses low-priority requests with 503 while more than MaxInflight
+// requests are in flight or the database latency exceeds MaxLatency. A zero
+// threshold is not enforced.
+type Shedder struct {
+	MaxInflight float64
+	MaxLatency  time.Duration
+	// LowPriority selects the requests that may be shed.
+	LowPriority func(*http.Request) bool
+
+	inflight prometheus.Collector
+	mtx      sync.RWMutex
+	latency  time.Duration
+}
+
+// NewShedder returns a Shedder reading the number of requests in flight from
+// the sum of the gauges collected by inflight.
+func NewShedder(inflight prometheus.Collector, maxInflight float64, maxLatency time.Duration) *Shedder {
+	return &Shedder{
+		MaxInflight: maxInflight,
+		MaxLatency:  maxLatency,
+		LowPriority: ListRequest,
+		inflight:    inflight,
+	}
+}
+
+// Inflight returns the number of requests currently in flight.
+func (s *Shedder) Inflight() float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		s.inflight.Collect(ch)
+		close(ch)
+	}()
+	var n float64
+	for m := range ch {
+		var d dto.Metric
+		if m.Write(&d) == nil && d.Gauge != nil {
+			n += d.Gauge.GetValue()
+		}
+	}
+	return n
+}
+
+// ObserveLatency records a database round trip. The latency used is a moving
+// average, so a single slow call does not trigger shedding.
+func (s *Shedder) ObserveLatency(d time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.latency == 0 {
+		s.latency = d
+		return
+	}
+	s.latency = (3*s.latency + d) / 4
+}
+
+// Latency returns the average database latency.
+func (s *Shedder) Latency() time.Duration {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.latency
+}
+
+// Probe times ping every interval until ctx is done. Failed pings count as
+// taking the whole interval.
+func (s *Shedder) Probe(ctx context.Context, interval time.Duration, ping func() error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		begin := time.Now()
+		d := interval
+		if ping() == nil {
+			d = time.Since(begin)
+		}
+		s.ObserveLatency(d)
+	}
+}
+
+// overloaded returns why requests should be shed, if they should.
+func (s *Shedder) overloaded() (string, bool) {
+	if s.MaxInflight > 0 && s.Inflight() > s.MaxInflight {
+		return ShedInflight, true
+	}
+	if s.MaxLatency > 0 && s.Latency() > s.MaxLatency {
+		return ShedLatency, true
+	}
+	return "", false
+}
+
+// Wrap implements middleware.Interface.
+func (s *Shedder) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.LowPriority(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if reason, ok := s.overloaded(); ok {
+			RequestsShed.WithLabelValues(reason).Inc()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, users.CodeOverloaded, "Service overloaded, try again later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
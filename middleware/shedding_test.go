@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestShedderInflight(t *testing.T) {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_inflight"}, []string{"path"})
+	g.WithLabelValues("/customers").Set(3)
+	g.WithLabelValues("/login").Set(2)
+	s := NewShedder(g, 4, 0)
+	if n := s.Inflight(); n != 5 {
+		t.Errorf("Expected gauges to be summed, received %v", n)
+	}
+	rec := httptest.NewRecorder()
+	s.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/customers", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected list request to be shed, received %v", rec.Code)
+	}
+	for _, path := range []string{"/login", "/health", "/customers/1"} {
+		rec = httptest.NewRecorder()
+		s.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected %v to be served, received %v", path, rec.Code)
+		}
+	}
+	g.WithLabelValues("/customers").Set(1)
+	rec = httptest.NewRecorder()
+	s.Wrap(okHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/customers", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected list request once load drops, received %v", rec.Code)
+	}
+}
+
+func TestShedderLatency(t *testing.T) {
+	s := NewShedder(prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_idle"}, nil), 0, 100*time.Millisecond)
+	s.ObserveLatency(10 * time.Millisecond)
+	s.ObserveLatency(time.Second)
+	if _, shed := s.overloaded(); !shed {
+		t.Errorf("Expected average latency %v to shed", s.Latency())
+	}
+	for i := 0; i < 10; i++ {
+		s.ObserveLatency(10 * time.Millisecond)
+	}
+	if _, shed := s.overloaded(); shed {
+		t.Errorf("Expected average latency %v to recover", s.Latency())
+	}
+}
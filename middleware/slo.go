@@ -0,0 +1,136 @@
+package middleware
+
+// slo.go contains a middleware counting requests against per-route service
+// level objectives, so that burn-rate alerts are a ratio of two counters
+// rather than a quantile estimated from latency histograms.
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	SLORequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_slo_requests_total",
+		Help: "Number of requests to routes with an objective, by whether they were served without a server error within its latency.",
+	}, []string{"route", "within_slo"})
+	SLOLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_slo_latency_objective_seconds",
+		Help: "Latency within which requests to a route must be served.",
+	}, []string{"route"})
+	SLOAvailability = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_slo_availability_objective_ratio",
+		Help: "Fraction of requests to a route that must be served within its objective.",
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(SLORequests)
+	prometheus.MustRegister(SLOLatency)
+	prometheus.MustRegister(SLOAvailability)
+}
+
+// SLO is the objective of a route: Availability of its requests, such as
+// 0.999, served within Latency without a server error.
+type SLO struct {
+	Latency      time.Duration
+	Availability float64
+}
+
+// ParseSLOs parses route=latency/availability pairs with the availability
+// in percent, such as "login=300ms/99.9". Routes are named as in HTTP
+// metrics.
+func ParseSLOs(ss []string) (map[string]SLO, error) {
+	slos := make(map[string]SLO)
+	for _, pair := range ss {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		route, objective, ok := strings.Cut(pair, "=")
+		l, a, ok2 := strings.Cut(objective, "/")
+		latency, err := time.ParseDuration(strings.TrimSpace(l))
+		percent, err2 := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		if !ok || !ok2 || err != nil || err2 != nil || latency <= 0 || percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("invalid route objective %q", pair)
+		}
+		slos[strings.TrimSpace(route)] = SLO{Latency: latency, Availability: percent / 100}
+	}
+	return slos, nil
+}
+
+// Objectives counts the requests to routes with an SLO in SLORequests, and
+// exports the objectives, so that the error budget burn rate of a route is
+// the rate of requests not within its SLO over all its requests, divided by
+// one less its availability objective.
+type Objectives struct {
+	routes *Routes
+	slos   map[string]SLO
+}
+
+// NewObjectives returns an Objectives naming requests with routes.
+func NewObjectives(routes *Routes, slos map[string]SLO) *Objectives {
+	for route, slo := range slos {
+		SLOLatency.WithLabelValues(route).Set(slo.Latency.Seconds())
+		SLOAvailability.WithLabelValues(route).Set(slo.Availability)
+	}
+	return &Objectives{routes: routes, slos: slos}
+}
+
+// Wrap implements middleware.Interface.
+func (o *Objectives) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if !o.routes.Match(r, &match) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := match.Route.GetName()
+		slo, ok := o.slos[route]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		begin := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		within := sw.code < http.StatusInternalServerError && time.Since(begin) <= slo.Latency
+		SLORequests.WithLabelValues(route, strconv.FormatBool(within)).Inc()
+	})
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	wrote bool
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if !sw.wrote {
+		sw.code, sw.wrote = code, true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wrote = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseSLOs(t *testing.T) {
+	slos, err := ParseSLOs([]string{"login=300ms/99", " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slo := slos["login"]; len(slos) != 1 || slo.Latency != 300*time.Millisecond || slo.Availability != 0.99 {
+		t.Errorf("Expected the objective, received %v", slos)
+	}
+	for _, s := range []string{"login", "login=300ms", "login=300ms/100", "login=soon/99", "login=0s/99"} {
+		if _, err := ParseSLOs([]string{s}); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+func sloCount(t *testing.T, route, within string) float64 {
+	t.Helper()
+	var d dto.Metric
+	if err := SLORequests.WithLabelValues(route, within).Write(&d); err != nil {
+		t.Fatal(err)
+	}
+	return d.GetCounter().GetValue()
+}
+
+func TestObjectives(t *testing.T) {
+	router := mux.NewRouter()
+	router.Path("/slo")
+	o := NewObjectives(NewRoutes(router, false), map[string]SLO{"slo": {Latency: time.Second, Availability: 0.99}})
+	var code int
+	h := o.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+
+	good, bad := sloCount(t, "slo", "true"), sloCount(t, "slo", "false")
+	for _, code = range []int{http.StatusOK, http.StatusNotFound, http.StatusServiceUnavailable} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slo", nil))
+	}
+	if n := sloCount(t, "slo", "true") - good; n != 2 {
+		t.Errorf("Expected successes and client errors within the objective, counted %v", n)
+	}
+	if n := sloCount(t, "slo", "false") - bad; n != 1 {
+		t.Errorf("Expected server errors outside the objective, counted %v", n)
+	}
+}
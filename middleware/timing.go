@@ -0,0 +1,110 @@
+package middleware
+
+// timing.go contains a middleware breaking the time serving each request
+// down into the database, serialization, the handler and the middleware, so
+// that a slow route can be told apart as DB-bound or CPU-bound without a
+// profiler.
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikesay/user/timing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var RequestPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "http_request_phase_duration_seconds",
+	Help:    "Time (in seconds) spent serving HTTP requests, by route and phase: db, serialization, handler or middleware.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"route", "phase"})
+
+func init() {
+	prometheus.MustRegister(RequestPhaseDuration)
+}
+
+// Timing times the phases of requests, observing them in
+// RequestPhaseDuration and, if header is set, sending them to clients in a
+// Server-Timing header. The header is written with the response headers, so
+// it leaves out the time writing the body and in the middleware after it.
+//
+// Timing should wrap the other middleware, and Handler the router, so that
+// the time before and after the router is the middleware's.
+type Timing struct {
+	routes *Routes
+	header bool
+	now    func() time.Time
+}
+
+// NewTiming returns a Timing naming requests with routes.
+func NewTiming(routes *Routes, header bool) *Timing {
+	return &Timing{routes: routes, header: header, now: time.Now}
+}
+
+// Wrap implements middleware.Interface.
+func (t *Timing) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer := timing.NewTimer(t.now)
+		if t.header {
+			w = &timingWriter{ResponseWriter: w, timer: timer}
+		}
+		next.ServeHTTP(w, r.WithContext(timing.NewContext(r.Context(), timer)))
+
+		route := "other"
+		var match mux.RouteMatch
+		if t.routes.Match(r, &match) {
+			route = match.Route.GetName()
+		}
+		spent, _ := timer.Spent()
+		for _, phase := range timing.Phases {
+			RequestPhaseDuration.WithLabelValues(route, phase).Observe(spent[phase].Seconds())
+		}
+	})
+}
+
+// Handler counts the time in next as the handler's.
+func (t *Timing) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing.Enter(r.Context(), timing.Handler)
+		defer timing.Enter(r.Context(), timing.Middleware)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timingWriter adds the Server-Timing header as the response headers are
+// written.
+type timingWriter struct {
+	http.ResponseWriter
+	timer *timing.Timer
+	wrote bool
+}
+
+func (tw *timingWriter) WriteHeader(code int) {
+	if !tw.wrote {
+		tw.wrote = true
+		tw.Header().Set("Server-Timing", tw.timer.Header())
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wrote {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timingWriter) Flush() {
+	if !tw.wrote {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikesay/user/timing"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func phaseSum(t *testing.T, route, phase string) (float64, uint64) {
+	t.Helper()
+	var d dto.Metric
+	if err := RequestPhaseDuration.WithLabelValues(route, phase).(prometheus.Metric).Write(&d); err != nil {
+		t.Fatal(err)
+	}
+	return d.GetHistogram().GetSampleSum(), d.GetHistogram().GetSampleCount()
+}
+
+func TestTiming(t *testing.T) {
+	now := time.Unix(0, 0)
+	router := mux.NewRouter()
+	router.Path("/timed").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now = now.Add(time.Millisecond)
+		done := timing.Database(r.Context())
+		now = now.Add(3 * time.Millisecond)
+		done()
+		timing.Enter(r.Context(), timing.Serialization)
+		now = now.Add(2 * time.Millisecond)
+		w.Write([]byte("ok"))
+		now = now.Add(time.Hour)
+	})
+	tm := NewTiming(NewRoutes(router, false), true)
+	tm.now = func() time.Time { return now }
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now = now.Add(4 * time.Millisecond)
+		tm.Handler(router).ServeHTTP(w, r)
+	})
+
+	sum, count := phaseSum(t, "timed", timing.DB)
+	rec := httptest.NewRecorder()
+	tm.Wrap(slow).ServeHTTP(rec, httptest.NewRequest("GET", "/timed", nil))
+	want := "db;dur=3.000, serialization;dur=2.000, handler;dur=1.000, middleware;dur=4.000, total;dur=10.000"
+	if h := rec.Header().Get("Server-Timing"); h != want {
+		t.Errorf("Expected %q, received %q", want, h)
+	}
+	if s, c := phaseSum(t, "timed", timing.DB); c != count+1 || s-sum < 0.0029 || s-sum > 0.0031 {
+		t.Errorf("Expected the database time observed, received %v in %v", s-sum, c-count)
+	}
+	if s, _ := phaseSum(t, "timed", timing.Serialization); s < 3600 {
+		t.Errorf("Expected the time writing the body observed, received %v", s)
+	}
+
+	rec = httptest.NewRecorder()
+	NewTiming(NewRoutes(router, false), false).Wrap(router).ServeHTTP(rec, httptest.NewRequest("GET", "/timed", nil))
+	if h := rec.Header().Get("Server-Timing"); h != "" {
+		t.Errorf("Expected no header unless enabled, received %q", h)
+	}
+}
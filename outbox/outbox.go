@@ -0,0 +1,195 @@
+// Package outbox catches the mail and webhooks sent while developing, so
+// that they can be read at /dev/outbox without a mail server or a webhook
+// endpoint. It is only served in dev mode, and keeps messages in memory.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/events"
+)
+
+// Prefix is the path the outbox is served under. Webhooks are received at
+// Prefix + "/webhook" and any path below it.
+const Prefix = "/dev/outbox"
+
+// Kinds of messages.
+const (
+	Mail    = "mail"
+	Webhook = "webhook"
+)
+
+// maxBody bounds the size of a caught message.
+const maxBody = 1 << 20
+
+// Message is a caught mail or webhook.
+type Message struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	Time        time.Time `json:"time"`
+	From        string    `json:"from,omitempty"`
+	To          []string  `json:"to,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Body        string    `json:"body"`
+}
+
+// Outbox holds the latest caught messages.
+type Outbox struct {
+	// Format is the format events are caught in, as the webhook would
+	// post them. Nil catches them as JSON.
+	Format events.Format
+
+	size int
+	now  func() time.Time
+
+	mtx      sync.Mutex
+	messages []Message
+	lastID   int
+}
+
+// New returns an Outbox keeping the latest size messages.
+func New(size int) *Outbox {
+	return &Outbox{size: size, now: time.Now}
+}
+
+// Add catches m, numbering and timing it.
+func (o *Outbox) Add(m Message) Message {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.lastID++
+	m.ID, m.Time = o.lastID, o.now().UTC()
+	o.messages = append(o.messages, m)
+	if len(o.messages) > o.size {
+		o.messages = o.messages[len(o.messages)-o.size:]
+	}
+	return m
+}
+
+// Messages returns the caught messages, newest first.
+func (o *Outbox) Messages() []Message {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	ms := make([]Message, len(o.messages))
+	for i, m := range o.messages {
+		ms[len(ms)-1-i] = m
+	}
+	return ms
+}
+
+// Clear drops the caught messages.
+func (o *Outbox) Clear() {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.messages = nil
+}
+
+// Publish implements events.Publisher, catching events as the webhook
+// would post them.
+func (o *Outbox) Publish(ctx context.Context, e events.Event) error {
+	format := o.Format
+	if format == nil {
+		format = events.JSON{}
+	}
+	body, contentType, err := format.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return err
+	}
+	o.Add(Message{Kind: Webhook, Subject: e.Type, URL: "events", ContentType: contentType, Body: indented.String()})
+	return nil
+}
+
+// ServeHTTP shows the messages at Prefix, as JSON to clients accepting it,
+// and clears them on DELETE. Requests below Prefix + "/webhook" are caught.
+func (o *Outbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == Prefix+"/webhook" || strings.HasPrefix(r.URL.Path, Prefix+"/webhook/") {
+		o.receive(w, r)
+		return
+	}
+	if r.URL.Path != Prefix {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Cache-Control", "no-store")
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(o.Messages())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		viewer.Execute(w, o.Messages())
+	case "DELETE":
+		o.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// receive catches a webhook, answering 204 as a receiver would.
+func (o *Outbox) receive(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	o.Add(Message{
+		Kind:        Webhook,
+		Subject:     r.Method + " " + r.URL.Path,
+		URL:         r.URL.String(),
+		ContentType: r.Header.Get("Content-Type"),
+		Body:        string(body),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var viewer = template.Must(template.New("outbox").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Outbox</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+article { border: 1px solid #ccc; border-radius: 4px; margin: 1em 0; padding: 0 1em; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 0 1em; }
+dt { color: #666; }
+pre { background: #f6f6f6; overflow-x: auto; padding: 1em; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Outbox</h1>
+<p>Mail and webhooks caught in dev mode, newest first. Reload to see new ones.</p>
+{{range .}}
+<article>
+<h2>#{{.ID}} {{.Kind}}: {{.Subject}}</h2>
+<dl>
+<dt>Time</dt><dd>{{.Time.Format "2006-01-02 15:04:05 MST"}}</dd>
+{{if .From}}<dt>From</dt><dd>{{.From}}</dd>{{end}}
+{{if .To}}<dt>To</dt><dd>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</dd>{{end}}
+{{if .URL}}<dt>URL</dt><dd>{{.URL}}</dd>{{end}}
+{{if .ContentType}}<dt>Content type</dt><dd>{{.ContentType}}</dd>{{end}}
+</dl>
+<pre>{{.Body}}</pre>
+</article>
+{{else}}
+<p>Nothing caught yet.</p>
+{{end}}
+</body>
+</html>
+`))
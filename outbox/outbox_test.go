@@ -0,0 +1,78 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mikesay/user/events"
+)
+
+func TestSMTP(t *testing.T) {
+	o := New(10)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go o.ServeSMTP(l)
+
+	msg := "From: shop@example.com\r\nTo: eve@example.com\r\nSubject: =?utf-8?q?Verify_your_email_=E2=9C=93?=\r\nContent-Type: text/plain\r\n\r\nClick the link.\r\n..and a dot.\r\n"
+	if err := smtp.SendMail(l.Addr().String(), nil, "shop@example.com", []string{"eve@example.com", "ops@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	ms := o.Messages()
+	if len(ms) != 1 {
+		t.Fatalf("Expected the mail caught, received %+v", ms)
+	}
+	m := ms[0]
+	if m.Kind != Mail || m.From != "shop@example.com" || !slices.Equal(m.To, []string{"eve@example.com", "ops@example.com"}) {
+		t.Errorf("Unexpected envelope %+v", m)
+	}
+	if m.Subject != "Verify your email ✓" || m.ContentType != "text/plain" || m.Body != "Click the link.\n..and a dot.\n" {
+		t.Errorf("Unexpected message %q %q %q", m.Subject, m.ContentType, m.Body)
+	}
+}
+
+func TestWebhooksAndViewer(t *testing.T) {
+	o := New(2)
+	o.Publish(context.Background(), events.Event{Type: events.UserCreated, Subject: "u1"})
+	r := httptest.NewRequest("POST", Prefix+"/webhook/scim/Users?x=1", strings.NewReader(`{"userName":"eve"}`))
+	r.Header.Set("Content-Type", "application/scim+json")
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected the webhook acknowledged, received %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", Prefix, nil)
+	r.Header.Set("Accept", "application/json")
+	o.ServeHTTP(w, r)
+	var ms []Message
+	if err := json.NewDecoder(w.Body).Decode(&ms); err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].URL != Prefix+"/webhook/scim/Users?x=1" || ms[0].Body != `{"userName":"eve"}` || ms[1].Subject != events.UserCreated {
+		t.Errorf("Expected the webhook then the event, received %+v", ms)
+	}
+
+	o.Add(Message{Kind: Mail, Subject: "<b>Welcome</b>"})
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", Prefix, nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "&lt;b&gt;Welcome&lt;/b&gt;") || strings.Contains(body, events.UserCreated) {
+		t.Errorf("Expected the latest two messages escaped, received %s", body)
+	}
+
+	o.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", Prefix, nil))
+	if ms := o.Messages(); len(ms) != 0 {
+		t.Errorf("Expected the outbox cleared, received %+v", ms)
+	}
+}
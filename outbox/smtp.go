@@ -0,0 +1,116 @@
+package outbox
+
+// smtp.go contains the mail catcher, an SMTP server accepting any mail
+// without authentication and keeping it in the outbox instead of
+// delivering it.
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// smtpTimeout bounds how long a mail client may stay silent.
+const smtpTimeout = time.Minute
+
+// ServeSMTP catches the mail sent to l until l is closed.
+func (o *Outbox) ServeSMTP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go o.serveSMTP(c)
+	}
+}
+
+func (o *Outbox) serveSMTP(c net.Conn) {
+	defer c.Close()
+	// Connections are read up to a few messages, so a runaway client
+	// cannot fill the memory.
+	r := textproto.NewReader(bufio.NewReader(io.LimitReader(c, 10*maxBody)))
+	w := textproto.NewWriter(bufio.NewWriter(c))
+	w.PrintfLine("220 localhost ESMTP outbox")
+	var from string
+	var to []string
+	for {
+		c.SetDeadline(time.Now().Add(smtpTimeout))
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			w.PrintfLine("250 localhost")
+		case "MAIL":
+			from, to = smtpPath(arg), nil
+			w.PrintfLine("250 OK")
+		case "RCPT":
+			if from == "" {
+				w.PrintfLine("503 MAIL first")
+				continue
+			}
+			to = append(to, smtpPath(arg))
+			w.PrintfLine("250 OK")
+		case "DATA":
+			if from == "" || len(to) == 0 {
+				w.PrintfLine("503 MAIL and RCPT first")
+				continue
+			}
+			w.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := r.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			o.Add(mailMessage(from, to, data))
+			from, to = "", nil
+			w.PrintfLine("250 OK")
+		case "RSET":
+			from, to = "", nil
+			w.PrintfLine("250 OK")
+		case "NOOP":
+			w.PrintfLine("250 OK")
+		case "QUIT":
+			w.PrintfLine("221 Bye")
+			return
+		default:
+			w.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// smtpPath returns the address of a "FROM:<address> params" or
+// "TO:<address>" argument.
+func smtpPath(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	path, _, _ = strings.Cut(strings.TrimSpace(path), " ")
+	return strings.Trim(path, "<>")
+}
+
+// mailMessage reads the headers of the mail data, keeping it whole if it
+// cannot be parsed.
+func mailMessage(from string, to []string, data []byte) Message {
+	m := Message{Kind: Mail, From: from, To: to, Body: string(data)}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return m
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return m
+	}
+	var dec mime.WordDecoder
+	if m.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+	m.ContentType = msg.Header.Get("Content-Type")
+	m.Body = string(body)
+	return m
+}
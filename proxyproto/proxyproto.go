@@ -0,0 +1,176 @@
+// Package proxyproto accepts connections relayed by layer 4 load balancers
+// using the PROXY protocol, versions 1 and 2, reporting the address of the
+// client instead of the load balancer.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("Invalid PROXY protocol header")
+
+var (
+	v1Prefix  = []byte("PROXY ")
+	v2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	maxV1Size = 107
+)
+
+// Listener reads a PROXY protocol header at the start of each connection
+// from a trusted peer. Connections without a header are served with their
+// own addresses.
+type Listener struct {
+	net.Listener
+	// Trusted selects the peers whose headers are believed. Nil trusts all.
+	Trusted func(net.Addr) bool
+	// Timeout bounds how long a client may take to send the header.
+	Timeout time.Duration
+}
+
+// Accept returns the next connection. The header is read when the
+// connection is first used, so that slow peers do not hold up Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.Trusted != nil && !l.Trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &Conn{Conn: c, r: bufio.NewReader(c), timeout: l.Timeout}, nil
+}
+
+// Conn is a connection whose remote address is read from its PROXY header.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.remote, c.err = readHeader(c.r)
+	})
+}
+
+// Read reads past the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the peer's if
+// the connection has none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads a version 1 or 2 header. It returns a nil address for
+// connections without a header, or whose header does not carry a TCP
+// address, such as health checks from the load balancer itself.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	// The first byte tells whether to wait for a whole signature, so that
+	// short requests without a header are not held up.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil
+	}
+	switch first[0] {
+	case v2Sig[0]:
+		if b, _ := r.Peek(len(v2Sig)); bytes.Equal(b, v2Sig) {
+			return readV2(r)
+		}
+	case v1Prefix[0]:
+		if b, _ := r.Peek(len(v1Prefix)); bytes.Equal(b, v1Prefix) {
+			return readV1(r)
+		}
+	}
+	return nil, nil
+}
+
+// readV1 reads a header such as "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Size {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, ErrInvalidHeader
+	}
+	f := strings.Split(s, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary header.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if h[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// The LOCAL command is sent by the load balancer on its own behalf.
+	if h[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch h[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
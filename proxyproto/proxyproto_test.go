@@ -0,0 +1,88 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	h := append([]byte{}, v2Sig...)
+	h = append(h, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6[32:], 1234)
+	cases := []struct {
+		name, input, addr, rest string
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nGET /", "203.0.113.7:56324", "GET /"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\nGET /", "[2001:db8::1]:1234", "GET /"},
+		{"v1 unknown", "PROXY UNKNOWN\r\nGET /", "", "GET /"},
+		{"v2 tcp4", string(v2Header(1, 0x11, v4)) + "GET /", "203.0.113.7:56324", "GET /"},
+		{"v2 tcp6", string(v2Header(1, 0x21, v6)) + "GET /", "[2001:db8::1]:1234", "GET /"},
+		{"v2 local", string(v2Header(0, 0x11, v4)) + "GET /", "", "GET /"},
+		{"none", "POST /login", "", "POST /login"},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.input))
+		addr, err := readHeader(r)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if got := ""; addr != nil {
+			got = addr.String()
+			if got != c.addr {
+				t.Errorf("%v: expected %v, received %v", c.name, c.addr, got)
+			}
+		} else if c.addr != "" {
+			t.Errorf("%v: expected %v, received no address", c.name, c.addr)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != c.rest {
+			t.Errorf("%v: expected %q to follow, received %q", c.name, c.rest, rest)
+		}
+	}
+	for _, s := range []string{"PROXY TCP4 nope 10.0.0.1 1 2\r\n", "PROXY TCP4 203.0.113.7 10.0.0.1 1 2\n", "PROXY " + strings.Repeat("x", 200)} {
+		if _, err := readHeader(bufio.NewReader(strings.NewReader(s))); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Listener{Listener: ln, Timeout: time.Second}
+	defer l.Close()
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nhello")
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr := c.RemoteAddr().String(); addr != "203.0.113.7:56324" {
+		t.Errorf("Expected the client address, received %v", addr)
+	}
+	if b, _ := io.ReadAll(c); string(b) != "hello" {
+		t.Errorf("Expected the data after the header, received %q", b)
+	}
+}
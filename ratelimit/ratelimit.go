@@ -0,0 +1,168 @@
+// Package ratelimit limits the writes of each customer, such as the cards
+// and addresses they add, with token buckets kept in memory or in Redis.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operations limited per customer.
+const (
+	Cards     = "cards"
+	Addresses = "addresses"
+	Profile   = "profile"
+)
+
+var (
+	ErrLimited = users.NewError(users.CodeRateLimited, "Too many changes, try again later")
+
+	Decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "customer_write_limit_decisions_total",
+		Help: "Number of customer writes checked against their limit, by operation and result.",
+	}, []string{"operation", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(Decisions)
+}
+
+// Limit is a token bucket holding up to Count writes, refilled at Count
+// writes per Per.
+type Limit struct {
+	Count int
+	Per   time.Duration
+}
+
+// perMilli returns the writes the bucket is refilled with each millisecond.
+func (l Limit) perMilli() float64 {
+	return float64(l.Count) / float64(l.Per.Milliseconds())
+}
+
+// ParseLimits parses operation=count/duration pairs, such as
+// "cards=10/1h".
+func ParseLimits(ss []string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, pair := range ss {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		op, limit, ok := strings.Cut(pair, "=")
+		c, p, ok2 := strings.Cut(limit, "/")
+		count, err := strconv.Atoi(strings.TrimSpace(c))
+		per, err2 := time.ParseDuration(strings.TrimSpace(p))
+		op = strings.TrimSpace(op)
+		if !ok || !ok2 || err != nil || err2 != nil || count <= 0 || per < time.Millisecond {
+			return nil, fmt.Errorf("invalid write limit %q", pair)
+		}
+		switch op {
+		case Cards, Addresses, Profile:
+		default:
+			return nil, fmt.Errorf("unknown operation %q, not %v, %v or %v", op, Cards, Addresses, Profile)
+		}
+		limits[op] = Limit{Count: count, Per: per}
+	}
+	return limits, nil
+}
+
+// Store keeps the token buckets.
+type Store interface {
+	// Take takes a token from the bucket of key at now, reporting whether
+	// there was one and, if not, how long until there is.
+	Take(ctx context.Context, key string, l Limit, now time.Time) (bool, time.Duration, error)
+}
+
+// Limiter limits the writes of each customer to Limits, by operation.
+// Operations without a limit are not limited.
+type Limiter struct {
+	Store  Store
+	Limits map[string]Limit
+}
+
+// Allow takes a token for op by customer at now, returning ErrLimited if
+// the customer is over the limit. Writes are allowed when Store fails, so
+// that an outage of Redis does not stop customers changing their details.
+func (l *Limiter) Allow(ctx context.Context, op, customer string, now time.Time) error {
+	limit, ok := l.Limits[op]
+	if !ok || customer == "" {
+		return nil
+	}
+	allowed, _, err := l.Store.Take(ctx, op+":"+customer, limit, now)
+	switch {
+	case err != nil:
+		Decisions.WithLabelValues(op, "error").Inc()
+		return nil
+	case !allowed:
+		Decisions.WithLabelValues(op, "limited").Inc()
+		return ErrLimited
+	}
+	Decisions.WithLabelValues(op, "allowed").Inc()
+	return nil
+}
+
+// take refills a bucket holding tokens at last to now, and takes a token if
+// it holds one. It returns the tokens left and the wait for the next one.
+func take(l Limit, tokens float64, last, now time.Time) (float64, bool, time.Duration) {
+	if elapsed := now.Sub(last); elapsed > 0 {
+		tokens = min(float64(l.Count), tokens+float64(elapsed.Milliseconds())*l.perMilli())
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration(math.Ceil((1-tokens)/l.perMilli())) * time.Millisecond
+}
+
+// Memory keeps buckets in memory, so each replica enforces its own limit.
+type Memory struct {
+	mtx     sync.Mutex
+	buckets map[string]bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// NewMemory returns an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]bucket)}
+}
+
+// Take implements Store.
+func (m *Memory) Take(ctx context.Context, key string, l Limit, now time.Time) (bool, time.Duration, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.sweep(now)
+	b, ok := m.buckets[key]
+	if !ok {
+		b = bucket{tokens: float64(l.Count), last: now}
+	}
+	tokens, allowed, wait := take(l, b.tokens, b.last, now)
+	m.buckets[key] = bucket{tokens: tokens, last: now, limit: l}
+	return allowed, wait, nil
+}
+
+// sweep forgets buckets refilled by now, which are as good as new, at most
+// once a minute.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	for k, b := range m.buckets {
+		if now.Sub(b.last) >= b.limit.Per {
+			delete(m.buckets, k)
+		}
+	}
+	m.swept = now
+}
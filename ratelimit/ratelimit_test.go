@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits([]string{"cards=10/1h", " profile = 3/1m", " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits[Cards] != (Limit{Count: 10, Per: time.Hour}) || limits[Profile] != (Limit{Count: 3, Per: time.Minute}) {
+		t.Errorf("Expected the limits, received %v", limits)
+	}
+	for _, s := range []string{"cards", "cards=10", "cards=0/1h", "cards=10/soon", "notes=10/1h"} {
+		if _, err := ParseLimits([]string{s}); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	l := Limit{Count: 2, Per: 2048 * time.Millisecond}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := m.Take(context.Background(), "a", l, now); !ok {
+			t.Fatalf("Expected write %v allowed", i)
+		}
+	}
+	if ok, wait, _ := m.Take(context.Background(), "a", l, now); ok || wait != 1024*time.Millisecond {
+		t.Errorf("Expected the third write refused for 1024ms, received %v %v", ok, wait)
+	}
+	if ok, _, _ := m.Take(context.Background(), "b", l, now); !ok {
+		t.Error("Expected buckets kept per key")
+	}
+	if ok, _, _ := m.Take(context.Background(), "a", l, now.Add(1024*time.Millisecond)); !ok {
+		t.Error("Expected a write allowed once refilled")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, l Limit, now time.Time) (bool, time.Duration, error) {
+	return false, 0, errors.New("connection refused")
+}
+
+func TestLimiter(t *testing.T) {
+	l := &Limiter{Store: NewMemory(), Limits: map[string]Limit{Cards: {Count: 1, Per: time.Hour}}}
+	now := time.Now()
+	if err := l.Allow(context.Background(), Cards, "c1", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Allow(context.Background(), Cards, "c1", now); err != ErrLimited {
+		t.Errorf("Expected the second card limited, received %v", err)
+	}
+	if err := l.Allow(context.Background(), Addresses, "c1", now); err != nil {
+		t.Errorf("Expected operations without a limit allowed, received %v", err)
+	}
+	l.Store = failingStore{}
+	if err := l.Allow(context.Background(), Cards, "c1", now); err != nil {
+		t.Errorf("Expected writes allowed when the store fails, received %v", err)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	commands := make(chan []interface{}, 2)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for _, reply := range []string{"+OK\r\n", "*2\r\n:0\r\n:1500\r\n"} {
+			cmd, err := readReply(br)
+			if err != nil {
+				return
+			}
+			commands <- cmd.([]interface{})
+			c.Write([]byte(reply))
+		}
+	}()
+
+	r, err := NewRedis("redis://:secret@"+ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, wait, err := r.Take(context.Background(), "cards:c1", Limit{Count: 10, Per: time.Hour}, time.UnixMilli(1000))
+	if err != nil || ok || wait != 1500*time.Millisecond {
+		t.Errorf("Expected the write refused for 1.5s, received %v %v %v", ok, wait, err)
+	}
+	if auth := <-commands; auth[0] != "AUTH" || auth[1] != "secret" {
+		t.Errorf("Expected the password sent, received %v", auth)
+	}
+	if eval := <-commands; eval[0] != "EVAL" || eval[3] != "ratelimit:cards:c1" || eval[5] != "10" || eval[6] != "1000" {
+		t.Errorf("Expected the take script run on the bucket, received %v", eval)
+	}
+}
+
+func TestNewRedis(t *testing.T) {
+	r, err := NewRedis("redis://localhost", time.Second)
+	if err != nil || r.Addr != "localhost:6379" {
+		t.Errorf("Expected the default port, received %v %v", r, err)
+	}
+	for _, s := range []string{"localhost:6379", "http://localhost"} {
+		if _, err := NewRedis(s, time.Second); err == nil || !strings.Contains(err.Error(), "redis") {
+			t.Errorf("Expected %q refused, received %v", s, err)
+		}
+	}
+}
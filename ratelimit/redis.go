@@ -0,0 +1,196 @@
+package ratelimit
+
+// redis.go contains the Redis store, sharing buckets between replicas. It
+// speaks just enough of the Redis protocol to run the script taking tokens.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// takeScript refills and takes from the bucket hash KEYS[1] atomically.
+// ARGV are the refill rate per millisecond, the bucket size and the time in
+// milliseconds. Buckets expire once they would be full again.
+const takeScript = `
+local rate, size, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(b[1]) or size
+local last = tonumber(b[2]) or now
+tokens = math.min(size, tokens + math.max(0, now - last) * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(size / rate))
+return {allowed, wait}
+`
+
+// idleConns bounds the connections kept open between writes.
+const idleConns = 8
+
+// Redis keeps buckets in Redis under "ratelimit:" keys, so that replicas
+// share the limits.
+type Redis struct {
+	Addr     string
+	Password string
+	Timeout  time.Duration
+
+	idle chan net.Conn
+}
+
+// NewRedis returns a Redis store for a URL such as
+// redis://:password@localhost:6379, giving up on commands after timeout.
+func NewRedis(rawURL string, timeout time.Duration) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a redis:// URL", rawURL)
+	}
+	r := &Redis{Addr: u.Host, Timeout: timeout, idle: make(chan net.Conn, idleConns)}
+	if u.Port() == "" {
+		r.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.Password, _ = u.User.Password()
+	}
+	return r, nil
+}
+
+// Take implements Store.
+func (r *Redis) Take(ctx context.Context, key string, l Limit, now time.Time) (bool, time.Duration, error) {
+	reply, err := r.do(ctx, "EVAL", takeScript, "1", "ratelimit:"+key,
+		strconv.FormatFloat(l.perMilli(), 'f', -1, 64), strconv.Itoa(l.Count), strconv.FormatInt(now.UnixMilli(), 10))
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+// do runs a command on an idle connection, or a new one.
+func (r *Redis) do(ctx context.Context, args ...string) (interface{}, error) {
+	var c net.Conn
+	select {
+	case c = <-r.idle:
+	default:
+		var err error
+		if c, err = r.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.roundTrip(ctx, c, args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection may be left mid-reply.
+		c.Close()
+		return nil, err
+	}
+	select {
+	case r.idle <- c:
+	default:
+		c.Close()
+	}
+	return reply, err
+}
+
+func (r *Redis) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: r.Timeout}
+	c, err := d.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.Password != "" {
+		if _, err := r.roundTrip(ctx, c, "AUTH", r.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// roundTrip writes a command to c and reads its reply.
+func (r *Redis) roundTrip(ctx context.Context, c net.Conn, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(r.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+	return readReply(bufio.NewReader(c))
+}
+
+// redisError is an error reply, after which the connection can be reused.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readReply reads a reply: a string, an int64, nil or a slice of them.
+func readReply(br *bufio.Reader) (interface{}, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(br); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,155 @@
+// Package redact masks sensitive fields, such as passwords and card
+// numbers, in structured log lines and trace tags, so that a careless log
+// statement in an error path cannot leak them.
+//
+// Fields are matched by name, ignoring case and the separators "_", "-" and
+// ".", so "longNum" also matches "long_num" and "LONG-NUM".
+package redact
+
+import (
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// Mask replaces the values of sensitive fields.
+const Mask = "[REDACTED]"
+
+// DefaultFields are the fields masked unless others are configured.
+var DefaultFields = []string{
+	"password", "pass", "salt",
+	"longNum", "cardNumber", "cvv", "ccv",
+	"secret", "token", "authorization", "cookie",
+}
+
+// Fields is a set of sensitive field names.
+type Fields map[string]bool
+
+// NewFields returns the set of the named fields. Empty names are skipped.
+func NewFields(names []string) Fields {
+	f := make(Fields, len(names))
+	for _, n := range names {
+		if n = normalize(n); n != "" {
+			f[n] = true
+		}
+	}
+	return f
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", ".", "").Replace(strings.TrimSpace(name)))
+}
+
+// Sensitive reports whether the field named key is masked.
+func (f Fields) Sensitive(key string) bool {
+	return len(f) > 0 && f[normalize(key)]
+}
+
+// keyvals returns kvs with the values of sensitive keys masked, copying
+// them only if any is.
+func (f Fields) keyvals(kvs []interface{}) []interface{} {
+	out := kvs
+	for i := 0; i+1 < len(kvs); i += 2 {
+		key, ok := kvs[i].(string)
+		if !ok || !f.Sensitive(key) {
+			continue
+		}
+		if &out[0] == &kvs[0] {
+			out = append([]interface{}(nil), kvs...)
+		}
+		out[i+1] = Mask
+	}
+	return out
+}
+
+type logger struct {
+	next   log.Logger
+	fields Fields
+}
+
+// Logger returns a logger masking the values of sensitive keys before
+// passing lines to next. It should wrap the logger writing lines, beneath
+// any log.With context, so that context values are masked too.
+func Logger(next log.Logger, f Fields) log.Logger {
+	return logger{next: next, fields: f}
+}
+
+func (l logger) Log(keyvals ...interface{}) error {
+	return l.next.Log(l.fields.keyvals(keyvals)...)
+}
+
+type tracer struct {
+	opentracing.Tracer
+	fields Fields
+}
+
+// Tracer returns a tracer whose spans mask the values of sensitive tags and
+// log fields.
+func Tracer(next opentracing.Tracer, f Fields) opentracing.Tracer {
+	return &tracer{Tracer: next, fields: f}
+}
+
+func (t *tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var o opentracing.StartSpanOptions
+	for _, opt := range opts {
+		opt.Apply(&o)
+	}
+	masked := opentracing.Tags{}
+	for k := range o.Tags {
+		if t.fields.Sensitive(k) {
+			masked[k] = Mask
+		}
+	}
+	if len(masked) > 0 {
+		// Later options override earlier tags.
+		opts = append(opts, masked)
+	}
+	return span{Span: t.Tracer.StartSpan(operationName, opts...), tracer: t}
+}
+
+type span struct {
+	opentracing.Span
+	tracer *tracer
+}
+
+func (s span) SetTag(key string, value interface{}) opentracing.Span {
+	if s.tracer.fields.Sensitive(key) {
+		value = Mask
+	}
+	s.Span.SetTag(key, value)
+	return s
+}
+
+func (s span) LogFields(fields ...otlog.Field) {
+	out := fields
+	for i, f := range fields {
+		if !s.tracer.fields.Sensitive(f.Key()) {
+			continue
+		}
+		if &out[0] == &fields[0] {
+			out = append([]otlog.Field(nil), fields...)
+		}
+		out[i] = otlog.String(f.Key(), Mask)
+	}
+	s.Span.LogFields(out...)
+}
+
+func (s span) LogKV(keyvals ...interface{}) {
+	s.Span.LogKV(s.tracer.fields.keyvals(keyvals)...)
+}
+
+func (s span) SetOperationName(operationName string) opentracing.Span {
+	s.Span.SetOperationName(operationName)
+	return s
+}
+
+func (s span) SetBaggageItem(key, value string) opentracing.Span {
+	s.Span.SetBaggageItem(key, value)
+	return s
+}
+
+func (s span) Tracer() opentracing.Tracer {
+	return s.tracer
+}
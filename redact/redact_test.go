@@ -0,0 +1,83 @@
+package redact
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestSensitive(t *testing.T) {
+	f := NewFields(DefaultFields)
+	for key, want := range map[string]bool{
+		"password":  true,
+		"Password":  true,
+		"long_num":  true,
+		"LONG-NUM":  true,
+		"card.cvv":  false,
+		"cvv":       true,
+		"username":  false,
+		"passwords": false,
+	} {
+		if f.Sensitive(key) != want {
+			t.Errorf("Expected %q sensitive %v", key, want)
+		}
+	}
+	if NewFields([]string{"", " "}).Sensitive("") {
+		t.Error("Expected empty names skipped")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := Logger(log.NewLogfmtLogger(&buf), NewFields([]string{"password", "longNum"}))
+	l = log.With(l, "password", "context-secret")
+	kvs := []interface{}{"method", "Register", "LongNum", "4111111111111111", "odd"}
+	l.Log(kvs...)
+	s := buf.String()
+	if strings.Contains(s, "context-secret") || strings.Contains(s, "4111") {
+		t.Errorf("Expected sensitive values masked, received %q", s)
+	}
+	if !strings.Contains(s, "method=Register") || !strings.Contains(s, "LongNum="+Mask) {
+		t.Errorf("Expected other values kept and keys logged, received %q", s)
+	}
+	if kvs[3] != "4111111111111111" {
+		t.Error("Expected the caller's key values left unchanged")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	mock := mocktracer.New()
+	tr := Tracer(mock, NewFields([]string{"authorization", "token"}))
+	sp := tr.StartSpan("GET /customers", opentracing.Tags{"Authorization": "Bearer secret", "http.method": "GET"})
+	sp.SetTag("token", "secret").SetTag("user", "u1")
+	sp.LogFields(otlog.String("token", "secret"), otlog.Int("count", 2))
+	sp.LogKV("authorization", "secret", "event", "done")
+	child := tr.StartSpan("child", opentracing.ChildOf(sp.Context()))
+	child.SetTag("token", "secret")
+	child.Finish()
+	sp.Finish()
+
+	if sp.Tracer() != tr {
+		t.Error("Expected spans to report the redacting tracer")
+	}
+	spans := mock.FinishedSpans()
+	if len(spans) != 2 || spans[0].ParentID != spans[1].SpanContext.SpanID || spans[0].Tag("token") != Mask {
+		t.Fatalf("Expected the child span masked under its parent, received %+v", spans)
+	}
+	parent := spans[1]
+	if parent.Tag("Authorization") != Mask || parent.Tag("token") != Mask || parent.Tag("http.method") != "GET" || parent.Tag("user") != "u1" {
+		t.Errorf("Expected sensitive tags masked, received %v", parent.Tags())
+	}
+	for _, r := range parent.Logs() {
+		for _, f := range r.Fields {
+			if f.ValueString == "secret" {
+				t.Errorf("Expected sensitive log fields masked, received %+v", r.Fields)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package reporting sends server errors and panics to an error tracker,
+// such as Sentry, for triage.
+package reporting
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrQueueFull is returned by Queue.Report when reports are not keeping up.
+var ErrQueueFull = errors.New("error report queue is full")
+
+var Reported = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "error_reports_total",
+	Help: "Number of errors reported to the error tracker, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(Reported)
+}
+
+// Report is a server error or panic, with the request it was serving.
+// Customers are identified by a hash of their ID only.
+type Report struct {
+	// Type is the error code, or "panic".
+	Type    string
+	Message string
+	// Stack is the stack of panics.
+	Stack    []byte
+	Method   string
+	Route    string
+	Status   int
+	TraceID  string
+	UserHash string
+	Time     time.Time
+}
+
+// Reporter sends reports to an error tracker.
+type Reporter interface {
+	Report(ctx context.Context, r Report) error
+}
+
+// Queue sends reports through Reporter in the background, so that a slow
+// tracker or a burst of errors never holds up requests. Reports are dropped
+// while size of them are waiting.
+type Queue struct {
+	Reporter Reporter
+	Logger   log.Logger
+
+	queue chan Report
+}
+
+// NewQueue returns a Queue holding up to size reports.
+func NewQueue(r Reporter, size int, logger log.Logger) *Queue {
+	return &Queue{Reporter: r, Logger: logger, queue: make(chan Report, size)}
+}
+
+// Report implements Reporter, queueing r to be sent by Run.
+func (q *Queue) Report(ctx context.Context, r Report) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	select {
+	case q.queue <- r:
+		return nil
+	default:
+		Reported.WithLabelValues("dropped").Inc()
+		return ErrQueueFull
+	}
+}
+
+// Run sends queued reports until ctx is done.
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-q.queue:
+			if err := q.Reporter.Report(ctx, r); err != nil {
+				Reported.WithLabelValues("error").Inc()
+				q.Logger.Log("report", r.Type, "err", err)
+				continue
+			}
+			Reported.WithLabelValues("ok").Inc()
+		}
+	}
+}
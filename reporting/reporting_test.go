@@ -0,0 +1,84 @@
+package reporting
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestNewSentry(t *testing.T) {
+	s, err := NewSentry("https://key@o1.ingest.sentry.io/prefix/42", "production", "1.0", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.URL != "https://o1.ingest.sentry.io/prefix/api/42/store/" || s.Key != "key" {
+		t.Errorf("Expected the store endpoint and key, received %v %v", s.URL, s.Key)
+	}
+	for _, dsn := range []string{"o1.ingest.sentry.io/42", "https://o1.ingest.sentry.io/42", "https://key@o1.ingest.sentry.io/"} {
+		if _, err := NewSentry(dsn, "", "", time.Second); err == nil {
+			t.Errorf("Expected %q refused", dsn)
+		}
+	}
+}
+
+func TestSentryReport(t *testing.T) {
+	var auth string
+	var e sentryEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("X-Sentry-Auth")
+		json.NewDecoder(r.Body).Decode(&e)
+	}))
+	defer srv.Close()
+	s, err := NewSentry(strings.Replace(srv.URL, "//", "//key@", 1)+"/42", "production", "1.0", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Report(context.Background(), Report{Type: "panic", Message: "boom", Stack: []byte("main.go:1"), Method: "GET", Route: "customers_id", Status: 500, UserHash: "abc", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(auth, "sentry_key=key") {
+		t.Errorf("Expected the key sent, received %q", auth)
+	}
+	if e.Exception.Values[0].Value != "boom" || e.User.ID != "abc" || e.Request.URL != "customers_id" || e.Extra["stack"] != "main.go:1" || e.Environment != "production" {
+		t.Errorf("Expected the report as an event, received %+v", e)
+	}
+}
+
+type reports []Report
+
+func (rs *reports) Report(ctx context.Context, r Report) error {
+	*rs = append(*rs, r)
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	var sent reports
+	q := NewQueue(&sent, 1, log.NewNopLogger())
+	if err := q.Report(context.Background(), Report{Type: "INTERNAL_ERROR"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Report(context.Background(), Report{Type: "panic"}); err != ErrQueueFull {
+		t.Errorf("Expected the report dropped, received %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); len(q.queue) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if len(sent) != 1 || sent[0].Type != "INTERNAL_ERROR" || sent[0].Time.IsZero() {
+		t.Errorf("Expected the queued report sent, received %+v", sent)
+	}
+}
@@ -0,0 +1,150 @@
+package reporting
+
+// sentry.go contains the Sentry reporter, posting events to the store
+// endpoint of the project named by a DSN.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentry reports errors as Sentry events.
+type Sentry struct {
+	// URL is the project's store endpoint, and Key its public key.
+	URL         string
+	Key         string
+	Environment string
+	Release     string
+	Client      *http.Client
+}
+
+// NewSentry returns a Sentry reporting to the project of dsn, such as
+// https://key@o1.ingest.sentry.io/42, giving up on requests after timeout.
+func NewSentry(dsn, environment, release string, timeout time.Duration) (*Sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := path.Base(u.Path)
+	if u.Scheme == "" || u.Host == "" || u.User == nil || u.User.Username() == "" || project == "/" || project == "." {
+		return nil, fmt.Errorf("%q is not a Sentry DSN", dsn)
+	}
+	store := url.URL{Scheme: u.Scheme, Host: u.Host, Path: path.Join(path.Dir(u.Path), "api", project, "store") + "/"}
+	return &Sentry{
+		URL:         store.String(),
+		Key:         u.User.Username(),
+		Environment: environment,
+		Release:     release,
+		Client:      &http.Client{Timeout: timeout},
+	}, nil
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Transaction string            `json:"transaction,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Exception   sentryExceptions  `json:"exception"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+	User        *sentryUser       `json:"user,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sentryRequest struct {
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+type sentryUser struct {
+	ID string `json:"id"`
+}
+
+// event returns r as a Sentry event. Only the route of the request is sent,
+// as paths may carry customer IDs.
+func (s *Sentry) event(r Report) (sentryEvent, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return sentryEvent{}, err
+	}
+	e := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   r.Time.UTC().Format(time.RFC3339Nano),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "user",
+		Transaction: r.Route,
+		Environment: s.Environment,
+		Release:     s.Release,
+		Exception:   sentryExceptions{Values: []sentryException{{Type: r.Type, Value: r.Message}}},
+		Tags:        map[string]string{"status_code": strconv.Itoa(r.Status)},
+	}
+	if r.Method != "" || r.Route != "" {
+		e.Request = &sentryRequest{Method: r.Method, URL: r.Route}
+	}
+	if r.UserHash != "" {
+		e.User = &sentryUser{ID: r.UserHash}
+	}
+	if r.TraceID != "" {
+		e.Tags["trace_id"] = r.TraceID
+	}
+	if len(r.Stack) > 0 {
+		e.Level = "fatal"
+		e.Extra = map[string]string{"stack": string(r.Stack)}
+	}
+	return e, nil
+}
+
+// Report implements Reporter. Responses other than 2xx are errors.
+func (s *Sentry) Report(ctx context.Context, r Report) error {
+	e, err := s.event(r)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", strings.Join([]string{
+		"Sentry sentry_version=7",
+		"sentry_client=user/" + s.Release,
+		"sentry_key=" + s.Key,
+	}, ", "))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sentry returned %v", resp.Status)
+	}
+	return nil
+}
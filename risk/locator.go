@@ -0,0 +1,103 @@
+package risk
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+)
+
+var (
+	ErrInvalidLocation = errors.New("Invalid location record")
+)
+
+// Location is the approximate position of an IP address.
+type Location struct {
+	Country string
+	Lat     float64
+	Lon     float64
+}
+
+// Locator resolves IP addresses to locations.
+type Locator interface {
+	Locate(ip string) (Location, bool)
+}
+
+type network struct {
+	net *net.IPNet
+	loc Location
+}
+
+// NetworkLocator resolves addresses from a static list of networks. The
+// first network containing the address wins.
+type NetworkLocator struct {
+	networks []network
+}
+
+// NewNetworkLocator reads CSV records of the form cidr,country,lat,lon.
+func NewNetworkLocator(r io.Reader) (*NetworkLocator, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 4
+	cr.Comment = '#'
+	nl := &NetworkLocator{networks: make([]network, 0)}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nl, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, n, err := net.ParseCIDR(rec[0])
+		if err != nil {
+			return nil, ErrInvalidLocation
+		}
+		lat, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return nil, ErrInvalidLocation
+		}
+		lon, err := strconv.ParseFloat(rec[3], 64)
+		if err != nil {
+			return nil, ErrInvalidLocation
+		}
+		nl.networks = append(nl.networks, network{n, Location{Country: rec[1], Lat: lat, Lon: lon}})
+	}
+}
+
+// NewNetworkLocatorFile reads a NetworkLocator from the named CSV file.
+func NewNetworkLocatorFile(name string) (*NetworkLocator, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewNetworkLocator(f)
+}
+
+// Locate implements Locator.
+func (nl *NetworkLocator) Locate(ip string) (Location, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return Location{}, false
+	}
+	for _, n := range nl.networks {
+		if n.net.Contains(addr) {
+			return n.loc, true
+		}
+	}
+	return Location{}, false
+}
+
+// Distance returns the great-circle distance between a and b in km.
+func Distance(a, b Location) float64 {
+	const earthRadius = 6371
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLon := (b.Lon - a.Lon) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
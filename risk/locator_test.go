@@ -0,0 +1,52 @@
+package risk
+
+import (
+	"strings"
+	"testing"
+)
+
+const testNetworks = `# cidr,country,lat,lon
+10.1.0.0/16,NL,52.37,4.89
+10.2.0.0/16,NL,51.92,4.48
+10.3.0.0/16,US,40.71,-74.00
+`
+
+func TestNetworkLocator(t *testing.T) {
+	nl, err := NewNetworkLocator(strings.NewReader(testNetworks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := nl.Locate("10.3.4.5")
+	if !ok || loc.Country != "US" {
+		t.Errorf("Expected US location received %v", loc)
+	}
+	if _, ok := nl.Locate("192.168.0.1"); ok {
+		t.Error("Expected unknown network to be unresolved")
+	}
+	if _, ok := nl.Locate("garbage"); ok {
+		t.Error("Expected invalid address to be unresolved")
+	}
+}
+
+func TestNetworkLocatorInvalid(t *testing.T) {
+	_, err := NewNetworkLocator(strings.NewReader("10.0.0.0/33,NL,1,1\n"))
+	if err != ErrInvalidLocation {
+		t.Error("Expected invalid location error for bad cidr")
+	}
+	_, err = NewNetworkLocator(strings.NewReader("10.0.0.0/8,NL,north,1\n"))
+	if err != ErrInvalidLocation {
+		t.Error("Expected invalid location error for bad latitude")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	amsterdam := Location{Lat: 52.37, Lon: 4.89}
+	newYork := Location{Lat: 40.71, Lon: -74.00}
+	d := Distance(amsterdam, newYork)
+	if d < 5800 || d > 5900 {
+		t.Errorf("Expected roughly 5860km between Amsterdam and New York, received %v", d)
+	}
+	if Distance(amsterdam, amsterdam) != 0 {
+		t.Error("Expected zero distance to self")
+	}
+}
@@ -0,0 +1,188 @@
+package risk
+
+// risk.go evaluates login attempts for signs of account takeover. The
+// evaluator is pure: callers supply the login and the user's recent history.
+
+import (
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Decision is the outcome of evaluating a login.
+type Decision string
+
+const (
+	Allow     Decision = "allow"
+	Challenge Decision = "challenge"
+	Deny      Decision = "deny"
+)
+
+// Signals raised by the evaluator.
+const (
+	SignalNewCountry       = "new_country"
+	SignalImpossibleTravel = "impossible_travel"
+	SignalNewDevice        = "new_device"
+)
+
+var (
+	Decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "login_risk_decisions_total",
+		Help: "Number of evaluated logins by risk decision.",
+	}, []string{"decision"})
+)
+
+func init() {
+	prometheus.MustRegister(Decisions)
+}
+
+// Login is a successful credential check awaiting a risk decision.
+type Login struct {
+	UserID    string
+	Username  string
+	IP        string
+	UserAgent string
+	Time      time.Time
+	// Previous holds the user's earlier login attempts, newest first.
+	Previous []users.LoginAttempt
+	// Device is the fingerprint the client sent of its device, if any.
+	Device string
+}
+
+// Assessment is the result of evaluating a Login.
+type Assessment struct {
+	Login    Login
+	Signals  []string
+	Decision Decision
+}
+
+// Suspicious reports whether any signal was raised.
+func (a Assessment) Suspicious() bool {
+	return len(a.Signals) > 0
+}
+
+// Notifier is told about every suspicious login.
+type Notifier interface {
+	Notify(Assessment) error
+}
+
+// Evaluator scores logins and decides what to do with suspicious ones.
+type Evaluator struct {
+	// Action is the decision taken for suspicious logins.
+	Action Decision
+	// MaxSpeed is the fastest plausible travel speed in km/h.
+	MaxSpeed float64
+	Locator  Locator
+	Notifier Notifier
+}
+
+// NewEvaluator returns an Evaluator applying action to suspicious logins.
+func NewEvaluator(action Decision, locator Locator, notifier Notifier) *Evaluator {
+	return &Evaluator{
+		Action:   action,
+		MaxSpeed: 1000,
+		Locator:  locator,
+		Notifier: notifier,
+	}
+}
+
+// Evaluate checks l against the user's history and returns the decision.
+// Users without a successful login on record are always allowed.
+func (e *Evaluator) Evaluate(l Login) Assessment {
+	a := Assessment{Login: l, Signals: make([]string, 0), Decision: Allow}
+	previous := successful(l.Previous)
+	if len(previous) > 0 {
+		a.Signals = append(a.Signals, e.geoSignals(l, previous)...)
+		if !seenDevice(l, previous) {
+			a.Signals = append(a.Signals, SignalNewDevice)
+		}
+	}
+	if a.Suspicious() {
+		a.Decision = e.Action
+		if e.Notifier != nil {
+			e.Notifier.Notify(a)
+		}
+	}
+	Decisions.WithLabelValues(string(a.Decision)).Inc()
+	return a
+}
+
+func (e *Evaluator) geoSignals(l Login, previous []users.LoginAttempt) []string {
+	signals := make([]string, 0)
+	if e.Locator == nil {
+		return signals
+	}
+	current, ok := e.Locator.Locate(l.IP)
+	if !ok {
+		return signals
+	}
+	known := false
+	for _, p := range previous {
+		if loc, ok := e.Locator.Locate(p.IP); ok && loc.Country == current.Country {
+			known = true
+			break
+		}
+	}
+	if !known {
+		signals = append(signals, SignalNewCountry)
+	}
+	last, ok := e.Locator.Locate(previous[0].IP)
+	if ok {
+		hours := l.Time.Sub(previous[0].Time).Hours()
+		km := Distance(last, current)
+		if km > 0 && (hours <= 0 || km/hours > e.MaxSpeed) {
+			signals = append(signals, SignalImpossibleTravel)
+		}
+	}
+	return signals
+}
+
+func successful(attempts []users.LoginAttempt) []users.LoginAttempt {
+	s := make([]users.LoginAttempt, 0, len(attempts))
+	for _, a := range attempts {
+		if a.Success {
+			s = append(s, a)
+		}
+	}
+	return s
+}
+
+// seenDevice reports whether the login comes from a device the user logged
+// in from before. Devices are told apart by fingerprint where the login and
+// the history carry them, and by user agent otherwise, such as for history
+// recorded before clients sent fingerprints.
+func seenDevice(l Login, previous []users.LoginAttempt) bool {
+	byFingerprint := false
+	if l.Device != "" {
+		for _, p := range previous {
+			if p.Device != "" {
+				byFingerprint = true
+				break
+			}
+		}
+	}
+	for _, p := range previous {
+		if byFingerprint && p.Device == l.Device || !byFingerprint && p.UserAgent == l.UserAgent {
+			return true
+		}
+	}
+	return false
+}
+
+// LogNotifier logs suspicious logins.
+type LogNotifier struct {
+	Logger log.Logger
+}
+
+// Notify implements Notifier.
+func (n LogNotifier) Notify(a Assessment) error {
+	return n.Logger.Log(
+		"risk", "suspicious login",
+		"user", a.Login.UserID,
+		"ip", a.Login.IP,
+		"signals", len(a.Signals),
+		"decision", a.Decision,
+	)
+}
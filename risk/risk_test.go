@@ -0,0 +1,115 @@
+package risk
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/users"
+)
+
+type recordingNotifier struct {
+	assessments []Assessment
+}
+
+func (n *recordingNotifier) Notify(a Assessment) error {
+	n.assessments = append(n.assessments, a)
+	return nil
+}
+
+func testEvaluator(t *testing.T, action Decision) (*Evaluator, *recordingNotifier) {
+	nl, err := NewNetworkLocator(strings.NewReader(testNetworks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &recordingNotifier{}
+	return NewEvaluator(action, nl, n), n
+}
+
+func hasSignal(a Assessment, signal string) bool {
+	for _, s := range a.Signals {
+		if s == signal {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEvaluateFirstLogin(t *testing.T) {
+	e, n := testEvaluator(t, Deny)
+	a := e.Evaluate(Login{IP: "10.3.0.1", UserAgent: "a", Time: time.Now()})
+	if a.Decision != Allow || a.Suspicious() {
+		t.Error("Expected first login to be allowed")
+	}
+	if len(n.assessments) != 0 {
+		t.Error("Expected no notification")
+	}
+}
+
+func TestEvaluateKnownLogin(t *testing.T) {
+	e, _ := testEvaluator(t, Deny)
+	now := time.Now()
+	a := e.Evaluate(Login{IP: "10.1.0.1", UserAgent: "a", Time: now, Previous: []users.LoginAttempt{
+		{IP: "10.2.0.1", UserAgent: "a", Success: true, Time: now.Add(-24 * time.Hour)},
+	}})
+	if a.Decision != Allow {
+		t.Errorf("Expected known device and country to be allowed, received %v", a.Signals)
+	}
+}
+
+func TestEvaluateImpossibleTravel(t *testing.T) {
+	e, n := testEvaluator(t, Challenge)
+	now := time.Now()
+	a := e.Evaluate(Login{IP: "10.3.0.1", UserAgent: "b", Time: now, Previous: []users.LoginAttempt{
+		{IP: "10.3.0.9", UserAgent: "x", Success: false, Time: now.Add(-time.Minute)},
+		{IP: "10.1.0.1", UserAgent: "a", Success: true, Time: now.Add(-time.Hour)},
+	}})
+	if a.Decision != Challenge {
+		t.Errorf("Expected challenge decision, received %v", a.Decision)
+	}
+	for _, s := range []string{SignalNewCountry, SignalImpossibleTravel, SignalNewDevice} {
+		if !hasSignal(a, s) {
+			t.Errorf("Expected %v signal", s)
+		}
+	}
+	if len(n.assessments) != 1 {
+		t.Error("Expected suspicious login to be notified")
+	}
+}
+
+func TestEvaluateWithoutLocator(t *testing.T) {
+	e := NewEvaluator(Deny, nil, nil)
+	a := e.Evaluate(Login{IP: "10.3.0.1", UserAgent: "a", Time: time.Now(), Previous: []users.LoginAttempt{
+		{IP: "10.1.0.1", UserAgent: "a", Success: true, Time: time.Now()},
+	}})
+	if a.Suspicious() {
+		t.Error("Expected geo signals to be skipped without a locator")
+	}
+}
+
+func TestEvaluateDeviceFingerprint(t *testing.T) {
+	e, _ := testEvaluator(t, Challenge)
+	now := time.Now()
+	fingerprinted := []users.LoginAttempt{
+		{IP: "10.1.0.1", UserAgent: "a", Device: "d1", Success: true, Time: now.Add(-24 * time.Hour)},
+		{IP: "10.1.0.1", UserAgent: "b", Success: true, Time: now.Add(-48 * time.Hour)},
+	}
+	for _, c := range []struct {
+		login     Login
+		previous  []users.LoginAttempt
+		newDevice bool
+	}{
+		{Login{UserAgent: "c", Device: "d1"}, fingerprinted, false},
+		{Login{UserAgent: "a", Device: "d2"}, fingerprinted, true},
+		{Login{UserAgent: "b"}, fingerprinted, false},
+		// History recorded before fingerprints were sent is compared by
+		// user agent.
+		{Login{UserAgent: "b", Device: "d2"}, fingerprinted[1:], false},
+		{Login{UserAgent: "c", Device: "d2"}, fingerprinted[1:], true},
+	} {
+		c.login.IP, c.login.Time, c.login.Previous = "10.1.0.1", now, c.previous
+		if a := e.Evaluate(c.login); hasSignal(a, SignalNewDevice) != c.newDevice {
+			t.Errorf("%+v: expected new device %v, received %v", c.login, c.newDevice, a.Signals)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package scim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/events"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrQueueFull is returned by Client.Publish when pushes are not keeping up.
+// The users it drops are caught up by the next reconciliation.
+var ErrQueueFull = errors.New("SCIM push queue is full")
+
+var Pushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "scim_pushes_total",
+	Help: "Number of users pushed to downstream SCIM services, by target and result.",
+}, []string{"target", "result"})
+
+func init() {
+	prometheus.MustRegister(Pushes)
+}
+
+// queueSize bounds the users waiting to be pushed.
+const queueSize = 1000
+
+// Target is a downstream SCIM service users are pushed to.
+type Target struct {
+	// Name labels the target in logs and metrics.
+	Name string
+	// URL is the base of the service's endpoints, such as
+	// https://example.com/scim/v2.
+	URL string
+	// Token, if set, is sent as a bearer token.
+	Token string
+}
+
+// Client keeps the users of downstream SCIM services in step with this
+// service, as the source of truth. Pushed users carry their ID as their
+// externalId, by which they are found again; users of the target without
+// one are left alone.
+//
+// A push sends the user as currently stored rather than the change that
+// triggered it, so pushes can be retried and reordered safely.
+type Client struct {
+	Targets []Target
+	HTTP    *http.Client
+	// Retries bounds the further attempts to push a user after the first
+	// fails, waiting Backoff and doubling the wait each time.
+	Retries int
+	Backoff time.Duration
+	Logger  log.Logger
+
+	queue chan string
+}
+
+// NewClient returns a Client pushing users to targets, giving up on
+// requests after timeout.
+func NewClient(targets []Target, timeout time.Duration, logger log.Logger) *Client {
+	return &Client{
+		Targets: targets,
+		HTTP:    &http.Client{Timeout: timeout},
+		Retries: 5,
+		Backoff: time.Second,
+		Logger:  logger,
+		queue:   make(chan string, queueSize),
+	}
+}
+
+// Publish implements events.Publisher, queueing the subject of user events
+// to be pushed by Run.
+func (c *Client) Publish(ctx context.Context, e events.Event) error {
+	if !strings.HasPrefix(e.Type, "user.") {
+		return nil
+	}
+	select {
+	case c.queue <- e.Subject:
+		return nil
+	default:
+		for _, t := range c.Targets {
+			Pushes.WithLabelValues(t.Name, "dropped").Inc()
+		}
+		return ErrQueueFull
+	}
+}
+
+// Run pushes queued users to every target until ctx is done.
+func (c *Client) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-c.queue:
+			for _, t := range c.Targets {
+				c.pushRetrying(ctx, t, id)
+			}
+		}
+	}
+}
+
+func (c *Client) pushRetrying(ctx context.Context, t Target, id string) {
+	wait := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := c.Push(ctx, t, id)
+		if err == nil {
+			Pushes.WithLabelValues(t.Name, "ok").Inc()
+			return
+		}
+		if attempt == c.Retries || ctx.Err() != nil {
+			Pushes.WithLabelValues(t.Name, "failed").Inc()
+			c.Logger.Log("target", t.Name, "user", id, "attempts", attempt+1, "err", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// Push brings the target's copy of the user up to date, creating,
+// replacing or deleting it.
+func (c *Client) Push(ctx context.Context, t Target, id string) error {
+	u, err := db.GetUser(ctx, id)
+	gone := users.ErrorCode(err) == users.CodeUserNotFound
+	if err != nil && !gone {
+		return err
+	}
+	remote, err := c.find(ctx, t, id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case gone && remote == nil:
+		return nil
+	case gone:
+		return c.do(ctx, t, "DELETE", "/Users/"+remote.ID, nil, nil)
+	case remote == nil:
+		return c.do(ctx, t, "POST", "/Users", outbound(u), nil)
+	default:
+		return c.do(ctx, t, "PUT", "/Users/"+remote.ID, outbound(u), nil)
+	}
+}
+
+// Reconciliation counts the changes reconciling a target made.
+type Reconciliation struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Deleted int `json:"deleted"`
+	Failed  int `json:"failed"`
+}
+
+// Reconcile creates and updates the target's copies of every user, and
+// deletes those of users that no longer exist, catching up on pushes that
+// failed or were dropped. Users failing to push are counted, not returned.
+func (c *Client) Reconcile(ctx context.Context, t Target) (Reconciliation, error) {
+	var r Reconciliation
+	remote, err := c.list(ctx, t)
+	if err != nil {
+		return r, err
+	}
+	count := func(n *int, err error) {
+		if err != nil {
+			r.Failed++
+			c.Logger.Log("target", t.Name, "err", err)
+			return
+		}
+		*n++
+	}
+	err = db.ExportUsers(db.Query{}, "", func(u users.User, _ string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		want := outbound(u)
+		have, ok := remote[u.UserID]
+		delete(remote, u.UserID)
+		switch {
+		case !ok:
+			count(&r.Created, c.do(ctx, t, "POST", "/Users", want, nil))
+		case !same(have, want):
+			count(&r.Updated, c.do(ctx, t, "PUT", "/Users/"+have.ID, want, nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+	for _, have := range remote {
+		count(&r.Deleted, c.do(ctx, t, "DELETE", "/Users/"+have.ID, nil, nil))
+	}
+	return r, nil
+}
+
+// ReconcileJob reconciles every target. It takes no params.
+func ReconcileJob(c *Client) jobs.Handler {
+	return func(ctx context.Context, params json.RawMessage, progress func(jobs.Progress)) (map[string]interface{}, error) {
+		result := make(map[string]interface{}, len(c.Targets))
+		for k, t := range c.Targets {
+			r, err := c.Reconcile(ctx, t)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				result[t.Name] = err.Error()
+			} else {
+				result[t.Name] = r
+			}
+			progress(jobs.Progress{Done: k + 1, Total: len(c.Targets)})
+		}
+		return result, nil
+	}
+}
+
+// find returns the target's user with id as its externalId, or nil.
+func (c *Client) find(ctx context.Context, t Target, id string) (*User, error) {
+	filter := url.QueryEscape(`externalId eq ` + strconv.Quote(id))
+	var resp ListResponse
+	if err := c.do(ctx, t, "GET", "/Users?filter="+filter, nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, u := range resp.Resources {
+		if u.ExternalID == id {
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+// list returns the target's users with an externalId, by it.
+func (c *Client) list(ctx context.Context, t Target) (map[string]User, error) {
+	found := make(map[string]User)
+	for start := 1; ; {
+		var resp ListResponse
+		path := fmt.Sprintf("/Users?startIndex=%d&count=%d", start, defaultCount)
+		if err := c.do(ctx, t, "GET", path, nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, u := range resp.Resources {
+			if u.ExternalID != "" {
+				found[u.ExternalID] = u
+			}
+		}
+		n := len(resp.Resources)
+		if n == 0 || start+n > resp.TotalResults {
+			return found, nil
+		}
+		start += n
+	}
+}
+
+// do sends in to the target and decodes the response into out, if given.
+// Deleting a user that is already gone succeeds.
+func (c *Client) do(ctx context.Context, t Target, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(t.URL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if t.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if method == "DELETE" && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("SCIM target %v returned %v to %v %v", t.Name, resp.Status, method, path)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// outbound returns u as pushed to targets.
+func outbound(u users.User) User {
+	out := resource(u)
+	out.ID, out.ExternalID, out.Meta = "", u.UserID, nil
+	return out
+}
+
+// same reports whether the target's user has the attributes pushed.
+func same(have, want User) bool {
+	name := func(u User) Name {
+		if u.Name == nil {
+			return Name{}
+		}
+		return *u.Name
+	}
+	return have.UserName == want.UserName && name(have) == name(want) && primaryEmail(have.Emails) == primaryEmail(want.Emails)
+}
@@ -0,0 +1,268 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/events"
+	"github.com/mikesay/user/jobs"
+	"github.com/mikesay/user/users"
+)
+
+// downstream is a SCIM service keeping users in memory.
+type downstream struct {
+	mu    sync.Mutex
+	users map[string]User
+	next  int
+	// fail is the number of requests answered 503 before others succeed.
+	fail int
+}
+
+func newDownstream(t *testing.T, us ...User) (*downstream, Target) {
+	d := &downstream{users: map[string]User{}}
+	for _, u := range us {
+		d.users[u.ID] = u
+	}
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+	return d, Target{Name: "idp", URL: srv.URL + "/scim/v2/", Token: "secret"}
+}
+
+func (d *downstream) get(externalID string) (User, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, u := range d.users {
+		if u.ExternalID == externalID {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+func (d *downstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if d.fail > 0 {
+		d.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/scim/v2/Users/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/scim/v2/Users":
+		var ids []string
+		for id := range d.users {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		resp := ListResponse{Schemas: []string{ListSchema}, Resources: []User{}}
+		if f := r.URL.Query().Get("filter"); f != "" {
+			want, _ := strconv.Unquote(strings.TrimPrefix(f, "externalId eq "))
+			for _, id := range ids {
+				if d.users[id].ExternalID == want {
+					resp.Resources = append(resp.Resources, d.users[id])
+				}
+			}
+		} else {
+			start, _ := strconv.Atoi(r.URL.Query().Get("startIndex"))
+			for _, id := range ids[min(start-1, len(ids)):] {
+				resp.Resources = append(resp.Resources, d.users[id])
+			}
+		}
+		resp.TotalResults = len(resp.Resources)
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == "POST" && r.URL.Path == "/scim/v2/Users":
+		var u User
+		json.NewDecoder(r.Body).Decode(&u)
+		d.next++
+		u.ID = fmt.Sprintf("r%d", d.next)
+		d.users[u.ID] = u
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(u)
+	case r.Method == "PUT" || r.Method == "DELETE":
+		if _, ok := d.users[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(d.users, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var u User
+		json.NewDecoder(r.Body).Decode(&u)
+		u.ID = id
+		d.users[id] = u
+		json.NewEncoder(w).Encode(u)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// localDB holds the source of truth in memory.
+type localDB struct {
+	db.Database
+	mu    sync.Mutex
+	users map[string]users.User
+}
+
+func useLocalDB(t *testing.T, us ...users.User) *localDB {
+	d := &localDB{users: map[string]users.User{}}
+	for _, u := range us {
+		d.users[u.UserID] = u
+	}
+	prev := db.DefaultDb
+	db.DefaultDb = d
+	t.Cleanup(func() { db.DefaultDb = prev })
+	return d
+}
+
+func (d *localDB) GetUser(id string) (users.User, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u, ok := d.users[id]
+	if !ok {
+		return users.User{}, users.ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (d *localDB) ExportUsers(q db.Query, cursor string, f func(users.User, string) error) error {
+	var ids []string
+	for id := range d.users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := f(d.users[id], id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPush(t *testing.T) {
+	local := useLocalDB(t, users.User{UserID: "u1", Username: "alice", FirstName: "Alice", Email: "a@example.com"})
+	remote, target := newDownstream(t)
+	c := NewClient([]Target{target}, time.Second, log.NewNopLogger())
+	ctx := context.Background()
+
+	if err := c.Push(ctx, target, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := remote.get("u1")
+	if !ok || u.UserName != "alice" || u.Name.GivenName != "Alice" || u.Emails[0].Value != "a@example.com" {
+		t.Fatalf("Expected alice created, received %+v", remote.users)
+	}
+
+	local.users["u1"] = users.User{UserID: "u1", Username: "alice", FirstName: "Alice", Email: "alice@example.com"}
+	if err := c.Push(ctx, target, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := remote.get("u1"); u.ID != "r1" || u.Emails[0].Value != "alice@example.com" || len(remote.users) != 1 {
+		t.Errorf("Expected alice replaced, received %+v", remote.users)
+	}
+
+	delete(local.users, "u1")
+	for i := 0; i < 2; i++ {
+		if err := c.Push(ctx, target, "u1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(remote.users) != 0 {
+		t.Errorf("Expected alice deleted, received %+v", remote.users)
+	}
+
+	target.Token = "guess"
+	if err := c.Push(ctx, target, "u1"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the refusal returned, received %v", err)
+	}
+}
+
+func TestRunRetries(t *testing.T) {
+	useLocalDB(t, users.User{UserID: "u1", Username: "alice"})
+	remote, target := newDownstream(t)
+	remote.fail = 2
+	c := NewClient([]Target{target}, time.Second, log.NewNopLogger())
+	c.Backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	c.Publish(ctx, events.Event{Type: events.CardFlagged, Subject: "c1"})
+	if err := c.Publish(ctx, events.Event{Type: events.UserCreated, Subject: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := remote.get("u1"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected alice pushed after the failures")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(c.queue) != 0 {
+		t.Errorf("Expected card events not queued, received %v", len(c.queue))
+	}
+}
+
+func TestPublishQueueFull(t *testing.T) {
+	c := NewClient(nil, time.Second, log.NewNopLogger())
+	for i := 0; i < queueSize; i++ {
+		c.Publish(context.Background(), events.Event{Type: events.UserUpdated, Subject: "u1"})
+	}
+	if err := c.Publish(context.Background(), events.Event{Type: events.UserUpdated, Subject: "u1"}); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, received %v", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	useLocalDB(t,
+		users.User{UserID: "u1", Username: "alice", FirstName: "Alice"},
+		users.User{UserID: "u2", Username: "bob"},
+		users.User{UserID: "u3", Username: "carol"},
+	)
+	remote, target := newDownstream(t,
+		User{ID: "a", ExternalID: "u1", UserName: "alice", Name: &Name{GivenName: "Alicia"}},
+		User{ID: "b", ExternalID: "u9", UserName: "gone"},
+		User{ID: "c", UserName: "manual"},
+		User{ID: "d", ExternalID: "u3", UserName: "carol", Name: &Name{}},
+	)
+	c := NewClient([]Target{target}, time.Second, log.NewNopLogger())
+
+	r, err := c.Reconcile(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != (Reconciliation{Created: 1, Updated: 1, Deleted: 1}) {
+		t.Errorf("Expected bob created, alice updated and u9 deleted, received %+v", r)
+	}
+	if u, _ := remote.get("u1"); u.Name.GivenName != "Alice" {
+		t.Errorf("Expected alice's name restored, received %+v", u)
+	}
+	if _, ok := remote.users["c"]; !ok {
+		t.Errorf("Expected users without an externalId left alone, received %+v", remote.users)
+	}
+
+	result, err := ReconcileJob(c)(context.Background(), nil, func(jobs.Progress) {})
+	if err != nil || result["idp"] != (Reconciliation{}) {
+		t.Errorf("Expected nothing left to reconcile, received %v %v", result, err)
+	}
+}
@@ -0,0 +1,499 @@
+// Package scim serves the SCIM 2.0 Users endpoints (RFC 7643, RFC 7644) on
+// top of the service, so that corporate identity providers such as Okta and
+// Azure AD can provision customers and deprovision them when they leave.
+//
+// Users can be created, read, listed, filtered by userName, patched and
+// deleted. Patches replace names and the email; setting active to false
+// deletes the customer, as the service has no notion of a suspended account,
+// and deletes are confirmed on the identity provider's behalf. Users are
+// always reported active.
+//
+// Client pushes users the other way, to downstream SCIM services, where
+// this service is the source of truth.
+package scim
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikesay/user/api"
+	"github.com/mikesay/user/clock"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// Prefix is the path the endpoints are served under.
+const Prefix = "/scim/v2/"
+
+// Schema URNs.
+const (
+	UserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	ListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+const (
+	contentType = "application/scim+json"
+	// defaultCount and maxCount bound the users listed per page.
+	defaultCount = 100
+	maxCount     = 1000
+)
+
+// filterPattern matches the one filter supported, an exact userName.
+var filterPattern = regexp.MustCompile(`(?i)^\s*userName\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// User is a customer as a SCIM User resource.
+type User struct {
+	Schemas []string `json:"schemas"`
+	ID      string   `json:"id,omitempty"`
+	// ExternalID is the user's ID in the provisioning system. Users pushed
+	// by Client carry their ID here; the endpoints ignore it.
+	ExternalID string  `json:"externalId,omitempty"`
+	UserName   string  `json:"userName"`
+	Name       *Name   `json:"name,omitempty"`
+	Emails     []Email `json:"emails,omitempty"`
+	// Password is only read, when creating users. Users created without
+	// one get a random password, and sign in through the identity provider.
+	Password string `json:"password,omitempty"`
+	Active   *bool  `json:"active,omitempty"`
+	Meta     *Meta  `json:"meta,omitempty"`
+}
+
+type Name struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created,omitzero"`
+	LastModified time.Time `json:"lastModified,omitzero"`
+	Location     string    `json:"location"`
+}
+
+// ListResponse is a page of users.
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []User   `json:"Resources"`
+}
+
+// PatchRequest is a list of patch operations.
+type PatchRequest struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+// Operation adds, replaces or removes the attribute at Path. Without a
+// path, Value maps attribute paths to their values.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Error is a SCIM error response.
+type Error struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}{[]string{ErrorSchema}, strconv.Itoa(e.Status), e.ScimType, e.Detail})
+}
+
+func badRequest(scimType, format string, a ...interface{}) *Error {
+	return &Error{Status: http.StatusBadRequest, ScimType: scimType, Detail: fmt.Sprintf(format, a...)}
+}
+
+type handler struct {
+	service api.Service
+	rng     clock.RNG
+}
+
+// NewHandler serves the Users endpoints under Prefix. Passwords of users
+// created without one are read from rng, or clock.Random if it is nil.
+func NewHandler(s api.Service, rng clock.RNG) http.Handler {
+	h := handler{service: s, rng: rng}
+	r := mux.NewRouter()
+	r.Methods("POST").Path(Prefix + "Users").HandlerFunc(h.create)
+	r.Methods("GET").Path(Prefix + "Users").HandlerFunc(h.list)
+	r.Methods("GET").Path(Prefix + "Users/{id}").HandlerFunc(h.get)
+	r.Methods("PATCH").Path(Prefix + "Users/{id}").HandlerFunc(h.patch)
+	r.Methods("DELETE").Path(Prefix + "Users/{id}").HandlerFunc(h.delete)
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, &Error{Status: http.StatusNotFound, Detail: "No such endpoint"})
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, &Error{Status: http.StatusMethodNotAllowed, Detail: "Method not allowed"})
+	})
+	return r
+}
+
+func (h handler) create(w http.ResponseWriter, r *http.Request) {
+	var in User
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, badRequest("invalidSyntax", "%v", err))
+		return
+	}
+	if in.UserName == "" {
+		writeError(w, badRequest("invalidValue", "userName is required"))
+		return
+	}
+	if in.Active != nil && !*in.Active {
+		writeError(w, badRequest("invalidValue", "Users cannot be created inactive"))
+		return
+	}
+	existing, err := h.findByUserName(r, in.UserName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(existing) > 0 {
+		writeError(w, &Error{Status: http.StatusConflict, ScimType: "uniqueness", Detail: "userName is already taken"})
+		return
+	}
+	u := users.User{Username: in.UserName, Password: in.Password}
+	if in.Name != nil {
+		u.FirstName, u.LastName = in.Name.GivenName, in.Name.FamilyName
+	}
+	u.Email = primaryEmail(in.Emails)
+	if u.Password == "" {
+		u.Password = hex.EncodeToString(clock.Bytes(h.rng, 32))
+	}
+	id, err := h.service.PostUser(r.Context(), u)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	out, err := h.user(r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", out.Meta.Location)
+	writeJSON(w, http.StatusCreated, out)
+}
+
+func (h handler) get(w http.ResponseWriter, r *http.Request) {
+	u, err := h.user(r, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+// list pages through users, or finds the one matching a userName filter.
+// The service cannot count users cheaply, so totalResults counts those up
+// to the end of the page, plus one if more follow; clients paging until
+// they pass totalResults read every user.
+func (h handler) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, err := queryInt(q.Get("startIndex"), 1)
+	if err != nil {
+		writeError(w, badRequest("invalidValue", "startIndex must be a number"))
+		return
+	}
+	count, err := queryInt(q.Get("count"), defaultCount)
+	if err != nil {
+		writeError(w, badRequest("invalidValue", "count must be a number"))
+		return
+	}
+	start = max(start, 1)
+	count = min(max(count, 0), maxCount)
+	if db.MaxListDecoded > 0 {
+		// The page and the user showing more follow are read at once.
+		count = min(count, db.MaxListDecoded-1)
+	}
+
+	var found []users.User
+	total := 0
+	if f := q.Get("filter"); f != "" {
+		m := filterPattern.FindStringSubmatch(f)
+		if m == nil {
+			writeError(w, badRequest("invalidFilter", "Only userName eq filters are supported"))
+			return
+		}
+		userName, err := strconv.Unquote(`"` + m[1] + `"`)
+		if err != nil {
+			writeError(w, badRequest("invalidFilter", "%v", err))
+			return
+		}
+		if found, err = h.findByUserName(r, userName); err != nil {
+			writeError(w, err)
+			return
+		}
+		total = len(found)
+		found = found[min(start-1, len(found)):]
+		found = found[:min(count, len(found))]
+	} else {
+		found, err = h.service.GetUsers(r.Context(), "", db.ListOptions{Offset: start - 1, Limit: count + 1})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		total = start - 1 + len(found)
+		found = found[:min(count, len(found))]
+	}
+
+	resp := ListResponse{
+		Schemas:      []string{ListSchema},
+		TotalResults: total,
+		StartIndex:   start,
+		ItemsPerPage: len(found),
+		Resources:    make([]User, 0, len(found)),
+	}
+	for _, u := range found {
+		resp.Resources = append(resp.Resources, resource(u))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// patch applies the operations to the user's names and email. Setting
+// active to false deletes the user instead.
+func (h handler) patch(w http.ResponseWriter, r *http.Request) {
+	var req PatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, badRequest("invalidSyntax", "%v", err))
+		return
+	}
+	id := mux.Vars(r)["id"]
+	us, err := h.service.GetUsers(r.Context(), id, db.ListOptions{})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	p := patch{user: us[0], active: true}
+	for _, op := range req.Operations {
+		if err := p.apply(op); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if !p.active {
+		if err := h.deleteUser(r, id); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if p.changed {
+		if err := h.service.UpdateProfile(r.Context(), p.user); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	h.get(w, r)
+}
+
+func (h handler) delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.deleteUser(r, mux.Vars(r)["id"]); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUser deletes the customer, confirming the delete itself when the
+// service requires confirmation: identity providers deprovision without a
+// person to confirm, so access to the endpoints, restricted to admins, is
+// taken as confirmation. Deployments requiring every delete to be
+// confirmed by hand should not enable SCIM.
+func (h handler) deleteUser(r *http.Request, id string) error {
+	plan, err := h.service.PlanDelete(r.Context(), "customers", id)
+	if err != nil {
+		return err
+	}
+	return h.service.Delete(r.Context(), "customers", id, plan.Token)
+}
+
+func (h handler) user(r *http.Request, id string) (User, error) {
+	us, err := h.service.GetUsers(r.Context(), id, db.ListOptions{})
+	if err != nil {
+		return User{}, err
+	}
+	return resource(us[0]), nil
+}
+
+// findByUserName returns the users whose username is userName once
+// normalized, as logins look them up.
+func (h handler) findByUserName(r *http.Request, userName string) ([]users.User, error) {
+	return h.service.SearchUsers(r.Context(), db.Query{Username: userName})
+}
+
+// patch is a user being patched.
+type patch struct {
+	user    users.User
+	active  bool
+	changed bool
+}
+
+func (p *patch) apply(op Operation) error {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+		if op.Path != "" {
+			return p.set(op.Path, op.Value)
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return badRequest("invalidValue", "Operations without a path need an object value")
+		}
+		for path, v := range values {
+			if err := p.set(path, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "remove":
+		switch strings.ToLower(op.Path) {
+		case "name.givenname":
+			p.user.FirstName = ""
+		case "name.familyname":
+			p.user.LastName = ""
+		case "emails", `emails[type eq "work"].value`:
+			p.user.Email = ""
+		default:
+			return badRequest("noTarget", "%q cannot be removed", op.Path)
+		}
+		p.changed = true
+		return nil
+	}
+	return badRequest("invalidSyntax", "Unknown op %q", op.Op)
+}
+
+func (p *patch) set(path string, v json.RawMessage) error {
+	var err error
+	switch strings.ToLower(path) {
+	case "name.givenname":
+		err = json.Unmarshal(v, &p.user.FirstName)
+	case "name.familyname":
+		err = json.Unmarshal(v, &p.user.LastName)
+	case "name":
+		var n Name
+		if err = json.Unmarshal(v, &n); err == nil {
+			p.user.FirstName, p.user.LastName = n.GivenName, n.FamilyName
+		}
+	case "emails":
+		var es []Email
+		if err = json.Unmarshal(v, &es); err == nil {
+			p.user.Email = primaryEmail(es)
+		}
+	case `emails[type eq "work"].value`:
+		err = json.Unmarshal(v, &p.user.Email)
+	case "active":
+		p.active, err = parseBool(v)
+		return err
+	default:
+		return badRequest("invalidPath", "%q cannot be patched", path)
+	}
+	if err != nil {
+		return badRequest("invalidValue", "%v: %v", path, err)
+	}
+	p.changed = true
+	return nil
+}
+
+// parseBool reads a JSON boolean, or a string such as "False" as Azure AD
+// sends.
+func parseBool(v json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b, nil
+		}
+	}
+	return false, badRequest("invalidValue", "active must be a boolean")
+}
+
+// primaryEmail returns the primary email, or the first if none is primary.
+func primaryEmail(es []Email) string {
+	for _, e := range es {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(es) > 0 {
+		return es[0].Value
+	}
+	return ""
+}
+
+// resource returns u as a SCIM User.
+func resource(u users.User) User {
+	active := true
+	out := User{
+		Schemas:  []string{UserSchema},
+		ID:       u.UserID,
+		UserName: u.Username,
+		Name:     &Name{GivenName: u.FirstName, FamilyName: u.LastName},
+		Active:   &active,
+		Meta: &Meta{
+			ResourceType: "User",
+			Created:      u.CreatedAt,
+			LastModified: u.UpdatedAt,
+			Location:     Prefix + "Users/" + u.UserID,
+		},
+	}
+	if u.Email != "" {
+		out.Emails = []Email{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	return out
+}
+
+func queryInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as a SCIM error. Service errors keep the status the
+// API answers them with.
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Status: api.ErrorStatus(err), Detail: err.Error()}
+		if users.ErrorCode(err) == users.CodeIDConflict {
+			e.ScimType = "uniqueness"
+		}
+	}
+	writeJSON(w, e.Status, e)
+}
@@ -0,0 +1,238 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mikesay/user/api"
+	"github.com/mikesay/user/db"
+	"github.com/mikesay/user/users"
+)
+
+// fakeService keeps users in memory, keyed by ID.
+type fakeService struct {
+	api.Service
+	users   map[string]users.User
+	deleted []string
+}
+
+func newFakeService(us ...users.User) *fakeService {
+	s := &fakeService{users: map[string]users.User{}}
+	for _, u := range us {
+		s.users[u.UserID] = u
+	}
+	return s
+}
+
+func (s *fakeService) ids() []string {
+	var ids []string
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *fakeService) GetUsers(ctx context.Context, id string, l db.ListOptions) ([]users.User, error) {
+	if id != "" {
+		u, ok := s.users[id]
+		if !ok {
+			return nil, users.ErrUserNotFound
+		}
+		return []users.User{u}, nil
+	}
+	var us []users.User
+	for _, id := range s.ids()[min(l.Offset, len(s.users)):] {
+		if l.Limit > 0 && len(us) == l.Limit {
+			break
+		}
+		us = append(us, s.users[id])
+	}
+	return us, nil
+}
+
+func (s *fakeService) SearchUsers(ctx context.Context, q db.Query) ([]users.User, error) {
+	var us []users.User
+	for _, id := range s.ids() {
+		name := strings.ToLower(s.users[id].Username)
+		if q.Username != "" && name == strings.ToLower(q.Username) || q.Username == "" && strings.HasPrefix(name, strings.ToLower(q.UsernamePrefix)) {
+			us = append(us, s.users[id])
+		}
+	}
+	return us, nil
+}
+
+func (s *fakeService) PostUser(ctx context.Context, u users.User) (string, error) {
+	if u.Password == "" {
+		return "", users.NewError(users.CodeMissingField, "Missing password")
+	}
+	u.UserID = fmt.Sprintf("u%d", len(s.users)+1)
+	s.users[u.UserID] = u
+	return u.UserID, nil
+}
+
+func (s *fakeService) UpdateProfile(ctx context.Context, u users.User) error {
+	if _, ok := s.users[u.UserID]; !ok {
+		return users.ErrUserNotFound
+	}
+	s.users[u.UserID] = u
+	return nil
+}
+
+func (s *fakeService) PlanDelete(ctx context.Context, entity, id string) (api.DeletePlan, error) {
+	return api.DeletePlan{Entity: entity, ID: id, Token: "token-" + id}, nil
+}
+
+func (s *fakeService) Delete(ctx context.Context, entity, id, confirm string) error {
+	if confirm != "token-"+id {
+		return api.ErrConfirmationRequired
+	}
+	if _, ok := s.users[id]; !ok {
+		return users.ErrUserNotFound
+	}
+	delete(s.users, id)
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestCreate(t *testing.T) {
+	s := newFakeService(users.User{UserID: "u1", Username: "Alice"})
+	h := NewHandler(s, strings.NewReader(strings.Repeat("x", 32)))
+
+	w := do(h, "POST", Prefix+"Users", `{"schemas":["`+UserSchema+`"],"userName":"bob","name":{"givenName":"Bob","familyName":"Smith"},"emails":[{"value":"home@example.com"},{"value":"bob@example.com","primary":true}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, received %v %v", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != contentType || w.Header().Get("Location") != Prefix+"Users/u2" {
+		t.Errorf("Expected a SCIM response locating u2, received %v", w.Header())
+	}
+	var u User
+	json.NewDecoder(w.Body).Decode(&u)
+	if u.ID != "u2" || u.UserName != "bob" || u.Name.GivenName != "Bob" || u.Emails[0].Value != "bob@example.com" || !*u.Active {
+		t.Errorf("Expected bob created, received %+v", u)
+	}
+	if s.users["u2"].Password != strings.Repeat("78", 32) {
+		t.Errorf("Expected a random password, received %q", s.users["u2"].Password)
+	}
+
+	w = do(h, "POST", Prefix+"Users", `{"userName":"alice"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"scimType":"uniqueness"`) {
+		t.Errorf("Expected a taken userName refused, received %v %v", w.Code, w.Body)
+	}
+	w = do(h, "POST", Prefix+"Users", `{"name":{"givenName":"Nobody"}}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"status":"400"`) {
+		t.Errorf("Expected a missing userName refused, received %v %v", w.Code, w.Body)
+	}
+}
+
+func TestList(t *testing.T) {
+	s := newFakeService()
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprintf("u%d", i)
+		s.users[id] = users.User{UserID: id, Username: "user" + id}
+	}
+	h := NewHandler(s, nil)
+
+	for _, c := range []struct {
+		query        string
+		ids          string
+		total, start int
+	}{
+		{"", "u1 u2 u3 u4 u5", 5, 1},
+		{"?startIndex=2&count=2", "u2 u3", 4, 2},
+		{"?startIndex=5&count=2", "u5", 5, 5},
+		{"?startIndex=9", "", 8, 9},
+		{"?count=0", "", 1, 1},
+		{`?filter=userName+eq+"USERU3"`, "u3", 1, 1},
+		{`?filter=userName+eq+"nobody"`, "", 0, 1},
+	} {
+		w := do(h, "GET", Prefix+"Users"+c.query, "")
+		var resp ListResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		var ids []string
+		for _, u := range resp.Resources {
+			ids = append(ids, u.ID)
+		}
+		if w.Code != http.StatusOK || strings.Join(ids, " ") != c.ids || resp.TotalResults != c.total || resp.StartIndex != c.start || resp.ItemsPerPage != len(ids) {
+			t.Errorf("%v: expected %q of %v from %v, received %v %+v", c.query, c.ids, c.total, c.start, w.Code, resp)
+		}
+	}
+
+	defer func(m int) { db.MaxListDecoded = m }(db.MaxListDecoded)
+	db.MaxListDecoded = 3
+	var resp ListResponse
+	json.NewDecoder(do(h, "GET", Prefix+"Users?count=5", "").Body).Decode(&resp)
+	if resp.ItemsPerPage != 2 || resp.TotalResults != 3 {
+		t.Errorf("Expected pages kept under the list cap with more results reported, received %+v", resp)
+	}
+
+	for _, q := range []string{`?filter=emails+eq+"a@example.com"`, "?count=many"} {
+		if w := do(h, "GET", Prefix+"Users"+q, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, received %v %v", q, w.Code, w.Body)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	h := NewHandler(newFakeService(users.User{UserID: "u1", Username: "alice", Email: "a@example.com"}), nil)
+	w := do(h, "GET", Prefix+"Users/u1", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"emails":[{"value":"a@example.com","type":"work","primary":true}]`) {
+		t.Errorf("Expected alice, received %v %v", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "password") {
+		t.Errorf("Expected no password, received %v", w.Body)
+	}
+	w = do(h, "GET", Prefix+"Users/u9", "")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), ErrorSchema) {
+		t.Errorf("Expected a SCIM 404, received %v %v", w.Code, w.Body)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	s := newFakeService(users.User{UserID: "u1", Username: "alice", FirstName: "Alice", LastName: "Jones", Email: "a@example.com"})
+	h := NewHandler(s, nil)
+
+	w := do(h, "PATCH", Prefix+"Users/u1", `{"schemas":["`+PatchSchema+`"],"Operations":[
+		{"op":"Replace","path":"name.familyName","value":"Smith"},
+		{"op":"replace","value":{"emails":[{"value":"alice@example.com","primary":true}],"active":true}}]}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"familyName":"Smith"`) {
+		t.Errorf("Expected alice patched, received %v %v", w.Code, w.Body)
+	}
+	if u := s.users["u1"]; u.FirstName != "Alice" || u.LastName != "Smith" || u.Email != "alice@example.com" {
+		t.Errorf("Expected the profile updated, received %+v", u)
+	}
+
+	w = do(h, "PATCH", Prefix+"Users/u1", `{"Operations":[{"op":"replace","path":"userName","value":"bob"}]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"scimType":"invalidPath"`) {
+		t.Errorf("Expected a userName patch refused, received %v %v", w.Code, w.Body)
+	}
+
+	// Azure AD sends booleans as strings.
+	w = do(h, "PATCH", Prefix+"Users/u1", `{"Operations":[{"op":"Replace","path":"active","value":"False"}]}`)
+	if w.Code != http.StatusNoContent || len(s.deleted) != 1 {
+		t.Errorf("Expected alice deprovisioned, received %v %v %v", w.Code, w.Body, s.deleted)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := newFakeService(users.User{UserID: "u1", Username: "alice"})
+	h := NewHandler(s, nil)
+	if w := do(h, "DELETE", Prefix+"Users/u1", ""); w.Code != http.StatusNoContent || len(s.users) != 0 {
+		t.Errorf("Expected alice deleted, received %v %v", w.Code, w.Body)
+	}
+	if w := do(h, "DELETE", Prefix+"Users/u1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, received %v %v", w.Code, w.Body)
+	}
+}
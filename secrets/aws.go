@@ -0,0 +1,69 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mikesay/user/sigv4"
+)
+
+// AWS reads credentials from an AWS Secrets Manager secret whose string is
+// a JSON object holding username and password. Requests are signed with
+// Signature Version 4.
+type AWS struct {
+	Region   string
+	SecretID string
+	// Endpoint defaults to the regional Secrets Manager endpoint.
+	Endpoint string
+	Auth     sigv4.Credentials
+	Client   *http.Client
+}
+
+// NewAWS returns an AWS provider authenticating with the standard AWS
+// environment variables.
+func NewAWS(region, secretID string) *AWS {
+	return &AWS{
+		Region:   region,
+		SecretID: secretID,
+		Endpoint: fmt.Sprintf("https://secretsmanager.%v.amazonaws.com/", region),
+		Auth:     sigv4.FromEnv(),
+	}
+}
+
+func (a *AWS) Credentials(ctx context.Context) (Credentials, error) {
+	body, _ := json.Marshal(map[string]string{"SecretId": a.SecretID})
+	req, err := http.NewRequestWithContext(ctx, "POST", a.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	a.Auth.Sign(req, body, a.Region, "secretsmanager", time.Now())
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("secrets manager: reading %v: %v", a.SecretID, res.Status)
+	}
+	var secret struct {
+		SecretString string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return Credentials{}, err
+	}
+	var c Credentials
+	if err := json.Unmarshal([]byte(secret.SecretString), &c); err != nil {
+		return Credentials{}, err
+	}
+	return check(c)
+}
@@ -0,0 +1,149 @@
+// Package secrets reads database credentials from where the deployment keeps
+// them: mounted files, HashiCorp Vault or AWS Secrets Manager.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoCredentials = errors.New("Secret holds no username or password")
+)
+
+// Credentials authenticate with a database.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Provider returns the current credentials. Providers are read again
+// periodically, so credentials rotated at the source are picked up.
+type Provider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+var (
+	provider     = os.Getenv("SECRETS_PROVIDER")
+	usernameFile = env("SECRETS_USERNAME_FILE", "/etc/secrets/username")
+	passwordFile = env("SECRETS_PASSWORD_FILE", "/etc/secrets/password")
+	vaultPath    = os.Getenv("VAULT_SECRET_PATH")
+	awsSecretID  = os.Getenv("AWS_SECRET_ID")
+	// RotateInterval is how often credentials are read again. Zero reads
+	// them once.
+	RotateInterval = envDuration("SECRETS_ROTATE_INTERVAL", 5*time.Minute)
+)
+
+// RegisterFlags registers the flags selecting and configuring the provider
+// on fs. The environment sets their defaults.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&provider, "secrets-provider", provider, "Where database credentials are read from: file, vault or aws. Empty uses -mongo-user and -mongo-password")
+	fs.StringVar(&usernameFile, "secrets-username-file", usernameFile, "File holding the database username, for the file provider")
+	fs.StringVar(&passwordFile, "secrets-password-file", passwordFile, "File holding the database password, for the file provider")
+	fs.StringVar(&vaultPath, "vault-secret-path", vaultPath, "Vault path of the secret holding username and password, such as secret/data/user-db. VAULT_ADDR and VAULT_TOKEN locate Vault")
+	fs.StringVar(&awsSecretID, "aws-secret-id", awsSecretID, "Secrets Manager secret holding username and password as JSON. AWS_REGION and the AWS_ACCESS_KEY_ID family of variables authenticate")
+	fs.DurationVar(&RotateInterval, "secrets-rotate-interval", RotateInterval, "How often credentials are read again, reconnecting when they change. 0 disables")
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// Default returns the provider selected by flags, or nil if none is.
+func Default() (Provider, error) {
+	switch provider {
+	case "":
+		return nil, nil
+	case "file":
+		return File{UsernameFile: usernameFile, PasswordFile: passwordFile}, nil
+	case "vault":
+		return &Vault{Addr: os.Getenv("VAULT_ADDR"), Token: os.Getenv("VAULT_TOKEN"), Path: vaultPath}, nil
+	case "aws":
+		return NewAWS(os.Getenv("AWS_REGION"), awsSecretID), nil
+	}
+	return nil, fmt.Errorf("unknown secrets provider %q", provider)
+}
+
+// Watcher is implemented by providers that can tell when their credentials
+// may have changed, sooner than RotateInterval.
+type Watcher interface {
+	// Watch calls changed after each change until ctx is done.
+	Watch(ctx context.Context, changed func())
+}
+
+// File reads credentials from files, such as a mounted Kubernetes secret.
+// Files are read on every call, so updates to the mount are seen.
+type File struct {
+	UsernameFile string
+	PasswordFile string
+}
+
+func (f File) Credentials(ctx context.Context) (Credentials, error) {
+	username, err := os.ReadFile(f.UsernameFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	password, err := os.ReadFile(f.PasswordFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return check(Credentials{
+		Username: strings.TrimSpace(string(username)),
+		Password: strings.TrimSpace(string(password)),
+	})
+}
+
+// watchInterval is how often File checks its files for changes.
+var watchInterval = time.Second
+
+// Watch polls the modification time of the files. Kubernetes updates a
+// mounted secret by swapping a symbolic link, which the time followed
+// through the link reflects.
+func (f File) Watch(ctx context.Context, changed func()) {
+	last := f.modTime()
+	t := time.NewTicker(watchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if mt := f.modTime(); mt != last {
+			last = mt
+			changed()
+		}
+	}
+}
+
+func (f File) modTime() [2]time.Time {
+	var mt [2]time.Time
+	for i, name := range []string{f.UsernameFile, f.PasswordFile} {
+		if fi, err := os.Stat(name); err == nil {
+			mt[i] = fi.ModTime()
+		}
+	}
+	return mt
+}
+
+func check(c Credentials) (Credentials, error) {
+	if c.Username == "" || c.Password == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return c, nil
+}
@@ -0,0 +1,99 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikesay/user/sigv4"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	f := File{UsernameFile: filepath.Join(dir, "username"), PasswordFile: filepath.Join(dir, "password")}
+	os.WriteFile(f.UsernameFile, []byte("user\n"), 0600)
+	os.WriteFile(f.PasswordFile, []byte("pass\n"), 0600)
+	c, err := f.Credentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Username != "user" || c.Password != "pass" {
+		t.Errorf("Expected trimmed credentials, received %+v", c)
+	}
+	os.WriteFile(f.PasswordFile, nil, 0600)
+	if _, err := f.Credentials(context.Background()); err != ErrNoCredentials {
+		t.Errorf("Expected empty password to be refused, received %v", err)
+	}
+}
+
+func TestVault(t *testing.T) {
+	for path, body := range map[string]string{
+		"/v1/secret/data/user-db": `{"data":{"data":{"username":"user","password":"pass"},"metadata":{"version":3}}}`,
+		"/v1/kv/user-db":          `{"data":{"username":"user","password":"pass"}}`,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != "token" || r.URL.Path != path {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(body))
+		}))
+		v := &Vault{Addr: srv.URL, Token: "token", Path: strings.TrimPrefix(path, "/v1/")}
+		c, err := v.Credentials(context.Background())
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Username != "user" || c.Password != "pass" {
+			t.Errorf("Expected credentials from %v, received %+v", path, c)
+		}
+	}
+}
+
+func TestAWS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || !strings.Contains(r.Header.Get("Authorization"), "Credential=AKID/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"SecretString":"{\"username\":\"user\",\"password\":\"pass\"}"}`))
+	}))
+	defer srv.Close()
+	a := &AWS{Region: "eu-west-1", SecretID: "user-db", Endpoint: srv.URL, Auth: sigv4.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}}
+	c, err := a.Credentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Username != "user" || c.Password != "pass" {
+		t.Errorf("Expected credentials from the secret string, received %+v", c)
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	watchInterval = 10 * time.Millisecond
+	dir := t.TempDir()
+	f := File{UsernameFile: filepath.Join(dir, "username"), PasswordFile: filepath.Join(dir, "password")}
+	os.WriteFile(f.UsernameFile, []byte("user"), 0600)
+	os.WriteFile(f.PasswordFile, []byte("old"), 0600)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go f.Watch(ctx, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	time.Sleep(50 * time.Millisecond)
+	os.Chtimes(f.PasswordFile, time.Now(), time.Now().Add(time.Minute))
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Error("Expected password change to be noticed")
+	}
+}
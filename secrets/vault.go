@@ -0,0 +1,59 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Vault reads credentials from a HashiCorp Vault key/value secret holding
+// username and password keys. Both versions of the engine are supported.
+type Vault struct {
+	Addr  string
+	Token string
+	// Path is the API path of the secret, including the data segment for
+	// version 2 engines, such as "secret/data/user-db".
+	Path   string
+	Client *http.Client
+}
+
+func (v *Vault) Credentials(ctx context.Context) (Credentials, error) {
+	url := strings.TrimSuffix(v.Addr, "/") + "/v1/" + strings.TrimPrefix(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("vault: reading %v: %v", v.Path, res.Status)
+	}
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return Credentials{}, err
+	}
+	// Version 2 engines nest the secret, with its metadata, under data.
+	var nested struct {
+		Data *Credentials `json:"data"`
+	}
+	if err := json.Unmarshal(body.Data, &nested); err == nil && nested.Data != nil {
+		return check(*nested.Data)
+	}
+	var c Credentials
+	if err := json.Unmarshal(body.Data, &c); err != nil {
+		return Credentials{}, err
+	}
+	return check(c)
+}
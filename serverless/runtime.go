@@ -0,0 +1,121 @@
+package serverless
+
+// runtime.go contains a client of the AWS Lambda Runtime API, the HTTP
+// protocol custom runtimes fetch invocations and post their results with.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const runtimeAPIVersion = "2018-06-01"
+
+// Runtime serves invocations from the Lambda Runtime API at API, the
+// host:port Lambda sets in AWS_LAMBDA_RUNTIME_API.
+type Runtime struct {
+	API    string
+	Client *http.Client
+}
+
+// Run fetches invocations one at a time and serves them with the handler
+// returned by handler, until ctx is done. handler is called for every
+// invocation, so that it can set up on first use and retry a failed set up;
+// its error fails the invocation.
+func (rt *Runtime) Run(ctx context.Context, handler func(context.Context) (http.Handler, error)) error {
+	for {
+		id, deadline, payload, err := rt.next(ctx)
+		if err == nil {
+			err = rt.invoke(ctx, id, deadline, payload, handler)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rt *Runtime) invoke(ctx context.Context, id string, deadline time.Time, payload []byte, handler func(context.Context) (http.Handler, error)) error {
+	ictx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	h, err := handler(ictx)
+	if err != nil {
+		return rt.post(ctx, "invocation/"+id+"/error", invocationError(err))
+	}
+	resp, err := Handle(h)(ictx, payload)
+	if err != nil {
+		return rt.post(ctx, "invocation/"+id+"/error", invocationError(err))
+	}
+	return rt.post(ctx, "invocation/"+id+"/response", resp)
+}
+
+// next waits for the next invocation, returning its request ID, deadline
+// and event.
+func (rt *Runtime) next(ctx context.Context) (string, time.Time, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rt.url("invocation/next"), nil)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	resp, err := rt.client().Do(req)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	defer resp.Body.Close()
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, nil, fmt.Errorf("next invocation: %v", resp.Status)
+	}
+	id := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+	ms, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64)
+	if id == "" || err != nil {
+		return "", time.Time{}, nil, fmt.Errorf("next invocation: missing request id or deadline")
+	}
+	return id, time.UnixMilli(ms), payload, nil
+}
+
+func (rt *Runtime) post(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", rt.url(path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rt.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("post %v: %v", path, resp.Status)
+	}
+	return nil
+}
+
+func (rt *Runtime) url(path string) string {
+	return "http://" + rt.API + "/" + runtimeAPIVersion + "/runtime/" + path
+}
+
+func (rt *Runtime) client() *http.Client {
+	if rt.Client != nil {
+		return rt.Client
+	}
+	return http.DefaultClient
+}
+
+func invocationError(err error) []byte {
+	b, _ := json.Marshal(struct {
+		Message string `json:"errorMessage"`
+		Type    string `json:"errorType"`
+	}{err.Error(), "Runtime.HandlerError"})
+	return b
+}
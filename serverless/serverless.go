@@ -0,0 +1,191 @@
+// Package serverless serves an http.Handler from function platforms: it
+// translates API Gateway proxy events into requests and their responses
+// back, and runs the AWS Lambda Runtime API loop without depending on the
+// Lambda SDK.
+package serverless
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Event is an API Gateway proxy event, in either the REST API (1.0) or the
+// HTTP API (2.0) payload format.
+type Event struct {
+	Version string `json:"version"`
+
+	// HTTPMethod, Path and the multi value fields are set in 1.0 events.
+	HTTPMethod                      string              `json:"httpMethod"`
+	Path                            string              `json:"path"`
+	QueryStringParameters           map[string]string   `json:"queryStringParameters"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders"`
+
+	// RawPath, RawQueryString and Cookies are set in 2.0 events.
+	RawPath        string   `json:"rawPath"`
+	RawQueryString string   `json:"rawQueryString"`
+	Cookies        []string `json:"cookies"`
+
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		HTTP struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	} `json:"requestContext"`
+}
+
+// v2 reports whether e is in the HTTP API payload format.
+func (e *Event) v2() bool {
+	return e.Version == "2.0"
+}
+
+// Response is the response to an Event, in the payload format of the event.
+type Response struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Cookies           []string            `json:"cookies,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// Request returns the HTTP request e describes.
+func Request(ctx context.Context, e *Event) (*http.Request, error) {
+	method, path, sourceIP := e.HTTPMethod, e.Path, e.RequestContext.Identity.SourceIP
+	query := url.Values(e.MultiValueQueryStringParameters).Encode()
+	if len(e.MultiValueQueryStringParameters) == 0 && len(e.QueryStringParameters) > 0 {
+		q := url.Values{}
+		for k, v := range e.QueryStringParameters {
+			q.Set(k, v)
+		}
+		query = q.Encode()
+	}
+	if e.v2() {
+		method, path, query, sourceIP = e.RequestContext.HTTP.Method, e.RawPath, e.RawQueryString, e.RequestContext.HTTP.SourceIP
+	}
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(e.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event body: %v", err)
+		}
+		body = b
+	}
+	target := path
+	if query != "" {
+		target += "?" + query
+	}
+	r, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range e.MultiValueHeaders {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	for k, v := range e.Headers {
+		if len(e.MultiValueHeaders[k]) == 0 {
+			r.Header.Set(k, v)
+		}
+	}
+	if len(e.Cookies) > 0 {
+		r.Header.Set("Cookie", strings.Join(e.Cookies, "; "))
+	}
+	r.Host = r.Header.Get("Host")
+	if sourceIP != "" {
+		// Handlers split the port off remote addresses.
+		r.RemoteAddr = sourceIP + ":0"
+	}
+	return r, nil
+}
+
+// Serve serves e with h, returning the response in the format of e.
+func Serve(ctx context.Context, h http.Handler, e *Event) (*Response, error) {
+	r, err := Request(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	w := &responseWriter{header: make(http.Header)}
+	h.ServeHTTP(w, r)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	resp := &Response{StatusCode: w.code}
+	if utf8.Valid(w.body.Bytes()) {
+		resp.Body = w.body.String()
+	} else {
+		resp.Body, resp.IsBase64Encoded = base64.StdEncoding.EncodeToString(w.body.Bytes()), true
+	}
+	if e.v2() {
+		resp.Headers = make(map[string]string, len(w.header))
+		for k, vs := range w.header {
+			if k == "Set-Cookie" {
+				resp.Cookies = vs
+				continue
+			}
+			resp.Headers[k] = strings.Join(vs, ",")
+		}
+	} else {
+		resp.MultiValueHeaders = w.header
+	}
+	return resp, nil
+}
+
+// Handle returns a function serving the JSON proxy events it is invoked
+// with using h. Its signature suits the handlers of function SDKs, such as
+// lambda.Start of aws-lambda-go.
+func Handle(h http.Handler) func(context.Context, json.RawMessage) (json.RawMessage, error) {
+	return func(ctx context.Context, payload json.RawMessage) (json.RawMessage, error) {
+		var e Event
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, fmt.Errorf("invalid event: %v", err)
+		}
+		resp, err := Serve(ctx, h, &e)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	}
+}
+
+// responseWriter buffers a response.
+type responseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// Flush does nothing; the response is sent once the handler returns.
+func (w *responseWriter) Flush() {}
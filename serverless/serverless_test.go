@@ -0,0 +1,134 @@
+package serverless
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echo answers with the method, path, query, body and client of requests.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+	http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+	w.Header().Set("X-Accept", r.Header.Get("Accept"))
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+string(body)+" "+r.RemoteAddr)
+})
+
+func TestServeV1(t *testing.T) {
+	var e Event
+	json.Unmarshal([]byte(`{
+		"httpMethod": "POST", "path": "/customers",
+		"multiValueQueryStringParameters": {"q": ["x"]},
+		"multiValueHeaders": {"Accept": ["application/json"]},
+		"body": "e30=", "isBase64Encoded": true,
+		"requestContext": {"identity": {"sourceIp": "192.0.2.1"}}
+	}`), &e)
+	resp, err := Serve(context.Background(), echo, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Body != "POST /customers?q=x {} 192.0.2.1:0" {
+		t.Errorf("Expected the request served, received %+v", resp)
+	}
+	if resp.MultiValueHeaders["X-Accept"][0] != "application/json" || len(resp.MultiValueHeaders["Set-Cookie"]) != 2 {
+		t.Errorf("Expected multi value headers, received %v", resp.MultiValueHeaders)
+	}
+}
+
+func TestServeV2(t *testing.T) {
+	var e Event
+	json.Unmarshal([]byte(`{
+		"version": "2.0", "rawPath": "/customers", "rawQueryString": "q=x",
+		"headers": {"accept": "application/json"}, "cookies": ["c=3"],
+		"requestContext": {"http": {"method": "GET", "sourceIp": "192.0.2.1"}}
+	}`), &e)
+	resp, err := Serve(context.Background(), echo, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Body != "GET /customers?q=x  192.0.2.1:0" {
+		t.Errorf("Expected the request served, received %+v", resp)
+	}
+	if resp.Headers["X-Accept"] != "application/json" || len(resp.Cookies) != 2 || resp.MultiValueHeaders != nil {
+		t.Errorf("Expected headers and cookies apart, received %+v", resp)
+	}
+}
+
+func TestServeBinary(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte{0xff, 0xfe})
+	})
+	resp, err := Serve(context.Background(), h, &Event{HTTPMethod: "GET", Path: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsBase64Encoded || resp.Body != "//4=" || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a binary body encoded, received %+v", resp)
+	}
+}
+
+// fakeRuntime serves invocations of events, recording what is posted back.
+type fakeRuntime struct {
+	events  chan string
+	results chan string
+}
+
+func (f *fakeRuntime) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/2018-06-01/runtime/invocation/next":
+		select {
+		case e := <-f.events:
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", "id")
+			w.Header().Set("Lambda-Runtime-Deadline-Ms", strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10))
+			io.WriteString(w, e)
+		case <-r.Context().Done():
+		}
+	case strings.HasPrefix(r.URL.Path, "/2018-06-01/runtime/invocation/id/"):
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		f.results <- strings.TrimPrefix(r.URL.Path, "/2018-06-01/runtime/invocation/id/") + " " + string(body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRuntime(t *testing.T) {
+	f := &fakeRuntime{events: make(chan string, 2), results: make(chan string, 2)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	rt := &Runtime{API: strings.TrimPrefix(srv.URL, "http://")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	setups := 0
+	go func() {
+		done <- rt.Run(ctx, func(context.Context) (http.Handler, error) {
+			if setups++; setups == 1 {
+				return nil, errors.New("database down")
+			}
+			return echo, nil
+		})
+	}()
+
+	f.events <- `{"httpMethod": "GET", "path": "/health"}`
+	if r := <-f.results; !strings.HasPrefix(r, "error ") || !strings.Contains(r, "database down") {
+		t.Errorf("Expected a failed set up to fail the invocation, received %v", r)
+	}
+	f.events <- `{"httpMethod": "GET", "path": "/health"}`
+	if r := <-f.results; !strings.HasPrefix(r, "response ") || !strings.Contains(r, `"statusCode":201`) {
+		t.Errorf("Expected the invocation served once set up, received %v", r)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected the runtime stopped cleanly, received %v", err)
+	}
+}
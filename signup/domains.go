@@ -0,0 +1,142 @@
+package signup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source supplies a list of email domains.
+type Source interface {
+	Domains(ctx context.Context) ([]string, error)
+}
+
+// OpenSource returns a URL source for http and https locations and a File
+// source for anything else.
+func OpenSource(location string) Source {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return &URL{URL: location}
+	}
+	return File(location)
+}
+
+// File reads domains from a file holding one per line. Blank lines and
+// lines starting with # are ignored.
+type File string
+
+func (f File) Domains(ctx context.Context) ([]string, error) {
+	r, err := os.Open(string(f))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return parseDomains(r)
+}
+
+// URL fetches domains in the File format over HTTP, such as from a
+// community maintained list.
+type URL struct {
+	URL    string
+	Client *http.Client
+}
+
+func (u *URL) Domains(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", u.URL, res.Status)
+	}
+	return parseDomains(res.Body)
+}
+
+func parseDomains(r io.Reader) ([]string, error) {
+	var domains []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, strings.ToLower(line))
+	}
+	return domains, s.Err()
+}
+
+// DomainList is a set of domains read from a Source. A listed domain also
+// covers its subdomains.
+type DomainList struct {
+	Source Source
+
+	mtx     sync.RWMutex
+	domains map[string]bool
+}
+
+// NewDomainList returns a list read from src, failing if it cannot be read.
+func NewDomainList(ctx context.Context, src Source) (*DomainList, error) {
+	l := &DomainList{Source: src}
+	return l, l.Refresh(ctx)
+}
+
+// Refresh reads the source again. The previous list is kept if it fails.
+func (l *DomainList) Refresh(ctx context.Context) error {
+	domains, err := l.Source.Domains(ctx)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		set[d] = true
+	}
+	l.mtx.Lock()
+	l.domains = set
+	l.mtx.Unlock()
+	return nil
+}
+
+// Run refreshes the list every interval until ctx is done, passing failures
+// to onError.
+func (l *DomainList) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := l.Refresh(ctx); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Contains reports whether domain or one of its parents is listed.
+func (l *DomainList) Contains(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	for domain != "" {
+		if l.domains[domain] {
+			return true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package signup
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter allows Max events per key in each fixed Window. Counts are kept in
+// memory, so each replica enforces its own limit.
+type Limiter struct {
+	Max    int
+	Window time.Duration
+
+	mtx     sync.Mutex
+	windows map[string]window
+	swept   time.Time
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+// NewLimiter returns a Limiter allowing max events per key in each window.
+func NewLimiter(max int, w time.Duration) *Limiter {
+	return &Limiter{Max: max, Window: w, windows: make(map[string]window)}
+}
+
+// Allow records an event for key at t, reporting whether it is within the
+// limit. Refused events are not counted.
+func (l *Limiter) Allow(key string, t time.Time) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sweep(t)
+	w := l.windows[key]
+	if t.Sub(w.start) >= l.Window {
+		w = window{start: t}
+	}
+	if w.count >= l.Max {
+		return false
+	}
+	w.count++
+	l.windows[key] = w
+	return true
+}
+
+// sweep forgets expired windows, at most once per window.
+func (l *Limiter) sweep(t time.Time) {
+	if t.Sub(l.swept) < l.Window {
+		return
+	}
+	for k, w := range l.windows {
+		if t.Sub(w.start) >= l.Window {
+			delete(l.windows, k)
+		}
+	}
+	l.swept = t
+}
+
+// Subnet returns the /24 IPv4 or /48 IPv6 network containing ip, or ip
+// itself if it cannot be parsed.
+func Subnet(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
@@ -0,0 +1,64 @@
+// Package signup guards registration against abuse: it throttles signups
+// per address and per subnet, refuses disposable email domains, and scores
+// registrations for spam.
+package signup
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a registration is blocked.
+const (
+	ReasonAddress    = "address"
+	ReasonSubnet     = "subnet"
+	ReasonDisposable = "disposable_email"
+)
+
+var (
+	ErrThrottled       = users.NewError(users.CodeSignupThrottled, "Too many registrations, try again later")
+	ErrDisposableEmail = users.NewError(users.CodeDisposableEmail, "Disposable email addresses are not accepted")
+
+	Blocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registration_blocked_total",
+		Help: "Number of registrations refused, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(Blocked)
+}
+
+// Guard decides whether a registration may proceed. Nil fields disable
+// their check.
+type Guard struct {
+	// Addresses limits registrations per client address.
+	Addresses *Limiter
+	// Subnets limits registrations per /24 IPv4 or /48 IPv6 network.
+	Subnets *Limiter
+	// Disposable lists the email domains refused.
+	Disposable *DomainList
+}
+
+// Check returns an error if a registration from ip with email is refused.
+// Refused registrations do not count against the limits of other checks.
+func (g *Guard) Check(ip, email string, t time.Time) error {
+	if g.Disposable != nil {
+		if _, domain, ok := strings.Cut(users.NormalizeEmail(email), "@"); ok && g.Disposable.Contains(domain) {
+			Blocked.WithLabelValues(ReasonDisposable).Inc()
+			return ErrDisposableEmail
+		}
+	}
+	if g.Addresses != nil && !g.Addresses.Allow(ip, t) {
+		Blocked.WithLabelValues(ReasonAddress).Inc()
+		return ErrThrottled
+	}
+	if g.Subnets != nil && !g.Subnets.Allow(Subnet(ip), t) {
+		Blocked.WithLabelValues(ReasonSubnet).Inc()
+		return ErrThrottled
+	}
+	return nil
+}
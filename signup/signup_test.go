@@ -0,0 +1,106 @@
+package signup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(2, time.Minute)
+	now := time.Now()
+	if !l.Allow("a", now) || !l.Allow("a", now) {
+		t.Fatal("Expected events within the limit to be allowed")
+	}
+	if l.Allow("a", now) {
+		t.Error("Expected third event in the window to be refused")
+	}
+	if !l.Allow("b", now) {
+		t.Error("Expected other keys to be counted separately")
+	}
+	if !l.Allow("a", now.Add(time.Minute)) {
+		t.Error("Expected a new window to allow events again")
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	for ip, want := range map[string]string{
+		"192.0.2.17":     "192.0.2.0/24",
+		"2001:db8:1:2::": "2001:db8:1::/48",
+		"unknown":        "unknown",
+	} {
+		if got := Subnet(ip); got != want {
+			t.Errorf("Expected %v for %v, received %v", want, ip, got)
+		}
+	}
+}
+
+type failingSource struct{}
+
+func (failingSource) Domains(context.Context) ([]string, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestDomainList(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "domains")
+	os.WriteFile(name, []byte("# disposable\nMailinator.com\n\ntrashmail.net\n"), 0600)
+	l, err := NewDomainList(context.Background(), OpenSource(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]bool{
+		"mailinator.com":      true,
+		"eu.mailinator.com":   true,
+		"TRASHMAIL.NET":       true,
+		"example.com":         false,
+		"notmailinator.com":   false,
+		"mailinator.com.evil": false,
+	} {
+		if l.Contains(domain) != want {
+			t.Errorf("Expected %v to be listed: %v", domain, want)
+		}
+	}
+	l.Source = failingSource{}
+	if err := l.Refresh(context.Background()); err == nil {
+		t.Error("Expected failing source to be reported")
+	}
+	if !l.Contains("mailinator.com") {
+		t.Error("Expected previous list to be kept")
+	}
+}
+
+func TestURLSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("mailinator.com\n"))
+	}))
+	defer srv.Close()
+	ds, err := OpenSource(srv.URL).Domains(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0] != "mailinator.com" {
+		t.Errorf("Expected fetched domains, received %v", ds)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	g := &Guard{
+		Subnets:    NewLimiter(1, time.Hour),
+		Disposable: &DomainList{domains: map[string]bool{"mailinator.com": true}},
+	}
+	now := time.Now()
+	if err := g.Check("192.0.2.1", "bot@Mailinator.com", now); err != ErrDisposableEmail {
+		t.Errorf("Expected disposable email to be refused, received %v", err)
+	}
+	if err := g.Check("192.0.2.1", "a@example.com", now); err != nil {
+		t.Errorf("Expected refused attempt not to count, received %v", err)
+	}
+	if err := g.Check("192.0.2.2", "b@example.com", now); err != ErrThrottled {
+		t.Errorf("Expected second signup from the subnet to be throttled, received %v", err)
+	}
+}
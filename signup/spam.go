@@ -0,0 +1,167 @@
+package signup
+
+// spam.go scores registrations for signs of junk accounts, which are then
+// flagged for review, challenged or rejected. Scorers are pluggable; the
+// Heuristics scorer is built in.
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mikesay/user/users"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Action is what is done with a registration scored as spam.
+type Action string
+
+const (
+	Allow Action = "allow"
+	// Flag registers the customer tagged with SpamTag, for review.
+	Flag      Action = "flag"
+	Challenge Action = "challenge"
+	Reject    Action = "reject"
+)
+
+// Signals raised by Heuristics.
+const (
+	SignalHoneypot  = "honeypot"
+	SignalGibberish = "gibberish_name"
+	SignalVelocity  = "velocity"
+)
+
+// SpamTag tags the customers registered by flagged registrations.
+const SpamTag = "spam_review"
+
+var (
+	ErrSpamChallenge = users.NewError(users.CodeSignupChallenge, "Additional verification required")
+	ErrSpamRejected  = users.NewError(users.CodeSignupRejected, "Registration refused")
+
+	SpamDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registration_spam_decisions_total",
+		Help: "Number of scored registrations, by action.",
+	}, []string{"action"})
+	SpamSignals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registration_spam_signals_total",
+		Help: "Number of spam signals raised on registrations, by signal.",
+	}, []string{"signal"})
+)
+
+func init() {
+	prometheus.MustRegister(SpamDecisions)
+	prometheus.MustRegister(SpamSignals)
+}
+
+// Registration is a registration awaiting a spam score. Honeypot is the
+// form field hidden from people, which only bots fill in.
+type Registration struct {
+	Username  string
+	Email     string
+	FirstName string
+	LastName  string
+	IP        string
+	Honeypot  string
+	Time      time.Time
+}
+
+// Score is how likely a registration is spam, with the signals raised.
+type Score struct {
+	Value   float64
+	Signals []string
+}
+
+// Scorer scores registrations.
+type Scorer interface {
+	Score(r Registration) Score
+}
+
+// SpamFilter takes Action on registrations scoring Threshold or more.
+type SpamFilter struct {
+	Scorer    Scorer
+	Threshold float64
+	Action    Action
+}
+
+// Assess scores r and returns the action to take on it.
+func (f *SpamFilter) Assess(r Registration) (Action, Score) {
+	s := f.Scorer.Score(r)
+	for _, signal := range s.Signals {
+		SpamSignals.WithLabelValues(signal).Inc()
+	}
+	action := Allow
+	if s.Value >= f.Threshold {
+		action = f.Action
+	}
+	SpamDecisions.WithLabelValues(string(action)).Inc()
+	return action, s
+}
+
+// Heuristics scores registrations by the weights of the signals they
+// raise: a filled honeypot, names that look like random letters, and more
+// registrations from the client address than Velocity allows. A nil
+// Velocity disables its signal.
+type Heuristics struct {
+	HoneypotWeight  float64
+	GibberishWeight float64
+	VelocityWeight  float64
+	Velocity        *Limiter
+}
+
+// NewHeuristics returns Heuristics raising the velocity signal past max
+// registrations per address in each window. Weights are set so that a
+// filled honeypot alone, or both other signals, score 1.
+func NewHeuristics(max int, window time.Duration) *Heuristics {
+	h := &Heuristics{HoneypotWeight: 1, GibberishWeight: 0.5, VelocityWeight: 0.5}
+	if max > 0 {
+		h.Velocity = NewLimiter(max, window)
+	}
+	return h
+}
+
+// Score implements Scorer.
+func (h *Heuristics) Score(r Registration) Score {
+	s := Score{Signals: make([]string, 0)}
+	raise := func(signal string, weight float64) {
+		s.Signals = append(s.Signals, signal)
+		s.Value += weight
+	}
+	if strings.TrimSpace(r.Honeypot) != "" {
+		raise(SignalHoneypot, h.HoneypotWeight)
+	}
+	for _, name := range []string{r.FirstName, r.LastName, r.Username} {
+		if Gibberish(name) {
+			raise(SignalGibberish, h.GibberishWeight)
+			break
+		}
+	}
+	if h.Velocity != nil && !h.Velocity.Allow(r.IP, r.Time) {
+		raise(SignalVelocity, h.VelocityWeight)
+	}
+	return s
+}
+
+// Gibberish reports whether name looks like letters typed at random: six
+// consonants in a row, or hardly any vowels in a longer name. Some real
+// names match too, which is why the signal alone does not reach the
+// default threshold. Only Latin letters are judged, so names in other
+// scripts never look like gibberish.
+func Gibberish(name string) bool {
+	letters, vowels, run := 0, 0, 0
+	for _, c := range strings.ToLower(name) {
+		if c > unicode.MaxASCII || !unicode.IsLetter(c) {
+			run = 0
+			continue
+		}
+		letters++
+		if strings.ContainsRune("aeiouy", c) {
+			vowels++
+			run = 0
+			continue
+		}
+		if run++; run >= 6 {
+			return true
+		}
+	}
+	return letters >= 8 && vowels*6 < letters
+}
@@ -0,0 +1,53 @@
+package signup
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGibberish(t *testing.T) {
+	for name, want := range map[string]bool{
+		"Eve":          false,
+		"Berger":       false,
+		"Schwarzkopf":  false,
+		"O'Brien":      false,
+		"Nguyễn":       false,
+		"Иванов":       false,
+		"xkcdqwrtzp":   true,
+		"Bqzxwvrk":     true,
+		"hjkl hjkl":    true,
+		"qwrtpsdfghjk": true,
+	} {
+		if got := Gibberish(name); got != want {
+			t.Errorf("Expected %v for %q, received %v", want, name, got)
+		}
+	}
+}
+
+func TestHeuristics(t *testing.T) {
+	h := NewHeuristics(1, time.Hour)
+	now := time.Now()
+	r := Registration{Username: "eve", FirstName: "Eve", LastName: "Berger", IP: "192.0.2.1", Time: now}
+	if s := h.Score(r); s.Value != 0 || len(s.Signals) != 0 {
+		t.Errorf("Expected a clean registration, received %+v", s)
+	}
+	r.FirstName, r.Honeypot = "Bqzxwvrk", "http://spam.example.com"
+	s := h.Score(r)
+	if s.Value != 2 || !slices.Equal(s.Signals, []string{SignalHoneypot, SignalGibberish, SignalVelocity}) {
+		t.Errorf("Expected every signal raised, received %+v", s)
+	}
+	if s := h.Score(Registration{IP: "192.0.2.1", Time: now.Add(time.Hour)}); len(s.Signals) != 0 {
+		t.Errorf("Expected velocity measured per window, received %+v", s)
+	}
+}
+
+func TestSpamFilter(t *testing.T) {
+	f := &SpamFilter{Scorer: NewHeuristics(0, time.Hour), Threshold: 1, Action: Flag}
+	if a, _ := f.Assess(Registration{FirstName: "Bqzxwvrk"}); a != Allow {
+		t.Errorf("Expected a gibberish name alone allowed, received %v", a)
+	}
+	if a, s := f.Assess(Registration{Honeypot: "x"}); a != Flag || s.Value != 1 {
+		t.Errorf("Expected a filled honeypot flagged, received %v %+v", a, s)
+	}
+}
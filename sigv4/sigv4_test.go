@@ -0,0 +1,30 @@
+package sigv4
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestSign checks the get-vanilla case of the AWS Signature Version 4 test
+// suite.
+func TestSign(t *testing.T) {
+	c := Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	r := httptest.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	r.Header = http.Header{}
+	c.Sign(r, nil, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := r.Header.Get("Authorization"); got != want {
+		t.Errorf("Expected %v, received %v", want, got)
+	}
+}
+
+func TestSignS3(t *testing.T) {
+	r := httptest.NewRequest("PUT", "https://s3.eu-west-1.amazonaws.com/bucket/key", nil)
+	r.Header = http.Header{}
+	Credentials{AccessKeyID: "AKID", SessionToken: "token"}.Sign(r, []byte("data"), "eu-west-1", "s3", time.Now())
+	if r.Header.Get("X-Amz-Content-Sha256") == "" || r.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Errorf("Expected payload hash and session token headers, received %v", r.Header)
+	}
+}
@@ -0,0 +1,117 @@
+// Package testenv starts the external services integration tests need in
+// throwaway Docker containers, so that they run without any manual set up.
+//
+// Tests needing containers are built with the integration tag:
+//
+//	go test -tags integration ./...
+//
+// They are skipped when Docker is unavailable. MONGO_TEST_URI points them at
+// an existing Mongo instead of starting one.
+package testenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNoDocker is returned when containers cannot be started.
+var ErrNoDocker = errors.New("docker is unavailable")
+
+// MongoImage is the image Mongo is started from.
+var MongoImage = env("MONGO_TEST_IMAGE", "mongo:7")
+
+// Mongo returns the URI of a Mongo ready to accept connections, and a
+// function stopping it. It is MONGO_TEST_URI if set, and otherwise a new
+// container.
+func Mongo(ctx context.Context) (uri string, stop func(), err error) {
+	if uri := os.Getenv("MONGO_TEST_URI"); uri != "" {
+		return uri, func() {}, nil
+	}
+	addr, stop, err := run(ctx, MongoImage, "27017")
+	if err != nil {
+		return "", nil, err
+	}
+	uri = "mongodb://" + addr
+	if err := waitMongo(ctx, uri); err != nil {
+		stop()
+		return "", nil, err
+	}
+	return uri, stop, nil
+}
+
+// run starts a container of image, publishing port on a free local port,
+// and returns the published address and a function removing the container.
+func run(ctx context.Context, image, port string) (string, func(), error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return "", nil, ErrNoDocker
+	}
+	if err := exec.CommandContext(ctx, "docker", "info").Run(); err != nil {
+		return "", nil, ErrNoDocker
+	}
+	out, err := docker(ctx, "run", "--detach", "--rm", "--publish", "127.0.0.1::"+port, image)
+	if err != nil {
+		return "", nil, err
+	}
+	id := out
+	stop := func() {
+		exec.Command("docker", "rm", "--force", id).Run()
+	}
+	out, err = docker(ctx, "port", id, port+"/tcp")
+	if err != nil {
+		stop()
+		return "", nil, err
+	}
+	// Docker lists one address per published interface; 127.0.0.1 was asked
+	// for.
+	addr, _, _ := strings.Cut(out, "\n")
+	return addr, stop, nil
+}
+
+func docker(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "docker", args...).Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return "", fmt.Errorf("docker %v: %v: %s", args[0], err, exit.Stderr)
+		}
+		return "", fmt.Errorf("docker %v: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// waitMongo pings uri until it answers, or ctx is done.
+func waitMongo(ctx context.Context, uri string) error {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	for {
+		pctx, cancel := context.WithTimeout(ctx, time.Second)
+		err = client.Ping(pctx, nil)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("mongo at %v not ready: %v", uri, err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,140 @@
+// Package timing breaks the time spent serving a request down into phases,
+// so that a slow request can be told apart as waiting on the database or busy
+// in the service.
+//
+// A request is always in one phase, switched by Enter as it passes from the
+// middleware into its handler and in and out of serialization. Database calls
+// overlay the phase: while any is in flight, time is the database's.
+package timing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases of a request.
+const (
+	// Middleware is the time before the request reaches its handler and
+	// after the handler returns, including time spent shed or queued.
+	Middleware = "middleware"
+	// Handler is the time in the handler, other than serialization and
+	// database calls.
+	Handler = "handler"
+	// Serialization is the time decoding the request and encoding the
+	// response.
+	Serialization = "serialization"
+	// DB is the time waiting on the database.
+	DB = "db"
+)
+
+// Phases are the phases of a request, in the order they are reported.
+var Phases = []string{DB, Serialization, Handler, Middleware}
+
+// Timer accumulates the time a request spends in each phase.
+type Timer struct {
+	mtx   sync.Mutex
+	now   func() time.Time
+	start time.Time
+	since time.Time
+	phase string
+	// db counts the database calls in flight.
+	db    int
+	spent map[string]time.Duration
+}
+
+// NewTimer returns a Timer started in the Middleware phase, reading the time
+// from now.
+func NewTimer(now func() time.Time) *Timer {
+	t := now()
+	return &Timer{now: now, start: t, since: t, phase: Middleware, spent: make(map[string]time.Duration, len(Phases))}
+}
+
+// account adds the time since the last change to the current phase. The
+// caller holds t.mtx.
+func (t *Timer) account() {
+	now := t.now()
+	phase := t.phase
+	if t.db > 0 {
+		phase = DB
+	}
+	t.spent[phase] += now.Sub(t.since)
+	t.since = now
+}
+
+// Enter switches the timer to phase.
+func (t *Timer) Enter(phase string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.account()
+	t.phase = phase
+}
+
+// Spent returns the time spent in each phase so far, and in total.
+func (t *Timer) Spent() (map[string]time.Duration, time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.account()
+	spent := make(map[string]time.Duration, len(t.spent))
+	for phase, d := range t.spent {
+		spent[phase] = d
+	}
+	return spent, t.since.Sub(t.start)
+}
+
+// Header returns the time spent so far as a Server-Timing header value, in
+// milliseconds.
+func (t *Timer) Header() string {
+	spent, total := t.Spent()
+	var b strings.Builder
+	for _, phase := range Phases {
+		fmt.Fprintf(&b, "%v;dur=%.3f, ", phase, ms(spent[phase]))
+	}
+	fmt.Fprintf(&b, "total;dur=%.3f", ms(total))
+	return b.String()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type timerKey struct{}
+
+// NewContext returns a copy of ctx carrying t.
+func NewContext(ctx context.Context, t *Timer) context.Context {
+	return context.WithValue(ctx, timerKey{}, t)
+}
+
+// FromContext returns the timer ctx carries, or nil.
+func FromContext(ctx context.Context) *Timer {
+	t, _ := ctx.Value(timerKey{}).(*Timer)
+	return t
+}
+
+// Enter switches the timer ctx carries, if any, to phase.
+func Enter(ctx context.Context, phase string) {
+	if t := FromContext(ctx); t != nil {
+		t.Enter(phase)
+	}
+}
+
+// Database counts the time until the returned func is called as the
+// database's, in the timer ctx carries, if any. Calls may overlap.
+func Database(ctx context.Context) (done func()) {
+	t := FromContext(ctx)
+	if t == nil {
+		return func() {}
+	}
+	t.mtx.Lock()
+	t.account()
+	t.db++
+	t.mtx.Unlock()
+	return func() {
+		t.mtx.Lock()
+		t.account()
+		t.db--
+		t.mtx.Unlock()
+	}
+}
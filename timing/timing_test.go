@@ -0,0 +1,63 @@
+package timing
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when told to.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestTimer(t *testing.T) {
+	c := &fakeClock{t: time.Unix(0, 0)}
+	timer := NewTimer(c.now)
+	ctx := NewContext(context.Background(), timer)
+
+	c.advance(time.Millisecond)
+	Enter(ctx, Serialization)
+	c.advance(2 * time.Millisecond)
+	Enter(ctx, Handler)
+	c.advance(3 * time.Millisecond)
+	first := Database(ctx)
+	c.advance(4 * time.Millisecond)
+	second := Database(ctx)
+	c.advance(5 * time.Millisecond)
+	first()
+	c.advance(6 * time.Millisecond)
+	second()
+	c.advance(7 * time.Millisecond)
+	Enter(ctx, Middleware)
+	c.advance(8 * time.Millisecond)
+
+	spent, total := timer.Spent()
+	want := map[string]time.Duration{
+		Middleware:    9 * time.Millisecond,
+		Serialization: 2 * time.Millisecond,
+		Handler:       10 * time.Millisecond,
+		DB:            15 * time.Millisecond,
+	}
+	for phase, d := range want {
+		if spent[phase] != d {
+			t.Errorf("Expected %v in %v, received %v", d, phase, spent[phase])
+		}
+	}
+	if total != 36*time.Millisecond {
+		t.Errorf("Expected 36ms in total, received %v", total)
+	}
+	if h := timer.Header(); h != "db;dur=15.000, serialization;dur=2.000, handler;dur=10.000, middleware;dur=9.000, total;dur=36.000" {
+		t.Errorf("Unexpected header %q", h)
+	}
+}
+
+func TestWithoutTimer(t *testing.T) {
+	ctx := context.Background()
+	Enter(ctx, Handler)
+	Database(ctx)()
+	if FromContext(ctx) != nil {
+		t.Error("Expected no timer")
+	}
+}
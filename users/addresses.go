@@ -1,15 +1,22 @@
 package users
 
+import "time"
+
 type Address struct {
-	Street   string `json:"street" bson:"street,omitempty"`
-	Number   string `json:"number" bson:"number,omitempty"`
-	Country  string `json:"country" bson:"country,omitempty"`
-	City     string `json:"city" bson:"city,omitempty"`
-	PostCode string `json:"postcode" bson:"postcode,omitempty"`
-	ID       string `json:"id" bson:"-"`
-	Links    Links  `json:"_links"`
+	Street    string    `json:"street" bson:"street,omitempty"`
+	Number    string    `json:"number" bson:"number,omitempty"`
+	Country   string    `json:"country" bson:"country,omitempty"`
+	City      string    `json:"city" bson:"city,omitempty"`
+	PostCode  string    `json:"postcode" bson:"postcode,omitempty"`
+	ID        string    `json:"id" bson:"-"`
+	CreatedAt time.Time `json:"createdAt,omitzero" bson:"createdAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitzero" bson:"updatedAt,omitempty"`
 }
 
-func (a *Address) AddLinks() {
-	a.Links.AddAddress(a.ID)
+// Validate checks the postcode, if any, looks like one.
+func (a *Address) Validate() error {
+	if a.PostCode != "" && !postcode.MatchString(a.PostCode) {
+		return ErrInvalidPostcode
+	}
+	return nil
 }
@@ -7,10 +7,8 @@ import (
 
 func TestAddLinksAdd(t *testing.T) {
 	domain = "mydomain"
-	a := Address{ID: "test"}
-	a.AddLinks()
 	h := Href{"http://mydomain/addresses/test"}
-	if !reflect.DeepEqual(a.Links["address"], h) {
+	if !reflect.DeepEqual(AddressLinks("test")["address"], h) {
 		t.Error("expected equal address links")
 	}
 
@@ -0,0 +1,95 @@
+package users
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateOfBirthLayout is the form dates of birth are given and stored in.
+const DateOfBirthLayout = "2006-01-02"
+
+var (
+	ErrInvalidDateOfBirth = NewError(CodeInvalidDateOfBirth, "Date of birth must be a past date of the form YYYY-MM-DD")
+	ErrUnderage           = NewError(CodeUnderage, "Customer is below the minimum age")
+)
+
+// ParseDateOfBirth reads a date of birth, refusing dates in the future or
+// more than 150 years before now.
+func ParseDateOfBirth(s string, now time.Time) (time.Time, error) {
+	dob, err := time.Parse(DateOfBirthLayout, s)
+	if err != nil || dob.After(now) || dob.Before(now.AddDate(-150, 0, 0)) {
+		return time.Time{}, ErrInvalidDateOfBirth
+	}
+	return dob, nil
+}
+
+// Age returns the age in whole years, on now, of someone born on dob.
+func Age(dob, now time.Time) int {
+	age := now.Year() - dob.Year()
+	if now.Month() < dob.Month() || (now.Month() == dob.Month() && now.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
+// AgePolicy sets the minimum age customers must be to register, by the
+// residency they register with.
+type AgePolicy struct {
+	// Default applies to residencies without a minimum of their own. Zero
+	// sets no minimum.
+	Default     int
+	Residencies map[string]int
+}
+
+// ParseAgePolicy returns a policy from the default minimum age and
+// "residency=age" pairs.
+func ParseAgePolicy(def int, residencies []string) (AgePolicy, error) {
+	if def < 0 {
+		return AgePolicy{}, fmt.Errorf("negative minimum age %d", def)
+	}
+	p := AgePolicy{Default: def, Residencies: make(map[string]int)}
+	for _, pair := range residencies {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		residency, n, ok := strings.Cut(pair, "=")
+		age, err := strconv.Atoi(strings.TrimSpace(n))
+		if !ok || err != nil || age < 0 || strings.TrimSpace(residency) == "" {
+			return AgePolicy{}, fmt.Errorf("invalid minimum age %q", pair)
+		}
+		p.Residencies[strings.TrimSpace(residency)] = age
+	}
+	return p, nil
+}
+
+// Minimum returns the minimum age for customers of the residency.
+func (p AgePolicy) Minimum(residency string) int {
+	if age, ok := p.Residencies[residency]; ok {
+		return age
+	}
+	return p.Default
+}
+
+// Check validates the date of birth a customer registers with and enforces
+// the minimum age of their residency. Without a minimum the date of birth
+// is optional.
+func (p AgePolicy) Check(dob, residency string, now time.Time) error {
+	min := p.Minimum(residency)
+	if dob == "" {
+		if min > 0 {
+			return NewError(CodeMissingField, fmt.Sprintf(ErrMissingField, "dateOfBirth"))
+		}
+		return nil
+	}
+	born, err := ParseDateOfBirth(dob, now)
+	if err != nil {
+		return err
+	}
+	if Age(born, now) < min {
+		return ErrUnderage
+	}
+	return nil
+}
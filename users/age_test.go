@@ -0,0 +1,57 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAge(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for dob, age := range map[string]int{
+		"2006-03-01": 18,
+		"2006-03-02": 17,
+		"2004-02-29": 20,
+		"2024-03-01": 0,
+	} {
+		born, err := ParseDateOfBirth(dob, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := Age(born, now); a != age {
+			t.Errorf("Expected %v to be %v, received %v", dob, age, a)
+		}
+	}
+	for _, dob := range []string{"2024-03-02", "1850-01-01", "01/02/2000", "2000-02-30"} {
+		if _, err := ParseDateOfBirth(dob, now); err != ErrInvalidDateOfBirth {
+			t.Errorf("Expected %q refused, received %v", dob, err)
+		}
+	}
+}
+
+func TestAgePolicy(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	p, err := ParseAgePolicy(0, []string{"us=21", " eu = 16 ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check("", "", now); err != nil {
+		t.Errorf("Expected no date of birth needed without a minimum, received %v", err)
+	}
+	if err := p.Check("", "us", now); err == nil {
+		t.Error("Expected a date of birth required with a minimum")
+	}
+	if err := p.Check("2005-01-01", "us", now); err != ErrUnderage {
+		t.Errorf("Expected 19 year olds refused in us, received %v", err)
+	}
+	if err := p.Check("2005-01-01", "eu", now); err != nil {
+		t.Errorf("Expected 19 year olds allowed in eu, received %v", err)
+	}
+	if err := p.Check("tomorrow", "", now); err != ErrInvalidDateOfBirth {
+		t.Errorf("Expected an invalid date refused without a minimum, received %v", err)
+	}
+	for _, pairs := range [][]string{{"us"}, {"us=-1"}, {"=18"}, {"us=old"}} {
+		if _, err := ParseAgePolicy(18, pairs); err == nil {
+			t.Errorf("Expected %v refused", pairs)
+		}
+	}
+}
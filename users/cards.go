@@ -1,23 +1,45 @@
 package users
 
 import (
-	"fmt"
 	"strings"
+	"time"
+)
+
+// Card statuses. Cards saved without a status are active.
+const (
+	CardActive         = "active"
+	CardSuspectedFraud = "suspected_fraud"
 )
 
 type Card struct {
-	LongNum string `json:"longNum" bson:"longNum"`
-	Expires string `json:"expires" bson:"expires"`
-	CCV     string `json:"ccv" bson:"ccv"`
-	ID      string `json:"id" bson:"-"`
-	Links   Links  `json:"_links" bson:"-"`
+	LongNum   string    `json:"longNum" bson:"longNum"`
+	Expires   string    `json:"expires" bson:"expires"`
+	CCV       string    `json:"ccv" bson:"ccv"`
+	ID        string    `json:"id" bson:"-"`
+	CreatedAt time.Time `json:"createdAt,omitzero" bson:"createdAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitzero" bson:"updatedAt,omitempty"`
+	Status    string    `json:"status,omitempty" bson:"status,omitempty"`
+	// Flag records who flagged the card and why, while it is flagged.
+	Flag *CardFlag `json:"flag,omitempty" bson:"flag,omitempty"`
 }
 
-func (c *Card) MaskCC() {
-	l := len(c.LongNum) - 4
-	c.LongNum = fmt.Sprintf("%v%v", strings.Repeat("*", l), c.LongNum[l:])
+// CardFlag is the payments risk team's reason for flagging a card.
+type CardFlag struct {
+	Reason    string    `json:"reason" bson:"reason"`
+	Actor     string    `json:"actor" bson:"actor"`
+	FlaggedAt time.Time `json:"flaggedAt" bson:"flaggedAt"`
 }
 
-func (c *Card) AddLinks() {
-	c.Links.AddCard(c.ID)
+// Usable reports whether the card may be charged.
+func (c *Card) Usable() bool {
+	return c.Status == "" || c.Status == CardActive
+}
+
+// MaskCC hides all but the last four characters of the number. Numbers
+// are masked by character rather than byte, as they are not validated and
+// may be shorter than four or hold any text.
+func (c *Card) MaskCC() {
+	r := []rune(c.LongNum)
+	l := max(len(r)-4, 0)
+	c.LongNum = strings.Repeat("*", l) + string(r[l:])
 }
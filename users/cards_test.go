@@ -7,10 +7,8 @@ import (
 
 func TestAddLinksCard(t *testing.T) {
 	domain = "mydomain"
-	c := Card{ID: "test"}
-	c.AddLinks()
 	h := Href{"http://mydomain/cards/test"}
-	if !reflect.DeepEqual(c.Links["card"], h) {
+	if !reflect.DeepEqual(CardLinks("test")["card"], h) {
 		t.Error("expected equal address links")
 	}
 
@@ -25,3 +23,36 @@ func TestMaskCC(t *testing.T) {
 		t.Errorf("Expected matching CC number %v received %v", test1comp, test1)
 	}
 }
+
+func TestUsable(t *testing.T) {
+	for status, usable := range map[string]bool{"": true, CardActive: true, CardSuspectedFraud: false} {
+		c := Card{Status: status}
+		if c.Usable() != usable {
+			t.Errorf("Expected usable %v for status %q", usable, status)
+		}
+	}
+}
+
+// FuzzMaskCC checks that masking never panics and only reveals the last
+// four characters of a number.
+func FuzzMaskCC(f *testing.F) {
+	for _, n := range []string{"1234567890", "4111111111111111", "", "123", "1234", "４１１１１１１１", "12\xff34"} {
+		f.Add(n)
+	}
+	f.Fuzz(func(t *testing.T, n string) {
+		c := Card{LongNum: n}
+		c.MaskCC()
+		in, out := []rune(n), []rune(c.LongNum)
+		if len(in) != len(out) {
+			t.Fatalf("Masking %q changed its length to %q", n, c.LongNum)
+		}
+		for k := range out {
+			if k < len(in)-4 && out[k] != '*' {
+				t.Errorf("Masking %q revealed %q", n, c.LongNum)
+			}
+			if k >= len(in)-4 && out[k] != in[k] {
+				t.Errorf("Masking %q lost the last digits, received %q", n, c.LongNum)
+			}
+		}
+	})
+}
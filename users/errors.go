@@ -0,0 +1,85 @@
+package users
+
+import (
+	"errors"
+	"regexp"
+)
+
+// Error codes returned to clients. They are stable; messages may change.
+const (
+	CodeInternal             = "INTERNAL_ERROR"
+	CodeInvalidRequest       = "INVALID_REQUEST"
+	CodeInvalidID            = "INVALID_ID"
+	CodeMissingField         = "MISSING_FIELD"
+	CodeUserNotFound         = "USER_NOT_FOUND"
+	CodeAddressNotFound      = "ADDRESS_NOT_FOUND"
+	CodeCardNotFound         = "CARD_NOT_FOUND"
+	CodeIDConflict           = "ID_CONFLICT"
+	CodeAddressLimitExceeded = "ADDRESS_LIMIT_EXCEEDED"
+	CodeCardLimitExceeded    = "CARD_LIMIT_EXCEEDED"
+	CodeInvalidPostcode      = "INVALID_POSTCODE"
+	CodeUsernameLength       = "USERNAME_LENGTH"
+	CodeUsernameCharset      = "USERNAME_CHARSET"
+	CodeUsernameReserved     = "USERNAME_RESERVED"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeLoginChallenge       = "LOGIN_CHALLENGE"
+	CodeLoginDenied          = "LOGIN_DENIED"
+	CodeForbidden            = "FORBIDDEN"
+	CodeInvalidBackup        = "INVALID_BACKUP"
+	CodeConfirmationRequired = "CONFIRMATION_REQUIRED"
+	CodeInvalidConfirmation  = "INVALID_CONFIRMATION"
+	CodeOverloaded           = "OVERLOADED"
+	CodeAvatarNotFound       = "AVATAR_NOT_FOUND"
+	CodeInvalidAvatar        = "INVALID_AVATAR"
+	CodeAvatarTooLarge       = "AVATAR_TOO_LARGE"
+	CodeSignupThrottled      = "SIGNUP_THROTTLED"
+	CodeDisposableEmail      = "DISPOSABLE_EMAIL"
+	CodeReadOnly             = "READ_ONLY"
+	CodeInvalidTag           = "INVALID_TAG"
+	CodeInvalidCardStatus    = "INVALID_CARD_STATUS"
+	CodeCardFlagged          = "CARD_FLAGGED"
+	CodeInvalidNote          = "INVALID_NOTE"
+	CodeInvalidDateOfBirth   = "INVALID_DATE_OF_BIRTH"
+	CodeUnderage             = "UNDERAGE"
+	CodeAuthzUnavailable     = "AUTHZ_UNAVAILABLE"
+	CodeSignupChallenge      = "SIGNUP_CHALLENGE"
+	CodeSignupRejected       = "SIGNUP_REJECTED"
+	CodeRateLimited          = "RATE_LIMITED"
+)
+
+var (
+	ErrUserNotFound    = NewError(CodeUserNotFound, "User not found")
+	ErrInvalidID       = NewError(CodeInvalidID, "Invalid Id")
+	ErrAddressNotFound = NewError(CodeAddressNotFound, "Address not found")
+	ErrCardNotFound    = NewError(CodeCardNotFound, "Card not found")
+	ErrInvalidPostcode = NewError(CodeInvalidPostcode, "Postcode is invalid")
+	ErrInvalidTag      = NewError(CodeInvalidTag, "Tag must be 1 to 32 lowercase letters, digits, underscores or hyphens")
+
+	postcode   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 -]{1,9}$`)
+	tagPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+// Error is a domain error carrying a machine-readable code.
+type Error struct {
+	Code    string
+	Message string
+}
+
+// NewError returns an Error with the given code and message.
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the code of the Error in err's chain, or CodeInternal if
+// there is none.
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
@@ -0,0 +1,41 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	if c := ErrorCode(ErrUserNotFound); c != CodeUserNotFound {
+		t.Errorf("Expected %v, received %v", CodeUserNotFound, c)
+	}
+	if c := ErrorCode(fmt.Errorf("restore: %w", ErrUsernameReserved)); c != CodeUsernameReserved {
+		t.Errorf("Expected wrapped code %v, received %v", CodeUsernameReserved, c)
+	}
+	if c := ErrorCode(errors.New("boom")); c != CodeInternal {
+		t.Errorf("Expected %v, received %v", CodeInternal, c)
+	}
+}
+
+func TestAddressValidate(t *testing.T) {
+	for _, p := range []string{"", "1012 AB", "SW1A 1AA", "10115", "01234-567"} {
+		a := Address{PostCode: p}
+		if err := a.Validate(); err != nil {
+			t.Errorf("Expected %q to be valid, received %v", p, err)
+		}
+	}
+	for _, p := range []string{"1", "<script>", "12345678901"} {
+		a := Address{PostCode: p}
+		if err := a.Validate(); err != ErrInvalidPostcode {
+			t.Errorf("Expected %q to be refused, received %v", p, err)
+		}
+	}
+}
+
+func TestUserValidateCode(t *testing.T) {
+	u := User{}
+	if c := ErrorCode(u.Validate()); c != CodeMissingField {
+		t.Errorf("Expected %v, received %v", CodeMissingField, c)
+	}
+}
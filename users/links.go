@@ -4,10 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
 )
 
 var (
-	domain    string
+	domain    = os.Getenv("HATEAOS")
 	entitymap = map[string]string{
 		"customer": "customers",
 		"address":  "addresses",
@@ -15,28 +16,37 @@ var (
 	}
 )
 
-func init() {
-	flag.StringVar(&domain, "link-domain", os.Getenv("HATEAOS"), "HATEAOS link domain")
+// RegisterFlags registers the link domain flag on fs, defaulting to the
+// HATEAOS environment variable.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&domain, "link-domain", domain, "HATEAOS link domain")
 }
 
 type Links map[string]Href
 
+// AddLink replaces the links with those of the entity, sized for the
+// attribute links customers add to them.
 func (l *Links) AddLink(ent string, id string) {
-	nl := make(Links)
-	link := fmt.Sprintf("http://%v/%v/%v", domain, entitymap[ent], id)
+	nl := make(Links, 4)
+	link := entityURL(ent, id)
 	nl[ent] = Href{link}
 	nl["self"] = Href{link}
 	*l = nl
-
 }
 
 func (l *Links) AddAttrLink(attr string, corent string, id string) {
-	link := fmt.Sprintf("http://%v/%v/%v/%v", domain, entitymap[corent], id, entitymap[attr])
+	link := entityURL(corent, id) + "/" + entitymap[attr]
 	nl := *l
 	nl[entitymap[attr]] = Href{link}
 	*l = nl
 }
 
+// entityURL is built by concatenation rather than fmt, as links are added to
+// every entity served.
+func entityURL(ent, id string) string {
+	return "http://" + domain + "/" + entitymap[ent] + "/" + id
+}
+
 func (l *Links) AddCustomer(id string) {
 	l.AddLink("customer", id)
 	l.AddAttrLink("address", "customer", id)
@@ -51,6 +61,47 @@ func (l *Links) AddCard(id string) {
 	l.AddLink("card", id)
 }
 
+// CustomerLinks, AddressLinks and CardLinks return the links of the entity
+// with id. Entities without an ID, not having been saved, have none.
+func CustomerLinks(id string) Links {
+	if id == "" {
+		return nil
+	}
+	var l Links
+	l.AddCustomer(id)
+	return l
+}
+
+func AddressLinks(id string) Links {
+	if id == "" {
+		return nil
+	}
+	var l Links
+	l.AddAddress(id)
+	return l
+}
+
+func CardLinks(id string) Links {
+	if id == "" {
+		return nil
+	}
+	var l Links
+	l.AddCard(id)
+	return l
+}
+
+// NextLinks returns the link to the next page of a list of the entity, with
+// the query selecting it.
+func NextLinks(ent string, query string) Links {
+	return Links{"next": Href{"http://" + domain + "/" + entitymap[ent] + "?" + query}}
+}
+
+// AvatarURL returns the URL of a user's profile image stored under key. The
+// key's last element versions the URL, so caches see a new image at once.
+func AvatarURL(id, key string) string {
+	return fmt.Sprintf("http://%v/customers/%v/avatar?v=%v", domain, id, path.Base(key))
+}
+
 type Href struct {
 	URL string `json:"href"`
 }
@@ -0,0 +1,38 @@
+package users
+
+import "time"
+
+// Login outcomes. Challenged and denied logins had valid credentials but
+// were stopped by the risk evaluator; verified logins passed the one-time
+// code of a challenge, and unverified ones gave a wrong code.
+const (
+	LoginSucceeded  = "succeeded"
+	LoginFailed     = "failed"
+	LoginChallenged = "challenged"
+	LoginDenied     = "denied"
+	LoginVerified   = "verified"
+	LoginUnverified = "unverified"
+)
+
+// LoginAttempt records a single attempt to log in, successful or not.
+type LoginAttempt struct {
+	UserID    string    `json:"userID,omitempty" bson:"userID,omitempty"`
+	Username  string    `json:"username" bson:"username"`
+	Success   bool      `json:"success" bson:"success"`
+	IP        string    `json:"ip" bson:"ip"`
+	UserAgent string    `json:"userAgent" bson:"userAgent"`
+	Time      time.Time `json:"time" bson:"time"`
+	// Device is the fingerprint the client sent of its device, if any.
+	Device string `json:"device,omitempty" bson:"device,omitempty"`
+	// Outcome tells apart why an attempt succeeded or not. Attempts
+	// recorded before it was added have none.
+	Outcome string `json:"outcome,omitempty" bson:"outcome,omitempty"`
+	// Challenge is the ID of the step-up challenge the attempt was
+	// challenged with or verified.
+	Challenge string `json:"challenge,omitempty" bson:"challenge,omitempty"`
+}
+
+// Successful reports whether the outcome is a login.
+func Successful(outcome string) bool {
+	return outcome == LoginSucceeded || outcome == LoginVerified
+}
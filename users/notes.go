@@ -0,0 +1,60 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Note visibilities. Internal notes are for support agents only; customer
+// notes record what the customer was told and may be shown to them.
+const (
+	NoteInternal = "internal"
+	NoteCustomer = "customer"
+)
+
+// Kinds of the notes the service records itself, as the audit trail of
+// impersonation. Notes written by agents have no kind.
+const (
+	NoteImpersonation        = "impersonation"
+	NoteImpersonationRevoked = "impersonation-revoked"
+)
+
+// MaxNoteLength bounds the characters of a note's text.
+const MaxNoteLength = 10000
+
+var ErrInvalidNote = NewError(CodeInvalidNote, fmt.Sprintf("Note visibility must be %v or %v, and its text at most %v characters", NoteInternal, NoteCustomer, MaxNoteLength))
+
+// Note is a support agent's record of an interaction with a customer.
+type Note struct {
+	ID         string    `json:"id" bson:"-"`
+	UserID     string    `json:"userID" bson:"userID"`
+	Author     string    `json:"author" bson:"author"`
+	Text       string    `json:"text" bson:"text"`
+	Visibility string    `json:"visibility" bson:"visibility"`
+	Kind       string    `json:"kind,omitempty" bson:"kind,omitempty"`
+	CreatedAt  time.Time `json:"createdAt,omitzero" bson:"createdAt"`
+}
+
+// Validate checks the note has an author and text, and defaults its
+// visibility to internal.
+func (n *Note) Validate() error {
+	if strings.TrimSpace(n.Author) == "" {
+		return NewError(CodeMissingField, fmt.Sprintf(ErrMissingField, "author"))
+	}
+	if strings.TrimSpace(n.Text) == "" {
+		return NewError(CodeMissingField, fmt.Sprintf(ErrMissingField, "text"))
+	}
+	if utf8.RuneCountInString(n.Text) > MaxNoteLength {
+		return ErrInvalidNote
+	}
+	switch n.Visibility {
+	case "":
+		n.Visibility = NoteInternal
+	case NoteInternal, NoteCustomer:
+	default:
+		return ErrInvalidNote
+	}
+	return nil
+}
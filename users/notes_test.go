@@ -0,0 +1,23 @@
+package users
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNoteValidate(t *testing.T) {
+	n := Note{Author: "agent", Text: "Called about a late delivery"}
+	if err := n.Validate(); err != nil || n.Visibility != NoteInternal {
+		t.Errorf("Expected an internal note, received %v %+v", err, n)
+	}
+	for name, n := range map[string]Note{
+		"author":     {Text: "text"},
+		"text":       {Author: "agent", Text: " "},
+		"visibility": {Author: "agent", Text: "text", Visibility: "public"},
+		"length":     {Author: "agent", Text: strings.Repeat("é", MaxNoteLength+1)},
+	} {
+		if err := n.Validate(); err == nil {
+			t.Errorf("Expected a note without a valid %v refused", name)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package users
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrUsernameLength   = NewError(CodeUsernameLength, "Username has an invalid length")
+	ErrUsernameCharset  = NewError(CodeUsernameCharset, "Username contains invalid characters")
+	ErrUsernameReserved = NewError(CodeUsernameReserved, "Username is reserved")
+
+	// DefaultUsernameCharset allows letters, digits, dots, dashes and
+	// underscores.
+	DefaultUsernameCharset = `^[A-Za-z0-9._-]+$`
+	// DefaultReservedUsernames are refused by the default policy.
+	DefaultReservedUsernames = []string{
+		"admin", "administrator", "root", "support", "system", "help",
+		"security", "abuse", "postmaster", "webmaster", "hostmaster",
+	}
+)
+
+// UsernamePolicy decides which usernames may be registered.
+type UsernamePolicy struct {
+	MinLength int
+	MaxLength int
+	// Charset matches the whole of an acceptable username.
+	Charset *regexp.Regexp
+	// CaseInsensitive treats usernames differing only in case as the same.
+	CaseInsensitive bool
+	// Reserved usernames are compared case-insensitively.
+	Reserved map[string]bool
+}
+
+// DefaultUsernamePolicy returns the policy used unless configured otherwise.
+func DefaultUsernamePolicy() UsernamePolicy {
+	p, _ := NewUsernamePolicy(3, 32, DefaultUsernameCharset, true, DefaultReservedUsernames)
+	return p
+}
+
+// NewUsernamePolicy returns a policy, failing if charset is not a valid
+// regular expression.
+func NewUsernamePolicy(min, max int, charset string, caseInsensitive bool, reserved []string) (UsernamePolicy, error) {
+	re, err := regexp.Compile(charset)
+	if err != nil {
+		return UsernamePolicy{}, err
+	}
+	p := UsernamePolicy{
+		MinLength:       min,
+		MaxLength:       max,
+		Charset:         re,
+		CaseInsensitive: caseInsensitive,
+		Reserved:        make(map[string]bool, len(reserved)),
+	}
+	for _, r := range reserved {
+		if r = strings.TrimSpace(r); r != "" {
+			p.Reserved[strings.ToLower(r)] = true
+		}
+	}
+	return p, nil
+}
+
+// Normalize returns the form of name used to compare usernames.
+func (p UsernamePolicy) Normalize(name string) string {
+	if p.CaseInsensitive {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// Validate checks name against the policy.
+func (p UsernamePolicy) Validate(name string) error {
+	n := utf8.RuneCountInString(name)
+	if n < p.MinLength || (p.MaxLength > 0 && n > p.MaxLength) {
+		return ErrUsernameLength
+	}
+	if p.Charset != nil && !p.Charset.MatchString(name) {
+		return ErrUsernameCharset
+	}
+	if p.Reserved[strings.ToLower(name)] {
+		return ErrUsernameReserved
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package users
+
+import "testing"
+
+func TestUsernamePolicyValidate(t *testing.T) {
+	p := DefaultUsernamePolicy()
+	cases := map[string]error{
+		"Eve_Berger":                        nil,
+		"user1":                             nil,
+		"ab":                                ErrUsernameLength,
+		"abcdefghijklmnopqrstuvwxyz0123456": ErrUsernameLength,
+		"eve berger":                        ErrUsernameCharset,
+		"Admin":                             ErrUsernameReserved,
+		"support":                           ErrUsernameReserved,
+	}
+	for name, want := range cases {
+		if err := p.Validate(name); err != want {
+			t.Errorf("Expected %v for %q, received %v", want, name, err)
+		}
+	}
+}
+
+func TestUsernamePolicyNormalize(t *testing.T) {
+	if n := DefaultUsernamePolicy().Normalize("Eve_Berger"); n != "eve_berger" {
+		t.Errorf("Expected lower case username, received %v", n)
+	}
+	p, err := NewUsernamePolicy(1, 0, `.*`, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Normalize("Eve_Berger"); n != "Eve_Berger" {
+		t.Errorf("Expected case to be kept, received %v", n)
+	}
+	if p.Validate("admin") != nil {
+		t.Error("Expected empty reserved list to allow admin")
+	}
+}
+
+func TestNewUsernamePolicyInvalidCharset(t *testing.T) {
+	if _, err := NewUsernamePolicy(1, 0, `[`, false, nil); err == nil {
+		t.Error("Expected invalid charset to be refused")
+	}
+}
+
+// FuzzUsernamePolicy checks that a username accepted by a policy is still
+// accepted, and identifies the same account, once normalized.
+func FuzzUsernamePolicy(f *testing.F) {
+	for _, name := range []string{"Eve_Berger", "ADMIN", "ab", "éve", "İstanbul", "ǅemal", "\xff"} {
+		f.Add(name)
+	}
+	unicode, _ := NewUsernamePolicy(3, 32, `^[\p{L}\p{N}._-]+$`, true, DefaultReservedUsernames)
+	policies := []UsernamePolicy{DefaultUsernamePolicy(), unicode}
+	f.Fuzz(func(t *testing.T, name string) {
+		for _, p := range policies {
+			if p.Validate(name) != nil {
+				continue
+			}
+			n := p.Normalize(name)
+			if err := p.Validate(n); err != nil {
+				t.Errorf("%q is valid but its normal form %q is not: %v", name, n, err)
+			}
+			if p.Normalize(n) != n {
+				t.Errorf("Normalizing %q twice gives %q", name, p.Normalize(n))
+			}
+		}
+	})
+}
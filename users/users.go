@@ -1,12 +1,13 @@
 package users
 
 import (
-	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"strconv"
+	"strings"
 	"time"
+
+	"github.com/mikesay/user/clock"
 )
 
 var (
@@ -20,11 +21,42 @@ type User struct {
 	Email     string    `json:"-" bson:"email"`
 	Username  string    `json:"username" bson:"username"`
 	Password  string    `json:"-" bson:"password,omitempty"`
-	Addresses []Address `json:"-,omitempty" bson:"-"`
-	Cards     []Card    `json:"-,omitempty" bson:"-"`
+	Addresses []Address `json:"-" bson:"-"`
+	Cards     []Card    `json:"-" bson:"-"`
 	UserID    string    `json:"id" bson:"-"`
-	Links     Links     `json:"_links"`
 	Salt      string    `json:"-" bson:"salt"`
+	CreatedAt time.Time `json:"createdAt,omitzero" bson:"createdAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitzero" bson:"updatedAt,omitempty"`
+	LastLogin time.Time `json:"lastLogin,omitzero" bson:"lastLogin,omitempty"`
+	// UsernameNormalized is Username as compared by the username policy.
+	UsernameNormalized string `json:"-" bson:"usernameNormalized,omitempty"`
+	// EmailNormalized is Email as returned by NormalizeEmail.
+	EmailNormalized string `json:"-" bson:"emailNormalized,omitempty"`
+	// Avatar is the blob key of the profile image, if one was uploaded.
+	Avatar string `json:"-" bson:"avatar,omitempty"`
+	// Residency is the region the user's data must be kept in, naming the
+	// database shard they are stored on.
+	Residency string `json:"residency,omitempty" bson:"residency,omitempty"`
+	// DateOfBirth is an optional date of the form YYYY-MM-DD, needed to
+	// buy age-restricted products.
+	DateOfBirth string `json:"dateOfBirth,omitempty" bson:"dateOfBirth,omitempty"`
+	// Tags group accounts for support, such as vip or fraud_review.
+	Tags []string `json:"tags,omitempty" bson:"tags,omitempty"`
+}
+
+// NormalizeEmail returns the form of an email address used to compare
+// addresses.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ValidateTag checks a tag is a short lowercase word, which may contain
+// digits, underscores and hyphens.
+func ValidateTag(tag string) error {
+	if !tagPattern.MatchString(tag) {
+		return ErrInvalidTag
+	}
+	return nil
 }
 
 func New() User {
@@ -35,16 +67,16 @@ func New() User {
 
 func (u *User) Validate() error {
 	if u.FirstName == "" {
-		return fmt.Errorf(ErrMissingField, "FirstName")
+		return NewError(CodeMissingField, fmt.Sprintf(ErrMissingField, "FirstName"))
 	}
 	if u.LastName == "" {
-		return fmt.Errorf(ErrMissingField, "LastName")
+		return NewError(CodeMissingField, fmt.Sprintf(ErrMissingField, "LastName"))
 	}
 	if u.Username == "" {
-		return fmt.Errorf(ErrMissingField, "Username")
+		return NewError(CodeMissingField, fmt.Sprintf(ErrMissingField, "Username"))
 	}
 	if u.Password == "" {
-		return fmt.Errorf(ErrMissingField, "Password")
+		return NewError(CodeMissingField, fmt.Sprintf(ErrMissingField, "Password"))
 	}
 	return nil
 }
@@ -56,12 +88,14 @@ func (u *User) MaskCCs() {
 	}
 }
 
-func (u *User) AddLinks() {
-	u.Links.AddCustomer(u.UserID)
+// NewSalt sets a new random salt.
+func (u *User) NewSalt() {
+	u.NewSaltFrom(nil)
 }
 
-func (u *User) NewSalt() {
-	h := sha1.New()
-	io.WriteString(h, strconv.Itoa(int(time.Now().UnixNano())))
-	u.Salt = fmt.Sprintf("%x", h.Sum(nil))
+// NewSaltFrom sets a new salt read from rng, or from clock.Random if rng is
+// nil. Salts are 20 bytes in hex, the length of the SHA-1 digests they once
+// were.
+func (u *User) NewSaltFrom(rng clock.RNG) {
+	u.Salt = hex.EncodeToString(clock.Bytes(rng, 20))
 }
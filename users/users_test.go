@@ -2,6 +2,7 @@ package users
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -52,3 +53,22 @@ func TestMaskCCs(t *testing.T) {
 		t.Error("Card two CC not masked")
 	}
 }
+
+func TestNormalizeEmail(t *testing.T) {
+	if e := NormalizeEmail(" Eve@Example.COM "); e != "eve@example.com" {
+		t.Errorf("Expected normalized email, received %v", e)
+	}
+}
+
+func TestValidateTag(t *testing.T) {
+	for _, tag := range []string{"vip", "fraud_review", "beta-2"} {
+		if err := ValidateTag(tag); err != nil {
+			t.Errorf("Expected %q to be accepted, received %v", tag, err)
+		}
+	}
+	for _, tag := range []string{"", "VIP", "a b", "a/b", strings.Repeat("x", 33)} {
+		if err := ValidateTag(tag); err != ErrInvalidTag {
+			t.Errorf("Expected %q to be refused, received %v", tag, err)
+		}
+	}
+}